@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package framework
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// DefaultThreshold is the slowdown, in percent of the baseline, above which a test regresses
+// unless Thresholds say otherwise.
+const DefaultThreshold = 10
+
+// Thresholds are the slowdowns, in percent of the baseline, above which tests regress.
+type Thresholds struct {
+	// Default applies to the tests which aren't in Tests. Defaults to DefaultThreshold.
+	Default float64
+	// Tests are the thresholds of specific tests by name.
+	Tests map[string]float64
+}
+
+func (t Thresholds) of(name string) float64 {
+	if threshold, ok := t.Tests[name]; ok {
+		return threshold
+	}
+	if t.Default == 0 {
+		return DefaultThreshold
+	}
+	return t.Default
+}
+
+// Change is the change of the median time of a test from the baseline.
+type Change struct {
+	TestName      string  `json:"testName"`
+	BaselinePct50 float64 `json:"baselinePct50"`
+	Pct50         float64 `json:"pct50"`
+	// Percent is the change in percent of the baseline. It's positive if the test is slower.
+	Percent   float64 `json:"percent"`
+	Threshold float64 `json:"threshold"`
+	Regressed bool    `json:"regressed"`
+}
+
+// Compare compares the median times of the tests of `current` with those of `baseline`, sorted
+// by test name. Tests which are missing from either run are skipped.
+func Compare(baseline, current *BenchmarkFramework, thresholds Thresholds) ([]Change, error) {
+	if len(baseline.Parameters) != 0 || len(current.Parameters) != 0 {
+		if !reflect.DeepEqual(baseline.Parameters, current.Parameters) {
+			return nil, fmt.Errorf("baseline was run with other parameters %v", baseline.Parameters)
+		}
+	}
+	baselineDrivers := make(map[string]BenchmarkTestDriver, len(baseline.Drivers))
+	for _, d := range baseline.Drivers {
+		baselineDrivers[d.TestName] = d
+	}
+	changes := []Change{}
+	for _, d := range current.Drivers {
+		b, ok := baselineDrivers[d.TestName]
+		if !ok || b.Pct50 <= 0 {
+			continue
+		}
+		c := Change{
+			TestName:      d.TestName,
+			BaselinePct50: b.Pct50,
+			Pct50:         d.Pct50,
+			Percent:       (d.Pct50 - b.Pct50) / b.Pct50 * 100,
+			Threshold:     thresholds.of(d.TestName),
+		}
+		c.Regressed = c.Percent > c.Threshold
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].TestName < changes[j].TestName })
+	return changes, nil
+}
+
+// Regressions returns the changes which regressed.
+func Regressions(changes []Change) []Change {
+	var regressions []Change
+	for _, c := range changes {
+		if c.Regressed {
+			regressions = append(regressions, c)
+		}
+	}
+	return regressions
+}
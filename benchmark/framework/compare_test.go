@@ -0,0 +1,90 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package framework
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	params := map[string]string{"files": "1"}
+	baseline := &BenchmarkFramework{Parameters: params, Drivers: []BenchmarkTestDriver{
+		{TestName: "fast", Pct50: 100},
+		{TestName: "slow", Pct50: 100},
+		{TestName: "noisy", Pct50: 100},
+		{TestName: "removed", Pct50: 100},
+	}}
+	current := &BenchmarkFramework{Parameters: params, Drivers: []BenchmarkTestDriver{
+		{TestName: "slow", Pct50: 120},
+		{TestName: "fast", Pct50: 50},
+		{TestName: "noisy", Pct50: 120},
+		{TestName: "added", Pct50: 100},
+	}}
+	changes, err := Compare(baseline, current, Thresholds{Tests: map[string]float64{"noisy": 25}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{TestName: "fast", BaselinePct50: 100, Pct50: 50, Percent: -50, Threshold: DefaultThreshold},
+		{TestName: "noisy", BaselinePct50: 100, Pct50: 120, Percent: 20, Threshold: 25},
+		{TestName: "slow", BaselinePct50: 100, Pct50: 120, Percent: 20, Threshold: DefaultThreshold, Regressed: true},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("unexpected change %d: got %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+	if regressions := Regressions(changes); len(regressions) != 1 || regressions[0].TestName != "slow" {
+		t.Fatalf("unexpected regressions: %+v", regressions)
+	}
+
+	changes, err = Compare(baseline, current, Thresholds{Default: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regressions := Regressions(changes); len(regressions) != 0 {
+		t.Fatalf("unexpected regressions with default threshold: %+v", regressions)
+	}
+
+	current.Parameters = map[string]string{"files": "2"}
+	if _, err := Compare(baseline, current, Thresholds{}); err == nil {
+		t.Fatal("compared runs with different parameters")
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	frame := &BenchmarkFramework{
+		OutputDir:  t.TempDir(),
+		CommitID:   "abc",
+		Parameters: map[string]string{"files": "1"},
+		Drivers:    []BenchmarkTestDriver{{TestName: "test", TestTimes: []float64{1, 2, 3}, Pct50: 2}},
+	}
+	if err := frame.WriteResults(); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadResults(filepath.Join(frame.OutputDir, resultFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.CommitID != "abc" || read.Parameters["files"] != "1" || len(read.Drivers) != 1 || read.Drivers[0].Pct50 != 2 {
+		t.Fatalf("unexpected results read back: %+v", read)
+	}
+}
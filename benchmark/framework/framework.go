@@ -36,9 +36,12 @@ var (
 )
 
 type BenchmarkFramework struct {
-	OutputDir string                `json:"-"`
-	CommitID  string                `json:"commit"`
-	Drivers   []BenchmarkTestDriver `json:"benchmarkTests"`
+	OutputDir string `json:"-"`
+	CommitID  string `json:"commit"`
+	// Parameters describe the inputs of the tests, e.g. the size of a generated layer.
+	// Results are only compared between runs with the same parameters.
+	Parameters map[string]string     `json:"parameters,omitempty"`
+	Drivers    []BenchmarkTestDriver `json:"benchmarkTests"`
 }
 
 type BenchmarkTestDriver struct {
@@ -59,10 +62,23 @@ type BenchmarkTestDriver struct {
 	Max            float64          `json:"max"`
 }
 
+// Run runs the tests of the drivers and writes their results to OutputDir.
+// It parses the command line flags of the testing package, e.g. -test.v.
 func (frame *BenchmarkFramework) Run(ctx context.Context) {
 	testing.Init()
 	flag.Set("test.benchtime", "1x")
 	flag.Parse()
+	frame.RunTests(ctx)
+	if err := frame.WriteResults(); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// RunTests runs the tests of the drivers without parsing the command line,
+// e.g. for commands with flags of their own.
+func (frame *BenchmarkFramework) RunTests(ctx context.Context) {
+	testing.Init()
+	flag.Set("test.benchtime", "1x")
 	for i := 0; i < len(frame.Drivers); i++ {
 		testDriver := &frame.Drivers[i]
 		fmt.Printf("Running tests for %s\n", testDriver.TestName)
@@ -84,20 +100,37 @@ func (frame *BenchmarkFramework) Run(ctx context.Context) {
 
 		}
 	}
+}
 
+// WriteResults writes the results of the tests to results.json in OutputDir.
+func (frame *BenchmarkFramework) WriteResults() error {
 	json, err := json.MarshalIndent(frame, "", " ")
 	if err != nil {
-		fmt.Printf("JSON Marshalling Error: %v\n", err)
+		return fmt.Errorf("failed to marshal results: %w", err)
 	}
 	err = os.MkdirAll(frame.OutputDir, resultFilePerm)
 	if err != nil {
-		fmt.Printf("Failed to Create Output Dir: %v\n", err)
+		return fmt.Errorf("failed to create output dir: %w", err)
 	}
 	resultFileLoc := frame.OutputDir + "/" + resultFilename
 	err = os.WriteFile(resultFileLoc, json, resultFilePerm)
 	if err != nil {
-		fmt.Printf("WriteFile Error: %v\n", err)
+		return fmt.Errorf("failed to write results: %w", err)
+	}
+	return nil
+}
+
+// ReadResults reads the results written by WriteResults to `path`, e.g. to compare them with a later run.
+func ReadResults(path string) (*BenchmarkFramework, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results: %w", err)
+	}
+	var frame BenchmarkFramework
+	if err := json.Unmarshal(b, &frame); err != nil {
+		return nil, fmt.Errorf("failed to parse results %s: %w", path, err)
 	}
+	return &frame, nil
 }
 
 func (driver *BenchmarkTestDriver) calculateStats() {
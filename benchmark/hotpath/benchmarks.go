@@ -0,0 +1,247 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hotpath
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/reader"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// filesPerDir is the number of files in each directory of the generated layer.
+	filesPerDir = 32
+	// readSize is the size of the reads of the file read benchmark, the maximum size of FUSE reads.
+	readSize = 128 << 10
+	// seed makes the generated layer the same on every run.
+	seed = 1
+)
+
+// Default returns the benchmarks of the hot paths of the snapshotter:
+//
+//   - ztoc-build builds the zTOC of the layer, as `soci create` does.
+//   - metadata-import imports the zTOC into the metadata store, as mounting the layer does.
+//   - span-fetch fetches, verifies and decompresses all the spans of the layer into an empty cache.
+//   - file-read reads all the files of the layer from cached spans in reads of the size of FUSE reads,
+//     as the FUSE read handlers do, without the round trip through the kernel.
+func Default() []Benchmark {
+	return []Benchmark{
+		{Name: "ztoc-build", Setup: setupZtocBuild},
+		{Name: "metadata-import", Setup: setupMetadataImport},
+		{Name: "span-fetch", Setup: setupSpanFetch},
+		{Name: "file-read", Setup: setupFileRead},
+	}
+}
+
+// Layer is the layer the benchmarks run on: a gzip-compressed tar of text-like files,
+// which is generated from a fixed seed so that runs are comparable.
+type Layer struct {
+	// Dir is a directory the benchmarks can write their inputs to.
+	Dir string
+	// Path is the path of the compressed layer, and Blob its contents.
+	Path string
+	Blob []byte
+	// Ztoc is the zTOC of the layer.
+	Ztoc     *ztoc.Ztoc
+	SpanSize int64
+	// Files are the paths of the regular files of the layer.
+	Files []string
+}
+
+func generateLayer(dir string, files, fileSize int, spanSize int64) (*Layer, error) {
+	l := &Layer{Dir: dir, Path: filepath.Join(dir, "layer.tar.gz"), SpanSize: spanSize}
+	rnd := rand.New(rand.NewSource(seed))
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for i := 0; i < files; i++ {
+		if i%filesPerDir == 0 {
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: fmt.Sprintf("dir%04d/", i/filesPerDir), Mode: 0755}); err != nil {
+				return nil, err
+			}
+		}
+		name := fmt.Sprintf("dir%04d/file%04d", i/filesPerDir, i%filesPerDir)
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(fileSize)}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(textData(rnd, fileSize)); err != nil {
+			return nil, err
+		}
+		l.Files = append(l.Files, name)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	l.Blob = buf.Bytes()
+	if err := os.WriteFile(l.Path, l.Blob, 0600); err != nil {
+		return nil, err
+	}
+	zt, err := ztoc.NewBuilder("soci-bench").BuildZtoc(l.Path, spanSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build ztoc: %w", err)
+	}
+	l.Ztoc = zt
+	return l, nil
+}
+
+// textData returns `size` bytes of text-like data, so that decompressing
+// the layer costs about as much as decompressing real layers.
+func textData(rnd *rand.Rand, size int) []byte {
+	words := []string{"soci ", "snapshotter ", "span ", "layer ", "ztoc ", "lazy ", "loading ", "\n"}
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(words[rnd.Intn(len(words))])
+	}
+	return buf.Bytes()[:size]
+}
+
+func (l *Layer) sectionReader() *io.SectionReader {
+	return io.NewSectionReader(bytes.NewReader(l.Blob), 0, int64(len(l.Blob)))
+}
+
+func setupZtocBuild(_ context.Context, l *Layer) (*Op, error) {
+	return &Op{
+		Run: func() error {
+			_, err := ztoc.NewBuilder("soci-bench").BuildZtoc(l.Path, l.SpanSize)
+			return err
+		},
+	}, nil
+}
+
+func openMetadataDB(l *Layer, name string) (*bolt.DB, error) {
+	db, err := bolt.Open(filepath.Join(l.Dir, name), 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata db: %w", err)
+	}
+	return db, nil
+}
+
+func setupMetadataImport(_ context.Context, l *Layer) (*Op, error) {
+	db, err := openMetadataDB(l, "metadata-import.db")
+	if err != nil {
+		return nil, err
+	}
+	sr := l.sectionReader()
+	return &Op{
+		Run: func() error {
+			r, err := metadata.NewReader(db, sr, l.Ztoc.TOC)
+			if err != nil {
+				return err
+			}
+			return r.Close()
+		},
+		Close: db.Close,
+	}, nil
+}
+
+func setupSpanFetch(_ context.Context, l *Layer) (*Op, error) {
+	sr := l.sectionReader()
+	return &Op{
+		Run: func() error {
+			c := cache.NewMemoryCache()
+			defer c.Close()
+			m := spanmanager.New(l.Ztoc, sr, c, 0)
+			r, err := m.GetContents(0, l.Ztoc.UncompressedArchiveSize)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(io.Discard, r)
+			return err
+		},
+	}, nil
+}
+
+func setupFileRead(_ context.Context, l *Layer) (*Op, error) {
+	db, err := openMetadataDB(l, "file-read.db")
+	if err != nil {
+		return nil, err
+	}
+	sr := l.sectionReader()
+	mr, err := metadata.NewReader(db, sr, l.Ztoc.TOC)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := cache.NewMemoryCache()
+	vr, err := reader.NewReader(mr, digest.FromBytes(l.Blob), spanmanager.New(l.Ztoc, sr, c, 0))
+	if err != nil {
+		c.Close()
+		db.Close()
+		return nil, err
+	}
+	r := vr.SkipVerify()
+	closeAll := func() error {
+		vr.Close()
+		c.Close()
+		return db.Close()
+	}
+
+	type file struct {
+		id   uint32
+		size int64
+	}
+	var files []file
+	for _, name := range l.Files {
+		dirID, _, err := mr.GetChild(mr.RootID(), path.Dir(name))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		id, attr, err := mr.GetChild(dirID, path.Base(name))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, file{id: id, size: attr.Size})
+	}
+	buf := make([]byte, readSize)
+	return &Op{
+		Run: func() error {
+			for _, f := range files {
+				ra, err := r.OpenFile(f.id)
+				if err != nil {
+					return err
+				}
+				for off := int64(0); off < f.size; off += readSize {
+					if _, err := ra.ReadAt(buf, off); err != nil && err != io.EOF {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Close: closeAll,
+	}, nil
+}
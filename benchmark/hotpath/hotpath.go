@@ -0,0 +1,165 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package hotpath benchmarks the hot paths of the snapshotter on a generated layer with the
+// benchmark framework, so that performance changes can be measured on the hardware the
+// snapshotter runs on and compared against the results of a previous run.
+package hotpath
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/benchmark/framework"
+)
+
+const (
+	defaultCount    = 10
+	defaultFiles    = 1024
+	defaultFileSize = 32 << 10 // 32 KiB
+	defaultSpanSize = 1 << 20  // 1 MiB
+)
+
+// Benchmark is a benchmark of an operation of the snapshotter.
+type Benchmark struct {
+	// Name identifies the benchmark in the results.
+	Name string
+
+	// Setup prepares the inputs of the operation from the generated layer `l`, and returns
+	// the operation. Only the operation is measured.
+	Setup func(ctx context.Context, l *Layer) (*Op, error)
+}
+
+// Op is a benchmarked operation.
+type Op struct {
+	// Run runs the operation once.
+	Run func() error
+
+	// Close releases the inputs of the operation, if set.
+	Close func() error
+}
+
+// Options configures the benchmarks.
+type Options struct {
+	// Count is the number of times each benchmark runs. Defaults to 10.
+	Count int
+
+	// Filter selects the benchmarks which run by name. All of them run if nil.
+	Filter *regexp.Regexp
+
+	// Files and FileSize are the number and size of the files of the generated layer.
+	// They default to 1024 files of 32KiB.
+	Files    int
+	FileSize int
+
+	// SpanSize is the span size of the zTOC of the generated layer. Defaults to 1MiB.
+	SpanSize int64
+
+	// Dir is the directory the inputs are generated in. Defaults to a temporary directory.
+	Dir string
+}
+
+func (o *Options) setDefaults() {
+	if o.Count <= 0 {
+		o.Count = defaultCount
+	}
+	if o.Files <= 0 {
+		o.Files = defaultFiles
+	}
+	if o.FileSize <= 0 {
+		o.FileSize = defaultFileSize
+	}
+	if o.SpanSize <= 0 {
+		o.SpanSize = defaultSpanSize
+	}
+}
+
+// Run generates a layer and runs `benchmarks` on it in order with the benchmark framework.
+// The returned framework holds the results, with the parameters of the layer, which must be
+// the same for results to be compared.
+func Run(ctx context.Context, benchmarks []Benchmark, opts Options) (*framework.BenchmarkFramework, error) {
+	opts.setDefaults()
+	dir, err := os.MkdirTemp(opts.Dir, "soci-bench-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create benchmark directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := generateLayer(dir, opts.Files, opts.FileSize, opts.SpanSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate layer: %w", err)
+	}
+
+	frame := &framework.BenchmarkFramework{
+		Parameters: map[string]string{
+			"files":    strconv.Itoa(opts.Files),
+			"fileSize": strconv.Itoa(opts.FileSize),
+			"spanSize": strconv.FormatInt(opts.SpanSize, 10),
+		},
+	}
+	// runErr is the first error of the benchmarks. The benchmarks which run after it are skipped.
+	var runErr error
+	for _, b := range benchmarks {
+		if opts.Filter != nil && !opts.Filter.MatchString(b.Name) {
+			continue
+		}
+		b := b
+		var op *Op
+		frame.Drivers = append(frame.Drivers, framework.BenchmarkTestDriver{
+			TestName:      b.Name,
+			NumberOfTests: opts.Count,
+			BeforeFunction: func() {
+				if runErr == nil {
+					runErr = ctx.Err()
+				}
+				if runErr != nil {
+					return
+				}
+				var err error
+				op, err = b.Setup(ctx, l)
+				if err != nil {
+					runErr = fmt.Errorf("benchmark %s failed to set up: %w", b.Name, err)
+					return
+				}
+				// Warm up, e.g. so that lazily initialized state isn't measured.
+				if err := op.Run(); err != nil {
+					runErr = fmt.Errorf("benchmark %s failed: %w", b.Name, err)
+				}
+			},
+			TestFunction: func(tb *testing.B) {
+				for i := 0; i < tb.N && runErr == nil; i++ {
+					if err := op.Run(); err != nil {
+						runErr = fmt.Errorf("benchmark %s failed: %w", b.Name, err)
+					}
+				}
+			},
+			AfterFunction: func() error {
+				if op == nil || op.Close == nil {
+					return nil
+				}
+				return op.Close()
+			},
+		})
+	}
+	frame.RunTests(ctx)
+	if runErr != nil {
+		return nil, runErr
+	}
+	return frame, nil
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hotpath
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	opts := Options{Count: 3, Files: 40, FileSize: 3000, SpanSize: 16 << 10, Dir: t.TempDir()}
+	frame, err := Run(context.Background(), Default(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"files": "40", "fileSize": "3000", "spanSize": "16384"}
+	if !reflect.DeepEqual(frame.Parameters, want) {
+		t.Fatalf("unexpected parameters %v; want %v", frame.Parameters, want)
+	}
+	if len(frame.Drivers) != len(Default()) {
+		t.Fatalf("unexpected number of results: %d", len(frame.Drivers))
+	}
+	for i, d := range frame.Drivers {
+		if d.TestName != Default()[i].Name {
+			t.Fatalf("unexpected result %d: %s", i, d.TestName)
+		}
+		if len(d.TestTimes) != 3 || d.Pct50 <= 0 {
+			t.Fatalf("unexpected result of %s: %+v", d.TestName, d)
+		}
+	}
+
+	opts.Filter = regexp.MustCompile("^span-")
+	frame, err = Run(context.Background(), Default(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Drivers) != 1 || frame.Drivers[0].TestName != "span-fetch" {
+		t.Fatalf("filter was not applied: %+v", frame.Drivers)
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	errOp := errors.New("op failed")
+	benchmarks := []Benchmark{{
+		Name: "failing",
+		Setup: func(context.Context, *Layer) (*Op, error) {
+			return &Op{Run: func() error { return errOp }}, nil
+		},
+	}}
+	_, err := Run(context.Background(), benchmarks, Options{Count: 1, Files: 1, FileSize: 10, Dir: t.TempDir()})
+	if !errors.Is(err, errOp) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -48,6 +48,7 @@ import (
 const (
 	defaultMaxLRUCacheEntry = 10
 	defaultMaxCacheFds      = 10
+	defaultMaxMmaps         = 64
 )
 
 type DirectoryCacheConfig struct {
@@ -77,6 +78,18 @@ type DirectoryCacheConfig struct {
 	// Direct forcefully enables direct mode for all operation in cache.
 	// Thus operation won't use on-memory caches.
 	Direct bool
+
+	// Mmap serves reads of cached files from read-only memory mappings instead of
+	// reading them into buffers. It applies to direct mode too.
+	Mmap bool
+
+	// Number of memory mappings to cache (default: 64).
+	// This is only used when Mmap is enabled.
+	MaxMmaps int
+
+	// Persistent keeps the cache directory when the cache is closed,
+	// so that the cached data can be reused after a restart.
+	Persistent bool
 }
 
 // TODO: contents validation.
@@ -94,6 +107,14 @@ type BlobCache interface {
 	Close() error
 }
 
+// Remover is implemented by caches whose contents can be removed, e.g. to demote
+// the cached data of idle layers.
+type Remover interface {
+	// Remove removes the contents of key from the cache. Readers of the contents which
+	// are still open can keep reading them. Removing missing contents is not an error.
+	Remove(key string) error
+}
+
 // Reader provides the data cached.
 type Reader interface {
 	io.ReaderAt
@@ -165,19 +186,41 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		return nil, err
 	}
 	wipdir := filepath.Join(directory, "wip")
+	if config.Persistent {
+		// Writes which were in progress when the cache was last used are never committed.
+		if err := os.RemoveAll(wipdir); err != nil {
+			return nil, err
+		}
+	}
 	if err := os.MkdirAll(wipdir, 0700); err != nil {
 		return nil, err
 	}
+	var mmapCache *lrucache.Cache
+	if config.Mmap {
+		maxEntry := config.MaxMmaps
+		if maxEntry == 0 {
+			maxEntry = defaultMaxMmaps
+		}
+		mmapCache = lrucache.New(maxEntry)
+		mmapCache.OnEvicted = func(key string, value interface{}) {
+			munmap(value.([]byte))
+		}
+	}
 	dc := &directoryCache{
 		cache:        dataCache,
+		mmapCache:    mmapCache,
 		fileCache:    fdCache,
 		wipLock:      new(namedmutex.NamedMutex),
 		directory:    directory,
 		wipDirectory: wipdir,
 		bufPool:      bufPool,
 		direct:       config.Direct,
+		persistent:   config.Persistent,
 	}
 	dc.syncAdd = config.SyncAdd
+	if err := dc.loadPack(); err != nil {
+		return nil, fmt.Errorf("failed to load packed contents of %q: %w", directory, err)
+	}
 	return dc, nil
 }
 
@@ -185,17 +228,28 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 type directoryCache struct {
 	cache        *lrucache.Cache
 	fileCache    *lrucache.Cache
+	mmapCache    *lrucache.Cache // nil unless reads are served from memory mappings
 	wipDirectory string
 	directory    string
 	wipLock      *namedmutex.NamedMutex
 
 	bufPool *sync.Pool
 
-	syncAdd bool
-	direct  bool
+	syncAdd    bool
+	direct     bool
+	persistent bool
 
 	closed   bool
 	closedMu sync.Mutex
+
+	// pack locates the contents packed by Compact, nil if there are none. packDirty is whether
+	// contents were removed from it since its index was written. They are guarded by packMu.
+	pack      *packIndex
+	packDirty bool
+	// packRemoved is the log of the contents removed from the pack, opened on first removal.
+	packRemoved *os.File
+	packMu      sync.RWMutex
+	compactMu   sync.Mutex // held by Compact
 }
 
 func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
@@ -232,11 +286,18 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 		}
 	}
 
+	if dc.mmapCache != nil {
+		return dc.getMapped(key)
+	}
+
 	// Open the cache file and read the target region
 	// TODO: If the target cache is write-in-progress, should we wait for the completion
 	//       or simply report the cache miss?
 	file, err := os.Open(dc.cachePath(key))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return dc.getPacked(key)
+		}
 		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, err)
 	}
 
@@ -266,6 +327,33 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	}, nil
 }
 
+// getMapped returns a reader of the memory mapping of the cache file.
+// Mappings are shared by readers and unmapped once they are evicted and no reader uses them.
+func (dc *directoryCache) getMapped(key string) (Reader, error) {
+	m, done, ok := dc.mmapCache.Get(key)
+	if !ok {
+		b, err := mmapFile(dc.cachePath(key))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return dc.getPacked(key)
+			}
+			return nil, fmt.Errorf("failed to map blob file for %q: %w", key, err)
+		}
+		var added bool
+		m, done, added = dc.mmapCache.Add(key, b)
+		if !added {
+			munmap(b) // mapping already exists in the cache. unmap it.
+		}
+	}
+	return &reader{
+		ReaderAt: bytes.NewReader(m.([]byte)),
+		closeFunc: func() error {
+			done()
+			return nil
+		},
+	}, nil
+}
+
 func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if dc.isClosed() {
 		return nil, fmt.Errorf("cache is already closed")
@@ -296,6 +384,9 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 				return multierror.Append(allErr,
 					fmt.Errorf("failed to create cache directory %q: %w", c, err))
 			}
+			// The contents aren't replaced while they are being packed.
+			dc.packMu.RLock()
+			defer dc.packMu.RUnlock()
 			return os.Rename(wip.Name(), c)
 		},
 		abortFunc: func() error {
@@ -365,9 +456,43 @@ func (dc *directoryCache) Close() error {
 		return nil
 	}
 	dc.closed = true
+	if dc.mmapCache != nil {
+		// Mappings which are still read are unmapped once their readers are closed.
+		dc.mmapCache.Clear()
+	}
+	if dc.persistent {
+		dc.packMu.Lock()
+		defer dc.packMu.Unlock()
+		if dc.packDirty {
+			return dc.commitPackIndex(dc.pack)
+		}
+		return nil
+	}
 	return os.RemoveAll(dc.directory)
 }
 
+// Remove implements Remover. Contents which are still being added asynchronously
+// (i.e. without SyncAdd or Direct) may be cached again once they are committed.
+func (dc *directoryCache) Remove(key string) error {
+	if dc.isClosed() {
+		return fmt.Errorf("cache is already closed")
+	}
+	dc.cache.Remove(key)
+	dc.fileCache.Remove(key)
+	if dc.mmapCache != nil {
+		dc.mmapCache.Remove(key)
+	}
+	dc.packMu.Lock()
+	defer dc.packMu.Unlock()
+	if err := dc.removePacked(key); err != nil {
+		return err
+	}
+	if err := os.Remove(dc.cachePath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (dc *directoryCache) isClosed() bool {
 	dc.closedMu.Lock()
 	closed := dc.closed
@@ -419,6 +544,14 @@ func (mc *MemoryCache) Add(key string, opts ...Option) (Writer, error) {
 	}, nil
 }
 
+// Remove implements Remover.
+func (mc *MemoryCache) Remove(key string) error {
+	mc.mu.Lock()
+	delete(mc.Membuf, key)
+	mc.mu.Unlock()
+	return nil
+}
+
 func (mc *MemoryCache) Close() error {
 	return nil
 }
@@ -42,6 +42,8 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -78,6 +80,238 @@ func TestDirectoryCache(t *testing.T) {
 		return c
 	}
 	testCache(t, "dir-with-small-mem", newCache)
+
+	// with memory mappings
+	newCache = func(t *testing.T) BlobCache {
+		tmp := t.TempDir()
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd: true,
+			Direct:  true,
+			Mmap:    true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	testCache(t, "dir-with-mmap", newCache)
+}
+
+// BenchmarkDirectoryCacheGet compares reading a cached span with pread
+// and with memory mappings, the way FUSE reads of a hot layer do.
+func BenchmarkDirectoryCacheGet(b *testing.B) {
+	const (
+		blobSize = 4 << 20   // default span size
+		readSize = 128 << 10 // maximum FUSE read size
+	)
+	blob := make([]byte, blobSize)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			c, err := NewDirectoryCache(b.TempDir(), DirectoryCacheConfig{
+				SyncAdd: true,
+				Direct:  true,
+				Mmap:    mmap,
+			})
+			if err != nil {
+				b.Fatalf("failed to make cache: %v", err)
+			}
+			defer c.Close()
+			w, err := c.Add("span")
+			if err != nil {
+				b.Fatalf("failed to add blob: %v", err)
+			}
+			if _, err := w.Write(blob); err != nil {
+				b.Fatalf("failed to write blob: %v", err)
+			}
+			if err := w.Commit(); err != nil {
+				b.Fatalf("failed to commit blob: %v", err)
+			}
+			w.Close()
+
+			p := make([]byte, readSize)
+			b.SetBytes(readSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := c.Get("span")
+				if err != nil {
+					b.Fatalf("failed to get blob: %v", err)
+				}
+				if _, err := r.ReadAt(p, int64(i*readSize%blobSize)); err != nil && err != io.EOF {
+					b.Fatalf("failed to read blob: %v", err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestPersistentDirectoryCache(t *testing.T) {
+	tmp := t.TempDir()
+	newCache := func() BlobCache {
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd:    true,
+			Persistent: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c
+	}
+
+	c := newCache()
+	d := digestFor(sampleData)
+	w, err := c.Add(d)
+	if err != nil {
+		t.Fatalf("failed to add %v: %v", d, err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write %v: %v", d, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %v: %v", d, err)
+	}
+	w.Close()
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	// The data must survive closing the cache.
+	c = newCache()
+	defer c.Close()
+	hit(sampleData)(t, c)
+}
+
+func TestDirectoryCacheCompact(t *testing.T) {
+	tmp := t.TempDir()
+	newCache := func(mmap bool) BlobCache {
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd:    true,
+			Direct:     true,
+			Mmap:       mmap,
+			Persistent: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c
+	}
+	blobs := []string{sampleData, "test", "", "0123"}
+
+	c := newCache(false)
+	for _, blob := range blobs {
+		add(blob)(t, c)
+	}
+	compact(len(blobs)+1, 0)(t, c)
+	compact(len(blobs), len(blobs))(t, c)
+	for _, blob := range blobs {
+		hit(blob)(t, c)
+	}
+	checkFiles(t, tmp, 0)
+
+	// Contents added or removed after they were packed replace the packed contents.
+	remove("test")(t, c)
+	miss("test")(t, c)
+	add("abcdef")(t, c)
+	hit("abcdef")(t, c)
+	compact(1, 1)(t, c)
+	checkFiles(t, tmp, 0)
+	for _, blob := range []string{sampleData, "", "0123", "abcdef"} {
+		hit(blob)(t, c)
+	}
+	miss("test")(t, c)
+	remove("0123")(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	// The packed contents survive closing the cache, and so do their removals.
+	c = newCache(true)
+	defer c.Close()
+	for _, blob := range []string{sampleData, "", "abcdef"} {
+		hit(blob)(t, c)
+	}
+	miss("test")(t, c)
+	miss("0123")(t, c)
+	packs, err := os.ReadDir(filepath.Join(tmp, packDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 2 {
+		t.Fatalf("unexpected files in the pack directory: %v", packs)
+	}
+}
+
+func TestDirectoryCachePackRemovals(t *testing.T) {
+	tmp := t.TempDir()
+	newCache := func() BlobCache {
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd:    true,
+			Direct:     true,
+			Persistent: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c
+	}
+	packSize := func(c BlobCache) int64 {
+		t.Helper()
+		dc := c.(*directoryCache)
+		info, err := os.Stat(filepath.Join(dc.packDirectory(), dc.pack.Pack))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	blobs := []string{sampleData, "test", "0123"}
+
+	c := newCache()
+	for _, blob := range blobs {
+		add(blob)(t, c)
+	}
+	compact(len(blobs), len(blobs))(t, c)
+	remove("test")(t, c)
+
+	// The removal survives a crash, i.e. the cache isn't closed.
+	c = newCache()
+	defer c.Close()
+	miss("test")(t, c)
+	hit(sampleData)(t, c)
+	hit("0123")(t, c)
+
+	// The pack is only rewritten once removed contents take at least half of it.
+	before := packSize(c)
+	compact(len(blobs), 0)(t, c)
+	if size := packSize(c); size != before {
+		t.Fatalf("pack was rewritten while most of it is live; size = %d, expected = %d", size, before)
+	}
+	remove(sampleData)(t, c)
+	compact(len(blobs), 0)(t, c)
+	if size := packSize(c); size != int64(len("0123")) {
+		t.Fatalf("removed contents weren't dropped from the pack; size = %d", size)
+	}
+	hit("0123")(t, c)
+	miss(sampleData)(t, c)
+	if _, err := os.Stat(filepath.Join(tmp, packDirName, packRemovedName)); !os.IsNotExist(err) {
+		t.Fatalf("log of removed contents wasn't cleared once the index was written: %v", err)
+	}
+}
+
+// checkFiles checks that the cache directory `dir` holds `n` contents in files of their own.
+func checkFiles(t *testing.T, dir string, n int) {
+	t.Helper()
+	dc := &directoryCache{directory: dir, wipDirectory: filepath.Join(dir, "wip")}
+	loose, err := dc.looseFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loose) != n {
+		t.Fatalf("unexpected number of files in the cache directory; expected = %d, got = %d", n, len(loose))
+	}
 }
 
 func TestMemoryCache(t *testing.T) {
@@ -121,6 +355,19 @@ func testCache(t *testing.T, name string, newCache func(t *testing.T) BlobCache)
 				miss("dummy"),
 			},
 		},
+		{
+			name: "removed_data",
+			blobs: []string{
+				sampleData,
+				"test",
+			},
+			checks: []check{
+				hit(sampleData),
+				remove(sampleData),
+				miss(sampleData),
+				hit("test"),
+			},
+		},
 		{
 			name: "dup_data",
 			blobs: []string{
@@ -206,3 +453,41 @@ func miss(sample string) check {
 		}
 	}
 }
+
+func add(sample string) check {
+	return func(t *testing.T, c BlobCache) {
+		d := digestFor(sample)
+		w, err := c.Add(d)
+		if err != nil {
+			t.Fatalf("failed to add %v: %v", d, err)
+		}
+		defer w.Close()
+		if _, err := w.Write([]byte(sample)); err != nil {
+			t.Fatalf("failed to write %v: %v", d, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %v: %v", d, err)
+		}
+	}
+}
+
+func compact(minFiles, want int) check {
+	return func(t *testing.T, c BlobCache) {
+		n, err := c.(Compactor).Compact(minFiles)
+		if err != nil {
+			t.Fatalf("failed to compact: %v", err)
+		}
+		if n != want {
+			t.Fatalf("unexpected number of packed contents; expected = %d, got = %d", want, n)
+		}
+	}
+}
+
+func remove(sample string) check {
+	return func(t *testing.T, c BlobCache) {
+		d := digestFor(sample)
+		if err := c.(Remover).Remove(d); err != nil {
+			t.Errorf("failed to remove %q: %v", d, err)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	packDirName   = "packs"
+	packIndexName = "index.json"
+	packPrefix    = "pack-"
+	// packRemovedName is the name of the log of the contents removed from the pack since
+	// its index was written, one key per line, so that they aren't restored after a crash.
+	packRemovedName = "removed.log"
+)
+
+// Compactor is implemented by caches which can pack their contents into fewer files,
+// e.g. so that caches holding many small contents don't use an inode per content.
+type Compactor interface {
+	// Compact packs the contents of the cache into a single file if at least `minFiles` of them
+	// are stored in files of their own, or if removed contents take at least half of the pack,
+	// and returns the number of contents packed from their own files. Readers of the contents
+	// which are still open can keep reading them. Compact may run concurrently with the other
+	// methods of the cache.
+	Compact(minFiles int) (int, error)
+}
+
+// packIndex locates the packed contents in the pack file.
+type packIndex struct {
+	// Pack is the name of the pack file in the pack directory.
+	Pack    string               `json:"pack"`
+	Entries map[string]packEntry `json:"entries"`
+}
+
+type packEntry struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// looseFile is a content of the cache stored in a file of its own.
+type looseFile struct {
+	key  string
+	info fs.FileInfo
+}
+
+// Compact implements Compactor. Contents are looked up in their own files before the pack,
+// so that contents added after they were packed replace the packed ones. Packed contents
+// which are removed are dropped from the pack file by the next compaction, which rewrites
+// the live contents of the pack. Until then, persistent caches log their removal.
+func (dc *directoryCache) Compact(minFiles int) (int, error) {
+	if dc.isClosed() {
+		return 0, fmt.Errorf("cache is already closed")
+	}
+	dc.compactMu.Lock()
+	defer dc.compactMu.Unlock()
+
+	loose, err := dc.looseFiles()
+	if err != nil {
+		return 0, err
+	}
+	if (len(loose) == 0 || len(loose) < minFiles) && !dc.packMostlyRemoved() {
+		return 0, nil
+	}
+	// The entries of the current pack are copied, since Remove deletes them concurrently.
+	var old *packIndex
+	dc.packMu.RLock()
+	if dc.pack != nil {
+		old = &packIndex{Pack: dc.pack.Pack, Entries: make(map[string]packEntry, len(dc.pack.Entries))}
+		for key, e := range dc.pack.Entries {
+			old.Entries[key] = e
+		}
+	}
+	dc.packMu.RUnlock()
+
+	// Write the new pack: the contents of the current pack followed by the loose files.
+	// They are copied without holding packMu, and those which are removed or replaced
+	// in the meantime are left out of the index below.
+	if err := os.MkdirAll(dc.packDirectory(), 0700); err != nil {
+		return 0, err
+	}
+	packFile, err := os.CreateTemp(dc.packDirectory(), packPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	packPath := packFile.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			packFile.Close()
+			os.Remove(packPath)
+		}
+	}()
+	next := &packIndex{
+		Pack:    filepath.Base(packPath),
+		Entries: make(map[string]packEntry),
+	}
+	var offset int64
+	if old != nil {
+		oldPack, err := os.Open(filepath.Join(dc.packDirectory(), old.Pack))
+		if err != nil {
+			return 0, err
+		}
+		defer oldPack.Close()
+		for key, e := range old.Entries {
+			if _, err := io.Copy(packFile, io.NewSectionReader(oldPack, e.Offset, e.Size)); err != nil {
+				return 0, fmt.Errorf("failed to copy packed %q: %w", key, err)
+			}
+			next.Entries[key] = packEntry{Offset: offset, Size: e.Size}
+			offset += e.Size
+		}
+	}
+	for _, l := range loose {
+		n, err := copyFile(packFile, dc.cachePath(l.key))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed in the meantime
+			}
+			return 0, fmt.Errorf("failed to pack %q: %w", l.key, err)
+		}
+		next.Entries[l.key] = packEntry{Offset: offset, Size: n}
+		offset += n
+	}
+	if err := packFile.Sync(); err != nil {
+		return 0, err
+	}
+	if err := packFile.Close(); err != nil {
+		return 0, err
+	}
+
+	// Switch to the new pack. Removes and commits wait for the switch, so that contents
+	// which are removed or replaced while they are packed are dropped from the new index.
+	dc.packMu.Lock()
+	defer dc.packMu.Unlock()
+	packed := make(map[string]bool)
+	for _, l := range loose {
+		if _, ok := next.Entries[l.key]; !ok {
+			continue
+		}
+		info, err := os.Stat(dc.cachePath(l.key))
+		if err != nil || !os.SameFile(info, l.info) {
+			delete(next.Entries, l.key) // removed or replaced in the meantime
+			continue
+		}
+		packed[l.key] = true
+	}
+	if old != nil {
+		for key := range old.Entries {
+			if _, ok := dc.pack.Entries[key]; !ok && !packed[key] {
+				delete(next.Entries, key) // removed from the pack in the meantime
+			}
+		}
+	}
+	if err := dc.commitPackIndex(next); err != nil {
+		return 0, err
+	}
+	committed = true
+	dc.pack = next
+	dc.packDirty = false
+	for key := range packed {
+		if err := os.Remove(dc.cachePath(key)); err != nil && !os.IsNotExist(err) {
+			return len(packed), err
+		}
+	}
+	if old != nil {
+		// Readers of the old pack can keep reading it until they are closed.
+		dc.fileCache.Remove(packCacheKey(old.Pack))
+		if err := os.Remove(filepath.Join(dc.packDirectory(), old.Pack)); err != nil && !os.IsNotExist(err) {
+			return len(packed), err
+		}
+	}
+	return len(packed), nil
+}
+
+// packMostlyRemoved returns whether removed contents take at least half of the pack file,
+// so that it's worth rewriting it without them.
+func (dc *directoryCache) packMostlyRemoved() bool {
+	dc.packMu.RLock()
+	defer dc.packMu.RUnlock()
+	if dc.pack == nil {
+		return false
+	}
+	var live int64
+	for _, e := range dc.pack.Entries {
+		live += e.Size
+	}
+	info, err := os.Stat(filepath.Join(dc.packDirectory(), dc.pack.Pack))
+	if err != nil {
+		return false
+	}
+	removed := info.Size() - live
+	return removed > 0 && removed >= live
+}
+
+// looseFiles returns the contents of the cache stored in files of their own.
+func (dc *directoryCache) looseFiles() ([]looseFile, error) {
+	var loose []looseFile
+	err := filepath.WalkDir(dc.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == dc.wipDirectory || path == dc.packDirectory() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		key, err := filepath.Rel(dc.directory, path)
+		if err != nil {
+			return err
+		}
+		loose = append(loose, looseFile{key: key, info: info})
+		return nil
+	})
+	return loose, err
+}
+
+// getPacked returns a reader of the packed contents of key.
+func (dc *directoryCache) getPacked(key string) (Reader, error) {
+	dc.packMu.RLock()
+	pack := dc.pack
+	var (
+		e  packEntry
+		ok bool
+	)
+	if pack != nil {
+		e, ok = pack.Entries[key]
+	}
+	dc.packMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, os.ErrNotExist)
+	}
+	// The pack file is shared by the readers of the packed contents.
+	cacheKey := packCacheKey(pack.Pack)
+	f, done, ok := dc.fileCache.Get(cacheKey)
+	if !ok {
+		file, err := os.Open(filepath.Join(dc.packDirectory(), pack.Pack))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pack file for %q: %w", key, err)
+		}
+		var added bool
+		f, done, added = dc.fileCache.Add(cacheKey, file)
+		if !added {
+			file.Close() // file already exists in the cache. close it.
+		}
+	}
+	return &reader{
+		ReaderAt: io.NewSectionReader(f.(*os.File), e.Offset, e.Size),
+		closeFunc: func() error {
+			done() // file will be closed when it's evicted from the cache
+			return nil
+		},
+	}, nil
+}
+
+// removePacked removes key from the pack index. Persistent caches log the removal before
+// the index is updated, so that the contents aren't restored if the snapshotter crashes
+// before the index is written again. The caller must hold packMu.
+func (dc *directoryCache) removePacked(key string) error {
+	if dc.pack == nil {
+		return nil
+	}
+	if _, ok := dc.pack.Entries[key]; !ok {
+		return nil
+	}
+	if dc.persistent {
+		if err := dc.logPackRemoval(key); err != nil {
+			return fmt.Errorf("failed to log removal of packed %q: %w", key, err)
+		}
+	}
+	delete(dc.pack.Entries, key)
+	dc.packDirty = true
+	return nil
+}
+
+// logPackRemoval durably appends key to the log of the contents removed from the pack.
+// The caller must hold packMu.
+func (dc *directoryCache) logPackRemoval(key string) error {
+	if dc.packRemoved == nil {
+		f, err := os.OpenFile(filepath.Join(dc.packDirectory(), packRemovedName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		dc.packRemoved = f
+	}
+	if _, err := dc.packRemoved.WriteString(key + "\n"); err != nil {
+		return err
+	}
+	return dc.packRemoved.Sync()
+}
+
+// commitPackIndex writes the index of `pack` and clears the log of the removed contents,
+// which the index reflects. The caller must hold packMu, or be the only user of the cache.
+func (dc *directoryCache) commitPackIndex(pack *packIndex) error {
+	if err := dc.writePackIndex(pack); err != nil {
+		return err
+	}
+	if dc.packRemoved != nil {
+		dc.packRemoved.Close()
+		dc.packRemoved = nil
+	}
+	if err := os.Remove(filepath.Join(dc.packDirectory(), packRemovedName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readPackRemovals returns the keys logged by logPackRemoval.
+func (dc *directoryCache) readPackRemovals() ([]string, error) {
+	f, err := os.Open(filepath.Join(dc.packDirectory(), packRemovedName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var keys []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// A crash may leave the last line partially written; it can't match a key of the index.
+		if key := sc.Text(); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, sc.Err()
+}
+
+// loadPack loads the pack index of the cache directory, if any, and removes the pack
+// files which aren't referenced by it (e.g. left by a compaction which didn't complete).
+func (dc *directoryCache) loadPack() error {
+	entries, err := os.ReadDir(dc.packDirectory())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := os.ReadFile(filepath.Join(dc.packDirectory(), packIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var pack *packIndex
+	if err == nil {
+		pack = &packIndex{}
+		if err := json.Unmarshal(b, pack); err != nil {
+			return fmt.Errorf("invalid pack index: %w", err)
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, packPrefix) && (pack == nil || name != pack.Pack) {
+			if err := os.Remove(filepath.Join(dc.packDirectory(), name)); err != nil {
+				return err
+			}
+		}
+	}
+	// Contents removed since the index was written must not be restored.
+	removed, err := dc.readPackRemovals()
+	if err != nil {
+		return fmt.Errorf("invalid log of removed packed contents: %w", err)
+	}
+	if pack != nil {
+		for _, key := range removed {
+			if _, ok := pack.Entries[key]; ok {
+				delete(pack.Entries, key)
+				dc.packDirty = true
+			}
+		}
+	}
+	dc.pack = pack
+	return nil
+}
+
+// writePackIndex atomically replaces the pack index of the cache directory with `pack`.
+func (dc *directoryCache) writePackIndex(pack *packIndex) error {
+	b, err := json.Marshal(pack)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dc.packDirectory(), packIndexName+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dc.packDirectory(), packIndexName))
+}
+
+func (dc *directoryCache) packDirectory() string {
+	return filepath.Join(dc.directory, packDirName)
+}
+
+// packCacheKey is the key of the pack file `name` in the file descriptor cache.
+// It can't collide with the keys of contents, which are relative paths in the cache directory.
+func packCacheKey(name string) string {
+	return "/" + packDirName + "/" + name
+}
+
+// copyFile appends the file at `path` to w and returns the number of bytes copied.
+func copyFile(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
@@ -34,54 +34,45 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	golog "log"
 	"math/rand"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/awslabs/soci-snapshotter/fs"
+	fsconfig "github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/preflight"
 	"github.com/awslabs/soci-snapshotter/service"
-	"github.com/awslabs/soci-snapshotter/service/keychain/cri"
 	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
-	"github.com/awslabs/soci-snapshotter/service/keychain/kubeconfig"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/awslabs/soci-snapshotter/version"
-	"github.com/awslabs/soci-snapshotter/ztoc"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
 	"github.com/containerd/containerd/contrib/snapshotservice"
-	"github.com/containerd/containerd/defaults"
 	"github.com/containerd/containerd/log"
-	"github.com/containerd/containerd/pkg/dialer"
 	"github.com/containerd/containerd/snapshots"
-	runtime_alpha "github.com/containerd/containerd/third_party/k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
 	sddaemon "github.com/coreos/go-systemd/v22/daemon"
-	metrics "github.com/docker/go-metrics"
 	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/backoff"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 const (
-	defaultAddress             = "/run/soci-snapshotter-grpc/soci-snapshotter-grpc.sock"
-	defaultConfigPath          = "/etc/soci-snapshotter-grpc/config.toml"
-	defaultLogLevel            = logrus.InfoLevel
-	defaultRootDir             = "/var/lib/soci-snapshotter-grpc"
+	defaultAddress    = "/run/soci-snapshotter-grpc/soci-snapshotter-grpc.sock"
+	defaultConfigPath = "/etc/soci-snapshotter-grpc/config.toml"
+	defaultLogLevel   = logrus.InfoLevel
+	defaultRootDir    = "/var/lib/soci-snapshotter-grpc"
+
+	// defaultImageServiceAddress is the address of the CRI image service of the CRI keychain.
 	defaultImageServiceAddress = "/run/containerd/containerd.sock"
-	defaultMetricsNetwork      = "tcp"
 )
 
 // logLevel of Debug or Trace may emit sensitive information
@@ -92,9 +83,27 @@ var (
 	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
 	rootDir      = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
 	printVersion = flag.Bool("version", false, "print the version")
+
+	printContainerdConfig = flag.Bool("print-containerd-config", false,
+		"print the containerd config registering the snapshotter as a proxy plugin, e.g. for a drop-in file imported by containerd's config")
+	preflightOnly = flag.Bool("preflight", false,
+		"run the preflight checks of the host, print their report as JSON and exit, with status 1 if the snapshotter can't start")
 )
 
+// currentConfigVersion is the version of the config file format understood by this snapshotter.
+const currentConfigVersion = 1
+
 type snapshotterConfig struct {
+	// Version is the version of the config file format. Zero means currentConfigVersion.
+	Version int `toml:"version"`
+
+	// LogLevel is the logging level. The `-log-level` flag takes precedence if it is set explicitly.
+	// Unlike the flag, it is re-applied when the config is reloaded with SIGHUP.
+	LogLevel string `toml:"log_level"`
+
+	// LogFormat is the format of log entries: "json" (the default) or "text".
+	LogFormat string `toml:"log_format"`
+
 	service.Config
 
 	// MetricsAddress is address for the metrics API
@@ -106,11 +115,75 @@ type snapshotterConfig struct {
 	// NoPrometheus is a flag to disable the emission of the metrics
 	NoPrometheus bool `toml:"no_prometheus"`
 
+	// HealthAddress is the address of the HTTP health endpoint (`/healthz`). It is disabled if empty.
+	HealthAddress string `toml:"health_address"`
+
+	// HealthNetwork is the type of network for the health endpoint (e.g. tcp or unix)
+	HealthNetwork string `toml:"health_network"`
+
+	// MigrationAddress is a Unix domain socket address where the snapshotter exports and imports
+	// the state of snapshots to migrate containers between nodes. It is disabled if empty.
+	MigrationAddress string `toml:"migration_address"`
+
 	// DebugAddress is a Unix domain socket address where the snapshotter exposes /debug/ endpoints.
 	DebugAddress string `toml:"debug_address"`
 
+	// QuotaAddress is a Unix domain socket address where the snapshotter reports the usage of
+	// the quotas of each namespace (`/quotas`). It is disabled if empty.
+	QuotaAddress string `toml:"quota_address"`
+
+	// DiscoveryAddress is a Unix domain socket address where the snapshotter lists and invalidates
+	// the cached discoveries of the SOCI indices of images (`/discovery`), and pins the cached spans
+	// of the layers of SOCI indices (`/pins`). It is disabled if empty.
+	DiscoveryAddress string `toml:"discovery_address"`
+
+	// PrewarmAddress is a Unix domain socket address where the snapshotter accepts requests to
+	// warm its caches for an image before any container of it is created (`/prewarm`).
+	// It is disabled if empty.
+	PrewarmAddress string `toml:"prewarm_address"`
+
+	// EventsAddress is the address of containerd (e.g. "/run/containerd/containerd.sock"), whose
+	// events service the snapshotter publishes its events to, e.g. the fallbacks of layers from
+	// lazy loading. It is disabled if empty.
+	EventsAddress string `toml:"events_address"`
+
+	// ContainerdUnpackAddress is the address of containerd (e.g. "/run/containerd/containerd.sock"),
+	// whose content and diff services the snapshotter fetches and unpacks layers with when it can
+	// neither mount them lazily nor unpack them itself. Such layers are left to the container runtime
+	// if empty.
+	ContainerdUnpackAddress string `toml:"containerd_unpack_address"`
+
+	// Preflight configures the checks of the host run before the snapshotter starts.
+	Preflight PreflightConfig `toml:"preflight"`
+
+	// StateSocket is the Unix domain socket where the snapshotter serves its metrics and the state
+	// of its mounts read-only, e.g. to agents on the host which scrape them without a network port.
+	StateSocket StateSocketConfig `toml:"state_socket"`
+
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store" default:"db"`
+
+	// MetadataLayout is the layout of the "db" metadata store: "shared" (default) keeps the metadata
+	// of all layers in one DB file and "per-layer" in a DB file for each layer. The files of the
+	// other layout are removed on startup, since the metadata is imported again on mount.
+	MetadataLayout string `toml:"metadata_layout"`
+
+	// DisabledPlugins lists the IDs of optional subsystems which are not initialized
+	// even if their config section enables them (e.g. to roll out a new subsystem gradually).
+	DisabledPlugins []string `toml:"disabled_plugins"`
+}
+
+// StateSocketConfig is the config of the state socket. Access to it is controlled by the permissions
+// of the socket file: clients need write permission on it to connect.
+type StateSocketConfig struct {
+	// Address is the path of the socket. It is disabled if empty.
+	Address string `toml:"address"`
+
+	// Mode is the octal file mode of the socket (e.g. "0660"). Defaults to "0600".
+	Mode string `toml:"mode"`
+
+	// Group is the name or ID of the group owning the socket. Defaults to the group of the snapshotter.
+	Group string `toml:"group"`
 }
 
 func main() {
@@ -124,10 +197,16 @@ func main() {
 		fmt.Println("soci-snapshotter-grpc version", version.Version, version.Revision)
 		return
 	}
+	if *printContainerdConfig {
+		fmt.Print(containerdConfig(*address))
+		return
+	}
 	logrus.SetLevel(lvl)
-	logrus.SetFormatter(&logrus.JSONFormatter{
-		TimestampFormat: log.RFC3339NanoFixed,
-	})
+	formatter, err := logutil.Formatter(logutil.JSONFormat)
+	if err != nil {
+		log.L.WithError(err).Fatal("failed to prepare logger")
+	}
+	logrus.SetFormatter(formatter)
 
 	var (
 		ctx, cancel = context.WithCancel(log.WithLogger(context.Background(), log.L))
@@ -144,73 +223,75 @@ func main() {
 	}).Info("starting soci-snapshotter-grpc")
 
 	// Get configuration from specified file
-	tree, err := toml.LoadFile(*configPath)
-	if err != nil && !(os.IsNotExist(err) && *configPath == defaultConfigPath) {
+	config, err = loadConfig(*configPath)
+	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to load config file %q", *configPath)
 	}
-	if err := tree.Unmarshal(&config); err != nil {
-		log.G(ctx).WithError(err).Fatalf("failed to unmarshal config file %q", *configPath)
+	if err := applyLogLevel(config); err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to prepare logger")
 	}
 
-	if err := service.Supported(*rootDir); err != nil {
-		log.G(ctx).WithError(err).Fatalf("snapshotter is not supported")
+	report := preflight.Run(ctx, preflightChecks(config, *rootDir, *configPath))
+	if *preflightOnly {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		if report.Fatal() {
+			os.Exit(1)
+		}
+		return
+	}
+	logPreflightReport(ctx, report)
+	if report.Fatal() || (config.Preflight.Strict && len(report.Failures) > 0) {
+		log.G(ctx).WithError(report.Err()).Fatal("snapshotter is not supported")
 	}
 
 	// Create a gRPC server
 	rpc := grpc.NewServer()
 
-	// Configure keychain
-	credsFuncs := []resolver.Credential{dockerconfig.NewDockerConfigKeychain(ctx)}
-	if config.Config.KubeconfigKeychainConfig.EnableKeychain {
-		var opts []kubeconfig.Option
-		if kcp := config.Config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
-			opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
-		}
-		credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
+	// Initialize the optional subsystems.
+	ic := &initContext{
+		ctx:        ctx,
+		config:     &config,
+		rpc:        rpc,
+		credsFuncs: []resolver.Credential{dockerconfig.NewDockerConfigKeychain(ctx)},
 	}
-	if config.Config.CRIKeychainConfig.EnableKeychain {
-		// connects to the backend CRI service (defaults to containerd socket)
-		criAddr := defaultImageServiceAddress
-		if cp := config.CRIKeychainConfig.ImageServicePath; cp != "" {
-			criAddr = cp
-		}
-		connectCRI := func() (runtime_alpha.ImageServiceClient, error) {
-			// TODO: make gRPC options configurable from config.toml
-			backoffConfig := backoff.DefaultConfig
-			backoffConfig.MaxDelay = 3 * time.Second
-			connParams := grpc.ConnectParams{
-				Backoff: backoffConfig,
-			}
-			gopts := []grpc.DialOption{
-				grpc.WithTransportCredentials(insecure.NewCredentials()),
-				grpc.WithConnectParams(connParams),
-				grpc.WithContextDialer(dialer.ContextDialer),
-				grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(defaults.DefaultMaxRecvMsgSize)),
-				grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(defaults.DefaultMaxSendMsgSize)),
-			}
-			conn, err := grpc.Dial(dialer.DialAddress(criAddr), gopts...)
-			if err != nil {
-				return nil, err
-			}
-			return runtime_alpha.NewImageServiceClient(conn), nil
-		}
-		f, criServer := cri.NewCRIKeychain(ctx, connectCRI)
-		runtime_alpha.RegisterImageServiceServer(rpc, criServer)
-		credsFuncs = append(credsFuncs, f)
+	plugins, err := initPlugins(ic)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to initialize plugins")
 	}
-	var fsOpts []fs.Option
-	mt, err := getMetadataStore(*rootDir, config)
+	log.G(ctx).WithField("plugins", plugins).Info("initialized plugins")
+
+	fsOpts := ic.fsOpts
+	mt, err := getMetadataStore(ctx, *rootDir, config)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure metadata store")
 	}
 	fsOpts = append(fsOpts, fs.WithMetadataStore(mt))
-	rs, err := service.NewSociSnapshotterService(ctx, *rootDir, &config.Config,
-		service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...))
+	configReloads := make(chan fsconfig.Config, 1)
+	fsOpts = append(fsOpts, fs.WithConfigReloads(configReloads))
+	serviceOpts := append([]service.Option{service.WithCredsFuncs(ic.credsFuncs...), service.WithFilesystemOptions(fsOpts...),
+		service.WithSnapshotterOptions(ic.snOpts...)}, ic.serviceOpts...)
+	rs, err := service.NewSociSnapshotterService(ctx, *rootDir, &config.Config, serviceOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 	}
 
-	cleanup, err := serve(ctx, rpc, *address, rs, config)
+	ic.snapshotter = rs
+
+	reload := func() error {
+		newConfig, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if err := applyLogLevel(newConfig); err != nil {
+			return err
+		}
+		configReloads <- newConfig.Config.Config
+		return nil
+	}
+
+	cleanup, err := serve(ctx, rpc, *address, rs, ic.serveFns, reload)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
 	}
@@ -222,21 +303,27 @@ func main() {
 	log.G(ctx).Info("Exiting")
 }
 
-func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig) (bool, error) {
+func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter,
+	serveFns []func(errCh chan<- error) (func() error, error), reload func() error) (bool, error) {
 	// Convert the snapshotter to a gRPC service,
 	snsvc := snapshotservice.FromSnapshotter(rs)
 
 	// Register the service with the gRPC server
 	snapshotsapi.RegisterSnapshotsServer(rpc, snsvc)
 
-	// Prepare the directory for the socket
-	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
-		return false, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
+	// With socket activation, systemd creates the socket and queues the connections of containerd
+	// until the snapshotter serves them.
+	l, err := activatedListener(addr)
+	if err != nil {
+		return false, err
 	}
-
-	// Try to remove the socket file to avoid EADDRINUSE
-	if err := os.RemoveAll(addr); err != nil {
-		return false, fmt.Errorf("failed to remove %q: %w", addr, err)
+	if l == nil {
+		// Prepare the directory for the socket
+		if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+			return false, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
+		}
+	} else {
+		log.G(ctx).Infof("serving on socket %q passed by systemd", l.Addr())
 	}
 
 	errCh := make(chan error, 1)
@@ -248,38 +335,21 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 		}
 	}()
 
-	// We need to consider both the existence of MetricsAddress as well as NoPrometheus flag not set
-	if config.MetricsAddress != "" && !config.NoPrometheus {
-		if config.MetricsNetwork == "" {
-			config.MetricsNetwork = defaultMetricsNetwork
-		}
-		l, err := net.Listen(config.MetricsNetwork, config.MetricsAddress)
+	for _, serveFn := range serveFns {
+		cleanupFn, err := serveFn(errCh)
 		if err != nil {
-			return false, fmt.Errorf("failed to get listener for metrics endpoint: %w", err)
+			return false, err
+		}
+		if cleanupFn != nil {
+			cleanupFns = append(cleanupFns, cleanupFn)
 		}
-		cleanupFns = append(cleanupFns, l.Close)
-		m := http.NewServeMux()
-		m.Handle("/metrics", metrics.Handler())
-		go func() {
-			if err := http.Serve(l, m); err != nil {
-				errCh <- fmt.Errorf("error on serving metrics via socket %q: %w", addr, err)
-			}
-		}()
-	}
-
-	if config.DebugAddress != "" {
-		log.G(ctx).Infof("listen %q for debugging", config.DebugAddress)
-		go func() {
-			if err := http.ListenAndServe(config.DebugAddress, nil); err != nil {
-				errCh <- fmt.Errorf("error on serving a debug endpoint via socket %q: %w", addr, err)
-			}
-		}()
 	}
 
 	// Listen and serve
-	l, err := net.Listen("unix", addr)
-	if err != nil {
-		return false, fmt.Errorf("error on listen socket %q: %w", addr, err)
+	if l == nil {
+		if l, err = listenUnix(addr); err != nil {
+			return false, fmt.Errorf("error on listen socket %q: %w", addr, err)
+		}
 	}
 	cleanupFns = append(cleanupFns, l.Close)
 	go func() {
@@ -288,25 +358,33 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 		}
 	}()
 
-	if os.Getenv("NOTIFY_SOCKET") != "" {
-		notified, notifyErr := sddaemon.SdNotify(false, sddaemon.SdNotifyReady)
-		log.G(ctx).Debugf("SdNotifyReady notified=%v, err=%v", notified, notifyErr)
-	}
-	defer func() {
-		if os.Getenv("NOTIFY_SOCKET") != "" {
-			notified, notifyErr := sddaemon.SdNotify(false, sddaemon.SdNotifyStopping)
-			log.G(ctx).Debugf("SdNotifyStopping notified=%v, err=%v", notified, notifyErr)
-		}
-	}()
+	sdNotify(ctx, sddaemon.SdNotifyReady)
+	defer sdNotify(ctx, sddaemon.SdNotifyStopping)
+	stopWatchdog := startWatchdog(ctx, rs)
+	defer stopWatchdog()
 
 	var s os.Signal
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM)
-	select {
-	case s = <-sigCh:
-		log.G(ctx).Infof("Got %v", s)
-	case err := <-errCh:
-		return false, err
+	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	for s == nil {
+		select {
+		case s = <-sigCh:
+			log.G(ctx).Infof("Got %v", s)
+			if s == unix.SIGHUP {
+				// SIGHUP reloads the runtime-reloadable subset of the config and keeps serving.
+				sdNotify(ctx, sddaemon.SdNotifyReloading)
+				err := reload()
+				sdNotify(ctx, sddaemon.SdNotifyReady)
+				if err != nil {
+					log.G(ctx).WithError(err).Errorf("failed to reload config file %q", *configPath)
+				} else {
+					log.G(ctx).Infof("reloaded config file %q", *configPath)
+				}
+				s = nil
+			}
+		case err := <-errCh:
+			return false, err
+		}
 	}
 	if s == unix.SIGINT {
 		return true, nil // do cleanup on SIGINT
@@ -314,27 +392,92 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 	return false, nil
 }
 
+// loadConfig loads the snapshotter config from the TOML file at path.
+// A missing file at the default path results in the default config.
+func loadConfig(path string) (snapshotterConfig, error) {
+	var config snapshotterConfig
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && path == defaultConfigPath {
+			return config, nil
+		}
+		return config, err
+	}
+	if err := tree.Unmarshal(&config); err != nil {
+		return config, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if config.Version == 0 {
+		config.Version = currentConfigVersion
+	}
+	if config.Version > currentConfigVersion {
+		return config, fmt.Errorf("unsupported config version %d; the latest supported version is %d", config.Version, currentConfigVersion)
+	}
+	return config, nil
+}
+
+// applyLogLevel sets the logging level from the config unless the `-log-level` flag was set explicitly,
+// and the format of log entries.
+func applyLogLevel(config snapshotterConfig) error {
+	formatter, err := logutil.Formatter(config.LogFormat)
+	if err != nil {
+		return err
+	}
+	logrus.SetFormatter(formatter)
+	if config.LogLevel == "" || isFlagSet("log-level") {
+		return nil
+	}
+	lvl, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	return nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 const (
 	dbMetadataType = "db"
 )
 
-func getMetadataStore(rootDir string, config snapshotterConfig) (metadata.Store, error) {
+func getMetadataStore(ctx context.Context, rootDir string, config snapshotterConfig) (metadata.Store, error) {
 	switch config.MetadataStore {
 	case "", dbMetadataType:
+		removed, err := metadata.MigrateLayout(rootDir, config.MetadataLayout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate metadata layout: %w", err)
+		}
+		if len(removed) > 0 {
+			log.G(ctx).WithField("removed", removed).Info("removed metadata of another layout or previous run")
+		}
 		bOpts := bolt.Options{
 			NoFreelistSync:  true,
 			InitialMmapSize: 64 * 1024 * 1024,
 			FreelistType:    bolt.FreelistMapType,
 		}
-		db, err := bolt.Open(filepath.Join(rootDir, "metadata.db"), 0600, &bOpts)
-		if err != nil {
-			return nil, err
-		}
-		return func(sr *io.SectionReader, toc ztoc.TOC, opts ...metadata.Option) (metadata.Reader, error) {
-			return metadata.NewReader(db, sr, toc, opts...)
-		}, nil
+		return metadata.OpenStore(rootDir, config.MetadataLayout, &bOpts)
 	default:
 		return nil, fmt.Errorf("unknown metadata store type: %v; must be %v",
 			config.MetadataStore, dbMetadataType)
 	}
 }
+
+// containerdConfig returns the containerd config registering the snapshotter listening on addr
+// as the `soci` proxy plugin. It can be written to a file listed in the `imports` of containerd's config.
+func containerdConfig(addr string) string {
+	return fmt.Sprintf(`version = 2
+
+[proxy_plugins]
+  [proxy_plugins.soci]
+    type = "snapshot"
+    address = %q
+`, addr)
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/service"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"google.golang.org/grpc"
+)
+
+// daemonPlugin is an optional subsystem of the snapshotter daemon.
+//
+// Plugins register themselves from init functions in files guarded by a build tag
+// (e.g. `no_ipfs`), so that minimal builds can leave them out. At runtime, a plugin is
+// initialized if its config section enables it and it is not listed in `disabled_plugins`.
+type daemonPlugin struct {
+	// ID identifies the plugin in the config and in logs.
+	ID string
+
+	// Requires lists the IDs of the plugins which must be initialized before this one.
+	// The plugin is skipped if any of them is not initialized.
+	Requires []string
+
+	// After lists the IDs of the plugins which are initialized before this one if they are
+	// initialized at all. Registration order follows file names, so it must not be relied on
+	// when the order matters, e.g. for the order of preference of keychains.
+	After []string
+
+	// Enabled returns whether the config section of the plugin enables it.
+	// The plugin is enabled by default if it is nil.
+	Enabled func(config *snapshotterConfig) bool
+
+	// Disable turns off the subsystem in the config if the plugin is not initialized.
+	// It is needed by subsystems which are built into the filesystem and enabled by its config.
+	Disable func(config *snapshotterConfig)
+
+	// Init initializes the plugin.
+	Init func(ic *initContext) error
+}
+
+// initContext is passed to plugins to let them hook into the daemon.
+type initContext struct {
+	ctx    context.Context
+	config *snapshotterConfig
+	rpc    *grpc.Server
+
+	// credsFuncs are the keychains of the snapshotter, in order of preference.
+	credsFuncs []resolver.Credential
+	// fsOpts are the options of the filesystem.
+	fsOpts []fs.Option
+	// snOpts are the options of the snapshotter.
+	snOpts []snapshot.Opt
+	// serviceOpts are the options of the snapshotter service, e.g. of the subsystems which need
+	// the registry hosts the service configures.
+	serviceOpts []service.Option
+	// serveFns are started once the snapshotter serves. An error sent on errCh stops the snapshotter.
+	// The returned cleanup function, if any, is called when the snapshotter stops.
+	serveFns []func(errCh chan<- error) (cleanup func() error, err error)
+	// snapshotter is the snapshotter. It is created after the plugins are initialized,
+	// so it is only available from serveFns.
+	snapshotter snapshots.Snapshotter
+}
+
+// daemonPlugins holds the plugins in registration order.
+var daemonPlugins []*daemonPlugin
+
+func registerPlugin(p *daemonPlugin) {
+	for _, registered := range daemonPlugins {
+		if registered.ID == p.ID {
+			panic(fmt.Sprintf("plugin %q is registered twice", p.ID))
+		}
+	}
+	daemonPlugins = append(daemonPlugins, p)
+}
+
+// initPlugins initializes the enabled plugins so that every plugin is initialized after the plugins
+// it requires or is ordered after, and otherwise in registration order. It returns the IDs of the initialized plugins.
+func initPlugins(ic *initContext) ([]string, error) {
+	disabled := make(map[string]bool)
+	for _, id := range ic.config.DisabledPlugins {
+		disabled[id] = true
+	}
+	ordered, err := sortPlugins(daemonPlugins)
+	if err != nil {
+		return nil, err
+	}
+
+	var initialized []string
+	done := make(map[string]bool)
+	for _, p := range ordered {
+		logger := log.G(ic.ctx).WithField("plugin", p.ID)
+		skip := ""
+		switch {
+		case disabled[p.ID]:
+			skip = "disabled by disabled_plugins"
+		case p.Enabled != nil && !p.Enabled(ic.config):
+			skip = "not enabled by its config"
+		default:
+			for _, r := range p.Requires {
+				if !done[r] {
+					skip = fmt.Sprintf("required plugin %q is not initialized", r)
+					break
+				}
+			}
+		}
+		if skip != "" {
+			if p.Disable != nil {
+				p.Disable(ic.config)
+			}
+			logger.Debugf("skipping plugin: %s", skip)
+			continue
+		}
+		if err := p.Init(ic); err != nil {
+			return nil, fmt.Errorf("failed to initialize plugin %q: %w", p.ID, err)
+		}
+		done[p.ID] = true
+		initialized = append(initialized, p.ID)
+		logger.Debug("initialized plugin")
+	}
+	return initialized, nil
+}
+
+// sortPlugins orders plugins topologically by their requirements and ordering constraints,
+// keeping the registration order otherwise. Plugins which are not registered (e.g. left out
+// of the build) are ignored here. Requiring them makes the plugin skipped at init.
+func sortPlugins(plugins []*daemonPlugin) ([]*daemonPlugin, error) {
+	byID := make(map[string]*daemonPlugin)
+	for _, p := range plugins {
+		byID[p.ID] = p
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var (
+		ordered []*daemonPlugin
+		visit   func(p *daemonPlugin) error
+	)
+	visit = func(p *daemonPlugin) error {
+		switch state[p.ID] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("plugin %q is ordered after itself", p.ID)
+		}
+		state[p.ID] = visiting
+		for _, r := range append(append([]string{}, p.Requires...), p.After...) {
+			if dep, ok := byID[r]; ok {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[p.ID] = visited
+		ordered = append(ordered, p)
+		return nil
+	}
+	for _, p := range plugins {
+		if err := visit(p); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
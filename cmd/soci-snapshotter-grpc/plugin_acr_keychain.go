@@ -0,0 +1,51 @@
+//go:build !no_acr_keychain
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/awslabs/soci-snapshotter/service/keychain/azure"
+)
+
+func init() {
+	// Configured by the `[acr_keychain]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "acr-keychain",
+		// The keychains of the cluster are preferred over the identity of the node.
+		After: []string{"kubeconfig-keychain", "cri-keychain"},
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.ACRKeychainConfig.EnableKeychain
+		},
+		Init: func(ic *initContext) error {
+			cfg := ic.config.ACRKeychainConfig
+			opts := []azure.Option{azure.WithHosts(cfg.Hosts...)}
+			if cfg.ClientID != "" {
+				opts = append(opts, azure.WithClientID(cfg.ClientID))
+			}
+			if cfg.TenantID != "" {
+				opts = append(opts, azure.WithTenantID(cfg.TenantID))
+			}
+			kc, err := azure.NewACRKeychain(ic.ctx, opts...)
+			if err != nil {
+				return err
+			}
+			ic.credsFuncs = append(ic.credsFuncs, kc)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,44 @@
+//go:build !no_artifact_store
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/remote/artifactstore"
+)
+
+func init() {
+	// Configured by the `[artifact_store]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "artifact-store",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.ArtifactStoreConfig.Address != ""
+		},
+		Init: func(ic *initContext) error {
+			source, err := artifactstore.NewSource(ic.config.ArtifactStoreConfig)
+			if err != nil {
+				return fmt.Errorf("failed to configure artifact store: %w", err)
+			}
+			ic.fsOpts = append(ic.fsOpts, fs.WithBlobSource(source))
+			return nil
+		},
+	})
+}
@@ -0,0 +1,34 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+func init() {
+	// The background fetcher is built into the filesystem, which creates it unless
+	// `[background_fetch] disable` is set.
+	registerPlugin(&daemonPlugin{
+		ID: "background-fetch",
+		Enabled: func(config *snapshotterConfig) bool {
+			return !config.BackgroundFetchConfig.Disable
+		},
+		Disable: func(config *snapshotterConfig) {
+			config.BackgroundFetchConfig.Disable = true
+		},
+		Init: func(ic *initContext) error {
+			return nil
+		},
+	})
+}
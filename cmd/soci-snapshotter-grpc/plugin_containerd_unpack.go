@@ -0,0 +1,65 @@
+//go:build !no_containerd_unpack
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/service"
+	"github.com/containerd/containerd"
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	diffapi "github.com/containerd/containerd/api/services/diff/v1"
+	leasesapi "github.com/containerd/containerd/api/services/leases/v1"
+	"github.com/containerd/containerd/content/proxy"
+	leasesproxy "github.com/containerd/containerd/leases/proxy"
+	"github.com/containerd/containerd/pkg/dialer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func init() {
+	// Configured by `containerd_unpack_address`.
+	registerPlugin(&daemonPlugin{
+		ID: "containerd-unpack",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.ContainerdUnpackAddress != ""
+		},
+		Init: func(ic *initContext) error {
+			// The connection is made lazily, so the snapshotter starts before containerd does.
+			backoffConfig := backoff.DefaultConfig
+			backoffConfig.MaxDelay = 3 * time.Second
+			conn, err := grpc.Dial(dialer.DialAddress(ic.config.ContainerdUnpackAddress),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoffConfig}),
+				grpc.WithContextDialer(dialer.ContextDialer))
+			if err != nil {
+				return err
+			}
+			ic.serviceOpts = append(ic.serviceOpts, service.WithContainerdUnpack(
+				proxy.NewContentStore(contentapi.NewContentClient(conn)),
+				containerd.NewDiffServiceFromClient(diffapi.NewDiffClient(conn)),
+				leasesproxy.NewLeaseManager(leasesapi.NewLeasesClient(conn))))
+			ic.serveFns = append(ic.serveFns, func(chan<- error) (func() error, error) {
+				return conn.Close, nil
+			})
+			return nil
+		},
+	})
+}
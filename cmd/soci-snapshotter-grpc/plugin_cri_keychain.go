@@ -0,0 +1,74 @@
+//go:build !no_cri_keychain
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/service/keychain/cri"
+	"github.com/containerd/containerd/defaults"
+	"github.com/containerd/containerd/pkg/dialer"
+	runtime_alpha "github.com/containerd/containerd/third_party/k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func init() {
+	// Configured by the `[cri_keychain]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "cri-keychain",
+		// The kubeconfig keychain is preferred over the CRI keychain.
+		After: []string{"kubeconfig-keychain"},
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.CRIKeychainConfig.EnableKeychain
+		},
+		Init: func(ic *initContext) error {
+			// connects to the backend CRI service (defaults to containerd socket)
+			criAddr := defaultImageServiceAddress
+			if cp := ic.config.CRIKeychainConfig.ImageServicePath; cp != "" {
+				criAddr = cp
+			}
+			connectCRI := func() (runtime_alpha.ImageServiceClient, error) {
+				// TODO: make gRPC options configurable from config.toml
+				backoffConfig := backoff.DefaultConfig
+				backoffConfig.MaxDelay = 3 * time.Second
+				connParams := grpc.ConnectParams{
+					Backoff: backoffConfig,
+				}
+				gopts := []grpc.DialOption{
+					grpc.WithTransportCredentials(insecure.NewCredentials()),
+					grpc.WithConnectParams(connParams),
+					grpc.WithContextDialer(dialer.ContextDialer),
+					grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(defaults.DefaultMaxRecvMsgSize)),
+					grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(defaults.DefaultMaxSendMsgSize)),
+				}
+				conn, err := grpc.Dial(dialer.DialAddress(criAddr), gopts...)
+				if err != nil {
+					return nil, err
+				}
+				return runtime_alpha.NewImageServiceClient(conn), nil
+			}
+			f, criServer := cri.NewCRIKeychain(ic.ctx, connectCRI)
+			runtime_alpha.RegisterImageServiceServer(ic.rpc, criServer)
+			ic.credsFuncs = append(ic.credsFuncs, f)
+			return nil
+		},
+	})
+}
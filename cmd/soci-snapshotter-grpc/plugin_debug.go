@@ -0,0 +1,51 @@
+//go:build !no_debug
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	_ "net/http/pprof"
+
+	"github.com/containerd/containerd/log"
+)
+
+func init() {
+	// Configured by `debug_address`.
+	registerPlugin(&daemonPlugin{
+		ID: "debug",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.DebugAddress != ""
+		},
+		Init: func(ic *initContext) error {
+			address := ic.config.DebugAddress
+			ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+				log.G(ic.ctx).Infof("listen %q for debugging", address)
+				go func() {
+					if err := http.ListenAndServe(address, nil); err != nil {
+						errCh <- fmt.Errorf("error on serving a debug endpoint via socket %q: %w", address, err)
+					}
+				}()
+				return nil, nil
+			})
+			return nil
+		},
+	})
+}
@@ -0,0 +1,59 @@
+//go:build !no_events
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/containerd/containerd"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/containerd/containerd/pkg/dialer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func init() {
+	// Configured by `events_address`.
+	registerPlugin(&daemonPlugin{
+		ID: "events",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.EventsAddress != ""
+		},
+		Init: func(ic *initContext) error {
+			// The connection is made lazily, so the snapshotter starts before containerd does.
+			backoffConfig := backoff.DefaultConfig
+			backoffConfig.MaxDelay = 3 * time.Second
+			conn, err := grpc.Dial(dialer.DialAddress(ic.config.EventsAddress),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoffConfig}),
+				grpc.WithContextDialer(dialer.ContextDialer))
+			if err != nil {
+				return err
+			}
+			publisher := containerd.NewEventServiceFromClient(eventsapi.NewEventsClient(conn))
+			ic.snOpts = append(ic.snOpts, snapshot.WithEventPublisher(publisher))
+			ic.serveFns = append(ic.serveFns, func(chan<- error) (func() error, error) {
+				return conn.Close, nil
+			})
+			return nil
+		},
+	})
+}
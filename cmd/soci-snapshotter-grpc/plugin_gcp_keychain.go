@@ -0,0 +1,54 @@
+//go:build !no_gcp_keychain
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/awslabs/soci-snapshotter/service/keychain/gcp"
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+)
+
+func init() {
+	// Configured by the `[gcp_keychain]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "gcp-keychain",
+		// The keychains of the cluster are preferred over the identity of the node.
+		After: []string{"kubeconfig-keychain", "cri-keychain"},
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.GCPKeychainConfig.EnableKeychain
+		},
+		Init: func(ic *initContext) error {
+			cfg := ic.config.GCPKeychainConfig
+			// Access tokens are requested with the dialing config of the registries.
+			client := socihttp.NewRetryableClient(socihttp.RetryableClientConfigOverride{
+				DNSCacheTTLMsec:   ic.config.ResolverConfig.DNSCacheTTLMsec,
+				FallbackDelayMsec: ic.config.ResolverConfig.FallbackDelayMsec,
+			}.Apply(socihttp.NewRetryableClientConfig()))
+			opts := []gcp.Option{gcp.WithHosts(cfg.Hosts...), gcp.WithHTTPClient(client)}
+			if cfg.CredentialsFile != "" {
+				opts = append(opts, gcp.WithCredentialsFile(cfg.CredentialsFile))
+			}
+			kc, err := gcp.NewGCPKeychain(ic.ctx, opts...)
+			if err != nil {
+				return err
+			}
+			ic.credsFuncs = append(ic.credsFuncs, kc)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,68 @@
+//go:build !no_health
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/health"
+	"github.com/containerd/containerd/log"
+)
+
+const defaultHealthNetwork = "tcp"
+
+func init() {
+	// The gRPC health service is always served on the snapshotter socket.
+	// The HTTP endpoint is configured by `health_address` and `health_network`.
+	registerPlugin(&daemonPlugin{
+		ID: "health",
+		Init: func(ic *initContext) error {
+			registry := health.NewRegistry(0)
+			ic.fsOpts = append(ic.fsOpts, fs.WithHealthRegistry(registry))
+			registry.RegisterGRPC(ic.rpc)
+
+			network, address := ic.config.HealthNetwork, ic.config.HealthAddress
+			if address == "" {
+				return nil
+			}
+			if network == "" {
+				network = defaultHealthNetwork
+			}
+			ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+				l, err := net.Listen(network, address)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get listener for health endpoint: %w", err)
+				}
+				log.G(ic.ctx).Infof("listen %q for health checks", address)
+				m := http.NewServeMux()
+				m.Handle("/healthz", registry)
+				go func() {
+					if err := http.Serve(l, m); err != nil {
+						errCh <- fmt.Errorf("error on serving health checks via socket %q: %w", address, err)
+					}
+				}()
+				return l.Close, nil
+			})
+			return nil
+		},
+	})
+}
@@ -0,0 +1,38 @@
+//go:build !no_ipfs
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/remote/ipfs"
+)
+
+func init() {
+	// Configured by the `[ipfs]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "ipfs",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.IPFSConfig.Enable
+		},
+		Init: func(ic *initContext) error {
+			ic.fsOpts = append(ic.fsOpts, fs.WithBlobSource(ipfs.NewSource(ic.config.IPFSConfig)))
+			return nil
+		},
+	})
+}
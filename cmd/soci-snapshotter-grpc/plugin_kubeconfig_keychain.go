@@ -0,0 +1,41 @@
+//go:build !no_kubeconfig_keychain
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/awslabs/soci-snapshotter/service/keychain/kubeconfig"
+)
+
+func init() {
+	// Configured by the `[kubeconfig_keychain]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "kubeconfig-keychain",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.KubeconfigKeychainConfig.EnableKeychain
+		},
+		Init: func(ic *initContext) error {
+			var opts []kubeconfig.Option
+			if kcp := ic.config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
+				opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
+			}
+			ic.credsFuncs = append(ic.credsFuncs, kubeconfig.NewKubeconfigKeychain(ic.ctx, opts...))
+			return nil
+		},
+	})
+}
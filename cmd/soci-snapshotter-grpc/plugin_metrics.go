@@ -0,0 +1,61 @@
+//go:build !no_metrics
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	metrics "github.com/docker/go-metrics"
+)
+
+const defaultMetricsNetwork = "tcp"
+
+func init() {
+	// Configured by `metrics_address`, `metrics_network` and `no_prometheus`.
+	registerPlugin(&daemonPlugin{
+		ID: "metrics",
+		Enabled: func(config *snapshotterConfig) bool {
+			// We need to consider both the existence of MetricsAddress as well as NoPrometheus flag not set
+			return config.MetricsAddress != "" && !config.NoPrometheus
+		},
+		Init: func(ic *initContext) error {
+			network, address := ic.config.MetricsNetwork, ic.config.MetricsAddress
+			if network == "" {
+				network = defaultMetricsNetwork
+			}
+			ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+				l, err := net.Listen(network, address)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get listener for metrics endpoint: %w", err)
+				}
+				m := http.NewServeMux()
+				m.Handle("/metrics", metrics.Handler())
+				go func() {
+					if err := http.Serve(l, m); err != nil {
+						errCh <- fmt.Errorf("error on serving metrics via socket %q: %w", address, err)
+					}
+				}()
+				return l.Close, nil
+			})
+			return nil
+		},
+	})
+}
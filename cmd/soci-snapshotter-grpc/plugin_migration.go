@@ -0,0 +1,103 @@
+//go:build !no_migration
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+)
+
+func init() {
+	// Configured by `migration_address`.
+	registerPlugin(&daemonPlugin{
+		ID: "migration",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.MigrationAddress != ""
+		},
+		Init: func(ic *initContext) error {
+			address := ic.config.MigrationAddress
+			ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+				migrator, ok := ic.snapshotter.(snapshot.StateMigrator)
+				if !ok {
+					return nil, fmt.Errorf("snapshotter doesn't support migrating snapshot state")
+				}
+				m := http.NewServeMux()
+				m.Handle("/snapshots/state", migrationHandler(migrator))
+				return serveUnixSocket(ic.ctx, errCh, address, "snapshot state migration", m)
+			})
+			return nil
+		},
+	})
+}
+
+// migrationHandler exports the state of the snapshot `key` on GET and imports it on PUT.
+func migrationHandler(migrator snapshot.StateMigrator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing snapshot key", http.StatusBadRequest)
+			return
+		}
+		ctx := logutil.WithSnapshotKey(r.Context(), key)
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/x-tar")
+			tw := &trackingWriter{ResponseWriter: w}
+			err = migrator.ExportState(ctx, key, tw)
+			if err != nil && tw.written {
+				// Once the stream started, errors can only be reported by aborting it.
+				log.G(ctx).WithError(err).Error("failed to export snapshot state")
+				panic(http.ErrAbortHandler)
+			}
+		case http.MethodPut:
+			err = migrator.ImportState(ctx, key, r.Body)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to migrate snapshot state (%s)", r.Method)
+			status := http.StatusInternalServerError
+			switch {
+			case errdefs.IsNotFound(err):
+				status = http.StatusNotFound
+			case errdefs.IsFailedPrecondition(err):
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+		}
+	})
+}
+
+// trackingWriter records whether anything was written to the response.
+type trackingWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
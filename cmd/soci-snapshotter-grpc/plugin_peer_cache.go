@@ -0,0 +1,72 @@
+//go:build !no_peer_cache
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/remote/peercache"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/containerd/containerd/log"
+)
+
+func init() {
+	// Configured by the `[peer_cache]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "peer-cache",
+		Enabled: func(config *snapshotterConfig) bool {
+			return len(config.PeerCacheConfig.Peers) > 0 || config.PeerCacheConfig.ListenAddress != ""
+		},
+		Init: func(ic *initContext) error {
+			cfg := ic.config.PeerCacheConfig
+			var peers spanmanager.SpanPeers
+			if len(cfg.Peers) > 0 {
+				client, err := peercache.NewClient(cfg)
+				if err != nil {
+					return fmt.Errorf("failed to configure peer cache: %w", err)
+				}
+				peers = client
+			}
+			var registry *spanmanager.SpanRegistry
+			if cfg.ListenAddress != "" {
+				registry = spanmanager.NewSpanRegistry()
+				address := cfg.ListenAddress
+				ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+					l, err := peercache.Listen(cfg)
+					if err != nil {
+						return nil, fmt.Errorf("failed to get listener for peer cache: %w", err)
+					}
+					log.G(ic.ctx).Infof("listen %q for peer cache requests", address)
+					m := http.NewServeMux()
+					m.Handle(peercache.SpansPath, peercache.NewServer(registry))
+					go func() {
+						if err := http.Serve(l, m); err != nil {
+							errCh <- fmt.Errorf("error on serving peer cache via %q: %w", address, err)
+						}
+					}()
+					return l.Close, nil
+				})
+			}
+			ic.fsOpts = append(ic.fsOpts, fs.WithPeerCache(peers, registry))
+			return nil
+		},
+	})
+}
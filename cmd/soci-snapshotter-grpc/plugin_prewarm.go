@@ -0,0 +1,46 @@
+//go:build !no_prewarm
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+)
+
+func init() {
+	// Configured by `prewarm_address`.
+	registerPlugin(&daemonPlugin{
+		ID: "prewarm",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.PrewarmAddress != ""
+		},
+		Init: func(ic *initContext) error {
+			prewarmer := fs.NewPrewarmer()
+			ic.fsOpts = append(ic.fsOpts, fs.WithPrewarmer(prewarmer))
+			address := ic.config.PrewarmAddress
+			ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+				m := http.NewServeMux()
+				m.Handle("/prewarm", prewarmer.Handler())
+				return serveUnixSocket(ic.ctx, errCh, address, "prewarm requests", m)
+			})
+			return nil
+		},
+	})
+}
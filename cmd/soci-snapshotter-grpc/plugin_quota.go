@@ -0,0 +1,47 @@
+//go:build !no_quota
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/quota"
+)
+
+func init() {
+	// Configured by `quota_address`. Quotas are enforced by the filesystem regardless.
+	registerPlugin(&daemonPlugin{
+		ID: "quota",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.QuotaAddress != ""
+		},
+		Init: func(ic *initContext) error {
+			quotas := quota.NewManager(ic.config.QuotaConfig)
+			ic.fsOpts = append(ic.fsOpts, fs.WithQuotaManager(quotas))
+			address := ic.config.QuotaAddress
+			ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+				m := http.NewServeMux()
+				m.Handle("/quotas", quotas)
+				return serveUnixSocket(ic.ctx, errCh, address, "quota usage", m)
+			})
+			return nil
+		},
+	})
+}
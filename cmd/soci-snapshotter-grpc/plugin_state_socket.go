@@ -0,0 +1,160 @@
+//go:build !no_state_socket
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	metrics "github.com/docker/go-metrics"
+)
+
+const defaultStateSocketMode = 0600
+
+func init() {
+	// Configured by `[state_socket]`.
+	registerPlugin(&daemonPlugin{
+		ID: "state-socket",
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.StateSocket.Address != ""
+		},
+		Init: func(ic *initContext) error {
+			cfg := ic.config.StateSocket
+			mode, gid, err := stateSocketPermissions(cfg)
+			if err != nil {
+				return err
+			}
+			state := fs.NewStateExporter()
+			ic.fsOpts = append(ic.fsOpts, fs.WithStateExporter(state))
+
+			m := http.NewServeMux()
+			if !ic.config.NoPrometheus {
+				m.Handle("/metrics", metrics.Handler())
+			}
+			m.Handle("/mounts", state.MountsHandler())
+			m.Handle("/cache", state.CacheHandler())
+			ic.serveFns = append(ic.serveFns, func(errCh chan<- error) (func() error, error) {
+				if reporter, ok := ic.snapshotter.(snapshot.FallbackReporter); ok {
+					m.Handle("/fallbacks", fallbacksHandler(reporter))
+				}
+				l, err := listenStateSocket(cfg.Address, mode, gid)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get listener for state socket: %w", err)
+				}
+				return serveHTTP(ic.ctx, errCh, l, cfg.Address, "state", readOnly(m)), nil
+			})
+			return nil
+		},
+	})
+}
+
+// fallbacksHandler reports the latest layers which fell back from lazy loading as JSON.
+func fallbacksHandler(reporter snapshot.FallbackReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reporter.Fallbacks())
+	})
+}
+
+// stateSocketPermissions returns the file mode and the group of the state socket. The group is -1
+// if it's left to the snapshotter's.
+func stateSocketPermissions(cfg StateSocketConfig) (os.FileMode, int, error) {
+	mode := os.FileMode(defaultStateSocketMode)
+	if cfg.Mode != "" {
+		m, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil || m&^0777 != 0 {
+			return 0, 0, fmt.Errorf("invalid state socket mode %q", cfg.Mode)
+		}
+		mode = os.FileMode(m)
+	}
+	gid := -1
+	if cfg.Group != "" {
+		g, err := strconv.Atoi(cfg.Group)
+		if err != nil {
+			group, err := user.LookupGroup(cfg.Group)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid state socket group: %w", err)
+			}
+			if g, err = strconv.Atoi(group.Gid); err != nil {
+				return 0, 0, fmt.Errorf("invalid ID of state socket group %q: %w", cfg.Group, err)
+			}
+		}
+		gid = g
+	}
+	return mode, gid, nil
+}
+
+// listenStateSocket listens on a temporary socket which is moved to `address` once its permissions
+// are set, so that clients can't connect to it with the permissions given by the umask.
+func listenStateSocket(address string, mode os.FileMode, gid int) (net.Listener, error) {
+	tmp := address + ".tmp"
+	// Remove the socket of a previous run, which nothing serves anymore.
+	if err := os.RemoveAll(address); err != nil {
+		return nil, fmt.Errorf("failed to remove %q: %w", address, err)
+	}
+	l, err := listenUnix(tmp)
+	if err != nil {
+		return nil, err
+	}
+	// The listener must not remove the socket from its temporary path when it's closed.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, mode)
+	if err == nil && gid >= 0 {
+		err = os.Chown(tmp, -1, gid)
+	}
+	if err == nil {
+		err = os.Rename(tmp, address)
+	}
+	if err != nil {
+		l.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &unlinkListener{Listener: l, path: address}, nil
+}
+
+// unlinkListener removes its socket file when it's closed.
+type unlinkListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unlinkListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// readOnly rejects the requests to `h` which may modify state.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
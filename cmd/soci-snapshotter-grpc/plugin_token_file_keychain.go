@@ -0,0 +1,53 @@
+//go:build !no_token_file_keychain
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/service/keychain/tokenfile"
+)
+
+func init() {
+	// Configured by the `[token_file_keychain]` section.
+	registerPlugin(&daemonPlugin{
+		ID: "token-file-keychain",
+		// The keychains of the cluster are preferred over the token file.
+		After: []string{"kubeconfig-keychain", "cri-keychain"},
+		Enabled: func(config *snapshotterConfig) bool {
+			return config.TokenFileKeychainConfig.EnableKeychain
+		},
+		Init: func(ic *initContext) error {
+			cfg := ic.config.TokenFileKeychainConfig
+			if cfg.Path == "" {
+				return fmt.Errorf("token file keychain requires a path")
+			}
+			opts := []tokenfile.Option{tokenfile.WithHosts(cfg.Hosts...)}
+			if cfg.Username != "" {
+				opts = append(opts, tokenfile.WithUsername(cfg.Username))
+			}
+			kc, err := tokenfile.NewTokenFileKeychain(ic.ctx, cfg.Path, opts...)
+			if err != nil {
+				return err
+			}
+			ic.credsFuncs = append(ic.credsFuncs, kc)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	fsconfig "github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/preflight"
+	"github.com/awslabs/soci-snapshotter/service"
+	"github.com/containerd/containerd/log"
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// The kernel must support overlayfs with multiple lower directories.
+	minKernelMajor = 4
+	minKernelMinor = 0
+
+	defaultPreflightMinFreeBytes = 1 << 30
+)
+
+// PreflightConfig is the config of the checks of the host run before the snapshotter starts.
+type PreflightConfig struct {
+	// Strict makes the snapshotter refuse to start if any check fails, rather than only
+	// if a check which it can't run without fails.
+	Strict bool `toml:"strict"`
+
+	// MinFreeBytes is the space which must be available in the root directory. Defaults to 1GiB.
+	// A negative value disables the check.
+	MinFreeBytes int64 `toml:"min_free_bytes"`
+}
+
+// preflightChecks returns the checks of the requirements of the snapshotter with `config`.
+func preflightChecks(config snapshotterConfig, root, configFile string) []preflight.Check {
+	checks := []preflight.Check{
+		{
+			Name:     "config",
+			Degrades: []string{"settings of unknown config keys"},
+			Remedy:   fmt.Sprintf("fix the config file %s", configFile),
+			Run: func(ctx context.Context) error {
+				return checkConfigKeys(configFile)
+			},
+		},
+		preflight.KernelVersion(minKernelMajor, minKernelMinor),
+		preflight.WritableDirectory("root-directory", root),
+		{
+			Name:   "overlayfs",
+			Remedy: fmt.Sprintf("put %s on a filesystem which supports overlayfs (e.g. ext4 or xfs with ftype=1)", root),
+			Run: func(ctx context.Context) error {
+				return service.Supported(root)
+			},
+		},
+		preflight.FUSEDevice(),
+		preflight.Fusermount(),
+	}
+	contentStorePath := config.ContentStorePath
+	if contentStorePath == "" {
+		contentStorePath = fsconfig.DefaultSociContentStorePath
+	}
+	contentStore := preflight.WritableDirectory("content-store-directory", contentStorePath)
+	contentStore.Degrades = []string{preflight.LazyLoading}
+	checks = append(checks, contentStore)
+
+	minFree := config.Preflight.MinFreeBytes
+	if minFree == 0 {
+		minFree = defaultPreflightMinFreeBytes
+	}
+	if minFree > 0 {
+		checks = append(checks, preflight.FreeSpace("root-free-space", root, minFree,
+			[]string{"caching of fetched layer contents"}))
+	}
+	if config.CRIKeychainConfig.EnableKeychain {
+		address := defaultImageServiceAddress
+		if config.CRIKeychainConfig.ImageServicePath != "" {
+			address = config.CRIKeychainConfig.ImageServicePath
+		}
+		checks = append(checks, preflight.UnixSocket("containerd-socket", address,
+			[]string{"registry credentials from the CRI keychain"},
+			"start containerd or fix cri_keychain.image_service_path; the keychain connects once the socket is served"))
+	}
+	return checks
+}
+
+// logPreflightReport logs the failed checks of `report` with their consequences.
+func logPreflightReport(ctx context.Context, report preflight.Report) {
+	for _, f := range report.Failures {
+		entry := log.G(ctx).WithField("check", f.Check).WithField("remedy", f.Remedy)
+		if f.Fatal {
+			entry.Error("preflight check failed: " + f.Error)
+			continue
+		}
+		entry.WithField("degrades", f.Degrades).Warn("preflight check failed: " + f.Error)
+	}
+	if degraded := report.Degraded(); len(degraded) > 0 {
+		log.G(ctx).WithField("features", degraded).Warn("features are degraded by failed preflight checks")
+	}
+}
+
+// checkConfigKeys returns an error listing the keys of the config file which the snapshotter
+// doesn't know, e.g. misspelled ones, since they would be silently ignored.
+func checkConfigKeys(configFile string) error {
+	tree, err := toml.LoadFile(configFile)
+	if err != nil {
+		if os.IsNotExist(err) && configFile == defaultConfigPath {
+			return nil
+		}
+		return err
+	}
+	unknown := unknownKeys(tree, reflect.TypeOf(snapshotterConfig{}), "")
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys are ignored: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// unknownKeys returns the keys of `tree` which don't match a field of the struct type `t`.
+func unknownKeys(tree *toml.Tree, t reflect.Type, prefix string) []string {
+	var unknown []string
+	for _, key := range tree.Keys() {
+		field, ok := configField(t, key)
+		if !ok {
+			unknown = append(unknown, prefix+key)
+			continue
+		}
+		ft := field
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Map {
+			// The keys of maps are arbitrary, so only the tables they hold are checked.
+			elem := ft.Elem()
+			for elem.Kind() == reflect.Ptr {
+				elem = elem.Elem()
+			}
+			if sub, ok := tree.GetPath([]string{key}).(*toml.Tree); ok && elem.Kind() == reflect.Struct {
+				for _, k := range sub.Keys() {
+					if entry, ok := sub.GetPath([]string{k}).(*toml.Tree); ok {
+						unknown = append(unknown, unknownKeys(entry, elem, prefix+key+"."+k+".")...)
+					}
+				}
+			}
+			continue
+		}
+		if ft.Kind() != reflect.Struct {
+			continue
+		}
+		switch v := tree.GetPath([]string{key}).(type) {
+		case *toml.Tree:
+			unknown = append(unknown, unknownKeys(v, ft, prefix+key+".")...)
+		case []*toml.Tree:
+			for _, sub := range v {
+				unknown = append(unknown, unknownKeys(sub, ft, prefix+key+".")...)
+			}
+		}
+	}
+	return unknown
+}
+
+// configField returns the type of the field of the struct type `t` which the config key `key` sets.
+// The fields of embedded structs without a key are fields of `t`.
+func configField(t reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("toml"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" && f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if ft, ok := configField(f.Type, key); ok {
+				return ft, true
+			}
+			continue
+		}
+		if tag == key || (tag == "" && strings.EqualFold(f.Name, key)) {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,58 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/containerd/containerd/log"
+)
+
+// listenUnix listens on the Unix domain socket `address`, replacing the socket file left by a previous run.
+func listenUnix(address string) (net.Listener, error) {
+	// Try to remove the socket file to avoid EADDRINUSE
+	if err := os.RemoveAll(address); err != nil {
+		return nil, fmt.Errorf("failed to remove %q: %w", address, err)
+	}
+	return net.Listen("unix", address)
+}
+
+// serveUnixSocket serves `handler` over HTTP on the Unix domain socket `address` for a serveFn.
+// `what` says what is served, in logs and errors.
+func serveUnixSocket(ctx context.Context, errCh chan<- error, address, what string, handler http.Handler) (func() error, error) {
+	l, err := listenUnix(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get listener for %s: %w", what, err)
+	}
+	return serveHTTP(ctx, errCh, l, address, what, handler), nil
+}
+
+// serveHTTP serves `handler` over HTTP on `l`, which listens on `address`, and sends the error
+// to errCh if serving fails. It returns the cleanup function of a serveFn, which closes `l`.
+func serveHTTP(ctx context.Context, errCh chan<- error, l net.Listener, address, what string, handler http.Handler) func() error {
+	log.G(ctx).Infof("listen %q for %s", address, what)
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			errCh <- fmt.Errorf("error on serving %s via socket %q: %w", what, address, err)
+		}
+	}()
+	return l.Close
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/coreos/go-systemd/v22/activation"
+	sddaemon "github.com/coreos/go-systemd/v22/daemon"
+)
+
+// watchdogProbeKey is the key of the snapshot the watchdog stats to check that
+// the snapshotter still serves requests. It doesn't exist.
+const watchdogProbeKey = "soci-watchdog-probe"
+
+// activatedListener returns the listener of the snapshotter socket at addr passed by systemd
+// with socket activation, or nil if the snapshotter isn't socket activated. If systemd passed a
+// single socket, it's used whatever its address, e.g. if the socket unit listens on another path.
+func activatedListener(addr string) (net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sockets passed by systemd: %w", err)
+	}
+	var found net.Listener
+	for _, l := range listeners {
+		if l != nil && found == nil && (len(listeners) == 1 || l.Addr().String() == addr) {
+			found = l
+		} else if l != nil {
+			l.Close()
+		}
+	}
+	if found == nil && len(listeners) > 0 {
+		return nil, fmt.Errorf("none of the %d sockets passed by systemd listens on %q", len(listeners), addr)
+	}
+	return found, nil
+}
+
+// sdNotify sends `state` to systemd if the snapshotter runs as a `Type=notify` service.
+func sdNotify(ctx context.Context, state string) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	notified, err := sddaemon.SdNotify(false, state)
+	log.G(ctx).Debugf("SdNotify %q notified=%v, err=%v", state, notified, err)
+}
+
+// startWatchdog notifies the systemd watchdog (`WatchdogSec=`) every half watchdog interval as long
+// as the snapshotter serves requests, so that systemd restarts a hung snapshotter. It returns a
+// function stopping the notifications.
+func startWatchdog(ctx context.Context, sn snapshots.Snapshotter) func() {
+	interval, err := sddaemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("invalid systemd watchdog settings")
+		return func() {}
+	}
+	if interval == 0 {
+		return func() {}
+	}
+	log.G(ctx).Infof("notifying the systemd watchdog every %v", interval/2)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := probe(ctx, sn, interval/2); err != nil {
+					log.G(ctx).WithError(err).Warn("snapshotter is not responding, not notifying the systemd watchdog")
+					continue
+				}
+				sdNotify(ctx, sddaemon.SdNotifyWatchdog)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// probe checks that the snapshotter answers a request within timeout. The answer
+// itself doesn't matter, since the probed snapshot doesn't exist.
+func probe(ctx context.Context, sn snapshots.Snapshotter, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		sn.Stat(ctx, watchdogProbeKey)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out checking the snapshotter")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/remote/artifactstore"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/util/mtls"
+	"github.com/containerd/containerd/log"
+)
+
+// serveArtifacts runs soci-store as an artifact service at address, without mounting a filesystem.
+// It fetches the SOCI indices, zTOCs and spans requested by snapshotters from the registries
+// configured by hosts and caches them under the root directory, so that they are fetched once
+// for all the snapshotters sharing the service. It returns once ctx is done.
+func serveArtifacts(ctx context.Context, address string, hosts source.RegistryHosts, cfg Config) error {
+	cacheDir := filepath.Join(*rootDir, "artifacts")
+	blobCache, err := cache.NewDirectoryCache(cacheDir, cache.DirectoryCacheConfig{
+		Direct:     true,
+		Persistent: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to prepare artifact cache: %w", err)
+	}
+	defer blobCache.Close()
+
+	opts := []artifactstore.Option{artifactstore.WithMaxCacheSize(cacheDir, *artifactServiceMaxCacheSize)}
+	if *artifactServiceRegistries != "" {
+		opts = append(opts, artifactstore.WithRegistries(strings.Split(*artifactServiceRegistries, ",")))
+	}
+	artifacts, err := artifactstore.NewServer(hosts, remote.NewResolver(cfg.Config.BlobConfig, nil, nil), blobCache, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to prepare artifact service: %w", err)
+	}
+	l, err := listen(address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(artifactstore.BlobsPath, artifacts)
+	server := &http.Server{Handler: mux}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(l)
+	}()
+	log.G(ctx).WithField("address", address).Info("serving artifacts")
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("failed to serve artifacts: %w", err)
+	case <-ctx.Done():
+		return server.Close()
+	}
+}
+
+// listen listens on a `unix://` socket path, which only root can connect to, or on a TCP address,
+// which requires snapshotters to authenticate with a certificate signed by the client CA.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		tlsConfig, err := mtls.ServerConfig(*artifactServiceTLSCert, *artifactServiceTLSKey, *artifactServiceClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("artifact service on TCP requires mutual TLS: %w", err)
+		}
+		l, err := tls.Listen("tcp", address, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %q: %w", address, err)
+		}
+		return l, nil
+	}
+	path := strings.TrimPrefix(address, "unix://")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory of socket %q: %w", path, err)
+	}
+	// Remove the socket left by a previous run.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove socket %q: %w", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to restrict access to socket %q: %w", path, err)
+	}
+	return l, nil
+}
@@ -72,6 +72,18 @@ var (
 	rootDir           = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
 	localKeychainPort = flag.Int("local_keychain_port", 0,
 		"Port on which to expose the local_keychain gRPC service that accepts username/password credentials for private images. If 0, the local_keychain service is not started/exposed.")
+	artifactService = flag.String("artifact-service", "",
+		"Address (unix://<socket path> or <host>:<port>) on which to run as an artifact service serving SOCI indices, zTOCs and spans to snapshotters, instead of mounting a store. If empty, the store is mounted at the mount point.")
+	artifactServiceTLSCert = flag.String("artifact-service-tls-cert", "",
+		"PEM file of the certificate presented by the artifact service to snapshotters. Required with a TCP address.")
+	artifactServiceTLSKey = flag.String("artifact-service-tls-key", "",
+		"PEM file of the key of the certificate of the artifact service. Required with a TCP address.")
+	artifactServiceClientCA = flag.String("artifact-service-client-ca", "",
+		"PEM file of the CAs which sign the certificates of the snapshotters allowed to use the artifact service. Required with a TCP address.")
+	artifactServiceRegistries = flag.String("artifact-service-registries", "",
+		"Comma-separated registries (e.g. registry.example.com:5000) whose images the artifact service serves. If empty, images of any registry are served.")
+	artifactServiceMaxCacheSize = flag.Int64("artifact-service-max-cache-size", 10<<30,
+		"Maximum size (in bytes) of the blobs cached by the artifact service. The least recently served blobs are removed first.")
 )
 
 type Config struct {
@@ -112,7 +124,7 @@ func main() {
 	// logs are always printed as "debug" mode.
 	golog.SetOutput(log.G(ctx).WriterLevel(logrus.DebugLevel))
 
-	if mountPoint == "" {
+	if mountPoint == "" && *artifactService == "" {
 		log.G(ctx).Fatalf("mount point must be specified")
 	}
 
@@ -150,6 +162,21 @@ func main() {
 
 	// Use RegistryHosts based on ResolverConfig and keychain
 	hosts := resolver.RegistryHostsFromConfig(resolver.Config(cfg.ResolverConfig), credsFuncs...)
+	hosts = resolver.LimitBandwidth(hosts, resolver.Config(cfg.ResolverConfig))
+
+	if *artifactService != "" {
+		ctx, cancel := context.WithCancel(ctx)
+		go func() {
+			waitForSIGINT()
+			log.G(ctx).Info("Got SIGINT")
+			cancel()
+		}()
+		if err := serveArtifacts(ctx, *artifactService, hosts, cfg); err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to run artifact service")
+		}
+		log.G(ctx).Info("Exiting")
+		return
+	}
 
 	// Configure and mount filesystem
 	if _, err := os.Stat(mountPoint); err != nil {
@@ -170,9 +197,13 @@ func main() {
 	// Configure filesystem and snapshotter
 	var fsOpts []socifs.Option
 	opq := layer.OverlayOpaqueTrusted
+	rewriteRef, err := resolver.RefRewriterFromConfig(cfg.ResolverConfig.Rewrite)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("invalid rewrite rules of image references")
+	}
 	fsOpts = append(fsOpts, socifs.WithGetSources(
 		source.FromDefaultLabels(hosts), // provides source info based on default labels
-	), socifs.WithOverlayOpaqueType(opq))
+	), socifs.WithOverlayOpaqueType(opq), socifs.WithRefRewriter(rewriteRef))
 	fs, bgFetcher, err := socifs.NewFilesystem(ctx, defaultRootDir, cfg.Config, fsOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to prepare fs")
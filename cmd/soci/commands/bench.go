@@ -0,0 +1,190 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/benchmark/framework"
+	"github.com/awslabs/soci-snapshotter/benchmark/hotpath"
+	"github.com/awslabs/soci-snapshotter/version"
+	"github.com/urfave/cli"
+)
+
+const (
+	countFlag              = "count"
+	runFlag                = "run"
+	filesFlag              = "files"
+	fileSizeFlag           = "file-size"
+	outputDirFlag          = "output-dir"
+	baselineFlag           = "baseline"
+	thresholdFlag          = "threshold"
+	benchmarkThresholdFlag = "benchmark-threshold"
+)
+
+// BenchCommand benchmarks the hot paths of the snapshotter on the host with the benchmark
+// framework, and compares the results with those of a previous run.
+var BenchCommand = cli.Command{
+	Name:  "bench",
+	Usage: "benchmark the snapshotter on this host",
+	Description: `Runs benchmarks of the hot paths of the snapshotter on a generated layer: building its ztoc
+(ztoc-build), importing the ztoc into the metadata store (metadata-import), fetching and decompressing
+its spans (span-fetch) and reading its files as the FUSE read handlers do (file-read). The layer is
+generated from a fixed seed, so results are comparable between runs with the same layer flags.
+
+The results are written to results.json in --output-dir, as those of the other benchmarks. With
+--baseline, the median times are compared with the results.json of a previous run, and the command
+exits with an error if a benchmark is slower than the baseline by more than its threshold.`,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  countFlag,
+			Usage: "number of times each benchmark runs",
+			Value: 10,
+		},
+		cli.StringFlag{
+			Name:  runFlag,
+			Usage: "regular expression of the names of the benchmarks to run (default: all)",
+		},
+		cli.IntFlag{
+			Name:  filesFlag,
+			Usage: "number of files of the generated layer",
+			Value: 1024,
+		},
+		cli.IntFlag{
+			Name:  fileSizeFlag,
+			Usage: "size of the files of the generated layer in bytes",
+			Value: 32 << 10,
+		},
+		cli.Int64Flag{
+			Name:  spanSizeFlag,
+			Usage: "span size of the ztoc of the generated layer in bytes",
+			Value: 1 << 20,
+		},
+		cli.StringFlag{
+			Name:  outputDirFlag,
+			Usage: "directory to write results.json to, e.g. to use it as a baseline later",
+			Value: "./output",
+		},
+		cli.StringFlag{
+			Name:  baselineFlag,
+			Usage: "results.json of a previous run to compare the results with",
+		},
+		cli.Float64Flag{
+			Name:  thresholdFlag,
+			Usage: "slowdown in percent of the baseline above which a benchmark regresses",
+			Value: framework.DefaultThreshold,
+		},
+		cli.StringSliceFlag{
+			Name:  benchmarkThresholdFlag,
+			Usage: "threshold of a specific benchmark, as <name>=<percent>; can be repeated",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		opts := hotpath.Options{
+			Count:    cliContext.Int(countFlag),
+			Files:    cliContext.Int(filesFlag),
+			FileSize: cliContext.Int(fileSizeFlag),
+			SpanSize: cliContext.Int64(spanSizeFlag),
+		}
+		if run := cliContext.String(runFlag); run != "" {
+			filter, err := regexp.Compile(run)
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %w", runFlag, err)
+			}
+			opts.Filter = filter
+		}
+		thresholds := framework.Thresholds{
+			Default: cliContext.Float64(thresholdFlag),
+			Tests:   make(map[string]float64),
+		}
+		for _, v := range cliContext.StringSlice(benchmarkThresholdFlag) {
+			name, percent, ok := strings.Cut(v, "=")
+			if !ok {
+				return fmt.Errorf("invalid --%s %q: expected <name>=<percent>", benchmarkThresholdFlag, v)
+			}
+			threshold, err := strconv.ParseFloat(percent, 64)
+			if err != nil {
+				return fmt.Errorf("invalid --%s %q: %w", benchmarkThresholdFlag, v, err)
+			}
+			thresholds.Tests[name] = threshold
+		}
+		var baseline *framework.BenchmarkFramework
+		if path := cliContext.String(baselineFlag); path != "" {
+			b, err := framework.ReadResults(path)
+			if err != nil {
+				return err
+			}
+			baseline = b
+		}
+
+		frame, err := hotpath.Run(context.Background(), hotpath.Default(), opts)
+		if err != nil {
+			return err
+		}
+		frame.OutputDir = cliContext.String(outputDirFlag)
+		frame.CommitID = version.Revision
+		if err := frame.WriteResults(); err != nil {
+			return err
+		}
+		var changes []framework.Change
+		if baseline != nil {
+			changes, err = framework.Compare(baseline, frame, thresholds)
+			if err != nil {
+				return err
+			}
+		}
+
+		printBenchResults(frame, changes)
+		if regressions := framework.Regressions(changes); len(regressions) > 0 {
+			names := make([]string, 0, len(regressions))
+			for _, r := range regressions {
+				names = append(names, fmt.Sprintf("%s (%+.1f%%)", r.TestName, r.Percent))
+			}
+			return fmt.Errorf("%d benchmarks regressed: %s", len(regressions), strings.Join(names, ", "))
+		}
+		return nil
+	},
+}
+
+// printBenchResults prints the times of the benchmarks in milliseconds, with their changes from the baseline.
+func printBenchResults(frame *framework.BenchmarkFramework, changes []framework.Change) {
+	byName := make(map[string]framework.Change, len(changes))
+	for _, c := range changes {
+		byName[c.TestName] = c
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+	writer.Write([]byte("BENCHMARK\tRUNS\tMEAN MS\tP50 MS\tP90 MS\tBASELINE P50 MS\tCHANGE\t\n"))
+	for _, d := range frame.Drivers {
+		baseline, change := "-", "-"
+		if c, ok := byName[d.TestName]; ok {
+			baseline = fmt.Sprintf("%.2f", c.BaselinePct50*1e3)
+			change = fmt.Sprintf("%+.1f%%", c.Percent)
+			if c.Regressed {
+				change += " (regressed)"
+			}
+		}
+		writer.Write([]byte(fmt.Sprintf("%s\t%d\t%.2f\t%.2f\t%.2f\t%s\t%s\t\n",
+			d.TestName, len(d.TestTimes), d.Mean*1e3, d.Pct50*1e3, d.Pct90*1e3, baseline, change)))
+	}
+	writer.Flush()
+}
@@ -0,0 +1,276 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/bundle"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+const (
+	layersFlag          = "layers"
+	indexStoreFlag      = "index-store"
+	leaseExpirationFlag = "lease-expiration"
+)
+
+// BundleCommand moves SOCI artifacts to hosts which can't reach the registry.
+var BundleCommand = cli.Command{
+	Name:  "bundle",
+	Usage: "export and import bundles of SOCI artifacts for air-gapped hosts",
+	Subcommands: []cli.Command{
+		bundleExportCommand,
+		bundleImportCommand,
+	},
+}
+
+var bundleExportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export the SOCI index of an image and its ztocs to a bundle",
+	ArgsUsage: "[flags] <image_ref> <file>",
+	Description: `Writes the most recent SOCI index of the image for each platform and its ztocs, from the local
+content store, to a tarball in the OCI image layout.
+
+With --layers, the image manifests, configs and layers are added to the bundle as well, so that the
+snapshotter can serve the layers without the registry. They are read from the content store of
+containerd, which must hold all of them, e.g. because the image was pulled with ctr.`,
+	Flags: append(append(
+		commands.SnapshotterFlags,
+		internal.PlatformFlags...),
+		cli.BoolFlag{
+			Name:  layersFlag,
+			Usage: "add the image manifests, configs and layers to the bundle",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref, file := cliContext.Args().Get(0), cliContext.Args().Get(1)
+		if ref == "" || file == "" {
+			return fmt.Errorf("please provide an image reference and the file to export to")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+		if err != nil {
+			return err
+		}
+		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		store, err := internal.OpenContentStore(cliContext)
+		if err != nil {
+			return err
+		}
+
+		var images []bundle.Image
+		for _, platform := range ps {
+			platform := platform
+			indexDescriptors, _, err := soci.GetIndexDescriptorCollection(ctx, cs, artifactsDb, img, []ocispec.Platform{platform})
+			if err != nil {
+				return err
+			}
+			if len(indexDescriptors) == 0 {
+				return fmt.Errorf("no soci index found for image %s on platform %s; create one with `soci create`", ref, platforms.Format(platform))
+			}
+			sort.Slice(indexDescriptors, func(i, j int) bool {
+				return indexDescriptors[i].CreatedAt.Before(indexDescriptors[j].CreatedAt)
+			})
+			images = append(images, bundle.Image{
+				Index:    indexDescriptors[len(indexDescriptors)-1].Descriptor,
+				Platform: &platform,
+			})
+		}
+
+		var opts []bundle.ExportOption
+		if cliContext.Bool(layersFlag) {
+			opts = append(opts, bundle.WithLayers(contentFetcher{cs}))
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		err = bundle.Export(ctx, f, store, images, opts...)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(file)
+			return err
+		}
+		for _, img := range images {
+			fmt.Printf("exported soci index %s for platform %s\n", img.Index.Digest, platforms.Format(*img.Platform))
+		}
+		return nil
+	},
+}
+
+var bundleImportCommand = cli.Command{
+	Name:      "import",
+	Usage:     "import a bundle of SOCI artifacts into the local content store",
+	ArgsUsage: "[flags] <file>",
+	Description: `Imports the SOCI indices, ztocs and layers of a bundle written by 'soci bundle export' into the
+local content store as the snapshotter configures it, records them in the artifacts database, and records
+the index of each image manifest in the index store, where the snapshotter looks for it before asking the
+registry. Blobs already in the content store are skipped.
+
+The image manifests are held by a containerd lease in the namespace of the command, so that 'soci gc'
+keeps their indices and layers until the images are imported into containerd, e.g. with 'ctr image import',
+or the lease expires.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  indexStoreFlag,
+			Usage: "directory recording the SOCI index of each image manifest for the snapshotter (default: index_store_path of the snapshotter config)",
+		},
+		cli.DurationFlag{
+			Name:  leaseExpirationFlag,
+			Usage: "how long the imported artifacts are kept by 'soci gc' if their images aren't in containerd; 0 keeps them until the lease is removed",
+			Value: 24 * time.Hour,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		file := cliContext.Args().First()
+		if file == "" {
+			return fmt.Errorf("please provide the bundle to import")
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		cfg, err := internal.LoadConfig(cliContext)
+		if err != nil {
+			return err
+		}
+		indexStore := cliContext.String(indexStoreFlag)
+		if indexStore == "" {
+			indexStore = cfg.IndexStorePath
+		}
+		if indexStore == "" {
+			indexStore = config.DefaultSociIndexStorePath
+		}
+		store, err := internal.OpenContentStore(cliContext)
+		if err != nil {
+			return err
+		}
+		imported, err := bundle.Import(ctx, f, store)
+		if err != nil {
+			return err
+		}
+		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(indexStore, 0755); err != nil {
+			return err
+		}
+
+		// The lease is created before the entries are written, so that a concurrent 'soci gc'
+		// never sees the indices without it.
+		leaseOpts := []leases.Opt{leases.WithRandomID()}
+		if exp := cliContext.Duration(leaseExpirationFlag); exp > 0 {
+			leaseOpts = append(leaseOpts, leases.WithExpiration(exp))
+		}
+		lm := client.LeasesService()
+		lease, err := lm.Create(ctx, leaseOpts...)
+		if err != nil {
+			return fmt.Errorf("cannot create lease: %w", err)
+		}
+		for _, im := range imported {
+			if err := lm.AddResource(ctx, lease, leases.Resource{ID: im.Manifest.String(), Type: "content"}); err != nil {
+				return fmt.Errorf("cannot add image manifest %s to lease %s: %w", im.Manifest, lease.ID, err)
+			}
+		}
+
+		now := time.Now()
+		for _, im := range imported {
+			entries := []*soci.ArtifactEntry{{
+				Digest:         im.Index.Digest.String(),
+				OriginalDigest: im.Manifest.String(),
+				ImageDigest:    im.Manifest.String(),
+				Type:           soci.ArtifactEntryTypeIndex,
+				Location:       im.Manifest.String(),
+				Size:           im.Index.Size,
+				MediaType:      im.Index.MediaType,
+				CreatedAt:      now,
+			}}
+			if im.Index.Platform != nil {
+				entries[0].Platform = platforms.Format(*im.Index.Platform)
+			}
+			for _, ztoc := range im.Ztocs {
+				layer := ztoc.Annotations[soci.IndexAnnotationImageLayerDigest]
+				entries = append(entries, &soci.ArtifactEntry{
+					Digest:         ztoc.Digest.String(),
+					OriginalDigest: layer,
+					Type:           soci.ArtifactEntryTypeLayer,
+					Location:       layer,
+					Size:           ztoc.Size,
+					MediaType:      soci.SociLayerMediaType,
+					CreatedAt:      now,
+				})
+			}
+			for _, blob := range im.Image {
+				entries = append(entries, &soci.ArtifactEntry{
+					Digest:         blob.Digest.String(),
+					OriginalDigest: blob.Digest.String(),
+					ImageDigest:    im.Manifest.String(),
+					Type:           soci.ArtifactEntryTypeImageBlob,
+					Location:       blob.Digest.String(),
+					Size:           blob.Size,
+					MediaType:      blob.MediaType,
+					CreatedAt:      now,
+				})
+			}
+			if err := artifactsDb.WriteArtifactEntries(entries...); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(indexStore, im.Manifest.Encoded()), []byte(im.Index.Digest.String()), 0644); err != nil {
+				return fmt.Errorf("cannot record the index of image manifest %s: %w", im.Manifest, err)
+			}
+			fmt.Printf("imported soci index %s for image manifest %s (layers: %v)\n", im.Index.Digest, im.Manifest, len(im.Image) > 0)
+		}
+		fmt.Printf("imported artifacts are held by lease %s\n", lease.ID)
+		return nil
+	},
+}
@@ -0,0 +1,29 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/urfave/cli"
+)
+
+// ConfigFlag is the global flag of the config file of the snapshotter, whose local content store is used.
+var ConfigFlag = cli.StringFlag{
+	Name:  internal.ConfigFlagKey,
+	Usage: "path to the config file of the snapshotter, whose local content store and tiers are used",
+	Value: internal.DefaultConfigPath,
+}
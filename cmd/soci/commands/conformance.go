@@ -0,0 +1,197 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/conformance"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+const (
+	ociLayoutFlag   = "oci-layout"
+	imageRefFlag    = "image-ref"
+	verifySpansFlag = "verify-spans"
+	jsonFlag        = "json"
+)
+
+// ConformanceCommand checks a SOCI index and its zTOCs, e.g. produced by another tool,
+// against what the snapshotter expects of them.
+var ConformanceCommand = cli.Command{
+	Name:      "conformance",
+	Usage:     "check that a SOCI index and its ztocs can be used by the snapshotter",
+	ArgsUsage: "[flags] <index_digest>",
+	Description: `Checks the SOCI index and its ztocs against the rules the snapshotter relies on: media types,
+annotations, the flatbuffer layout of ztocs and the invariants of their spans. The artifacts are read
+from the local content store, or from an OCI image layout with --oci-layout.
+
+With --image-ref, the index is checked against the manifest of the image in containerd as well, and
+--verify-spans checks the span digests of the ztocs against the layers of the image. Without
+--image-ref, --verify-spans reads the layers from the OCI image layout.
+
+Exits with an error if a rule is violated.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  ociLayoutFlag,
+			Usage: "OCI image layout directory to read the artifacts from, instead of the local content store",
+		},
+		cli.StringFlag{
+			Name:  imageRefFlag,
+			Usage: "image in containerd which the index is for",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image manifest to check the index against (default: the host platform)",
+		},
+		cli.BoolFlag{
+			Name:  verifySpansFlag,
+			Usage: "check the span digests of the ztocs against the layers, which are read in full",
+		},
+		cli.BoolFlag{
+			Name:  jsonFlag,
+			Usage: "print the report as JSON",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		indexDigest, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return fmt.Errorf("please provide the digest of an index: %w", err)
+		}
+		var store orascontent.Storage
+		if layout := cliContext.String(ociLayoutFlag); layout != "" {
+			store, err = oci.New(layout)
+		} else {
+			store, err = internal.OpenContentStore(cliContext)
+		}
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		size, err := blobSize(ctx, store, indexDigest)
+		if err != nil {
+			return fmt.Errorf("failed to find index %s: %w", indexDigest, err)
+		}
+		indexDesc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    indexDigest,
+			Size:      size,
+		}
+
+		var (
+			opts   []conformance.Option
+			layers orascontent.Fetcher = store
+		)
+		if ref := cliContext.String(imageRefFlag); ref != "" {
+			client, cctx, cancel, err := commands.NewClient(cliContext)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			ctx = cctx
+			cs := client.ContentStore()
+			img, err := client.ImageService().Get(ctx, ref)
+			if err != nil {
+				return err
+			}
+			platform := platforms.Default()
+			if p := cliContext.String("platform"); p != "" {
+				spec, err := platforms.Parse(p)
+				if err != nil {
+					return err
+				}
+				platform = platforms.OnlyStrict(spec)
+			}
+			manifestDesc, err := soci.GetImageManifestDescriptor(ctx, cs, img.Target, platform)
+			if err != nil {
+				return err
+			}
+			manifest, err := images.Manifest(ctx, cs, img.Target, platform)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, conformance.WithImageManifest(*manifestDesc, manifest))
+			layers = contentFetcher{cs}
+		}
+		if cliContext.Bool(verifySpansFlag) {
+			opts = append(opts, conformance.WithLayerFetcher(layers))
+		}
+
+		report, err := conformance.Check(ctx, store, indexDesc, opts...)
+		if err != nil {
+			return err
+		}
+		if cliContext.Bool(jsonFlag) {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+		} else {
+			for _, v := range report.Violations {
+				fmt.Printf("%s\t%s\t%s\n", v.Rule, v.Artifact, v.Message)
+			}
+		}
+		if !report.Passed() {
+			return fmt.Errorf("%d violations in index %s and its %d ztocs", len(report.Violations), indexDigest, report.Ztocs)
+		}
+		if !cliContext.Bool(jsonFlag) {
+			fmt.Printf("index %s and its %d ztocs passed\n", indexDigest, report.Ztocs)
+		}
+		return nil
+	},
+}
+
+// blobSize returns the size of the blob `dgst` of `store`, which is only known from its content.
+func blobSize(ctx context.Context, store orascontent.Fetcher, dgst digest.Digest) (int64, error) {
+	rc, err := store.Fetch(ctx, ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(io.Discard, rc)
+}
+
+// contentFetcher fetches the layers of images from the content store of containerd.
+type contentFetcher struct {
+	cs content.Store
+}
+
+func (f contentFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ra, err := f.cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{content.NewReader(ra), ra}, nil
+}
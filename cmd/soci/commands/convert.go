@@ -0,0 +1,188 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/estargz"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+const (
+	convertToFlag        = "to"
+	estargzChunkSizeFlag = "estargz-chunk-size"
+	alignGzipMembersFlag = "align-gzip-members"
+
+	formatSoci    = "soci"
+	formatEstargz = "estargz"
+)
+
+// ConvertCommand converts images between eStargz and SOCI, so that fleets moving between the stargz
+// snapshotter and the SOCI snapshotter don't need to rebuild their images.
+var ConvertCommand = cli.Command{
+	Name:      "convert",
+	Usage:     "convert images between eStargz and SOCI",
+	ArgsUsage: "[flags] <src_image_ref> [<dst_image_ref>]",
+	Description: `With --to soci, creates the SOCI index of an eStargz image, so that the image can be lazily
+loaded by both snapshotters. eStargz layers are valid tar.gz layers, so the image isn't changed
+and its layers are neither downloaded again nor recompressed; they must be in the content store.
+The files of the zTOCs of the layers are read from their eStargz TOCs.
+
+With --to soci --align-gzip-members, recompresses the layers of any image into gzip members
+holding --span-size uncompressed bytes each, stores the result as <dst_image_ref> and creates
+its SOCI index. Each span of the zTOCs then starts a gzip member, so spans are decompressed
+without the data preceding them. The tar archives of the layers, and so the diff IDs of the
+image, aren't changed.
+
+With --to estargz, converts the layers of an image (e.g. one indexed for SOCI) to eStargz and
+stores the result as <dst_image_ref>. The SOCI index of the source image doesn't apply to the
+converted image, whose layers are different.`,
+	Flags: append(
+		internal.PlatformFlags,
+		cli.StringFlag{
+			Name:  convertToFlag,
+			Usage: fmt.Sprintf("format to convert the image to: %s or %s", formatSoci, formatEstargz),
+		},
+		cli.Int64Flag{
+			Name:  spanSizeFlag,
+			Usage: "Span size that soci index uses to segment layer data (--to soci). Default is 4 MiB",
+			Value: 1 << 22,
+		},
+		cli.Int64Flag{
+			Name:  minLayerSizeFlag,
+			Usage: "Minimum layer size to build zTOC for (--to soci). Default is 10 MiB.",
+			Value: 10 << 20,
+		},
+		layerSpanSizeCliFlag(" (--to soci)"),
+		cli.BoolFlag{
+			Name:  alignGzipMembersFlag,
+			Usage: "Recompress the layers into gzip members aligned to the spans of their zTOCs (--to soci)",
+		},
+		cli.Int64Flag{
+			Name:  estargzChunkSizeFlag,
+			Usage: "Maximum size of the chunks the contents of files are split into (--to estargz). Default is 4 MiB",
+			Value: estargz.DefaultChunkSize,
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		srcRef := cliContext.Args().Get(0)
+		if srcRef == "" {
+			return errors.New("source image needs to be specified")
+		}
+		to := cliContext.String(convertToFlag)
+		if to != formatSoci && to != formatEstargz {
+			return fmt.Errorf("--%s must be %s or %s", convertToFlag, formatSoci, formatEstargz)
+		}
+		dstRef := cliContext.Args().Get(1)
+		align := cliContext.Bool(alignGzipMembersFlag)
+		if (to == formatEstargz || align) && dstRef == "" {
+			return errors.New("destination image needs to be specified")
+		}
+		if align && to != formatSoci {
+			return fmt.Errorf("--%s requires --%s %s", alignGzipMembersFlag, convertToFlag, formatSoci)
+		}
+		// The span size rules match the layers before they are recompressed, so they can't be
+		// applied consistently to the recompressed layers.
+		if align && len(cliContext.StringSlice(layerSpanSizeFlag)) > 0 {
+			return fmt.Errorf("--%s can't be used with --%s", alignGzipMembersFlag, layerSpanSizeFlag)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		srcImg, err := client.ImageService().Get(ctx, srcRef)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, srcImg, cs)
+		if err != nil {
+			return err
+		}
+
+		if to == formatSoci {
+			img := srcImg
+			if align {
+				dstImg, err := converter.Convert(ctx, client, dstRef, srcRef,
+					converter.WithLayerConvertFunc(soci.AlignedLayerConvertFunc(cliContext.Int64(spanSizeFlag))),
+					converter.WithPlatform(platforms.Any(ps...)))
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s: %s\n", dstImg.Name, dstImg.Target.Digest)
+				img = *dstImg
+			} else if err := verifyEstargzImage(ctx, cs, srcImg, ps); err != nil {
+				return err
+			}
+			rules, err := spanSizeRules(cliContext)
+			if err != nil {
+				return err
+			}
+			builderOpts := []soci.BuildOption{
+				soci.WithMinLayerSize(cliContext.Int64(minLayerSizeFlag)),
+				soci.WithSpanSize(cliContext.Int64(spanSizeFlag)),
+				soci.WithSpanSizeRules(rules...),
+				soci.WithBuildToolIdentifier(buildToolIdentifier),
+			}
+			blobStore, err := internal.OpenContentStore(cliContext)
+			if err != nil {
+				return err
+			}
+			return createIndices(ctx, cs, blobStore, img, ps, builderOpts, createOptions{})
+		}
+
+		dstImg, err := converter.Convert(ctx, client, dstRef, srcRef,
+			converter.WithLayerConvertFunc(estargz.LayerConvertFunc(cliContext.Int64(estargzChunkSizeFlag))),
+			converter.WithPlatform(platforms.Any(ps...)))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", dstImg.Name, dstImg.Target.Digest)
+		return nil
+	},
+}
+
+// verifyEstargzImage returns an error unless all the layers of the platforms `ps` of the image `img`
+// are eStargz layers.
+func verifyEstargzImage(ctx context.Context, cs content.Store, img images.Image, ps []ocispec.Platform) error {
+	for _, plat := range ps {
+		manifest, err := images.Manifest(ctx, cs, img.Target, platforms.OnlyStrict(plat))
+		if err != nil {
+			return err
+		}
+		for _, l := range manifest.Layers {
+			if err := estargz.VerifyLayer(ctx, cs, l); err != nil {
+				return fmt.Errorf("image %s is not an eStargz image: %w", img.Name, err)
+			}
+		}
+	}
+	return nil
+}
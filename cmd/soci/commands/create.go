@@ -17,33 +17,61 @@
 package commands
 
 import (
+	"context"
 	"errors"
-	"os"
+	"fmt"
+	"strings"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
-	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
-	"oras.land/oras-go/v2/content/oci"
+	orascontent "oras.land/oras-go/v2/content"
 )
 
 const (
 	buildToolIdentifier = "AWS SOCI CLI v0.1"
 	spanSizeFlag        = "span-size"
 	minLayerSizeFlag    = "min-layer-size"
+	layerSpanSizeFlag   = "layer-span-size"
+	reuseZtocsFlag      = "reuse-ztocs"
+	reuseIndexFlag      = "reuse-index"
+	indexPackagingFlag  = "index-packaging"
+	artifactTypeFlag    = "artifact-type"
+	annotationFlag      = "annotation"
 )
 
 // CreateCommand creates SOCI index for an image
 // Output of this command is SOCI layers and SOCI index stored in a local directory
 // SOCI layer is named as <image-layer-digest>.soci.layer
 // SOCI index is named as <image-manifest-digest>.soci.index
+// For a multi-architecture image, a SOCI index list referencing the SOCI index of every
+// platform is created as well
 var CreateCommand = cli.Command{
 	Name:      "create",
 	Usage:     "create SOCI index",
 	ArgsUsage: "[flags] <image_ref>",
-	Flags: append(
+	Description: `Creates a SOCI index for the given platforms of an image (the default platform if none is given).
+For a multi-architecture image, use --all-platforms or repeat --platform to create the SOCI indices
+of several platforms at once. An OCI image index referencing them (a SOCI index list) is created too,
+so that they can be handled as a single artifact.
+
+When the image is rebuilt with only some of its layers changed, --reuse-ztocs and --reuse-index
+reuse the zTOCs already built for the unchanged layers, so that only the new layers are indexed.
+--reuse-ztocs looks them up in the local SOCI content store, and --reuse-index in a SOCI index
+(or SOCI index list) in a registry, e.g. the one pushed for the previous build of the image.
+
+By default, SOCI indices are packaged as OCI 1.0 image manifests whose config media type is the
+SOCI index artifact type, which every registry accepts. --index-packaging oci-1.1 packages them as
+OCI 1.1 artifacts instead, with an artifactType and an empty config. The snapshotter discovers
+both, so registries can be migrated gradually.`,
+	Flags: append(append(
 		internal.PlatformFlags,
+		commands.RegistryFlags...),
 		cli.Int64Flag{
 			Name:  spanSizeFlag,
 			Usage: "Span size that soci index uses to segment layer data. Default is 4 MiB",
@@ -54,6 +82,29 @@ var CreateCommand = cli.Command{
 			Usage: "Minimum layer size to build zTOC for. Smaller layers won't have zTOC and not lazy pulled. Default is 10 MiB.",
 			Value: 10 << 20,
 		},
+		layerSpanSizeCliFlag(""),
+		cli.BoolFlag{
+			Name:  reuseZtocsFlag,
+			Usage: "Reuse the zTOCs of the local SOCI content store built for layers of the image with the same span size",
+		},
+		cli.StringSliceFlag{
+			Name:  reuseIndexFlag,
+			Usage: "Reuse the zTOCs of the SOCI index (or SOCI index list) with the given reference in a registry. Can be repeated",
+		},
+		cli.StringFlag{
+			Name:  indexPackagingFlag,
+			Usage: fmt.Sprintf("Packaging of the SOCI indices: %s or %s", soci.IndexPackagingLegacy, soci.IndexPackagingOCI11),
+			Value: string(soci.IndexPackagingLegacy),
+		},
+		cli.StringFlag{
+			Name:  artifactTypeFlag,
+			Usage: "Artifact type of the SOCI indices. The snapshotter only discovers SOCI indices with the default artifact type",
+			Value: soci.SociIndexArtifactType,
+		},
+		cli.StringSliceFlag{
+			Name:  annotationFlag,
+			Usage: "Annotation of the form <key>=<value> added to the SOCI indices, e.g. a build ID or a git commit. Can be repeated",
+		},
 	),
 	Action: func(cliContext *cli.Context) error {
 		srcRef := cliContext.Args().Get(0)
@@ -73,57 +124,185 @@ var CreateCommand = cli.Command{
 		if err != nil {
 			return err
 		}
-		spanSize := cliContext.Int64(spanSizeFlag)
-		minLayerSize := cliContext.Int64(minLayerSizeFlag)
-		// Creating the snapshotter's root path first if it does not exist, since this ensures, that
-		// it has the limited permission set as drwx--x--x.
-		// The subsequent oci.New creates a root path dir with too broad permission set.
-		if _, err := os.Stat(config.DefaultSociSnapshotterRootPath); os.IsNotExist(err) {
-			if err = os.Mkdir(config.DefaultSociSnapshotterRootPath, 0711); err != nil {
-				return err
-			}
-		} else if err != nil {
+		ps, err := internal.GetPlatforms(ctx, cliContext, srcImg, cs)
+		if err != nil {
 			return err
 		}
-		blobStore, err := oci.New(config.DefaultSociContentStorePath)
+		rules, err := spanSizeRules(cliContext)
 		if err != nil {
 			return err
 		}
-
-		ps, err := internal.GetPlatforms(ctx, cliContext, srcImg, cs)
+		builderOpts := []soci.BuildOption{
+			soci.WithMinLayerSize(cliContext.Int64(minLayerSizeFlag)),
+			soci.WithSpanSize(cliContext.Int64(spanSizeFlag)),
+			soci.WithSpanSizeRules(rules...),
+			soci.WithBuildToolIdentifier(buildToolIdentifier),
+			soci.WithProgress(printLayerProgress),
+		}
+		packaging, err := soci.ParseIndexPackaging(cliContext.String(indexPackagingFlag))
 		if err != nil {
 			return err
 		}
-
-		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+		annotations, err := parseAnnotations(cliContext.StringSlice(annotationFlag))
 		if err != nil {
 			return err
 		}
-
-		builderOpts := []soci.BuildOption{
-			soci.WithMinLayerSize(minLayerSize),
-			soci.WithSpanSize(spanSize),
-			soci.WithBuildToolIdentifier(buildToolIdentifier),
+		builderOpts = append(builderOpts,
+			soci.WithIndexPackaging(packaging),
+			soci.WithArtifactType(cliContext.String(artifactTypeFlag)),
+			soci.WithIndexAnnotations(annotations))
+		opts := createOptions{
+			reuseLocalZtocs: cliContext.Bool(reuseZtocsFlag),
+			annotations:     annotations,
 		}
-
-		for _, plat := range ps {
-			builder, err := soci.NewIndexBuilder(cs, blobStore, artifactsDb, append(builderOpts, soci.WithPlatform(plat))...)
-
+		for _, ref := range cliContext.StringSlice(reuseIndexFlag) {
+			source, err := remoteZtocSource(ctx, cliContext, ref)
 			if err != nil {
 				return err
 			}
+			opts.ztocSources = append(opts.ztocSources, source)
+		}
+		blobStore, err := internal.OpenContentStore(cliContext)
+		if err != nil {
+			return err
+		}
+		return createIndices(ctx, cs, blobStore, srcImg, ps, builderOpts, opts)
+	},
+}
 
-			sociIndexWithMetadata, err := builder.Build(ctx, srcImg)
-			if err != nil {
-				return err
-			}
+// layerSpanSizeCliFlag is the flag overriding the span size of some layers. `note` is appended to its usage.
+func layerSpanSizeCliFlag(note string) cli.StringSliceFlag {
+	return cli.StringSliceFlag{
+		Name: layerSpanSizeFlag,
+		Usage: "Span size of the layers matching a rule of the form [media-type=<media type>,][min-layer-size=<bytes>,]span-size=<bytes>" +
+			note + ", instead of --span-size. Can be repeated; the first matching rule applies",
+	}
+}
 
-			err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore, builder.ArtifactsDb)
-			if err != nil {
-				return err
-			}
+// spanSizeRules returns the span size rules of the --layer-span-size flags.
+func spanSizeRules(cliContext *cli.Context) ([]soci.SpanSizeRule, error) {
+	var rules []soci.SpanSizeRule
+	for _, s := range cliContext.StringSlice(layerSpanSizeFlag) {
+		rule, err := soci.ParseSpanSizeRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// createOptions holds the options of createIndices which aren't build options of soci indices.
+type createOptions struct {
+	// reuseLocalZtocs reuses the zTOCs of the local SOCI content store (--reuse-ztocs).
+	reuseLocalZtocs bool
+	// ztocSources are the zTOC sources of the --reuse-index flags.
+	ztocSources []soci.ZtocSource
+	// annotations are added to the SOCI index list.
+	annotations map[string]string
+}
+
+// parseAnnotations parses the <key>=<value> annotations of the --annotation flags.
+func parseAnnotations(flags []string) (map[string]string, error) {
+	annotations := make(map[string]string, len(flags))
+	for _, f := range flags {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid annotation %q, expected <key>=<value>", f)
 		}
+		annotations[k] = v
+	}
+	return annotations, nil
+}
+
+// remoteZtocSource returns the zTOC source of the SOCI index (or SOCI index list) `ref` in a registry.
+func remoteZtocSource(ctx context.Context, cliContext *cli.Context, ref string) (soci.ZtocSource, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := internal.NewRepository(cliContext, refspec)
+	if err != nil {
+		return nil, err
+	}
+	object := refspec.Object
+	if dgst := refspec.Digest(); dgst != "" {
+		object = dgst.String()
+	}
+	desc, err := repo.Resolve(ctx, object)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve soci index %s: %w", ref, err)
+	}
+	indices, err := soci.FetchIndices(ctx, repo, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch soci index %s: %w", ref, err)
+	}
+	return soci.NewIndexZtocSource(repo, indices...), nil
+}
+
+// createIndices creates and stores the SOCI indices of the platforms `ps` of the image `img`,
+// and the SOCI index list referencing them if the image is multi-platform.
+// printLayerProgress prints the zTOC of each layer, or why the layer was skipped.
+func printLayerProgress(p soci.LayerProgress) {
+	switch {
+	case p.Ztoc == nil:
+		fmt.Printf("ztoc skipped - layer %s (%s) %s\n", p.Layer.Digest, p.Layer.MediaType, p.SkipReason)
+	case p.Reused:
+		fmt.Printf("layer %s -> ztoc %s (reused)\n", p.Layer.Digest, p.Ztoc.Digest)
+	default:
+		fmt.Printf("layer %s -> ztoc %s\n", p.Layer.Digest, p.Ztoc.Digest)
+	}
+}
+
+func createIndices(ctx context.Context, cs content.Store, blobStore orascontent.Storage, img images.Image, ps []ocispec.Platform, builderOpts []soci.BuildOption, opts createOptions) error {
+	artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+	if err != nil {
+		return err
+	}
 
+	var sources []soci.ZtocSource
+	if opts.reuseLocalZtocs {
+		sources = append(sources, soci.NewArtifactsDbZtocSource(artifactsDb, blobStore))
+	}
+	builderOpts = append(builderOpts, soci.WithZtocSources(append(sources, opts.ztocSources...)...))
+
+	var indices []*soci.IndexWithMetadata
+	for _, plat := range ps {
+		builder, err := soci.NewIndexBuilder(cs, blobStore, artifactsDb, append(builderOpts, soci.WithPlatform(plat))...)
+
+		if err != nil {
+			return err
+		}
+
+		sociIndexWithMetadata, err := builder.Build(ctx, img)
+		if err != nil {
+			return err
+		}
+
+		err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore, builder.ArtifactsDb)
+		if err != nil {
+			return err
+		}
+		indices = append(indices, sociIndexWithMetadata)
+	}
+
+	if !images.IsIndexType(img.Target.MediaType) {
 		return nil
-	},
+	}
+	listAnnotations := map[string]string{
+		soci.IndexAnnotationBuildToolIdentifier: buildToolIdentifier,
+	}
+	for k, v := range opts.annotations {
+		listAnnotations[k] = v
+	}
+	indexList, err := soci.NewIndexList(indices, img.Target.Digest, listAnnotations)
+	if err != nil {
+		return err
+	}
+	desc, err := soci.WriteSociIndexList(ctx, indexList, blobStore, artifactsDb)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("soci index list: %s\n", desc.Digest)
+	return nil
 }
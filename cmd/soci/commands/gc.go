@@ -0,0 +1,164 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+const (
+	dryRunFlag = "dry-run"
+	// gcRefContentLabel is the prefix of the labels by which containerd keeps the content they reference.
+	gcRefContentLabel = "containerd.io/gc.ref.content"
+)
+
+var GCCommand = cli.Command{
+	Name:  "gc",
+	Usage: "remove the indices and ztocs of images which were removed from containerd",
+	Description: `remove the indices whose image manifest was removed from the content store of containerd in every namespace,
+and the ztocs which aren't referenced by any remaining index, from the artifacts database and the local content store.
+Index lists are removed once their multi-architecture image is removed, and keep the indices they reference until then.
+Containerd keeps the manifest of an image as long as the image exists or is held by a lease (e.g. while it is pulled),
+so the indices are removed once their image is removed and garbage collected by containerd, e.g. by "nerdctl image prune".
+The indices of image manifests held by a lease are kept even if the manifests aren't in the content store yet, e.g. after
+'soci bundle import', and so are indices held by a lease or referenced by a garbage collection label of containerd. Image layers imported from bundles are removed along with the last index of their image.
+Pinned indices and ztocs are never removed.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  dryRunFlag,
+			Usage: "only print the indices and ztocs which would be removed",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		nss, err := client.NamespaceService().List(ctx)
+		if err != nil {
+			return err
+		}
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		// What's live is gathered from containerd once, before the artifacts database is locked.
+		live, err := liveContent(ctx, client.ContentStore(), nss)
+		if err != nil {
+			return err
+		}
+		leased, err := leasedContent(ctx, client.LeasesService(), nss)
+		if err != nil {
+			return err
+		}
+		for dgst := range leased {
+			live[dgst] = struct{}{}
+		}
+		isLive := func(ae *soci.ArtifactEntry) (bool, error) {
+			if ae.OriginalDigest == "" {
+				return true, nil
+			}
+			_, manifestLive := live[digest.Digest(ae.OriginalDigest)]
+			_, artifactLive := live[digest.Digest(ae.Digest)]
+			return manifestLive || artifactLive, nil
+		}
+		dryRun := cliContext.Bool(dryRunFlag)
+		blobStorePaths, err := internal.BlobStorePaths(cliContext)
+		if err != nil {
+			return err
+		}
+		result, err := db.GarbageCollect(ctx, blobStorePaths, isLive, dryRun)
+		if err != nil {
+			return err
+		}
+		action := "removed"
+		if dryRun {
+			action = "would remove"
+		}
+		for _, dgst := range result.RemovedIndexLists {
+			fmt.Printf("%s index list %s\n", action, dgst)
+		}
+		for _, dgst := range result.RemovedIndexes {
+			fmt.Printf("%s index %s\n", action, dgst)
+		}
+		for _, dgst := range result.RemovedZtocs {
+			fmt.Printf("%s ztoc %s\n", action, dgst)
+		}
+		for _, dgst := range result.RemovedImageBlobs {
+			fmt.Printf("%s image blob %s\n", action, dgst)
+		}
+		return nil
+	},
+}
+
+// liveContent returns the digests of the content in the content store of any of the namespaces `nss`,
+// and of the content referenced by their garbage collection labels, e.g. a SOCI index referenced by
+// the image which owns it.
+func liveContent(ctx context.Context, cs content.Store, nss []string) (map[digest.Digest]struct{}, error) {
+	live := make(map[digest.Digest]struct{})
+	for _, ns := range nss {
+		err := cs.Walk(namespaces.WithNamespace(ctx, ns), func(info content.Info) error {
+			live[info.Digest] = struct{}{}
+			for k, v := range info.Labels {
+				if strings.HasPrefix(k, gcRefContentLabel) {
+					live[digest.Digest(v)] = struct{}{}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk the content of namespace %s: %w", ns, err)
+		}
+	}
+	return live, nil
+}
+
+// leasedContent returns the digests of the content held by the leases of any of the namespaces `nss`.
+func leasedContent(ctx context.Context, lm leases.Manager, nss []string) (map[digest.Digest]struct{}, error) {
+	leased := make(map[digest.Digest]struct{})
+	for _, ns := range nss {
+		ctx := namespaces.WithNamespace(ctx, ns)
+		ls, err := lm.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the leases of namespace %s: %w", ns, err)
+		}
+		for _, l := range ls {
+			resources, err := lm.ListResources(ctx, l)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list the resources of lease %s: %w", l.ID, err)
+			}
+			for _, r := range resources {
+				if r.Type == "content" {
+					leased[digest.Digest(r.ID)] = struct{}{}
+				}
+			}
+		}
+	}
+	return leased, nil
+}
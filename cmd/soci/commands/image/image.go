@@ -23,5 +23,6 @@ var Command = cli.Command{
 	Usage: "manage images",
 	Subcommands: []cli.Command{
 		rpullCommand,
+		listIndexedCommand,
 	},
 }
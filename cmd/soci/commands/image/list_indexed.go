@@ -0,0 +1,218 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+const (
+	remoteFlag     = "remote"
+	incompleteFlag = "incomplete"
+)
+
+// listIndexedCommand reports the SOCI coverage of the images of the containerd image store.
+var listIndexedCommand = cli.Command{
+	Name:      "list-indexed",
+	Usage:     "report which local images have SOCI indices and how many of their layers are indexed",
+	ArgsUsage: "[flags] [<filter>, ...]",
+	Description: `Lists the images of the containerd image store, optionally filtered like "ctr images list",
+with the SOCI index of each of their platforms, the number of layers indexed out of the total and
+the size of the layers indexed out of the total. Indices are looked up in the local SOCI store, and
+also in the registry of the images with --remote if there is no local index.`,
+	Flags: append(append(
+		commands.RegistryFlags,
+		internal.PlatformFlags...),
+		cli.BoolFlag{
+			Name:  remoteFlag,
+			Usage: "look up the indices of images without a local index in their registry",
+		},
+		cli.BoolFlag{
+			Name:  incompleteFlag,
+			Usage: "only list the images which have layers without a ztoc",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		imgs, err := client.ImageService().List(ctx, cliContext.Args()...)
+		if err != nil {
+			return fmt.Errorf("failed to list images: %w", err)
+		}
+		sort.Slice(imgs, func(i, j int) bool {
+			return imgs[i].Name < imgs[j].Name
+		})
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		store, err := internal.OpenContentStore(cliContext)
+		if err != nil {
+			return err
+		}
+
+		cs := client.ContentStore()
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("IMAGE REF\tPLATFORM\tSOCI INDEX\tSOURCE\tLAYERS INDEXED\tBYTES INDEXED\tCOVERAGE\t\n"))
+		for _, img := range imgs {
+			ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+			if err != nil {
+				return err
+			}
+			for _, platform := range ps {
+				manifestDesc, err := soci.GetImageManifestDescriptor(ctx, cs, img.Target, platforms.OnlyStrict(platform))
+				if err != nil {
+					// Images are often only available locally for some of their platforms.
+					continue
+				}
+				manifest, err := readManifest(ctx, cs, *manifestDesc)
+				if err != nil {
+					return fmt.Errorf("failed to read manifest of image %s: %w", img.Name, err)
+				}
+
+				source := "local"
+				indexDesc, index, err := localIndex(ctx, cs, db, store, img, platform)
+				if err != nil {
+					return fmt.Errorf("failed to read SOCI index of image %s: %w", img.Name, err)
+				}
+				if index == nil && cliContext.Bool(remoteFlag) {
+					source = "remote"
+					indexDesc, index, err = remoteIndex(ctx, cliContext, img.Name, *manifestDesc)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "failed to look up the SOCI index of image %s in its registry: %v\n", img.Name, err)
+					}
+				}
+
+				coverage := soci.NewCoverage(manifest, index)
+				if cliContext.Bool(incompleteFlag) && coverage.IndexedLayers == coverage.Layers {
+					continue
+				}
+				indexDigest := "-"
+				if index == nil {
+					source = "-"
+				} else {
+					indexDigest = indexDesc.Digest.String()
+				}
+				writer.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%d/%d\t%d/%d\t%.1f%%\t\n",
+					img.Name,
+					platforms.Format(platform),
+					indexDigest,
+					source,
+					coverage.IndexedLayers, coverage.Layers,
+					coverage.IndexedSize, coverage.Size,
+					percent(coverage.IndexedSize, coverage.Size),
+				)))
+			}
+		}
+		writer.Flush()
+		return nil
+	},
+}
+
+func readManifest(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Manifest, error) {
+	var manifest ocispec.Manifest
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(b, &manifest)
+	return manifest, err
+}
+
+// localIndex returns the most recent SOCI index of the platform of img in the local SOCI store,
+// or a nil index if there is none.
+func localIndex(ctx context.Context, cs content.Store, db *soci.ArtifactsDb, store orascontent.ReadOnlyStorage, img images.Image, platform ocispec.Platform) (ocispec.Descriptor, *soci.Index, error) {
+	descs, _, err := soci.GetIndexDescriptorCollection(ctx, cs, db, img, []ocispec.Platform{platform})
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	var latest *soci.IndexDescriptorInfo
+	for i, desc := range descs {
+		if desc.MediaType == ocispec.MediaTypeImageIndex {
+			continue
+		}
+		if latest == nil || desc.CreatedAt.After(latest.CreatedAt) {
+			latest = &descs[i]
+		}
+	}
+	if latest == nil {
+		return ocispec.Descriptor{}, nil, nil
+	}
+	rc, err := store.Fetch(ctx, latest.Descriptor)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer rc.Close()
+	index, err := soci.NewIndexFromReader(rc)
+	return latest.Descriptor, index, err
+}
+
+// remoteIndex returns the SOCI index of the image manifest of ref in its registry,
+// selected like the snapshotter selects it, or a nil index if there is none.
+func remoteIndex(ctx context.Context, cliContext *cli.Context, ref string, manifestDesc ocispec.Descriptor) (ocispec.Descriptor, *soci.Index, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	repo, err := internal.NewRepository(cliContext, refspec)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	desc, err := fs.NewOCIArtifactClient(repo).SelectReferrer(ctx, ocispec.Descriptor{Digest: manifestDesc.Digest}, fs.SelectFirstPolicy)
+	if errors.Is(err, fs.ErrNoReferrers) {
+		return ocispec.Descriptor{}, nil, nil
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	rc, err := repo.Fetch(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer rc.Close()
+	index, err := soci.NewIndexFromReader(rc)
+	return desc, index, err
+}
+
+func percent(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
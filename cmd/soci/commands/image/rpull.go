@@ -51,6 +51,7 @@ import (
 const (
 	remoteSnapshotterName = "soci"
 	skipContentVerifyOpt  = "skip-content-verify"
+	prefetchOpt           = "prefetch"
 )
 
 // rpullCommand is a subcommand to pull an image from a registry levaraging soci snapshotter
@@ -80,6 +81,10 @@ command.
 			Name:  internal.PlatformFlagKey,
 			Usage: "The platform to pull.",
 		},
+		cli.StringFlag{
+			Name:  prefetchOpt,
+			Usage: "The percentage of each layer to fetch when it's mounted, e.g. 25%. Overrides the snapshotter's prefetch_percent.",
+		},
 	),
 	Action: func(context *cli.Context) error {
 		var (
@@ -121,6 +126,13 @@ command.
 
 		config.platform = context.String(internal.PlatformFlagKey)
 
+		if prefetch := context.String(prefetchOpt); prefetch != "" {
+			if _, err := source.ParsePrefetchPercent(prefetch); err != nil {
+				return err
+			}
+			config.prefetch = prefetch
+		}
+
 		return pull(ctx, client, ref, config)
 	},
 }
@@ -131,6 +143,7 @@ type rPullConfig struct {
 	snapshotter string
 	indexDigest string
 	platform    string
+	prefetch    string
 }
 
 func pull(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) error {
@@ -144,6 +157,10 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 
 	log.G(pCtx).WithField("image", ref).Debug("fetching")
 	labels := commands.LabelArgs(config.Labels)
+	wrapper := ctdsnapshotters.AppendInfoHandlerWrapper(ref)
+	if config.prefetch != "" {
+		wrapper = source.AppendPrefetchLabelHandlerWrapper(config.prefetch, wrapper)
+	}
 	if _, err := client.Pull(pCtx, ref, []containerd.RemoteOpt{
 		containerd.WithPullLabels(labels),
 		containerd.WithResolver(config.Resolver),
@@ -153,8 +170,7 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 		containerd.WithPullUnpack,
 		containerd.WithPlatform(config.platform),
 		containerd.WithPullSnapshotter(config.snapshotter),
-		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(
-			config.indexDigest, ctdsnapshotters.AppendInfoHandlerWrapper(ref))),
+		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(config.indexDigest, wrapper)),
 	}...); err != nil {
 		return err
 	}
@@ -25,5 +25,8 @@ var Command = cli.Command{
 		listCommand,
 		infoCommand,
 		rmCommand,
+		pinCommand,
+		unpinCommand,
+		verifyCommand,
 	},
 }
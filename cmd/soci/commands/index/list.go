@@ -35,12 +35,12 @@ import (
 type filter func(ae *soci.ArtifactEntry) bool
 
 func indexFilter(ae *soci.ArtifactEntry) bool {
-	return ae.Type == soci.ArtifactEntryTypeIndex
+	return ae.Type == soci.ArtifactEntryTypeIndex || ae.Type == soci.ArtifactEntryTypeIndexList
 }
 
 func platformFilter(platform specs.Platform) filter {
 	return func(ae *soci.ArtifactEntry) bool {
-		return indexFilter(ae) && ae.Platform == platforms.Format(platform)
+		return ae.Type == soci.ArtifactEntryTypeIndex && ae.Platform == platforms.Format(platform)
 	}
 }
 
@@ -63,7 +63,7 @@ func anyMatch(fns []filter) filter {
 
 var listCommand = cli.Command{
 	Name:    "list",
-	Usage:   "list indices",
+	Usage:   "list indices and index lists",
 	Aliases: []string{"ls"},
 	Flags: []cli.Flag{
 		cli.StringFlag{
@@ -116,6 +116,9 @@ var listCommand = cli.Command{
 
 			cs := client.ContentStore()
 			var filters []filter
+			if images.IsIndexType(img.Target.MediaType) && !cliContext.IsSet("platform") {
+				filters = append(filters, originalDigestFilter(img.Target.Digest.String()))
+			}
 			for _, plat := range plats {
 				desc, err := soci.GetImageManifestDescriptor(ctx, cs, img.Target, platforms.OnlyStrict(plat))
 				if err != nil {
@@ -155,7 +158,7 @@ var listCommand = cli.Command{
 		}
 
 		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
-		writer.Write([]byte("DIGEST\tSIZE\tIMAGE REF\tPLATFORM\tMEDIA TYPE\tCREATED\t\n"))
+		writer.Write([]byte("DIGEST\tSIZE\tIMAGE REF\tPLATFORM\tMEDIA TYPE\tCREATED\tPINNED\t\n"))
 
 		for _, ae := range artifacts {
 			imgs, _ := is.List(ctx, fmt.Sprintf("target.digest==%s", ae.ImageDigest))
@@ -174,13 +177,14 @@ var listCommand = cli.Command{
 
 func writeArtifactEntry(w io.Writer, ae *soci.ArtifactEntry, imageRef string) {
 	w.Write([]byte(fmt.Sprintf(
-		"%s\t%d\t%s\t%s\t%s\t%s\t\n",
+		"%s\t%d\t%s\t%s\t%s\t%s\t%t\t\n",
 		ae.Digest,
 		ae.Size,
 		imageRef,
 		ae.Platform,
 		ae.MediaType,
 		getDuration(ae.CreatedAt),
+		ae.Pinned,
 	)))
 }
 
@@ -0,0 +1,140 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+const adminAddressFlag = "admin-address"
+
+var adminAddressCliFlag = cli.StringFlag{
+	Name:  adminAddressFlag,
+	Usage: "address of the discovery socket of the snapshotter (discovery_address), to pin the cached spans of the indices too",
+}
+
+var pinCommand = cli.Command{
+	Name:  "pin",
+	Usage: "pin indices",
+	Description: `pin indices and their ztocs, so that they can't be removed until they are unpinned.
+This is meant for images which must always be lazily loaded, e.g. golden images which must start instantly.
+With --admin-address, the snapshotter keeps the cached spans of the layers of the indices too.`,
+	ArgsUsage: "<digest> [<digest>...]",
+	Flags:     []cli.Flag{adminAddressCliFlag},
+	Action: func(cliContext *cli.Context) error {
+		args := cliContext.Args()
+		if len(args) == 0 {
+			return fmt.Errorf("please provide at least one index digest")
+		}
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		store, err := internal.OpenContentStore(cliContext)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cliContext.GlobalDuration("timeout"))
+		defer cancel()
+		for _, arg := range args {
+			dgst, err := digest.Parse(arg)
+			if err != nil {
+				return err
+			}
+			if err := db.PinIndex(ctx, store, dgst.String()); err != nil {
+				return err
+			}
+			if address := cliContext.String(adminAddressFlag); address != "" {
+				if err := pinSpans(ctx, address, http.MethodPost, dgst); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
+
+var unpinCommand = cli.Command{
+	Name:        "unpin",
+	Usage:       "unpin indices",
+	Description: "unpin indices pinned with \"soci index pin\", so that they can be removed again",
+	ArgsUsage:   "<digest> [<digest>...]",
+	Flags:       []cli.Flag{adminAddressCliFlag},
+	Action: func(cliContext *cli.Context) error {
+		args := cliContext.Args()
+		if len(args) == 0 {
+			return fmt.Errorf("please provide at least one index digest")
+		}
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		for _, arg := range args {
+			dgst, err := digest.Parse(arg)
+			if err != nil {
+				return err
+			}
+			if err := db.UnpinIndex(dgst.String()); err != nil {
+				return err
+			}
+			if address := cliContext.String(adminAddressFlag); address != "" {
+				if err := pinSpans(context.Background(), address, http.MethodDelete, dgst); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// pinSpans pins (POST) or unpins (DELETE) the cached spans of the index `dgst` in the snapshotter
+// whose discovery socket is at address.
+func pinSpans(ctx context.Context, address, method string, dgst digest.Digest) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", address)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost/pins?digest="+url.QueryEscape(dgst.String()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach the snapshotter at %q: %w", address, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("failed to pin the spans of index %s: %s: %s", dgst, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
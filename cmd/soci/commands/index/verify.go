@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci/conformance"
+	"github.com/awslabs/soci-snapshotter/util/containerdutil"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+const (
+	samplesFlag = "samples"
+	jsonFlag    = "json"
+
+	defaultSamples = 16
+)
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify an index against the layers of an image in a registry",
+	ArgsUsage: "[flags] <image_ref> <index_digest>",
+	Description: `Verifies that a SOCI index, e.g. produced by a third party, can be trusted to lazily load the
+image: the index and its ztocs are fetched from the repository of the image and checked like
+"soci conformance" does, then sampled spans of each ztoc are read from the layers in the registry
+with range requests. The digests of the spans are verified, the spans are decompressed from the
+checkpoints of the ztoc, and the regular files starting in them are checked against their tar headers.
+
+The layers are not pulled: only the sampled spans are fetched. Use --samples 0 to check every span.
+
+Exits with an error if a check fails.`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image manifest to verify the index against (default: the host platform)",
+		},
+		cli.IntFlag{
+			Name:  samplesFlag,
+			Usage: "number of spans of each ztoc to read from its layer, including the first and last one. 0 checks every span",
+			Value: defaultSamples,
+		},
+		cli.BoolFlag{
+			Name:  jsonFlag,
+			Usage: "print the report as JSON",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		if len(cliContext.Args()) != 2 {
+			return fmt.Errorf("please provide an image reference and the digest of an index")
+		}
+		refspec, err := reference.Parse(cliContext.Args()[0])
+		if err != nil {
+			return err
+		}
+		indexDigest, err := digest.Parse(cliContext.Args()[1])
+		if err != nil {
+			return fmt.Errorf("please provide the digest of an index: %w", err)
+		}
+		platform := platforms.Default()
+		if p := cliContext.String("platform"); p != "" {
+			spec, err := platforms.Parse(p)
+			if err != nil {
+				return err
+			}
+			platform = platforms.OnlyStrict(spec)
+		}
+
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+		repo, err := internal.NewRepository(cliContext, refspec)
+		if err != nil {
+			return err
+		}
+		object := refspec.Object
+		if dgst := refspec.Digest(); dgst != "" {
+			object = dgst.String()
+		}
+		imageDesc, err := repo.Resolve(ctx, object)
+		if err != nil {
+			return fmt.Errorf("failed to resolve image %s: %w", refspec, err)
+		}
+		manifestDesc, manifest, err := containerdutil.ResolveManifest(ctx, repo, imageDesc, platform)
+		if err != nil {
+			return fmt.Errorf("failed to fetch image manifest of %s: %w", refspec, err)
+		}
+		indexDesc, err := repo.Resolve(ctx, indexDigest.String())
+		if err != nil {
+			return fmt.Errorf("failed to resolve index %s: %w", indexDigest, err)
+		}
+
+		var blobs []*internal.RemoteBlob
+		layers := func(ctx context.Context, layer ocispec.Descriptor) (io.ReaderAt, error) {
+			blob := internal.NewRemoteBlob(ctx, repo, refspec, layer.Digest)
+			blobs = append(blobs, blob)
+			return blob, nil
+		}
+		report, err := conformance.Check(ctx, repo, indexDesc,
+			conformance.WithImageManifest(manifestDesc, manifest),
+			conformance.WithLayerReader(layers, cliContext.Int(samplesFlag)))
+		if err != nil {
+			return err
+		}
+
+		if cliContext.Bool(jsonFlag) {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+		} else {
+			for _, v := range report.Violations {
+				fmt.Printf("%s\t%s\t%s\n", v.Rule, v.Artifact, v.Message)
+			}
+		}
+		if !report.Passed() {
+			return fmt.Errorf("%d violations in index %s and its %d ztocs", len(report.Violations), indexDigest, report.Ztocs)
+		}
+		if !cliContext.Bool(jsonFlag) {
+			var (
+				requests int
+				fetched  int64
+			)
+			for _, blob := range blobs {
+				requests += blob.Requests
+				fetched += blob.Fetched
+			}
+			fmt.Printf("index %s and its %d ztocs verified: %d spans checked with %d range requests (%d bytes)\n",
+				indexDigest, report.Ztocs, report.SampledSpans, requests, fetched)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	dockercliconfig "github.com/docker/cli/cli/config"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// NewRepository returns the remote repository of refspec, authenticated with the
+// credentials of the `--user` flag or of the docker config file.
+func NewRepository(cliContext *cli.Context, refspec reference.Spec) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(refspec.Locator)
+	if err != nil {
+		return nil, err
+	}
+	authClient := auth.DefaultClient
+
+	var username string
+	var secret string
+	if cliContext.IsSet("user") {
+		username = cliContext.String("user")
+		if i := strings.IndexByte(username, ':'); i > 0 {
+			secret = username[i+1:]
+			username = username[0:i]
+		}
+	} else {
+		cf := dockercliconfig.LoadDefaultConfigFile(io.Discard)
+		if cf.ContainsAuth() {
+			if ac, err := cf.GetAuthConfig(refspec.Hostname()); err == nil {
+				username = ac.Username
+				secret = ac.Password
+			}
+		}
+	}
+
+	authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
+		return auth.Credential{
+			Username: username,
+			Password: secret,
+		}, nil
+	}
+
+	repo.Client = authClient
+	repo.PlainHTTP = cliContext.Bool("plain-http")
+	return repo, nil
+}
+
+// RemoteBlob reads ranges of a blob of a remote repository with range requests,
+// so that extracting a file only fetches the spans containing it.
+type RemoteBlob struct {
+	ctx    context.Context
+	client remote.Client
+	url    string
+
+	// Requests and Fetched count the range requests and the bytes they fetched.
+	Requests int
+	Fetched  int64
+}
+
+// NewRemoteBlob returns the blob `dgst` of the repository `repo` of `refspec`.
+func NewRemoteBlob(ctx context.Context, repo *remote.Repository, refspec reference.Spec, dgst digest.Digest) *RemoteBlob {
+	scheme := "https"
+	if repo.PlainHTTP {
+		scheme = "http"
+	}
+	host, repository, _ := strings.Cut(refspec.Locator, "/")
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	return &RemoteBlob{
+		ctx:    ctx,
+		client: repo.Client,
+		url:    fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, host, repository, dgst),
+	}
+}
+
+func (b *RemoteBlob) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status code of range request to %s: %v", b.url, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	b.Requests++
+	b.Fetched += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
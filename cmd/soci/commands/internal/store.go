@@ -0,0 +1,94 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	socistore "github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+const (
+	// ConfigFlagKey is the global flag of the config file of the snapshotter, whose local content store is used.
+	ConfigFlagKey = "config"
+	// DefaultConfigPath is the default config file of the snapshotter.
+	DefaultConfigPath = "/etc/soci-snapshotter-grpc/config.toml"
+)
+
+// snapshotterRoot is the directory of the filesystem of the snapshotter in its default root directory,
+// where the placements of the content store tiers are recorded.
+var snapshotterRoot = filepath.Join(config.DefaultSociSnapshotterRootPath, "soci")
+
+// LoadConfig returns the config of the filesystem of the snapshotter from the file of the global
+// config flag. The default config file may be missing.
+func LoadConfig(cliContext *cli.Context) (config.Config, error) {
+	var cfg config.Config
+	path := cliContext.GlobalString(ConfigFlagKey)
+	tree, err := toml.LoadFile(path)
+	if err != nil && !(os.IsNotExist(err) && path == DefaultConfigPath) {
+		return cfg, fmt.Errorf("failed to load snapshotter config %s: %w", path, err)
+	}
+	if err == nil {
+		if err := tree.Unmarshal(&cfg); err != nil {
+			return cfg, fmt.Errorf("failed to unmarshal snapshotter config %s: %w", path, err)
+		}
+	}
+	if cfg.ContentStorePath == "" {
+		cfg.ContentStorePath = config.DefaultSociContentStorePath
+	}
+	return cfg, nil
+}
+
+// OpenContentStore returns SOCIs local content store as the snapshotter configures it,
+// so that the artifacts placed in any of its tiers are found.
+func OpenContentStore(cliContext *cli.Context) (orascontent.Storage, error) {
+	cfg, err := LoadConfig(cliContext)
+	if err != nil {
+		return nil, err
+	}
+	// Creating the snapshotter's root path first if it does not exist, since this ensures, that
+	// it has the limited permission set as drwx--x--x.
+	// The subsequent oci.New creates a root path dir with too broad permission set.
+	if _, err := os.Stat(config.DefaultSociSnapshotterRootPath); os.IsNotExist(err) {
+		if err = os.Mkdir(config.DefaultSociSnapshotterRootPath, 0711); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	store, err := socistore.OpenLocalStore(snapshotterRoot, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open local content store: %w", err)
+	}
+	return store, nil
+}
+
+// BlobStorePaths returns the directories of the blobs of SOCIs local content store as the
+// snapshotter configures it, one for each of its tiers.
+func BlobStorePaths(cliContext *cli.Context) ([]string, error) {
+	cfg, err := LoadConfig(cliContext)
+	if err != nil {
+		return nil, err
+	}
+	return socistore.LocalBlobPaths(cfg), nil
+}
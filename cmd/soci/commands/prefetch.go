@@ -0,0 +1,126 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/urfave/cli"
+)
+
+const defaultPrewarmAddress = "/run/soci-snapshotter-grpc/prewarm.sock"
+
+// PrefetchCommand asks the snapshotter to warm its caches for an image before any container of it is created.
+var PrefetchCommand = cli.Command{
+	Name:      "prefetch",
+	Usage:     "warm the caches of the snapshotter for an image",
+	ArgsUsage: "<image>",
+	Description: `Fetches the SOCI index and ztocs of <image> into the caches of the snapshotter, and optionally
+the contents of its prefetch profile or a percentage of each layer, so that the first container of
+the image starts warm. The caches of the namespace given with --namespace are warmed, unless
+namespaces share their caches. The snapshotter must be configured with prewarm_address.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the prewarm socket of the snapshotter",
+			Value: defaultPrewarmAddress,
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image (default: the platform of the snapshotter)",
+		},
+		cli.StringFlag{
+			Name:  "soci-index-digest",
+			Usage: "digest of the SOCI index of the image (default: discovered from the registry)",
+		},
+		cli.IntFlag{
+			Name:  "prefetch-percent",
+			Usage: "percentage of each layer to prefetch, from 0 to 100",
+		},
+		cli.StringFlag{
+			Name:  "prefetch-profile",
+			Usage: "digest of the prefetch profile whose files are prefetched",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference")
+		}
+		req := fs.PrewarmRequest{
+			Ref:             ref,
+			Platform:        cliContext.String("platform"),
+			IndexDigest:     cliContext.String("soci-index-digest"),
+			PrefetchPercent: cliContext.Int("prefetch-percent"),
+			PrefetchProfile: cliContext.String("prefetch-profile"),
+			Namespace:       cliContext.GlobalString("namespace"),
+		}
+		res, err := prewarm(context.Background(), cliContext.String("address"), req)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("manifest: %s\n", res.ManifestDigest)
+		fmt.Printf("soci index: %s\n", res.IndexDigest)
+		fmt.Printf("layers: %d/%d\n", res.ResolvedLayers, res.Layers)
+		if req.PrefetchPercent > 0 || req.PrefetchProfile != "" {
+			fmt.Printf("prefetched files: %d\n", res.PrefetchedFiles)
+		}
+		return nil
+	},
+}
+
+func prewarm(ctx context.Context, address string, req fs.PrewarmRequest) (fs.PrewarmResult, error) {
+	var res fs.PrewarmResult
+	body, err := json.Marshal(req)
+	if err != nil {
+		return res, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", address)
+			},
+		},
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/prewarm", bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return res, fmt.Errorf("cannot reach the snapshotter at %q: %w", address, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return res, fmt.Errorf("failed to prewarm %s: %s: %s", req.Ref, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, fmt.Errorf("invalid response from the snapshotter: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// PrefetchProfileCommand manages the prefetch profiles passed to the snapshotter with snapshot labels.
+var PrefetchProfileCommand = cli.Command{
+	Name:  "prefetch-profile",
+	Usage: "manage the prefetch profiles of the snapshotter",
+	Subcommands: []cli.Command{
+		prefetchProfileCreateCommand,
+	},
+}
+
+var prefetchProfileCreateCommand = cli.Command{
+	Name:      "create",
+	Usage:     "create a prefetch profile from a list of files and print its digest",
+	ArgsUsage: "<file>",
+	Description: `Creates a prefetch profile of the files listed in <file> (or stdin if <file> is "-"), one path
+relative to the root of the image per line, in the local content store. Empty lines and lines starting
+with # are skipped.
+
+Snapshots labeled with the digest of the profile, with the containerd.io/snapshot/remote/soci/v1/prefetch.profile.digest
+label, fetch the contents of the files of the profile when their layers are mounted.`,
+	Action: func(cliContext *cli.Context) error {
+		file := cliContext.Args().First()
+		if file == "" {
+			return fmt.Errorf("please provide the list of files of the profile")
+		}
+		var r io.Reader = os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var files []string
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			files = append(files, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no files in %s", file)
+		}
+
+		b, err := json.Marshal(soci.NewPrefetchProfile(files))
+		if err != nil {
+			return err
+		}
+		desc := ocispec.Descriptor{
+			MediaType: soci.PrefetchProfileMediaType,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		}
+		store, err := internal.OpenContentStore(cliContext)
+		if err != nil {
+			return err
+		}
+		if err := store.Push(context.Background(), desc, bytes.NewReader(b)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return fmt.Errorf("cannot store prefetch profile: %w", err)
+		}
+		fmt.Println(desc.Digest)
+		return nil
+	},
+}
@@ -20,24 +20,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"sort"
-	"strings"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/fs"
-	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/reference"
-	dockercliconfig "github.com/docker/cli/cli/config"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 	oraslib "oras.land/oras-go/v2"
-	"oras.land/oras-go/v2/content/oci"
 	"oras.land/oras-go/v2/registry/remote"
-	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
 // PushCommand is a command to push an image artifacts from local content store to the remote repository
@@ -102,50 +96,18 @@ if they are available in the snapshotter's local content store.
 			return err
 		}
 
-		dst, err := remote.NewRepository(refspec.Locator)
+		dst, err := internal.NewRepository(cliContext, refspec)
 		if err != nil {
 			return err
 		}
-		authClient := auth.DefaultClient
 
-		var username string
-		var secret string
-		if cliContext.IsSet("user") {
-			username = cliContext.String("user")
-			if i := strings.IndexByte(username, ':'); i > 0 {
-				secret = username[i+1:]
-				username = username[0:i]
-			}
-		} else {
-			cf := dockercliconfig.LoadDefaultConfigFile(io.Discard)
-			if cf.ContainsAuth() {
-				if ac, err := cf.GetAuthConfig(refspec.Hostname()); err == nil {
-					username = ac.Username
-					secret = ac.Password
-				}
-			}
-		}
-
-		authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
-			return auth.Credential{
-				Username: username,
-				Password: secret,
-			}, nil
-		}
-
-		src, err := oci.New(config.DefaultSociContentStorePath)
+		src, err := internal.OpenContentStore(cliContext)
 		if err != nil {
-			return fmt.Errorf("cannot create OCI local store: %w", err)
+			return err
 		}
 
-		dst.Client = authClient
-		dst.PlainHTTP = cliContext.Bool("plain-http")
-
-		debug := cliContext.GlobalBool("debug")
-		if debug {
-			dst.Client = &debugClient{client: authClient}
-		} else {
-			dst.Client = authClient
+		if cliContext.GlobalBool("debug") {
+			dst.Client = &debugClient{client: dst.Client}
 		}
 		existingIndexOption := cliContext.String(internal.ExistingIndexFlagName)
 		if !internal.SupportedArg(existingIndexOption, internal.SupportedExistingIndexOptions) {
@@ -173,6 +135,7 @@ if they are available in the snapshotter's local content store.
 			return nil
 		}
 
+		skipped := false
 		for _, platform := range ps {
 			indexDescriptors, imgManifestDesc, err := soci.GetIndexDescriptorCollection(ctx, cs, artifactsDb, img, []ocispec.Platform{platform})
 			if err != nil {
@@ -209,6 +172,7 @@ if they are available in the snapshotter's local content store.
 						if !quiet {
 							fmt.Printf("%s: skipping pushing artifacts for image manifest: %s\n", foundMessage, imgManifestDesc.Digest.String())
 						}
+						skipped = true
 						continue
 					case internal.Warn:
 						fmt.Printf("[WARN] %s: pushing index anyway\n", foundMessage)
@@ -230,6 +194,30 @@ if they are available in the snapshotter's local content store.
 			}
 
 		}
+
+		// The index list references the indices of all platforms, so it's only pushed along with all of them.
+		if !cliContext.Bool(internal.AllPlatformsFlagKey) || skipped {
+			return nil
+		}
+		listDescriptors, err := soci.GetIndexListDescriptors(artifactsDb, img)
+		if err != nil {
+			return err
+		}
+		if len(listDescriptors) == 0 {
+			return nil
+		}
+		sort.Slice(listDescriptors, func(i, j int) bool {
+			return listDescriptors[i].CreatedAt.Before(listDescriptors[j].CreatedAt)
+		})
+		listDesc := listDescriptors[len(listDescriptors)-1]
+		if quiet {
+			fmt.Println(listDesc.Digest.String())
+		} else {
+			fmt.Printf("pushing soci index list with digest: %v\n", listDesc.Digest)
+		}
+		if err := oraslib.CopyGraph(context.Background(), src, dst, listDesc.Descriptor, options); err != nil {
+			return fmt.Errorf("error pushing graph to remote: %w", err)
+		}
 		return nil
 	},
 }
@@ -17,18 +17,33 @@
 package commands
 
 import (
-	"path/filepath"
+	"fmt"
+	"os"
 
-	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/urfave/cli"
-	"oras.land/oras-go/v2/content/oci"
+)
+
+const (
+	verifyFlag  = "verify"
+	resetDBFlag = "reset-db"
 )
 
 var RebuildDBCommand = cli.Command{
 	Name:  "rebuild-db",
 	Usage: `rebuild the artifacts database. You should use this command after "rpull" so that indices/ztocs can be discovered by commands like "soci index list".`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  verifyFlag,
+			Usage: "validate every index and ztoc in the local content store against its digest and recorded size, removing corrupted blobs and repairing corrupted database entries",
+		},
+		cli.BoolFlag{
+			Name:  resetDBFlag,
+			Usage: "remove the artifacts database and rebuild it from scratch, e.g. if it cannot be opened anymore",
+		},
+	},
 	Action: func(cliContext *cli.Context) error {
 		client, ctx, cancel, err := commands.NewClient(cliContext)
 		if err != nil {
@@ -36,15 +51,38 @@ var RebuildDBCommand = cli.Command{
 		}
 		defer cancel()
 		containerdContentStore := client.ContentStore()
+		if cliContext.Bool(resetDBFlag) {
+			if err := os.Remove(soci.ArtifactsDbPath()); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove the artifacts database: %w", err)
+			}
+		}
 		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
 		if err != nil {
 			return err
 		}
-		blobStore, err := oci.New(config.DefaultSociContentStorePath)
+		blobStore, err := internal.OpenContentStore(cliContext)
 		if err != nil {
 			return err
 		}
-		blobStorePath := filepath.Join(config.DefaultSociContentStorePath, "blobs")
-		return artifactsDb.SyncWithLocalStore(ctx, blobStore, blobStorePath, containerdContentStore)
+		blobStorePaths, err := internal.BlobStorePaths(cliContext)
+		if err != nil {
+			return err
+		}
+		if cliContext.Bool(verifyFlag) {
+			result, err := artifactsDb.VerifyLocalStore(ctx, blobStorePaths)
+			if err != nil {
+				return err
+			}
+			for _, dgst := range result.RemovedBlobs {
+				fmt.Printf("removed corrupted blob %s\n", dgst)
+			}
+			for _, dgst := range result.RemovedEntries {
+				fmt.Printf("removed corrupted database entry %s\n", dgst)
+			}
+			for _, dgst := range result.RepairedEntries {
+				fmt.Printf("repaired database entry %s\n", dgst)
+			}
+		}
+		return artifactsDb.SyncWithLocalStore(ctx, blobStore, blobStorePaths, containerdContentStore)
 	},
 }
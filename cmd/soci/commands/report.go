@@ -0,0 +1,200 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/urfave/cli"
+)
+
+const (
+	// stateDirName is the hidden directory at the root of every lazily loaded layer
+	// which holds a JSON file with the stats of the layer.
+	stateDirName = ".soci-snapshotter"
+
+	bandwidthFlag = "bandwidth"
+)
+
+// layerStats is the content of the stat file of a lazily loaded layer.
+type layerStats struct {
+	Digest          string `json:"digest"`
+	Size            int64  `json:"size"`
+	FetchedSize     int64  `json:"fetchedSize"`
+	FilesTouched    int64  `json:"filesTouched"`
+	SpanCacheHits   int64  `json:"spanCacheHits"`
+	SpanCacheMisses int64  `json:"spanCacheMisses"`
+	Error           string `json:"error,omitempty"`
+}
+
+var ReportCommand = cli.Command{
+	Name:      "report",
+	Usage:     "summarize how much of an image was fetched lazily compared to a full pull",
+	ArgsUsage: "<container-id|snapshot-key>",
+	Description: `Reports, for a running or stopped container (or an active snapshot), the total size of its
+lazily loaded layers, the bytes actually fetched, the number of files touched, span cache hits,
+and the estimated transfer time saved compared to pulling the whole image.
+Layers that were not lazily loaded (e.g. pulled without a SOCI index) are only counted.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "snapshotter",
+			Usage: "snapshotter of the snapshot key, if a snapshot key is given instead of a container ID",
+			Value: "soci",
+		},
+		cli.Float64Flag{
+			Name:  bandwidthFlag,
+			Usage: "registry bandwidth in MiB/s used to estimate the time saved",
+			Value: 100,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		id := cliContext.Args().First()
+		if id == "" {
+			return fmt.Errorf("please provide a container ID or snapshot key")
+		}
+		bandwidth := cliContext.Float64(bandwidthFlag)
+		if bandwidth <= 0 {
+			return fmt.Errorf("--%s must be positive", bandwidthFlag)
+		}
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		snapshotter, key := cliContext.String("snapshotter"), id
+		container, err := client.ContainerService().Get(ctx, id)
+		if err == nil {
+			snapshotter, key = container.Snapshotter, container.SnapshotKey
+		} else if !errdefs.IsNotFound(err) {
+			return err
+		}
+		mounts, err := client.SnapshotService(snapshotter).Mounts(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to get mounts of snapshot %q: %w", key, err)
+		}
+
+		var (
+			stats         []layerStats
+			nonLazyLayers int
+		)
+		for _, dir := range layerDirs(mounts) {
+			s, err := readLayerStats(dir)
+			if errors.Is(err, os.ErrNotExist) {
+				nonLazyLayers++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read stats of layer %q: %w", dir, err)
+			}
+			stats = append(stats, s...)
+		}
+
+		var total layerStats
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("LAYER\tSIZE\tFETCHED\tFILES TOUCHED\tCACHE HITS\tCACHE MISSES\t\n"))
+		for _, s := range stats {
+			writer.Write([]byte(fmt.Sprintf("%s\t%d\t%d\t%d\t%d\t%d\t\n",
+				s.Digest, s.Size, s.FetchedSize, s.FilesTouched, s.SpanCacheHits, s.SpanCacheMisses)))
+			total.Size += s.Size
+			total.FetchedSize += s.FetchedSize
+			total.FilesTouched += s.FilesTouched
+			total.SpanCacheHits += s.SpanCacheHits
+			total.SpanCacheMisses += s.SpanCacheMisses
+		}
+		writer.Flush()
+
+		saved := total.Size - total.FetchedSize
+		fmt.Println()
+		fmt.Printf("lazily loaded layers:  %d (%d other layers)\n", len(stats), nonLazyLayers)
+		fmt.Printf("total size:            %d bytes\n", total.Size)
+		fmt.Printf("fetched:               %d bytes (%.1f%%)\n", total.FetchedSize, percent(total.FetchedSize, total.Size))
+		fmt.Printf("files touched:         %d\n", total.FilesTouched)
+		fmt.Printf("span cache hits:       %d (%.1f%%)\n", total.SpanCacheHits,
+			percent(total.SpanCacheHits, total.SpanCacheHits+total.SpanCacheMisses))
+		fmt.Printf("bandwidth saved:       %d bytes\n", saved)
+		fmt.Printf("estimated time saved:  %v (at %.0f MiB/s)\n",
+			time.Duration(float64(saved)/(bandwidth*(1<<20))*float64(time.Second)).Round(time.Millisecond), bandwidth)
+		return nil
+	},
+}
+
+// layerDirs returns the directories of the layers of a snapshot from its mounts.
+func layerDirs(mounts []mount.Mount) []string {
+	var dirs []string
+	for _, m := range mounts {
+		switch m.Type {
+		case "overlay":
+			for _, o := range m.Options {
+				if strings.HasPrefix(o, "lowerdir=") {
+					dirs = append(dirs, strings.Split(strings.TrimPrefix(o, "lowerdir="), ":")...)
+				}
+			}
+		case "bind":
+			// A writable bind mount is the upper directory of a snapshot without parents, not a layer.
+			for _, o := range m.Options {
+				if o == "ro" {
+					dirs = append(dirs, m.Source)
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+// readLayerStats reads the stats of the lazily loaded layer mounted at dir.
+// It returns os.ErrNotExist if the layer is not lazily loaded.
+func readLayerStats(dir string) ([]layerStats, error) {
+	stateDir := filepath.Join(dir, stateDirName)
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	var stats []layerStats
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(stateDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var s layerStats
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+func percent(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
@@ -23,27 +23,42 @@ import (
 	"io"
 	"os"
 
-	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/containerd/containerd/cmd/ctr/commands"
-	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
-	"oras.land/oras-go/v2/content/oci"
+	orascontent "oras.land/oras-go/v2/content"
 )
 
 var getFileCommand = cli.Command{
 	Name:      "get-file",
-	Usage:     "retrieve a file from a local image layer using a specified ztoc",
+	Usage:     "retrieve a file from a local or remote image layer using a specified ztoc",
 	ArgsUsage: "<digest> <file>",
-	Flags: []cli.Flag{
+	Description: `Extract a file from the layer indexed by a ztoc.
+
+By default the layer is read from the local content store. With --remote, only the
+spans of the layer containing the file are fetched from the repository of the given
+image with range requests, so that the layer doesn't have to be pulled.
+`,
+	Flags: append(commands.RegistryFlags,
 		cli.StringFlag{
 			Name:  "output, o",
 			Usage: "the file to write the extracted content. Defaults to stdout",
 		},
-	},
+		cli.StringFlag{
+			Name:  "remote",
+			Usage: "fetch the layer from the repository of this image reference instead of the local content store",
+		},
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "the digest of the layer indexed by the ztoc. Defaults to the layer recorded in the artifact store",
+		},
+	),
 	Action: func(cliContext *cli.Context) error {
 		if len(cliContext.Args()) != 2 {
 			return errors.New("please provide both a ztoc digest and a filename to extract")
@@ -61,38 +76,59 @@ var getFileCommand = cli.Command{
 		}
 		defer cancel()
 
-		toc, err := getZtoc(ctx, ztocDigest)
+		blobStore, err := internal.OpenContentStore(cliContext)
 		if err != nil {
 			return err
 		}
-
-		layerReader, err := getLayer(ctx, ztocDigest, client.ContentStore())
+		toc, err := getZtoc(ctx, blobStore, ztocDigest)
 		if err != nil {
 			return err
 		}
-		defer layerReader.Close()
 
-		data, err := toc.ExtractFile(io.NewSectionReader(layerReader, 0, int64(toc.CompressedArchiveSize)), file)
+		layerDigest, err := getLayerDigest(cliContext, ztocDigest)
 		if err != nil {
 			return err
 		}
 
+		var data []byte
+		if ref := cliContext.String("remote"); ref != "" {
+			refspec, err := reference.Parse(ref)
+			if err != nil {
+				return err
+			}
+			repo, err := internal.NewRepository(cliContext, refspec)
+			if err != nil {
+				return err
+			}
+			blob := internal.NewRemoteBlob(ctx, repo, refspec, layerDigest)
+			data, err = toc.ExtractFile(io.NewSectionReader(blob, 0, int64(toc.CompressedArchiveSize)), file)
+			if err != nil {
+				return err
+			}
+			log.G(ctx).WithField("requests", blob.Requests).WithField("bytes", blob.Fetched).
+				Debug("fetched spans of remote layer")
+		} else {
+			layerReader, err := client.ContentStore().ReaderAt(ctx, v1.Descriptor{Digest: layerDigest})
+			if err != nil {
+				return err
+			}
+			defer layerReader.Close()
+			data, err = toc.ExtractFile(io.NewSectionReader(layerReader, 0, int64(toc.CompressedArchiveSize)), file)
+			if err != nil {
+				return err
+			}
+		}
+
 		outfile := cliContext.String("output")
 		if outfile != "" {
-			os.WriteFile(outfile, data, 0)
-			return nil
+			return os.WriteFile(outfile, data, 0644)
 		}
 		fmt.Println(string(data))
 		return nil
 	},
 }
 
-func getZtoc(ctx context.Context, d digest.Digest) (*ztoc.Ztoc, error) {
-	blobStore, err := oci.New(config.DefaultSociContentStorePath)
-	if err != nil {
-		return nil, err
-	}
-
+func getZtoc(ctx context.Context, blobStore orascontent.Fetcher, d digest.Digest) (*ztoc.Ztoc, error) {
 	reader, err := blobStore.Fetch(ctx, v1.Descriptor{Digest: d})
 	if err != nil {
 		return nil, err
@@ -102,19 +138,19 @@ func getZtoc(ctx context.Context, d digest.Digest) (*ztoc.Ztoc, error) {
 	return ztoc.Unmarshal(reader)
 }
 
-func getLayer(ctx context.Context, ztocDigest digest.Digest, cs content.Store) (content.ReaderAt, error) {
+// getLayerDigest returns the digest of the layer indexed by the ztoc, which is either
+// given with the `--layer` flag or recorded in the artifact store.
+func getLayerDigest(cliContext *cli.Context, ztocDigest digest.Digest) (digest.Digest, error) {
+	if layer := cliContext.String("layer"); layer != "" {
+		return digest.Parse(layer)
+	}
 	metadata, err := soci.NewDB(soci.ArtifactsDbPath())
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	artifact, err := metadata.GetArtifactEntry(ztocDigest.String())
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	layerDigest, err := digest.Parse(artifact.OriginalDigest)
-	if err != nil {
-		return nil, err
-	}
-
-	return cs.ReaderAt(ctx, v1.Descriptor{Digest: layerDigest})
+	return digest.Parse(artifact.OriginalDigest)
 }
@@ -21,14 +21,13 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
-	"oras.land/oras-go/v2/content/oci"
 )
 
 type Info struct {
@@ -36,10 +35,12 @@ type Info struct {
 	BuildTool         string             `json:"build_tool"`
 	Size              int64              `json:"size"`
 	SpanSize          compression.Offset `json:"span_size"`
+	SpanAligned       bool               `json:"span_aligned"`
 	NumSpans          compression.SpanID `json:"num_spans"`
 	NumFiles          int                `json:"num_files"`
 	NumMultiSpanFiles int                `json:"num_multi_span_files"`
 	Files             []FileInfo         `json:"files"`
+	Spans             []SpanInfo         `json:"spans,omitempty"`
 }
 
 type FileInfo struct {
@@ -51,10 +52,25 @@ type FileInfo struct {
 	EndSpan   compression.SpanID `json:"end_span"`
 }
 
+// SpanInfo is the layout of a span in the compressed and uncompressed layer.
+type SpanInfo struct {
+	ID                 compression.SpanID `json:"id"`
+	CompressedOffset   compression.Offset `json:"compressed_offset"`
+	CompressedSize     compression.Offset `json:"compressed_size"`
+	UncompressedOffset compression.Offset `json:"uncompressed_offset"`
+	UncompressedSize   compression.Offset `json:"uncompressed_size"`
+}
+
 var infoCommand = cli.Command{
 	Name:      "info",
 	Usage:     "get detailed info about a ztoc",
 	ArgsUsage: "<digest>",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "spans",
+			Usage: "include the compressed and uncompressed offsets of every span",
+		},
+	},
 	Action: func(cliContext *cli.Context) error {
 		digest, err := digest.Parse(cliContext.Args().First())
 		if err != nil {
@@ -71,7 +87,7 @@ var infoCommand = cli.Command{
 		if entry.MediaType == soci.SociIndexArtifactType {
 			return fmt.Errorf("the provided digest belongs to a SOCI index. Use `soci index info` to get the detailed information about it")
 		}
-		storage, err := oci.New(config.DefaultSociContentStorePath)
+		storage, err := internal.OpenContentStore(cliContext)
 		if err != nil {
 			return err
 		}
@@ -93,12 +109,13 @@ var infoCommand = cli.Command{
 
 		multiSpanFiles := 0
 		zinfo := Info{
-			Version:   string(ztoc.Version),
-			BuildTool: ztoc.BuildToolIdentifier,
-			Size:      entry.Size,
-			SpanSize:  gzInfo.SpanSize(),
-			NumSpans:  ztoc.MaxSpanID + 1,
-			NumFiles:  len(ztoc.FileMetadata),
+			Version:     string(ztoc.Version),
+			BuildTool:   ztoc.BuildToolIdentifier,
+			Size:        entry.Size,
+			SpanSize:    gzInfo.SpanSize(),
+			SpanAligned: ztoc.SpanAligned,
+			NumSpans:    ztoc.MaxSpanID + 1,
+			NumFiles:    len(ztoc.FileMetadata),
 		}
 		for _, v := range ztoc.FileMetadata {
 			startSpan := gzInfo.UncompressedOffsetToSpanID(v.UncompressedOffset)
@@ -116,6 +133,19 @@ var infoCommand = cli.Command{
 			})
 		}
 		zinfo.NumMultiSpanFiles = multiSpanFiles
+		if cliContext.Bool("spans") {
+			for id := compression.SpanID(0); id <= ztoc.MaxSpanID; id++ {
+				compStart := gzInfo.StartCompressedOffset(id)
+				uncompStart := gzInfo.StartUncompressedOffset(id)
+				zinfo.Spans = append(zinfo.Spans, SpanInfo{
+					ID:                 id,
+					CompressedOffset:   compStart,
+					CompressedSize:     gzInfo.EndCompressedOffset(id, ztoc.CompressedArchiveSize) - compStart,
+					UncompressedOffset: uncompStart,
+					UncompressedSize:   gzInfo.EndUncompressedOffset(id, ztoc.UncompressedArchiveSize) - uncompStart,
+				})
+			}
+		}
 		j, err := json.MarshalIndent(zinfo, "", "  ")
 		if err != nil {
 			return err
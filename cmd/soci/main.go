@@ -79,6 +79,7 @@ func main() {
 			Name:  "debug",
 			Usage: "enable debug output",
 		},
+		commands.ConfigFlag,
 	}
 
 	app.Version = fmt.Sprintf("%s %s", version.Version, version.Revision)
@@ -91,6 +92,14 @@ func main() {
 		commands.PushCommand,
 		run.Command,
 		commands.RebuildDBCommand,
+		commands.GCCommand,
+		commands.ReportCommand,
+		commands.ConvertCommand,
+		commands.ConformanceCommand,
+		commands.BundleCommand,
+		commands.BenchCommand,
+		commands.PrefetchProfileCommand,
+		commands.PrefetchCommand,
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -0,0 +1,136 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/labels"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerConvertFunc returns a converter.ConvertFunc which converts the layers of an image to eStargz
+// layers with chunks of at most `chunkSize` bytes, e.g. so that images indexed for SOCI can be
+// lazily loaded by the stargz snapshotter too. Layers which are eStargz already are left as is.
+func LayerConvertFunc(chunkSize int64) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			return nil, nil
+		}
+		if _, ok := desc.Annotations[TOCJSONDigestAnnotation]; ok {
+			return nil, nil
+		}
+		info, err := cs.Info(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer ra.Close()
+		r, err := compression.DecompressStream(io.NewSectionReader(ra, 0, desc.Size))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		ref := fmt.Sprintf("convert-estargz-from-%s", desc.Digest)
+		w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		// Discard the data of an interrupted conversion.
+		if err := w.Truncate(0); err != nil {
+			return nil, err
+		}
+		tocDigest, diffID, err := Convert(w, r, chunkSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert layer %s: %w", desc.Digest, err)
+		}
+		// Keep the labels of the layer (e.g. its distribution sources), but not its diff ID.
+		layerLabels := make(map[string]string, len(info.Labels)+1)
+		for k, v := range info.Labels {
+			layerLabels[k] = v
+		}
+		layerLabels[labels.LabelUncompressed] = diffID.String()
+		if err := w.Commit(ctx, 0, "", content.WithLabels(layerLabels)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, err
+		}
+
+		newDesc := desc
+		newDesc.Digest = w.Digest()
+		newInfo, err := cs.Info(ctx, newDesc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		newDesc.Size = newInfo.Size
+		// The uncompressed size is read from the layout of the converted layer.
+		newRA, err := cs.ReaderAt(ctx, newDesc)
+		if err != nil {
+			return nil, err
+		}
+		defer newRA.Close()
+		layer, err := Open(newRA, newDesc.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read converted layer %s: %w", newDesc.Digest, err)
+		}
+		newDesc.MediaType = GzipMediaType(desc.MediaType)
+		newDesc.Annotations = make(map[string]string, len(desc.Annotations)+2)
+		for k, v := range desc.Annotations {
+			newDesc.Annotations[k] = v
+		}
+		newDesc.Annotations[TOCJSONDigestAnnotation] = tocDigest.String()
+		newDesc.Annotations[StoreUncompressedSizeAnnotation] = strconv.FormatInt(layer.UncompressedSize, 10)
+		return &newDesc, nil
+	}
+}
+
+// GzipMediaType returns the gzip compressed variant of the layer media type `mediaType`.
+func GzipMediaType(mediaType string) string {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2Layer, images.MediaTypeDockerSchema2LayerGzip:
+		return images.MediaTypeDockerSchema2LayerGzip
+	case images.MediaTypeDockerSchema2LayerForeign, images.MediaTypeDockerSchema2LayerForeignGzip:
+		return images.MediaTypeDockerSchema2LayerForeignGzip
+	case ocispec.MediaTypeImageLayerNonDistributable, ocispec.MediaTypeImageLayerNonDistributableGzip, ocispec.MediaTypeImageLayerNonDistributableZstd: //nolint:staticcheck
+		return ocispec.MediaTypeImageLayerNonDistributableGzip //nolint:staticcheck
+	default:
+		return ocispec.MediaTypeImageLayerGzip
+	}
+}
+
+// VerifyLayer returns an error unless the layer `desc` of the content store `cs` is an eStargz
+// layer which matches its annotations.
+func VerifyLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor) error {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	_, err = OpenDescriptor(ra, desc)
+	return err
+}
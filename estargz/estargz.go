@@ -0,0 +1,247 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package estargz reads and writes eStargz layers, the lazily loadable gzip layers of the
+// stargz snapshotter, so that images can be moved between the stargz snapshotter and SOCI
+// without rebuilding them. Layers are read and written with the eStargz library of the stargz
+// snapshotter.
+//
+// An eStargz layer is a gzip compressed tar archive whose entries (and chunks of the contents
+// of large files) are compressed as separate gzip members. It ends with a member holding the
+// JSON TOC of the layer, followed by a footer locating it. Since the layer is still a valid
+// tar.gz, it can be pulled and unpacked like any other layer.
+package estargz
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	stargz "github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// TOCJSONDigestAnnotation is the annotation of eStargz layers which contains the digest
+	// of the JSON of their TOC.
+	TOCJSONDigestAnnotation = stargz.TOCJSONDigestAnnotation
+
+	// StoreUncompressedSizeAnnotation is the annotation of eStargz layers which contains
+	// the size of their uncompressed tar archive.
+	StoreUncompressedSizeAnnotation = stargz.StoreUncompressedSizeAnnotation
+)
+
+// xattrPAXPrefix is the prefix of the PAX records of tar headers which hold extended attributes.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// gzipMagic are the first bytes of a gzip member compressed with deflate.
+var gzipMagic = []byte{0x1f, 0x8b, 8}
+
+// Layer is an eStargz layer read by Open.
+type Layer struct {
+	// TOC is the TOC of the layer.
+	TOC *stargz.JTOC
+	// TOCDigest is the digest of the JSON of the TOC of the layer.
+	TOCDigest digest.Digest
+	// UncompressedSize is the size of the uncompressed tar archive of the layer.
+	UncompressedSize int64
+
+	// memberOffsets maps the offsets of the gzip members of the layer which hold the contents
+	// of files to their offsets in the uncompressed tar archive.
+	memberOffsets map[int64]int64
+}
+
+// Open reads the eStargz layer `r` of `size` bytes: its TOC, and the layout of its gzip members
+// from their trailers, so that the offsets of files in the uncompressed tar archive are known
+// without decompressing the layer.
+func Open(r io.ReaderAt, size int64) (*Layer, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	tocOffset, footerSize, err := stargz.OpenFooter(sr)
+	if err != nil {
+		return nil, fmt.Errorf("not an eStargz layer: %w", err)
+	}
+	if tocOffset <= 0 || tocOffset >= size-footerSize {
+		return nil, fmt.Errorf("not an eStargz layer: invalid TOC offset %d", tocOffset)
+	}
+	var d stargz.Decompressor = &stargz.GzipDecompressor{}
+	if footerSize != d.FooterSize() {
+		d = &stargz.LegacyGzipDecompressor{}
+	}
+	toc, tocDigest, err := d.ParseTOC(io.NewSectionReader(r, tocOffset, size-footerSize-tocOffset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOC: %w", err)
+	}
+
+	// Every chunk of the contents of a file starts a gzip member, which ends where the next
+	// one starts. The first member holds the headers preceding the first chunk, and the last
+	// one the TOC.
+	starts := []int64{0, tocOffset}
+	for _, e := range toc.Entries {
+		if isData(e) && e.Offset != 0 {
+			if e.Offset < 0 || e.Offset >= tocOffset {
+				return nil, fmt.Errorf("invalid offset %d of %q", e.Offset, e.Name)
+			}
+			starts = append(starts, e.Offset)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	l := &Layer{TOC: toc, TOCDigest: tocDigest, memberOffsets: make(map[int64]int64)}
+	memberSizes := make(map[int64]int64)
+	for i, start := range starts {
+		if _, ok := l.memberOffsets[start]; ok {
+			continue
+		}
+		end := size - footerSize
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		memberSize, err := readMemberSize(r, start, end)
+		if err != nil {
+			return nil, err
+		}
+		l.memberOffsets[start] = l.UncompressedSize
+		memberSizes[start] = memberSize
+		l.UncompressedSize += memberSize
+	}
+
+	// The trailers only record the sizes of members modulo 4 GiB, and members which don't start
+	// a chunk (which the eStargz writer doesn't write) would be missed, so check that the chunks
+	// fit their members.
+	var fileSize int64
+	for _, e := range toc.Entries {
+		if e.Type == "reg" {
+			fileSize = e.Size
+		}
+		if !isData(e) || fileSize == 0 {
+			continue
+		}
+		chunkSize := e.ChunkSize
+		if chunkSize == 0 {
+			chunkSize = fileSize - e.ChunkOffset
+		}
+		if e.InnerOffset < 0 || chunkSize < 0 || e.InnerOffset+chunkSize > memberSizes[e.Offset] {
+			return nil, fmt.Errorf("chunk at %d of %q doesn't fit the gzip member at %d", e.ChunkOffset, e.Name, e.Offset)
+		}
+	}
+	return l, nil
+}
+
+// OpenDescriptor reads the eStargz layer `desc` from `r`, like Open, and checks that it matches
+// the annotations of the descriptor.
+func OpenDescriptor(r io.ReaderAt, desc ocispec.Descriptor) (*Layer, error) {
+	tocDigest, ok := desc.Annotations[TOCJSONDigestAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("layer %s is not an eStargz layer: no %s annotation", desc.Digest, TOCJSONDigestAnnotation)
+	}
+	l, err := Open(r, desc.Size)
+	if err != nil {
+		return nil, fmt.Errorf("layer %s is not an eStargz layer: %w", desc.Digest, err)
+	}
+	if l.TOCDigest.String() != tocDigest {
+		return nil, fmt.Errorf("TOC digest of layer %s doesn't match its annotation; expected = %s, got = %s", desc.Digest, tocDigest, l.TOCDigest)
+	}
+	if s, ok := desc.Annotations[StoreUncompressedSizeAnnotation]; ok {
+		if size, err := strconv.ParseInt(s, 10, 64); err != nil || size != l.UncompressedSize {
+			return nil, fmt.Errorf("uncompressed size of layer %s doesn't match its annotation; expected = %s, got = %d", desc.Digest, s, l.UncompressedSize)
+		}
+	}
+	return l, nil
+}
+
+// ZtocTOC returns the TOC of the zTOC of the layer, built from the TOC of the layer. The offsets
+// of entries other than regular files with contents aren't recorded in the TOC of the layer,
+// and are left to 0 since files are only read from the offsets of their contents.
+func (l *Layer) ZtocTOC() (ztoc.TOC, error) {
+	var (
+		files  []ztoc.FileMetadata
+		unames = make(map[int]string)
+		gnames = make(map[int]string)
+	)
+	for _, e := range l.TOC.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		// Names are only recorded for the first entry of each owner.
+		if e.Uname != "" {
+			unames[e.UID] = e.Uname
+		}
+		if e.Gname != "" {
+			gnames[e.GID] = e.Gname
+		}
+		md := ztoc.FileMetadata{
+			Name:             e.Name,
+			Type:             e.Type,
+			UncompressedSize: compression.Offset(e.Size),
+			Linkname:         e.LinkName,
+			Mode:             e.Mode,
+			UID:              e.UID,
+			GID:              e.GID,
+			Uname:            unames[e.UID],
+			Gname:            gnames[e.GID],
+			Devmajor:         int64(e.DevMajor),
+			Devminor:         int64(e.DevMinor),
+		}
+		if e.ModTime3339 != "" {
+			modTime, err := time.Parse(time.RFC3339, e.ModTime3339)
+			if err != nil {
+				return ztoc.TOC{}, fmt.Errorf("invalid modification time of %q: %w", e.Name, err)
+			}
+			md.ModTime = modTime
+		}
+		for k, v := range e.Xattrs {
+			if md.Xattrs == nil {
+				md.Xattrs = make(map[string]string, len(e.Xattrs))
+			}
+			md.Xattrs[xattrPAXPrefix+k] = string(v)
+		}
+		if e.Type == "reg" && e.Size > 0 {
+			md.UncompressedOffset = compression.Offset(l.memberOffsets[e.Offset] + e.InnerOffset)
+		}
+		files = append(files, md)
+	}
+	return ztoc.TOC{FileMetadata: files}, nil
+}
+
+// isData returns whether the TOC entry `e` holds the contents of a regular file.
+func isData(e *stargz.TOCEntry) bool {
+	return e.Type == "reg" || e.Type == "chunk"
+}
+
+// readMemberSize returns the uncompressed size of the gzip member of `r` from `start` to `end`,
+// modulo 4 GiB, from its trailer.
+func readMemberSize(r io.ReaderAt, start, end int64) (int64, error) {
+	if end-start < 18 {
+		return 0, fmt.Errorf("gzip member at %d is too small: %d bytes", start, end-start)
+	}
+	magic := make([]byte, len(gzipMagic))
+	if _, err := r.ReadAt(magic, start); err != nil {
+		return 0, fmt.Errorf("failed to read gzip member at %d: %w", start, err)
+	}
+	if string(magic) != string(gzipMagic) {
+		return 0, fmt.Errorf("no gzip member at %d", start)
+	}
+	trailer := make([]byte, 4)
+	if _, err := r.ReadAt(trailer, end-4); err != nil {
+		return 0, fmt.Errorf("failed to read trailer of gzip member at %d: %w", start, err)
+	}
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
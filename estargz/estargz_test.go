@@ -0,0 +1,322 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/labels"
+	stargz "github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestConvert(t *testing.T) {
+	large := string(testutil.RandomByteData(2500))
+	src, err := io.ReadAll(testutil.BuildTar([]testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/small", "small file", testutil.WithFileXattrs(map[string]string{"user.foo": "bar"})),
+		testutil.File("dir/large", large),
+		testutil.File("dir/empty", ""),
+		testutil.Symlink("link", "dir/small"),
+		// The TOC of a source archive which is an eStargz layer already is replaced.
+		testutil.File(stargz.TOCTarName, "{}"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tocDigest, diffID, err := Convert(&buf, bytes.NewReader(src), 1000)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	blob := buf.Bytes()
+
+	layer, err := Open(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatalf("failed to open layer: %v", err)
+	}
+	if layer.TOCDigest != tocDigest {
+		t.Fatalf("unexpected TOC digest; expected = %s, got = %s", tocDigest, layer.TOCDigest)
+	}
+	toc := layer.TOC
+	var names []string
+	for _, e := range toc.Entries {
+		names = append(names, e.Name+":"+e.Type)
+	}
+	expectedNames := []string{
+		stargz.NoPrefetchLandmark + ":reg", "dir/:dir", "dir/small:reg",
+		"dir/large:reg", "dir/large:chunk", "dir/large:chunk",
+		"dir/empty:reg", "link:symlink",
+	}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("unexpected TOC entries; expected = %v, got = %v", expectedNames, names)
+	}
+	if string(toc.Entries[2].Xattrs["user.foo"]) != "bar" {
+		t.Fatalf("unexpected xattrs of dir/small: %v", toc.Entries[2].Xattrs)
+	}
+	if toc.Entries[3].Digest != digest.FromString(large).String() || toc.Entries[3].Size != int64(len(large)) {
+		t.Fatalf("unexpected entry of dir/large: %+v", toc.Entries[3])
+	}
+
+	// Each chunk can be decompressed on its own from its offset.
+	for _, e := range toc.Entries[3:6] {
+		gz, err := gzip.NewReader(bytes.NewReader(blob[e.Offset:]))
+		if err != nil {
+			t.Fatalf("failed to open chunk at %d of dir/large: %v", e.Offset, err)
+		}
+		size := e.ChunkSize
+		if size == 0 {
+			size = int64(len(large)) - e.ChunkOffset
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(gz, chunk); err != nil {
+			t.Fatalf("failed to read chunk at %d of dir/large: %v", e.Offset, err)
+		}
+		if string(chunk) != large[e.ChunkOffset:e.ChunkOffset+size] || digest.FromBytes(chunk).String() != e.ChunkDigest {
+			t.Fatalf("unexpected chunk at %d of dir/large", e.ChunkOffset)
+		}
+	}
+
+	// The layer is still a valid tar.gz, whose diff ID is returned.
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress layer: %v", err)
+	}
+	if digest.FromBytes(uncompressed) != diffID || int64(len(uncompressed)) != layer.UncompressedSize {
+		t.Fatalf("unexpected diff ID or size; expected = %s (%d), got = %s (%d)",
+			digest.FromBytes(uncompressed), len(uncompressed), diffID, layer.UncompressedSize)
+	}
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	var tarNames []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid tar archive: %v", err)
+		}
+		tarNames = append(tarNames, h.Name)
+		if h.Name == "dir/large" {
+			b, err := io.ReadAll(tr)
+			if err != nil || string(b) != large {
+				t.Fatalf("unexpected contents of dir/large: %v", err)
+			}
+		}
+	}
+	expectedTarNames := []string{stargz.NoPrefetchLandmark, "dir/", "dir/small", "dir/large", "dir/empty", "link", stargz.TOCTarName}
+	if !reflect.DeepEqual(tarNames, expectedTarNames) {
+		t.Fatalf("unexpected tar entries; expected = %v, got = %v", expectedTarNames, tarNames)
+	}
+}
+
+func TestZtocTOC(t *testing.T) {
+	large := string(testutil.RandomByteData(2500))
+	src, err := io.ReadAll(testutil.BuildTar([]testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/small", "small file", testutil.WithFileXattrs(map[string]string{"user.foo": "bar"})),
+		testutil.File("dir/large", large),
+		testutil.File("dir/empty", ""),
+		testutil.Symlink("link", "dir/small"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, _, err := Convert(&buf, bytes.NewReader(src), 1000); err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	blob := buf.Bytes()
+	layer, err := Open(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatalf("failed to open layer: %v", err)
+	}
+	toc, err := layer.ZtocTOC()
+	if err != nil {
+		t.Fatalf("failed to build zTOC TOC: %v", err)
+	}
+
+	// The files are found at the same offsets as in the tar archive of the layer.
+	name := filepath.Join(t.TempDir(), "layer")
+	if err := os.WriteFile(name, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tb := ztoc.NewTocBuilder()
+	tb.RegisterTarProvider(compression.Gzip, ztoc.TarProviderGzip)
+	expected, _, err := tb.TocFromFile(compression.Gzip, name)
+	if err != nil {
+		t.Fatalf("failed to build TOC from the tar archive: %v", err)
+	}
+	files := make(map[string]ztoc.FileMetadata)
+	for _, f := range expected.FileMetadata {
+		files[f.Name] = f
+	}
+	if len(toc.FileMetadata) != len(expected.FileMetadata)-1 {
+		t.Fatalf("unexpected number of files; expected = %d, got = %d", len(expected.FileMetadata)-1, len(toc.FileMetadata))
+	}
+	var small ztoc.FileMetadata
+	for _, f := range toc.FileMetadata {
+		if f.Name == "dir/small" {
+			small = f
+		}
+		e, ok := files[f.Name]
+		if !ok {
+			t.Fatalf("unexpected file %q", f.Name)
+		}
+		if f.Type != e.Type || f.UncompressedSize != e.UncompressedSize || f.Linkname != e.Linkname || f.Mode != e.Mode {
+			t.Fatalf("unexpected metadata of %q; expected = %+v, got = %+v", f.Name, e, f)
+		}
+		if f.Type == "reg" && f.UncompressedSize > 0 && f.UncompressedOffset != e.UncompressedOffset {
+			t.Fatalf("unexpected offset of %q; expected = %d, got = %d", f.Name, e.UncompressedOffset, f.UncompressedOffset)
+		}
+	}
+	if !reflect.DeepEqual(small.Xattrs, map[string]string{"SCHILY.xattr.user.foo": "bar"}) {
+		t.Fatalf("unexpected xattrs of dir/small: %v", small.Xattrs)
+	}
+
+	// A layer whose members don't match its TOC is rejected.
+	corrupt := append([]byte(nil), blob...)
+	corrupt[layer.TOC.Entries[3].Offset] = 0
+	if _, err := Open(bytes.NewReader(corrupt), int64(len(corrupt))); err == nil {
+		t.Fatal("expected an error opening a layer whose members don't match its TOC")
+	}
+}
+
+func TestFooter(t *testing.T) {
+	footer := footerBytes(12345)
+	if len(footer) != stargz.FooterSize {
+		t.Fatalf("unexpected footer size: %d", len(footer))
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		t.Fatalf("footer is not a gzip member: %v", err)
+	}
+	if b, err := io.ReadAll(gz); err != nil || len(b) != 0 {
+		t.Fatalf("unexpected contents of footer: %q, err = %v", b, err)
+	}
+	if _, offset, _, err := (&stargz.GzipDecompressor{}).ParseFooter(footer); err != nil || offset != 12345 {
+		t.Fatalf("unexpected TOC offset; err = %v, got = %d", err, offset)
+	}
+}
+
+func TestOpenNotEStargz(t *testing.T) {
+	blob, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{testutil.File("foo", "bar")}, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(bytes.NewReader(blob), int64(len(blob))); err == nil {
+		t.Fatal("expected an error reading the TOC of a layer which isn't eStargz")
+	}
+}
+
+func TestLayerConvertFunc(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), memoryLabelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{testutil.File("foo", "bar")}, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	if err := content.WriteBlob(ctx, cs, "layer", bytes.NewReader(blob), desc); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLayer(ctx, cs, desc); err == nil {
+		t.Fatal("expected the verification of a layer which isn't eStargz to fail")
+	}
+
+	convert := LayerConvertFunc(0)
+	newDesc, err := convert(ctx, cs, desc)
+	if err != nil {
+		t.Fatalf("failed to convert layer: %v", err)
+	}
+	if newDesc == nil || newDesc.MediaType != images.MediaTypeDockerSchema2LayerGzip {
+		t.Fatalf("unexpected converted layer: %+v", newDesc)
+	}
+	if err := VerifyLayer(ctx, cs, *newDesc); err != nil {
+		t.Fatalf("converted layer is not a valid eStargz layer: %v", err)
+	}
+	info, err := cs.Info(ctx, newDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := digest.Parse(info.Labels[labels.LabelUncompressed]); err != nil {
+		t.Fatalf("converted layer has no diff ID label: %v", info.Labels)
+	}
+	if newDesc.Annotations[StoreUncompressedSizeAnnotation] == "" {
+		t.Fatalf("converted layer has no uncompressed size annotation: %v", newDesc.Annotations)
+	}
+
+	// eStargz layers are left as is.
+	if again, err := convert(ctx, cs, *newDesc); err != nil || again != nil {
+		t.Fatalf("unexpected conversion of an eStargz layer; desc = %v, err = %v", again, err)
+	}
+}
+
+// memoryLabelStore keeps the labels of a local content store in memory.
+type memoryLabelStore map[digest.Digest]map[string]string
+
+func (s memoryLabelStore) Get(d digest.Digest) (map[string]string, error) {
+	return s[d], nil
+}
+
+func (s memoryLabelStore) Set(d digest.Digest, labels map[string]string) error {
+	s[d] = labels
+	return nil
+}
+
+func (s memoryLabelStore) Update(d digest.Digest, update map[string]string) (map[string]string, error) {
+	labels := s[d]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s[d] = labels
+	return labels, nil
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	stargz "github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultChunkSize is the maximum size of the chunks the contents of regular files are split into.
+const DefaultChunkSize = 4 << 20
+
+// landmarkContents is the content of the landmark files.
+var landmarkContents = []byte{0xf}
+
+// Convert writes the tar archive read from `r` to `w` as an eStargz layer, with the contents
+// of regular files split into chunks of at most `chunkSize` bytes (DefaultChunkSize if 0).
+// It returns the digest of the JSON of the TOC of the layer and the digest of its uncompressed
+// tar archive. The TOC and landmark entries of an archive which is an eStargz layer already
+// are replaced. No files are marked for prefetching.
+func Convert(w io.Writer, r io.Reader, chunkSize int64) (tocDigest, diffID digest.Digest, err error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	sw := stargz.NewWriterWithCompressor(w, &gzipCompressor{
+		GzipCompressor: stargz.NewGzipCompressorWithLevel(gzip.DefaultCompression),
+		level:          gzip.DefaultCompression,
+	})
+	sw.ChunkSize = int(chunkSize)
+
+	var landmark bytes.Buffer
+	tw := tar.NewWriter(&landmark)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     stargz.NoPrefetchLandmark,
+		Mode:     0644,
+		Size:     int64(len(landmarkContents)),
+	}); err != nil {
+		return "", "", err
+	}
+	if _, err := tw.Write(landmarkContents); err != nil {
+		return "", "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", "", err
+	}
+	if err := sw.AppendTar(&landmark); err != nil {
+		return "", "", err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(withoutEstargzEntries(pw, r))
+	}()
+	err = sw.AppendTar(pr)
+	// Unblock the copy of the archive if it wasn't read to the end.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return "", "", err
+	}
+	tocDigest, err = sw.Close()
+	if err != nil {
+		return "", "", err
+	}
+	return tocDigest, digest.Digest(sw.DiffID()), nil
+}
+
+// withoutEstargzEntries copies the tar archive read from `r` to `w`, without the TOC and landmark
+// entries of eStargz layers.
+func withoutEstargzEntries(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %w", err)
+		}
+		switch strings.TrimPrefix(h.Name, "./") {
+		case stargz.TOCTarName, stargz.PrefetchLandmark, stargz.NoPrefetchLandmark:
+			continue
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// gzipCompressor compresses eStargz layers like stargz.GzipCompressor, but writes their footer by
+// hand: the library encodes it with compress/gzip, whose encoding of the empty member, and so the
+// size of the footer, depends on the version of Go.
+type gzipCompressor struct {
+	*stargz.GzipCompressor
+	level int
+}
+
+func (gc *gzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *stargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	gz, err := gzip.NewWriterLevel(w, gc.level)
+	if err != nil {
+		return "", err
+	}
+	tw := tar.NewWriter(io.MultiWriter(gz, diffHash))
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     stargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(footerBytes(off)); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// footerBytes returns the eStargz footer of a layer whose TOC is at `tocOffset`: an empty gzip
+// member whose header has an extra field with the offset, of exactly stargz.FooterSize bytes.
+func footerBytes(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	buf := bytes.NewBuffer(make([]byte, 0, stargz.FooterSize))
+	// Header: magic, deflate, FEXTRA flag, no modification time, no extra flags, unknown OS.
+	buf.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 255})
+	binary.Write(buf, binary.LittleEndian, uint16(4+len(subfield)))
+	buf.Write([]byte{'S', 'G'})
+	binary.Write(buf, binary.LittleEndian, uint16(len(subfield)))
+	buf.WriteString(subfield)
+	// An empty final stored block, then the CRC-32 and size of the empty contents.
+	buf.Write([]byte{1, 0, 0, 0xff, 0xff})
+	buf.Write(make([]byte, 8))
+	return buf.Bytes()
+}
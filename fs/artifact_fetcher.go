@@ -22,22 +22,26 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
-	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
-	"github.com/awslabs/soci-snapshotter/service/keychain/local_keychain"
+	fsremote "github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/awslabs/soci-snapshotter/soci"
-	socihttp "github.com/awslabs/soci-snapshotter/util/http"
-	"github.com/awslabs/soci-snapshotter/util/ioutils"
+	socistore "github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/errdef"
 	"oras.land/oras-go/v2/registry/remote"
-	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
 type Fetcher interface {
@@ -48,6 +52,21 @@ type Fetcher interface {
 	// Store takes in a descriptor and io.Reader and stores it in the local store.
 	Store(ctx context.Context, desc ocispec.Descriptor, reader io.Reader) error
 }
+
+// ErrArtifactTooLarge is returned when a fetched SOCI artifact exceeds its configured maximum size.
+var ErrArtifactTooLarge = errors.New("artifact exceeds the maximum allowed size")
+
+// ErrIndexSubjectMismatch is returned when the SOCI index of an image is for another image,
+// e.g. a previous image of the same ref.
+var ErrIndexSubjectMismatch = errors.New("soci index is for another image")
+
+// ArtifactSizeLimits are the maximum sizes of the SOCI artifacts read by FetchSociArtifacts.
+// A non-positive limit means the size is unlimited.
+type ArtifactSizeLimits struct {
+	MaxIndexSize int64
+	MaxZtocSize  int64
+}
+
 type resolverStorage interface {
 	content.Resolver
 	content.Storage
@@ -59,57 +78,165 @@ type artifactFetcher struct {
 	localStore       content.Storage
 	refspec          reference.Spec
 	contentStorePath string
+	// blobSources are tried before the remote store.
+	blobSources []fsremote.BlobSource
 }
 
 // Constructs a new artifact fetcher
-// Takes in the image reference, the local store and the resolver
-func newArtifactFetcher(refspec reference.Spec, localStore content.Storage, remoteStore resolverStorage, contentStorePath string) (*artifactFetcher, error) {
+// Takes in the image reference, the local store, the resolver and the blob sources to try before the resolver
+func newArtifactFetcher(refspec reference.Spec, localStore content.Storage, remoteStore resolverStorage, contentStorePath string, blobSources []fsremote.BlobSource) (*artifactFetcher, error) {
 	return &artifactFetcher{
 		localStore:       localStore,
 		remoteStore:      remoteStore,
 		refspec:          refspec,
 		contentStorePath: contentStorePath,
+		blobSources:      blobSources,
 	}, nil
 }
 
-func newRemoteStore(refspec reference.Spec) (*remote.Repository, error) {
-	repo, err := remote.NewRepository(refspec.Locator)
+// newRaceReferrersCaller returns a ReferrersCaller which queries the Referrers API and
+// the fallback referrers tag of the repository concurrently, instead of trying the tag only
+// once the Referrers API turns out to be unsupported.
+func newRaceReferrersCaller(refspec reference.Spec, hosts source.RegistryHosts) (ReferrersCaller, error) {
+	apiStore, err := newRegistryRepository(refspec, hosts)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create repository %s: %w", refspec.Locator, err)
+		return nil, err
+	}
+	if err := apiStore.SetReferrersCapability(true); err != nil {
+		return nil, err
+	}
+	tagStore, err := newRegistryRepository(refspec, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if err := tagStore.SetReferrersCapability(false); err != nil {
+		return nil, err
 	}
+	return NewRaceReferrersCaller(apiStore, tagStore), nil
+}
 
-	authClient := auth.Client{
-		Client: socihttp.NewRetryableClient(socihttp.NewRetryableClientConfig()),
-		Cache:  auth.DefaultCache,
-		Credential: func(ctx context.Context, host string) (auth.Credential, error) {
-			keychain, err := local_keychain.Get()
-			if err != nil {
-				return auth.EmptyCredential, err
-			}
-			username, password, err := keychain.GetCredentials(host, refspec)
-			if err == nil {
-				return auth.Credential{
-					Username: username,
-					Password: password,
-				}, nil
-			}
-			username, secret, err := dockerconfig.DockerCreds(host)
-			if err != nil {
-				return auth.EmptyCredential, err
-			}
-			if username == "" && secret != "" {
-				return auth.Credential{
-					RefreshToken: secret,
-				}, nil
-			}
-			return auth.Credential{
-				Username: username,
-				Password: secret,
-			}, nil
-		},
+// newRemoteStore returns the store of the contents of the repository of refspec. Contents are
+// fetched from the mirrors of the registry configured by hosts before the registry itself, the
+// same way as layers are.
+func newRemoteStore(refspec reference.Spec, hosts source.RegistryHosts) (resolverStorage, error) {
+	repos, err := repositories(refspec, hosts)
+	if err != nil {
+		return nil, err
 	}
-	repo.Client = &authClient
-	return repo, nil
+	if len(repos) == 1 {
+		return repos[0], nil
+	}
+	return &mirroredStore{repos: repos}, nil
+}
+
+// newRegistryRepository returns the repository of refspec in the registry itself. Mirrors are
+// ignored since they may not serve the referrers of an image; the registry is the last of the hosts.
+func newRegistryRepository(refspec reference.Spec, hosts source.RegistryHosts) (*remote.Repository, error) {
+	repos, err := repositories(refspec, hosts)
+	if err != nil {
+		return nil, err
+	}
+	return repos[len(repos)-1], nil
+}
+
+// repositories returns the repository of refspec in each of the hosts configured for its
+// registry, in order. Requests to a host use the client, credentials and path configured for
+// it by hosts, so that they are sent the same way as the requests for layers.
+func repositories(refspec reference.Spec, hosts source.RegistryHosts) ([]*remote.Repository, error) {
+	var registryHosts []docker.RegistryHost
+	if hosts != nil {
+		var err error
+		if registryHosts, err = hosts(refspec); err != nil {
+			return nil, fmt.Errorf("cannot configure hosts of registry %s: %w", refspec.Hostname(), err)
+		}
+	}
+	if len(registryHosts) == 0 {
+		registryHosts = []docker.RegistryHost{{Host: refspec.Hostname(), Scheme: "https", Path: "/v2"}}
+	}
+	name := strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/")
+	var repos []*remote.Repository
+	for _, host := range registryHosts {
+		repo, err := remote.NewRepository(host.Host + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create repository %s on %s: %w", name, host.Host, err)
+		}
+		client, err := fsremote.NewRegistryClient(host, refspec)
+		if err != nil {
+			return nil, fmt.Errorf("cannot configure client of registry %s: %w", host.Host, err)
+		}
+		if p := strings.TrimSuffix(host.Path, "/"); p != "" && p != "/v2" {
+			// The host serves the repositories under another path, e.g. a proxy prefix or the
+			// `override_path` of a mirror, while the repository requests them under /v2.
+			log.L.WithField("host", host.Host).WithField("path", p).Debug("requesting repositories under path of host")
+			client.Transport = &pathTransport{inner: client.Transport, path: p}
+		}
+		repo.Client = client
+		repo.PlainHTTP = host.Scheme == "http"
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// pathTransport sends the requests for the paths under /v2 to the same paths under another path.
+type pathTransport struct {
+	inner http.RoundTripper
+	path  string
+}
+
+func (t *pathTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/v2" || strings.HasPrefix(req.URL.Path, "/v2/") {
+		req = req.Clone(req.Context())
+		req.URL.Path = t.path + strings.TrimPrefix(req.URL.Path, "/v2")
+		req.URL.RawPath = ""
+	}
+	return t.inner.RoundTrip(req)
+}
+
+// mirroredStore reads contents from the first of its repositories which serves them, e.g. from
+// the mirrors of a registry before the registry itself. Contents are pushed to the last one.
+type mirroredStore struct {
+	repos []*remote.Repository
+}
+
+func (s *mirroredStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (rc io.ReadCloser, err error) {
+	for _, repo := range s.repos {
+		if rc, err = repo.Fetch(ctx, desc); err == nil {
+			return rc, nil
+		}
+		log.G(ctx).WithError(err).WithField("host", repo.Reference.Registry).WithField(logutil.DigestField, desc.Digest).Debug("failed to fetch from host")
+	}
+	return nil, err
+}
+
+func (s *mirroredStore) Exists(ctx context.Context, desc ocispec.Descriptor) (ok bool, err error) {
+	for _, repo := range s.repos {
+		if ok, err = repo.Exists(ctx, desc); err == nil && ok {
+			return true, nil
+		}
+	}
+	return false, err
+}
+
+func (s *mirroredStore) Resolve(ctx context.Context, ref string) (desc ocispec.Descriptor, err error) {
+	// References are resolved in each repository by their tag or digest, since the
+	// registry of the reference is only that of the last repository. References which
+	// aren't full references already are a tag or a digest.
+	if refspec, err := reference.Parse(ref); err == nil {
+		ref = refspec.Object
+		if i := strings.LastIndex(ref, "@"); i >= 0 {
+			ref = ref[i+1:]
+		}
+	}
+	for _, repo := range s.repos {
+		if desc, err = repo.Resolve(ctx, ref); err == nil {
+			return desc, nil
+		}
+	}
+	return ocispec.Descriptor{}, err
+}
+
+func (s *mirroredStore) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) error {
+	return s.repos[len(s.repos)-1].Push(ctx, expected, content)
 }
 
 // Takes in a descriptor and returns the associated ref to fetch from remote.
@@ -125,37 +252,46 @@ func (f *artifactFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (i
 	// Try to read the requested artifact from the local filesystem first.
 	// This is faster and lets us bypass all of the container registry interaction when available.
 	localFilename := filepath.Join(f.contentStorePath, "blobs", "sha256", desc.Digest.Encoded())
-	if _, err := os.Stat(localFilename); err == nil {
+	// A blob whose size doesn't match the descriptor is still being written to a shared content
+	// store, or was left partially written by a crashed writer, so it's fetched again instead.
+	if info, err := os.Stat(localFilename); err == nil && (desc.Size == 0 || info.Size() == desc.Size) {
 		file, err := os.Open(localFilename)
 		if err != nil {
 			return nil, false, fmt.Errorf("error reading local file %s: %w", localFilename, err)
 		}
-		log.G(ctx).WithField("digest", desc.Digest).Debug("fetched artifact on local filesystem, skipping local oras store and remote fetch")
+		log.G(ctx).WithField(logutil.DigestField, desc.Digest).Debug("fetched artifact on local filesystem, skipping local oras store and remote fetch")
 		return io.NopCloser(file), true, nil
 	} else {
-		log.G(ctx).WithField("digest", desc.Digest).Debug("failed to locate artifact on local filesystem, falling back to local oras store")
+		log.G(ctx).WithField(logutil.DigestField, desc.Digest).Debug("failed to locate artifact on local filesystem, falling back to local oras store")
 	}
 
 	// Check local oras store first
 	rc, err := f.localStore.Fetch(ctx, desc)
 	if err == nil {
-		log.G(ctx).WithField("digest", desc.Digest).Debug("fetched artifact from local oras store, skipping remote fetch")
+		log.G(ctx).WithField(logutil.DigestField, desc.Digest).Debug("fetched artifact from local oras store, skipping remote fetch")
 		return rc, true, nil
 	}
 
-	log.G(ctx).WithField("digest", desc.Digest.String()).Debug("fetching artifact from remote")
+	log.G(ctx).WithField(logutil.DigestField, desc.Digest.String()).Debug("fetching artifact from remote")
 	if desc.Size == 0 {
 		// Digest verification fails is desc.Size == 0
 		// Therefore, we try to use the resolver to resolve the descriptor
 		// and hopefully get the size.
 		// Note that the resolve would fail for size > 4MiB, since that's the limit
 		// for the manifest size when using the Docker resolver.
-		log.G(ctx).WithField("digest", desc.Digest).Warn("size of descriptor is 0, trying to resolve it...")
+		log.G(ctx).WithField(logutil.DigestField, desc.Digest).Warn("size of descriptor is 0, trying to resolve it...")
 		desc, err = f.resolve(ctx, desc)
 		if err != nil {
 			return nil, false, fmt.Errorf("size of descriptor is 0; unable to resolve: %w", err)
 		}
 	}
+	if len(f.blobSources) > 0 {
+		rc, err = fsremote.FetchFromSources(ctx, f.blobSources, f.refspec, desc)
+		if err == nil {
+			log.G(ctx).WithField(logutil.DigestField, desc.Digest).Debug("fetched artifact from blob source")
+			return rc, false, nil
+		}
+	}
 	rc, err = f.remoteStore.Fetch(ctx, desc)
 	if err != nil {
 		return nil, false, fmt.Errorf("unable to fetch descriptor (%v) from remote store: %w", desc.Digest, err)
@@ -164,6 +300,48 @@ func (f *artifactFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (i
 	return rc, false, nil
 }
 
+// fetchWithLimit is like Fetch, but fails with ErrArtifactTooLarge if the artifact is larger than limit.
+// The limit is checked against the descriptor before fetching, and enforced while the artifact is read,
+// so a registry serving more data than advertised can't make the caller buffer it.
+func (f *artifactFetcher) fetchWithLimit(ctx context.Context, desc ocispec.Descriptor, limit int64) (io.ReadCloser, bool, error) {
+	if limit > 0 && desc.Size > limit {
+		return nil, false, fmt.Errorf("%w: descriptor %v has size %d, limit is %d", ErrArtifactTooLarge, desc.Digest, desc.Size, limit)
+	}
+	rc, local, err := f.Fetch(ctx, desc)
+	if err != nil || limit <= 0 {
+		return rc, local, err
+	}
+	return &sizeLimitedReadCloser{
+		ReadCloser: rc,
+		remaining:  limit,
+	}, local, nil
+}
+
+// sizeLimitedReadCloser returns ErrArtifactTooLarge once the underlying reader
+// has more than the limit bytes.
+type sizeLimitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *sizeLimitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Probe for one more byte to tell EOF apart from an oversized artifact.
+		var b [1]byte
+		n, err := l.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, ErrArtifactTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
 func (f *artifactFetcher) resolve(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
 	ref := f.constructRef(desc)
 	desc, err := f.remoteStore.Resolve(ctx, ref)
@@ -182,38 +360,242 @@ func (f *artifactFetcher) Store(ctx context.Context, desc ocispec.Descriptor, re
 	return nil
 }
 
-func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore content.Storage, remoteStore resolverStorage, contentStorePath string) (*soci.Index, error) {
+// FetchProgress is the progress of the fetch of a SOCI artifact by FetchSociArtifacts.
+type FetchProgress struct {
+	Descriptor ocispec.Descriptor
+	// Fetched is the number of bytes of the artifact read so far.
+	Fetched int64
+	// Local is whether the artifact is read from the local store instead of being fetched.
+	Local bool
+	// Done is whether the artifact is fetched and stored in the local store.
+	Done bool
+	// Shared is whether the artifact was fetched by a concurrent fetch of another index, which
+	// this fetch waited for instead of fetching it again.
+	Shared bool
+	// Err is why the artifact couldn't be fetched or stored, if it couldn't.
+	Err error
+}
+
+// FetchOption configures FetchSociArtifacts.
+type FetchOption func(*fetchConfig)
+
+type fetchConfig struct {
+	progress   func(FetchProgress)
+	shared     *sharedFetches
+	asyncZtocs bool
+}
+
+func newFetchConfig(opts []FetchOption) fetchConfig {
+	var cfg fetchConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return cfg
+}
+
+// WithFetchProgress reports the progress of the fetch of each artifact to `f`, as it's read and
+// once it's stored or failed. `f` is called concurrently for different artifacts and must return
+// quickly, since reads wait for it.
+func WithFetchProgress(f func(FetchProgress)) FetchOption {
+	return func(c *fetchConfig) {
+		c.progress = f
+	}
+}
+
+// sharedFetches are the fetches of artifacts shared by concurrent calls of FetchSociArtifacts.
+type sharedFetches struct {
+	singleflight.Group
+
+	mu sync.Mutex
+	// pending are the artifacts which a fetch has read but not stored yet, which it stores with
+	// the other artifacts of its index.
+	pending map[string]*pendingArtifact
+}
+
+// withSharedFetches shares the fetches of artifacts with the concurrent calls of FetchSociArtifacts
+// with the same group, e.g. of the zTOCs of a layer shared by images which are pulled at the same time.
+func withSharedFetches(g *sharedFetches) FetchOption {
+	return func(c *fetchConfig) {
+		c.shared = g
+	}
+}
+
+// pending returns the artifact `key` which another fetch is storing, if any.
+func (c *fetchConfig) pending(key string) (*pendingArtifact, bool) {
+	if c.shared == nil {
+		return nil, false
+	}
+	c.shared.mu.Lock()
+	defer c.shared.mu.Unlock()
+	p, ok := c.shared.pending[key]
+	return p, ok
+}
 
-	fetcher, err := newArtifactFetcher(refspec, localStore, remoteStore, contentStorePath)
+// newPending registers the artifact `key` as read by a fetch which will store it, until it completes it.
+func (c *fetchConfig) newPending(key string) *pendingArtifact {
+	p := &pendingArtifact{done: make(chan struct{})}
+	if c.shared == nil {
+		return p
+	}
+	c.shared.mu.Lock()
+	defer c.shared.mu.Unlock()
+	if c.shared.pending == nil {
+		c.shared.pending = make(map[string]*pendingArtifact)
+	}
+	c.shared.pending[key] = p
+	p.release = func() {
+		c.shared.mu.Lock()
+		defer c.shared.mu.Unlock()
+		delete(c.shared.pending, key)
+	}
+	return p
+}
+
+// WithAsyncZtocFetch makes FetchSociArtifacts return once the SOCI index is fetched, without
+// fetching its zTOCs. Each zTOC is fetched with FetchZtoc instead, when its layer is mounted.
+func WithAsyncZtocFetch() FetchOption {
+	return func(c *fetchConfig) {
+		c.asyncZtocs = true
+	}
+}
+
+// do calls `fetch`, unless a fetch with the same key is already running, in which case it waits
+// for that fetch and returns its result. If the shared fetch fails, e.g. because the context of
+// its caller was canceled or its caller fetches from another repository, `fetch` is called too.
+func (c *fetchConfig) do(ctx context.Context, key string, fetch func() (interface{}, error)) (v interface{}, shared bool, err error) {
+	if c.shared == nil {
+		v, err = fetch()
+		return v, false, err
+	}
+	var leader bool
+	ch := c.shared.DoChan(key, func() (interface{}, error) {
+		leader = true
+		return fetch()
+	})
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil && !leader {
+			v, err = fetch()
+			return v, false, err
+		}
+		return res.Val, !leader, res.Err
+	}
+}
+
+// progressReader reports the bytes read from an artifact, and stops reading it once `ctx` is done,
+// so that a canceled fetch doesn't store the artifact, even if it's read from a local file.
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	progress FetchProgress
+	report   func(FetchProgress)
+}
+
+func (c *fetchConfig) newProgressReader(ctx context.Context, desc ocispec.Descriptor, r io.Reader, local bool) *progressReader {
+	return &progressReader{
+		ctx:      ctx,
+		r:        r,
+		progress: FetchProgress{Descriptor: desc, Local: local},
+		report:   c.progress,
+	}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if n > 0 && r.report != nil {
+		r.progress.Fetched += int64(n)
+		r.report(r.progress)
+	}
+	return n, err
+}
+
+// finish reports that the artifact is stored, or couldn't be fetched or stored because of err.
+func (r *progressReader) finish(err error) {
+	if r.report == nil {
+		return
+	}
+	r.progress.Done = err == nil
+	r.progress.Err = err
+	r.report(r.progress)
+}
+
+func (c *fetchConfig) report(p FetchProgress) {
+	if c.progress != nil {
+		c.progress(p)
+	}
+}
+
+// FetchSociArtifacts fetches the SOCI index `indexDesc` and its zTOCs, and stores them in
+// localStore. The index is stored once all of its zTOCs are, so that canceling `ctx` or
+// failing to fetch a zTOC doesn't leave an index without its zTOCs in localStore. With
+// WithAsyncZtocFetch, the index is stored right away and its zTOCs aren't fetched.
+func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore content.Storage, remoteStore resolverStorage, contentStorePath string, sizeLimits ArtifactSizeLimits, blobSources []fsremote.BlobSource, opts ...FetchOption) (_ *soci.Index, retErr error) {
+	cfg := newFetchConfig(opts)
+
+	fetcher, err := newArtifactFetcher(refspec, localStore, remoteStore, contentStorePath, blobSources)
 	if err != nil {
 		return nil, fmt.Errorf("could not create an artifact fetcher: %w", err)
 	}
 
-	log.G(ctx).WithField("digest", indexDesc.Digest).Debug("fetching SOCI index")
+	log.G(ctx).WithField(logutil.DigestField, indexDesc.Digest).Debug("fetching SOCI index")
 
-	indexReader, local, err := fetcher.Fetch(ctx, indexDesc)
+	type fetchedIndex struct {
+		b        []byte
+		local    bool
+		progress *progressReader
+	}
+	v, shared, err := cfg.do(ctx, contentStorePath+"@"+indexDesc.Digest.String(), func() (interface{}, error) {
+		indexReader, local, err := fetcher.fetchWithLimit(ctx, indexDesc, sizeLimits.MaxIndexSize)
+		if err != nil {
+			err = fmt.Errorf("unable to fetch SOCI index: %w", err)
+			cfg.report(FetchProgress{Descriptor: indexDesc, Err: err})
+			return nil, err
+		}
+		defer indexReader.Close()
+		indexProgress := cfg.newProgressReader(ctx, indexDesc, indexReader, local)
+		b, err := io.ReadAll(indexProgress)
+		if err != nil {
+			err = fmt.Errorf("unable to read SOCI index: %w", err)
+			indexProgress.finish(err)
+			return nil, err
+		}
+		return fetchedIndex{b, local, indexProgress}, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to fetch SOCI index: %w", err)
+		return nil, err
 	}
-	defer indexReader.Close()
-
-	cw := new(ioutils.CountWriter)
-	tee := io.TeeReader(indexReader, cw)
+	b, local := v.(fetchedIndex).b, v.(fetchedIndex).local
+	defer func() {
+		if !shared {
+			v.(fetchedIndex).progress.finish(retErr)
+			return
+		}
+		cfg.report(FetchProgress{Descriptor: indexDesc, Fetched: int64(len(b)), Local: local, Done: retErr == nil, Shared: true, Err: retErr})
+	}()
 
 	var index soci.Index
-	err = soci.DecodeIndex(tee, &index)
+	err = soci.DecodeIndex(bytes.NewReader(b), &index)
 	if err != nil {
 		return nil, fmt.Errorf("cannot deserialize byte data to index: %w", err)
 	}
 
-	if !local {
-		b, err := soci.MarshalIndex(&index)
-		if err != nil {
+	if !cfg.asyncZtocs {
+		if err := fetchZtocs(ctx, &cfg, fetcher, index.Blobs, contentStorePath, sizeLimits); err != nil {
 			return nil, err
 		}
+	}
+
+	if !local {
+		// Store the index as fetched, so that it matches its digest.
 		err = localStore.Push(ctx, ocispec.Descriptor{
-			Digest: indexDesc.Digest,
-			Size:   cw.Size(),
+			MediaType: indexDesc.MediaType,
+			Digest:    indexDesc.Digest,
+			Size:      int64(len(b)),
 		}, bytes.NewReader(b))
 
 		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
@@ -221,28 +603,212 @@ func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc o
 		}
 	}
 
-	eg, ctx := errgroup.WithContext(ctx)
-	for _, blob := range index.Blobs {
+	return &index, nil
+}
+
+// FetchZtoc fetches the zTOC described by `ztocDesc` into the local store, unless it's already
+// there, e.g. for the layers of an index fetched with WithAsyncZtocFetch.
+func FetchZtoc(ctx context.Context, refspec reference.Spec, ztocDesc ocispec.Descriptor, localStore content.Storage, remoteStore resolverStorage, contentStorePath string, sizeLimits ArtifactSizeLimits, blobSources []fsremote.BlobSource, opts ...FetchOption) error {
+	cfg := newFetchConfig(opts)
+	fetcher, err := newArtifactFetcher(refspec, localStore, remoteStore, contentStorePath, blobSources)
+	if err != nil {
+		return fmt.Errorf("could not create an artifact fetcher: %w", err)
+	}
+	return fetchZtoc(ctx, &cfg, fetcher, ztocDesc, contentStorePath, sizeLimits)
+}
+
+// pendingArtifact is an artifact which a fetch is storing with the other artifacts of its index.
+// The concurrent fetches of the artifact wait until it's stored.
+type pendingArtifact struct {
+	done    chan struct{}
+	err     error
+	release func()
+}
+
+func (p *pendingArtifact) complete(err error) {
+	if p.release != nil {
+		p.release()
+	}
+	p.err = err
+	close(p.done)
+}
+
+func (p *pendingArtifact) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.done:
+		return p.err
+	}
+}
+
+// fetchedZtoc is a zTOC read by fetchZtocs, which commits it with the other zTOCs of its index.
+type fetchedZtoc struct {
+	progress *progressReader
+	pending  *pendingArtifact
+}
+
+// sharedPending returns the pending artifact which the result `v` of a fetch of a zTOC waits for,
+// if any. A zTOC fetched by fetchZtocs is stored by the fetch which read it, unless it's shared.
+func sharedPending(v interface{}, shared bool) (*pendingArtifact, bool) {
+	switch v := v.(type) {
+	case fetchedZtoc:
+		return v.pending, shared
+	case *pendingArtifact:
+		return v, true
+	}
+	return nil, false
+}
+
+// fetchZtocs fetches the zTOCs `blobs` which aren't in the local store yet. Each zTOC is written to
+// a batch of the local store as it's fetched, and the batch is committed once all of them are, which
+// saves a sync of the store per zTOC. The zTOCs read by concurrent fetches of other indices are
+// waited for instead.
+func fetchZtocs(ctx context.Context, cfg *fetchConfig, fetcher *artifactFetcher, blobs []ocispec.Descriptor, contentStorePath string, sizeLimits ArtifactSizeLimits) (retErr error) {
+	type sharedZtoc struct {
+		desc    ocispec.Descriptor
+		pending *pendingArtifact
+	}
+	var (
+		mu      sync.Mutex
+		fetched []fetchedZtoc
+		waiting []sharedZtoc
+	)
+	// The zTOCs read by this fetch must be completed before it waits for the zTOCs read by other
+	// fetches, which may wait for them too, or once it fails.
+	complete := func(err error) {
+		for _, z := range fetched {
+			z.progress.finish(err)
+			z.pending.complete(err)
+		}
+		fetched = nil
+	}
+	batch, err := socistore.NewBatch(ctx, fetcher.localStore)
+	if err != nil {
+		return fmt.Errorf("unable to store ztocs in local store: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			batch.Discard()
+		}
+		complete(retErr)
+	}()
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	for _, blob := range blobs {
 		blob := blob
+		key := contentStorePath + "@" + blob.Digest.String()
 		eg.Go(func() error {
-			rc, local, err := fetcher.Fetch(ctx, blob)
+			v, shared, err := cfg.do(egCtx, key, func() (interface{}, error) {
+				if p, ok := cfg.pending(key); ok {
+					return p, nil
+				}
+				rc, local, err := fetcher.fetchWithLimit(egCtx, blob, sizeLimits.MaxZtocSize)
+				if err != nil {
+					err = fmt.Errorf("cannot fetch artifact: %w", err)
+					cfg.report(FetchProgress{Descriptor: blob, Err: err})
+					return nil, err
+				}
+				if local {
+					rc.Close()
+					cfg.report(FetchProgress{Descriptor: blob, Fetched: blob.Size, Local: true, Done: true})
+					return nil, nil
+				}
+				defer rc.Close()
+				z := fetchedZtoc{progress: cfg.newProgressReader(ctx, blob, rc, false), pending: cfg.newPending(key)}
+				mu.Lock()
+				fetched = append(fetched, z)
+				mu.Unlock()
+				// The body is read right away rather than once all the zTOCs are fetched, so it
+				// doesn't hold a connection to the registry while the others are fetched.
+				if err := batch.Add(egCtx, blob, z.progress); err != nil {
+					return nil, fmt.Errorf("unable to store ztoc in local store: %w", err)
+				}
+				return z, nil
+			})
 			if err != nil {
-				return fmt.Errorf("cannot fetch artifact: %w", err)
-			}
-			defer rc.Close()
-			if local {
-				return nil
+				return err
 			}
-			if err := fetcher.Store(ctx, blob, rc); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
-				return fmt.Errorf("unable to store ztoc in local store: %w", err)
+			if p, ok := sharedPending(v, shared); ok {
+				mu.Lock()
+				waiting = append(waiting, sharedZtoc{blob, p})
+				mu.Unlock()
+			} else if shared {
+				cfg.report(FetchProgress{Descriptor: blob, Fetched: blob.Size, Done: true, Shared: true})
 			}
 			return nil
 		})
 	}
-
 	if err := eg.Wait(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return &index, nil
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to store ztocs in local store: %w", err)
+	}
+	complete(nil)
+	for _, z := range waiting {
+		if err := waitZtoc(ctx, cfg, fetcher, z.desc, z.pending, sizeLimits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchZtoc fetches the zTOC `blob` into the local store, unless it's there already.
+func fetchZtoc(ctx context.Context, cfg *fetchConfig, fetcher *artifactFetcher, blob ocispec.Descriptor, contentStorePath string, sizeLimits ArtifactSizeLimits) error {
+	key := contentStorePath + "@" + blob.Digest.String()
+	v, shared, err := cfg.do(ctx, key, func() (interface{}, error) {
+		if p, ok := cfg.pending(key); ok {
+			return p, nil
+		}
+		return nil, storeZtoc(ctx, cfg, fetcher, blob, sizeLimits)
+	})
+	if err != nil {
+		return err
+	}
+	if p, ok := sharedPending(v, true); ok {
+		return waitZtoc(ctx, cfg, fetcher, blob, p, sizeLimits)
+	}
+	if shared {
+		cfg.report(FetchProgress{Descriptor: blob, Fetched: blob.Size, Done: true, Shared: true})
+	}
+	return nil
+}
+
+// waitZtoc waits until the zTOC `blob` read by another fetch is stored, and fetches it again if
+// the other fetch fails to store it.
+func waitZtoc(ctx context.Context, cfg *fetchConfig, fetcher *artifactFetcher, blob ocispec.Descriptor, p *pendingArtifact, sizeLimits ArtifactSizeLimits) error {
+	if err := p.wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return storeZtoc(ctx, cfg, fetcher, blob, sizeLimits)
+	}
+	cfg.report(FetchProgress{Descriptor: blob, Fetched: blob.Size, Done: true, Shared: true})
+	return nil
+}
+
+// storeZtoc fetches the zTOC `blob` into the local store, unless it's there already.
+func storeZtoc(ctx context.Context, cfg *fetchConfig, fetcher *artifactFetcher, blob ocispec.Descriptor, sizeLimits ArtifactSizeLimits) error {
+	rc, local, err := fetcher.fetchWithLimit(ctx, blob, sizeLimits.MaxZtocSize)
+	if err != nil {
+		err = fmt.Errorf("cannot fetch artifact: %w", err)
+		cfg.report(FetchProgress{Descriptor: blob, Err: err})
+		return err
+	}
+	defer rc.Close()
+	if local {
+		cfg.report(FetchProgress{Descriptor: blob, Fetched: blob.Size, Local: true, Done: true})
+		return nil
+	}
+	progress := cfg.newProgressReader(ctx, blob, rc, false)
+	err = fetcher.Store(ctx, blob, progress)
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		err = fmt.Errorf("unable to store ztoc in local store: %w", err)
+		progress.finish(err)
+		return err
+	}
+	progress.finish(nil)
+	return nil
 }
@@ -19,11 +19,19 @@ package fs
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -213,12 +221,561 @@ func TestArtifactFetcherFetchOnlyOnce(t *testing.T) {
 	}
 }
 
+func TestArtifactFetcherFetchWithLimit(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contents    []byte
+		size        int64
+		limit       int64
+		expectedErr error
+	}{
+		{
+			name:     "artifact within the limit",
+			contents: []byte("test"),
+			size:     4,
+			limit:    4,
+		},
+		{
+			name:     "no limit",
+			contents: []byte("test"),
+			size:     4,
+		},
+		{
+			name:        "descriptor size exceeds the limit",
+			contents:    []byte("test"),
+			size:        4,
+			limit:       3,
+			expectedErr: ErrArtifactTooLarge,
+		},
+		{
+			name:        "streamed content exceeds the limit",
+			contents:    []byte("foobarbaz"),
+			limit:       4,
+			expectedErr: ErrArtifactTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fetcher, err := newFakeArtifactFetcher(imageRef, tc.contents)
+			if err != nil {
+				t.Fatalf("could not create artifact fetcher: %v", err)
+			}
+			desc := ocispec.Descriptor{
+				Digest: digest.FromBytes(tc.contents),
+				Size:   tc.size,
+			}
+			// Make sure that the limit is also enforced while streaming
+			// when the registry serves more data than resolved.
+			if tc.size == 0 {
+				desc.Size = tc.limit
+			}
+
+			reader, _, err := fetcher.fetchWithLimit(context.Background(), desc, tc.limit)
+			if err == nil {
+				defer reader.Close()
+				var readBytes []byte
+				readBytes, err = io.ReadAll(reader)
+				if err == nil {
+					if diff := cmp.Diff(tc.contents, readBytes); diff != "" {
+						t.Fatalf("unexpected content, diff = %v", diff)
+					}
+				}
+			}
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected error; expected = %v, got = %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+// TestRemoteStore checks that SOCI artifacts are fetched from the mirrors of a registry before
+// the registry itself, with the credentials of the hosts, like layers.
+func TestRemoteStore(t *testing.T) {
+	blob := []byte("ztoc")
+	desc := ocispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	var mirrorRequests int
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorRequests++
+		http.NotFound(w, r)
+	}))
+	defer mirror.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/repo/blobs/"+desc.Digest.String() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(blob)
+	}))
+	defer registry.Close()
+
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+	hosts := func(reference.Spec) ([]docker.RegistryHost, error) {
+		var hosts []docker.RegistryHost
+		for _, h := range []string{mirrorHost, registryHost} {
+			client := &http.Client{}
+			hosts = append(hosts, docker.RegistryHost{
+				Client: client,
+				Host:   h,
+				Scheme: "http",
+				Path:   "/v2",
+				Authorizer: docker.NewDockerAuthorizer(
+					docker.WithAuthClient(client),
+					docker.WithAuthCreds(func(string) (string, string, error) { return "user", "pass", nil })),
+			})
+		}
+		return hosts, nil
+	}
+	refspec, err := reference.Parse(registryHost + "/repo:tag")
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+	store, err := newRemoteStore(refspec, hosts)
+	if err != nil {
+		t.Fatalf("cannot create remote store: %v", err)
+	}
+	rc, err := store.Fetch(context.Background(), desc)
+	if err != nil {
+		t.Fatalf("cannot fetch: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("cannot read: %v", err)
+	}
+	if !bytes.Equal(b, blob) {
+		t.Fatalf("unexpected contents; expected = %q, got = %q", blob, b)
+	}
+	if mirrorRequests == 0 {
+		t.Fatalf("the mirror wasn't tried before the registry")
+	}
+
+	repo, err := newRegistryRepository(refspec, hosts)
+	if err != nil {
+		t.Fatalf("cannot create registry repository: %v", err)
+	}
+	if repo.Reference.Registry != registryHost {
+		t.Fatalf("unexpected registry; expected = %q, got = %q", registryHost, repo.Reference.Registry)
+	}
+}
+
+// TestRemoteStoreMirrorPath checks that SOCI artifacts are fetched from mirrors serving the
+// repositories under another path than /v2, e.g. behind a proxy prefix.
+func TestRemoteStoreMirrorPath(t *testing.T) {
+	const prefix = "/artifactory/api/docker/x/v2"
+	blob := []byte("ztoc")
+	desc := ocispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case prefix + "/repo/blobs/" + desc.Digest.String():
+			w.Write(blob)
+		case prefix + "/repo/manifests/tag":
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+			if r.Method == http.MethodGet {
+				w.Write(manifest)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+	registry := httptest.NewServer(http.NotFoundHandler())
+	defer registry.Close()
+
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+	hosts := func(reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{
+			{Client: &http.Client{}, Host: strings.TrimPrefix(mirror.URL, "http://"), Scheme: "http", Path: prefix},
+			{Client: &http.Client{}, Host: registryHost, Scheme: "http", Path: "/v2"},
+		}, nil
+	}
+	refspec, err := reference.Parse(registryHost + "/repo:tag")
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+	store, err := newRemoteStore(refspec, hosts)
+	if err != nil {
+		t.Fatalf("cannot create remote store: %v", err)
+	}
+	rc, err := store.Fetch(context.Background(), desc)
+	if err != nil {
+		t.Fatalf("cannot fetch from mirror: %v", err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err != nil || !bytes.Equal(b, blob) {
+		t.Fatalf("unexpected contents; expected = %q, got = %q, %v", blob, b, err)
+	}
+	// The reference is resolved by its tag in the mirror.
+	resolved, err := store.Resolve(context.Background(), refspec.String())
+	if err != nil {
+		t.Fatalf("cannot resolve in mirror: %v", err)
+	}
+	if resolved.Digest != digest.FromBytes(manifest) {
+		t.Fatalf("unexpected digest; expected = %s, got = %s", digest.FromBytes(manifest), resolved.Digest)
+	}
+}
+
+func TestFetchSociArtifacts(t *testing.T) {
+	ctx := context.Background()
+	remoteStore, indexDesc, ztocs := newTestSociArtifacts(t)
+	localStore := memory.New()
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		fetched  = make(map[digest.Digest]int64)
+		finished = make(map[digest.Digest]bool)
+	)
+	progress := func(p FetchProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Err != nil {
+			t.Errorf("unexpected error fetching %v: %v", p.Descriptor.Digest, p.Err)
+		}
+		fetched[p.Descriptor.Digest] = p.Fetched
+		if p.Done {
+			finished[p.Descriptor.Digest] = true
+		}
+	}
+	if _, err := FetchSociArtifacts(ctx, refspec, indexDesc, localStore, remoteStore, "", ArtifactSizeLimits{}, nil, WithFetchProgress(progress)); err != nil {
+		t.Fatalf("cannot fetch SOCI artifacts: %v", err)
+	}
+	for _, desc := range append(ztocs, indexDesc) {
+		if !finished[desc.Digest] {
+			t.Fatalf("the fetch of %v wasn't reported as done", desc.Digest)
+		}
+		if fetched[desc.Digest] != desc.Size {
+			t.Fatalf("unexpected bytes fetched of %v; expected = %d, got = %d", desc.Digest, desc.Size, fetched[desc.Digest])
+		}
+		if ok, err := localStore.Exists(ctx, desc); err != nil || !ok {
+			t.Fatalf("%v isn't stored locally: %v", desc.Digest, err)
+		}
+	}
+}
+
+func TestFetchSociArtifactsAsyncZtocs(t *testing.T) {
+	ctx := context.Background()
+	remoteStore, indexDesc, ztocs := newTestSociArtifacts(t)
+	localStore := memory.New()
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+
+	if _, err := FetchSociArtifacts(ctx, refspec, indexDesc, localStore, remoteStore, "", ArtifactSizeLimits{}, nil, WithAsyncZtocFetch()); err != nil {
+		t.Fatalf("cannot fetch SOCI artifacts: %v", err)
+	}
+	if ok, err := localStore.Exists(ctx, indexDesc); err != nil || !ok {
+		t.Fatalf("index isn't stored locally: %v", err)
+	}
+	for _, desc := range ztocs {
+		if ok, _ := localStore.Exists(ctx, desc); ok {
+			t.Fatalf("%v is stored locally although zTOCs are fetched asynchronously", desc.Digest)
+		}
+	}
+
+	for _, desc := range ztocs {
+		if err := FetchZtoc(ctx, refspec, desc, localStore, remoteStore, "", ArtifactSizeLimits{}, nil); err != nil {
+			t.Fatalf("cannot fetch ztoc %v: %v", desc.Digest, err)
+		}
+		if ok, err := localStore.Exists(ctx, desc); err != nil || !ok {
+			t.Fatalf("%v isn't stored locally: %v", desc.Digest, err)
+		}
+	}
+	// Fetching a zTOC which is stored locally already reads it from the local store.
+	var local bool
+	if err := FetchZtoc(ctx, refspec, ztocs[0], localStore, remoteStore, "", ArtifactSizeLimits{}, nil, WithFetchProgress(func(p FetchProgress) {
+		local = p.Local
+	})); err != nil {
+		t.Fatalf("cannot fetch ztoc %v again: %v", ztocs[0].Digest, err)
+	}
+	if !local {
+		t.Fatalf("%v was fetched remotely although it's stored locally", ztocs[0].Digest)
+	}
+}
+
+func TestFetchSociArtifactsConnLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	remoteStore, indexDesc, ztocs := newTestSociArtifacts(t)
+	// A single connection to the registry, like with max_conns_per_host = 1, which stalls the fetch
+	// if the body of a zTOC is kept open until the others are fetched.
+	store := &connLimitStore{resolverStorage: remoteStore, conns: make(chan struct{}, 1)}
+	localStore := memory.New()
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+
+	if _, err := FetchSociArtifacts(ctx, refspec, indexDesc, localStore, store, "", ArtifactSizeLimits{}, nil); err != nil {
+		t.Fatalf("cannot fetch SOCI artifacts: %v", err)
+	}
+	for _, desc := range ztocs {
+		if ok, err := localStore.Exists(ctx, desc); err != nil || !ok {
+			t.Fatalf("%v isn't stored locally: %v", desc.Digest, err)
+		}
+	}
+}
+
+func TestFetchSociArtifactsCanceled(t *testing.T) {
+	remoteStore, indexDesc, ztocs := newTestSociArtifacts(t)
+	localStore := memory.New()
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel the fetch once the last zTOC starts to be fetched.
+	store := &cancelingStore{resolverStorage: remoteStore, cancelAt: ztocs[len(ztocs)-1].Digest, cancel: cancel}
+
+	var (
+		mu     sync.Mutex
+		failed = make(map[digest.Digest]bool)
+	)
+	progress := func(p FetchProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Err != nil {
+			failed[p.Descriptor.Digest] = true
+		}
+	}
+	_, err = FetchSociArtifacts(ctx, refspec, indexDesc, localStore, store, "", ArtifactSizeLimits{}, nil, WithFetchProgress(progress))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; expected = %v, got = %v", context.Canceled, err)
+	}
+	for _, desc := range []ocispec.Descriptor{indexDesc, ztocs[len(ztocs)-1]} {
+		if !failed[desc.Digest] {
+			t.Fatalf("the fetch of %v wasn't reported as failed", desc.Digest)
+		}
+		if ok, _ := localStore.Exists(context.Background(), desc); ok {
+			t.Fatalf("%v is stored locally although the fetch was canceled", desc.Digest)
+		}
+	}
+}
+
+func TestFetchSociArtifactsShared(t *testing.T) {
+	ctx := context.Background()
+	remoteStore, indexDesc, ztocs := newTestSociArtifacts(t)
+	store := &countingStore{resolverStorage: remoteStore, fetches: make(map[digest.Digest]int), release: make(chan struct{})}
+	localStore := memory.New()
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+
+	var (
+		shared sharedFetches
+		mu     sync.Mutex
+		waited = make(map[digest.Digest]bool)
+		errs   = make(chan error, 2)
+	)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := FetchSociArtifacts(ctx, refspec, indexDesc, localStore, store, "", ArtifactSizeLimits{}, nil,
+				withSharedFetches(&shared), WithFetchProgress(func(p FetchProgress) {
+					mu.Lock()
+					defer mu.Unlock()
+					if p.Shared {
+						waited[p.Descriptor.Digest] = true
+					}
+				}))
+			errs <- err
+		}()
+	}
+	// Let both fetches start before the index is served.
+	time.Sleep(100 * time.Millisecond)
+	close(store.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("cannot fetch SOCI artifacts: %v", err)
+		}
+	}
+	if n := store.fetches[indexDesc.Digest]; n != 1 {
+		t.Fatalf("index was fetched %d times", n)
+	}
+	if !waited[indexDesc.Digest] {
+		t.Fatal("the fetch of the index wasn't reported as shared")
+	}
+	for _, desc := range ztocs {
+		if n := store.fetches[desc.Digest]; n != 1 {
+			t.Fatalf("%v was fetched %d times", desc.Digest, n)
+		}
+	}
+}
+
+func TestFetchSociArtifactsSharedZtocs(t *testing.T) {
+	ctx := context.Background()
+	remoteStore, indexDesc, ztocs := newTestSociArtifacts(t)
+	localStore := memory.New()
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatalf("cannot parse ref: %v", err)
+	}
+	// Another index has the same zTOCs in the reverse order, so that each fetch reads some of
+	// the zTOCs that the other waits for.
+	reversed := []ocispec.Descriptor{ztocs[2], ztocs[1], ztocs[0]}
+	b, err := soci.MarshalIndex(soci.NewIndex(reversed, nil, nil))
+	if err != nil {
+		t.Fatalf("cannot marshal index: %v", err)
+	}
+	otherDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	if err := remoteStore.Push(ctx, otherDesc, bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot push index: %v", err)
+	}
+	store := &countingStore{resolverStorage: remoteStore, fetches: make(map[digest.Digest]int), release: make(chan struct{})}
+
+	var shared sharedFetches
+	errs := make(chan error, 2)
+	for _, desc := range []ocispec.Descriptor{indexDesc, otherDesc} {
+		desc := desc
+		go func() {
+			_, err := FetchSociArtifacts(ctx, refspec, desc, localStore, store, "", ArtifactSizeLimits{}, nil, withSharedFetches(&shared))
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(store.release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("cannot fetch SOCI artifacts: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the fetches of indices sharing zTOCs")
+		}
+	}
+	for _, desc := range ztocs {
+		if n := store.fetches[desc.Digest]; n != 1 {
+			t.Fatalf("%v was fetched %d times", desc.Digest, n)
+		}
+		if ok, err := localStore.Exists(ctx, desc); err != nil || !ok {
+			t.Fatalf("%v isn't stored locally: %v", desc.Digest, err)
+		}
+	}
+}
+
+// newTestSociArtifacts returns a store holding a SOCI index and its zTOCs.
+func newTestSociArtifacts(t *testing.T) (resolverStorage, ocispec.Descriptor, []ocispec.Descriptor) {
+	ctx := context.Background()
+	store := memory.New()
+	var ztocs []ocispec.Descriptor
+	for i := 0; i < 3; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, 1000*(i+1))
+		desc := ocispec.Descriptor{
+			MediaType: soci.SociLayerMediaType,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		}
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatalf("cannot push ztoc: %v", err)
+		}
+		ztocs = append(ztocs, desc)
+	}
+	b, err := soci.MarshalIndex(soci.NewIndex(ztocs, nil, nil))
+	if err != nil {
+		t.Fatalf("cannot marshal index: %v", err)
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if err := store.Push(ctx, indexDesc, bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot push index: %v", err)
+	}
+	return store, indexDesc, ztocs
+}
+
+// cancelingStore calls cancel when the content `cancelAt` is fetched.
+type cancelingStore struct {
+	resolverStorage
+	cancelAt digest.Digest
+	cancel   context.CancelFunc
+}
+
+func (s *cancelingStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if desc.Digest == s.cancelAt {
+		s.cancel()
+	}
+	return s.resolverStorage.Fetch(ctx, desc)
+}
+
+// countingStore counts the fetches of each artifact, which wait until release is closed.
+type countingStore struct {
+	resolverStorage
+	mu      sync.Mutex
+	fetches map[digest.Digest]int
+	release chan struct{}
+}
+
+func (s *countingStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.fetches[desc.Digest]++
+	s.mu.Unlock()
+	<-s.release
+	return s.resolverStorage.Fetch(ctx, desc)
+}
+
+// connLimitStore allows as many fetches at a time as the capacity of conns. A fetch holds its
+// connection until its body is closed.
+type connLimitStore struct {
+	resolverStorage
+	conns chan struct{}
+}
+
+func (s *connLimitStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	select {
+	case s.conns <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	rc, err := s.resolverStorage.Fetch(ctx, desc)
+	if err != nil {
+		<-s.conns
+		return nil, err
+	}
+	return &connReadCloser{ReadCloser: rc, release: func() { <-s.conns }}, nil
+}
+
+type connReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (c *connReadCloser) Close() error {
+	c.once.Do(c.release)
+	return c.ReadCloser.Close()
+}
+
 func newFakeArtifactFetcher(ref string, contents []byte) (*artifactFetcher, error) {
 	refspec, err := reference.Parse(ref)
 	if err != nil {
 		return nil, err
 	}
-	return newArtifactFetcher(refspec, memory.New(), newFakeRemoteStore(contents))
+	return newArtifactFetcher(refspec, memory.New(), newFakeRemoteStore(contents), "", nil)
 }
 
 func newFakeRemoteStore(contents []byte) resolverStorage {
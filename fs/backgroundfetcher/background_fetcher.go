@@ -19,6 +19,7 @@ package backgroundfetcher
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
@@ -28,6 +29,33 @@ import (
 
 type Option func(*BackgroundFetcher) error
 
+// Policy decides the order in which layers are background fetched.
+type Policy string
+
+const (
+	// PolicyRoundRobin fetches one span of every queued layer in turn.
+	PolicyRoundRobin Policy = "round-robin"
+	// PolicyLayerPriority fetches layers with a higher priority first (see Resolver.Priority),
+	// and among layers of the same priority, the ones accessed more on demand first.
+	// Layers with the same priority and number of accesses are fetched in turn.
+	PolicyLayerPriority Policy = "layer-priority"
+)
+
+// WithPolicy sets the order in which layers are background fetched. Defaults to PolicyRoundRobin.
+func WithPolicy(policy Policy) Option {
+	return func(bf *BackgroundFetcher) error {
+		switch policy {
+		case "":
+			bf.policy = PolicyRoundRobin
+		case PolicyRoundRobin, PolicyLayerPriority:
+			bf.policy = policy
+		default:
+			return fmt.Errorf("unknown background fetch policy %q", policy)
+		}
+		return nil
+	}
+}
+
 func WithSilencePeriod(period time.Duration) Option {
 	return func(bf *BackgroundFetcher) error {
 		bf.silencePeriod = period
@@ -42,6 +70,8 @@ func WithFetchPeriod(period time.Duration) Option {
 	}
 }
 
+// WithMaxQueueSize sets the number of layers which can be queued, including the layers being
+// fetched, before Add blocks. It's at least 1.
 func WithMaxQueueSize(size int) Option {
 	return func(bf *BackgroundFetcher) error {
 		bf.maxQueueSize = size
@@ -71,10 +101,13 @@ func (p defaultPauser) pause(d time.Duration) {
 // A backgroundFetcher is responsible for fetching spans from layers
 // in the background.
 type BackgroundFetcher struct {
+	// periodMu guards silencePeriod, which can be updated while the background fetcher is running.
+	periodMu         sync.Mutex
 	silencePeriod    time.Duration
 	fetchPeriod      time.Duration
 	maxQueueSize     int
 	emitMetricPeriod time.Duration
+	policy           Policy
 
 	rateLimiter *rate.Limiter
 
@@ -83,12 +116,18 @@ type BackgroundFetcher struct {
 	// All span managers are added to the channel and picked up in Run().
 	// If a span manager is still able to fetch, it is reinserted into the chanel.
 	workQueue chan Resolver
+	// queued holds a token for every resolver added and not done yet, wherever it is
+	// (workQueue, pending or being resolved), so Add blocks once maxQueueSize resolvers are queued.
+	queued chan struct{}
+	// pending holds the resolvers taken from workQueue but not resolved yet with PolicyLayerPriority.
+	// It is only accessed by Run().
+	pending   []Resolver
 	closeChan chan struct{}
 	pauseChan chan struct{}
 }
 
 func NewBackgroundFetcher(opts ...Option) (*BackgroundFetcher, error) {
-	bf := new(BackgroundFetcher)
+	bf := &BackgroundFetcher{policy: PolicyRoundRobin}
 	for _, o := range opts {
 		if err := o(bf); err != nil {
 			return nil, err
@@ -98,7 +137,11 @@ func NewBackgroundFetcher(opts ...Option) (*BackgroundFetcher, error) {
 	// with a burst capacity of 1 (i.e., it will never invoke more than 1 bg-fetch
 	// within bf.fetchPeriod)
 	bf.rateLimiter = rate.NewLimiter(rate.Every(bf.fetchPeriod), 1)
+	if bf.maxQueueSize < 1 {
+		bf.maxQueueSize = 1
+	}
 	bf.workQueue = make(chan Resolver, bf.maxQueueSize)
+	bf.queued = make(chan struct{}, bf.maxQueueSize)
 	bf.closeChan = make(chan struct{})
 	bf.pauseChan = make(chan struct{}, bf.maxQueueSize)
 
@@ -111,15 +154,51 @@ func NewBackgroundFetcher(opts ...Option) (*BackgroundFetcher, error) {
 
 // Add a new Resolver to be background fetched from.
 // Sends the resolver through the channel, which will be received in the Run() method.
+// It blocks while maxQueueSize resolvers are queued.
 func (bf *BackgroundFetcher) Add(resolver Resolver) {
+	bf.queued <- struct{}{}
+	bf.workQueue <- resolver
+}
+
+// requeue queues a resolver taken by next() again. It never blocks, since the resolver
+// still holds its token in bf.queued.
+func (bf *BackgroundFetcher) requeue(resolver Resolver) {
 	bf.workQueue <- resolver
 }
 
+// done releases the token of a resolver taken by next() which won't be queued again.
+func (bf *BackgroundFetcher) done() {
+	<-bf.queued
+}
+
+// QueueSize returns the number of layers queued to be background fetched, including the ones being fetched.
+func (bf *BackgroundFetcher) QueueSize() int {
+	return len(bf.queued)
+}
+
+// MaxQueueSize returns the number of layers which can be queued before Add blocks.
+func (bf *BackgroundFetcher) MaxQueueSize() int {
+	return bf.maxQueueSize
+}
+
 func (bf *BackgroundFetcher) Close() error {
 	bf.closeChan <- struct{}{}
 	return nil
 }
 
+// SetFetchPeriod changes how often a span is fetched while the background fetcher is running.
+func (bf *BackgroundFetcher) SetFetchPeriod(period time.Duration) {
+	bf.rateLimiter.SetLimit(rate.Every(period))
+}
+
+// SetSilencePeriod changes the period the background fetcher is paused for when a new image is mounted.
+// It takes effect on the next pause.
+func (bf *BackgroundFetcher) SetSilencePeriod(period time.Duration) {
+	bf.periodMu.Lock()
+	bf.silencePeriod = period
+	bf.periodMu.Unlock()
+}
+
 // Pause sends a signal to pause the background fetcher for silencePeriod on the next iteration.
 func (bf *BackgroundFetcher) Pause() {
 	bf.pauseChan <- struct{}{}
@@ -138,8 +217,11 @@ loop:
 		}
 	}
 	if needPause {
-		log.G(ctx).WithField("silencePeriod", bf.silencePeriod).Debug("new image mounted, pausing the background fetcher for silence period")
-		bf.bfPauser.pause(bf.silencePeriod)
+		bf.periodMu.Lock()
+		silencePeriod := bf.silencePeriod
+		bf.periodMu.Unlock()
+		log.G(ctx).WithField("silencePeriod", silencePeriod).Debug("new image mounted, pausing the background fetcher for silence period")
+		bf.bfPauser.pause(silencePeriod)
 	}
 }
 
@@ -161,20 +243,22 @@ func (bf *BackgroundFetcher) Run(ctx context.Context) error {
 		default:
 		}
 
-		select {
-		case lr := <-bf.workQueue:
+		if lr := bf.next(); lr != nil {
 			if lr.Closed() {
+				bf.done()
 				continue
 			}
 			go func() {
 				more, err := lr.Resolve(ctx)
 				if more {
-					bf.workQueue <- lr
-				} else if err != nil {
+					bf.requeue(lr)
+					return
+				}
+				bf.done()
+				if err != nil {
 					log.G(ctx).WithError(err).Warn("error trying to resolve layer, removing it from the queue")
 				}
 			}()
-		default:
 		}
 
 		if err := bf.rateLimiter.Wait(ctx); err != nil {
@@ -183,6 +267,48 @@ func (bf *BackgroundFetcher) Run(ctx context.Context) error {
 	}
 }
 
+// next returns the resolver to fetch a span from next, or nil if there is none.
+func (bf *BackgroundFetcher) next() Resolver {
+	if bf.policy != PolicyLayerPriority {
+		select {
+		case lr := <-bf.workQueue:
+			return lr
+		default:
+			return nil
+		}
+	}
+
+	// Resolvers are appended to pending in the order they are queued, so picking the
+	// first of the best resolvers and re-queueing it at the end makes equal resolvers take turns.
+loop:
+	for {
+		select {
+		case lr := <-bf.workQueue:
+			if lr.Closed() {
+				bf.done()
+				continue
+			}
+			bf.pending = append(bf.pending, lr)
+		default:
+			break loop
+		}
+	}
+	if len(bf.pending) == 0 {
+		return nil
+	}
+	best := 0
+	bestPriority, bestAccesses := bf.pending[0].Priority(), bf.pending[0].Accesses()
+	for i, lr := range bf.pending[1:] {
+		p, a := lr.Priority(), lr.Accesses()
+		if p > bestPriority || (p == bestPriority && a > bestAccesses) {
+			best, bestPriority, bestAccesses = i+1, p, a
+		}
+	}
+	lr := bf.pending[best]
+	bf.pending = append(bf.pending[:best], bf.pending[best+1:]...)
+	return lr
+}
+
 func (bf *BackgroundFetcher) emitWorkQueueMetric(ctx context.Context, ticker *time.Ticker) {
 	for {
 		select {
@@ -192,7 +318,7 @@ func (bf *BackgroundFetcher) emitWorkQueueMetric(ctx context.Context, ticker *ti
 			return
 		case <-ticker.C:
 			// background fetcher is at the snapshotter's fs level, so no image digest as key
-			commonmetrics.AddImageOperationCount(commonmetrics.BackgroundFetchWorkQueueSize, "", int32(len(bf.workQueue)))
+			commonmetrics.AddImageOperationCount(commonmetrics.BackgroundFetchWorkQueueSize, "", int32(bf.QueueSize()))
 		}
 	}
 }
@@ -197,3 +197,98 @@ func (c *countingWriter) Commit() error {
 func (c *countingWriter) Abort() error {
 	return nil
 }
+
+type fakeResolver struct {
+	name     string
+	priority int
+	accesses int64
+	closed   bool
+}
+
+func (r *fakeResolver) Resolve(context.Context) (bool, error) { return false, nil }
+func (r *fakeResolver) Close() error                          { r.closed = true; return nil }
+func (r *fakeResolver) Closed() bool                          { return r.closed }
+func (r *fakeResolver) Priority() int                         { return r.priority }
+func (r *fakeResolver) Accesses() int64                       { return r.accesses }
+
+func TestBackgroundFetcherLayerPriority(t *testing.T) {
+	bf, err := NewBackgroundFetcher(WithMaxQueueSize(10), WithPolicy(PolicyLayerPriority))
+	if err != nil {
+		t.Fatalf("unable to construct background fetcher: %v", err)
+	}
+	upper := &fakeResolver{name: "upper", priority: -2}
+	middle := &fakeResolver{name: "middle", priority: -1}
+	accessed := &fakeResolver{name: "accessed", priority: -1, accesses: 5}
+	base := &fakeResolver{name: "base", priority: 0}
+	closed := &fakeResolver{name: "closed", priority: 10, closed: true}
+	for _, r := range []Resolver{upper, middle, accessed, base, closed} {
+		bf.Add(r)
+	}
+
+	expected := []string{"base", "accessed", "middle", "upper"}
+	for _, name := range expected {
+		lr := bf.next()
+		if lr == nil {
+			t.Fatalf("expected resolver %q, got none", name)
+		}
+		if got := lr.(*fakeResolver).name; got != name {
+			t.Fatalf("unexpected resolver; expected %q, got %q", name, got)
+		}
+	}
+	if lr := bf.next(); lr != nil {
+		t.Fatalf("expected no resolver, got %q", lr.(*fakeResolver).name)
+	}
+
+	// Resolvers with the same priority and accesses take turns.
+	a := &fakeResolver{name: "a"}
+	b := &fakeResolver{name: "b"}
+	bf.Add(a)
+	bf.Add(b)
+	for _, name := range []string{"a", "b", "a", "b"} {
+		lr := bf.next()
+		if got := lr.(*fakeResolver).name; got != name {
+			t.Fatalf("unexpected resolver; expected %q, got %q", name, got)
+		}
+		bf.requeue(lr)
+	}
+}
+
+func TestBackgroundFetcherMaxQueueSize(t *testing.T) {
+	bf, err := NewBackgroundFetcher(WithMaxQueueSize(2), WithPolicy(PolicyLayerPriority))
+	if err != nil {
+		t.Fatalf("unable to construct background fetcher: %v", err)
+	}
+	bf.Add(&fakeResolver{name: "a"})
+	bf.Add(&fakeResolver{name: "b"})
+	// Resolvers taken from the work queue are still queued.
+	if lr := bf.next(); lr == nil {
+		t.Fatalf("expected a resolver, got none")
+	}
+	added := make(chan struct{})
+	go func() {
+		bf.Add(&fakeResolver{name: "c"})
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatalf("Add didn't block with a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if size := bf.QueueSize(); size != 2 {
+		t.Fatalf("unexpected queue size; expected 2, got %d", size)
+	}
+
+	// Resolvers which are done make room for new ones.
+	bf.done()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("Add blocked after a resolver was done")
+	}
+}
+
+func TestBackgroundFetcherUnknownPolicy(t *testing.T) {
+	if _, err := NewBackgroundFetcher(WithPolicy("random")); err == nil {
+		t.Fatalf("expected an error for an unknown policy")
+	}
+}
@@ -41,6 +41,23 @@ type Resolver interface {
 
 	// Checks whether the resolver is closed or not.
 	Closed() bool
+
+	// Priority is the background fetch priority of the layer. Layers with a higher
+	// priority are fetched first with PolicyLayerPriority.
+	Priority() int
+
+	// Accesses is the number of on-demand reads of the layer so far.
+	Accesses() int64
+}
+
+// ResolverOption is an option of a Resolver.
+type ResolverOption func(*base)
+
+// WithPriority sets the background fetch priority of the layer. Defaults to 0.
+func WithPriority(priority int) ResolverOption {
+	return func(b *base) {
+		b.priority = priority
+	}
 }
 
 type base struct {
@@ -49,7 +66,8 @@ type base struct {
 	closed      bool
 	closedMu    sync.Mutex
 	// timestamp when background fetch for the layer starts
-	start time.Time
+	start    time.Time
+	priority int
 }
 
 func (b *base) Close() error {
@@ -65,18 +83,31 @@ func (b *base) Closed() bool {
 	return b.closed
 }
 
+func (b *base) Priority() int {
+	return b.priority
+}
+
+func (b *base) Accesses() int64 {
+	hits, misses := b.CacheStats()
+	return hits + misses
+}
+
 // A sequentialLayerResolver background fetches spans sequentially, starting from span 0.
 type sequentialLayerResolver struct {
 	*base
 	nextSpanFetchID compression.SpanID
 }
 
-func NewSequentialResolver(layerDigest digest.Digest, spanManager *sm.SpanManager) Resolver {
+func NewSequentialResolver(layerDigest digest.Digest, spanManager *sm.SpanManager, opts ...ResolverOption) Resolver {
+	b := &base{
+		SpanManager: spanManager,
+		layerDigest: layerDigest,
+	}
+	for _, o := range opts {
+		o(b)
+	}
 	return &sequentialLayerResolver{
-		base: &base{
-			SpanManager: spanManager,
-			layerDigest: layerDigest,
-		},
+		base: b,
 	}
 }
 
@@ -0,0 +1,570 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockdev
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+)
+
+// EROFS on-disk format constants.
+// See https://docs.kernel.org/filesystems/erofs.html and include/erofs_fs.h of erofs-utils.
+const (
+	erofsMagic       uint32 = 0xE0F5E1E2
+	erofsSuperOffset        = 1024
+	erofsBlockBits          = 12
+	erofsBlockSize          = 1 << erofsBlockBits
+	erofsSuperSize          = 128
+	// The inodes follow the superblock, so that the root isn't nid 0: readdir reports nids as
+	// inode numbers, and entries with inode number 0 are skipped by libc.
+	erofsMetaBlock = 0
+
+	erofsSlotSize           = 32 // nids are offsets of inodes in slots of 32 bytes
+	erofsInodeSize          = 64 // extended inodes, which hold 32-bit uids and gids and the mtime
+	erofsDirentSize         = 12
+	erofsXattrHeaderSize    = 12
+	erofsXattrEntrySize     = 4
+	erofsNameLen            = 255
+	erofsInodeExtended      = 1 // i_format version bit
+	erofsLayoutFlatPlain    = 0 // i_format data layout: data in contiguous blocks from raw_blkaddr
+	erofsXattrIndexUser     = 1
+	erofsXattrIndexTrusted  = 4
+	erofsXattrIndexSecurity = 6
+
+	erofsFTUnknown = 0
+	erofsFTRegFile = 1
+	erofsFTDir     = 2
+	erofsFTChrdev  = 3
+	erofsFTBlkdev  = 4
+	erofsFTFifo    = 5
+	erofsFTSymlink = 7
+
+	modeIFREG      = 0100000
+	modeIFDIR      = 0040000
+	modeIFLNK      = 0120000
+	modeIFCHR      = 0020000
+	modeIFBLK      = 0060000
+	modeIFIFO      = 0010000
+	modePerm       = 07777
+	defaultDirMode = modeIFDIR | 0755
+
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+var erofsXattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"user.", erofsXattrIndexUser},
+	{"trusted.", erofsXattrIndexTrusted},
+	{"security.", erofsXattrIndexSecurity},
+}
+
+// erofsNode is a file of the image.
+type erofsNode struct {
+	mode     uint16
+	uid, gid uint32
+	mtime    int64
+	mtimeNs  uint32
+	size     uint64
+	rdev     uint32
+	xattrs   map[string][]byte
+	children map[string]*erofsNode
+
+	// offset is the offset of the contents of a regular file in the archive, and link is the
+	// target of a symlink.
+	offset int64
+	link   string
+
+	parent  *erofsNode
+	nid     uint64
+	ino     uint32
+	nlink   uint32
+	blkaddr uint32
+	// data is the contents of a directory or a symlink, which are held in the metadata blocks.
+	data []byte
+}
+
+func (n *erofsNode) isDir() bool { return n.mode&0170000 == modeIFDIR }
+
+func (n *erofsNode) fileType() uint8 {
+	switch n.mode & 0170000 {
+	case modeIFREG:
+		return erofsFTRegFile
+	case modeIFDIR:
+		return erofsFTDir
+	case modeIFLNK:
+		return erofsFTSymlink
+	case modeIFCHR:
+		return erofsFTChrdev
+	case modeIFBLK:
+		return erofsFTBlkdev
+	case modeIFIFO:
+		return erofsFTFifo
+	}
+	return erofsFTUnknown
+}
+
+// extent maps the data blocks of a regular file to its contents in the archive.
+type extent struct {
+	block  uint32
+	offset int64
+	size   int64
+}
+
+// Image is an EROFS image of the files of a layer. Its metadata (the superblock, the inodes, the
+// directories and the symlinks) is built in memory, and the blocks of the regular files are read
+// from the uncompressed layer archive, so that their contents are fetched lazily.
+type Image struct {
+	meta    []byte
+	extents []extent
+	blocks  uint32
+	archive io.ReaderAt
+}
+
+// NewImage builds the EROFS image of the files of a layer, which are read from `archive`.
+// Whiteouts are converted to the format of overlayfs: removed files are character devices
+// 0/0, and opaque directories have the `opaqueXattrs` extended attributes set to "y".
+func NewImage(toc ztoc.TOC, archive io.ReaderAt, opaqueXattrs []string) (*Image, error) {
+	root, err := buildTree(toc, opaqueXattrs)
+	if err != nil {
+		return nil, err
+	}
+	return layoutImage(root, archive)
+}
+
+// Size returns the size of the image in bytes.
+func (img *Image) Size() int64 {
+	return int64(img.blocks) << erofsBlockBits
+}
+
+// ReadAt reads the image at off. The blocks of regular files are read from the archive.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		n, err := img.ReadAt(p, off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos < int64(len(img.meta)) {
+			n += copy(p[n:], img.meta[pos:])
+			continue
+		}
+		block := uint32(pos >> erofsBlockBits)
+		// The extents are sorted by block, and the blocks between extents are zero.
+		i := sort.Search(len(img.extents), func(i int) bool { return img.extents[i].block > block }) - 1
+		if i < 0 {
+			return n, fmt.Errorf("offset %d is not in the data of a file", pos)
+		}
+		e := img.extents[i]
+		rel := pos - int64(e.block)<<erofsBlockBits
+		end := int64(len(p) - n)
+		if i+1 < len(img.extents) {
+			if next := int64(img.extents[i+1].block)<<erofsBlockBits - pos; next < end {
+				end = next
+			}
+		}
+		buf := p[n : n+int(end)]
+		if rel < e.size {
+			m := buf
+			if int64(len(m)) > e.size-rel {
+				m = m[:e.size-rel]
+			}
+			if _, err := img.archive.ReadAt(m, e.offset+rel); err != nil && err != io.EOF {
+				return n, err
+			}
+			buf = buf[len(m):]
+		}
+		// The tail of the last block of a file is zero.
+		for i := range buf {
+			buf[i] = 0
+		}
+		n += int(end)
+	}
+	return n, nil
+}
+
+// buildTree builds the tree of the files of the layer. Later entries replace earlier ones, as
+// they do when the archive is extracted.
+func buildTree(toc ztoc.TOC, opaqueXattrs []string) (*erofsNode, error) {
+	root := &erofsNode{mode: defaultDirMode, children: make(map[string]*erofsNode)}
+	mkdirAll := func(p string) *erofsNode {
+		n := root
+		for _, c := range strings.Split(strings.Trim(p, "/"), "/") {
+			if c == "" {
+				continue
+			}
+			child, ok := n.children[c]
+			if !ok || !child.isDir() {
+				// Parent directories missing from the archive are created with default attributes.
+				child = &erofsNode{mode: defaultDirMode, children: make(map[string]*erofsNode)}
+				n.children[c] = child
+			}
+			n = child
+		}
+		return n
+	}
+
+	for _, f := range toc.FileMetadata {
+		name := path.Clean("/" + f.Name)
+		dir, base := path.Split(name)
+		if len(base) > erofsNameLen {
+			return nil, fmt.Errorf("name of %q is longer than %d bytes", f.Name, erofsNameLen)
+		}
+		if name == "/" {
+			if f.Type == "dir" {
+				setAttrs(root, f)
+			}
+			continue
+		}
+		parent := mkdirAll(dir)
+		if base == whiteoutOpaqueDir {
+			if parent.xattrs == nil {
+				parent.xattrs = make(map[string][]byte)
+			}
+			for _, x := range opaqueXattrs {
+				parent.xattrs[x] = []byte("y")
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			base = strings.TrimPrefix(base, whiteoutPrefix)
+			parent.children[base] = &erofsNode{mode: modeIFCHR, uid: uint32(f.UID), gid: uint32(f.GID)}
+			continue
+		}
+
+		var n *erofsNode
+		switch f.Type {
+		case "hardlink":
+			if n = lookupFile(root, path.Clean("/"+f.Linkname)); n == nil {
+				return nil, fmt.Errorf("target %q of hard link %q not found", f.Linkname, f.Name)
+			}
+			if n.isDir() {
+				return nil, fmt.Errorf("hard link %q to directory %q", f.Name, f.Linkname)
+			}
+		case "dir":
+			n = parent.children[base]
+			if n == nil || !n.isDir() {
+				n = &erofsNode{children: make(map[string]*erofsNode)}
+			}
+			setAttrs(n, f)
+			n.mode = modeIFDIR | uint16(f.Mode&modePerm)
+		default:
+			n = &erofsNode{}
+			setAttrs(n, f)
+			perm := uint16(f.Mode & modePerm)
+			switch f.Type {
+			case "reg":
+				n.mode = modeIFREG | perm
+				n.size = uint64(f.UncompressedSize)
+				n.offset = int64(f.UncompressedOffset)
+			case "symlink":
+				n.mode = modeIFLNK | 0777
+				n.link = f.Linkname
+				n.size = uint64(len(f.Linkname))
+			case "char", "block":
+				n.mode = modeIFCHR | perm
+				if f.Type == "block" {
+					n.mode = modeIFBLK | perm
+				}
+				n.rdev = encodeDev(uint32(f.Devmajor), uint32(f.Devminor))
+			case "fifo":
+				n.mode = modeIFIFO | perm
+			default:
+				return nil, fmt.Errorf("unsupported type %q of %q", f.Type, f.Name)
+			}
+		}
+		parent.children[base] = n
+	}
+	return root, nil
+}
+
+// lookupFile looks up a file of any type at p.
+func lookupFile(root *erofsNode, p string) *erofsNode {
+	dir, base := path.Split(p)
+	n := root
+	for _, c := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if c == "" {
+			continue
+		}
+		if n = n.children[c]; n == nil || !n.isDir() {
+			return nil
+		}
+	}
+	return n.children[base]
+}
+
+func setAttrs(n *erofsNode, f ztoc.FileMetadata) {
+	n.uid, n.gid = uint32(f.UID), uint32(f.GID)
+	if !f.ModTime.IsZero() {
+		n.mtime, n.mtimeNs = f.ModTime.Unix(), uint32(f.ModTime.Nanosecond())
+	}
+	if xattrs := f.ExtendedAttributes(); len(xattrs) > 0 {
+		n.xattrs = xattrs
+	}
+}
+
+// encodeDev encodes a device number like the kernel's new_encode_dev.
+func encodeDev(major, minor uint32) uint32 {
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
+
+// layoutImage assigns the inodes and blocks of the files of the tree and writes the metadata
+// of the image. The image is laid out as:
+//   - the superblock, at offset 1024
+//   - the inodes, right after the superblock
+//   - the contents of the directories and symlinks
+//   - the contents of the regular files, each from a block of its own
+func layoutImage(root *erofsNode, archive io.ReaderAt) (*Image, error) {
+	// Number the files depth first, with the root first, so that its nid fits in 16 bits.
+	var nodes []*erofsNode
+	var walk func(n *erofsNode)
+	walk = func(n *erofsNode) {
+		n.nlink++
+		if n.nlink > 1 {
+			// A hard link to a file already numbered.
+			return
+		}
+		nodes = append(nodes, n)
+		if n.isDir() {
+			n.nlink++
+			for _, name := range sortedNames(n) {
+				c := n.children[name]
+				if c.isDir() {
+					c.parent = n
+					n.nlink++
+				}
+				walk(c)
+			}
+		}
+	}
+	root.parent = root
+	walk(root)
+
+	off := int64(erofsSuperOffset + erofsSuperSize)
+	for i, n := range nodes {
+		size := int64(erofsInodeSize + xattrSize(n.xattrs))
+		size = (size + erofsSlotSize - 1) / erofsSlotSize * erofsSlotSize
+		if size > erofsBlockSize {
+			return nil, fmt.Errorf("extended attributes of a file don't fit in a block")
+		}
+		// Inodes don't cross blocks.
+		if off>>erofsBlockBits != (off+size-1)>>erofsBlockBits {
+			off = (off>>erofsBlockBits + 1) << erofsBlockBits
+		}
+		n.nid = uint64(off-int64(erofsMetaBlock)<<erofsBlockBits) / erofsSlotSize
+		n.ino = uint32(i + 1)
+		off += size
+	}
+	if root.nid > 0xffff {
+		return nil, fmt.Errorf("unexpected root nid %d", root.nid)
+	}
+	block := uint32((off + erofsBlockSize - 1) >> erofsBlockBits)
+
+	// The contents of directories and symlinks follow the inodes.
+	for _, n := range nodes {
+		switch {
+		case n.isDir():
+			n.data = dirBlocks(n)
+			n.size = uint64(len(n.data))
+		case n.mode&0170000 == modeIFLNK:
+			n.data = []byte(n.link)
+		default:
+			continue
+		}
+		if len(n.data) > 0 {
+			n.blkaddr = block
+			block += uint32((len(n.data) + erofsBlockSize - 1) >> erofsBlockBits)
+		}
+	}
+	metaBlocks := block
+
+	// The contents of the regular files are read from the archive.
+	var extents []extent
+	for _, n := range nodes {
+		if n.mode&0170000 != modeIFREG || n.size == 0 {
+			continue
+		}
+		n.blkaddr = block
+		extents = append(extents, extent{block: block, offset: n.offset, size: int64(n.size)})
+		blocks := (n.size + erofsBlockSize - 1) >> erofsBlockBits
+		if uint64(block)+blocks > 1<<32-1 {
+			return nil, fmt.Errorf("image is larger than %d blocks", uint32(1<<32-1))
+		}
+		block += uint32(blocks)
+	}
+
+	meta := make([]byte, int64(metaBlocks)<<erofsBlockBits)
+	for _, n := range nodes {
+		writeInode(meta[int64(erofsMetaBlock)<<erofsBlockBits+int64(n.nid)*erofsSlotSize:], n)
+		if n.data != nil {
+			copy(meta[int64(n.blkaddr)<<erofsBlockBits:], n.data)
+			n.data = nil
+		}
+	}
+	sb := meta[erofsSuperOffset:]
+	binary.LittleEndian.PutUint32(sb[0:], erofsMagic)
+	sb[12] = erofsBlockBits
+	binary.LittleEndian.PutUint16(sb[14:], uint16(root.nid))
+	binary.LittleEndian.PutUint64(sb[16:], uint64(len(nodes)))
+	binary.LittleEndian.PutUint32(sb[36:], block)
+	binary.LittleEndian.PutUint32(sb[40:], erofsMetaBlock)
+
+	return &Image{meta: meta, extents: extents, blocks: block, archive: archive}, nil
+}
+
+func sortedNames(n *erofsNode) []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dirBlocks returns the contents of a directory: blocks of dirents followed by their names,
+// sorted by name across blocks. The size of the directory is the size of the contents without
+// the padding of the last block.
+func dirBlocks(n *erofsNode) []byte {
+	type dirent struct {
+		name string
+		nid  uint64
+		ft   uint8
+	}
+	entries := []dirent{{".", n.nid, erofsFTDir}, {"..", n.parent.nid, erofsFTDir}}
+	for name, c := range n.children {
+		entries = append(entries, dirent{name, c.nid, c.fileType()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var data []byte
+	for len(entries) > 0 {
+		// Fill a block with as many entries as fit.
+		k, used := 0, 0
+		for k < len(entries) && used+erofsDirentSize+len(entries[k].name) <= erofsBlockSize {
+			used += erofsDirentSize + len(entries[k].name)
+			k++
+		}
+		blk := make([]byte, erofsBlockSize)
+		nameoff := erofsDirentSize * k
+		for i, e := range entries[:k] {
+			d := blk[i*erofsDirentSize:]
+			binary.LittleEndian.PutUint64(d[0:], e.nid)
+			binary.LittleEndian.PutUint16(d[8:], uint16(nameoff))
+			d[10] = e.ft
+			nameoff += copy(blk[nameoff:], e.name)
+		}
+		entries = entries[k:]
+		if len(entries) == 0 {
+			blk = blk[:used]
+		}
+		data = append(data, blk...)
+	}
+	return data
+}
+
+// xattrSize returns the size of the inline extended attributes of an inode.
+func xattrSize(xattrs map[string][]byte) int {
+	size := 0
+	for name, value := range xattrs {
+		if _, suffix, ok := xattrIndex(name); ok && len(value) <= 0xffff {
+			size += xattrEntrySize(suffix, value)
+		}
+	}
+	if size == 0 {
+		return 0
+	}
+	return erofsXattrHeaderSize + size
+}
+
+func xattrEntrySize(suffix string, value []byte) int {
+	return (erofsXattrEntrySize + len(suffix) + len(value) + 3) &^ 3
+}
+
+// xattrIndex returns the index of the prefix of an extended attribute and the rest of its name.
+// Extended attributes of other namespaces, e.g. POSIX ACLs, aren't supported.
+func xattrIndex(name string) (uint8, string, bool) {
+	for _, p := range erofsXattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			suffix := name[len(p.prefix):]
+			return p.index, suffix, suffix != "" && len(suffix) <= erofsNameLen
+		}
+	}
+	return 0, "", false
+}
+
+// writeInode writes the extended inode of n and its inline extended attributes to b.
+func writeInode(b []byte, n *erofsNode) {
+	binary.LittleEndian.PutUint16(b[0:], erofsInodeExtended|erofsLayoutFlatPlain<<1)
+	binary.LittleEndian.PutUint16(b[4:], n.mode)
+	binary.LittleEndian.PutUint64(b[8:], n.size)
+	switch n.mode & 0170000 {
+	case modeIFCHR, modeIFBLK:
+		binary.LittleEndian.PutUint32(b[16:], n.rdev)
+	default:
+		binary.LittleEndian.PutUint32(b[16:], n.blkaddr)
+	}
+	binary.LittleEndian.PutUint32(b[20:], n.ino)
+	binary.LittleEndian.PutUint32(b[24:], n.uid)
+	binary.LittleEndian.PutUint32(b[28:], n.gid)
+	binary.LittleEndian.PutUint64(b[32:], uint64(n.mtime))
+	binary.LittleEndian.PutUint32(b[40:], n.mtimeNs)
+	binary.LittleEndian.PutUint32(b[44:], n.nlink)
+
+	size := xattrSize(n.xattrs)
+	if size == 0 {
+		return
+	}
+	// i_xattr_icount counts the header as one slot of 4 bytes, and the entries in slots of 4 bytes.
+	binary.LittleEndian.PutUint16(b[2:], uint16((size-erofsXattrHeaderSize)/4+1))
+	names := make([]string, 0, len(n.xattrs))
+	for name := range n.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	off := erofsInodeSize + erofsXattrHeaderSize
+	for _, name := range names {
+		value := n.xattrs[name]
+		index, suffix, ok := xattrIndex(name)
+		if !ok || len(value) > 0xffff {
+			continue
+		}
+		e := b[off:]
+		e[0] = uint8(len(suffix))
+		e[1] = index
+		binary.LittleEndian.PutUint16(e[2:], uint16(len(value)))
+		copy(e[erofsXattrEntrySize:], suffix)
+		copy(e[erofsXattrEntrySize+len(suffix):], value)
+		off += xattrEntrySize(suffix, value)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockdev
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// buildTestImage builds the EROFS image of a tar of ents.
+func buildTestImage(t *testing.T, ents []testutil.TarEntry) (*Image, []byte) {
+	t.Helper()
+	tarFile, archive, err := testutil.WriteTarToTempFile("erofs-test-*.tar", testutil.BuildTar(ents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tarFile)
+	tb := ztoc.NewTocBuilder()
+	tb.RegisterTarProvider(compression.Uncompressed, ztoc.TarProviderTar)
+	toc, _, err := tb.TocFromFile(compression.Uncompressed, tarFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := NewImage(toc, bytes.NewReader(archive), []string{"trusted.overlay.opaque"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, img.Size())
+	if _, err := img.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	return img, b
+}
+
+// erofsReader reads files from an EROFS image built by NewImage.
+type erofsReader struct {
+	t   *testing.T
+	img []byte
+}
+
+type erofsInode struct {
+	mode    uint16
+	size    uint64
+	u       uint32
+	uid     uint32
+	nlink   uint32
+	xattrs  map[string]string
+	blkaddr uint32
+}
+
+func (r *erofsReader) inode(nid uint64) erofsInode {
+	b := r.img[erofsMetaBlock*erofsBlockSize+nid*erofsSlotSize:]
+	if binary.LittleEndian.Uint16(b[0:]) != erofsInodeExtended {
+		r.t.Fatalf("inode %d is not an extended flat inode", nid)
+	}
+	ino := erofsInode{
+		mode:  binary.LittleEndian.Uint16(b[4:]),
+		size:  binary.LittleEndian.Uint64(b[8:]),
+		u:     binary.LittleEndian.Uint32(b[16:]),
+		uid:   binary.LittleEndian.Uint32(b[24:]),
+		nlink: binary.LittleEndian.Uint32(b[44:]),
+	}
+	ino.blkaddr = ino.u
+	if icount := binary.LittleEndian.Uint16(b[2:]); icount > 0 {
+		ino.xattrs = make(map[string]string)
+		x := b[erofsInodeSize+erofsXattrHeaderSize : erofsInodeSize+erofsXattrHeaderSize+int(icount-1)*4]
+		for len(x) > 0 {
+			nameLen, index, valueLen := int(x[0]), x[1], int(binary.LittleEndian.Uint16(x[2:]))
+			prefix := ""
+			for _, p := range erofsXattrPrefixes {
+				if p.index == index {
+					prefix = p.prefix
+				}
+			}
+			ino.xattrs[prefix+string(x[4:4+nameLen])] = string(x[4+nameLen : 4+nameLen+valueLen])
+			x = x[xattrEntrySize(string(x[4:4+nameLen]), x[4+nameLen:4+nameLen+valueLen]):]
+		}
+	}
+	return ino
+}
+
+func (r *erofsReader) data(ino erofsInode) []byte {
+	off := int64(ino.blkaddr) * erofsBlockSize
+	return r.img[off : off+int64(ino.size)]
+}
+
+// readdir returns the nids of the entries of a directory, checking that they are sorted.
+func (r *erofsReader) readdir(nid uint64) map[string]uint64 {
+	ino := r.inode(nid)
+	data := r.data(ino)
+	entries := make(map[string]uint64)
+	last := ""
+	for blk := 0; blk < len(data); blk += erofsBlockSize {
+		b := data[blk:]
+		if len(b) > erofsBlockSize {
+			b = b[:erofsBlockSize]
+		}
+		n := int(binary.LittleEndian.Uint16(b[8:])) / erofsDirentSize
+		for i := 0; i < n; i++ {
+			d := b[i*erofsDirentSize:]
+			start := int(binary.LittleEndian.Uint16(d[8:]))
+			end := len(b)
+			if i+1 < n {
+				end = int(binary.LittleEndian.Uint16(b[(i+1)*erofsDirentSize+8:]))
+			} else if z := bytes.IndexByte(b[start:], 0); z >= 0 {
+				end = start + z
+			}
+			name := string(b[start:end])
+			if name <= last {
+				r.t.Fatalf("entries of directory %d are not sorted: %q after %q", nid, name, last)
+			}
+			last = name
+			entries[name] = binary.LittleEndian.Uint64(d[0:])
+		}
+	}
+	return entries
+}
+
+func (r *erofsReader) lookup(p string) (uint64, erofsInode) {
+	nid := uint64(binary.LittleEndian.Uint16(r.img[erofsSuperOffset+14:]))
+	for _, c := range strings.Split(strings.Trim(p, "/"), "/") {
+		if c == "" {
+			continue
+		}
+		child, ok := r.readdir(nid)[c]
+		if !ok {
+			r.t.Fatalf("%q not found", p)
+		}
+		nid = child
+	}
+	return nid, r.inode(nid)
+}
+
+func TestImage(t *testing.T) {
+	large := strings.Repeat("0123456789", 1000)
+	var many []testutil.TarEntry
+	for i := 0; i < 500; i++ {
+		many = append(many, testutil.File(fmt.Sprintf("many/file-%03d", i), ""))
+	}
+	img, b := buildTestImage(t, append([]testutil.TarEntry{
+		testutil.Dir("etc/", testutil.WithDirOwner(1, 2)),
+		testutil.File("etc/hosts", "127.0.0.1 localhost\n", testutil.WithFileMode(0640)),
+		testutil.File("etc/large", large, testutil.WithFileXattrs(map[string]string{"user.foo": "bar"})),
+		testutil.File("implicit/dir/file", "x"),
+		testutil.Symlink("etc/link", "hosts"),
+		testutil.Link("etc/hardlink", "etc/hosts"),
+		testutil.Chardev("dev/null", 1, 3),
+		testutil.Fifo("fifo"),
+		testutil.File("opaque/.wh..wh..opq", ""),
+		testutil.File("removed/.wh.file", ""),
+		testutil.File("etc/hosts.new", "replaced"),
+	}, many...))
+	if img.Size()%erofsBlockSize != 0 {
+		t.Fatalf("image size %d is not a multiple of the block size", img.Size())
+	}
+	if magic := binary.LittleEndian.Uint32(b[erofsSuperOffset:]); magic != erofsMagic {
+		t.Fatalf("unexpected magic %#x", magic)
+	}
+	r := &erofsReader{t: t, img: b}
+
+	hostsNid, hosts := r.lookup("etc/hosts")
+	if got := string(r.data(hosts)); got != "127.0.0.1 localhost\n" || hosts.mode != modeIFREG|0640 || hosts.nlink != 2 {
+		t.Fatalf("unexpected etc/hosts: %q, mode %o, nlink %d", got, hosts.mode, hosts.nlink)
+	}
+	if nid, _ := r.lookup("etc/hardlink"); nid != hostsNid {
+		t.Fatalf("hard link doesn't share the inode of its target")
+	}
+	_, l := r.lookup("etc/large")
+	if got := string(r.data(l)); got != large || l.xattrs["user.foo"] != "bar" {
+		t.Fatalf("unexpected etc/large: %d bytes, xattrs %v", len(got), l.xattrs)
+	}
+	if _, link := r.lookup("etc/link"); string(r.data(link)) != "hosts" || link.mode&0170000 != modeIFLNK {
+		t.Fatalf("unexpected etc/link")
+	}
+	if _, etc := r.lookup("etc"); etc.uid != 1 || etc.nlink != 2 {
+		t.Fatalf("unexpected etc: uid %d, nlink %d", etc.uid, etc.nlink)
+	}
+	if _, root := r.lookup("/"); root.nlink != 2+6 {
+		t.Fatalf("unexpected root nlink %d", root.nlink)
+	}
+	if _, null := r.lookup("dev/null"); null.mode&0170000 != modeIFCHR || null.u != encodeDev(1, 3) {
+		t.Fatalf("unexpected dev/null: mode %o, rdev %#x", null.mode, null.u)
+	}
+	if _, f := r.lookup("implicit/dir/file"); string(r.data(f)) != "x" {
+		t.Fatalf("unexpected implicit/dir/file")
+	}
+	if _, opq := r.lookup("opaque"); opq.xattrs["trusted.overlay.opaque"] != "y" {
+		t.Fatalf("opaque directory is not marked opaque: %v", opq.xattrs)
+	}
+	if _, wh := r.lookup("removed/file"); wh.mode != modeIFCHR || wh.u != 0 {
+		t.Fatalf("whiteout is not a character device 0/0: mode %o, rdev %#x", wh.mode, wh.u)
+	}
+	if entries := r.readdir(r.mustNid("many")); len(entries) != 502 {
+		t.Fatalf("unexpected number of entries of many: %d", len(entries))
+	}
+
+	// Reads which span metadata and file blocks are served piecewise.
+	p := make([]byte, 3*erofsBlockSize)
+	off := int64(l.blkaddr)*erofsBlockSize - erofsBlockSize
+	if _, err := img.ReadAt(p, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, b[off:off+int64(len(p))]) {
+		t.Fatalf("unexpected contents read across blocks")
+	}
+	if _, err := img.ReadAt(p, img.Size()-1); err != io.EOF {
+		t.Fatalf("unexpected error reading past the end of the image: %v", err)
+	}
+}
+
+func (r *erofsReader) mustNid(p string) uint64 {
+	nid, _ := r.lookup(p)
+	return nid
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockdev
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/log"
+)
+
+const defaultSocketDir = "/run/soci-snapshotter-grpc/nbd"
+
+// Format is the contents of the block devices of layers.
+type Format string
+
+const (
+	// FormatEROFS serves an EROFS image of the files of each layer.
+	FormatEROFS Format = "erofs"
+	// FormatTar serves the uncompressed archive of each layer.
+	FormatTar Format = "tar"
+)
+
+// Exporter serves every exported layer on its own unix socket in a directory.
+type Exporter struct {
+	socketDir    string
+	format       Format
+	opaqueXattrs []string
+
+	mu      sync.Mutex
+	servers map[string]*Server // mountpoint -> server
+}
+
+// NewExporter creates an Exporter which creates its sockets in socketDir and serves layers in
+// `format`, which defaults to FormatEROFS. The opaque directories of EROFS images have the
+// `opaqueXattrs` extended attributes.
+func NewExporter(socketDir string, format Format, opaqueXattrs []string) (*Exporter, error) {
+	if socketDir == "" {
+		socketDir = defaultSocketDir
+	}
+	switch format {
+	case "":
+		format = FormatEROFS
+	case FormatEROFS, FormatTar:
+	default:
+		return nil, fmt.Errorf("unknown block device format %q", format)
+	}
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		socketDir:    socketDir,
+		format:       format,
+		opaqueXattrs: opaqueXattrs,
+		servers:      make(map[string]*Server),
+	}, nil
+}
+
+// SocketPath returns the path of the NBD socket of the layer mounted at mountpoint.
+func SocketPath(socketDir, mountpoint string) string {
+	if socketDir == "" {
+		socketDir = defaultSocketDir
+	}
+	return filepath.Join(socketDir, fmt.Sprintf("%x", sha256.Sum256([]byte(mountpoint)))[:16]+".nbd")
+}
+
+// Export starts serving the block device of the layer mounted at mountpoint, whose files are
+// `toc` and whose uncompressed archive of `size` bytes is r.
+func (e *Exporter) Export(ctx context.Context, mountpoint string, toc ztoc.TOC, r io.ReaderAt, size int64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.servers[mountpoint]; ok {
+		return nil
+	}
+	if e.format == FormatEROFS {
+		img, err := NewImage(toc, r, e.opaqueXattrs)
+		if err != nil {
+			return fmt.Errorf("failed to build EROFS image: %w", err)
+		}
+		r, size = img, img.Size()
+	}
+	socketPath := SocketPath(e.socketDir, mountpoint)
+	if err := os.RemoveAll(socketPath); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %w", socketPath, err)
+	}
+	s := NewServer("", r, size)
+	e.servers[mountpoint] = s
+	go func() {
+		if err := s.Serve(ctx, l); err != nil {
+			log.G(ctx).WithError(err).WithField("socket", socketPath).Warn("nbd server stopped")
+		}
+	}()
+	log.G(ctx).WithField("socket", socketPath).WithField("format", e.format).Info("serving layer as NBD block device")
+	return nil
+}
+
+// Unexport stops serving the block device of the layer mounted at mountpoint.
+func (e *Exporter) Unexport(mountpoint string) error {
+	e.mu.Lock()
+	s, ok := e.servers[mountpoint]
+	delete(e.servers, mountpoint)
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	err := s.Close()
+	os.Remove(SocketPath(e.socketDir, mountpoint))
+	return err
+}
@@ -0,0 +1,383 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package blockdev serves lazily loaded layers as read-only block devices over
+// the NBD protocol, for microVM runtimes (e.g. Firecracker, Kata containers)
+// that need a block device rather than a shared filesystem.
+//
+// The device contains an EROFS image of the files of the layer (see Image), which guests mount
+// directly, e.g. as the lower layers of overlayfs. Alternatively, it contains the uncompressed
+// layer archive (the tar stream), which can be used as the blob device of an EROFS image in tar
+// index mode (see `mkfs.erofs --tar=i`). Either way, blocks are fetched from the registry
+// through the span manager on first read.
+package blockdev
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+)
+
+// NBD protocol constants.
+// See https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic            uint64 = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic         uint64 = 0x49484156454F5054 // "IHAVEOPT"
+	nbdOptReplyMagic    uint64 = 0x3e889045565a9
+	nbdRequestMagic     uint32 = 0x25609513
+	nbdSimpleReplyMagic uint32 = 0x67446698
+
+	nbdFlagFixedNewstyle uint16 = 1 << 0
+	nbdFlagNoZeroes      uint16 = 1 << 1
+
+	nbdFlagCFixedNewstyle uint32 = 1 << 0
+	nbdFlagCNoZeroes      uint32 = 1 << 1
+
+	nbdFlagHasFlags     uint16 = 1 << 0
+	nbdFlagReadOnly     uint16 = 1 << 1
+	nbdFlagSendFlush    uint16 = 1 << 2
+	nbdFlagCanMultiConn uint16 = 1 << 8
+
+	nbdOptExportName uint32 = 1
+	nbdOptAbort      uint32 = 2
+	nbdOptInfo       uint32 = 6
+	nbdOptGo         uint32 = 7
+
+	nbdRepAck        uint32 = 1
+	nbdRepInfo       uint32 = 3
+	nbdRepErrUnsup   uint32 = 1<<31 + 1
+	nbdRepErrUnknown uint32 = 1<<31 + 6
+
+	nbdInfoExport uint16 = 0
+
+	nbdCmdRead  uint16 = 0
+	nbdCmdWrite uint16 = 1
+	nbdCmdDisc  uint16 = 2
+	nbdCmdFlush uint16 = 3
+
+	nbdEPERM  uint32 = 1
+	nbdEIO    uint32 = 5
+	nbdEINVAL uint32 = 22
+
+	// maxOptionLength and maxRequestLength bound the memory a client can make the server allocate.
+	maxOptionLength  = 64 << 10
+	maxRequestLength = 32 << 20
+
+	// maxInflightReads bounds the reads served concurrently on a connection, so that a client
+	// queueing reads without draining their replies can't make the server allocate more than
+	// maxInflightReads * maxRequestLength bytes.
+	maxInflightReads = 8
+)
+
+const transmissionFlags = nbdFlagHasFlags | nbdFlagReadOnly | nbdFlagSendFlush | nbdFlagCanMultiConn
+
+var errAborted = errors.New("client aborted the negotiation")
+
+// Server serves a single read-only export over NBD.
+type Server struct {
+	name string
+	r    io.ReaderAt
+	size int64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// NewServer creates a Server exporting `size` bytes of `r` under the export name `name`.
+// Clients may connect with any export name if `name` is empty.
+func NewServer(name string, r io.ReaderAt, size int64) *Server {
+	return &Server{
+		name:  name,
+		r:     r,
+		size:  size,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			if err := s.serveConn(ctx, conn); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.G(ctx).WithError(err).Debug("nbd connection failed")
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections and closes all active connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) error {
+	if err := s.negotiate(conn); err != nil {
+		if errors.Is(err, errAborted) {
+			return nil
+		}
+		return err
+	}
+	return s.transmit(ctx, conn)
+}
+
+// negotiate runs the fixed newstyle handshake until the client selects the export.
+func (s *Server) negotiate(conn net.Conn) error {
+	hello := make([]byte, 18)
+	binary.BigEndian.PutUint64(hello[0:], nbdMagic)
+	binary.BigEndian.PutUint64(hello[8:], nbdOptMagic)
+	binary.BigEndian.PutUint16(hello[16:], nbdFlagFixedNewstyle|nbdFlagNoZeroes)
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return err
+	}
+	if clientFlags&nbdFlagCFixedNewstyle == 0 {
+		return fmt.Errorf("client does not support fixed newstyle negotiation")
+	}
+	noZeroes := clientFlags&nbdFlagCNoZeroes != 0
+
+	for {
+		var hdr struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &hdr); err != nil {
+			return err
+		}
+		if hdr.Magic != nbdOptMagic {
+			return fmt.Errorf("unexpected option magic %#x", hdr.Magic)
+		}
+		if hdr.Length > maxOptionLength {
+			return fmt.Errorf("option too large: %d bytes", hdr.Length)
+		}
+		data := make([]byte, hdr.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return err
+		}
+
+		switch hdr.Option {
+		case nbdOptExportName:
+			if !s.matchName(string(data)) {
+				// There is no way to report an error for NBD_OPT_EXPORT_NAME other than closing the connection.
+				return fmt.Errorf("unknown export %q", data)
+			}
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply[0:], uint64(s.size))
+			binary.BigEndian.PutUint16(reply[8:], transmissionFlags)
+			if !noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+			_, err := conn.Write(reply)
+			return err
+		case nbdOptAbort:
+			if err := writeOptionReply(conn, hdr.Option, nbdRepAck, nil); err != nil {
+				return err
+			}
+			return errAborted
+		case nbdOptInfo, nbdOptGo:
+			if len(data) < 4 {
+				return fmt.Errorf("malformed option %d", hdr.Option)
+			}
+			nameLen := binary.BigEndian.Uint32(data)
+			if uint64(nameLen)+4 > uint64(len(data)) {
+				return fmt.Errorf("malformed option %d", hdr.Option)
+			}
+			if !s.matchName(string(data[4 : 4+nameLen])) {
+				if err := writeOptionReply(conn, hdr.Option, nbdRepErrUnknown, []byte("unknown export")); err != nil {
+					return err
+				}
+				continue
+			}
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info[0:], nbdInfoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(s.size))
+			binary.BigEndian.PutUint16(info[10:], transmissionFlags)
+			if err := writeOptionReply(conn, hdr.Option, nbdRepInfo, info); err != nil {
+				return err
+			}
+			if err := writeOptionReply(conn, hdr.Option, nbdRepAck, nil); err != nil {
+				return err
+			}
+			if hdr.Option == nbdOptGo {
+				return nil
+			}
+		default:
+			if err := writeOptionReply(conn, hdr.Option, nbdRepErrUnsup, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) matchName(name string) bool {
+	return s.name == "" || name == "" || name == s.name
+}
+
+func writeOptionReply(w io.Writer, option, replyType uint32, data []byte) error {
+	reply := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint64(reply[0:], nbdOptReplyMagic)
+	binary.BigEndian.PutUint32(reply[8:], option)
+	binary.BigEndian.PutUint32(reply[12:], replyType)
+	binary.BigEndian.PutUint32(reply[16:], uint32(len(data)))
+	_, err := w.Write(append(reply, data...))
+	return err
+}
+
+// transmit serves requests until the client disconnects. Reads are served
+// concurrently, so one slow span fetch does not block the whole device, up to
+// maxInflightReads at a time; further requests wait for a read to complete.
+func (s *Server) transmit(ctx context.Context, conn net.Conn) error {
+	var (
+		writeMu  sync.Mutex
+		wg       sync.WaitGroup
+		inflight = make(chan struct{}, maxInflightReads)
+	)
+	defer wg.Wait()
+	reply := func(handle uint64, errno uint32, data []byte) error {
+		hdr := make([]byte, 16)
+		binary.BigEndian.PutUint32(hdr[0:], nbdSimpleReplyMagic)
+		binary.BigEndian.PutUint32(hdr[4:], errno)
+		binary.BigEndian.PutUint64(hdr[8:], handle)
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if _, err := conn.Write(hdr); err != nil {
+			return err
+		}
+		if errno == 0 && len(data) > 0 {
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		var req struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			return err
+		}
+		if req.Magic != nbdRequestMagic {
+			return fmt.Errorf("unexpected request magic %#x", req.Magic)
+		}
+
+		switch req.Type {
+		case nbdCmdRead:
+			// The offset is checked on its own first, so that a large offset can't wrap the sum around.
+			if size := uint64(s.size); req.Length > maxRequestLength || req.Offset > size || uint64(req.Length) > size-req.Offset {
+				if err := reply(req.Handle, nbdEINVAL, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			inflight <- struct{}{}
+			wg.Add(1)
+			go func(handle uint64, offset int64, length uint32) {
+				defer func() {
+					<-inflight
+					wg.Done()
+				}()
+				buf := make([]byte, length)
+				errno := uint32(0)
+				if n, err := s.r.ReadAt(buf, offset); n < len(buf) {
+					log.G(ctx).WithError(err).WithField("offset", offset).Warn("nbd read failed")
+					errno = nbdEIO
+				}
+				if err := reply(handle, errno, buf); err != nil {
+					conn.Close()
+				}
+			}(req.Handle, int64(req.Offset), req.Length)
+		case nbdCmdWrite:
+			// The payload must be consumed to keep the stream in sync.
+			if _, err := io.CopyN(io.Discard, conn, int64(req.Length)); err != nil {
+				return err
+			}
+			if err := reply(req.Handle, nbdEPERM, nil); err != nil {
+				return err
+			}
+		case nbdCmdFlush:
+			if err := reply(req.Handle, 0, nil); err != nil {
+				return err
+			}
+		case nbdCmdDisc:
+			return nil
+		default:
+			if err := reply(req.Handle, nbdEINVAL, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockdev
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClient is a minimal NBD client speaking the fixed newstyle protocol.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *testClient) write(v ...interface{}) {
+	for _, x := range v {
+		if err := binary.Write(c.conn, binary.BigEndian, x); err != nil {
+			c.t.Fatalf("failed to write to server: %v", err)
+		}
+	}
+}
+
+func (c *testClient) read(v ...interface{}) {
+	for _, x := range v {
+		if err := binary.Read(c.conn, binary.BigEndian, x); err != nil {
+			c.t.Fatalf("failed to read from server: %v", err)
+		}
+	}
+}
+
+// handshake negotiates the export with NBD_OPT_GO and returns its size and transmission flags.
+func (c *testClient) handshake(name string) (uint64, uint16) {
+	var (
+		magic, optMagic uint64
+		flags           uint16
+	)
+	c.read(&magic, &optMagic, &flags)
+	if magic != nbdMagic || optMagic != nbdOptMagic {
+		c.t.Fatalf("unexpected handshake magic %#x %#x", magic, optMagic)
+	}
+	c.write(nbdFlagCFixedNewstyle | nbdFlagCNoZeroes)
+
+	c.write(nbdOptMagic, nbdOptGo, uint32(4+len(name)+2), uint32(len(name)), []byte(name), uint16(0))
+	var (
+		size      uint64
+		exportFlg uint16
+	)
+	for {
+		var (
+			replyMagic uint64
+			option     uint32
+			replyType  uint32
+			length     uint32
+		)
+		c.read(&replyMagic, &option, &replyType, &length)
+		if replyMagic != nbdOptReplyMagic || option != nbdOptGo {
+			c.t.Fatalf("unexpected option reply %#x %d", replyMagic, option)
+		}
+		data := make([]byte, length)
+		c.read(data)
+		switch replyType {
+		case nbdRepInfo:
+			size = binary.BigEndian.Uint64(data[2:])
+			exportFlg = binary.BigEndian.Uint16(data[10:])
+		case nbdRepAck:
+			return size, exportFlg
+		default:
+			c.t.Fatalf("unexpected option reply type %#x", replyType)
+		}
+	}
+}
+
+func (c *testClient) request(typ uint16, handle, offset uint64, length uint32) {
+	c.write(nbdRequestMagic, uint16(0), typ, handle, offset, length)
+}
+
+func (c *testClient) reply(handle uint64) uint32 {
+	var (
+		magic, errno uint32
+		h            uint64
+	)
+	c.read(&magic, &errno, &h)
+	if magic != nbdSimpleReplyMagic || h != handle {
+		c.t.Fatalf("unexpected reply %#x for handle %d", magic, h)
+	}
+	return errno
+}
+
+func TestServer(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	s := NewServer("", bytes.NewReader(content), int64(len(content)))
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "nbd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background(), l)
+	defer s.Close()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn}
+
+	size, flags := c.handshake("layer")
+	if size != uint64(len(content)) {
+		t.Fatalf("unexpected export size; expected = %d, got = %d", len(content), size)
+	}
+	if flags&nbdFlagReadOnly == 0 {
+		t.Fatalf("export is not read-only")
+	}
+
+	c.request(nbdCmdRead, 1, 100, 200)
+	if errno := c.reply(1); errno != 0 {
+		t.Fatalf("read failed with errno %d", errno)
+	}
+	got := make([]byte, 200)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[100:300]) {
+		t.Fatalf("unexpected content read from the export")
+	}
+
+	c.request(nbdCmdRead, 2, uint64(len(content))-10, 20)
+	if errno := c.reply(2); errno != nbdEINVAL {
+		t.Fatalf("unexpected errno for out of bounds read; expected = %d, got = %d", nbdEINVAL, errno)
+	}
+
+	// The end of this read wraps around to 10 bytes past the start of the export.
+	c.request(nbdCmdRead, 5, 1<<64-10, 20)
+	if errno := c.reply(5); errno != nbdEINVAL {
+		t.Fatalf("unexpected errno for read with overflowing offset; expected = %d, got = %d", nbdEINVAL, errno)
+	}
+
+	c.request(nbdCmdWrite, 3, 0, 4)
+	c.write([]byte("test"))
+	if errno := c.reply(3); errno != nbdEPERM {
+		t.Fatalf("unexpected errno for write; expected = %d, got = %d", nbdEPERM, errno)
+	}
+
+	c.request(nbdCmdDisc, 4, 0, 0)
+}
+
+// blockingReader blocks every read until released, counting the reads in progress.
+type blockingReader struct {
+	io.ReaderAt
+	release         chan struct{}
+	active, maxSeen int32
+}
+
+func (r *blockingReader) ReadAt(p []byte, off int64) (int, error) {
+	n := atomic.AddInt32(&r.active, 1)
+	defer atomic.AddInt32(&r.active, -1)
+	for {
+		max := atomic.LoadInt32(&r.maxSeen)
+		if n <= max || atomic.CompareAndSwapInt32(&r.maxSeen, max, n) {
+			break
+		}
+	}
+	<-r.release
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func TestServerBoundsInflightReads(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	r := &blockingReader{ReaderAt: bytes.NewReader(content), release: make(chan struct{})}
+	s := NewServer("", r, int64(len(content)))
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "nbd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background(), l)
+	defer s.Close()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn}
+	c.handshake("layer")
+
+	const reads = 2 * maxInflightReads
+	for i := 0; i < reads; i++ {
+		c.request(nbdCmdRead, uint64(i), 0, 16)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&r.active) < maxInflightReads {
+		if time.Now().After(deadline) {
+			t.Fatalf("reads were not served concurrently")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Give the server a chance to start reads beyond the bound.
+	time.Sleep(50 * time.Millisecond)
+	if max := atomic.LoadInt32(&r.maxSeen); max > maxInflightReads {
+		t.Fatalf("unexpected reads in flight; expected at most %d, got = %d", maxInflightReads, max)
+	}
+
+	close(r.release)
+	for i := 0; i < reads; i++ {
+		var (
+			magic, errno uint32
+			handle       uint64
+		)
+		c.read(&magic, &errno, &handle)
+		if errno != 0 {
+			t.Fatalf("read %d failed with errno %d", handle, errno)
+		}
+		c.read(make([]byte, 16))
+	}
+	c.request(nbdCmdDisc, reads, 0, 0)
+}
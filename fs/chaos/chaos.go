@@ -0,0 +1,165 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package chaos injects synthetic faults into the fetch path and the FUSE operations of the
+// snapshotter, to test how applications and the snapshotter itself cope with failures.
+package chaos
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// Injector injects the faults of a FaultInjectionConfig with their probabilities.
+// A nil Injector injects nothing.
+type Injector struct {
+	cfg config.FaultInjectionConfig
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	sleep func(time.Duration)
+}
+
+// New returns an Injector of the faults of cfg, or nil if fault injection isn't enabled.
+func New(cfg config.FaultInjectionConfig) (*Injector, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+	for name, p := range map[string]float64{
+		"fetch_delay_probability":    cfg.FetchDelayProbability,
+		"registry_error_probability": cfg.RegistryErrorProbability,
+		"fuse_delay_probability":     cfg.FuseDelayProbability,
+		"fuse_error_probability":     cfg.FuseErrorProbability,
+	} {
+		if p < 0 || p > 1 {
+			return nil, fmt.Errorf("invalid %s %v: must be between 0 and 1", name, p)
+		}
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{
+		cfg:   cfg,
+		rand:  rand.New(rand.NewSource(seed)),
+		sleep: time.Sleep,
+	}, nil
+}
+
+// hit returns true with probability p.
+func (i *Injector) hit(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rand.Float64() < p
+}
+
+// delay sleeps for msec milliseconds with probability p.
+func (i *Injector) delay(msec int64, p float64) {
+	if msec > 0 && i.hit(p) {
+		i.sleep(time.Duration(msec) * time.Millisecond)
+	}
+}
+
+// FuseError returns the errno a FUSE operation fails with, or 0 if it doesn't fail.
+// The operation is delayed first if a delay is injected.
+func (i *Injector) FuseError() syscall.Errno {
+	if i == nil {
+		return 0
+	}
+	i.delay(i.cfg.FuseDelayMsec, i.cfg.FuseDelayProbability)
+	if i.hit(i.cfg.FuseErrorProbability) {
+		return syscall.EIO
+	}
+	return 0
+}
+
+// Transport returns a RoundTripper which sends requests with `next`, after injecting
+// delays and 5xx responses into them.
+func (i *Injector) Transport(next http.RoundTripper) http.RoundTripper {
+	if i == nil {
+		return next
+	}
+	return &transport{i, next}
+}
+
+type transport struct {
+	i    *Injector
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.i.delay(t.i.cfg.FetchDelayMsec, t.i.cfg.FetchDelayProbability)
+	if t.i.hit(t.i.cfg.RegistryErrorProbability) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("injected fault")),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// RegistryHosts returns RegistryHosts whose clients inject faults into the requests they send.
+func (i *Injector) RegistryHosts(hosts source.RegistryHosts) source.RegistryHosts {
+	if i == nil {
+		return hosts
+	}
+	return func(ref reference.Spec) ([]docker.RegistryHost, error) {
+		registryHosts, err := hosts(ref)
+		if err != nil {
+			return nil, err
+		}
+		injected := make([]docker.RegistryHost, 0, len(registryHosts))
+		for _, h := range registryHosts {
+			client := http.DefaultClient
+			if h.Client != nil {
+				client = h.Client
+			}
+			inner := client.Transport
+			if inner == nil {
+				inner = http.DefaultTransport
+			}
+			injectedClient := *client
+			injectedClient.Transport = i.Transport(inner)
+			h.Client = &injectedClient
+			injected = append(injected, h)
+		}
+		return injected, nil
+	}
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+)
+
+func TestNew(t *testing.T) {
+	if i, err := New(config.FaultInjectionConfig{FuseErrorProbability: 1}); i != nil || err != nil {
+		t.Fatalf("disabled fault injection returned an injector: %v, %v", i, err)
+	}
+	if _, err := New(config.FaultInjectionConfig{Enable: true, RegistryErrorProbability: 1.5}); err == nil {
+		t.Fatalf("probability above 1 was accepted")
+	}
+	var i *Injector
+	if errno := i.FuseError(); errno != 0 {
+		t.Fatalf("nil injector injected %v", errno)
+	}
+	if tr := i.Transport(http.DefaultTransport); tr != http.DefaultTransport {
+		t.Fatalf("nil injector wrapped the transport")
+	}
+}
+
+func TestFuseError(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		cfg            config.FaultInjectionConfig
+		errno          syscall.Errno
+		expectedDelays int
+	}{
+		{
+			name: "no faults",
+			cfg:  config.FaultInjectionConfig{Enable: true, FuseDelayMsec: 10},
+		},
+		{
+			name:  "errors",
+			cfg:   config.FaultInjectionConfig{Enable: true, FuseErrorProbability: 1},
+			errno: syscall.EIO,
+		},
+		{
+			name:           "delays",
+			cfg:            config.FaultInjectionConfig{Enable: true, FuseDelayMsec: 10, FuseDelayProbability: 1},
+			expectedDelays: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i, err := New(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var delays []time.Duration
+			i.sleep = func(d time.Duration) { delays = append(delays, d) }
+			for n := 0; n < 3; n++ {
+				if errno := i.FuseError(); errno != tc.errno {
+					t.Fatalf("unexpected errno; expected = %v, got = %v", tc.errno, errno)
+				}
+			}
+			if len(delays) != tc.expectedDelays {
+				t.Fatalf("unexpected delays: %v", delays)
+			}
+			for _, d := range delays {
+				if d != 10*time.Millisecond {
+					t.Fatalf("unexpected delay %v", d)
+				}
+			}
+		})
+	}
+}
+
+func TestFaultProbability(t *testing.T) {
+	cfg := config.FaultInjectionConfig{Enable: true, Seed: 1, FuseErrorProbability: 0.25}
+	count := func() int {
+		i, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for k := 0; k < 1000; k++ {
+			if i.FuseError() != 0 {
+				n++
+			}
+		}
+		return n
+	}
+	n := count()
+	if n < 150 || n > 350 {
+		t.Fatalf("%d of 1000 operations failed with probability 0.25", n)
+	}
+	if count() != n {
+		t.Fatalf("faults of the same seed differ")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name             string
+		cfg              config.FaultInjectionConfig
+		expectedStatus   int
+		expectedRequests int
+	}{
+		{
+			name:             "no faults",
+			cfg:              config.FaultInjectionConfig{Enable: true},
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 1,
+		},
+		{
+			name:           "registry errors",
+			cfg:            config.FaultInjectionConfig{Enable: true, RegistryErrorProbability: 1},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests = 0
+			i, err := New(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: i.Transport(http.DefaultTransport)}
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expectedStatus || requests != tc.expectedRequests {
+				t.Fatalf("unexpected response %d after %d requests", resp.StatusCode, requests)
+			}
+		})
+	}
+}
@@ -18,10 +18,12 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/hashicorp/go-multierror"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2/content"
 )
@@ -54,6 +56,72 @@ type Inner interface {
 	ReferrersCaller
 }
 
+// raceReferrersCaller lists referrers with several ReferrersCallers concurrently,
+// e.g. with the Referrers API and with the fallback referrers tag schema, so that the
+// discovery latency is that of the fastest mechanism which finds referrers rather
+// than the sum of the latencies of the mechanisms tried before it.
+type raceReferrersCaller struct {
+	callers []ReferrersCaller
+}
+
+// NewRaceReferrersCaller returns a ReferrersCaller which queries all of `callers` concurrently.
+// The referrers found by the first caller which succeeds with a non-empty list are passed to `fn`
+// and the other callers are canceled. If no caller finds referrers, no referrers are passed to `fn`
+// unless every caller failed, in which case the errors are returned.
+func NewRaceReferrersCaller(callers ...ReferrersCaller) ReferrersCaller {
+	return &raceReferrersCaller{callers: callers}
+}
+
+type referrersResult struct {
+	descs []ocispec.Descriptor
+	err   error
+}
+
+func (c *raceReferrersCaller) Referrers(ctx context.Context, desc ocispec.Descriptor, artifactType string, fn func(referrers []ocispec.Descriptor) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	// cancels the callers which didn't win the race
+	defer cancel()
+
+	results := make(chan referrersResult, len(c.callers))
+	for _, caller := range c.callers {
+		caller := caller
+		go func() {
+			var descs []ocispec.Descriptor
+			err := caller.Referrers(ctx, desc, artifactType, func(referrers []ocispec.Descriptor) error {
+				descs = append(descs, referrers...)
+				return nil
+			})
+			results <- referrersResult{descs, err}
+		}()
+	}
+
+	var (
+		errs      error
+		succeeded bool
+	)
+	for range c.callers {
+		res := <-results
+		if res.err != nil {
+			errs = multierror.Append(errs, res.err)
+			continue
+		}
+		if len(res.descs) > 0 {
+			return fn(res.descs)
+		}
+		succeeded = true
+	}
+	if succeeded {
+		return nil
+	}
+	return errs
+}
+
+// storageWithReferrers lists the referrers of the contents of a storage with a distinct ReferrersCaller.
+type storageWithReferrers struct {
+	content.Storage
+	ReferrersCaller
+}
+
 type OCIArtifactClient struct {
 	Inner
 }
@@ -75,11 +143,45 @@ func (c *OCIArtifactClient) SelectReferrer(ctx context.Context, desc ocispec.Des
 	return fn(descs)
 }
 
+// AllReferrers returns the SOCI indices referring to `desc`, packaged either as OCI 1.0 manifests
+// or as OCI 1.1 artifacts (see soci.IndexPackaging).
 func (c *OCIArtifactClient) AllReferrers(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
 	descs := []ocispec.Descriptor{}
 	err := c.Referrers(ctx, desc, soci.SociIndexArtifactType, func(referrers []ocispec.Descriptor) error {
 		descs = append(descs, referrers...)
 		return nil
 	})
-	return descs, err
+	if err != nil || len(descs) > 0 {
+		return descs, err
+	}
+	return c.oci11Referrers(ctx, desc)
+}
+
+// oci11Referrers returns the SOCI indices packaged as OCI 1.1 artifacts referring to `desc` whose
+// artifact type was derived from their config, e.g. by the fallback referrers tag schema of clients
+// and registries predating OCI 1.1, which lists them with the artifact type of the empty config.
+func (c *OCIArtifactClient) oci11Referrers(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var candidates []ocispec.Descriptor
+	err := c.Referrers(ctx, desc, soci.MediaTypeEmptyJSON, func(referrers []ocispec.Descriptor) error {
+		candidates = append(candidates, referrers...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	descs := []ocispec.Descriptor{}
+	for _, candidate := range candidates {
+		b, err := content.FetchAll(ctx, c.Inner, candidate)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch referrer %s: %w", candidate.Digest, err)
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil || manifest.ArtifactType != soci.SociIndexArtifactType {
+			continue
+		}
+		candidate.ArtifactType = manifest.ArtifactType
+		descs = append(descs, candidate)
+	}
+	return descs, nil
 }
@@ -17,11 +17,14 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -104,3 +107,168 @@ func TestOCIArtifactClientSelectReferrer(t *testing.T) {
 		})
 	}
 }
+
+type fakeReferrersCaller struct {
+	descs []ocispec.Descriptor
+	err   error
+	// block makes Referrers wait until its context is canceled.
+	block    bool
+	canceled chan struct{}
+}
+
+func (f *fakeReferrersCaller) Referrers(ctx context.Context, desc ocispec.Descriptor, artifactType string, fn func(referrers []ocispec.Descriptor) error) error {
+	if f.block {
+		<-ctx.Done()
+		close(f.canceled)
+		return ctx.Err()
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if len(f.descs) == 0 {
+		return nil
+	}
+	return fn(f.descs)
+}
+
+func TestRaceReferrersCaller(t *testing.T) {
+	descs := []ocispec.Descriptor{{Digest: digest.FromBytes([]byte("foo")), Size: 3}}
+	errFake := errors.New("referrers API is not supported")
+	testCases := []struct {
+		name          string
+		callers       []*fakeReferrersCaller
+		expectedDescs []ocispec.Descriptor
+		expectedErr   error
+	}{
+		{
+			name:          "first success wins and cancels the other caller",
+			callers:       []*fakeReferrersCaller{{block: true}, {descs: descs}},
+			expectedDescs: descs,
+		},
+		{
+			name:          "failure of a caller is ignored if another finds referrers",
+			callers:       []*fakeReferrersCaller{{err: errFake}, {descs: descs}},
+			expectedDescs: descs,
+		},
+		{
+			name:          "empty list does not win against referrers",
+			callers:       []*fakeReferrersCaller{{}, {descs: descs}},
+			expectedDescs: descs,
+		},
+		{
+			name:    "no referrers",
+			callers: []*fakeReferrersCaller{{}, {err: errFake}},
+		},
+		{
+			name:        "all callers fail",
+			callers:     []*fakeReferrersCaller{{err: errFake}, {err: errFake}},
+			expectedErr: errFake,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var callers []ReferrersCaller
+			for _, c := range tc.callers {
+				c.canceled = make(chan struct{})
+				callers = append(callers, c)
+			}
+			var got []ocispec.Descriptor
+			err := NewRaceReferrersCaller(callers...).Referrers(context.Background(), ocispec.Descriptor{}, "", func(referrers []ocispec.Descriptor) error {
+				got = append(got, referrers...)
+				return nil
+			})
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected error; expected = %v, got = %v", tc.expectedErr, err)
+			}
+			if diff := cmp.Diff(tc.expectedDescs, got); diff != "" {
+				t.Fatalf("unexpected referrers; diff = %v", diff)
+			}
+			for _, c := range tc.callers {
+				if c.block {
+					<-c.canceled
+				}
+			}
+		})
+	}
+}
+
+// fakeArtifactInner lists referrers by artifact type and fetches them from memory.
+type fakeArtifactInner struct {
+	fakeInner
+	referrers map[string][]ocispec.Descriptor
+	blobs     map[digest.Digest][]byte
+}
+
+func (f *fakeArtifactInner) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	b, ok := f.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s: not found", desc.Digest)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (f *fakeArtifactInner) Referrers(ctx context.Context, desc ocispec.Descriptor, artifactType string, fn func(referrers []ocispec.Descriptor) error) error {
+	return fn(f.referrers[artifactType])
+}
+
+func TestOCIArtifactClientAllReferrers(t *testing.T) {
+	blobs := make(map[digest.Digest][]byte)
+	add := func(index *soci.Index) ocispec.Descriptor {
+		b, err := soci.MarshalIndex(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		blobs[desc.Digest] = b
+		return desc
+	}
+	subject := ocispec.Descriptor{Digest: digest.FromBytes([]byte("image")), Size: 5}
+	legacy := add(soci.NewIndex(nil, &subject, nil))
+	oci11Index := soci.NewIndex(nil, &subject, nil)
+	oci11Index.Packaging = soci.IndexPackagingOCI11
+	oci11 := add(oci11Index)
+	other := add(&soci.Index{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: "application/vnd.example.sbom", Packaging: soci.IndexPackagingOCI11})
+
+	withArtifactType := func(desc ocispec.Descriptor, artifactType string) ocispec.Descriptor {
+		desc.ArtifactType = artifactType
+		return desc
+	}
+	testCases := []struct {
+		name      string
+		referrers map[string][]ocispec.Descriptor
+		expected  []ocispec.Descriptor
+	}{
+		{
+			name: "indices listed with the SOCI index artifact type",
+			referrers: map[string][]ocispec.Descriptor{
+				soci.SociIndexArtifactType: {withArtifactType(legacy, soci.SociIndexArtifactType), withArtifactType(oci11, soci.SociIndexArtifactType)},
+			},
+			expected: []ocispec.Descriptor{withArtifactType(legacy, soci.SociIndexArtifactType), withArtifactType(oci11, soci.SociIndexArtifactType)},
+		},
+		{
+			name: "OCI 1.1 indices listed with the artifact type of their config",
+			referrers: map[string][]ocispec.Descriptor{
+				soci.MediaTypeEmptyJSON: {withArtifactType(other, soci.MediaTypeEmptyJSON), withArtifactType(oci11, soci.MediaTypeEmptyJSON)},
+			},
+			expected: []ocispec.Descriptor{withArtifactType(oci11, soci.SociIndexArtifactType)},
+		},
+		{
+			name:     "no referrers",
+			expected: []ocispec.Descriptor{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewOCIArtifactClient(&fakeArtifactInner{referrers: tc.referrers, blobs: blobs})
+			descs, err := client.AllReferrers(context.Background(), subject)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, descs); diff != "" {
+				t.Fatalf("unexpected referrers; diff = %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	defaultCompactionCheckPeriod       = 10 * time.Minute
+	defaultCompactionMinFetchedPercent = 80
+	defaultCompactionMinFiles          = 64
+)
+
+// spanCompactor packs the cached spans of the layers which are mostly fetched into a file
+// per layer, so that long-running nodes don't accumulate a file per cached span.
+type spanCompactor struct {
+	checkPeriod       time.Duration
+	minFetchedPercent int64
+	minFiles          int
+	mounts            *mountRegistry
+}
+
+// newSpanCompactor returns a compactor of the layers of `mounts`.
+func newSpanCompactor(cfg config.CompactionConfig, mounts *mountRegistry) *spanCompactor {
+	checkPeriod := time.Duration(cfg.CheckPeriodSec) * time.Second
+	if checkPeriod == 0 {
+		checkPeriod = defaultCompactionCheckPeriod
+	}
+	minFetchedPercent := cfg.MinFetchedPercent
+	if minFetchedPercent == 0 {
+		minFetchedPercent = defaultCompactionMinFetchedPercent
+	}
+	minFiles := cfg.MinFiles
+	if minFiles == 0 {
+		minFiles = defaultCompactionMinFiles
+	}
+	return &spanCompactor{
+		checkPeriod:       checkPeriod,
+		minFetchedPercent: minFetchedPercent,
+		minFiles:          minFiles,
+		mounts:            mounts,
+	}
+}
+
+// run compacts the layers every check period until ctx is done.
+func (c *spanCompactor) run(ctx context.Context) {
+	ticker := time.NewTicker(c.checkPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.compactLayers(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// compactLayers compacts the layers which are fetched at least by the minimum percentage
+// and have been fetched further since they were last compacted.
+func (c *spanCompactor) compactLayers(ctx context.Context) {
+	for _, l := range c.mounts.list() {
+		info := l.layer.Info()
+		fetchedSize := l.compactedSize
+		// Layers whose spans were removed since they were last compacted, e.g. by demotion,
+		// are compacted too, so that the space of the removed spans is reclaimed from the pack.
+		removed := info.FetchedSize < fetchedSize
+		if !removed && (info.Size <= 0 || info.FetchedSize*100 < info.Size*c.minFetchedPercent || info.FetchedSize == fetchedSize) {
+			continue
+		}
+		n, err := l.layer.Compact(c.minFiles)
+		if err != nil {
+			if !errors.Is(err, spanmanager.ErrCompactionNotSupported) {
+				log.G(ctx).WithError(err).WithField(logutil.LayerField, info.Digest).Warn("failed to compact cached spans")
+			}
+			continue
+		}
+		if n == 0 && !removed {
+			// Too few spans were cached since the last compaction; check again next time.
+			continue
+		}
+		l.compactedSize = info.FetchedSize
+		log.G(ctx).WithField(logutil.LayerField, info.Digest).WithField("spans", n).Debug("compacted cached spans")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+)
+
+type compactTestLayer struct {
+	breakableLayer
+	size, fetchedSize int64
+	files             int
+	compacted         int
+	calls             int
+}
+
+func (l *compactTestLayer) Info() layer.Info {
+	return layer.Info{Size: l.size, FetchedSize: l.fetchedSize}
+}
+
+func (l *compactTestLayer) Compact(minFiles int) (int, error) {
+	l.calls++
+	if l.files < minFiles {
+		return 0, nil
+	}
+	n := l.files
+	l.files = 0
+	l.compacted++
+	return n, nil
+}
+
+func TestSpanCompactor(t *testing.T) {
+	mounts := newMountRegistry()
+	c := newSpanCompactor(config.CompactionConfig{MinFetchedPercent: 50, MinFiles: 2}, mounts)
+	ctx := context.Background()
+	fetched := &compactTestLayer{size: 100, fetchedSize: 60, files: 4}
+	unfetched := &compactTestLayer{size: 100, fetchedSize: 40, files: 4}
+	fewFiles := &compactTestLayer{size: 100, fetchedSize: 100, files: 1}
+	mounts.add("/mnt/1", &layerMount{layer: fetched})
+	mounts.add("/mnt/2", &layerMount{layer: unfetched})
+	mounts.add("/mnt/3", &layerMount{layer: fewFiles})
+
+	c.compactLayers(ctx)
+	if fetched.compacted != 1 {
+		t.Fatal("mostly fetched layer was not compacted")
+	}
+	if unfetched.compacted != 0 {
+		t.Fatal("layer which is mostly not fetched was compacted")
+	}
+	if fewFiles.compacted != 0 {
+		t.Fatal("layer with too few cached files was compacted")
+	}
+
+	// Layers are compacted again once more of them is fetched.
+	fetched.files = 4
+	c.compactLayers(ctx)
+	if fetched.compacted != 1 {
+		t.Fatal("layer was compacted again before more of it was fetched")
+	}
+	fetched.fetchedSize = 80
+	fewFiles.files = 2
+	c.compactLayers(ctx)
+	if fetched.compacted != 2 || fewFiles.compacted != 1 {
+		t.Fatalf("layers were not compacted after more of them was fetched; compacted = %d, %d", fetched.compacted, fewFiles.compacted)
+	}
+
+	// Layers whose spans were removed are compacted to reclaim their space from the pack,
+	// even if they are no longer mostly fetched.
+	calls := fetched.calls
+	fetched.fetchedSize = 30
+	c.compactLayers(ctx)
+	if fetched.calls != calls+1 {
+		t.Fatal("layer whose spans were removed was not compacted")
+	}
+	c.compactLayers(ctx)
+	if fetched.calls != calls+1 {
+		t.Fatal("layer was compacted again before more of its spans were removed")
+	}
+
+	// Unmounted layers are no longer compacted.
+	mounts.remove("/mnt/1")
+	fetched.fetchedSize, fetched.files = 100, 4
+	c.compactLayers(ctx)
+	if fetched.compacted != 2 {
+		t.Fatal("unmounted layer was compacted")
+	}
+}
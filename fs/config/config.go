@@ -61,10 +61,43 @@ type Config struct {
 	MountTimeoutSec                int64  `toml:"mount_timeout_sec"`
 	FuseMetricsEmitWaitDurationSec int64  `toml:"fuse_metrics_emit_wait_duration_sec"`
 
+	// PrefetchPercent is the percentage of the spans of each layer which are fetched when the
+	// layer is mounted, before the mount returns. 0 fetches spans only when they are read.
+	// The soci.prefetch snapshot label of an image overrides it.
+	PrefetchPercent int `toml:"prefetch_percent"`
+
 	RootPath         string `toml:"root_path"`
 	ContentStorePath string `toml:"content_store_path"`
 	IndexStorePath   string `toml:"index_store_path"`
 
+	// Offline makes the snapshotter serve SOCI artifacts and layers from the local content store only,
+	// e.g. as imported with `soci bundle import`, and never contact registries or blob sources.
+	// Images whose SOCI index isn't in the local stores can't be lazily loaded.
+	Offline bool `toml:"offline"`
+
+	// ShareLayerMounts makes the snapshots of the same layer share a single FUSE mount of the layer,
+	// which is bind-mounted read-only at the mountpoint of each snapshot and unmounted once the
+	// last of them is unmounted. By default, each snapshot mounts its layer with a FUSE server of its own.
+	ShareLayerMounts bool `toml:"share_layer_mounts"`
+
+	// ShareNamespaces makes all containerd namespaces share the SOCI artifacts fetched into the local
+	// content store and the caches of layers. By default, each namespace fetches and caches them on its
+	// own, so that a namespace never reads what was fetched for another. Sharing them is only safe
+	// when all namespaces are trusted, e.g. in single-tenant clusters.
+	ShareNamespaces bool `toml:"share_namespaces"`
+
+	// SharedContentStore makes the local content store safe to share between several snapshotters,
+	// e.g. on an NFS or EFS volume mounted by several nodes. Blobs are written through temporary
+	// files renamed into place under an advisory lock, and partially written blobs are ignored.
+	// The artifacts fetched by the snapshotter are only stored in it with ShareNamespaces, since
+	// the artifacts of each namespace are otherwise stored apart.
+	SharedContentStore bool `toml:"shared_content_store"`
+
+	// ContentStoreTiers are additional directories of the local content store. SOCI artifacts
+	// fetched by the snapshotter are stored in the first tier whose rules they match, or else in
+	// ContentStorePath. Artifacts are moved to their tier on startup when the tiers change.
+	ContentStoreTiers []ContentStoreTierConfig `toml:"content_store_tier"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
@@ -74,6 +107,39 @@ type Config struct {
 	FuseConfig `toml:"fuse"`
 
 	BackgroundFetchConfig `toml:"background_fetch"`
+
+	// ArtifactFetchConfig is config for fetching SOCI artifacts (SOCI indexes and zTOCs).
+	ArtifactFetchConfig `toml:"artifact_fetch"`
+
+	// ReexportConfig is config for re-exporting lazily loaded layers to VMs.
+	ReexportConfig `toml:"reexport"`
+
+	// BlockDeviceConfig is config for serving lazily loaded layers as block devices.
+	BlockDeviceConfig `toml:"block_device"`
+
+	// PassthroughConfig is config for bypassing FUSE once layers are fully fetched.
+	PassthroughConfig `toml:"passthrough"`
+
+	// IPFSConfig is config for fetching blobs from IPFS.
+	IPFSConfig `toml:"ipfs"`
+
+	// IdleDemotionConfig is config for demoting the cached spans of images which are no longer read.
+	IdleDemotionConfig `toml:"idle_demotion"`
+
+	// ArtifactStoreConfig is config for fetching blobs through a shared soci-store artifact service.
+	ArtifactStoreConfig `toml:"artifact_store"`
+
+	// PeerCacheConfig is config for sharing cached spans with the snapshotters of other nodes.
+	PeerCacheConfig `toml:"peer_cache"`
+
+	// QuotaConfig is config for limiting the registry egress and cache usage of each containerd namespace.
+	QuotaConfig `toml:"quota"`
+
+	// CompactionConfig is config for packing the cached spans of mostly fetched layers into a file per layer.
+	CompactionConfig `toml:"compaction"`
+
+	// FaultInjectionConfig is config for injecting faults into registry fetches and FUSE operations in tests.
+	FaultInjectionConfig `toml:"fault_injection"`
 }
 
 type BlobConfig struct {
@@ -85,9 +151,50 @@ type BlobConfig struct {
 	MinWaitMsec          int64 `toml:"min_wait_msec"`
 	MaxWaitMsec          int64 `toml:"max_wait_msec"`
 
+	// RetryBudget is the number of retries shared by the in-flight fetches of a layer, so that
+	// a registry outage fails the fetches fast (and triggers fallbacks) instead of each fetch
+	// backing off up to MaxRetries times. Defaults to 100. A negative value disables the budget.
+	RetryBudget int `toml:"retry_budget"`
+	// RetryBudgetRefillMsec is the number of milliseconds after which a spent retry is
+	// returned to the retry budget of a layer. Defaults to 1000.
+	RetryBudgetRefillMsec int64 `toml:"retry_budget_refill_msec"`
+
+	// FullFetchOnIgnoredRange makes layers of hosts which ignore Range headers, i.e. which return
+	// the whole blob when a range is requested, download their whole blob once in the background
+	// and serve reads from it, instead of downloading the whole blob for every read.
+	FullFetchOnIgnoredRange bool `toml:"full_fetch_on_ignored_range"`
+
 	// MaxSpanVerificationRetries defines the number of additional times fetch
 	// will be invoked in case of span verification failure.
 	MaxSpanVerificationRetries int `toml:"max_span_verification_retries"`
+
+	// MaxConcurrentSpanFetches limits the number of spans fetched from remote at the same time
+	// across all layers. When the limit is reached, reads of executables are served before
+	// regular data reads, which are served before background fetches.
+	// Defaults to 32. A negative value disables the limit.
+	MaxConcurrentSpanFetches int `toml:"max_concurrent_span_fetches"`
+
+	// MaxConcurrentSpanFetchesPerLayer limits the number of spans of a single layer fetched from
+	// remote at the same time, so that the random reads of one container can't take all the
+	// fetches allowed by MaxConcurrentSpanFetches. Waiting fetches are then served from the layers
+	// with the fewest fetches in flight first. Defaults to 0 (no limit per layer).
+	MaxConcurrentSpanFetchesPerLayer int `toml:"max_concurrent_span_fetches_per_layer"`
+
+	// MaxDecompressWorkers limits the number of spans decompressed at the same time across all layers.
+	// Spans fetched ahead of reads are decompressed in the background by these workers, so that
+	// sequential reads of a layer use multiple cores. The spans which reads wait for are decompressed
+	// first. Defaults to the number of CPUs.
+	// A negative value disables the limit and the background decompression.
+	MaxDecompressWorkers int `toml:"max_decompress_workers"`
+
+	// SequentialReadaheadMinBytes is the read-ahead window of a file once it's read sequentially,
+	// i.e. a read starts where the previous read of the open file ended. The spans of the window
+	// after each sequential read are fetched in the background. Defaults to 4MiB.
+	// A negative value disables the read-ahead of sequentially read files.
+	SequentialReadaheadMinBytes int64 `toml:"sequential_readahead_min_bytes"`
+	// SequentialReadaheadMaxBytes is the size up to which the read-ahead window doubles
+	// with every further sequential read of a file. Defaults to 32MiB.
+	SequentialReadaheadMaxBytes int64 `toml:"sequential_readahead_max_bytes"`
 }
 
 type DirectoryCacheConfig struct {
@@ -95,6 +202,15 @@ type DirectoryCacheConfig struct {
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 	Direct           bool `toml:"direct" default:"true"`
+
+	// PersistSpans keeps the cached spans of each layer on disk across snapshotter restarts.
+	// Cached spans are validated against their digests before they are reused.
+	// Persisted spans are not evicted, so the span cache grows with the layers that are read.
+	PersistSpans bool `toml:"persist_spans"`
+
+	// Mmap serves reads of cached spans and HTTP chunks from memory mappings of the
+	// cache files, which saves a copy per read for hot layers.
+	Mmap bool `toml:"mmap"`
 }
 
 type FuseConfig struct {
@@ -111,6 +227,10 @@ type FuseConfig struct {
 	// for debugging purposes only. This option may emit sensitive information,
 	// e.g. filenames and paths within an image
 	LogFuseOperations bool `toml:"log_fuse_operations"`
+
+	// MaxConcurrentReads limits the number of reads served at the same time by the FUSE server
+	// of each mount. Further reads wait in a queue until a read completes. Defaults to 0 (no limit).
+	MaxConcurrentReads int `toml:"max_concurrent_reads"`
 }
 
 type BackgroundFetchConfig struct {
@@ -132,4 +252,254 @@ type BackgroundFetchConfig struct {
 	// EmitMetricPeriodSec is the amount of interval (in second) at which the background
 	// fetcher emits metrics
 	EmitMetricPeriodSec int64 `toml:"emit_metric_period_sec"`
+
+	// Policy decides the order in which layers are fetched: "round-robin" (the default) fetches
+	// one span of every layer in turn; "layer-priority" fetches lower layers of an image first,
+	// then layers which have been read more on demand. The priority of a layer can be overridden
+	// with the "com.amazon.soci.background-fetch-priority" annotation on its ztoc in the SOCI index.
+	Policy string `toml:"policy"`
+}
+
+type ArtifactFetchConfig struct {
+	// MaxSociIndexSize is the maximum size (in bytes) of a SOCI index the snapshotter
+	// will fetch. Defaults to 4MiB. A negative value disables the limit.
+	MaxSociIndexSize int64 `toml:"max_soci_index_size"`
+
+	// MaxZtocSize is the maximum size (in bytes) of a zTOC the snapshotter
+	// will fetch. Defaults to 256MiB. A negative value disables the limit.
+	MaxZtocSize int64 `toml:"max_ztoc_size"`
+
+	// DiscoveryErrorTTLSec is how long (in seconds) a failure to discover or fetch the SOCI artifacts
+	// of an image is cached before the next mount of the image tries again, e.g. once its SOCI index
+	// was pushed. Defaults to 30s. A negative value caches failures until the snapshotter restarts.
+	DiscoveryErrorTTLSec int64 `toml:"discovery_error_ttl_sec"`
+
+	// MissingIndexTTLSec is how long (in seconds) an image found to have no SOCI index is remembered
+	// as such, so that its mounts don't list its referrers again. Defaults to 5 minutes. A negative
+	// value disables it, so that every new mount of the image lists its referrers.
+	MissingIndexTTLSec int64 `toml:"missing_index_ttl_sec"`
+
+	// RefreshTTLSec is how long (in seconds) the SOCI index found for an image mounted by tag, e.g.
+	// `:latest`, is used before the next mount of the image discovers its index again, e.g. to find
+	// an index pushed to replace it. The images mounted by digest keep their index until the
+	// snapshotter restarts. Defaults to 0, which never refreshes discoveries.
+	RefreshTTLSec int64 `toml:"refresh_ttl_sec"`
+
+	// AsyncZtocFetch makes the mounts of an image wait for its SOCI index only, rather than for
+	// all of its zTOCs. Each zTOC is fetched when its layer is mounted, or pre-resolved by the mount
+	// of another layer of the image. Defaults to false.
+	AsyncZtocFetch bool `toml:"async_ztoc_fetch"`
+}
+
+type ContentStoreTierConfig struct {
+	// Path is the directory of the tier.
+	Path string `toml:"path"`
+
+	// MediaTypes are the media types of the artifacts stored in the tier, e.g. "application/octet-stream"
+	// for zTOCs. Empty means any media type.
+	MediaTypes []string `toml:"media_types"`
+
+	// MinSize and MaxSize are the sizes (in bytes) of the smallest and largest artifacts stored
+	// in the tier. Zero means no limit.
+	MinSize int64 `toml:"min_size"`
+	MaxSize int64 `toml:"max_size"`
+}
+
+type ReexportConfig struct {
+	// Mode is the protocol used to re-export every mounted layer read-only,
+	// so that VM-isolated runtimes can consume it lazily: "virtiofs" or "nfs".
+	// Layers are not re-exported if empty.
+	Mode string `toml:"mode"`
+
+	// VirtiofsdPath is the path to the virtiofsd binary. Defaults to virtiofsd in $PATH.
+	VirtiofsdPath string `toml:"virtiofsd_path"`
+
+	// SocketDir is the directory of the vhost-user sockets of the virtiofsd daemons.
+	// Defaults to /run/soci-snapshotter-grpc/virtiofs.
+	SocketDir string `toml:"socket_dir"`
+
+	// NFSClients is the exportfs client specification layers are exported to over NFS,
+	// e.g. "10.0.0.0/8". Every mounted layer is readable by any host it matches, so it
+	// should only match the VMs of the node. Required in "nfs" mode.
+	NFSClients string `toml:"nfs_clients"`
+}
+
+type BlockDeviceConfig struct {
+	// Enable serves every mounted layer as a read-only NBD block device,
+	// for microVM runtimes that need a block device.
+	Enable bool `toml:"enable"`
+
+	// Format is the contents of the block devices: "erofs" (default), an EROFS image of the
+	// files of the layer, or "tar", the uncompressed archive of the layer.
+	Format string `toml:"format"`
+
+	// SocketDir is the directory of the NBD unix sockets. Defaults to /run/soci-snapshotter-grpc/nbd.
+	SocketDir string `toml:"socket_dir"`
+}
+
+type PassthroughConfig struct {
+	// Enable extracts every layer to local disk once it has been fully fetched (e.g. by the
+	// background fetcher) and bind-mounts the extracted contents over its FUSE mountpoint,
+	// so that containers started afterwards read the layer without FUSE overhead.
+	// Containers already using the layer keep reading through FUSE.
+	// This needs as much extra disk space as the uncompressed layers.
+	Enable bool `toml:"enable"`
+
+	// CheckPeriodSec is how often (in seconds) mounted layers are checked for being fully fetched. Defaults to 10.
+	CheckPeriodSec int64 `toml:"check_period_sec"`
+}
+
+type CompactionConfig struct {
+	// Enable packs the cached spans of mostly fetched layers into a file per layer in the
+	// background, so that the cache doesn't use a file per span. Only directory caches are compacted.
+	Enable bool `toml:"enable"`
+
+	// CheckPeriodSec is how often (in seconds) layers are checked for compaction. Defaults to 600.
+	CheckPeriodSec int64 `toml:"check_period_sec"`
+
+	// MinFetchedPercent is the percentage of a layer which must be fetched before its cached spans
+	// are compacted. Defaults to 80.
+	MinFetchedPercent int64 `toml:"min_fetched_percent"`
+
+	// MinFiles is the number of spans which must be cached in files of their own before the cached
+	// spans of a layer are compacted. Defaults to 64.
+	MinFiles int `toml:"min_files"`
+}
+
+// FaultInjectionConfig injects synthetic delays and errors into the requests sent to registries and
+// into the FUSE operations of lazily loaded layers, to test how applications and the retries of the
+// snapshotter cope with failures. It's for testing only: it must never be enabled in production.
+// Probabilities are between 0 and 1.
+type FaultInjectionConfig struct {
+	// Enable turns fault injection on.
+	Enable bool `toml:"enable"`
+
+	// Seed seeds the random choice of the faults, so that the faults of a test run can be reproduced.
+	// 0 seeds it with the time of startup.
+	Seed int64 `toml:"seed"`
+
+	// FetchDelayMsec is how long (in milliseconds) requests to registries are delayed with
+	// FetchDelayProbability.
+	FetchDelayMsec        int64   `toml:"fetch_delay_msec"`
+	FetchDelayProbability float64 `toml:"fetch_delay_probability"`
+
+	// RegistryErrorProbability is the probability that a request to a registry fails with a
+	// 503 Service Unavailable response without being sent.
+	RegistryErrorProbability float64 `toml:"registry_error_probability"`
+
+	// FuseDelayMsec is how long (in milliseconds) FUSE operations are delayed with FuseDelayProbability.
+	FuseDelayMsec        int64   `toml:"fuse_delay_msec"`
+	FuseDelayProbability float64 `toml:"fuse_delay_probability"`
+
+	// FuseErrorProbability is the probability that a FUSE operation fails with EIO.
+	FuseErrorProbability float64 `toml:"fuse_error_probability"`
+}
+
+type IdleDemotionConfig struct {
+	// IdlePeriodSec is how long (in seconds) none of the layers of an image must be read
+	// before the cached spans of the image are demoted. 0 disables demotion.
+	IdlePeriodSec int64 `toml:"idle_period_sec"`
+
+	// Mode is how the cached spans of idle images are demoted: "drop" removes them from the cache,
+	// so they are fetched again when read, and "compress" removes the uncompressed copies of spans
+	// whose compressed copies are cached too, so they are only uncompressed again when read.
+	// Defaults to "drop".
+	Mode string `toml:"mode"`
+
+	// CheckPeriodSec is how often (in seconds) images are checked for being idle. Defaults to 60.
+	CheckPeriodSec int64 `toml:"check_period_sec"`
+}
+
+type IPFSConfig struct {
+	// Enable fetches spans and zTOCs from an IPFS node when it has them, and from the registry otherwise.
+	// A blob is looked up by the CID of the `ipfs://<cid>` URL of its descriptor, if any, or else by the
+	// CIDv1 of its sha256 digest, which only exists if the blob was added to IPFS as a single raw block.
+	Enable bool `toml:"enable"`
+
+	// APIAddress is the URL of the RPC API of the IPFS (Kubo) node. Defaults to http://127.0.0.1:5001.
+	APIAddress string `toml:"api_address"`
+
+	// FetchTimeoutMsec is how long (in ms) IPFS may take to start serving a blob
+	// before the registry is used instead. Defaults to 2000.
+	FetchTimeoutMsec int64 `toml:"fetch_timeout_msec"`
+
+	// UnavailableBackoffSec is how long (in seconds) a blob which IPFS failed to serve
+	// is fetched from the registry only. Defaults to 300.
+	UnavailableBackoffSec int64 `toml:"unavailable_backoff_sec"`
+}
+
+type ArtifactStoreConfig struct {
+	// Address is the address of a soci-store running as an artifact service (`soci-store --artifact-service`),
+	// e.g. unix:///run/soci-store/artifacts.sock or https://10.0.0.1:8090. If set, SOCI indices, zTOCs and spans
+	// are fetched through the service, which fetches and caches them once for all the snapshotters sharing it.
+	// The registry is used when the service is unavailable.
+	Address string `toml:"address"`
+
+	// FetchTimeoutMsec is how long (in ms) the service may take to start serving a blob
+	// before the registry is used instead. Defaults to 10000.
+	FetchTimeoutMsec int64 `toml:"fetch_timeout_msec"`
+
+	// TLS is the client certificate with which the snapshotter authenticates to a service
+	// listening on TCP, which requires mutual TLS. It's unused for unix sockets.
+	TLS TLSConfig `toml:"tls"`
+}
+
+// TLSConfig configures mutual TLS with the services of other nodes: the certificate presented
+// to them, and the CAs their certificates must be signed by.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM files of the certificate presented to services and of its key.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// CAFile is the PEM file of the CAs which sign the certificates of the services, and of the
+	// snapshotters connecting to the services of this snapshotter.
+	CAFile string `toml:"ca_file"`
+}
+
+// PeerCacheConfig configures the peer cache protocol, with which snapshotters of a cluster fetch
+// the spans cached by each other before fetching them from registries, so that spans read on any
+// node only transit the WAN once. Spans fetched from peers are verified against their zTOCs.
+type PeerCacheConfig struct {
+	// Peers are the addresses of the peer caches of other snapshotters, e.g. 10.0.0.2:8091 or
+	// https://node-2:8091. They are asked for spans in order before the registry.
+	Peers []string `toml:"peers"`
+
+	// ListenAddress is the TCP address the spans cached by this snapshotter are served to
+	// peers on, e.g. :8091. The spans are not served if it's empty.
+	ListenAddress string `toml:"listen_address"`
+
+	// FetchTimeoutMsec is how long (in ms) a peer may take to serve a span before the next
+	// peer or the registry is used instead. Defaults to 2000.
+	FetchTimeoutMsec int64 `toml:"fetch_timeout_msec"`
+
+	// UnavailableBackoffSec is how long (in seconds) a peer which couldn't be reached is
+	// not asked for spans. Defaults to 30.
+	UnavailableBackoffSec int64 `toml:"unavailable_backoff_sec"`
+
+	// TLS is the certificate with which the snapshotter authenticates to its peers and serves them,
+	// and the CA which signs the certificates of all the peers. It's required.
+	TLS TLSConfig `toml:"tls"`
+}
+
+// QuotaConfig limits the resources used by each containerd namespace, so that one tenant of a
+// shared node can't exhaust them. The usage of a namespace is accounted as the spans of its layers
+// are fetched and cached, and persists across unmounts and restarts; the spans of layers shared by
+// several namespaces count towards one of them. Limits are in bytes. 0 means unlimited.
+type QuotaConfig struct {
+	// FetchBytes limits the bytes fetched from registries for a namespace, including the layers
+	// unpacked locally, until its usage is reset.
+	FetchBytes int64 `toml:"fetch_bytes"`
+
+	// CacheBytes limits the bytes of the layers of a namespace held in the span cache.
+	CacheBytes int64 `toml:"cache_bytes"`
+
+	// Namespaces overrides the limits of specific namespaces.
+	Namespaces map[string]NamespaceQuotaConfig `toml:"namespaces"`
+}
+
+// NamespaceQuotaConfig overrides the limits of a namespace.
+// 0 means the limit of QuotaConfig. A negative limit means unlimited.
+type NamespaceQuotaConfig struct {
+	FetchBytes int64 `toml:"fetch_bytes"`
+	CacheBytes int64 `toml:"cache_bytes"`
 }
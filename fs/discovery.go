@@ -0,0 +1,358 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+)
+
+// discoveryCache holds the SOCI contexts of images by manifest digest, so that an image
+// rebuilt under the same tag never reuses the SOCI artifacts of its previous digest.
+//
+// Images are often pulled right after they are pushed, before their SOCI index is pushed.
+// So that the index is found by a later mount, failed discoveries are only cached for
+// `errorTTL`, and they are dropped as soon as the ref of the image moves to another digest.
+// Images found to have no SOCI index are cached for `missingIndexTTL` instead, so that the
+// repeated mounts of images which aren't indexed don't list the referrers of each of them.
+// The SOCI index of an image can be replaced too, so the mounts of an image by tag discover
+// its index again once it was found more than `refreshTTL` ago. Digest-pinned mounts don't.
+//
+// Unless namespaces share them, the discoveries of each containerd namespace are cached apart,
+// so that a namespace never uses the SOCI artifacts fetched for another.
+type discoveryCache struct {
+	// errorTTL is how long failed discoveries are cached. Negative means until restart.
+	errorTTL time.Duration
+	// missingIndexTTL is how long discoveries which found no SOCI index are cached.
+	// Negative means until restart.
+	missingIndexTTL time.Duration
+	now             func() time.Time
+	// isolateNamespaces caches the discoveries of each containerd namespace apart.
+	isolateNamespaces bool
+	// refreshTTL is how long successful discoveries are used by the mounts of images by tag
+	// before they are discovered again. Zero means until they are invalidated or restart.
+	refreshTTL time.Duration
+
+	mu       sync.Mutex
+	contexts map[discoveryKey]*sociContext
+	// refs are the manifest digests image refs were last mounted with.
+	refs map[discoveryKey]string
+}
+
+// discoveryKey is the key of a manifest digest or an image ref in the discoveries of a namespace.
+// The namespace is empty if namespaces share their discoveries.
+type discoveryKey struct {
+	namespace, name string
+}
+
+func newDiscoveryCache(errorTTL, missingIndexTTL time.Duration) *discoveryCache {
+	return &discoveryCache{
+		errorTTL:        errorTTL,
+		missingIndexTTL: missingIndexTTL,
+		now:             time.Now,
+		contexts:        make(map[discoveryKey]*sociContext),
+		refs:            make(map[discoveryKey]string),
+	}
+}
+
+// get returns the SOCI context of the image `manifestDigest` mounted as `ref`.
+// If `ref` was mounted with another digest before, the failed discoveries of both digests
+// are dropped along with recording the new digest of `ref`, so that no mount sees the update
+// of the ref with a stale failure.
+func (d *discoveryCache) get(ctx context.Context, ref, manifestDigest string) *sociContext {
+	var ns string
+	if d.isolateNamespaces {
+		ns, _ = namespaces.Namespace(ctx)
+	}
+	key := discoveryKey{ns, manifestDigest}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if prev, ok := d.refs[discoveryKey{ns, ref}]; ok && prev != manifestDigest {
+		log.G(ctx).WithField(logutil.ImageField, ref).WithField("previous", prev).WithField(logutil.DigestField, manifestDigest).
+			Info("image ref was updated, invalidating failed SOCI discoveries")
+		d.dropFailed(discoveryKey{ns, prev}, true)
+		d.dropFailed(key, true)
+	}
+	d.refs[discoveryKey{ns, ref}] = manifestDigest
+	d.dropFailed(key, false)
+	if d.refreshTTL > 0 && !pinned(ref) {
+		d.dropStale(ctx, key)
+	}
+	c, ok := d.contexts[key]
+	if !ok {
+		// The clock of the cache may be replaced, e.g. by tests, after the context is created.
+		c = &sociContext{clock: func() time.Time { return d.now() }}
+		d.contexts[key] = c
+	}
+	return c
+}
+
+// dropFailed drops the context of `key` if its discovery failed, and either `force`
+// is true or the failure expired. Contexts whose discovery is in progress are kept.
+func (d *discoveryCache) dropFailed(key discoveryKey, force bool) {
+	c, ok := d.contexts[key]
+	if !ok {
+		return
+	}
+	failedAt, err := c.failure()
+	if err == nil {
+		return
+	}
+	ttl := d.errorTTL
+	if errors.Is(err, ErrNoReferrers) {
+		ttl = d.missingIndexTTL
+	}
+	if force || (ttl >= 0 && d.now().Sub(failedAt) >= ttl) {
+		delete(d.contexts, key)
+	}
+}
+
+// dropStale drops the context of `key` if its discovery found the SOCI index more than
+// refreshTTL ago. The layers already mounted keep using the SOCI index they were mounted with.
+func (d *discoveryCache) dropStale(ctx context.Context, key discoveryKey) {
+	c, ok := d.contexts[key]
+	if !ok {
+		return
+	}
+	if foundAt, ok := c.found(); ok && d.now().Sub(foundAt) >= d.refreshTTL {
+		log.G(ctx).WithField(logutil.DigestField, key.name).Debug("refreshing SOCI discovery")
+		delete(d.contexts, key)
+	}
+}
+
+// pinned returns whether the image ref `ref` is pinned to a digest, so that it never moves.
+func pinned(ref string) bool {
+	refspec, err := reference.Parse(ref)
+	return err == nil && refspec.Digest() != ""
+}
+
+// Statuses of cached discoveries.
+const (
+	// DiscoveryPending is the status of discoveries which are in progress.
+	DiscoveryPending = "pending"
+	// DiscoveryFound is the status of discoveries which found the SOCI index of the image.
+	DiscoveryFound = "found"
+	// DiscoveryMissing is the status of discoveries which found that the image has no SOCI index.
+	DiscoveryMissing = "missing"
+	// DiscoveryFailed is the status of discoveries which failed, e.g. to fetch the SOCI index.
+	DiscoveryFailed = "failed"
+)
+
+// DiscoveryEntry is the cached discovery of the SOCI index of an image.
+type DiscoveryEntry struct {
+	// Namespace is the containerd namespace of the discovery. It's empty if namespaces share their discoveries.
+	Namespace      string `json:"namespace,omitempty"`
+	ManifestDigest string `json:"manifestDigest"`
+	// Refs are the image refs last mounted with the digest.
+	Refs        []string `json:"refs,omitempty"`
+	Status      string   `json:"status"`
+	IndexDigest string   `json:"indexDigest,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	// ExpiresAt is when a missing or failed discovery is dropped. It's unset if the discovery
+	// is kept until it's invalidated or the snapshotter restarts.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// RefreshAt is when a successful discovery is discovered again by the next mount of the
+	// image by tag. It's unset if the discovery isn't refreshed.
+	RefreshAt *time.Time `json:"refreshAt,omitempty"`
+}
+
+// entries returns the cached discoveries ordered by manifest digest and namespace.
+func (d *discoveryCache) entries() []DiscoveryEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	refs := make(map[discoveryKey][]string)
+	for ref, manifestDigest := range d.refs {
+		key := discoveryKey{ref.namespace, manifestDigest}
+		refs[key] = append(refs[key], ref.name)
+	}
+	entries := make([]DiscoveryEntry, 0, len(d.contexts))
+	for key, c := range d.contexts {
+		e := DiscoveryEntry{Namespace: key.namespace, ManifestDigest: key.name, Refs: refs[key], Status: DiscoveryPending}
+		sort.Strings(e.Refs)
+		indexDigest, failedAt, err := c.discovery()
+		switch {
+		case err != nil:
+			e.Status, e.Error = DiscoveryFailed, err.Error()
+			ttl := d.errorTTL
+			if errors.Is(err, ErrNoReferrers) {
+				e.Status, ttl = DiscoveryMissing, d.missingIndexTTL
+			}
+			if ttl >= 0 {
+				expiresAt := failedAt.Add(ttl)
+				e.ExpiresAt = &expiresAt
+			}
+		case indexDigest != "":
+			e.Status, e.IndexDigest = DiscoveryFound, indexDigest.String()
+			if foundAt, _ := c.found(); d.refreshTTL > 0 {
+				refreshAt := foundAt.Add(d.refreshTTL)
+				e.RefreshAt = &refreshAt
+			}
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ManifestDigest != entries[j].ManifestDigest {
+			return entries[i].ManifestDigest < entries[j].ManifestDigest
+		}
+		return entries[i].Namespace < entries[j].Namespace
+	})
+	return entries
+}
+
+// invalidate drops the cached discoveries of the images `manifestDigests` in all namespaces, or of
+// all images if none is given, and returns the digests of the dropped ones. The layers already
+// mounted keep using the SOCI index they were mounted with.
+func (d *discoveryCache) invalidate(manifestDigests ...string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	invalidate := make(map[string]bool)
+	for _, manifestDigest := range manifestDigests {
+		invalidate[manifestDigest] = true
+	}
+	dropped := make(map[string]bool)
+	for key := range d.contexts {
+		if len(manifestDigests) == 0 || invalidate[key.name] {
+			delete(d.contexts, key)
+			dropped[key.name] = true
+		}
+	}
+	var digests []string
+	for manifestDigest := range dropped {
+		digests = append(digests, manifestDigest)
+	}
+	sort.Strings(digests)
+	return digests
+}
+
+// manifestDigests returns the digests the image `ref` was last mounted with in each namespace.
+func (d *discoveryCache) manifestDigests(ref string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var manifestDigests []string
+	for key, manifestDigest := range d.refs {
+		if key.name == ref {
+			manifestDigests = append(manifestDigests, manifestDigest)
+		}
+	}
+	return manifestDigests
+}
+
+// DiscoveryAdmin lists and invalidates the discoveries of SOCI indices cached by the filesystem
+// it's passed to with WithDiscoveryAdmin, e.g. so that the index pushed for an image after it was
+// mounted is discovered without waiting for the cached result to expire.
+type DiscoveryAdmin struct {
+	mu    sync.Mutex
+	cache *discoveryCache
+}
+
+// NewDiscoveryAdmin returns a DiscoveryAdmin which has no discoveries until it's passed to a filesystem.
+func NewDiscoveryAdmin() *DiscoveryAdmin {
+	return &DiscoveryAdmin{}
+}
+
+func (a *DiscoveryAdmin) set(cache *discoveryCache) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cache = cache
+}
+
+func (a *DiscoveryAdmin) get() *discoveryCache {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cache
+}
+
+// Entries returns the cached discoveries ordered by manifest digest.
+func (a *DiscoveryAdmin) Entries() []DiscoveryEntry {
+	cache := a.get()
+	if cache == nil {
+		return []DiscoveryEntry{}
+	}
+	return cache.entries()
+}
+
+// Invalidate drops the cached discoveries of the images `manifestDigests`, or of all images if
+// none is given, and returns the digests of the dropped ones. The next mount of a dropped image
+// discovers its SOCI index again.
+func (a *DiscoveryAdmin) Invalidate(manifestDigests ...string) []string {
+	cache := a.get()
+	if cache == nil {
+		return nil
+	}
+	return cache.invalidate(manifestDigests...)
+}
+
+// InvalidateRef drops the cached discovery of the digest the image `ref` was last mounted with.
+func (a *DiscoveryAdmin) InvalidateRef(ref string) []string {
+	cache := a.get()
+	if cache == nil {
+		return nil
+	}
+	manifestDigests := cache.manifestDigests(ref)
+	if len(manifestDigests) == 0 {
+		return nil
+	}
+	return cache.invalidate(manifestDigests...)
+}
+
+// Handler serves the cached discoveries as JSON on GET. On DELETE, it invalidates the discovery
+// of the image with the `digest` or `ref` query parameter, or all of them with `all=true`, and
+// reports the digests of the invalidated ones.
+func (a *DiscoveryAdmin) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			v = a.Entries()
+		case http.MethodDelete:
+			q := r.URL.Query()
+			var invalidated []string
+			switch {
+			case q.Get("digest") != "":
+				invalidated = a.Invalidate(q.Get("digest"))
+			case q.Get("ref") != "":
+				invalidated = a.InvalidateRef(q.Get("ref"))
+			case q.Get("all") == "true":
+				invalidated = a.Invalidate()
+			default:
+				http.Error(w, "missing digest, ref or all=true", http.StatusBadRequest)
+				return
+			}
+			if invalidated == nil {
+				invalidated = []string{}
+			}
+			v = struct {
+				Invalidated []string `json:"invalidated"`
+			}{invalidated}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+}
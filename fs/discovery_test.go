@@ -0,0 +1,250 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+)
+
+func TestDiscoveryCache(t *testing.T) {
+	const (
+		ref     = "registry.example.com/app:latest"
+		digest1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		digest2 = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	ctx := context.Background()
+	fail := func(c *sociContext) {
+		c.cachedErr = errors.New("no soci index found")
+		c.failedAt = time.Now()
+	}
+
+	t.Run("failures expire", func(t *testing.T) {
+		d := newDiscoveryCache(time.Minute, time.Minute)
+		c := d.get(ctx, ref, digest1)
+		fail(c)
+		if d.get(ctx, ref, digest1) != c {
+			t.Fatalf("failure should be cached until it expires")
+		}
+		d.now = func() time.Time { return time.Now().Add(time.Minute) }
+		if d.get(ctx, ref, digest1) == c {
+			t.Fatalf("expired failure should not be cached")
+		}
+	})
+
+	t.Run("failures are cached forever with a negative ttl", func(t *testing.T) {
+		d := newDiscoveryCache(-1, -1)
+		c := d.get(ctx, ref, digest1)
+		fail(c)
+		d.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+		if d.get(ctx, ref, digest1) != c {
+			t.Fatalf("failure should be cached forever")
+		}
+	})
+
+	t.Run("ref updates drop failures", func(t *testing.T) {
+		d := newDiscoveryCache(time.Hour, time.Hour)
+		failed := d.get(ctx, ref, digest1)
+		fail(failed)
+		d.get(ctx, "registry.example.com/other:latest", digest2)
+		if d.get(ctx, ref, digest2) == nil {
+			t.Fatalf("no context returned")
+		}
+		if _, ok := d.contexts[discoveryKey{name: digest1}]; ok {
+			t.Fatalf("failure of the previous digest of the ref should be dropped")
+		}
+		// The ref moves back to the first digest, whose index was pushed meanwhile.
+		fail(d.contexts[discoveryKey{name: digest2}])
+		if d.get(ctx, ref, digest1) == failed {
+			t.Fatalf("failure of the new digest of the ref should be dropped")
+		}
+		if _, ok := d.contexts[discoveryKey{name: digest2}]; ok {
+			t.Fatalf("failure of the previous digest of the ref should be dropped")
+		}
+	})
+
+	t.Run("ref updates keep successful discoveries", func(t *testing.T) {
+		d := newDiscoveryCache(time.Hour, time.Hour)
+		c := d.get(ctx, ref, digest1)
+		d.get(ctx, ref, digest2)
+		if d.get(ctx, ref, digest1) != c {
+			t.Fatalf("successful discovery should be kept")
+		}
+	})
+
+	t.Run("successful discoveries of tags are refreshed", func(t *testing.T) {
+		const pinnedRef = "registry.example.com/app@" + digest1
+		d := newDiscoveryCache(time.Hour, time.Hour)
+		d.refreshTTL = time.Hour
+		c := d.get(ctx, ref, digest1)
+		c.setFound(digest2)
+		if d.get(ctx, ref, digest1) != c {
+			t.Fatalf("successful discovery should be used until it's refreshed")
+		}
+		d.now = func() time.Time { return time.Now().Add(time.Hour) }
+		if d.get(ctx, pinnedRef, digest1) != c {
+			t.Fatalf("successful discovery of a pinned ref should not be refreshed")
+		}
+		if d.get(ctx, ref, digest1) == c {
+			t.Fatalf("successful discovery of a tag should be refreshed once its ttl expires")
+		}
+	})
+
+	t.Run("missing indices are cached for their own ttl", func(t *testing.T) {
+		d := newDiscoveryCache(time.Minute, time.Hour)
+		c := d.get(ctx, ref, digest1)
+		c.cachedErr = fmt.Errorf("cannot fetch list of referrers: %w", ErrNoReferrers)
+		c.failedAt = time.Now()
+		d.now = func() time.Time { return time.Now().Add(time.Minute) }
+		if d.get(ctx, ref, digest1) != c {
+			t.Fatalf("missing index should be cached until its ttl expires")
+		}
+		d.now = func() time.Time { return time.Now().Add(time.Hour) }
+		if d.get(ctx, ref, digest1) == c {
+			t.Fatalf("expired missing index should not be cached")
+		}
+	})
+
+	t.Run("missing indices aren't cached with a zero ttl", func(t *testing.T) {
+		d := newDiscoveryCache(time.Hour, 0)
+		c := d.get(ctx, ref, digest1)
+		c.cachedErr = ErrNoReferrers
+		c.failedAt = time.Now()
+		if d.get(ctx, ref, digest1) == c {
+			t.Fatalf("missing index should not be cached")
+		}
+	})
+
+	t.Run("namespaces are isolated", func(t *testing.T) {
+		d := newDiscoveryCache(time.Hour, time.Hour)
+		d.isolateNamespaces = true
+		ctx1, ctx2 := namespaces.WithNamespace(ctx, "tenant1"), namespaces.WithNamespace(ctx, "tenant2")
+		c := d.get(ctx1, ref, digest1)
+		if d.get(ctx2, ref, digest1) == c {
+			t.Fatalf("discovery should not be shared between namespaces")
+		}
+		if d.get(ctx1, ref, digest1) != c {
+			t.Fatalf("discovery should be cached in its namespace")
+		}
+		// The ref moving to another digest in a namespace doesn't touch the discoveries of the others.
+		fail(d.get(ctx2, ref, digest1))
+		d.get(ctx1, ref, digest2)
+		if _, ok := d.contexts[discoveryKey{"tenant2", digest1}]; !ok {
+			t.Fatalf("failure of another namespace should be kept")
+		}
+		entries := d.entries()
+		if len(entries) != 3 || entries[0].Namespace != "tenant1" || entries[1].Namespace != "tenant2" {
+			t.Fatalf("unexpected entries: %+v", entries)
+		}
+		if got := d.invalidate(digest1); !reflect.DeepEqual(got, []string{digest1}) {
+			t.Fatalf("unexpected invalidated digests: %v", got)
+		}
+		if _, ok := d.contexts[discoveryKey{"tenant2", digest1}]; ok {
+			t.Fatalf("digest should be invalidated in all namespaces")
+		}
+	})
+}
+
+func TestDiscoveryAdmin(t *testing.T) {
+	const (
+		ref     = "registry.example.com/app:latest"
+		digest1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		digest2 = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+		digest3 = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+		index   = "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+	)
+	ctx := context.Background()
+	admin := NewDiscoveryAdmin()
+	if entries := admin.Entries(); len(entries) != 0 {
+		t.Fatalf("unexpected entries before the admin is passed to a filesystem: %v", entries)
+	}
+	d := newDiscoveryCache(time.Hour, -1)
+	admin.set(d)
+
+	d.get(ctx, ref, digest1).indexDigest = index
+	missing := d.get(ctx, "registry.example.com/other:latest", digest2)
+	missing.cachedErr, missing.failedAt = ErrNoReferrers, time.Now()
+	failed := d.get(ctx, "registry.example.com/third:latest", digest3)
+	failed.cachedErr, failed.failedAt = errors.New("unauthorized"), time.Now()
+
+	entries := admin.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	for i, want := range []DiscoveryEntry{
+		{ManifestDigest: digest1, Refs: []string{ref}, Status: DiscoveryFound, IndexDigest: index},
+		{ManifestDigest: digest2, Refs: []string{"registry.example.com/other:latest"}, Status: DiscoveryMissing, Error: ErrNoReferrers.Error()},
+		{ManifestDigest: digest3, Refs: []string{"registry.example.com/third:latest"}, Status: DiscoveryFailed, Error: "unauthorized"},
+	} {
+		got := entries[i]
+		if (got.ExpiresAt != nil) != (want.Status == DiscoveryFailed) {
+			t.Fatalf("unexpected expiry of %s: %v", got.ManifestDigest, got.ExpiresAt)
+		}
+		got.ExpiresAt = nil
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected entry; expected = %+v, got = %+v", want, got)
+		}
+	}
+
+	if got := admin.InvalidateRef(ref); !reflect.DeepEqual(got, []string{digest1}) {
+		t.Fatalf("unexpected invalidated digests of ref: %v", got)
+	}
+	if got := admin.Invalidate(digest1, digest2); !reflect.DeepEqual(got, []string{digest2}) {
+		t.Fatalf("unexpected invalidated digests: %v", got)
+	}
+	if got := admin.Invalidate(); !reflect.DeepEqual(got, []string{digest3}) {
+		t.Fatalf("unexpected invalidated digests of all images: %v", got)
+	}
+	if entries := admin.Entries(); len(entries) != 0 {
+		t.Fatalf("unexpected entries after invalidating all of them: %v", entries)
+	}
+}
+
+func TestDiscoveryAdminHandler(t *testing.T) {
+	const digest1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	admin := NewDiscoveryAdmin()
+	d := newDiscoveryCache(time.Hour, time.Hour)
+	admin.set(d)
+	d.get(context.Background(), "registry.example.com/app:latest", digest1)
+
+	for _, tc := range []struct {
+		method, query string
+		code          int
+		body          string
+	}{
+		{http.MethodGet, "", http.StatusOK, `"status":"pending"`},
+		{http.MethodDelete, "", http.StatusBadRequest, "missing"},
+		{http.MethodPost, "", http.StatusMethodNotAllowed, ""},
+		{http.MethodDelete, "?ref=registry.example.com/app:latest", http.StatusOK, `{"invalidated":["` + digest1 + `"]}`},
+		{http.MethodDelete, "?all=true", http.StatusOK, `{"invalidated":[]}`},
+	} {
+		w := httptest.NewRecorder()
+		admin.Handler().ServeHTTP(w, httptest.NewRequest(tc.method, "/discovery"+tc.query, nil))
+		if w.Code != tc.code || !strings.Contains(w.Body.String(), tc.body) {
+			t.Fatalf("unexpected response to %s %s: %d %s", tc.method, tc.query, w.Code, w.Body.String())
+		}
+	}
+}
@@ -43,28 +43,41 @@
 package fs
 
 import (
+	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	bf "github.com/awslabs/soci-snapshotter/fs/backgroundfetcher"
+	"github.com/awslabs/soci-snapshotter/fs/blockdev"
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	layermetrics "github.com/awslabs/soci-snapshotter/fs/metrics/layer"
+	"github.com/awslabs/soci-snapshotter/fs/quota"
+	"github.com/awslabs/soci-snapshotter/fs/reexport"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/health"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/snapshot"
 	"github.com/awslabs/soci-snapshotter/soci"
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
 	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
@@ -75,7 +88,7 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	orascontent "oras.land/oras-go/v2/content"
-	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
 const (
@@ -95,6 +108,14 @@ const (
 	// will block until a span manager is removed from the workqueue.
 	defaultBgMaxQueueSize = 100
 
+	// quotaUsageFileName is the name of the file in the root directory of the filesystem which
+	// persists the quota usage of each namespace.
+	quotaUsageFileName = "quota.json"
+
+	// pinsFileName is the name of the file in the root directory of the filesystem which
+	// persists the SOCI indices whose spans are pinned.
+	pinsFileName = "pinned-indices.json"
+
 	// The default amount of interval at which the background fetcher emits metrics
 	defaultBgMetricEmitPeriod = 10 * time.Second
 
@@ -103,6 +124,16 @@ const (
 
 	// Amount of time the snapshotter will wait before emitting the metrics for FUSE operation.
 	defaultFuseMetricsEmitWaitDuration = 60 * time.Second
+
+	// The default maximum sizes of fetched SOCI artifacts.
+	defaultMaxSociIndexSize = 4 << 20
+	defaultMaxZtocSize      = 256 << 20
+
+	// The default amount of time a failed discovery of SOCI artifacts is cached.
+	defaultDiscoveryErrorTTL = 30 * time.Second
+
+	// The default amount of time an image without SOCI index is remembered as such.
+	defaultMissingIndexTTL = 5 * time.Minute
 )
 
 var (
@@ -113,9 +144,22 @@ type Option func(*options)
 
 type options struct {
 	getSources        source.GetSources
+	registryHosts     source.RegistryHosts
 	resolveHandlers   map[string]remote.Handler
+	blobSources       []remote.BlobSource
 	metadataStore     metadata.Store
 	overlayOpaqueType layer.OverlayOpaqueType
+	configReloads     <-chan config.Config
+	healthRegistry    *health.Registry
+	quotas            *quota.Manager
+	state             *StateExporter
+	discoveryAdmin    *DiscoveryAdmin
+	prewarmer         *Prewarmer
+	pinAdmin          *PinAdmin
+	rewriteRef        source.RefRewriter
+	indexRequired     func(refspec reference.Spec) bool
+	spanPeers         spanmanager.SpanPeers
+	spanRegistry      *spanmanager.SpanRegistry
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -124,6 +168,32 @@ func WithGetSources(s source.GetSources) Option {
 	}
 }
 
+// WithRegistryHosts configures the registries SOCI indices and zTOCs are fetched from,
+// e.g. with the TLS settings of each registry. Without it, they are fetched with the
+// default settings. Layers are fetched from the hosts of the GetSources option.
+func WithRegistryHosts(hosts source.RegistryHosts) Option {
+	return func(opts *options) {
+		opts.registryHosts = hosts
+	}
+}
+
+// WithRefRewriter rewrites the image references of the mounted layers before they are
+// resolved, so that both their layers and their SOCI artifacts are fetched from the
+// rewritten references. The image references of the snapshots are unchanged.
+func WithRefRewriter(rewrite source.RefRewriter) Option {
+	return func(opts *options) {
+		opts.rewriteRef = rewrite
+	}
+}
+
+// WithIndexRequired makes the layers of the images for which `required` returns true fail to
+// mount if their SOCI index can't be found or verified, instead of being unpacked locally.
+func WithIndexRequired(required func(refspec reference.Spec) bool) Option {
+	return func(opts *options) {
+		opts.indexRequired = required
+	}
+}
+
 func WithResolveHandler(name string, handler remote.Handler) Option {
 	return func(opts *options) {
 		if opts.resolveHandlers == nil {
@@ -133,6 +203,14 @@ func WithResolveHandler(name string, handler remote.Handler) Option {
 	}
 }
 
+// WithBlobSource adds a source blobs are fetched from before falling back to the registry.
+// Sources are tried in the order they are added.
+func WithBlobSource(source remote.BlobSource) Option {
+	return func(opts *options) {
+		opts.blobSources = append(opts.blobSources, source)
+	}
+}
+
 func WithMetadataStore(metadataStore metadata.Store) Option {
 	return func(opts *options) {
 		opts.metadataStore = metadataStore
@@ -145,12 +223,90 @@ func WithOverlayOpaqueType(overlayOpaqueType layer.OverlayOpaqueType) Option {
 	}
 }
 
+// WithConfigReloads makes the filesystem apply every config received on the
+// channel. Only the settings which can safely change at runtime are applied:
+// the blob retry policy and timeouts, and the background fetcher pacing.
+// Everything else requires a restart.
+func WithConfigReloads(reloads <-chan config.Config) Option {
+	return func(opts *options) {
+		opts.configReloads = reloads
+	}
+}
+
+// WithHealthRegistry registers the health checks of the subsystems of the filesystem
+// (FUSE servers, content store, registry and background fetcher) in `registry`.
+func WithHealthRegistry(registry *health.Registry) Option {
+	return func(opts *options) {
+		opts.healthRegistry = registry
+	}
+}
+
+// WithQuotaManager makes the filesystem account the usage of each namespace in `quotas` and
+// enforce its limits, e.g. so that the usage can be reported. By default, the filesystem
+// enforces the quotas of its config with a manager of its own.
+func WithQuotaManager(quotas *quota.Manager) Option {
+	return func(opts *options) {
+		opts.quotas = quotas
+	}
+}
+
+// WithDiscoveryAdmin lets `admin` list and invalidate the discoveries of SOCI indices cached by the filesystem.
+func WithDiscoveryAdmin(admin *DiscoveryAdmin) Option {
+	return func(opts *options) {
+		opts.discoveryAdmin = admin
+	}
+}
+
+// WithPeerCache makes the filesystem fetch spans from the snapshotters of other nodes with `peers`
+// before fetching them from registries, if it's not nil, and register the spans it has cached in
+// `registry` to serve them to other nodes, if it's not nil.
+func WithPeerCache(peers spanmanager.SpanPeers, registry *spanmanager.SpanRegistry) Option {
+	return func(opts *options) {
+		opts.spanPeers = peers
+		opts.spanRegistry = registry
+	}
+}
+
+// WithPrewarmer lets `prewarmer` warm the caches of the filesystem for images before they are mounted.
+func WithPrewarmer(prewarmer *Prewarmer) Option {
+	return func(opts *options) {
+		opts.prewarmer = prewarmer
+	}
+}
+
+// WithPinAdmin lets `admin` pin the cached spans of the layers of SOCI indices in the filesystem.
+func WithPinAdmin(admin *PinAdmin) Option {
+	return func(opts *options) {
+		opts.pinAdmin = admin
+	}
+}
+
+// WithStateExporter makes the filesystem report the state of its mounts in `state`.
+func WithStateExporter(state *StateExporter) Option {
+	return func(opts *options) {
+		opts.state = state
+	}
+}
+
 func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...Option) (snapshot.FileSystem, *bf.BackgroundFetcher, error) {
 	var fsOpts options
 	for _, o := range opts {
 		o(&fsOpts)
 	}
 
+	if cfg.Offline {
+		// Offline, the local stores are all there is, so they default to where `soci bundle import` writes.
+		if cfg.ContentStorePath == "" {
+			cfg.ContentStorePath = config.DefaultSociContentStorePath
+		}
+		if cfg.IndexStorePath == "" {
+			cfg.IndexStorePath = config.DefaultSociIndexStorePath
+		}
+		WithResolveHandler("local", remote.NewLocalHandler(cfg.ContentStorePath))(&fsOpts)
+		fsOpts.blobSources = nil
+		log.G(ctx).WithField("contentStore", cfg.ContentStorePath).Info("offline mode: serving SOCI artifacts and layers from the local content store only")
+	}
+
 	attrTimeout := time.Duration(cfg.FuseConfig.AttrTimeout) * time.Second
 	if attrTimeout == 0 {
 		attrTimeout = defaultFuseTimeout
@@ -195,9 +351,9 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		bgEmitMetricPeriod = defaultBgMetricEmitPeriod
 	}
 
-	store, err := oci.New(cfg.ContentStorePath)
+	store, err := newLocalStore(ctx, root, cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot create local store: %w", err)
+		return nil, nil, err
 	}
 
 	var bgFetcher *bf.BackgroundFetcher
@@ -207,12 +363,14 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 			"silencePeriod":    bgSilencePeriod,
 			"maxQueueSize":     bgMaxQueueSize,
 			"emitMetricPeriod": bgEmitMetricPeriod,
+			"policy":           cfg.BackgroundFetchConfig.Policy,
 		}).Info("constructing background fetcher")
 
 		bgFetcher, err = bf.NewBackgroundFetcher(bf.WithFetchPeriod(bgFetchPeriod),
 			bf.WithSilencePeriod(bgSilencePeriod),
 			bf.WithMaxQueueSize(bgMaxQueueSize),
-			bf.WithEmitMetricPeriod(bgEmitMetricPeriod))
+			bf.WithEmitMetricPeriod(bgEmitMetricPeriod),
+			bf.WithPolicy(bf.Policy(cfg.BackgroundFetchConfig.Policy)))
 
 		if err != nil {
 			return nil, nil, fmt.Errorf("cannot create background fetcher: %w", err)
@@ -222,15 +380,27 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		log.G(context.Background()).Info("background fetch is disabled")
 	}
 
-	r, err := layer.NewResolver(root, cfg, fsOpts.resolveHandlers, metadataStore, store, fsOpts.overlayOpaqueType, bgFetcher)
+	r, err := layer.NewResolver(root, cfg, fsOpts.resolveHandlers, fsOpts.blobSources, metadataStore, store, fsOpts.overlayOpaqueType, bgFetcher)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to setup resolver: %w", err)
 	}
+	quotas := fsOpts.quotas
+	if quotas == nil {
+		quotas = quota.NewManager(cfg.QuotaConfig)
+	}
+	if err := quotas.Persist(filepath.Join(root, quotaUsageFileName)); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to load quota usage, accounting from scratch")
+	}
+	mounts := newMountRegistry()
+	quotas.SetMounts(mounts.quotaMounts)
+	r.SetUsageMeter(quotas.Meter)
+	r.SetPeerCache(fsOpts.spanPeers, fsOpts.spanRegistry)
 
 	var ns *metrics.Namespace
 	if !cfg.NoPrometheus {
 		ns = metrics.NewNamespace("soci", "fs", nil)
 		commonmetrics.Register() // Register common metrics. This will happen only once.
+		socihttp.RegisterMetrics()
 	}
 	c := layermetrics.NewLayerMetrics(ns)
 	if ns != nil {
@@ -246,7 +416,72 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		fuseMetricsEmitWaitDuration = defaultFuseMetricsEmitWaitDuration
 	}
 
-	return &filesystem{
+	exporter, err := reexport.New(cfg.ReexportConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to setup layer re-export: %w", err)
+	}
+
+	var blockDevices *blockdev.Exporter
+	if cfg.BlockDeviceConfig.Enable {
+		blockDevices, err = blockdev.NewExporter(cfg.BlockDeviceConfig.SocketDir, blockdev.Format(cfg.BlockDeviceConfig.Format),
+			// Guests mount overlayfs with or without "userxattr" regardless of the host.
+			layer.OverlayOpaqueAll.Xattrs())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to setup block devices: %w", err)
+		}
+	}
+
+	var passthrough *passthroughManager
+	if cfg.PassthroughConfig.Enable {
+		passthrough = newPassthroughManager(time.Duration(cfg.PassthroughConfig.CheckPeriodSec)*time.Second, fsOpts.overlayOpaqueType)
+	}
+
+	var idle *idleDemoter
+	if cfg.IdleDemotionConfig.IdlePeriodSec > 0 {
+		idle, err = newIdleDemoter(cfg.IdleDemotionConfig, mounts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if cfg.PrefetchPercent < 0 || cfg.PrefetchPercent > 100 {
+		return nil, nil, fmt.Errorf("invalid prefetch_percent %d: must be between 0 and 100", cfg.PrefetchPercent)
+	}
+
+	var compactor *spanCompactor
+	if cfg.CompactionConfig.Enable {
+		compactor = newSpanCompactor(cfg.CompactionConfig, mounts)
+	}
+
+	artifactSizeLimits := ArtifactSizeLimits{
+		MaxIndexSize: cfg.ArtifactFetchConfig.MaxSociIndexSize,
+		MaxZtocSize:  cfg.ArtifactFetchConfig.MaxZtocSize,
+	}
+	if artifactSizeLimits.MaxIndexSize == 0 {
+		artifactSizeLimits.MaxIndexSize = defaultMaxSociIndexSize
+	}
+	if artifactSizeLimits.MaxZtocSize == 0 {
+		artifactSizeLimits.MaxZtocSize = defaultMaxZtocSize
+	}
+
+	discoveryErrorTTL := time.Duration(cfg.ArtifactFetchConfig.DiscoveryErrorTTLSec) * time.Second
+	if discoveryErrorTTL == 0 {
+		discoveryErrorTTL = defaultDiscoveryErrorTTL
+	}
+	missingIndexTTL := time.Duration(cfg.ArtifactFetchConfig.MissingIndexTTLSec) * time.Second
+	if missingIndexTTL == 0 {
+		missingIndexTTL = defaultMissingIndexTTL
+	} else if missingIndexTTL < 0 {
+		missingIndexTTL = 0
+	}
+	sociContexts := newDiscoveryCache(discoveryErrorTTL, missingIndexTTL)
+	sociContexts.isolateNamespaces = !cfg.ShareNamespaces
+	sociContexts.refreshTTL = time.Duration(cfg.ArtifactFetchConfig.RefreshTTLSec) * time.Second
+	if fsOpts.discoveryAdmin != nil {
+		fsOpts.discoveryAdmin.set(sociContexts)
+	}
+
+	fs := &filesystem{
 		// it's generally considered bad practice to store a context in a struct,
 		// however `filesystem` has it's own lifecycle as well as a per-request lifecycle.
 		// Some operations (e.g. remote calls) exist within a per-request lifecycle and use
@@ -257,40 +492,152 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		ctx:                         ctx,
 		resolver:                    r,
 		getSources:                  getSources,
+		registryHosts:               fsOpts.registryHosts,
+		rewriteRef:                  fsOpts.rewriteRef,
+		indexRequired:               fsOpts.indexRequired,
 		debug:                       cfg.Debug,
-		layer:                       make(map[string]layer.Layer),
+		mounts:                      mounts,
+		stoppedFuseServers:          make(map[string]struct{}),
 		allowNoVerification:         cfg.AllowNoVerification,
 		disableVerification:         true,
 		metricsController:           c,
 		attrTimeout:                 attrTimeout,
 		entryTimeout:                entryTimeout,
 		negativeTimeout:             negativeTimeout,
+		sociContexts:                sociContexts,
 		orasStore:                   store,
 		indexStorePath:              cfg.IndexStorePath,
 		contentStorePath:            cfg.ContentStorePath,
 		bgFetcher:                   bgFetcher,
 		mountTimeout:                mountTimeout,
+		prefetchPercent:             cfg.PrefetchPercent,
 		fuseMetricsEmitWaitDuration: fuseMetricsEmitWaitDuration,
-	}, bgFetcher, nil
+		artifactSizeLimits:          artifactSizeLimits,
+		asyncZtocFetch:              cfg.ArtifactFetchConfig.AsyncZtocFetch,
+		exporter:                    exporter,
+		blockDevices:                blockDevices,
+		passthrough:                 passthrough,
+		idle:                        idle,
+		compactor:                   compactor,
+		quotas:                      quotas,
+		blobSources:                 fsOpts.blobSources,
+		offline:                     cfg.Offline,
+		shareNamespaces:             cfg.ShareNamespaces,
+	}
+	if cfg.ShareLayerMounts {
+		fs.sharedMounts, err = newSharedMounts(ctx, filepath.Join(root, sharedMountsDirName), fs.unmount)
+		if err != nil {
+			return nil, nil, err
+		}
+		fs.sharedMounts.isolateNamespaces = !cfg.ShareNamespaces
+	}
+	if fsOpts.prewarmer != nil {
+		fsOpts.prewarmer.set(fs)
+	}
+	if fsOpts.state != nil {
+		fsOpts.state.set(mounts)
+	}
+	fs.pins, err = newSpanPins(filepath.Join(root, pinsFileName), mounts)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to load pinned indices, no spans are pinned")
+	}
+	if fsOpts.pinAdmin != nil {
+		fsOpts.pinAdmin.set(fs.pins)
+	}
+	if fsOpts.configReloads != nil {
+		go fs.watchConfigReloads(ctx, fsOpts.configReloads)
+	}
+	if idle != nil {
+		go idle.run(ctx)
+	}
+	if compactor != nil {
+		go compactor.run(ctx)
+	}
+	if fsOpts.healthRegistry != nil {
+		fs.registerHealthChecks(fsOpts.healthRegistry)
+	}
+	return fs, bgFetcher, nil
+}
+
+func (fs *filesystem) watchConfigReloads(ctx context.Context, reloads <-chan config.Config) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cfg, ok := <-reloads:
+			if !ok {
+				return
+			}
+			fs.reloadConfig(ctx, cfg)
+		}
+	}
+}
+
+// reloadConfig applies the runtime-reloadable subset of cfg.
+func (fs *filesystem) reloadConfig(ctx context.Context, cfg config.Config) {
+	fs.resolver.SetBlobConfig(cfg.BlobConfig)
+
+	if fs.bgFetcher != nil {
+		bgFetchPeriod := time.Duration(cfg.BackgroundFetchConfig.FetchPeriodMsec) * time.Millisecond
+		if bgFetchPeriod == 0 {
+			bgFetchPeriod = defaultBgFetchPeriod
+		}
+		bgSilencePeriod := time.Duration(cfg.BackgroundFetchConfig.SilencePeriodMsec) * time.Millisecond
+		if bgSilencePeriod == 0 {
+			bgSilencePeriod = defaultBgSilencePeriod
+		}
+		fs.bgFetcher.SetFetchPeriod(bgFetchPeriod)
+		fs.bgFetcher.SetSilencePeriod(bgSilencePeriod)
+		log.G(ctx).WithFields(logrus.Fields{
+			"fetchPeriod":   bgFetchPeriod,
+			"silencePeriod": bgSilencePeriod,
+		}).Info("reloaded background fetcher config")
+	}
+	log.G(ctx).Info("reloaded blob config")
 }
 
 type sociContext struct {
 	cachedErr            error
+	failedAt             time.Time
 	cachedErrMu          sync.RWMutex
 	bgFetchPauseOnce     sync.Once
 	fetchOnce            sync.Once
 	sociIndex            *soci.Index
 	imageLayerToSociDesc map[string]ocispec.Descriptor
 	fuseOperationCounter *layer.FuseOperationCounter
+	// indexDigest is the digest of the SOCI index, once it's fetched, and foundAt is when.
+	// They are guarded by cachedErrMu.
+	indexDigest digest.Digest
+	foundAt     time.Time
+	// fetchZtoc fetches a zTOC of the index into the local store, if the index was fetched without them.
+	fetchZtoc func(ctx context.Context, desc ocispec.Descriptor) error
+	// clock is the clock of the discovery cache, which failedAt and foundAt are compared with.
+	// time.Now is used if it's nil.
+	clock func() time.Time
 }
 
-func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, store orascontent.Storage, indexStorePath, contentStorePath string, fuseOpEmitWaitDuration time.Duration) error {
+// sociContextConfig configures where a sociContext fetches the SOCI artifacts of its image from
+// and where it stores them.
+type sociContextConfig struct {
+	store                  orascontent.Storage
+	indexStorePath         string
+	contentStorePath       string
+	fuseOpEmitWaitDuration time.Duration
+	sizeLimits             ArtifactSizeLimits
+	blobSources            []remote.BlobSource
+	hosts                  source.RegistryHosts
+	offline                bool
+	fetchOpts              []FetchOption
+}
+
+func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, cfg sociContextConfig) error {
 	var retErr error
 	c.fetchOnce.Do(func() {
 		defer func() {
 			if retErr != nil {
 				c.cachedErrMu.Lock()
 				c.cachedErr = retErr
+				c.failedAt = c.now()
 				c.cachedErrMu.Unlock()
 			}
 		}()
@@ -301,13 +648,21 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 			return
 		}
 
-		remoteStore, err := newRemoteStore(refspec)
-		if err != nil {
-			retErr = err
-			return
+		var (
+			remoteStore     resolverStorage = offlineStore{}
+			referrersCaller ReferrersCaller = offlineStore{}
+		)
+		if !cfg.offline {
+			if remoteStore, err = newRemoteStore(refspec, cfg.hosts); err != nil {
+				retErr = err
+				return
+			}
+			if referrersCaller, err = newRaceReferrersCaller(refspec, cfg.hosts); err != nil {
+				retErr = err
+				return
+			}
 		}
-
-		client := NewOCIArtifactClient(remoteStore)
+		client := NewOCIArtifactClient(&storageWithReferrers{Storage: remoteStore, ReferrersCaller: referrersCaller})
 		indexDesc := ocispec.Descriptor{
 			Digest: digest.Digest(indexDigest),
 		}
@@ -315,7 +670,7 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 		if indexDigest == "" {
 			imageManifestHash := strings.TrimPrefix(imageManifestDigest, "sha256:")
 			log.G(ctx).Debugf("soci index digest for image %s not provided, attempting to retrieve locally/remotely", imageManifestHash)
-			index, err := os.ReadFile(filepath.Join(indexStorePath, imageManifestHash))
+			index, err := os.ReadFile(filepath.Join(cfg.indexStorePath, imageManifestHash))
 			if err == nil {
 				indexDigest = strings.TrimSpace(string(index))
 				indexDesc.Digest = digest.Digest(indexDigest)
@@ -340,19 +695,40 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 			indexDesc = desc
 		}
 
-		log.G(ctx).WithField("digest", indexDesc.Digest.String()).Infof("fetching SOCI artifacts using index descriptor")
+		log.G(ctx).WithField(logutil.DigestField, indexDesc.Digest.String()).Infof("fetching SOCI artifacts using index descriptor")
 
-		index, err := FetchSociArtifacts(ctx, refspec, indexDesc, store, remoteStore, contentStorePath)
+		fetchOpts := append(cfg.fetchOpts, WithFetchProgress(func(p FetchProgress) {
+			if p.Done {
+				log.G(ctx).WithFields(logrus.Fields{
+					logutil.DigestField: p.Descriptor.Digest,
+					"size":              p.Fetched,
+					"local":             p.Local,
+					"shared":            p.Shared,
+				}).Debug("fetched SOCI artifact")
+			}
+		}))
+		index, err := FetchSociArtifacts(ctx, refspec, indexDesc, cfg.store, remoteStore, cfg.contentStorePath, cfg.sizeLimits, cfg.blobSources, fetchOpts...)
 		if err != nil {
 			retErr = fmt.Errorf("error trying to fetch SOCI artifacts: %w", err)
 			return
 		}
+		// The index digest may come from a label computed for a previous image of the same ref.
+		if index.Subject != nil && index.Subject.Digest.String() != imageManifestDigest {
+			retErr = fmt.Errorf("index %s is for image %s, not %s: %w", indexDesc.Digest, index.Subject.Digest, imageManifestDigest, ErrIndexSubjectMismatch)
+			return
+		}
 		c.sociIndex = index
 		c.populateImageLayerToSociMapping(index)
+		if newFetchConfig(fetchOpts).asyncZtocs {
+			c.fetchZtoc = func(ctx context.Context, desc ocispec.Descriptor) error {
+				return FetchZtoc(ctx, refspec, desc, cfg.store, remoteStore, cfg.contentStorePath, cfg.sizeLimits, cfg.blobSources, fetchOpts...)
+			}
+		}
+		c.setFound(indexDesc.Digest)
 
 		// Create the FUSE operation counter.
 		// Metrics are emitted after a wait time of fuseOpEmitWaitDuration.
-		c.fuseOperationCounter = layer.NewFuseOperationCounter(digest.Digest(imageManifestDigest), fuseOpEmitWaitDuration)
+		c.fuseOperationCounter = layer.NewFuseOperationCounter(digest.Digest(imageManifestDigest), cfg.fuseOpEmitWaitDuration)
 		go c.fuseOperationCounter.Run(fsCtx)
 	})
 	c.cachedErrMu.RLock()
@@ -361,6 +737,61 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 	return retErr
 }
 
+// ensureZtoc makes sure the zTOC `desc` of the index is in the local store, fetching it if the
+// index was fetched without its zTOCs.
+func (c *sociContext) ensureZtoc(ctx context.Context, desc ocispec.Descriptor) error {
+	if c.fetchZtoc == nil {
+		return nil
+	}
+	return c.fetchZtoc(ctx, desc)
+}
+
+// resolveLayer resolves the layer `desc` of the image of the source `s` with its zTOC `sociDesc`.
+// Layers are resolved only through it, since the zTOC must be fetched first if the index was
+// fetched without its zTOCs.
+func (fs *filesystem) resolveLayer(ctx context.Context, c *sociContext, s source.Source, desc, sociDesc ocispec.Descriptor) (layer.Layer, error) {
+	if err := c.ensureZtoc(ctx, sociDesc); err != nil {
+		return nil, fmt.Errorf("failed to fetch ztoc %q of layer %q: %w", sociDesc.Digest, desc.Digest, err)
+	}
+	return fs.resolver.Resolve(ctx, s.Hosts, s.Name, desc, sociDesc, c.fuseOperationCounter, backgroundFetchPriority(ctx, s.Manifest, desc, sociDesc))
+}
+
+// failure returns when and why the discovery of the SOCI artifacts failed, if it failed.
+func (c *sociContext) failure() (time.Time, error) {
+	c.cachedErrMu.RLock()
+	defer c.cachedErrMu.RUnlock()
+	return c.failedAt, c.cachedErr
+}
+
+func (c *sociContext) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock()
+}
+
+// setFound records that the SOCI index `indexDigest` was fetched.
+func (c *sociContext) setFound(indexDigest digest.Digest) {
+	c.cachedErrMu.Lock()
+	defer c.cachedErrMu.Unlock()
+	c.indexDigest = indexDigest
+	c.foundAt = c.now()
+}
+
+// found returns when the SOCI index was fetched, if it was.
+func (c *sociContext) found() (time.Time, bool) {
+	c.cachedErrMu.RLock()
+	defer c.cachedErrMu.RUnlock()
+	return c.foundAt, c.indexDigest != ""
+}
+
+// discovery returns the digest of the SOCI index once it's fetched, or when and why its discovery failed.
+func (c *sociContext) discovery() (digest.Digest, time.Time, error) {
+	c.cachedErrMu.RLock()
+	defer c.cachedErrMu.RUnlock()
+	return c.indexDigest, c.failedAt, c.cachedErr
+}
+
 func (c *sociContext) populateImageLayerToSociMapping(sociIndex *soci.Index) {
 	c.imageLayerToSociDesc = make(map[string]ocispec.Descriptor, len(sociIndex.Blobs))
 	for _, desc := range sociIndex.Blobs {
@@ -373,37 +804,97 @@ type filesystem struct {
 	ctx                         context.Context
 	resolver                    *layer.Resolver
 	debug                       bool
-	layer                       map[string]layer.Layer
-	layerMu                     sync.Mutex
+	mounts                      *mountRegistry
+	stoppedFuseServers          map[string]struct{} // mountpoints whose FUSE server stopped before they were unmounted
+	stoppedFuseServersMu        sync.Mutex          // serializes the stops of FUSE servers with the unmounts
 	allowNoVerification         bool
 	disableVerification         bool
 	getSources                  source.GetSources
+	registryHosts               source.RegistryHosts
 	metricsController           *layermetrics.Controller
 	attrTimeout                 time.Duration
 	entryTimeout                time.Duration
 	negativeTimeout             time.Duration
-	sociContexts                sync.Map
+	sociContexts                *discoveryCache
+	artifactFetches             sharedFetches // fetches of SOCI artifacts shared by the images pulled at the same time
+	namespaceArtifactFetches    map[string]*sharedFetches
+	namespaceArtifactFetchesMu  sync.Mutex
 	orasStore                   orascontent.Storage
 	indexStorePath              string
 	contentStorePath            string
 	bgFetcher                   *bf.BackgroundFetcher
 	mountTimeout                time.Duration
+	prefetchPercent             int
 	fuseMetricsEmitWaitDuration time.Duration
+	artifactSizeLimits          ArtifactSizeLimits
+	asyncZtocFetch              bool // zTOCs are fetched when their layers are mounted, rather than with their index
+	exporter                    reexport.Exporter
+	blockDevices                *blockdev.Exporter
+	passthrough                 *passthroughManager
+	idle                        *idleDemoter
+	pins                        *spanPins
+	compactor                   *spanCompactor
+	quotas                      *quota.Manager
+	blobSources                 []remote.BlobSource
+	rewriteRef                  source.RefRewriter
+	offline                     bool // SOCI artifacts and layers are served from the local stores only
+	sharedMounts                *sharedMounts
+	shareNamespaces             bool // containerd namespaces share the SOCI artifacts and caches
+
+	// indexRequired returns whether the layers of an image fail to mount without a verified SOCI index.
+	indexRequired func(refspec reference.Spec) bool
 }
 
+// GetZtocForLayer returns the zTOC of the layer `layerDigest`, fetching it first if the index was
+// fetched without its zTOCs.
 func (fs *filesystem) GetZtocForLayer(ctx context.Context, imageRef, indexDigest, imageManifestDigest, layerDigest string) (ocispec.Descriptor, error) {
 	sociContext, err := fs.getSociContext(ctx, imageRef, indexDigest, imageManifestDigest)
 	if err != nil {
 		return ocispec.Descriptor{}, err
 	}
-	return sociContext.imageLayerToSociDesc[layerDigest], nil
+	desc, ok := sociContext.imageLayerToSociDesc[layerDigest]
+	if !ok {
+		return ocispec.Descriptor{}, nil
+	}
+	if err := sociContext.ensureZtoc(ctx, desc); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to fetch ztoc %q of layer %q: %w", desc.Digest, layerDigest, err)
+	}
+	return desc, nil
+}
+
+// rewriteLabels returns the labels with the image reference rewritten by the RefRewriter, if any.
+func (fs *filesystem) rewriteLabels(ctx context.Context, labels map[string]string) map[string]string {
+	ref, ok := labels[ctdsnapshotters.TargetRefLabel]
+	if fs.rewriteRef == nil || !ok {
+		return labels
+	}
+	rewritten := fs.rewriteRef(ref)
+	if rewritten == ref {
+		return labels
+	}
+	log.G(ctx).WithField(logutil.ImageField, ref).WithField("rewritten", rewritten).Debug("rewrote image reference")
+	l := make(map[string]string, len(labels))
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[ctdsnapshotters.TargetRefLabel] = rewritten
+	return l
 }
 
 func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	origRef := labels[ctdsnapshotters.TargetRefLabel]
+	labels = fs.rewriteLabels(ctx, labels)
 	imageRef, ok := labels[ctdsnapshotters.TargetRefLabel]
 	if !ok {
 		return fmt.Errorf("unable to get image ref from labels")
 	}
+	// Layers which weren't mounted lazily, e.g. small layers, are only unpacked for images
+	// requiring a SOCI index once it's verified.
+	if fs.requiresIndex(origRef, imageRef) {
+		if _, err := fs.getSociContext(ctx, imageRef, labels[source.TargetSociIndexDigestLabel], labels[ctdsnapshotters.TargetManifestDigestLabel]); err != nil {
+			return &indexRequiredError{ref: origRef, err: fmt.Errorf("unable to fetch SOCI artifacts: %w", err)}
+		}
+	}
 	// Get source information of this layer.
 	src, err := fs.getSources(labels)
 	if err != nil {
@@ -418,15 +909,22 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 	if err != nil {
 		return fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
 	}
-	remoteStore, err := newRemoteStore(refspec)
-	if err != nil {
-		return fmt.Errorf("cannot create remote store: %w", err)
+	var remoteStore resolverStorage = offlineStore{}
+	if !fs.offline {
+		if remoteStore, err = newRemoteStore(refspec, fs.registryHosts); err != nil {
+			return fmt.Errorf("cannot create remote store: %w", err)
+		}
 	}
-	fetcher, err := newArtifactFetcher(refspec, fs.orasStore, remoteStore, fs.contentStorePath)
+	fetcher, err := newArtifactFetcher(refspec, fs.orasStore, remoteStore, fs.contentStorePath, fs.blobSources)
 	if err != nil {
 		return fmt.Errorf("cannot create fetcher: %w", err)
 	}
-	unpacker := NewLayerUnpacker(fetcher, archive)
+	// Layers unpacked locally, e.g. because their namespace exceeded a quota, are fetched
+	// from registries too.
+	namespace, _ := namespaces.Namespace(ctx)
+	unpacker := NewLayerUnpacker(&meteredFetcher{Fetcher: fetcher, fetched: func(n int64) {
+		fs.quotas.AddFetched(namespace, n)
+	}}, archive)
 	desc := s.Target
 	err = unpacker.Unpack(ctx, desc, mountpoint, mounts)
 	if err != nil {
@@ -437,19 +935,71 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 }
 
 func (fs *filesystem) getSociContext(ctx context.Context, imageRef, indexDigest, imageManifestDigest string) (*sociContext, error) {
-	cAny, _ := fs.sociContexts.LoadOrStore(imageManifestDigest, &sociContext{})
-	c, ok := cAny.(*sociContext)
-	if !ok {
-		return nil, fmt.Errorf("could not load index: fs soci context is invalid type for %s", indexDigest)
+	c := fs.sociContexts.get(ctx, imageRef, imageManifestDigest)
+	fetchOpts := []FetchOption{withSharedFetches(fs.artifactFetchGroup(ctx))}
+	if fs.asyncZtocFetch {
+		fetchOpts = append(fetchOpts, WithAsyncZtocFetch())
 	}
-	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, fs.orasStore, fs.indexStorePath, fs.contentStorePath, fs.fuseMetricsEmitWaitDuration)
+	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, sociContextConfig{
+		store:                  fs.orasStore,
+		indexStorePath:         fs.indexStorePath,
+		contentStorePath:       fs.contentStorePath,
+		fuseOpEmitWaitDuration: fs.fuseMetricsEmitWaitDuration,
+		sizeLimits:             fs.artifactSizeLimits,
+		blobSources:            fs.blobSources,
+		hosts:                  fs.registryHosts,
+		offline:                fs.offline,
+		fetchOpts:              fetchOpts,
+	})
 	return c, err
 }
 
-func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
+// artifactFetchGroup returns the group of the fetches of SOCI artifacts shared by the images of
+// the namespace of ctx, or of all namespaces if they share their artifacts.
+func (fs *filesystem) artifactFetchGroup(ctx context.Context) *sharedFetches {
+	ns, _ := namespaces.Namespace(ctx)
+	if fs.shareNamespaces || ns == "" {
+		return &fs.artifactFetches
+	}
+	fs.namespaceArtifactFetchesMu.Lock()
+	defer fs.namespaceArtifactFetchesMu.Unlock()
+	if fs.namespaceArtifactFetches == nil {
+		fs.namespaceArtifactFetches = make(map[string]*sharedFetches)
+	}
+	g, ok := fs.namespaceArtifactFetches[ns]
+	if !ok {
+		g = new(sharedFetches)
+		fs.namespaceArtifactFetches[ns] = g
+	}
+	return g
+}
+
+func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if fs.sharedMounts != nil {
+		if digest, ok := labels[ctdsnapshotters.TargetLayerDigestLabel]; ok {
+			return fs.sharedMounts.Acquire(ctx, digest, mountpoint, func(source string) error {
+				return fs.mount(ctx, source, labels)
+			})
+		}
+	}
+	return fs.mount(ctx, mountpoint, labels)
+}
+
+// mount mounts the layer of the snapshot labeled with `labels` at `mountpoint` with a FUSE server of its own.
+func (fs *filesystem) mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
 	// Setting the start time to measure the Mount operation duration.
 	start := time.Now()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+	// failureReason is the reason counted if the current step of the mount fails.
+	failureReason := commonmetrics.MountFailureOther
+	defer func() {
+		// Layers without a ztoc are expected to be unpacked locally, so they don't count as failures.
+		if retErr != nil && !errors.Is(retErr, snapshot.ErrNoZtoc) {
+			commonmetrics.IncMountFailureCount(mountFailureReason(retErr, failureReason))
+		}
+	}()
+	origRef := labels[ctdsnapshotters.TargetRefLabel]
+	labels = fs.rewriteLabels(ctx, labels)
 
 	sociIndexDigest, ok := labels[source.TargetSociIndexDigestLabel]
 	if !ok {
@@ -463,11 +1013,21 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	if !ok {
 		return fmt.Errorf("unable to get image digest from labels")
 	}
+	// Layers of namespaces which exceeded a quota are unpacked locally instead.
+	namespace, _ := namespaces.Namespace(ctx)
+	if err := fs.quotas.CheckNamespace(namespace); err != nil {
+		return fmt.Errorf("cannot mount layer lazily: %w", err)
+	}
 
+	failureReason = commonmetrics.MountFailureIndexFetch
 	c, err := fs.getSociContext(ctx, imageRef, sociIndexDigest, imgDigest)
 	if err != nil {
+		if fs.requiresIndex(origRef, imageRef) {
+			return &indexRequiredError{ref: origRef, err: fmt.Errorf("unable to fetch SOCI artifacts: %w", err)}
+		}
 		return fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
 	}
+	failureReason = commonmetrics.MountFailureOther
 
 	// Get source information of this layer.
 	src, err := fs.getSources(labels)
@@ -494,13 +1054,16 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 				rErr = fmt.Errorf("skipping mounting layer %s as FUSE mount: %w", s.Target.Digest.String(), snapshot.ErrNoZtoc)
 				break
 			}
-
-			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, sociDesc, c.fuseOperationCounter)
+			l, err := fs.resolveLayer(ctx, c, s, s.Target, sociDesc)
 			if err == nil {
 				resultChan <- l
 				return
 			}
 			rErr = fmt.Errorf("failed to resolve layer %q from %q: %w", s.Target.Digest, s.Name, err)
+			if errors.Is(err, layer.ErrInvalidZtoc) && fs.requiresIndex(origRef, imageRef) {
+				rErr = &indexRequiredError{ref: origRef, err: rErr}
+				break
+			}
 		}
 		errChan <- rErr
 	}()
@@ -510,15 +1073,14 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	for _, desc := range neighboringLayers(preResolve.Manifest, preResolve.Target) {
 		desc := desc
 		go func() {
-			// Avoids to get canceled by client.
-			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint))
+			// Avoids to get canceled by client, but keeps the namespace whose caches the layer is resolved in.
+			ctx := log.WithLogger(namespaces.WithNamespace(context.Background(), namespace), log.G(ctx).WithField("mountpoint", mountpoint))
 			sociDesc, ok := c.imageLayerToSociDesc[desc.Digest.String()]
 			if !ok {
-				log.G(ctx).WithError(snapshot.ErrNoZtoc).WithField("layerDigest", desc.Digest.String()).Debug("skipping layer pre-resolve")
+				log.G(ctx).WithError(snapshot.ErrNoZtoc).WithField(logutil.LayerField, desc.Digest).Debug("skipping layer pre-resolve")
 				return
 			}
-
-			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc, sociDesc, c.fuseOperationCounter)
+			l, err := fs.resolveLayer(ctx, c, preResolve, desc, sociDesc)
 			if err != nil {
 				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
 				return
@@ -557,6 +1119,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		log.G(ctx).Infof("Verification forcefully skipped")
 	}
 
+	failureReason = commonmetrics.MountFailureFuse
 	node, err := l.RootNode(0)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("Failed to get root node")
@@ -569,9 +1132,9 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	defer commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.Mount, digest, start)
 
 	// Register the mountpoint layer
-	fs.layerMu.Lock()
-	fs.layer[mountpoint] = l
-	fs.layerMu.Unlock()
+	mnt := &layerMount{layer: l, namespace: namespace, imageDigest: imgDigest, layerDigest: digest, mountedAt: time.Now()}
+	mnt.indexDigest, _, _ = c.discovery()
+	fs.mounts.add(mountpoint, mnt)
 	fs.metricsController.Add(mountpoint, l)
 
 	// mount the node to the specified mountpoint
@@ -600,7 +1163,10 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		return
 	}
 
-	go server.Serve()
+	go func() {
+		server.Serve()
+		fs.fuseServerStopped(ctx, mountpoint, l)
+	}()
 
 	// Send a signal to the background fetcher that a new image is being mounted
 	// and to pause all background fetches.
@@ -610,16 +1176,78 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		}
 	})
 
-	return server.WaitMount()
+	if err := server.WaitMount(); err != nil {
+		return err
+	}
+
+	percent := fs.mountPrefetchPercent(ctx, labels)
+	profile, hasProfile := labels[source.PrefetchProfileDigestLabelV1]
+	if percent > 0 || hasProfile {
+		// Prefetching is best-effort and doesn't delay the mount: spans which weren't fetched
+		// are fetched when read. The prefetch outlives the request mounting the layer.
+		prefetchCtx := log.WithLogger(namespaces.WithNamespace(fs.ctx, namespace), log.G(ctx))
+		go fs.prefetch(prefetchCtx, l, percent, profile)
+	}
+
+	if fs.exporter != nil {
+		// Re-exporting is best-effort: the layer is still usable on the host if it fails.
+		if err := fs.exporter.Export(ctx, mountpoint); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to re-export layer")
+		}
+	}
+	if fs.blockDevices != nil {
+		r, size := l.UncompressedArchive()
+		if err := fs.blockDevices.Export(fs.ctx, mountpoint, l.TOC(), r, size); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to serve layer as block device")
+		}
+	}
+	if fs.passthrough != nil {
+		fs.passthrough.Watch(fs.ctx, mountpoint, l)
+	}
+	if mnt.indexDigest != "" {
+		fs.pins.mounted(mnt)
+	}
+	return nil
+}
+
+// prefetch fetches the first `percent` percent of the spans of the layer `l`, then the files of
+// the prefetch profile with digest `profile`, if it's not empty.
+func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer, percent int, profile string) {
+	if percent > 0 {
+		if err := l.Prefetch(percent); err != nil {
+			log.G(ctx).WithError(err).WithField("percent", percent).Warn("failed to prefetch layer")
+		}
+	}
+	if profile != "" {
+		n, err := fs.prefetchProfile(ctx, l, profile)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("profile", profile).Warn("failed to prefetch files of prefetch profile")
+		} else {
+			log.G(ctx).WithField("profile", profile).WithField("files", n).Debug("prefetched files of prefetch profile")
+		}
+	}
+}
+
+// mountPrefetchPercent returns the percentage of the spans of a layer to fetch when it's mounted
+// with `labels`. The prefetch label of the image overrides the configured percentage.
+func (fs *filesystem) mountPrefetchPercent(ctx context.Context, labels map[string]string) int {
+	v, ok := labels[source.TargetPrefetchLabel]
+	if !ok {
+		return fs.prefetchPercent
+	}
+	percent, err := source.ParsePrefetchPercent(v)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("ignoring prefetch label")
+		return fs.prefetchPercent
+	}
+	return percent
 }
 
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
 
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
-	fs.layerMu.Lock()
-	l := fs.layer[mountpoint]
-	fs.layerMu.Unlock()
+	l := fs.mountedLayer(mountpoint)
 	if l == nil {
 		log.G(ctx).Debug("layer not registered")
 		return fmt.Errorf("layer not registered")
@@ -642,7 +1270,7 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	log.G(ctx).WithError(err).Warn("failed to connect to blob")
 
 	// Check failed. Try to refresh the connection with fresh source information
-	src, err := fs.getSources(labels)
+	src, err := fs.getSources(fs.rewriteLabels(ctx, labels))
 	if err != nil {
 		return err
 	}
@@ -668,17 +1296,99 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	return rErr
 }
 
+var _ snapshot.SpanMigrator = &filesystem{}
+
+// ExportSpans writes the contents of the spans fetched so far of the layer mounted at mountpoint to tw, under dir.
+func (fs *filesystem) ExportSpans(ctx context.Context, mountpoint string, tw *tar.Writer, dir string) error {
+	l := fs.mountedLayer(mountpoint)
+	if l == nil {
+		return fmt.Errorf("layer not registered")
+	}
+	return l.ExportSpans(tw, dir)
+}
+
+// ImportSpan caches the contents of a span exported by ExportSpans under name for the layer mounted at mountpoint.
+func (fs *filesystem) ImportSpan(ctx context.Context, mountpoint, name string, r io.Reader) error {
+	l := fs.mountedLayer(mountpoint)
+	if l == nil {
+		return fmt.Errorf("layer not registered")
+	}
+	return l.ImportSpan(name, r)
+}
+
+var _ snapshot.FetchStatsProvider = &filesystem{}
+
+// FetchStats returns the fetch statistics of the layer mounted at mountpoint.
+func (fs *filesystem) FetchStats(ctx context.Context, mountpoint string) (snapshot.FetchStats, error) {
+	l := fs.mountedLayer(mountpoint)
+	if l == nil {
+		return snapshot.FetchStats{}, fmt.Errorf("layer not registered")
+	}
+	s := l.Info().FetchStats
+	return snapshot.FetchStats{FetchedBytes: s.FetchedBytes, CachedBytes: s.CachedBytes, Reads: s.Reads}, nil
+}
+
+// mountedLayer returns the layer mounted at `mountpoint`, or nil if no layer is mounted there.
+func (fs *filesystem) mountedLayer(mountpoint string) layer.Layer {
+	if fs.sharedMounts != nil {
+		mountpoint = fs.sharedMounts.Source(mountpoint)
+	}
+	if m := fs.mounts.get(mountpoint); m != nil {
+		return m.layer
+	}
+	return nil
+}
+
 func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
-	fs.layerMu.Lock()
-	l, ok := fs.layer[mountpoint]
+	if fs.sharedMounts != nil {
+		if shared, err := fs.sharedMounts.Release(ctx, mountpoint); shared {
+			return err
+		}
+	}
+	return fs.unmount(ctx, mountpoint)
+}
+
+// Close releases the resources of the filesystem which outlive its mounts, e.g. the persistent
+// index of the span caches. It's called by the snapshotter once it has unmounted every layer.
+func (fs *filesystem) Close() error {
+	err := fs.resolver.Close()
+	// The spans cached in memory are released once the resolver is closed.
+	if qerr := fs.quotas.Close(); err == nil {
+		err = qerr
+	}
+	return err
+}
+
+// unmount unmounts the FUSE mount of the layer at `mountpoint`.
+func (fs *filesystem) unmount(ctx context.Context, mountpoint string) error {
+	fs.stoppedFuseServersMu.Lock()
+	m, ok := fs.mounts.remove(mountpoint) // unregisters the corresponding layer
 	if !ok {
-		fs.layerMu.Unlock()
+		fs.stoppedFuseServersMu.Unlock()
 		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
 	}
-	delete(fs.layer, mountpoint) // unregisters the corresponding layer
-	l.Done()
-	fs.layerMu.Unlock()
+	delete(fs.stoppedFuseServers, mountpoint)
+	m.layer.Done()
+	fs.stoppedFuseServersMu.Unlock()
 	fs.metricsController.Remove(mountpoint)
+	if fs.exporter != nil {
+		if err := fs.exporter.Unexport(ctx, mountpoint); err != nil {
+			log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to stop re-exporting layer")
+		}
+	}
+	if fs.blockDevices != nil {
+		if err := fs.blockDevices.Unexport(mountpoint); err != nil {
+			log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to stop serving block device")
+		}
+	}
+	if fs.passthrough != nil {
+		if err := fs.passthrough.Unwatch(mountpoint); err != nil {
+			log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to remove passthrough mount")
+		}
+	}
+	if err := fs.quotas.Save(); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to save quota usage")
+	}
 	// The goroutine which serving the mountpoint possibly becomes not responding.
 	// In case of such situations, we use MNT_FORCE here and abort the connection.
 	// In the future, we might be able to consider to kill that specific hanging
@@ -687,6 +1397,40 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
 }
 
+// backgroundFetchPriority returns the background fetch priority of the target layer. Lower layers
+// (e.g. the base OS) are usually needed first, so the priority decreases with the position of the layer
+// in the manifest, unless the SOCI index overrides it with an annotation on the ztoc descriptor.
+func backgroundFetchPriority(ctx context.Context, manifest ocispec.Manifest, target, sociDesc ocispec.Descriptor) int {
+	if v, ok := sociDesc.Annotations[soci.IndexAnnotationBackgroundFetchPriority]; ok {
+		priority, err := strconv.Atoi(v)
+		if err == nil {
+			return priority
+		}
+		log.G(ctx).WithError(err).WithField(logutil.LayerField, target.Digest).Warn("ignoring invalid background fetch priority annotation")
+	}
+	for i, desc := range manifest.Layers {
+		if desc.Digest == target.Digest {
+			return -i
+		}
+	}
+	return 0
+}
+
+// mountFailureReason returns the reason of the mount failure `err`, or `reason` (the reason
+// of failures of the step of the mount which failed) if nothing more specific is known.
+func mountFailureReason(err error, reason string) string {
+	var errResp *errcode.ErrorResponse
+	switch {
+	case errors.Is(err, remote.ErrUnauthorized), errors.Is(err, docker.ErrInvalidAuthorization):
+		return commonmetrics.MountFailureAuth
+	case errors.As(err, &errResp) && (errResp.StatusCode == http.StatusUnauthorized || errResp.StatusCode == http.StatusForbidden):
+		return commonmetrics.MountFailureAuth
+	case errors.Is(err, layer.ErrInvalidZtoc):
+		return commonmetrics.MountFailureZtocParse
+	}
+	return reason
+}
+
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
 func neighboringLayers(manifest ocispec.Manifest, target ocispec.Descriptor) (descs []ocispec.Descriptor) {
 	for _, desc := range manifest.Layers {
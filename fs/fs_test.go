@@ -39,26 +39,36 @@
 package fs
 
 import (
+	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/fs/layer"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
 func TestCheck(t *testing.T) {
 	bl := &breakableLayer{}
 	fs := &filesystem{
-		layer: map[string]layer.Layer{
-			"test": bl,
-		},
+		mounts: &mountRegistry{mounts: map[string]*layerMount{
+			"test": {layer: bl},
+		}},
 		getSources: source.FromDefaultLabels(func(refspec reference.Spec) (hosts []docker.RegistryHost, _ error) {
 			return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost))(refspec.Hostname())
 		}),
@@ -74,6 +84,174 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestBackgroundFetchPriority(t *testing.T) {
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{
+			{Digest: digest.FromString("layer0")},
+			{Digest: digest.FromString("layer1")},
+			{Digest: digest.FromString("layer2")},
+		},
+	}
+	tests := []struct {
+		name        string
+		target      ocispec.Descriptor
+		annotations map[string]string
+		expected    int
+	}{
+		{
+			name:     "base layer comes first",
+			target:   manifest.Layers[0],
+			expected: 0,
+		},
+		{
+			name:     "upper layers come later",
+			target:   manifest.Layers[2],
+			expected: -2,
+		},
+		{
+			name:        "annotation overrides position",
+			target:      manifest.Layers[2],
+			annotations: map[string]string{soci.IndexAnnotationBackgroundFetchPriority: "10"},
+			expected:    10,
+		},
+		{
+			name:        "invalid annotation is ignored",
+			target:      manifest.Layers[1],
+			annotations: map[string]string{soci.IndexAnnotationBackgroundFetchPriority: "high"},
+			expected:    -1,
+		},
+		{
+			name:     "unknown layer",
+			target:   ocispec.Descriptor{Digest: digest.FromString("unknown")},
+			expected: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sociDesc := ocispec.Descriptor{Annotations: tt.annotations}
+			if got := backgroundFetchPriority(context.TODO(), manifest, tt.target, sociDesc); got != tt.expected {
+				t.Fatalf("unexpected priority; expected = %d, got = %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMountPrefetchPercent(t *testing.T) {
+	fs := &filesystem{prefetchPercent: 10}
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected int
+	}{
+		{
+			name:     "config applies without label",
+			expected: 10,
+		},
+		{
+			name:     "label overrides config",
+			labels:   map[string]string{source.TargetPrefetchLabel: "25%"},
+			expected: 25,
+		},
+		{
+			name:     "label disables prefetch",
+			labels:   map[string]string{source.TargetPrefetchLabel: "0%"},
+			expected: 0,
+		},
+		{
+			name:     "invalid label is ignored",
+			labels:   map[string]string{source.TargetPrefetchLabel: "all"},
+			expected: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fs.mountPrefetchPercent(context.TODO(), tt.labels); got != tt.expected {
+				t.Fatalf("unexpected prefetch percentage; expected = %d, got = %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetZtocForLayerAsyncZtocs(t *testing.T) {
+	ctx := context.Background()
+	fs := &filesystem{sociContexts: newDiscoveryCache(time.Hour, time.Hour)}
+	layerDigest := digest.FromString("layer")
+	ztocDesc := ocispec.Descriptor{Digest: digest.FromString("ztoc")}
+
+	// An index fetched without its zTOCs.
+	c := fs.sociContexts.get(ctx, "ref", "manifest")
+	c.fetchOnce.Do(func() {})
+	c.imageLayerToSociDesc = map[string]ocispec.Descriptor{layerDigest.String(): ztocDesc}
+	var fetched []digest.Digest
+	c.fetchZtoc = func(_ context.Context, desc ocispec.Descriptor) error {
+		fetched = append(fetched, desc.Digest)
+		return nil
+	}
+
+	desc, err := fs.GetZtocForLayer(ctx, "ref", "", "manifest", layerDigest.String())
+	if err != nil || desc.Digest != ztocDesc.Digest {
+		t.Fatalf("unexpected ztoc %v: %v", desc.Digest, err)
+	}
+	if len(fetched) != 1 || fetched[0] != ztocDesc.Digest {
+		t.Fatalf("ztoc wasn't fetched; fetched = %v", fetched)
+	}
+
+	// Layers without a zTOC don't fetch anything.
+	if desc, err := fs.GetZtocForLayer(ctx, "ref", "", "manifest", digest.FromString("other").String()); err != nil || desc.Digest != "" {
+		t.Fatalf("unexpected ztoc %v: %v", desc.Digest, err)
+	}
+	if len(fetched) != 1 {
+		t.Fatalf("unexpected ztoc fetches: %v", fetched)
+	}
+}
+
+func TestMountFailureReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		reason   string
+		expected string
+	}{
+		{
+			name:     "reason of the failed step",
+			err:      fmt.Errorf("unable to fetch SOCI artifacts: %w", errors.New("not found")),
+			reason:   commonmetrics.MountFailureIndexFetch,
+			expected: commonmetrics.MountFailureIndexFetch,
+		},
+		{
+			name:     "unauthorized blob fetch",
+			err:      fmt.Errorf("failed to resolve layer: %w", remote.ErrUnauthorized),
+			reason:   commonmetrics.MountFailureOther,
+			expected: commonmetrics.MountFailureAuth,
+		},
+		{
+			name:     "unauthorized index fetch",
+			err:      fmt.Errorf("unable to fetch SOCI artifacts: %w", &errcode.ErrorResponse{StatusCode: http.StatusForbidden}),
+			reason:   commonmetrics.MountFailureIndexFetch,
+			expected: commonmetrics.MountFailureAuth,
+		},
+		{
+			name:     "index fetch failing with another status",
+			err:      fmt.Errorf("unable to fetch SOCI artifacts: %w", &errcode.ErrorResponse{StatusCode: http.StatusNotFound}),
+			reason:   commonmetrics.MountFailureIndexFetch,
+			expected: commonmetrics.MountFailureIndexFetch,
+		},
+		{
+			name:     "invalid ztoc",
+			err:      fmt.Errorf("failed to resolve layer: %w", layer.ErrInvalidZtoc),
+			reason:   commonmetrics.MountFailureOther,
+			expected: commonmetrics.MountFailureZtocParse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mountFailureReason(tt.err, tt.reason); got != tt.expected {
+				t.Fatalf("unexpected reason; expected = %q, got = %q", tt.expected, got)
+			}
+		})
+	}
+}
+
 type breakableLayer struct {
 	success bool
 }
@@ -84,6 +262,15 @@ func (l *breakableLayer) Verify(tocDigest digest.Digest) error                {
 func (l *breakableLayer) SkipVerify()                                         {}
 func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
 func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
+func (l *breakableLayer) UncompressedArchive() (io.ReaderAt, int64)           { return nil, 0 }
+func (l *breakableLayer) TOC() ztoc.TOC                                       { return ztoc.TOC{} }
+func (l *breakableLayer) ExportSpans(*tar.Writer, string) error               { return nil }
+func (l *breakableLayer) ImportSpan(string, io.Reader) error                  { return nil }
+func (l *breakableLayer) Demote(spanmanager.DemoteMode) (int, error)          { return 0, nil }
+func (l *breakableLayer) SetPinned(bool)                                      {}
+func (l *breakableLayer) Compact(int) (int, error)                            { return 0, nil }
+func (l *breakableLayer) Prefetch(int) error                                  { return nil }
+func (l *breakableLayer) PrefetchFiles([]string) (int, error)                 { return 0, nil }
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/health"
+	"github.com/containerd/containerd/log"
+)
+
+// Names of the subsystems of the filesystem in health reports.
+const (
+	HealthFuse              = "fuse"
+	HealthContentStore      = "content_store"
+	HealthRegistry          = "registry"
+	HealthBackgroundFetcher = "background_fetcher"
+)
+
+func (fs *filesystem) registerHealthChecks(registry *health.Registry) {
+	registry.Register(HealthFuse, fs.checkFuseHealth)
+	registry.Register(HealthContentStore, fs.checkContentStoreHealth)
+	registry.Register(HealthRegistry, fs.checkRegistryHealth)
+	if fs.bgFetcher != nil {
+		registry.Register(HealthBackgroundFetcher, fs.checkBackgroundFetcherHealth)
+	}
+}
+
+// fuseServerStopped is called when the FUSE server of `mountpoint` stops serving.
+// This is expected once the layer is unmounted, but otherwise the mount is broken.
+func (fs *filesystem) fuseServerStopped(ctx context.Context, mountpoint string, l layer.Layer) {
+	fs.stoppedFuseServersMu.Lock()
+	defer fs.stoppedFuseServersMu.Unlock()
+	if m := fs.mounts.get(mountpoint); m == nil || m.layer != l {
+		return
+	}
+	log.G(ctx).Warn("FUSE server stopped before the layer was unmounted")
+	fs.stoppedFuseServers[mountpoint] = struct{}{}
+}
+
+// checkFuseHealth reports whether the FUSE servers of all the mounted layers are alive.
+func (fs *filesystem) checkFuseHealth(context.Context) health.Status {
+	fs.stoppedFuseServersMu.Lock()
+	defer fs.stoppedFuseServersMu.Unlock()
+	if len(fs.stoppedFuseServers) > 0 {
+		stopped := make([]string, 0, len(fs.stoppedFuseServers))
+		for mountpoint := range fs.stoppedFuseServers {
+			stopped = append(stopped, mountpoint)
+		}
+		sort.Strings(stopped)
+		return health.Unhealthy("FUSE servers stopped for %d of %d mounts: %v", len(stopped), fs.mounts.len(), stopped)
+	}
+	return health.Healthy("%d mounts", fs.mounts.len())
+}
+
+// checkContentStoreHealth reports whether the content store is writable.
+func (fs *filesystem) checkContentStoreHealth(context.Context) health.Status {
+	f, err := os.CreateTemp(fs.contentStorePath, ".health-*")
+	if err != nil {
+		return health.Unhealthy("content store is not writable: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write([]byte("ok")); err != nil {
+		return health.Unhealthy("content store is not writable: %v", err)
+	}
+	return health.Healthy("writable")
+}
+
+// checkRegistryHealth reports whether the last fetch of a layer region succeeded.
+func (fs *filesystem) checkRegistryHealth(context.Context) health.Status {
+	last := fs.resolver.LastFetch()
+	if last.Time.IsZero() {
+		return health.Healthy("no layer fetched yet")
+	}
+	if last.Err != nil {
+		return health.Unhealthy("last fetch at %s failed: %v", last.Time.Format(time.RFC3339), last.Err)
+	}
+	return health.Healthy("last fetch at %s succeeded", last.Time.Format(time.RFC3339))
+}
+
+// checkBackgroundFetcherHealth reports the queue depth of the background fetcher.
+// Once the queue is full, mounts block until a layer is fully fetched.
+func (fs *filesystem) checkBackgroundFetcherHealth(context.Context) health.Status {
+	size, max := fs.bgFetcher.QueueSize(), fs.bgFetcher.MaxQueueSize()
+	if size >= max {
+		return health.Unhealthy("queue is full: %d of %d layers", size, max)
+	}
+	return health.Healthy("%d of %d layers queued", size, max)
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/containerd/containerd/log"
+)
+
+const defaultIdleDemotionCheckPeriod = 60 * time.Second
+
+// idleDemoter demotes the cached spans of the images none of whose layers have been read
+// for the idle period, so that images which are no longer used don't hold on to the cache.
+//
+// A layer shared by several images is mounted once, so it belongs to the image it was first mounted for.
+type idleDemoter struct {
+	idlePeriod  time.Duration
+	checkPeriod time.Duration
+	mode        spanmanager.DemoteMode
+
+	mounts *mountRegistry
+
+	mu sync.Mutex
+	// demoted is the last access of each image when it was last demoted,
+	// so that an image is demoted only once per idle stretch.
+	demoted map[string]time.Time // image digest -> last access
+}
+
+// newIdleDemoter returns a demoter of the idle images among the layers of `mounts`.
+func newIdleDemoter(cfg config.IdleDemotionConfig, mounts *mountRegistry) (*idleDemoter, error) {
+	mode := spanmanager.DemoteMode(cfg.Mode)
+	switch mode {
+	case "":
+		mode = spanmanager.DemoteDrop
+	case spanmanager.DemoteDrop, spanmanager.DemoteCompress:
+	default:
+		return nil, fmt.Errorf("unknown idle demotion mode %q", cfg.Mode)
+	}
+	checkPeriod := time.Duration(cfg.CheckPeriodSec) * time.Second
+	if checkPeriod == 0 {
+		checkPeriod = defaultIdleDemotionCheckPeriod
+	}
+	return &idleDemoter{
+		idlePeriod:  time.Duration(cfg.IdlePeriodSec) * time.Second,
+		checkPeriod: checkPeriod,
+		mode:        mode,
+		mounts:      mounts,
+		demoted:     make(map[string]time.Time),
+	}, nil
+}
+
+// run checks for idle images every check period until ctx is done.
+func (d *idleDemoter) run(ctx context.Context) {
+	ticker := time.NewTicker(d.checkPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.demoteIdleImages(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// demoteIdleImages demotes the layers of the images which have been idle for the idle period at `now`.
+func (d *idleDemoter) demoteIdleImages(ctx context.Context, now time.Time) {
+	lastAccess := make(map[string]time.Time)
+	layers := make(map[string][]layer.Layer)
+	for _, m := range d.mounts.list() {
+		access := m.mountedAt
+		if readTime := m.layer.Info().ReadTime; readTime.After(access) {
+			access = readTime
+		}
+		if access.After(lastAccess[m.imageDigest]) {
+			lastAccess[m.imageDigest] = access
+		}
+		layers[m.imageDigest] = append(layers[m.imageDigest], m.layer)
+	}
+	d.mu.Lock()
+	// Images whose layers were all unmounted are forgotten.
+	for image := range d.demoted {
+		if _, ok := lastAccess[image]; !ok {
+			delete(d.demoted, image)
+		}
+	}
+	for image, access := range lastAccess {
+		if now.Sub(access) < d.idlePeriod || d.demoted[image].Equal(access) {
+			delete(layers, image)
+			continue
+		}
+		d.demoted[image] = access
+	}
+	d.mu.Unlock()
+
+	for image, imageLayers := range layers {
+		var demoted int
+		for _, l := range imageLayers {
+			n, err := l.Demote(d.mode)
+			demoted += n
+			if err != nil && !errors.Is(err, spanmanager.ErrDemotionNotSupported) {
+				log.G(ctx).WithError(err).WithField(logutil.ImageField, image).WithField(logutil.LayerField, l.Info().Digest).
+					Warn("failed to demote spans of idle image")
+			}
+		}
+		log.G(ctx).WithField(logutil.ImageField, image).WithField("mode", d.mode).WithField("spans", demoted).
+			WithField("idle", now.Sub(lastAccess[image]).Round(time.Second)).Info("demoted spans of idle image")
+	}
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+)
+
+type idleTestLayer struct {
+	breakableLayer
+	readTime time.Time
+	demoted  []spanmanager.DemoteMode
+}
+
+func (l *idleTestLayer) Info() layer.Info { return layer.Info{ReadTime: l.readTime} }
+func (l *idleTestLayer) Demote(mode spanmanager.DemoteMode) (int, error) {
+	l.demoted = append(l.demoted, mode)
+	return 1, nil
+}
+
+func TestIdleDemoter(t *testing.T) {
+	mounts := newMountRegistry()
+	d, err := newIdleDemoter(config.IdleDemotionConfig{IdlePeriodSec: 60, Mode: "compress"}, mounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	idle := &idleTestLayer{readTime: now.Add(-2 * time.Minute)}
+	alsoIdle := &idleTestLayer{}
+	active := &idleTestLayer{readTime: now.Add(-2 * time.Minute)}
+	recentlyRead := &idleTestLayer{readTime: now.Add(90 * time.Second)}
+	mounts.add("/mnt/1", &layerMount{layer: idle, imageDigest: "idle", mountedAt: now})
+	mounts.add("/mnt/2", &layerMount{layer: alsoIdle, imageDigest: "idle", mountedAt: now})
+	mounts.add("/mnt/3", &layerMount{layer: active, imageDigest: "active", mountedAt: now})
+	mounts.add("/mnt/4", &layerMount{layer: recentlyRead, imageDigest: "active", mountedAt: now})
+
+	d.demoteIdleImages(ctx, now)
+	// Layers which were never read are idle since they were mounted.
+	if len(idle.demoted) != 0 || len(alsoIdle.demoted) != 0 {
+		t.Fatal("image was demoted before it was idle")
+	}
+	d.demoteIdleImages(ctx, now.Add(2*time.Minute))
+	for _, l := range []*idleTestLayer{idle, alsoIdle} {
+		if len(l.demoted) != 1 || l.demoted[0] != spanmanager.DemoteCompress {
+			t.Fatalf("unexpected demotions of idle image: %v", l.demoted)
+		}
+	}
+	if len(active.demoted) != 0 || len(recentlyRead.demoted) != 0 {
+		t.Fatal("image which was read recently was demoted")
+	}
+
+	// Idle images are demoted once, until they are read again.
+	d.demoteIdleImages(ctx, now.Add(3*time.Minute))
+	if len(idle.demoted) != 1 {
+		t.Fatalf("idle image was demoted again: %v", idle.demoted)
+	}
+	idle.readTime = now.Add(3 * time.Minute)
+	d.demoteIdleImages(ctx, now.Add(5*time.Minute))
+	if len(idle.demoted) != 2 || len(alsoIdle.demoted) != 2 {
+		t.Fatalf("idle image was not demoted after it was read again: %v", idle.demoted)
+	}
+
+	mounts.remove("/mnt/1")
+	mounts.remove("/mnt/2")
+	d.demoteIdleImages(ctx, now.Add(6*time.Minute))
+	d.mu.Lock()
+	_, ok := d.demoted["idle"]
+	d.mu.Unlock()
+	if ok {
+		t.Fatal("image was not forgotten after its layers were unmounted")
+	}
+}
+
+func TestNewIdleDemoterInvalidMode(t *testing.T) {
+	if _, err := newIdleDemoter(config.IdleDemotionConfig{IdlePeriodSec: 60, Mode: "cold"}, newMountRegistry()); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
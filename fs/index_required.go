@@ -0,0 +1,59 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/containerd/containerd/reference"
+)
+
+// indexRequiredError is the error of preparing a layer of an image which must be lazily loaded
+// with a verified SOCI index, whose index can't be found or verified.
+// It is snapshot.ErrIndexRequired and wraps the cause.
+type indexRequiredError struct {
+	ref string
+	err error
+}
+
+func (e *indexRequiredError) Error() string {
+	return fmt.Sprintf("image %s requires a verified SOCI index: %v", e.ref, e.err)
+}
+
+func (e *indexRequiredError) Unwrap() error {
+	return e.err
+}
+
+func (e *indexRequiredError) Is(target error) bool {
+	return target == snapshot.ErrIndexRequired || errors.Is(snapshot.ErrIndexRequired, target)
+}
+
+// requiresIndex returns whether any of the references `refs` of an image requires a SOCI index,
+// e.g. both its reference and the one it's rewritten to.
+func (fs *filesystem) requiresIndex(refs ...string) bool {
+	if fs.indexRequired == nil {
+		return false
+	}
+	for _, ref := range refs {
+		if refspec, err := reference.Parse(ref); err == nil && fs.indexRequired(refspec) {
+			return true
+		}
+	}
+	return false
+}
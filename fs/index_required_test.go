@@ -0,0 +1,57 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+)
+
+func TestIndexRequired(t *testing.T) {
+	fs := &filesystem{indexRequired: func(refspec reference.Spec) bool {
+		return refspec.Hostname() == "secure.example.com"
+	}}
+	tests := []struct {
+		refs     []string
+		required bool
+	}{
+		{refs: []string{"secure.example.com/app:latest"}, required: true},
+		{refs: []string{"other.example.com/app:latest"}},
+		// Images rewritten from or to a registry requiring an index require it.
+		{refs: []string{"secure.example.com/app:latest", "mirror.example.com/app:latest"}, required: true},
+		{refs: []string{"other.example.com/app:latest", "secure.example.com/app:latest"}, required: true},
+		{refs: []string{""}},
+	}
+	for _, tc := range tests {
+		if got := fs.requiresIndex(tc.refs...); got != tc.required {
+			t.Errorf("unexpected requirement of %v; expected = %v, got = %v", tc.refs, tc.required, got)
+		}
+	}
+	if (&filesystem{}).requiresIndex("secure.example.com/app:latest") {
+		t.Error("index is required without a requirement")
+	}
+
+	cause := errors.New("no referrers")
+	err := error(&indexRequiredError{ref: "secure.example.com/app:latest", err: cause})
+	if !errors.Is(err, snapshot.ErrIndexRequired) || !errdefs.IsFailedPrecondition(err) || !errors.Is(err, cause) {
+		t.Fatalf("unexpected error chain of %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/archive"
+	"golang.org/x/sys/unix"
+)
+
+// Extract extracts the contents of the layer into dir, in the form overlayfs expects
+// of a lower directory. The result looks the same as the filesystem served by RootNode,
+// including whiteouts (character devices) and opaque directories (xattrs of opaqueType).
+func Extract(ctx context.Context, l Layer, dir string, opaqueType OverlayOpaqueType) error {
+	r, size := l.UncompressedArchive()
+	_, err := archive.Apply(ctx, dir, io.NewSectionReader(r, 0, size),
+		archive.WithConvertWhiteout(overlayConvertWhiteout(opaqueType)))
+	return err
+}
+
+// overlayConvertWhiteout is like archive.OverlayConvertWhiteout, but marks opaque
+// directories with the xattrs of opaqueType instead of always using trusted.overlay.opaque.
+func overlayConvertWhiteout(opaqueType OverlayOpaqueType) archive.ConvertWhiteout {
+	return func(hdr *tar.Header, path string) (bool, error) {
+		base := filepath.Base(path)
+		dir := filepath.Dir(path)
+		if base == whiteoutOpaqueDir {
+			for _, xattr := range opaqueXattrs[opaqueType] {
+				if err := unix.Setxattr(dir, xattr, []byte{'y'}, 0); err != nil {
+					return false, err
+				}
+			}
+			return false, nil
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			originalPath := filepath.Join(dir, base[len(whiteoutPrefix):])
+			if err := unix.Mknod(originalPath, unix.S_IFCHR, 0); err != nil {
+				return false, err
+			}
+			return false, os.Chown(originalPath, hdr.Uid, hdr.Gid)
+		}
+		return true, nil
+	}
+}
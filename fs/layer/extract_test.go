@@ -0,0 +1,65 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/archive"
+	ctdtestutil "github.com/containerd/containerd/pkg/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestOverlayConvertWhiteout(t *testing.T) {
+	ctdtestutil.RequiresRoot(t)
+	dir := t.TempDir()
+	tr := testutil.BuildTar([]testutil.TarEntry{
+		testutil.Dir("opaque/"),
+		testutil.File("opaque/"+whiteoutOpaqueDir, ""),
+		testutil.File(whiteoutPrefix+"deleted", ""),
+		testutil.File("file", "data"),
+	})
+	if _, err := archive.Apply(context.Background(), dir, tr,
+		archive.WithConvertWhiteout(overlayConvertWhiteout(OverlayOpaqueUser))); err != nil {
+		t.Fatalf("failed to apply archive: %v", err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dir, "deleted"))
+	if err != nil {
+		t.Fatalf("whiteout was not created: %v", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); fi.Mode()&os.ModeCharDevice == 0 || st.Rdev != 0 {
+		t.Fatalf("whiteout is not a 0/0 character device; mode = %v", fi.Mode())
+	}
+	buf := make([]byte, 1)
+	if _, err := unix.Getxattr(filepath.Join(dir, "opaque"), "user.overlay.opaque", buf); err != nil || buf[0] != 'y' {
+		t.Fatalf("directory is not marked opaque: %v", err)
+	}
+	for _, name := range []string{whiteoutPrefix + "deleted", filepath.Join("opaque", whiteoutOpaqueDir)} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("whiteout file %q was extracted", name)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "data" {
+		t.Fatalf("unexpected file contents %q: %v", data, err)
+	}
+}
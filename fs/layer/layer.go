@@ -39,16 +39,23 @@
 package layer
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/chaos"
 	"github.com/awslabs/soci-snapshotter/fs/config"
 
 	backgroundfetcher "github.com/awslabs/soci-snapshotter/fs/backgroundfetcher"
@@ -59,6 +66,8 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/awslabs/soci-snapshotter/util/lrucache"
 	"github.com/awslabs/soci-snapshotter/util/namedmutex"
 	"github.com/awslabs/soci-snapshotter/ztoc"
@@ -76,8 +85,34 @@ const (
 	defaultMaxLRUCacheEntry   = 10
 	defaultMaxCacheFds        = 10
 	memoryCacheType           = "memory"
+
+	defaultMaxConcurrentSpanFetches = 32
+
+	defaultSequentialReadaheadMinBytes = 4 << 20  // 4MiB
+	defaultSequentialReadaheadMaxBytes = 32 << 20 // 32MiB
 )
 
+// ErrInvalidZtoc is returned by Resolve when the zTOC of the layer can't be parsed.
+var ErrInvalidZtoc = errors.New("invalid ztoc")
+
+// invalidZtocError is the error of resolving a layer whose zTOC can't be parsed.
+// It is ErrInvalidZtoc and wraps the cause.
+type invalidZtocError struct {
+	err error
+}
+
+func (e *invalidZtocError) Error() string {
+	return fmt.Sprintf("%v; download and unpack this layer in container runtime for now: %v", ErrInvalidZtoc, e.err)
+}
+
+func (e *invalidZtocError) Unwrap() error {
+	return e.err
+}
+
+func (e *invalidZtocError) Is(target error) bool {
+	return target == ErrInvalidZtoc
+}
+
 // Layer represents a layer.
 type Layer interface {
 	// Info returns the information of this layer.
@@ -103,6 +138,40 @@ type Layer interface {
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
 
+	// UncompressedArchive returns a reader of the uncompressed layer archive and its size.
+	// Contents are fetched lazily, like the contents of files read through RootNode.
+	UncompressedArchive() (io.ReaderAt, int64)
+
+	// TOC returns the files of the layer recorded in its ztoc.
+	TOC() ztoc.TOC
+
+	// ExportSpans writes the contents of the spans of this layer fetched so far to tw, under dir.
+	ExportSpans(tw *tar.Writer, dir string) error
+
+	// ImportSpan caches the contents of a span exported by ExportSpans under name,
+	// e.g. on another node, so that the span is not fetched again.
+	ImportSpan(name string, r io.Reader) error
+
+	// Demote demotes the cached spans of this layer, e.g. when the layer is no longer read,
+	// and returns the number of spans demoted. Demoted spans are fetched or uncompressed again when read.
+	Demote(mode spanmanager.DemoteMode) (int, error)
+
+	// SetPinned pins or unpins the cached spans of this layer. Demote leaves pinned spans cached.
+	SetPinned(pinned bool)
+
+	// Compact packs the cached spans of this layer into a single file if at least `minFiles`
+	// of them are cached in files of their own, and returns the number of spans packed.
+	Compact(minFiles int) (int, error)
+
+	// Prefetch fetches the first `percent` percent of the spans of this layer and returns
+	// once they are cached, so that reads of them don't wait for the registry.
+	Prefetch(percent int) error
+
+	// PrefetchFiles fetches the spans of the regular files of this layer at `paths`, relative to
+	// the root of the layer, and returns the number of files found once their spans are cached.
+	// Paths which aren't regular files of this layer are skipped.
+	PrefetchFiles(paths []string) (int, error)
+
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
 	Done()
@@ -114,6 +183,12 @@ type Info struct {
 	Size        int64     // layer size in bytes
 	FetchedSize int64     // layer fetched size in bytes
 	ReadTime    time.Time // last time the layer was read
+	// FetchStats are statistics of how the contents of the layer were read.
+	FetchStats spanmanager.FetchStats
+	// CachedSize is the number of bytes of the layer held in the span cache.
+	CachedSize int64
+	// SpanSize is the uncompressed size of the spans the layer is fetched and cached in.
+	SpanSize int64
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -130,10 +205,24 @@ type Resolver struct {
 	artifactStore     content.Storage
 	overlayOpaqueType OverlayOpaqueType
 	bgFetcher         *backgroundfetcher.BackgroundFetcher
+	fetchScheduler    *spanmanager.FetchScheduler
+	decompressPool    *spanmanager.DecompressPool
+	readahead         spanmanager.SequentialReadahead
+	usageMeter        func(layerDigest digest.Digest, namespace string) spanmanager.UsageMeter
+	spanPeers         spanmanager.SpanPeers
+	spanRegistry      *spanmanager.SpanRegistry
+	faults            *chaos.Injector
+
+	// caches are the caches of the layers resolved without a namespace, or for all namespaces
+	// if they share their caches.
+	caches *namespaceCaches
+	// namespaceCaches are the caches of the layers resolved for each isolated namespace.
+	namespaceCaches   map[string]*namespaceCaches
+	namespaceCachesMu sync.Mutex
 }
 
 // NewResolver returns a new layer resolver.
-func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remote.Handler,
+func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remote.Handler, blobSources []remote.BlobSource,
 	metadataStore metadata.Store, artifactStore content.Storage, overlayOpaqueType OverlayOpaqueType, bgFetcher *backgroundfetcher.BackgroundFetcher) (*Resolver, error) {
 	resolveResultEntry := cfg.ResolveResultEntry
 	if resolveResultEntry == 0 {
@@ -146,29 +235,61 @@ func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remo
 	layerCache := lrucache.New(resolveResultEntry)
 	layerCache.OnEvicted = func(key string, value interface{}) {
 		if err := value.(*layer).close(); err != nil {
-			logrus.WithField("key", key).WithError(err).Warnf("failed to clean up layer")
+			logrus.WithField("src", key).WithError(err).Warnf("failed to clean up layer")
 			return
 		}
-		logrus.WithField("key", key).Debugf("cleaned up layer")
+		logrus.WithField("src", key).Debugf("cleaned up layer")
 	}
 
 	// blobCache caches resolved blobs for future use.
 	blobCache := lrucache.New(resolveResultEntry)
 	blobCache.OnEvicted = func(key string, value interface{}) {
 		if err := value.(remote.Blob).Close(); err != nil {
-			logrus.WithField("key", key).WithError(err).Warnf("failed to clean up blob")
+			logrus.WithField("src", key).WithError(err).Warnf("failed to clean up blob")
 			return
 		}
-		logrus.WithField("key", key).Debugf("cleaned up blob")
+		logrus.WithField("src", key).Debugf("cleaned up blob")
 	}
 
 	if err := os.MkdirAll(root, 0700); err != nil {
 		return nil, err
 	}
 
+	// fetchScheduler is shared by all layers so that on-demand reads of executables
+	// are not stuck behind data reads and background fetches of other layers.
+	maxConcurrentSpanFetches := cfg.BlobConfig.MaxConcurrentSpanFetches
+	if maxConcurrentSpanFetches == 0 {
+		maxConcurrentSpanFetches = defaultMaxConcurrentSpanFetches
+	}
+
+	maxDecompressWorkers := cfg.BlobConfig.MaxDecompressWorkers
+	if maxDecompressWorkers == 0 {
+		maxDecompressWorkers = runtime.NumCPU()
+	}
+
+	caches, err := newNamespaceCaches(filepath.Join(root, "spancache"), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	faults, err := chaos.New(cfg.FaultInjectionConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fault injection config: %w", err)
+	}
+
+	// Background downloads of blobs are kept with the other data of the snapshotter rather than
+	// in $TMPDIR, which may be a small tmpfs.
+	downloadDir := filepath.Join(root, "downloads")
+	if err := os.MkdirAll(downloadDir, 0700); err != nil {
+		return nil, err
+	}
+	blobResolver := remote.NewResolver(cfg.BlobConfig, resolveHandlers, blobSources)
+	blobResolver.SetOffline(cfg.Offline)
+	blobResolver.SetDownloadDir(downloadDir)
+
 	return &Resolver{
 		rootDir:           root,
-		resolver:          remote.NewResolver(cfg.BlobConfig, resolveHandlers),
+		resolver:          blobResolver,
 		layerCache:        layerCache,
 		blobCache:         blobCache,
 		config:            cfg,
@@ -177,14 +298,81 @@ func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remo
 		artifactStore:     artifactStore,
 		overlayOpaqueType: overlayOpaqueType,
 		bgFetcher:         bgFetcher,
+		fetchScheduler:    spanmanager.NewFairFetchScheduler(maxConcurrentSpanFetches, cfg.BlobConfig.MaxConcurrentSpanFetchesPerLayer),
+		decompressPool:    spanmanager.NewDecompressPool(maxDecompressWorkers),
+		readahead:         sequentialReadahead(cfg.BlobConfig),
+		caches:            caches,
+		faults:            faults,
+		namespaceCaches:   make(map[string]*namespaceCaches),
 	}, nil
 }
 
+// sequentialReadahead returns the read-ahead of sequentially read files configured in cfg.
+func sequentialReadahead(cfg config.BlobConfig) spanmanager.SequentialReadahead {
+	if cfg.SequentialReadaheadMinBytes < 0 {
+		return spanmanager.SequentialReadahead{}
+	}
+	s := spanmanager.SequentialReadahead{
+		MinWindow: cfg.SequentialReadaheadMinBytes,
+		MaxWindow: cfg.SequentialReadaheadMaxBytes,
+	}
+	if s.MinWindow == 0 {
+		s.MinWindow = defaultSequentialReadaheadMinBytes
+	}
+	if s.MaxWindow == 0 {
+		s.MaxWindow = defaultSequentialReadaheadMaxBytes
+	}
+	return s
+}
+
+// persistSpans returns whether the span caches survive snapshotter restarts.
+// Spans are never persisted in memory caches.
+func persistSpans(cfg config.Config) bool {
+	return cfg.DirectoryCacheConfig.PersistSpans && cfg.FSCacheType != memoryCacheType
+}
+
+// LastFetch returns the outcome of the last fetch of a region of any layer blob.
+func (r *Resolver) LastFetch() remote.FetchStatus {
+	return r.resolver.LastFetch()
+}
+
+// SetUsageMeter sets a function returning the meter accounting the usage of the spans of the
+// layer `layerDigest` resolved for `namespace`, or "" if the layer is shared by all namespaces,
+// e.g. to enforce quotas. It must be called before layers are resolved.
+func (r *Resolver) SetUsageMeter(meter func(layerDigest digest.Digest, namespace string) spanmanager.UsageMeter) {
+	r.usageMeter = meter
+}
+
+// SetPeerCache makes the layers resolved from now on fetch spans from `peers` before the
+// remote, if it's not nil, and register their cached spans in `registry` to serve them to
+// peers, if it's not nil. It must be called before layers are resolved.
+func (r *Resolver) SetPeerCache(peers spanmanager.SpanPeers, registry *spanmanager.SpanRegistry) {
+	r.spanPeers = peers
+	r.spanRegistry = registry
+}
+
+// SetBlobConfig updates the blob config used for layers resolved from now on.
+func (r *Resolver) SetBlobConfig(cfg config.BlobConfig) {
+	r.resolver.SetBlobConfig(cfg)
+}
+
 func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
 	if cacheType == memoryCacheType {
 		return cache.NewMemoryCache(), nil
 	}
 
+	// create a cache on an unique directory
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	cachePath, err := os.MkdirTemp(root, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize directory cache: %w", err)
+	}
+	return newDirectoryCache(cachePath, cfg, false)
+}
+
+func newDirectoryCache(cachePath string, cfg config.Config, persistent bool) (cache.BlobCache, error) {
 	dcc := cfg.DirectoryCacheConfig
 	maxDataEntry := dcc.MaxLRUCacheEntry
 	if maxDataEntry == 0 {
@@ -208,36 +396,36 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 	fCache.OnEvicted = func(key string, value interface{}) {
 		value.(*os.File).Close()
 	}
-	// create a cache on an unique directory
-	if err := os.MkdirAll(root, 0700); err != nil {
-		return nil, err
-	}
-	cachePath, err := os.MkdirTemp(root, "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize directory cache: %w", err)
-	}
 	return cache.NewDirectoryCache(
 		cachePath,
 		cache.DirectoryCacheConfig{
-			SyncAdd:   dcc.SyncAdd,
-			DataCache: dCache,
-			FdCache:   fCache,
-			BufPool:   bufPool,
-			Direct:    dcc.Direct,
+			SyncAdd:    dcc.SyncAdd,
+			DataCache:  dCache,
+			FdCache:    fCache,
+			BufPool:    bufPool,
+			Direct:     dcc.Direct,
+			Mmap:       dcc.Mmap,
+			Persistent: persistent,
 		},
 	)
 }
 
 // Resolve resolves a layer based on the passed layer blob information.
-func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc, sociDesc ocispec.Descriptor, opCounter *FuseOperationCounter, metadataOpts ...metadata.Option) (_ Layer, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+// bgFetchPriority is the priority of the layer in the background fetcher (see backgroundfetcher.PolicyLayerPriority).
+func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc, sociDesc ocispec.Descriptor, opCounter *FuseOperationCounter, bgFetchPriority int, metadataOpts ...metadata.Option) (_ Layer, retErr error) {
+	ns := r.namespace(ctx)
+	name := cacheKey(ns, refspec, desc.Digest)
+	caches, err := r.cachesOf(ns)
+	if err != nil {
+		return nil, err
+	}
 
 	// Wait if resolving this layer is already running. The result
 	// can hopefully get from the LRU cache.
 	r.resolveLock.Lock(name)
 	defer r.resolveLock.Unlock(name)
 
-	ctx = log.WithLogger(ctx, log.G(ctx).WithField("src", name))
+	ctx = logutil.WithLayer(logutil.WithImage(ctx, refspec.String()), desc.Digest)
 
 	// First, try to retrieve this layer from the underlying LRU cache.
 	r.layerCacheMu.Lock()
@@ -268,7 +456,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		}
 	}()
 
-	spanCache, err := newCache(filepath.Join(r.rootDir, "spancache"), r.config.FSCacheType, r.config)
+	spanCache, err := caches.spanCache(desc.Digest, sociDesc.Digest, r.config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create span manager cache: %w", err)
 	}
@@ -291,7 +479,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 
 	if err != nil {
 		// for now error out and let container runtime handle the layer download
-		return nil, fmt.Errorf("cannot get ztoc; download and unpack this layer in container runtime for now: %w", err)
+		return nil, &invalidZtocError{err: err}
 	}
 
 	if ztoc == nil {
@@ -302,10 +490,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	}
 
 	// log ztoc info
-	log.G(context.Background()).WithFields(logrus.Fields{
-		"layer_sha":      desc.Digest,
-		"files_in_layer": len(ztoc.FileMetadata),
-	}).Debugf("[Resolver.Resolve] downloaded layer ZTOC")
+	log.G(ctx).WithField("files_in_layer", len(ztoc.FileMetadata)).Debugf("[Resolver.Resolve] downloaded layer ZTOC")
 	// continue with resolving the layer presuming we handle ZTOC
 	// ztoc will belong to a layer
 
@@ -326,12 +511,41 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	if err != nil {
 		return nil, err
 	}
-	log.G(ctx).Debugf("[Resolver.Resolve]Initialized metadata store for layer sha=%v", desc.Digest)
+	log.G(ctx).Debugf("[Resolver.Resolve]Initialized metadata store")
 
-	spanManager := spanmanager.New(ztoc, sr, spanCache, r.config.BlobConfig.MaxSpanVerificationRetries, cache.Direct())
+	spanOpts := []spanmanager.Option{
+		spanmanager.WithCacheOptions(cache.Direct()),
+		spanmanager.WithLayerDigest(desc.Digest),
+		spanmanager.WithNamespace(ns),
+		spanmanager.WithFetchScheduler(r.fetchScheduler),
+		spanmanager.WithDecompressPool(r.decompressPool),
+		spanmanager.WithSharedFetches(caches.sharedFetches),
+		spanmanager.WithReadTuning(readTuning(ctx, sociDesc)),
+		spanmanager.WithSequentialReadahead(r.readahead),
+	}
+	if r.spanPeers != nil {
+		spanOpts = append(spanOpts, spanmanager.WithPeers(r.spanPeers))
+	}
+	if r.usageMeter != nil {
+		spanOpts = append(spanOpts, spanmanager.WithUsageMeter(r.usageMeter(desc.Digest, ns)))
+	}
+	if caches.spanIndex != nil {
+		spanOpts = append(spanOpts, spanmanager.WithPersistentIndex(caches.spanIndex, desc.Digest, sociDesc.Digest))
+	}
+	spanManager := spanmanager.New(ztoc, sr, spanCache, r.config.BlobConfig.MaxSpanVerificationRetries, spanOpts...)
+	if r.spanRegistry != nil {
+		spanManager.SetSpanRegistry(r.spanRegistry)
+	}
+	if caches.spanIndex != nil {
+		go func() {
+			if err := spanManager.RestoreCachedSpans(); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to restore cached spans")
+			}
+		}()
+	}
 	var bgLayerResolver backgroundfetcher.Resolver
 	if r.bgFetcher != nil {
-		bgLayerResolver = backgroundfetcher.NewSequentialResolver(desc.Digest, spanManager)
+		bgLayerResolver = backgroundfetcher.NewSequentialResolver(desc.Digest, spanManager, backgroundfetcher.WithPriority(bgFetchPriority))
 		r.bgFetcher.Add(bgLayerResolver)
 	}
 	vr, err := reader.NewReader(meta, desc.Digest, spanManager)
@@ -340,7 +554,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	}
 
 	// Combine layer information together and cache it.
-	l := newLayer(r, desc, blobR, vr, bgLayerResolver, opCounter)
+	l := newLayer(r, desc, blobR, vr, spanManager, bgLayerResolver, opCounter)
 	r.layerCacheMu.Lock()
 	cachedL, done2, added := r.layerCache.Add(name, l)
 	r.layerCacheMu.Unlock()
@@ -352,9 +566,30 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	return &layerRef{cachedL.(*layer), done2}, nil
 }
 
+// readTuning returns how the spans of the layer of `sociDesc` are fetched for reads,
+// from the readahead and coalescing annotations of its ztoc in the SOCI index.
+func readTuning(ctx context.Context, sociDesc ocispec.Descriptor) spanmanager.ReadTuning {
+	size := func(annotation string) int64 {
+		v, ok := sociDesc.Annotations[annotation]
+		if !ok {
+			return 0
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.G(ctx).WithField("annotation", annotation).WithField("value", v).Warn("ignoring invalid size annotation")
+			return 0
+		}
+		return n
+	}
+	return spanmanager.ReadTuning{
+		ReadaheadSize: size(soci.IndexAnnotationReadaheadSize),
+		CoalesceSize:  size(soci.IndexAnnotationCoalesceSize),
+	}
+}
+
 // resolveBlob resolves a blob based on the passed layer blob information.
 func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ *blobRef, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+	name := cacheKey(r.namespace(ctx), refspec, desc.Digest)
 
 	// Try to retrieve the blob from the underlying LRU cache.
 	r.blobCacheMu.Lock()
@@ -400,6 +635,7 @@ func newLayer(
 	desc ocispec.Descriptor,
 	blob *blobRef,
 	vr *reader.VerifiableReader,
+	spanManager *spanmanager.SpanManager,
 	bgResolver backgroundfetcher.Resolver,
 	opCounter *FuseOperationCounter,
 ) *layer {
@@ -408,6 +644,7 @@ func newLayer(
 		desc:                 desc,
 		blob:                 blob,
 		verifiableReader:     vr,
+		spanManager:          spanManager,
 		bgResolver:           bgResolver,
 		fuseOperationCounter: opCounter,
 	}
@@ -418,6 +655,7 @@ type layer struct {
 	desc             ocispec.Descriptor
 	blob             *blobRef
 	verifiableReader *reader.VerifiableReader
+	spanManager      *spanmanager.SpanManager
 
 	bgResolver backgroundfetcher.Resolver
 
@@ -439,6 +677,9 @@ func (l *layer) Info() Info {
 		Size:        l.blob.Size(),
 		FetchedSize: l.blob.FetchedSize(),
 		ReadTime:    readTime,
+		FetchStats:  l.spanManager.FetchStats(),
+		CachedSize:  l.spanManager.CachedSize(),
+		SpanSize:    l.spanManager.SpanSize(),
 	}
 }
 
@@ -467,6 +708,94 @@ func (l *layer) Verify(tocDigest digest.Digest) (err error) {
 	return
 }
 
+func (l *layer) UncompressedArchive() (io.ReaderAt, int64) {
+	return l.spanManager, l.spanManager.UncompressedArchiveSize()
+}
+
+func (l *layer) TOC() ztoc.TOC {
+	return l.spanManager.TOC()
+}
+
+func (l *layer) ExportSpans(tw *tar.Writer, dir string) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	return l.spanManager.ExportSpans(tw, dir)
+}
+
+func (l *layer) ImportSpan(name string, r io.Reader) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	return l.spanManager.ImportSpan(name, r)
+}
+
+func (l *layer) Demote(mode spanmanager.DemoteMode) (int, error) {
+	if l.isClosed() {
+		return 0, fmt.Errorf("layer is already closed")
+	}
+	return l.spanManager.Demote(mode)
+}
+
+func (l *layer) SetPinned(pinned bool) {
+	l.spanManager.SetPinned(pinned)
+}
+
+func (l *layer) Compact(minFiles int) (int, error) {
+	if l.isClosed() {
+		return 0, fmt.Errorf("layer is already closed")
+	}
+	return l.spanManager.Compact(minFiles)
+}
+
+func (l *layer) Prefetch(percent int) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	return l.spanManager.Prefetch(percent)
+}
+
+func (l *layer) PrefetchFiles(paths []string) (int, error) {
+	if l.isClosed() {
+		return 0, fmt.Errorf("layer is already closed")
+	}
+	md := l.verifiableReader.Metadata()
+	var ranges []spanmanager.ByteRange
+	for _, p := range paths {
+		id, attr, err := lookupPath(md, p)
+		if err != nil || !attr.Mode.IsRegular() || attr.Size == 0 {
+			continue
+		}
+		f, err := md.OpenFile(id)
+		if err != nil {
+			return 0, err
+		}
+		start := f.GetUncompressedOffset()
+		ranges = append(ranges, spanmanager.ByteRange{Start: start, End: start + f.GetUncompressedFileSize()})
+	}
+	if err := l.spanManager.PrefetchRanges(ranges); err != nil {
+		return 0, fmt.Errorf("failed to prefetch files: %w", err)
+	}
+	return len(ranges), nil
+}
+
+// lookupPath returns the node of the file at `p` in the layer of `md`.
+func lookupPath(md metadata.Reader, p string) (uint32, metadata.Attr, error) {
+	id := md.RootID()
+	var attr metadata.Attr
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		var err error
+		id, attr, err = md.GetChild(id, name)
+		if err != nil {
+			return 0, attr, err
+		}
+	}
+	return id, attr, nil
+}
+
 func (l *layer) SkipVerify() {
 	if l.r != nil {
 		return
@@ -485,7 +814,7 @@ func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.resolver.config.LogFuseOperations, l.fuseOperationCounter)
+	return newNode(l.desc.Digest, l.r, l.blob, l.spanManager, baseInode, l.resolver.overlayOpaqueType, l.resolver.config.LogFuseOperations, l.resolver.config.MaxConcurrentReads, l.fuseOperationCounter, l.resolver.faults)
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
@@ -502,6 +831,8 @@ func (l *layer) close() error {
 	if l.bgResolver != nil {
 		l.bgResolver.Close()
 	}
+	// The span manager must not serve the spans of a closed layer to peers.
+	l.spanManager.SetSpanRegistry(nil)
 	defer l.blob.done() // Close reader first, then close the blob
 	l.verifiableReader.Close()
 	if l.r != nil {
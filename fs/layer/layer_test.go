@@ -39,17 +39,104 @@
 package layer
 
 import (
+	"compress/gzip"
+	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/fs/reader"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestLayer(t *testing.T) {
 	testNodeRead(t, metadata.NewTempDbStore)
 	testExistence(t, metadata.NewTempDbStore)
+	testTarConformance(t, metadata.NewTempDbStore)
+}
+
+func TestFuseErrnoCount(t *testing.T) {
+	commonmetrics.Register()
+	imgDigest := digest.FromString("TestFuseErrnoCount")
+
+	ztoc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{testutil.File("foo", "bar")}, gzip.DefaultCompression, 64)
+	if err != nil {
+		t.Fatalf("failed to build sample ztoc: %v", err)
+	}
+	mr, err := metadata.NewTempDbStore(sr, ztoc.TOC)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	defer mr.Close()
+	vr, err := reader.NewReader(mr, digest.FromString(""), spanmanager.New(ztoc, sr, cache.NewMemoryCache(), 0))
+	if err != nil {
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	r := vr.GetReader()
+	defer r.Close()
+	root, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, nil, 100, OverlayOpaqueAll, false, 0, NewFuseOperationCounter(imgDigest, 0), nil)
+	if err != nil {
+		t.Fatalf("failed to get root node: %v", err)
+	}
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	n := root.(*node)
+
+	var eo fuse.EntryOut
+	for i := 0; i < 2; i++ {
+		if _, errno := n.Lookup(context.Background(), "missing", &eo); errno != syscall.ENOENT {
+			t.Fatalf("unexpected errno of lookup: got %v, want %v", errno, syscall.ENOENT)
+		}
+	}
+	if _, errno := n.Lookup(context.Background(), "foo", &eo); errno != 0 {
+		t.Fatalf("failed to lookup foo: %v", errno)
+	}
+
+	if got := fuseErrnoCount(t, fuseOpLookup, "ENOENT", imgDigest); got != 2 {
+		t.Fatalf("unexpected count of ENOENT: got %v, want 2", got)
+	}
+	if got := fuseErrnoCount(t, fuseOpLookup, "EIO", imgDigest); got != 0 {
+		t.Fatalf("unexpected count of EIO: got %v, want 0", got)
+	}
+}
+
+// fuseErrnoCount returns the count of errno returned from operation for the image.
+func fuseErrnoCount(t *testing.T, operation, errno string, image digest.Digest) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	want := map[string]string{"operation_type": operation, "errno": errno, "image": image.String()}
+	for _, mf := range mfs {
+		if mf.GetName() != "soci_fs_"+commonmetrics.FuseErrnoCountKey {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if want[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
 }
 
 func TestWaiter(t *testing.T) {
@@ -79,6 +166,42 @@ func TestWaiter(t *testing.T) {
 	}
 }
 
+func TestReadLimit(t *testing.T) {
+	ffs := &fs{reads: make(chan struct{}, 1)}
+	if !ffs.acquireRead(context.Background()) {
+		t.Fatalf("failed to acquire a free read slot")
+	}
+
+	// a read over the limit waits until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if ffs.acquireRead(ctx) {
+		t.Fatalf("read admitted over the limit")
+	}
+
+	// and is admitted once a read completes
+	admitted := make(chan bool)
+	go func() { admitted <- ffs.acquireRead(context.Background()) }()
+	ffs.releaseRead()
+	select {
+	case ok := <-admitted:
+		if !ok {
+			t.Fatalf("failed to acquire a released read slot")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the read to be admitted")
+	}
+	ffs.releaseRead()
+
+	// no limit
+	ffs = &fs{}
+	for i := 0; i < 10; i++ {
+		if !ffs.acquireRead(context.Background()) {
+			t.Fatalf("read limited without a limit")
+		}
+	}
+}
+
 func newWaiter() *waiter {
 	return &waiter{
 		completionCond: sync.NewCond(&sync.Mutex{}),
@@ -126,3 +249,102 @@ func (w *waiter) wait(timeout time.Duration) error {
 		return nil
 	}
 }
+
+func TestResolverNamespaceCaches(t *testing.T) {
+	cfg := config.Config{}
+	cfg.DirectoryCacheConfig.PersistSpans = true
+	root := t.TempDir()
+	shared, err := newNamespaceCaches(filepath.Join(root, "spancache"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Resolver{rootDir: root, config: cfg, caches: shared, namespaceCaches: make(map[string]*namespaceCaches)}
+	refspec, err := reference.Parse("registry.example.com/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromString("layer")
+
+	ctx := context.Background()
+	tenant1, tenant2 := namespaces.WithNamespace(ctx, "tenant1"), namespaces.WithNamespace(ctx, "tenant2")
+	caches := func(ctx context.Context) *namespaceCaches {
+		c, err := r.cachesOf(r.namespace(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if caches(ctx) != shared {
+		t.Fatalf("layers without a namespace should use the shared caches")
+	}
+	c1 := caches(tenant1)
+	if c1 == shared || c1 == caches(tenant2) || caches(tenant1) != c1 {
+		t.Fatalf("each namespace should have caches of its own")
+	}
+	if c1.spanIndex == nil || !strings.HasPrefix(c1.spanCacheRoot, filepath.Join(root, "namespaces", "tenant1")) {
+		t.Fatalf("unexpected span cache of namespace: %q", c1.spanCacheRoot)
+	}
+	if cacheKey(r.namespace(tenant1), refspec, dgst) == cacheKey(r.namespace(tenant2), refspec, dgst) {
+		t.Fatalf("layers of different namespaces should be cached apart")
+	}
+	if _, err := r.cachesOf("../escape"); err == nil {
+		t.Fatalf("created caches of an invalid namespace")
+	}
+
+	r.config.ShareNamespaces = true
+	if caches(tenant1) != shared || cacheKey(r.namespace(tenant1), refspec, dgst) != cacheKey(r.namespace(tenant2), refspec, dgst) {
+		t.Fatalf("namespaces should share the caches")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close resolver: %v", err)
+	}
+}
+
+func TestPersistentSpanCacheShared(t *testing.T) {
+	cfg := config.Config{}
+	cfg.DirectoryCacheConfig.PersistSpans = true
+	caches, err := newNamespaceCaches(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caches.close()
+	layerDigest, ztocDigest := digest.FromString("layer"), digest.FromString("ztoc")
+
+	c1, err := caches.spanCache(layerDigest, ztocDigest, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := c1.Add("span")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another layer with the same ztoc, e.g. of another image, shares the cache rather than
+	// discarding the write in progress.
+	c2, err := caches.spanCache(layerDigest, ztocDigest, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit write in progress: %v", err)
+	}
+	w.Close()
+	if err := c1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c2.Get("span")
+	if err != nil {
+		t.Fatalf("span isn't cached for the other layer: %v", err)
+	}
+	r.Close()
+	if err := c2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(caches.persistentCaches) != 0 {
+		t.Fatalf("cache wasn't released once closed by all layers")
+	}
+}
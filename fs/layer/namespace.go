@@ -0,0 +1,205 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/go-digest"
+)
+
+// namespaceCaches are the caches of the layers resolved for a containerd namespace.
+type namespaceCaches struct {
+	// spanCacheRoot is the directory of the span caches of the layers.
+	spanCacheRoot string
+	sharedFetches *spanmanager.SharedFetches
+	// spanIndex records the cached spans if the span cache is persistent.
+	spanIndex *spanmanager.PersistentIndex
+
+	// persistentCaches are the persistent span caches in use by their directory, which are
+	// shared by the layers with the same ztoc, e.g. of several images, since opening a
+	// persistent cache discards the writes in progress in its directory.
+	persistentCaches   map[string]*persistentSpanCache
+	persistentCachesMu sync.Mutex
+}
+
+func newNamespaceCaches(spanCacheRoot string, cfg config.Config) (*namespaceCaches, error) {
+	c := &namespaceCaches{
+		spanCacheRoot:    spanCacheRoot,
+		sharedFetches:    spanmanager.NewSharedFetches(),
+		persistentCaches: make(map[string]*persistentSpanCache),
+	}
+	if persistSpans(cfg) {
+		if err := os.MkdirAll(spanCacheRoot, 0700); err != nil {
+			return nil, err
+		}
+		var err error
+		c.spanIndex, err = spanmanager.OpenPersistentIndex(filepath.Join(spanCacheRoot, "index.db"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// spanCache returns the cache of the spans of the ztoc `ztocDigest` of the layer `layerDigest`.
+// If spans are persisted, the cache is stored on a directory dedicated to the ztoc, which is kept
+// when the cache is closed, so that the spans can be restored after a restart. The cache of a
+// directory is shared by the layers using it, and closed once all of them close it.
+func (c *namespaceCaches) spanCache(layerDigest, ztocDigest digest.Digest, cfg config.Config) (cache.BlobCache, error) {
+	if !persistSpans(cfg) {
+		return newCache(c.spanCacheRoot, cfg.FSCacheType, cfg)
+	}
+	cachePath := filepath.Join(c.spanCacheRoot, "persistent", layerDigest.Encoded(), ztocDigest.Encoded())
+	c.persistentCachesMu.Lock()
+	defer c.persistentCachesMu.Unlock()
+	pc, ok := c.persistentCaches[cachePath]
+	if !ok {
+		if err := os.MkdirAll(cachePath, 0700); err != nil {
+			return nil, err
+		}
+		dc, err := newDirectoryCache(cachePath, cfg, true)
+		if err != nil {
+			return nil, err
+		}
+		pc = &persistentSpanCache{BlobCache: dc}
+		c.persistentCaches[cachePath] = pc
+	}
+	pc.refs++
+	return &persistentSpanCacheRef{persistentSpanCache: pc, release: func() error {
+		c.persistentCachesMu.Lock()
+		defer c.persistentCachesMu.Unlock()
+		pc.refs--
+		if pc.refs > 0 {
+			return nil
+		}
+		delete(c.persistentCaches, cachePath)
+		return pc.BlobCache.Close()
+	}}, nil
+}
+
+// close closes the persistent index of the spans.
+func (c *namespaceCaches) close() error {
+	if c.spanIndex == nil {
+		return nil
+	}
+	return c.spanIndex.Close()
+}
+
+// persistentSpanCache is a persistent span cache shared by the layers using its directory.
+type persistentSpanCache struct {
+	cache.BlobCache
+	refs int // guarded by namespaceCaches.persistentCachesMu
+}
+
+// persistentSpanCacheRef is the reference of a layer to a persistentSpanCache.
+type persistentSpanCacheRef struct {
+	*persistentSpanCache
+	release   func() error
+	closeOnce sync.Once
+}
+
+func (r *persistentSpanCacheRef) Close() (err error) {
+	r.closeOnce.Do(func() {
+		err = r.release()
+	})
+	return err
+}
+
+func (r *persistentSpanCacheRef) Remove(key string) error {
+	if remover, ok := r.BlobCache.(cache.Remover); ok {
+		return remover.Remove(key)
+	}
+	return nil
+}
+
+func (r *persistentSpanCacheRef) Compact(minFiles int) (int, error) {
+	if compactor, ok := r.BlobCache.(cache.Compactor); ok {
+		return compactor.Compact(minFiles)
+	}
+	return 0, nil
+}
+
+// Close closes the caches of the resolver which outlive its layers, i.e. the persistent indices
+// of the spans. It must be called once the layers are closed, when the snapshotter shuts down.
+func (r *Resolver) Close() error {
+	r.decompressPool.Close()
+	var errs error
+	if err := r.caches.close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	r.namespaceCachesMu.Lock()
+	defer r.namespaceCachesMu.Unlock()
+	for ns, c := range r.namespaceCaches {
+		if err := c.close(); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed to close caches of namespace %q: %w", ns, err))
+		}
+	}
+	return errs
+}
+
+// namespace returns the containerd namespace of ctx if the caches of namespaces are isolated,
+// or "" if all namespaces share them.
+func (r *Resolver) namespace(ctx context.Context) string {
+	if r.config.ShareNamespaces {
+		return ""
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	return ns
+}
+
+// cachesOf returns the caches of the namespace `ns`, which are created on first use.
+func (r *Resolver) cachesOf(ns string) (*namespaceCaches, error) {
+	if ns == "" {
+		return r.caches, nil
+	}
+	r.namespaceCachesMu.Lock()
+	defer r.namespaceCachesMu.Unlock()
+	if c, ok := r.namespaceCaches[ns]; ok {
+		return c, nil
+	}
+	// The namespace names a directory, so it must not escape the root.
+	if err := identifiers.Validate(ns); err != nil {
+		return nil, fmt.Errorf("invalid namespace: %w", err)
+	}
+	c, err := newNamespaceCaches(filepath.Join(r.rootDir, "namespaces", ns, "spancache"), r.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create caches of namespace %q: %w", ns, err)
+	}
+	r.namespaceCaches[ns] = c
+	return c, nil
+}
+
+// cacheKey is the key of the layer or blob `dgst` of the image `refspec` in the caches of the resolver.
+func cacheKey(ns string, refspec reference.Spec, dgst digest.Digest) string {
+	key := refspec.String() + "/" + dgst.String()
+	if ns != "" {
+		key = ns + "/" + key
+	}
+	return key
+}
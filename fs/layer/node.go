@@ -47,15 +47,18 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/fs/chaos"
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/reader"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/containerd/containerd/log"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
@@ -73,6 +76,10 @@ const (
 	stateDirName      = ".soci-snapshotter"
 	statFileMode      = syscall.S_IFREG | 0400 // -r--------
 	stateDirMode      = syscall.S_IFDIR | 0500 // dr-x------
+
+	// fmodeExec is the kernel's __FMODE_EXEC flag. FUSE passes it through in the
+	// open flags when a file is opened by execve.
+	fmodeExec = 0x20
 )
 
 // OverlayOpaqueType enum possible types.
@@ -91,6 +98,11 @@ var opaqueXattrs = map[OverlayOpaqueType][]string{
 	OverlayOpaqueUser:    {"user.overlay.opaque"},
 }
 
+// Xattrs returns the extended attributes which mark opaque directories.
+func (t OverlayOpaqueType) Xattrs() []string {
+	return opaqueXattrs[t]
+}
+
 // fuse operations.
 const (
 	fuseOpGetattr         = "node.Getattr"
@@ -190,9 +202,23 @@ func incFuseOpFailureMetric(operationName string, layer digest.Digest) {
 	commonmetrics.IncOperationCount(metric, layer)
 }
 
+// countErrno counts a non-zero errno returned to the application from the FUSE operation operationName,
+// so that errors seen by containers (e.g. EIO from lazily fetched files) can be told apart from daemon-internal ones.
+func (fs *fs) countErrno(operationName string, errno syscall.Errno) {
+	if errno == 0 {
+		return
+	}
+	name := unix.ErrnoName(errno)
+	if name == "" {
+		name = strconv.Itoa(int(errno))
+	}
+	commonmetrics.IncFuseErrnoCount(operationName, name, fs.imageDigest)
+}
+
 // logFSOperations may cause sensitive information to be emitted to logs
 // e.g. filenames and paths within an image
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, logFSOperations bool, opCounter *FuseOperationCounter) (fusefs.InodeEmbedder, error) {
+// maxReads limits the number of reads served by the node at the same time; 0 means no limit.
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, spanManager *spanmanager.SpanManager, baseInode uint32, opaque OverlayOpaqueType, logFSOperations bool, maxReads int, opCounter *FuseOperationCounter, faults *chaos.Injector) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
@@ -202,6 +228,10 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 	if !ok {
 		return nil, fmt.Errorf("unknown overlay opaque type")
 	}
+	var imageDigest digest.Digest
+	if opCounter != nil {
+		imageDigest = opCounter.imageDigest
+	}
 	ffs := &fs{
 		r:                r,
 		layerDigest:      layerDgst,
@@ -210,8 +240,13 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 		opaqueXattrs:     opq,
 		logFSOperations:  logFSOperations,
 		operationCounter: opCounter,
+		imageDigest:      imageDigest,
+		faults:           faults,
+	}
+	if maxReads > 0 {
+		ffs.reads = make(chan struct{}, maxReads)
 	}
-	ffs.s = ffs.newState(layerDgst, blob)
+	ffs.s = ffs.newState(layerDgst, blob, spanManager)
 	return &node{
 		id:   rootID,
 		attr: rootAttr,
@@ -229,6 +264,38 @@ type fs struct {
 	opaqueXattrs     []string
 	logFSOperations  bool
 	operationCounter *FuseOperationCounter
+	// imageDigest is the digest of the image the layer is mounted for, if known.
+	imageDigest digest.Digest
+	// faults injects faults into the operations of the layer in tests.
+	faults *chaos.Injector
+	// reads limits the number of reads served at the same time, so that the random reads of a
+	// single container can't spawn unbounded fetches. nil means no limit.
+	reads chan struct{}
+}
+
+// acquireRead blocks until a read may be served, or ctx is done.
+func (fs *fs) acquireRead(ctx context.Context) bool {
+	if fs.reads == nil {
+		return true
+	}
+	select {
+	case fs.reads <- struct{}{}:
+		return true
+	default:
+	}
+	commonmetrics.IncOperationCount(commonmetrics.ThrottledReadCount, fs.layerDigest)
+	select {
+	case fs.reads <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (fs *fs) releaseRead() {
+	if fs.reads != nil {
+		<-fs.reads
+	}
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -272,22 +339,54 @@ func (n *node) isRootNode() bool {
 	return n.id == n.fs.rootID
 }
 
+// isOpaque returns whether the node is an opaque directory. Directories are marked as opaque by an
+// opaque whiteout, or by an overlayfs opaque xattr of any type, e.g. in layers built from the upper
+// directory of an overlayfs mount.
 func (n *node) isOpaque() bool {
+	if !n.attr.Mode.IsDir() {
+		return false
+	}
+	for _, k := range opaqueXattrs[OverlayOpaqueAll] {
+		if string(n.attr.Xattrs[k]) == opaqueXattrValue {
+			return true
+		}
+	}
 	if _, _, err := n.fs.r.Metadata().GetChild(n.id, whiteoutOpaqueDir); err == nil {
 		return true
 	}
 	return false
 }
 
+// xattrs returns the extended attributes of the node, including the opaque xattrs of the
+// filesystem if the node is an opaque directory.
+func (n *node) xattrs() map[string][]byte {
+	if !n.isOpaque() {
+		return n.attr.Xattrs
+	}
+	xattrs := make(map[string][]byte, len(n.attr.Xattrs)+len(n.fs.opaqueXattrs))
+	for k, v := range n.attr.Xattrs {
+		xattrs[k] = v
+	}
+	for _, k := range n.fs.opaqueXattrs {
+		// This node is an opaque directory so give overlayfs-compliant indicator.
+		xattrs[k] = []byte(opaqueXattrValue)
+	}
+	return xattrs
+}
+
 var _ = (fusefs.InodeEmbedder)((*node)(nil))
 
 var _ = (fusefs.NodeReaddirer)((*node)(nil))
 
-func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+func (n *node) Readdir(ctx context.Context) (_ fusefs.DirStream, errno syscall.Errno) {
 	n.logOperation(ctx, fuseOpReaddir)
+	defer func() { n.fs.countErrno(fuseOpReaddir, errno) }()
 	if n.fs.operationCounter != nil {
 		n.fs.operationCounter.Inc(fuseOpReaddir)
 	}
+	if errno = n.fs.faults.FuseError(); errno != 0 {
+		return nil, errno
+	}
 	ents, errno := n.readdir()
 	if errno != 0 {
 		return nil, errno
@@ -374,11 +473,15 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 
 var _ = (fusefs.NodeLookuper)((*node)(nil))
 
-func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (_ *fusefs.Inode, errno syscall.Errno) {
 	n.logOperation(ctx, fuseOpLookup)
+	defer func() { n.fs.countErrno(fuseOpLookup, errno) }()
 	if n.fs.operationCounter != nil {
 		n.fs.operationCounter.Inc(fuseOpLookup)
 	}
+	if errno = n.fs.faults.FuseError(); errno != 0 {
+		return nil, errno
+	}
 
 	isRoot := n.isRootNode()
 
@@ -472,28 +575,48 @@ var _ = (fusefs.NodeOpener)((*node)(nil))
 
 func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	n.logOperation(ctx, fuseOpOpen)
+	defer func() { n.fs.countErrno(fuseOpOpen, errno) }()
 	if n.fs.operationCounter != nil {
 		n.fs.operationCounter.Inc(fuseOpOpen)
 	}
-	ra, err := n.fs.r.OpenFile(n.id)
+	if errno = n.fs.faults.FuseError(); errno != 0 {
+		return nil, 0, errno
+	}
+	var opts []reader.OpenOption
+	if n.isExecutable(flags) {
+		opts = append(opts, reader.WithPriority(spanmanager.PriorityExec))
+	}
+	ra, err := n.fs.r.OpenFile(n.id, opts...)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpOpen, n.fs.layerDigest)
 		n.fs.s.report(fmt.Errorf("%s: %v", fuseOpOpen, err))
 		return nil, 0, syscall.EIO
 	}
+	n.fs.s.statFile.touch(n.id)
 	return &file{
 		n:  n,
 		ra: ra,
 	}, fuse.FOPEN_KEEP_CACHE, 0
 }
 
+// isExecutable reports whether reads of the file are likely on the critical path
+// of process startup, i.e. the file is being exec'd or has any executable bit set
+// (which also covers shared libraries mapped by the dynamic loader).
+func (n *node) isExecutable(flags uint32) bool {
+	return flags&fmodeExec != 0 || n.attr.Mode&0111 != 0
+}
+
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
 
-func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
 	n.logOperation(ctx, fuseOpGetattr)
+	defer func() { n.fs.countErrno(fuseOpGetattr, errno) }()
 	if n.fs.operationCounter != nil {
 		n.fs.operationCounter.Inc(fuseOpGetattr)
 	}
+	if errno = n.fs.faults.FuseError(); errno != 0 {
+		return errno
+	}
 	ino, err := n.fs.inodeOfID(n.id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpGetattr, n.fs.layerDigest)
@@ -506,23 +629,16 @@ func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrO
 
 var _ = (fusefs.NodeGetxattrer)((*node)(nil))
 
-func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (_ uint32, errno syscall.Errno) {
 	n.logOperation(ctx, fuseOpGetxattr)
+	defer func() { n.fs.countErrno(fuseOpGetxattr, errno) }()
 	if n.fs.operationCounter != nil {
 		n.fs.operationCounter.Inc(fuseOpGetxattr)
 	}
-	ent := n.attr
-	opq := n.isOpaque()
-	for _, opaqueXattr := range n.fs.opaqueXattrs {
-		if attr == opaqueXattr && opq {
-			// This node is an opaque directory so give overlayfs-compliant indicator.
-			if len(dest) < len(opaqueXattrValue) {
-				return uint32(len(opaqueXattrValue)), syscall.ERANGE
-			}
-			return uint32(copy(dest, opaqueXattrValue)), 0
-		}
+	if errno = n.fs.faults.FuseError(); errno != 0 {
+		return 0, errno
 	}
-	if v, ok := ent.Xattrs[attr]; ok {
+	if v, ok := n.xattrs()[attr]; ok {
 		if len(dest) < len(v) {
 			return uint32(len(v)), syscall.ERANGE
 		}
@@ -533,21 +649,23 @@ func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 
 var _ = (fusefs.NodeListxattrer)((*node)(nil))
 
-func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+func (n *node) Listxattr(ctx context.Context, dest []byte) (_ uint32, errno syscall.Errno) {
 	n.logOperation(ctx, fuseOpListxattr)
+	defer func() { n.fs.countErrno(fuseOpListxattr, errno) }()
 	if n.fs.operationCounter != nil {
 		n.fs.operationCounter.Inc(fuseOpListxattr)
 	}
-	ent := n.attr
-	opq := n.isOpaque()
-	var attrs []byte
-	if opq {
-		// This node is an opaque directory so add overlayfs-compliant indicator.
-		for _, opaqueXattr := range n.fs.opaqueXattrs {
-			attrs = append(attrs, []byte(opaqueXattr+"\x00")...)
-		}
+	if errno = n.fs.faults.FuseError(); errno != 0 {
+		return 0, errno
+	}
+	xattrs := n.xattrs()
+	names := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		names = append(names, k)
 	}
-	for k := range ent.Xattrs {
+	sort.Strings(names)
+	var attrs []byte
+	for _, k := range names {
 		attrs = append(attrs, []byte(k+"\x00")...)
 	}
 	if len(dest) < len(attrs) {
@@ -579,11 +697,19 @@ type file struct {
 
 var _ = (fusefs.FileReader)((*file)(nil))
 
-func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+func (f *file) Read(ctx context.Context, dest []byte, off int64) (_ fuse.ReadResult, errno syscall.Errno) {
 	f.n.logOperation(ctx, fuseOpFileRead)
+	defer func() { f.n.fs.countErrno(fuseOpFileRead, errno) }()
 	if f.n.fs.operationCounter != nil {
 		f.n.fs.operationCounter.Inc(fuseOpFileRead)
 	}
+	if errno = f.n.fs.faults.FuseError(); errno != 0 {
+		return nil, errno
+	}
+	if !f.n.fs.acquireRead(ctx) {
+		return nil, syscall.EINTR
+	}
+	defer f.n.fs.releaseRead()
 	defer commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.SynchronousRead, f.n.fs.layerDigest, time.Now()) // measure time for synchronous file reads (in microseconds)
 	defer commonmetrics.IncOperationCount(commonmetrics.SynchronousReadCount, f.n.fs.layerDigest)                   // increment the counter for synchronous file reads
 	n, err := f.ra.ReadAt(dest, off)
@@ -597,11 +723,15 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
-func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) (errno syscall.Errno) {
 	f.n.logOperation(ctx, fuseOpFileGetattr)
+	defer func() { f.n.fs.countErrno(fuseOpFileGetattr, errno) }()
 	if f.n.fs.operationCounter != nil {
 		f.n.fs.operationCounter.Inc(fuseOpFileGetattr)
 	}
+	if errno = f.n.fs.faults.FuseError(); errno != 0 {
+		return errno
+	}
 	ino, err := f.n.fs.inodeOfID(f.n.id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpFileGetattr, f.n.fs.layerDigest)
@@ -622,10 +752,14 @@ type whiteout struct {
 
 var _ = (fusefs.NodeGetattrer)((*whiteout)(nil))
 
-func (w *whiteout) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+func (w *whiteout) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer func() { w.fs.countErrno(fuseOpWhiteoutGetattr, errno) }()
 	if w.fs.operationCounter != nil {
 		w.fs.operationCounter.Inc(fuseOpWhiteoutGetattr)
 	}
+	if errno = w.fs.faults.FuseError(); errno != 0 {
+		return errno
+	}
 	ino, err := w.fs.inodeOfID(w.id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpWhiteoutGetattr, w.fs.layerDigest)
@@ -645,7 +779,7 @@ func (w *whiteout) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errn
 
 // newState provides new state directory node.
 // It creates statFile at the same time to give it stable inode number.
-func (fs *fs) newState(layerDigest digest.Digest, blob remote.Blob) *state {
+func (fs *fs) newState(layerDigest digest.Digest, blob remote.Blob, spanManager *spanmanager.SpanManager) *state {
 	return &state{
 		statFile: &statFile{
 			name: layerDigest.String() + ".json",
@@ -653,8 +787,9 @@ func (fs *fs) newState(layerDigest digest.Digest, blob remote.Blob) *state {
 				Digest: layerDigest.String(),
 				Size:   blob.Size(),
 			},
-			blob: blob,
-			fs:   fs,
+			blob:        blob,
+			spanManager: spanManager,
+			fs:          fs,
 		},
 		fs: fs,
 	}
@@ -720,6 +855,12 @@ type statJSON struct {
 	Size           int64   `json:"size"`
 	FetchedSize    int64   `json:"fetchedSize"`
 	FetchedPercent float64 `json:"fetchedPercent"` // Fetched / Size * 100.0
+	// FilesTouched is the number of distinct files opened in this layer.
+	FilesTouched int64 `json:"filesTouched"`
+	// SpanCacheHits and SpanCacheMisses count on-demand span reads served from
+	// the local cache and from the registry.
+	SpanCacheHits   int64 `json:"spanCacheHits"`
+	SpanCacheMisses int64 `json:"spanCacheMisses"`
 }
 
 // statFile is a file which contain something to be reported from this layer.
@@ -728,11 +869,15 @@ type statJSON struct {
 // This file has mode "-r-------- root root".
 type statFile struct {
 	fusefs.Inode
-	name     string
-	blob     remote.Blob
-	statJSON statJSON
-	mu       sync.Mutex
-	fs       *fs
+	name        string
+	blob        remote.Blob
+	spanManager *spanmanager.SpanManager
+	statJSON    statJSON
+	mu          sync.Mutex
+	fs          *fs
+
+	touched      sync.Map // file id -> struct{}
+	filesTouched int64    // accessed atomically
 }
 
 var _ = (fusefs.NodeOpener)((*statFile)(nil))
@@ -801,9 +946,20 @@ func (sf *statFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
 	return sf.fs.statFileToAttr(uint64(len(st)), out), 0
 }
 
+// touch records that the file with the id has been opened.
+func (sf *statFile) touch(id uint32) {
+	if _, loaded := sf.touched.LoadOrStore(id, struct{}{}); !loaded {
+		atomic.AddInt64(&sf.filesTouched, 1)
+	}
+}
+
 func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 	sf.statJSON.FetchedSize = sf.blob.FetchedSize()
 	sf.statJSON.FetchedPercent = float64(sf.statJSON.FetchedSize) / float64(sf.statJSON.Size) * 100.0
+	sf.statJSON.FilesTouched = atomic.LoadInt64(&sf.filesTouched)
+	if sf.spanManager != nil {
+		sf.statJSON.SpanCacheHits, sf.statJSON.SpanCacheMisses = sf.spanManager.CacheStats()
+	}
 	j, err := json.Marshal(&sf.statJSON)
 	if err != nil {
 		return nil, err
@@ -42,12 +42,14 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"testing"
@@ -265,7 +267,7 @@ func testExistenceWithOpaque(t *testing.T, factory metadata.Store, opaque Overla
 			},
 			want: []check{
 				hasOpaque("foo/"),
-				hasNodeXattrs("foo/", "SCHILY.xattr.foo", "bar"),
+				hasNodeXattrs("foo/", "foo", "bar"),
 				fileNotExist("foo/.wh..wh..opq"),
 			},
 		},
@@ -346,6 +348,157 @@ func testExistenceWithOpaque(t *testing.T, factory metadata.Store, opaque Overla
 	}
 }
 
+func testTarConformance(t *testing.T, factory metadata.Store) {
+	for _, o := range []OverlayOpaqueType{OverlayOpaqueAll, OverlayOpaqueTrusted, OverlayOpaqueUser} {
+		testTarConformanceWithOpaque(t, factory, o)
+	}
+}
+
+// testTarConformanceWithOpaque checks that the entries of a layer are exposed as they would be
+// when the tar is unpacked natively, i.e. by containerd's archive package.
+func testTarConformanceWithOpaque(t *testing.T, factory metadata.Store, opaque OverlayOpaqueType) {
+	capability := string([]byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	longName := strings.Repeat("a", 150)
+	opaqueWith := func(entry string, xattrs ...string) check {
+		return func(t *testing.T, root *node) {
+			for _, k := range opaqueXattrs[opaque] {
+				hasNodeXattrs(entry, k, opaqueXattrValue)(t, root)
+			}
+			hasXattrNames(entry, append(xattrs, opaqueXattrs[opaque]...)...)(t, root)
+		}
+	}
+	tests := []struct {
+		name string
+		in   []testutil.TarEntry
+		want []check
+	}{
+		{
+			name: "devices",
+			in: []testutil.TarEntry{
+				testutil.Chardev("null", 1, 3),
+				testutil.Blockdev("sda1", 8, 1),
+				testutil.Fifo("fifo"),
+			},
+			want: []check{
+				hasDevice("null", syscall.S_IFCHR, 1, 3),
+				hasDevice("sda1", syscall.S_IFBLK, 8, 1),
+				hasDevice("fifo", syscall.S_IFIFO, 0, 0),
+			},
+		},
+		{
+			name: "whiteout_device",
+			in: []testutil.TarEntry{
+				testutil.Dir("foo/"),
+				testutil.Chardev("foo/bar", 0, 0),
+			},
+			want: []check{
+				hasValidWhiteout("foo/bar"),
+			},
+		},
+		{
+			name: "security_xattrs",
+			in: []testutil.TarEntry{
+				testutil.File("ping", "", testutil.WithFileXattrs(map[string]string{
+					"security.capability": capability,
+					"security.selinux":    "system_u:object_r:ping_exec_t:s0\x00",
+				})),
+			},
+			want: []check{
+				hasNodeXattrs("ping", "security.capability", capability),
+				hasNodeXattrs("ping", "security.selinux", "system_u:object_r:ping_exec_t:s0\x00"),
+				hasXattrNames("ping", "security.capability", "security.selinux"),
+			},
+		},
+		{
+			name: "libarchive_xattrs",
+			in: []testutil.TarEntry{
+				testutil.File("foo", "", testutil.WithFilePAXRecords(map[string]string{
+					"LIBARCHIVE.xattr.user.a%3Db": base64.StdEncoding.EncodeToString([]byte("value")),
+				})),
+			},
+			want: []check{
+				hasNodeXattrs("foo", "user.a=b", "value"),
+				hasXattrNames("foo", "user.a=b"),
+			},
+		},
+		{
+			name: "pax_records_arent_xattrs",
+			in: []testutil.TarEntry{
+				testutil.File(longName, "", testutil.WithFileModTime(time.Unix(1, 5))),
+			},
+			want: []check{
+				hasXattrNames(longName),
+			},
+		},
+		{
+			name: "opaque_trusted_xattr",
+			in: []testutil.TarEntry{
+				testutil.Dir("foo/", testutil.WithDirXattrs(map[string]string{"trusted.overlay.opaque": "y"})),
+				testutil.File("foo/bar", ""),
+			},
+			want: []check{
+				opaqueWith("foo/", "trusted.overlay.opaque"),
+			},
+		},
+		{
+			name: "opaque_user_xattr",
+			in: []testutil.TarEntry{
+				testutil.Dir("foo/", testutil.WithDirXattrs(map[string]string{"user.overlay.opaque": "y"})),
+			},
+			want: []check{
+				opaqueWith("foo/", "user.overlay.opaque"),
+			},
+		},
+		{
+			name: "opaque_whiteout_and_xattr",
+			in: []testutil.TarEntry{
+				testutil.Dir("foo/", testutil.WithDirXattrs(map[string]string{"user.foo": "bar"})),
+				testutil.File("foo/.wh..wh..opq", ""),
+			},
+			want: []check{
+				opaqueWith("foo/", "user.foo"),
+				hasNodeXattrs("foo/", "user.foo", "bar"),
+				fileNotExist("foo/.wh..wh..opq"),
+			},
+		},
+		{
+			name: "not_opaque",
+			in: []testutil.TarEntry{
+				testutil.Dir("foo/", testutil.WithDirXattrs(map[string]string{"trusted.overlay.opaque": "n"})),
+			},
+			want: []check{
+				hasXattrNames("foo/", "trusted.overlay.opaque"),
+				hasNodeXattrs("foo/", "trusted.overlay.opaque", "n"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("testTarConformance_%s_opaque_%d", tt.name, opaque), func(t *testing.T) {
+			ztoc, sr, err := ztoc.BuildZtocReader(t, tt.in, gzip.DefaultCompression, sampleSpanSize)
+			if err != nil {
+				t.Fatalf("failed to build sample ztoc: %v", err)
+			}
+			mr, err := factory(sr, ztoc.TOC)
+			if err != nil {
+				t.Fatalf("failed to create reader: %v", err)
+			}
+			defer mr.Close()
+			spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache(), 0)
+			vr, err := reader.NewReader(mr, digest.FromString(""), spanManager)
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			r := vr.GetReader()
+			defer r.Close()
+			rootNode := getRootNode(t, r, opaque)
+			for _, want := range tt.want {
+				want(t, rootNode)
+			}
+		})
+	}
+}
+
 func hasSize(name string, size int) check {
 	return func(t *testing.T, root *node) {
 		_, n, err := getDirentAndNode(t, root, name)
@@ -363,7 +516,7 @@ func hasSize(name string, size int) check {
 }
 
 func getRootNode(t *testing.T, r reader.Reader, opaque OverlayOpaqueType) *node {
-	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque, false, nil)
+	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, nil, 100, opaque, false, 0, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -375,11 +528,13 @@ type testReader struct {
 	r reader.Reader
 }
 
-func (tr *testReader) OpenFile(id uint32) (io.ReaderAt, error) { return tr.r.OpenFile(id) }
-func (tr *testReader) Metadata() metadata.Reader               { return tr.r.Metadata() }
-func (tr *testReader) Cache(opts ...reader.CacheOption) error  { return nil }
-func (tr *testReader) Close() error                            { return nil }
-func (tr *testReader) LastOnDemandReadTime() time.Time         { return time.Now() }
+func (tr *testReader) OpenFile(id uint32, opts ...reader.OpenOption) (io.ReaderAt, error) {
+	return tr.r.OpenFile(id, opts...)
+}
+func (tr *testReader) Metadata() metadata.Reader              { return tr.r.Metadata() }
+func (tr *testReader) Cache(opts ...reader.CacheOption) error { return nil }
+func (tr *testReader) Close() error                           { return nil }
+func (tr *testReader) LastOnDemandReadTime() time.Time        { return time.Now() }
 
 type testBlobState struct {
 	size        int64
@@ -534,6 +689,61 @@ func hasNodeXattrs(entry, name, value string) check {
 	}
 }
 
+func hasDevice(name string, typ uint32, major, minor uint32) check {
+	return func(t *testing.T, root *node) {
+		ent, n, err := getDirentAndNode(t, root, name)
+		if err != nil {
+			t.Fatalf("failed to get node %q: %v", name, err)
+		}
+		var ao fuse.AttrOut
+		if errno := n.Operations().(fusefs.NodeGetattrer).Getattr(context.Background(), nil, &ao); errno != 0 {
+			t.Fatalf("failed to get attributes of node %q: %v", name, errno)
+		}
+		a := ao.Attr
+		if ent.Mode&syscall.S_IFMT != typ {
+			t.Errorf("entry %q has an invalid type %o; want %o", name, ent.Mode&syscall.S_IFMT, typ)
+		}
+		if a.Mode&syscall.S_IFMT != typ {
+			t.Errorf("node %q has an invalid type %o; want %o", name, a.Mode&syscall.S_IFMT, typ)
+		}
+		if a.Rdev != uint32(unix.Mkdev(major, minor)) {
+			t.Errorf("node %q has invalid device numbers (%d, %d); want (%d, %d)",
+				name, unix.Major(uint64(a.Rdev)), unix.Minor(uint64(a.Rdev)), major, minor)
+		}
+	}
+}
+
+// hasXattrNames checks that the node lists exactly the specified xattrs, once each.
+func hasXattrNames(entry string, names ...string) check {
+	return func(t *testing.T, root *node) {
+		_, n, err := getDirentAndNode(t, root, entry)
+		if err != nil {
+			t.Fatalf("failed to get node %q: %v", entry, err)
+		}
+		buf := make([]byte, 1000)
+		nb, errno := n.Operations().(fusefs.NodeListxattrer).Listxattr(context.Background(), buf)
+		if errno != 0 {
+			t.Fatalf("failed to get xattrs list of node %q: %v", entry, errno)
+		}
+		got := []string{}
+		if nb > 0 {
+			got = strings.Split(strings.TrimSuffix(string(buf[:nb]), "\x00"), "\x00")
+		}
+		want := []string{}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				want = append(want, name)
+			}
+		}
+		sort.Strings(want)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("node %q has unexpected xattrs (-want +got):\n%s", entry, diff)
+		}
+	}
+}
+
 func hasEntry(t *testing.T, name string, ents fusefs.DirStream) (fuse.DirEntry, bool) {
 	for ents.HasNext() {
 		de, errno := ents.Next()
@@ -602,6 +812,11 @@ func hasStateFile(t *testing.T, id string) check {
 		// report the data
 		root.fs.s.report(wantErr)
 
+		// opening the same file again must not count it twice
+		root.fs.s.statFile.touch(1)
+		root.fs.s.statFile.touch(2)
+		root.fs.s.statFile.touch(1)
+
 		// obtain file size (check later)
 		var ao fuse.AttrOut
 		errno = n.Operations().(fusefs.NodeGetattrer).Getattr(context.Background(), nil, &ao)
@@ -637,6 +852,10 @@ func hasStateFile(t *testing.T, id string) check {
 			t.Errorf("expected error %q, got %q", wantErr.Error(), j.Error)
 			return
 		}
+		if j.FilesTouched != 2 {
+			t.Errorf("expected 2 files touched, got %d", j.FilesTouched)
+			return
+		}
 	}
 }
 
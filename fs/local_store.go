@@ -0,0 +1,154 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	socistore "github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// newLocalStore returns the local store of the SOCI artifacts fetched by the snapshotter.
+// If content store tiers are configured, the artifacts stored in other tiers than they are
+// placed in by the config are moved first. Unless namespaces share it, the artifacts fetched for
+// each containerd namespace are stored apart.
+func newLocalStore(ctx context.Context, root string, cfg config.Config) (orascontent.Storage, error) {
+	store, err := newSharedLocalStore(ctx, root, cfg)
+	if err != nil || cfg.ShareNamespaces {
+		return store, err
+	}
+	if cfg.SharedContentStore {
+		log.G(ctx).Warn("shared_content_store is set without share_namespaces: the SOCI artifacts fetched for each namespace " +
+			"are stored apart in the root directory, not in the shared content store")
+	}
+	return newNamespacedStore(filepath.Join(root, "namespaces"), store), nil
+}
+
+func newSharedLocalStore(ctx context.Context, root string, cfg config.Config) (orascontent.Storage, error) {
+	store, err := socistore.OpenLocalStore(root, cfg)
+	if err != nil {
+		return nil, err
+	}
+	tiered, ok := store.(*socistore.TieredStore)
+	if !ok {
+		return store, nil
+	}
+	moved, err := tiered.Migrate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate local store to its tiers: %w", err)
+	}
+	if moved > 0 {
+		log.G(ctx).WithField("moved", moved).Info("moved SOCI artifacts to their content store tiers")
+	}
+	return tiered, nil
+}
+
+// namespacedStore stores the SOCI artifacts fetched for each containerd namespace in a store of
+// its own, so that a namespace never reads the artifacts fetched for another. The artifacts of
+// the shared store, e.g. created with `soci create` or imported with `soci bundle import` on the
+// host, are read by all namespaces. Contexts without a namespace use the shared store.
+type namespacedStore struct {
+	root   string
+	shared orascontent.Storage
+
+	mu     sync.Mutex
+	stores map[string]orascontent.Storage
+}
+
+func newNamespacedStore(root string, shared orascontent.Storage) *namespacedStore {
+	return &namespacedStore{
+		root:   root,
+		shared: shared,
+		stores: make(map[string]orascontent.Storage),
+	}
+}
+
+// store returns the store of the namespace of ctx, which is created on first use.
+func (s *namespacedStore) store(ctx context.Context) (orascontent.Storage, error) {
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok || ns == "" {
+		return s.shared, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if store, ok := s.stores[ns]; ok {
+		return store, nil
+	}
+	// The namespace names a directory, so it must not escape the root.
+	if err := identifiers.Validate(ns); err != nil {
+		return nil, fmt.Errorf("invalid namespace: %w", err)
+	}
+	store, err := oci.New(filepath.Join(s.root, ns, "content"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create local store of namespace %q: %w", ns, err)
+	}
+	s.stores[ns] = store
+	return store, nil
+}
+
+func (s *namespacedStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := store.Fetch(ctx, desc)
+	if store == s.shared || !errors.Is(err, errdef.ErrNotFound) {
+		return rc, err
+	}
+	return s.shared.Fetch(ctx, desc)
+}
+
+func (s *namespacedStore) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return false, err
+	}
+	ok, err := store.Exists(ctx, desc)
+	if ok || err != nil || store == s.shared {
+		return ok, err
+	}
+	return s.shared.Exists(ctx, desc)
+}
+
+func (s *namespacedStore) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.Push(ctx, expected, content)
+}
+
+func (s *namespacedStore) NewBatch(ctx context.Context) (socistore.Batch, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return socistore.NewBatch(ctx, store)
+}
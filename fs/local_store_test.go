@@ -0,0 +1,84 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+func TestNamespacedStore(t *testing.T) {
+	shared, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newNamespacedStore(t.TempDir(), shared)
+	blob := func(content string) ocispec.Descriptor {
+		return ocispec.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString(content), Size: int64(len(content))}
+	}
+	push := func(ctx context.Context, store orascontent.Pusher, content string) {
+		if err := store.Push(ctx, blob(content), bytes.NewReader([]byte(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	tenant1, tenant2 := namespaces.WithNamespace(ctx, "tenant1"), namespaces.WithNamespace(ctx, "tenant2")
+	push(ctx, shared, "imported")
+	push(tenant1, s, "fetched")
+
+	for _, tc := range []struct {
+		name    string
+		ctx     context.Context
+		content string
+		found   bool
+	}{
+		{"own artifact", tenant1, "fetched", true},
+		{"artifact of another namespace", tenant2, "fetched", false},
+		{"artifact of another namespace without a namespace", ctx, "fetched", false},
+		{"shared artifact", tenant1, "imported", true},
+		{"shared artifact without a namespace", ctx, "imported", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := s.Exists(tc.ctx, blob(tc.content))
+			if err != nil || ok != tc.found {
+				t.Fatalf("unexpected existence; expected = %v, got = %v (%v)", tc.found, ok, err)
+			}
+			b, err := orascontent.FetchAll(tc.ctx, s, blob(tc.content))
+			if !tc.found {
+				if !errors.Is(err, errdef.ErrNotFound) {
+					t.Fatalf("fetched the artifact of another namespace: %v", err)
+				}
+				return
+			}
+			if err != nil || string(b) != tc.content {
+				t.Fatalf("unexpected content %q: %v", b, err)
+			}
+		})
+	}
+	if _, err := s.Exists(namespaces.WithNamespace(ctx, "../escape"), blob("fetched")); err == nil {
+		t.Fatalf("found artifact of an invalid namespace")
+	}
+}
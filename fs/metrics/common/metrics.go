@@ -56,6 +56,16 @@ const (
 	// ImageOperationCountKey is the key for any metric related to operation count metric at the image level (as opposed to layer).
 	ImageOperationCountKey = "image_operation_count_key"
 
+	// FuseErrnoCountKey is the key for the metric counting errnos returned to applications from FUSE operations.
+	FuseErrnoCountKey = "fuse_errno_count"
+
+	// MountLatencyKeyMilliseconds is the key for the latency metric from the preparation of a snapshot
+	// to the FUSE mount of its layer.
+	MountLatencyKeyMilliseconds = "mount_latency_milliseconds"
+
+	// MountFailureCountKey is the key for the metric counting failed FUSE mounts by reason.
+	MountFailureCountKey = "mount_failure_count"
+
 	// Keep namespace as soci and subsystem as fs.
 	namespace = "soci"
 	subsystem = "fs"
@@ -74,6 +84,7 @@ const (
 	SynchronousReadCount              = "synchronous_read_count"
 	SynchronousReadRegistryFetchCount = "synchronous_read_remote_registry_fetch_count" // TODO revisit (wrong place)
 	SynchronousBytesServed            = "synchronous_bytes_served"
+	ThrottledReadCount                = "throttled_read_count" // reads which waited for the read limit of their mount
 
 	// fuse operation failure metrics
 	FuseNodeGetattrFailureCount     = "fuse_node_getattr_failure_count"
@@ -103,6 +114,20 @@ const (
 	BackgroundFetchWorkQueueSize = "background_fetch_work_queue_size"
 )
 
+// Reasons of mount failures.
+const (
+	// MountFailureIndexFetch is the reason of failures to fetch the SOCI index or its zTOCs.
+	MountFailureIndexFetch = "index_fetch"
+	// MountFailureZtocParse is the reason of failures to parse the zTOC of the layer.
+	MountFailureZtocParse = "ztoc_parse"
+	// MountFailureAuth is the reason of failures caused by the registry refusing the credentials.
+	MountFailureAuth = "auth"
+	// MountFailureFuse is the reason of failures to serve the layer with FUSE.
+	MountFailureFuse = "fuse"
+	// MountFailureOther is the reason of the other failures, e.g. timeouts resolving the layer.
+	MountFailureOther = "other"
+)
+
 var (
 	// Buckets for OperationLatency metrics.
 	latencyBucketsMilliseconds = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384} // in milliseconds
@@ -165,6 +190,41 @@ var (
 			Help:      "The count of soci snapshotter operations. Broken down by operation type and image digest.",
 		},
 		[]string{"operation_type", "image"})
+
+	// fuseErrnoCount counts the non-zero errnos returned to applications from FUSE operations
+	// by operation type, errno and image digest.
+	fuseErrnoCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      FuseErrnoCountKey,
+			Help:      "The count of errnos returned to applications from FUSE operations. Broken down by operation type, errno and image digest.",
+		},
+		[]string{"operation_type", "errno", "image"})
+
+	// mountLatencyMilliseconds collects the latency in milliseconds from the preparation of
+	// snapshots to the FUSE mount of their layers, grouped by image digest.
+	mountLatencyMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      MountLatencyKeyMilliseconds,
+			Help:      "Latency in milliseconds from the preparation of a snapshot to the FUSE mount of its layer. Broken down by image digest.",
+			Buckets:   latencyBucketsMilliseconds,
+		},
+		[]string{"image"},
+	)
+
+	// mountFailureCount counts the failed FUSE mounts by reason.
+	mountFailureCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      MountFailureCountKey,
+			Help:      "The count of failed FUSE mounts of layers. Broken down by reason.",
+		},
+		[]string{"reason"},
+	)
 )
 
 var register sync.Once
@@ -191,6 +251,9 @@ func Register() {
 		prometheus.MustRegister(operationCount)
 		prometheus.MustRegister(bytesCount)
 		prometheus.MustRegister(imageOperationCount)
+		prometheus.MustRegister(fuseErrnoCount)
+		prometheus.MustRegister(mountLatencyMilliseconds)
+		prometheus.MustRegister(mountFailureCount)
 	})
 }
 
@@ -226,3 +289,21 @@ func AddBytesCount(operation string, layer digest.Digest, bytes int64) {
 func AddImageOperationCount(operation string, image digest.Digest, count int32) {
 	imageOperationCount.WithLabelValues(operation, image.String()).Add(float64(count))
 }
+
+// IncFuseErrnoCount wraps the labels attachment as well as calling Inc into a single method.
+// `errno` is the name of the errno, e.g. "EIO".
+func IncFuseErrnoCount(operation, errno string, image digest.Digest) {
+	fuseErrnoCount.WithLabelValues(operation, errno, image.String()).Inc()
+}
+
+// MeasureMountLatency wraps the labels attachment as well as calling Observe into a single method.
+// `start` is when the snapshot of the layer started to be prepared.
+func MeasureMountLatency(image digest.Digest, start time.Time) {
+	mountLatencyMilliseconds.WithLabelValues(image.String()).Observe(sinceInMilliseconds(start))
+}
+
+// IncMountFailureCount wraps the labels attachment as well as calling Inc into a single method.
+// `reason` is one of the MountFailure reasons.
+func IncMountFailureCount(reason string) {
+	mountFailureCount.WithLabelValues(reason).Inc()
+}
@@ -65,4 +65,30 @@ var layerMetrics = []*metric{
 			}
 		},
 	},
+	{
+		name: "layer_readahead_spans",
+		help: "Number of spans of the layer fetched ahead of reads",
+		unit: metrics.Total,
+		vt:   prometheus.CounterValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().FetchStats.ReadaheadSpans),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_readahead_hits",
+		help: "Number of spans of the layer fetched ahead of reads which were read afterwards",
+		unit: metrics.Total,
+		vt:   prometheus.CounterValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().FetchStats.ReadaheadHits),
+				},
+			}
+		},
+	},
 }
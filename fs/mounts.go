@@ -0,0 +1,103 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/fs/quota"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// layerMount is the record of a layer mounted by the filesystem.
+type layerMount struct {
+	layer     layer.Layer
+	namespace string
+	// imageDigest is the digest of the manifest of the image the layer was mounted for,
+	// and indexDigest the digest of its SOCI index, or "" if it's unknown.
+	imageDigest string
+	indexDigest digest.Digest
+	layerDigest digest.Digest
+	mountedAt   time.Time
+	// compactedSize is the fetched size of the layer when it was last compacted.
+	// It's only accessed by the span compactor.
+	compactedSize int64
+}
+
+// mountRegistry holds the records of the mounted layers. The parts of the filesystem which act
+// on the mounted layers, e.g. idle demotion and compaction, read them from the registry rather
+// than tracking the mounts themselves.
+type mountRegistry struct {
+	mu     sync.Mutex
+	mounts map[string]*layerMount // mountpoint -> mount
+}
+
+func newMountRegistry() *mountRegistry {
+	return &mountRegistry{mounts: make(map[string]*layerMount)}
+}
+
+func (r *mountRegistry) add(mountpoint string, m *layerMount) {
+	r.mu.Lock()
+	r.mounts[mountpoint] = m
+	r.mu.Unlock()
+}
+
+// remove removes the record of the layer mounted at mountpoint and returns it, if any.
+func (r *mountRegistry) remove(mountpoint string) (*layerMount, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.mounts[mountpoint]
+	delete(r.mounts, mountpoint)
+	return m, ok
+}
+
+// get returns the record of the layer mounted at mountpoint, or nil if no layer is mounted there.
+func (r *mountRegistry) get(mountpoint string) *layerMount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mounts[mountpoint]
+}
+
+// list returns the records of the mounted layers by mountpoint.
+func (r *mountRegistry) list() map[string]*layerMount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mounts := make(map[string]*layerMount, len(r.mounts))
+	for mountpoint, m := range r.mounts {
+		mounts[mountpoint] = m
+	}
+	return mounts
+}
+
+func (r *mountRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.mounts)
+}
+
+// quotaMounts returns the mounted layers, as accounted by the quota manager.
+func (r *mountRegistry) quotaMounts() []quota.Mount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mounts := make([]quota.Mount, 0, len(r.mounts))
+	for _, m := range r.mounts {
+		mounts = append(mounts, quota.Mount{Namespace: m.namespace, Digest: m.layerDigest})
+	}
+	return mounts
+}
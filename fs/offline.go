@@ -0,0 +1,50 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// offlineStore stands in for the registry when the filesystem is offline.
+// It refuses every request, so that only the artifacts of the local stores are used.
+type offlineStore struct{}
+
+func (offlineStore) Resolve(ctx context.Context, ref string) (ocispec.Descriptor, error) {
+	return ocispec.Descriptor{}, fmt.Errorf("cannot resolve %s: %w", ref, remote.ErrOffline)
+}
+
+func (offlineStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("%s is not in the local content store: %w", desc.Digest, remote.ErrOffline)
+}
+
+func (offlineStore) Push(ctx context.Context, desc ocispec.Descriptor, content io.Reader) error {
+	return fmt.Errorf("cannot push %s: %w", desc.Digest, remote.ErrOffline)
+}
+
+func (offlineStore) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	return false, remote.ErrOffline
+}
+
+func (offlineStore) Referrers(ctx context.Context, desc ocispec.Descriptor, artifactType string, fn func(referrers []ocispec.Descriptor) error) error {
+	return fmt.Errorf("cannot list the referrers of %s: %w", desc.Digest, remote.ErrOffline)
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestSociContextInitOffline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	artifacts, indexDesc, ztocs := newTestSociArtifacts(t)
+	// Offline, SOCI artifacts are read from the content store, e.g. as imported from a bundle.
+	contentStorePath := t.TempDir()
+	localStore, err := oci.New(contentStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range append([]ocispec.Descriptor{indexDesc}, ztocs...) {
+		b, err := content.FetchAll(ctx, artifacts, desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := localStore.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifestDigest := digest.FromString("manifest")
+	indexStorePath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(indexStorePath, manifestDigest.Encoded()), []byte(indexDesc.Digest.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The registry must not be contacted.
+	var hostsCalled bool
+	var hosts source.RegistryHosts = func(reference.Spec) ([]docker.RegistryHost, error) {
+		hostsCalled = true
+		return nil, errors.New("registry contacted")
+	}
+
+	cfg := sociContextConfig{
+		store:            localStore,
+		indexStorePath:   indexStorePath,
+		contentStorePath: contentStorePath,
+		hosts:            hosts,
+		offline:          true,
+	}
+	var c sociContext
+	if err := c.Init(ctx, ctx, imageRef, "", manifestDigest.String(), cfg); err != nil {
+		t.Fatalf("failed to init from the local stores: %v", err)
+	}
+	if hostsCalled {
+		t.Fatal("the registry hosts were configured offline")
+	}
+	if c.indexDigest != indexDesc.Digest || len(c.sociIndex.Blobs) != len(ztocs) {
+		t.Fatalf("unexpected index %s with %d ztocs", c.indexDigest, len(c.sociIndex.Blobs))
+	}
+
+	// Without a local index, discovery fails instead of calling the Referrers API.
+	var missing sociContext
+	err = missing.Init(ctx, ctx, imageRef, "", digest.FromString("other").String(), cfg)
+	if !errors.Is(err, remote.ErrOffline) {
+		t.Fatalf("expected ErrOffline without a local index, got %v", err)
+	}
+	if hostsCalled {
+		t.Fatal("the registry hosts were configured offline")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	defaultPassthroughCheckPeriod = 10 * time.Second
+
+	// passthroughDirName is the name of the directory next to the mountpoint
+	// which holds the extracted contents of the layer.
+	passthroughDirName = "passthrough"
+)
+
+// passthroughManager switches layers which have been fully fetched from their FUSE mount
+// to a bind mount of their extracted contents, so that new readers bypass FUSE.
+//
+// The bind mount is stacked on top of the FUSE mount. Overlay mounts created before the switch
+// keep referencing the FUSE mount, so running containers are not affected.
+type passthroughManager struct {
+	checkPeriod time.Duration
+	opaqueType  layer.OverlayOpaqueType
+
+	mu       sync.Mutex
+	watchers map[string]*passthroughWatcher // mountpoint -> watcher
+}
+
+type passthroughWatcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// mounted is set when the extracted contents are bind-mounted over the mountpoint.
+	mounted bool
+}
+
+func newPassthroughManager(checkPeriod time.Duration, opaqueType layer.OverlayOpaqueType) *passthroughManager {
+	if checkPeriod == 0 {
+		checkPeriod = defaultPassthroughCheckPeriod
+	}
+	return &passthroughManager{
+		checkPeriod: checkPeriod,
+		opaqueType:  opaqueType,
+		watchers:    make(map[string]*passthroughWatcher),
+	}
+}
+
+// passthroughDir returns the directory the layer mounted at mountpoint is extracted to.
+// It lives in the snapshot directory, so it is removed together with the snapshot.
+func passthroughDir(mountpoint string) string {
+	return filepath.Join(filepath.Dir(mountpoint), passthroughDirName)
+}
+
+// Watch switches the layer mounted at mountpoint to passthrough once it is fully fetched.
+func (p *passthroughManager) Watch(ctx context.Context, mountpoint string, l layer.Layer) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &passthroughWatcher{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.watchers[mountpoint] = w
+	p.mu.Unlock()
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(p.checkPeriod)
+		defer ticker.Stop()
+		for {
+			info := l.Info()
+			if info.FetchedSize >= info.Size {
+				break
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := p.switchToPassthrough(ctx, mountpoint, l); err != nil {
+			log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to switch layer to passthrough")
+			return
+		}
+		p.mu.Lock()
+		w.mounted = true
+		p.mu.Unlock()
+		log.G(ctx).WithField("mountpoint", mountpoint).Info("switched fully fetched layer to passthrough")
+	}()
+}
+
+func (p *passthroughManager) switchToPassthrough(ctx context.Context, mountpoint string, l layer.Layer) error {
+	dir := passthroughDir(mountpoint)
+	// The directory may be left over from before a restart, when the layer was unmounted forcibly.
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if err := layer.Extract(ctx, l, dir, p.opaqueType); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to extract layer: %w", err)
+	}
+	// The root directory of the extracted layer must look like the root of the FUSE mount.
+	if fi, err := os.Stat(mountpoint); err == nil {
+		os.Chmod(dir, fi.Mode().Perm())
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			os.Lchown(dir, int(st.Uid), int(st.Gid))
+		}
+	}
+	if err := syscall.Mount(dir, mountpoint, "", syscall.MS_BIND, ""); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to bind mount extracted layer: %w", err)
+	}
+	// Bind mounts ignore MS_RDONLY on creation, so the mount is made read-only with a remount.
+	if err := syscall.Mount("", mountpoint, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		syscall.Unmount(mountpoint, syscall.MNT_DETACH)
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to make extracted layer read-only: %w", err)
+	}
+	return nil
+}
+
+// Unwatch stops watching the layer mounted at mountpoint and removes its passthrough mount, if any.
+// It must be called before the FUSE mount is unmounted.
+func (p *passthroughManager) Unwatch(mountpoint string) error {
+	p.mu.Lock()
+	w, ok := p.watchers[mountpoint]
+	delete(p.watchers, mountpoint)
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	w.cancel()
+	<-w.done
+	if !w.mounted {
+		return nil
+	}
+	if err := syscall.Unmount(mountpoint, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount passthrough mount: %w", err)
+	}
+	return os.RemoveAll(passthroughDir(mountpoint))
+}
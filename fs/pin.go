@@ -0,0 +1,246 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ErrPinUnavailable is returned by a PinAdmin which wasn't passed to a filesystem yet.
+var ErrPinUnavailable = errors.New("pinning is not available")
+
+// spanPins records the pinned SOCI indices, whose layers keep their cached spans, e.g. when they
+// are idle. The pins are persisted in a file, so that they survive restarts of the snapshotter.
+//
+// A layer shared by several images is mounted once, so its spans are pinned if any of the indices
+// it's mounted with is pinned.
+type spanPins struct {
+	path   string
+	mounts *mountRegistry
+
+	mu      sync.Mutex
+	indices map[digest.Digest]struct{}
+}
+
+// newSpanPins returns the pins persisted at path, if any, of the layers of `mounts`.
+func newSpanPins(path string, mounts *mountRegistry) (*spanPins, error) {
+	p := &spanPins{
+		path:    path,
+		mounts:  mounts,
+		indices: make(map[digest.Digest]struct{}),
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	var indices []digest.Digest
+	if err := json.Unmarshal(b, &indices); err != nil {
+		return p, fmt.Errorf("invalid pins in %q: %w", path, err)
+	}
+	for _, dgst := range indices {
+		p.indices[dgst] = struct{}{}
+	}
+	return p, nil
+}
+
+// mounted pins the spans of the layer of `m`, which was just mounted, if its index is pinned.
+func (p *spanPins) mounted(m *layerMount) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.indices[m.indexDigest]; ok {
+		m.layer.SetPinned(true)
+	}
+}
+
+// list returns the pinned indices ordered by digest.
+func (p *spanPins) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listLocked()
+}
+
+func (p *spanPins) listLocked() []string {
+	indices := make([]string, 0, len(p.indices))
+	for dgst := range p.indices {
+		indices = append(indices, dgst.String())
+	}
+	sort.Strings(indices)
+	return indices
+}
+
+// pin pins or unpins the index `index` and the spans of its mounted layers.
+func (p *spanPins) pin(index digest.Digest, pinned bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.indices[index]; ok == pinned {
+		return nil
+	}
+	if pinned {
+		p.indices[index] = struct{}{}
+	} else {
+		delete(p.indices, index)
+	}
+	if err := p.saveLocked(); err != nil {
+		if pinned {
+			delete(p.indices, index)
+		} else {
+			p.indices[index] = struct{}{}
+		}
+		return err
+	}
+	// The layers mounted with the index are pinned if any of their indices is.
+	mounts := p.mounts.list()
+	layers := make(map[layer.Layer]bool)
+	for _, m := range mounts {
+		_, ok := p.indices[m.indexDigest]
+		layers[m.layer] = layers[m.layer] || ok
+	}
+	for _, m := range mounts {
+		if m.indexDigest == index {
+			m.layer.SetPinned(layers[m.layer])
+		}
+	}
+	return nil
+}
+
+// saveLocked atomically replaces the file of the pins.
+func (p *spanPins) saveLocked() error {
+	b, err := json.Marshal(p.listLocked())
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save pins to %q: %w", p.path, err)
+	}
+	return nil
+}
+
+// PinAdmin pins the cached spans of the layers of SOCI indices in the filesystem it's passed to with
+// WithPinAdmin, so that they aren't demoted, e.g. for the indices pinned with `soci index pin`.
+type PinAdmin struct {
+	mu   sync.Mutex
+	pins *spanPins
+}
+
+// NewPinAdmin returns a PinAdmin which fails with ErrPinUnavailable until it's passed to a filesystem.
+func NewPinAdmin() *PinAdmin {
+	return &PinAdmin{}
+}
+
+func (a *PinAdmin) set(pins *spanPins) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pins = pins
+}
+
+func (a *PinAdmin) get() *spanPins {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.pins
+}
+
+// Pinned returns the digests of the pinned indices ordered by digest.
+func (a *PinAdmin) Pinned() []string {
+	pins := a.get()
+	if pins == nil {
+		return []string{}
+	}
+	return pins.list()
+}
+
+// Pin pins the cached spans of the layers of the index `index`, including the layers mounted later.
+func (a *PinAdmin) Pin(index digest.Digest) error {
+	pins := a.get()
+	if pins == nil {
+		return ErrPinUnavailable
+	}
+	return pins.pin(index, true)
+}
+
+// Unpin unpins the cached spans of the layers of the index `index`.
+func (a *PinAdmin) Unpin(index digest.Digest) error {
+	pins := a.get()
+	if pins == nil {
+		return ErrPinUnavailable
+	}
+	return pins.pin(index, false)
+}
+
+// Handler serves the digests of the pinned indices as JSON on GET. On POST and DELETE, it pins and
+// unpins the index with the `digest` query parameter.
+func (a *PinAdmin) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pin func(digest.Digest) error
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			pin = a.Pin
+		case http.MethodDelete:
+			pin = a.Unpin
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if pin != nil {
+			dgst, err := digest.Parse(r.URL.Query().Get("digest"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid index digest: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := pin(dgst); err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, ErrPinUnavailable) {
+					code = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Pinned []string `json:"pinned"`
+		}{a.Pinned()})
+	})
+}
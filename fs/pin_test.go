@@ -0,0 +1,129 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type pinTestLayer struct {
+	breakableLayer
+	pinned bool
+}
+
+func (l *pinTestLayer) SetPinned(pinned bool) { l.pinned = pinned }
+
+func TestSpanPins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), pinsFileName)
+	mounts := newMountRegistry()
+	pins, err := newSpanPins(path, mounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexA, indexB := digest.FromString("a"), digest.FromString("b")
+	// The shared layer is mounted once for each image.
+	own, shared := &pinTestLayer{}, &pinTestLayer{}
+	mounts.add("a0", &layerMount{layer: own, indexDigest: indexA})
+	mounts.add("a1", &layerMount{layer: shared, indexDigest: indexA})
+	mounts.add("b0", &layerMount{layer: shared, indexDigest: indexB})
+
+	if err := pins.pin(indexA, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.pin(indexB, true); err != nil {
+		t.Fatal(err)
+	}
+	if !own.pinned || !shared.pinned {
+		t.Fatalf("layers of pinned indices aren't pinned: %v, %v", own.pinned, shared.pinned)
+	}
+	// The shared layer stays pinned by the other index.
+	if err := pins.pin(indexA, false); err != nil {
+		t.Fatal(err)
+	}
+	if own.pinned || !shared.pinned {
+		t.Fatalf("unexpected pins after unpinning an index: %v, %v", own.pinned, shared.pinned)
+	}
+
+	// The pins are restored, and applied to the layers mounted later.
+	restored, err := newSpanPins(path, newMountRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.list(); !reflect.DeepEqual(got, []string{indexB.String()}) {
+		t.Fatalf("unexpected restored pins: %v", got)
+	}
+	l := &pinTestLayer{}
+	restored.mounted(&layerMount{layer: l, indexDigest: indexB})
+	if !l.pinned {
+		t.Fatal("layer of a restored pinned index isn't pinned")
+	}
+}
+
+func TestPinAdminHandler(t *testing.T) {
+	admin := NewPinAdmin()
+	h := admin.Handler()
+	index := digest.FromString("index")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pins?digest="+index.String(), nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status before the admin is passed to a filesystem: %d", rec.Code)
+	}
+
+	pins, err := newSpanPins(filepath.Join(t.TempDir(), pinsFileName), newMountRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.set(pins)
+	for _, tc := range []struct {
+		method   string
+		query    string
+		code     int
+		expected []string
+	}{
+		{method: http.MethodPost, query: "digest=invalid", code: http.StatusBadRequest},
+		{method: http.MethodPost, query: "digest=" + index.String(), code: http.StatusOK, expected: []string{index.String()}},
+		{method: http.MethodGet, code: http.StatusOK, expected: []string{index.String()}},
+		{method: http.MethodDelete, query: "digest=" + index.String(), code: http.StatusOK, expected: []string{}},
+		{method: http.MethodPut, code: http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, "/pins?"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%s %s: unexpected status %d: %s", tc.method, tc.query, rec.Code, rec.Body)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var res struct {
+			Pinned []string `json:"pinned"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Pinned, tc.expected) {
+			t.Fatalf("%s %s: unexpected pins %v", tc.method, tc.query, res.Pinned)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxPrefetchProfileSize is the maximum size of the prefetch profiles read from the local store.
+const maxPrefetchProfileSize = 16 << 20 // 16 MiB
+
+// prefetchProfile fetches the spans of the files of the layer `l` listed in the prefetch profile
+// `dgst` of the local store, and returns the number of these files found in the layer.
+func (fs *filesystem) prefetchProfile(ctx context.Context, l layer.Layer, dgst string) (int, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return 0, fmt.Errorf("invalid prefetch profile digest: %w", err)
+	}
+	rc, err := fs.orasStore.Fetch(ctx, ocispec.Descriptor{MediaType: soci.PrefetchProfileMediaType, Digest: d})
+	if err != nil {
+		return 0, fmt.Errorf("cannot read prefetch profile %s: %w", d, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, maxPrefetchProfileSize+1))
+	if err != nil {
+		return 0, fmt.Errorf("cannot read prefetch profile %s: %w", d, err)
+	}
+	if len(b) > maxPrefetchProfileSize {
+		return 0, fmt.Errorf("prefetch profile %s is larger than %d bytes", d, maxPrefetchProfileSize)
+	}
+	if d.Algorithm().FromBytes(b) != d {
+		return 0, fmt.Errorf("prefetch profile %s doesn't match its digest", d)
+	}
+	profile, err := soci.ParsePrefetchProfile(b)
+	if err != nil {
+		return 0, err
+	}
+	return l.PrefetchFiles(profile.Files)
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+type prefetchFilesTestLayer struct {
+	breakableLayer
+	prefetched []string
+}
+
+func (l *prefetchFilesTestLayer) PrefetchFiles(paths []string) (int, error) {
+	l.prefetched = append(l.prefetched, paths...)
+	return len(paths), nil
+}
+
+func TestPrefetchProfile(t *testing.T) {
+	ctx := context.Background()
+	store, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(b []byte) string {
+		desc := ocispec.Descriptor{MediaType: soci.PrefetchProfileMediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		return desc.Digest.String()
+	}
+	files := []string{"usr/bin/python3", "/etc/hosts"}
+	b, err := json.Marshal(soci.NewPrefetchProfile(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := push(b)
+	notProfile := push([]byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json"}`))
+
+	fs := &filesystem{orasStore: store}
+	l := &prefetchFilesTestLayer{}
+	n, err := fs.prefetchProfile(ctx, l, profile)
+	if err != nil {
+		t.Fatalf("failed to prefetch profile: %v", err)
+	}
+	if n != len(files) {
+		t.Fatalf("unexpected number of files prefetched: %d", n)
+	}
+	if diff := cmp.Diff(files, l.prefetched); diff != "" {
+		t.Fatalf("unexpected files prefetched (-want +got):\n%s", diff)
+	}
+
+	for _, invalid := range []string{notProfile, digest.FromString("missing").String(), "profile"} {
+		l := &prefetchFilesTestLayer{}
+		if _, err := fs.prefetchProfile(ctx, l, invalid); err == nil {
+			t.Errorf("expected an error for prefetch profile %q", invalid)
+		}
+		if len(l.prefetched) != 0 {
+			t.Errorf("prefetched files of invalid prefetch profile %q", invalid)
+		}
+	}
+}
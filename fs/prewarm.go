@@ -0,0 +1,238 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/util/containerdutil"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrPrewarmUnavailable is returned by a Prewarmer which wasn't passed to a filesystem yet.
+var ErrPrewarmUnavailable = errors.New("prewarming is not available")
+
+// PrewarmRequest is a request to warm the caches of the node for an image.
+type PrewarmRequest struct {
+	// Ref is the reference of the image.
+	Ref string `json:"ref"`
+	// Platform is the platform of the image manifest to prewarm, if the image is multi-platform.
+	// Defaults to the platform of the node.
+	Platform string `json:"platform,omitempty"`
+	// IndexDigest is the digest of the SOCI index to use. Defaults to the index the
+	// snapshotter would discover when mounting the image.
+	IndexDigest string `json:"indexDigest,omitempty"`
+	// PrefetchPercent is the percentage of the spans of each layer to fetch.
+	PrefetchPercent int `json:"prefetchPercent,omitempty"`
+	// PrefetchProfile is the digest of a prefetch profile of the local store whose files are fetched.
+	PrefetchProfile string `json:"prefetchProfile,omitempty"`
+	// Namespace is the containerd namespace whose caches are warmed, if namespaces don't share them.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// PrewarmResult reports what was warmed for an image.
+type PrewarmResult struct {
+	// ManifestDigest is the digest of the image manifest which was prewarmed.
+	ManifestDigest string `json:"manifestDigest"`
+	// IndexDigest is the digest of the SOCI index which was fetched.
+	IndexDigest string `json:"indexDigest"`
+	// Layers is the number of layers of the image.
+	Layers int `json:"layers"`
+	// ResolvedLayers is the number of layers with a ztoc whose metadata is ready to be mounted.
+	ResolvedLayers int `json:"resolvedLayers"`
+	// PrefetchedFiles is the number of files of the prefetch profile found in the layers.
+	PrefetchedFiles int `json:"prefetchedFiles"`
+}
+
+// Prewarmer warms the caches of the filesystem it's passed to with WithPrewarmer for images
+// before any container is created from them: it fetches their SOCI index and ztocs, resolves
+// their layers and optionally fetches some of their spans, e.g. so that a daemon set can make
+// the first start of a pod on a node as fast as the next ones.
+type Prewarmer struct {
+	mu sync.Mutex
+	fs *filesystem
+}
+
+// NewPrewarmer returns a Prewarmer which fails with ErrPrewarmUnavailable until it's passed to a filesystem.
+func NewPrewarmer() *Prewarmer {
+	return &Prewarmer{}
+}
+
+func (p *Prewarmer) set(fs *filesystem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fs = fs
+}
+
+func (p *Prewarmer) get() *filesystem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fs
+}
+
+// Prewarm warms the caches of the filesystem for the image of req. Layers without a ztoc are skipped,
+// and prefetching is best-effort, like when layers are mounted.
+func (p *Prewarmer) Prewarm(ctx context.Context, req PrewarmRequest) (PrewarmResult, error) {
+	fs := p.get()
+	if fs == nil {
+		return PrewarmResult{}, ErrPrewarmUnavailable
+	}
+	return fs.prewarm(ctx, req)
+}
+
+// Handler prewarms the image of the JSON PrewarmRequest POSTed to it, and responds with the PrewarmResult as JSON.
+func (p *Prewarmer) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PrewarmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid prewarm request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Ref == "" {
+			http.Error(w, "missing image ref", http.StatusBadRequest)
+			return
+		}
+		if req.PrefetchPercent < 0 || req.PrefetchPercent > 100 {
+			http.Error(w, "prefetch percent must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		res, err := p.Prewarm(r.Context(), req)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrPrewarmUnavailable) {
+				code = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+func (fs *filesystem) prewarm(ctx context.Context, req PrewarmRequest) (PrewarmResult, error) {
+	var res PrewarmResult
+	if fs.offline {
+		return res, fmt.Errorf("cannot prewarm images in offline mode")
+	}
+	if req.Namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, req.Namespace)
+	}
+	ref := fs.rewriteLabels(ctx, map[string]string{ctdsnapshotters.TargetRefLabel: req.Ref})[ctdsnapshotters.TargetRefLabel]
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return res, err
+	}
+	platform := platforms.Default()
+	if req.Platform != "" {
+		p, err := platforms.Parse(req.Platform)
+		if err != nil {
+			return res, fmt.Errorf("invalid platform %q: %w", req.Platform, err)
+		}
+		platform = platforms.Only(p)
+	}
+	manifestDesc, manifest, err := fs.resolveManifest(ctx, refspec, platform)
+	if err != nil {
+		return res, fmt.Errorf("cannot resolve image %s: %w", ref, err)
+	}
+	res.ManifestDigest = manifestDesc.Digest.String()
+	res.Layers = len(manifest.Layers)
+
+	c, err := fs.getSociContext(ctx, ref, req.IndexDigest, res.ManifestDigest)
+	if err != nil {
+		return res, fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
+	}
+	indexDigest, _, _ := c.discovery()
+	res.IndexDigest = indexDigest.String()
+
+	for _, desc := range manifest.Layers {
+		sociDesc, ok := c.imageLayerToSociDesc[desc.Digest.String()]
+		if !ok {
+			continue
+		}
+		src, err := fs.getSources(map[string]string{
+			ctdsnapshotters.TargetRefLabel:            ref,
+			ctdsnapshotters.TargetManifestDigestLabel: res.ManifestDigest,
+			ctdsnapshotters.TargetLayerDigestLabel:    desc.Digest.String(),
+			source.TargetSizeLabel:                    strconv.FormatInt(desc.Size, 10),
+		})
+		if err != nil {
+			return res, err
+		} else if len(src) == 0 {
+			return res, fmt.Errorf("no source of layer %s", desc.Digest)
+		}
+		s := src[0]
+		s.Manifest = manifest
+		l, err := fs.resolveLayer(ctx, c, s, desc, sociDesc)
+		if err != nil {
+			return res, fmt.Errorf("failed to resolve layer %s: %w", desc.Digest, err)
+		}
+		res.ResolvedLayers++
+		logger := log.G(ctx).WithField("layer", desc.Digest)
+		if req.PrefetchPercent > 0 {
+			if err := l.Prefetch(req.PrefetchPercent); err != nil {
+				logger.WithError(err).Warn("failed to prefetch layer")
+			}
+		}
+		if req.PrefetchProfile != "" {
+			n, err := fs.prefetchProfile(ctx, l, req.PrefetchProfile)
+			if err != nil {
+				logger.WithError(err).WithField("profile", req.PrefetchProfile).Warn("failed to prefetch files of prefetch profile")
+			}
+			res.PrefetchedFiles += n
+		}
+		// The layer remains in the resolver cache, ready for its mount, until it's evicted.
+		l.Done()
+	}
+	log.G(ctx).WithField("image", ref).WithField("manifest", res.ManifestDigest).Info("prewarmed image")
+	return res, nil
+}
+
+// resolveManifest resolves refspec to the image manifest of the platform and reads it.
+func (fs *filesystem) resolveManifest(ctx context.Context, refspec reference.Spec, platform platforms.MatchComparer) (ocispec.Descriptor, ocispec.Manifest, error) {
+	store, err := newRemoteStore(refspec, fs.registryHosts)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+	// Stores resolve the tag or digest of the reference.
+	object := refspec.Object
+	if i := strings.LastIndex(object, "@"); i >= 0 {
+		object = object[i+1:]
+	}
+	desc, err := store.Resolve(ctx, object)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+	return containerdutil.ResolveManifest(ctx, store, desc, platform)
+}
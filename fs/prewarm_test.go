@@ -0,0 +1,127 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPrewarmerHandler(t *testing.T) {
+	p := NewPrewarmer()
+	for _, tc := range []struct {
+		method, body string
+		code         int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "{", http.StatusBadRequest},
+		{http.MethodPost, `{}`, http.StatusBadRequest},
+		{http.MethodPost, `{"ref":"registry.example.com/app:latest","prefetchPercent":101}`, http.StatusBadRequest},
+		// The prewarmer wasn't passed to a filesystem.
+		{http.MethodPost, `{"ref":"registry.example.com/app:latest"}`, http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest(tc.method, "/prewarm", strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Fatalf("unexpected response to %s %s: %d %s", tc.method, tc.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestResolveManifest(t *testing.T) {
+	type blob struct {
+		mediaType string
+		content   []byte
+	}
+	blobs := make(map[string]blob)
+	add := func(mediaType string, v interface{}) ocispec.Descriptor {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		blobs[desc.Digest.String()] = blob{mediaType, b}
+		return desc
+	}
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer"), Size: 5}
+	amd64 := add(ocispec.MediaTypeImageManifest, ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: []ocispec.Descriptor{layer}})
+	amd64.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := add(ocispec.MediaTypeImageManifest, ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: []ocispec.Descriptor{layer, layer}})
+	arm64.Platform = &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	index := add(ocispec.MediaTypeImageIndex, ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{amd64, arm64}})
+	blobs["tag"] = blobs[index.Digest.String()]
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/repo/manifests/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", b.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.content)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(b.content).String())
+		if r.Method == http.MethodGet {
+			w.Write(b.content)
+		}
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+	fs := &filesystem{
+		registryHosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{Client: &http.Client{}, Host: host, Scheme: "http", Path: "/v2"}}, nil
+		},
+	}
+
+	for _, tc := range []struct {
+		ref      string
+		platform ocispec.Platform
+		expected ocispec.Descriptor
+		layers   int
+	}{
+		{ref: host + "/repo:tag", platform: *amd64.Platform, expected: amd64, layers: 1},
+		{ref: host + "/repo:tag", platform: *arm64.Platform, expected: arm64, layers: 2},
+		{ref: host + "/repo@" + arm64.Digest.String(), platform: *amd64.Platform, expected: arm64, layers: 2},
+	} {
+		refspec, err := reference.Parse(tc.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, manifest, err := fs.resolveManifest(context.Background(), refspec, platforms.Only(tc.platform))
+		if err != nil {
+			t.Fatalf("cannot resolve %s: %v", tc.ref, err)
+		}
+		if desc.Digest != tc.expected.Digest || len(manifest.Layers) != tc.layers {
+			t.Fatalf("unexpected manifest of %s for %s; expected = %s, got = %s", tc.ref, platforms.Format(tc.platform), tc.expected.Digest, desc.Digest)
+		}
+	}
+
+	refspec, _ := reference.Parse(host + "/repo:tag")
+	if _, _, err := fs.resolveManifest(context.Background(), refspec, platforms.Only(ocispec.Platform{OS: "windows", Architecture: "amd64"})); err == nil {
+		t.Fatalf("resolved a manifest for a platform missing from the image index")
+	}
+}
@@ -0,0 +1,476 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package quota accounts the registry egress and cache usage of each containerd namespace,
+// and enforces the limits configured for the namespaces.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// saveInterval is the minimum interval between the saves of the usage as it changes.
+// The usage is saved regardless when layers are unmounted and when the manager is closed.
+const saveInterval = 30 * time.Second
+
+// ErrQuotaExceeded is matched by the errors returned when a namespace exceeds a quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Resource is a resource limited by quotas.
+type Resource string
+
+const (
+	// Fetch is the number of bytes fetched from registries.
+	Fetch Resource = "fetch"
+	// Cache is the number of bytes held in the span cache.
+	Cache Resource = "cache"
+)
+
+// ExceededError is returned when the usage of a resource by a namespace reached its limit.
+type ExceededError struct {
+	Namespace string
+	Resource  Resource
+	Limit     int64
+	Usage     int64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota of namespace %q exceeded: %d of %d bytes used", e.Resource, e.Namespace, e.Usage, e.Limit)
+}
+
+// Is makes ExceededError match ErrQuotaExceeded.
+func (e *ExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Usage is the usage of the resources of a namespace.
+// A zero limit means unlimited.
+type Usage struct {
+	Namespace  string `json:"namespace"`
+	Layers     int    `json:"layers"`
+	FetchBytes int64  `json:"fetchBytes"`
+	FetchLimit int64  `json:"fetchLimit,omitempty"`
+	CacheBytes int64  `json:"cacheBytes"`
+	CacheLimit int64  `json:"cacheLimit,omitempty"`
+}
+
+// exceeded returns an ExceededError if the namespace reached one of its limits.
+func (u Usage) exceeded() error {
+	if u.FetchLimit > 0 && u.FetchBytes >= u.FetchLimit {
+		return &ExceededError{Namespace: u.Namespace, Resource: Fetch, Limit: u.FetchLimit, Usage: u.FetchBytes}
+	}
+	if u.CacheLimit > 0 && u.CacheBytes >= u.CacheLimit {
+		return &ExceededError{Namespace: u.Namespace, Resource: Cache, Limit: u.CacheLimit, Usage: u.CacheBytes}
+	}
+	return nil
+}
+
+// counters are the usage of a namespace, as persisted.
+type counters struct {
+	FetchBytes int64 `json:"fetchBytes"`
+	CacheBytes int64 `json:"cacheBytes"`
+}
+
+// Mount is a layer mounted for a namespace.
+type Mount struct {
+	Namespace string
+	Digest    digest.Digest
+}
+
+// Manager accounts the usage of each namespace as the spans of its layers are fetched and cached.
+// The bytes fetched from registries accumulate until they are reset, e.g. by an operator, and the
+// bytes cached decrease as spans are removed from the cache.
+type Manager struct {
+	config config.QuotaConfig
+	// limited is whether any namespace has a limit, so that checks are free otherwise.
+	limited bool
+
+	mu sync.Mutex
+	// mounts lists the mounted layers, or is nil if no layers are mounted.
+	mounts func() []Mount
+	usage  map[string]*counters
+	// path is the file the usage is persisted in, or "" if it isn't persisted.
+	path     string
+	dirty    bool
+	saving   bool
+	lastSave time.Time
+	// saveMu serializes the saves, so that older usage doesn't replace newer one.
+	saveMu sync.Mutex
+}
+
+// NewManager returns a manager enforcing the quotas of `cfg`.
+func NewManager(cfg config.QuotaConfig) *Manager {
+	limited := cfg.FetchBytes > 0 || cfg.CacheBytes > 0
+	for _, o := range cfg.Namespaces {
+		limited = limited || o.FetchBytes > 0 || o.CacheBytes > 0
+	}
+	return &Manager{
+		config:  cfg,
+		limited: limited,
+		usage:   make(map[string]*counters),
+	}
+}
+
+// Persist makes the manager persist the usage of the namespaces in the file at `path`, so that
+// it survives restarts, and loads the usage persisted there. The usage accounted so far is
+// replaced. If the persisted usage can't be loaded, an error is returned and the usage is
+// persisted in the file anyway. It must be called before the manager is used.
+func (m *Manager) Persist(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.path = path
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	usage := make(map[string]*counters)
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return fmt.Errorf("invalid quota usage in %q: %w", path, err)
+	}
+	m.usage = usage
+	return nil
+}
+
+// SetMounts makes the manager list the mounted layers with `mounts`, e.g. those of the filesystem
+// it's passed to. The spans of layers shared by all namespaces are accounted to the namespaces
+// mounting them. It must be called before the manager is used.
+func (m *Manager) SetMounts(mounts func() []Mount) {
+	m.mu.Lock()
+	m.mounts = mounts
+	m.mu.Unlock()
+}
+
+// Save saves the usage now, if it's persisted, e.g. once a layer is unmounted.
+// The usage accounted for unmounted layers is kept.
+func (m *Manager) Save() error {
+	return m.save()
+}
+
+// Close saves the usage, if it's persisted.
+func (m *Manager) Close() error {
+	return m.save()
+}
+
+// CheckNamespace returns an ExceededError if namespace reached one of its limits,
+// e.g. to refuse mounting more layers in it.
+func (m *Manager) CheckNamespace(namespace string) error {
+	if !m.limited {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usageOf(namespace, m.mountsLocked()).exceeded()
+}
+
+// AddFetched accounts `n` bytes fetched from registries to namespace, e.g. for layers
+// unpacked locally instead of being mounted lazily.
+func (m *Manager) AddFetched(namespace string, n int64) {
+	m.add(namespace, n, 0)
+}
+
+// Meter returns the meter of the spans of the layer with digest `dgst` resolved for namespace.
+// If namespace is "", the layer is shared by all namespaces, and each of its spans is accounted
+// once, to one of the namespaces mounting the layer: the first one within its limits, since
+// CheckFetch only refuses to fetch the spans of a layer if all of them reached their limits.
+// Spans of shared layers which aren't mounted aren't accounted.
+func (m *Manager) Meter(dgst digest.Digest, namespace string) spanmanager.UsageMeter {
+	return &meter{m: m, digest: dgst, namespace: namespace, cached: make(map[string]int64)}
+}
+
+// Usage returns the usage of all the namespaces with mounted layers or accounted usage,
+// sorted by namespace.
+func (m *Manager) Usage() []Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	namespaces := make(map[string]bool)
+	for ns := range m.usage {
+		namespaces[ns] = true
+	}
+	mounts := m.mountsLocked()
+	for _, mnt := range mounts {
+		namespaces[mnt.Namespace] = true
+	}
+	usage := make([]Usage, 0, len(namespaces))
+	for ns := range namespaces {
+		usage = append(usage, m.usageOf(ns, mounts))
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Namespace < usage[j].Namespace })
+	return usage
+}
+
+// Reset resets the bytes fetched from registries by namespace, e.g. at the start of a billing period.
+func (m *Manager) Reset(namespace string) {
+	m.mu.Lock()
+	if u, ok := m.usage[namespace]; ok && u.FetchBytes != 0 {
+		u.FetchBytes = 0
+		m.dirty = true
+	}
+	m.mu.Unlock()
+	if err := m.save(); err != nil {
+		log.L.WithError(err).Warn("failed to save quota usage")
+	}
+}
+
+// mountsLocked returns the mounted layers. m.mu must be held.
+func (m *Manager) mountsLocked() []Mount {
+	if m.mounts == nil {
+		return nil
+	}
+	return m.mounts()
+}
+
+// usageOf returns the usage of namespace with the layers `mounts` mounted. A layer mounted
+// several times in a namespace is counted once. m.mu must be held.
+func (m *Manager) usageOf(namespace string, mounts []Mount) Usage {
+	layers := make(map[digest.Digest]bool)
+	for _, mnt := range mounts {
+		if mnt.Namespace == namespace {
+			layers[mnt.Digest] = true
+		}
+	}
+	u := Usage{Namespace: namespace, Layers: len(layers)}
+	if c, ok := m.usage[namespace]; ok {
+		u.FetchBytes, u.CacheBytes = c.FetchBytes, c.CacheBytes
+	}
+	u.FetchLimit, u.CacheLimit = m.limits(namespace)
+	return u
+}
+
+// accountTo returns the namespace to account the spans of the layer with digest `dgst` resolved
+// for namespace to, or "" if they aren't accounted, and an ExceededError if the spans must not be
+// fetched because the namespace reached one of its limits.
+func (m *Manager) accountTo(dgst digest.Digest, namespace string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mounts := m.mountsLocked()
+	if namespace != "" {
+		return namespace, m.usageOf(namespace, mounts).exceeded()
+	}
+	var namespaces []string
+	seen := make(map[string]bool)
+	for _, mnt := range mounts {
+		if mnt.Digest == dgst && !seen[mnt.Namespace] {
+			seen[mnt.Namespace] = true
+			namespaces = append(namespaces, mnt.Namespace)
+		}
+	}
+	if len(namespaces) == 0 {
+		return "", nil
+	}
+	sort.Strings(namespaces)
+	var err error
+	for _, ns := range namespaces {
+		if err = m.usageOf(ns, mounts).exceeded(); err == nil {
+			return ns, nil
+		}
+	}
+	return namespaces[0], err
+}
+
+// add adds `fetch` and `cache` bytes to the usage of namespace, and saves the usage in the
+// background if it wasn't saved for a while.
+func (m *Manager) add(namespace string, fetch, cache int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.usage[namespace]
+	if !ok {
+		c = &counters{}
+		m.usage[namespace] = c
+	}
+	c.FetchBytes += fetch
+	c.CacheBytes += cache
+	// Spans cached before the usage was persisted may be removed afterwards.
+	if c.CacheBytes < 0 {
+		c.CacheBytes = 0
+	}
+	m.dirty = true
+	if m.path != "" && !m.saving && time.Since(m.lastSave) >= saveInterval {
+		m.saving = true
+		go func() {
+			if err := m.save(); err != nil {
+				log.L.WithError(err).Warn("failed to save quota usage")
+			}
+		}()
+	}
+}
+
+// save atomically writes the usage to the file it's persisted in, if it changed.
+func (m *Manager) save() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	m.mu.Lock()
+	if m.path == "" || !m.dirty {
+		m.saving = false
+		m.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(m.usage)
+	path := m.path
+	m.dirty, m.saving, m.lastSave = false, false, time.Now()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFile(path, b); err != nil {
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+		return fmt.Errorf("failed to save quota usage to %q: %w", path, err)
+	}
+	return nil
+}
+
+// writeFile atomically replaces the file at path with `b`.
+func writeFile(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// limits returns the limits of namespace. 0 means unlimited.
+func (m *Manager) limits(namespace string) (fetch, cache int64) {
+	fetch, cache = m.config.FetchBytes, m.config.CacheBytes
+	if o, ok := m.config.Namespaces[namespace]; ok {
+		if o.FetchBytes != 0 {
+			fetch = o.FetchBytes
+		}
+		if o.CacheBytes != 0 {
+			cache = o.CacheBytes
+		}
+	}
+	if fetch < 0 {
+		fetch = 0
+	}
+	if cache < 0 {
+		cache = 0
+	}
+	return fetch, cache
+}
+
+// ServeHTTP reports the usage of all the namespaces as JSON. DELETE requests reset the bytes
+// fetched by the namespace of the `namespace` query parameter.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Usage())
+	case http.MethodDelete:
+		namespace := r.URL.Query().Get("namespace")
+		if namespace == "" {
+			http.Error(w, "namespace is required", http.StatusBadRequest)
+			return
+		}
+		m.Reset(namespace)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// meter accounts the usage of the spans of a layer.
+type meter struct {
+	m         *Manager
+	digest    digest.Digest
+	namespace string
+
+	mu sync.Mutex
+	// cached are the bytes of the spans in the cache accounted to each namespace,
+	// so that they're released from the same namespaces once removed.
+	cached map[string]int64
+}
+
+var _ spanmanager.UsageMeter = &meter{}
+
+func (mt *meter) CheckFetch() error {
+	if !mt.m.limited {
+		return nil
+	}
+	_, err := mt.m.accountTo(mt.digest, mt.namespace)
+	return err
+}
+
+func (mt *meter) AddFetched(n int64) {
+	if ns, _ := mt.m.accountTo(mt.digest, mt.namespace); ns != "" {
+		mt.m.add(ns, n, 0)
+	}
+}
+
+func (mt *meter) AddCached(n int64) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if n >= 0 {
+		if ns, _ := mt.m.accountTo(mt.digest, mt.namespace); ns != "" {
+			mt.cached[ns] += n
+			mt.m.add(ns, 0, n)
+		}
+		return
+	}
+	namespaces := make([]string, 0, len(mt.cached))
+	for ns := range mt.cached {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		released := -n
+		if released > mt.cached[ns] {
+			released = mt.cached[ns]
+		}
+		mt.cached[ns] -= released
+		if mt.cached[ns] == 0 {
+			delete(mt.cached, ns)
+		}
+		mt.m.add(ns, 0, -released)
+		if n += released; n == 0 {
+			return
+		}
+	}
+	// The rest of the spans were cached before the meter was created, e.g. restored from
+	// the persistent index after a restart.
+	if ns, _ := mt.m.accountTo(mt.digest, mt.namespace); ns != "" {
+		mt.m.add(ns, 0, n)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package quota
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestManager(t *testing.T) {
+	cfg := config.QuotaConfig{
+		FetchBytes: 100,
+		CacheBytes: 1000,
+		Namespaces: map[string]config.NamespaceQuotaConfig{
+			"unlimited": {FetchBytes: -1, CacheBytes: -1},
+			"small":     {CacheBytes: 10},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "quota.json")
+	m := NewManager(cfg)
+	if err := m.Persist(path); err != nil {
+		t.Fatalf("failed to load missing usage: %v", err)
+	}
+	shared, heavy := digest.FromString("shared"), digest.FromString("heavy")
+	mounts := []Mount{
+		{Namespace: "default", Digest: shared},
+		// A layer mounted several times in a namespace counts once.
+		{Namespace: "default", Digest: shared},
+		{Namespace: "small", Digest: shared},
+		{Namespace: "unlimited", Digest: heavy},
+	}
+	m.SetMounts(func() []Mount { return mounts })
+
+	// Layers resolved for a namespace are accounted to it.
+	m.Meter(shared, "default").AddFetched(40)
+	m.Meter(shared, "small").AddCached(8)
+	heavyMeter := m.Meter(heavy, "unlimited")
+	heavyMeter.AddFetched(1000)
+	heavyMeter.AddCached(1000)
+	heavyMeter.AddCached(-400)
+	expected := []Usage{
+		{Namespace: "default", Layers: 1, FetchBytes: 40, FetchLimit: 100, CacheLimit: 1000},
+		{Namespace: "small", Layers: 1, CacheBytes: 8, FetchLimit: 100, CacheLimit: 10},
+		{Namespace: "unlimited", Layers: 1, FetchBytes: 1000, CacheBytes: 600},
+	}
+	if diff := cmp.Diff(expected, m.Usage()); diff != "" {
+		t.Fatalf("unexpected usage (-want +got):\n%s", diff)
+	}
+	for _, ns := range []string{"default", "small", "unlimited", "empty"} {
+		if err := m.CheckNamespace(ns); err != nil {
+			t.Fatalf("unexpected error of namespace %q within its limits: %v", ns, err)
+		}
+	}
+
+	m.Meter(shared, "small").AddCached(2)
+	err := m.CheckNamespace("small")
+	var exceeded *ExceededError
+	if !errors.Is(err, ErrQuotaExceeded) || !errors.As(err, &exceeded) || exceeded.Resource != Cache || exceeded.Usage != 10 {
+		t.Fatalf("unexpected error of namespace exceeding its cache quota: %v", err)
+	}
+	if err := m.Meter(shared, "small").CheckFetch(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected spans of namespace exceeding its quota not to be fetched: %v", err)
+	}
+
+	// Spans of layers shared by all namespaces are accounted once, to the first namespace
+	// within its limits which mounted the layer.
+	sharedMeter := m.Meter(shared, "")
+	if err := sharedMeter.CheckFetch(); err != nil {
+		t.Fatalf("unexpected error of layer shared with namespaces within their limits: %v", err)
+	}
+	sharedMeter.AddFetched(60)
+	sharedMeter.AddCached(5)
+	if err := m.CheckNamespace("default"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected namespace to exceed its fetch quota: %v", err)
+	}
+	if err := sharedMeter.CheckFetch(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected layer of namespaces exceeding their quotas not to be fetched: %v", err)
+	}
+	// Removed spans are released from the namespaces they were accounted to.
+	sharedMeter.AddCached(-5)
+
+	// The usage outlives the mounts and restarts.
+	mounts = nil
+	if err := m.Save(); err != nil {
+		t.Fatalf("failed to save usage: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("failed to save usage: %v", err)
+	}
+	m = NewManager(cfg)
+	if err := m.Persist(path); err != nil {
+		t.Fatalf("failed to load usage: %v", err)
+	}
+	expected = []Usage{
+		{Namespace: "default", FetchBytes: 100, FetchLimit: 100, CacheLimit: 1000},
+		{Namespace: "small", CacheBytes: 10, FetchLimit: 100, CacheLimit: 10},
+		{Namespace: "unlimited", FetchBytes: 1000, CacheBytes: 600},
+	}
+	if diff := cmp.Diff(expected, m.Usage()); diff != "" {
+		t.Fatalf("unexpected usage after restart (-want +got):\n%s", diff)
+	}
+	// Spans of shared layers which aren't mounted aren't accounted.
+	m.Meter(shared, "").AddFetched(10)
+	if diff := cmp.Diff(expected, m.Usage()); diff != "" {
+		t.Fatalf("unexpected usage after fetching unmounted layer (-want +got):\n%s", diff)
+	}
+
+	m.Reset("default")
+	if err := m.CheckNamespace("default"); err != nil {
+		t.Fatalf("unexpected error of namespace whose fetch usage was reset: %v", err)
+	}
+}
@@ -55,7 +55,7 @@ import (
 )
 
 type Reader interface {
-	OpenFile(id uint32) (io.ReaderAt, error)
+	OpenFile(id uint32, opts ...OpenOption) (io.ReaderAt, error)
 	Metadata() metadata.Reader
 	Close() error
 	LastOnDemandReadTime() time.Time
@@ -164,19 +164,26 @@ func (gr *reader) LastOnDemandReadTime() time.Time {
 	return t
 }
 
-func (gr *reader) OpenFile(id uint32) (io.ReaderAt, error) {
+func (gr *reader) OpenFile(id uint32, opts ...OpenOption) (io.ReaderAt, error) {
 	if gr.isClosed() {
 		return nil, fmt.Errorf("reader is already closed")
 	}
+	openOpts := openOptions{
+		priority: spanmanager.PriorityNormal,
+	}
+	for _, o := range opts {
+		o(&openOpts)
+	}
 	var fr metadata.File
 	fr, err := gr.r.OpenFile(id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %d: %w", id, err)
 	}
 	return &file{
-		id: id,
-		fr: fr,
-		gr: gr,
+		id:       id,
+		fr:       fr,
+		gr:       gr,
+		priority: openOpts.priority,
 	}, nil
 }
 
@@ -201,9 +208,12 @@ func (gr *reader) isClosed() bool {
 }
 
 type file struct {
-	id uint32
-	fr metadata.File
-	gr *reader
+	id       uint32
+	fr       metadata.File
+	gr       *reader
+	priority spanmanager.Priority
+	// pattern records the reads of the file for the read-ahead of sequential reads.
+	pattern spanmanager.AccessPattern
 }
 
 // ReadAt reads the file when the file is requested by the container
@@ -221,7 +231,7 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	}
 	fileOffsetStart := sf.fr.GetUncompressedOffset() + compression.Offset(offset)
 	fileOffsetEnd := fileOffsetStart + expectedSize
-	r, err := sf.gr.spanManager.GetContents(fileOffsetStart, fileOffsetEnd)
+	r, err := sf.gr.spanManager.GetContentsWithPriority(fileOffsetStart, fileOffsetEnd, sf.priority)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read the file: %w", err)
 	}
@@ -235,10 +245,25 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		return 0, fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d", n, expectedSize)
 	}
 	commonmetrics.AddBytesCount(commonmetrics.SynchronousBytesServed, sf.gr.layerSha, int64(n)) // measure the number of bytes served synchronously
+	sf.gr.spanManager.ObserveRead(&sf.pattern, fileOffsetStart, fileOffsetEnd)
 
 	return n, nil
 }
 
+// OpenOption configures a file opened with OpenFile.
+type OpenOption func(*openOptions)
+
+type openOptions struct {
+	priority spanmanager.Priority
+}
+
+// WithPriority sets the priority of the remote fetches issued while reading the file.
+func WithPriority(p spanmanager.Priority) OpenOption {
+	return func(opts *openOptions) {
+		opts.priority = p
+	}
+}
+
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
@@ -0,0 +1,207 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package reexport re-exports lazily loaded layers over virtiofs or NFS so that
+// VM-isolated runtimes (e.g. Kata containers, Firecracker microVMs) can consume
+// their contents without waiting for the whole image to be pulled.
+//
+// Layers are always exported read-only. Reads from the guest go through the
+// FUSE filesystem of the layer, so they are served lazily like any other read.
+package reexport
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	// ModeVirtiofs re-exports every layer with its own virtiofsd daemon.
+	ModeVirtiofs = "virtiofs"
+	// ModeNFS re-exports every layer with the kernel NFS server, using exportfs.
+	ModeNFS = "nfs"
+
+	defaultVirtiofsdPath = "virtiofsd"
+	defaultExportfsPath  = "exportfs"
+	defaultSocketDir     = "/run/soci-snapshotter-grpc/virtiofs"
+)
+
+// Exporter re-exports layer mountpoints.
+type Exporter interface {
+	// Export starts exporting the layer mounted at mountpoint.
+	Export(ctx context.Context, mountpoint string) error
+	// Unexport stops exporting the layer mounted at mountpoint.
+	// It must be called before the layer is unmounted.
+	Unexport(ctx context.Context, mountpoint string) error
+}
+
+// New creates an Exporter from the config. It returns nil if re-exporting is disabled.
+func New(cfg config.ReexportConfig) (Exporter, error) {
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case ModeVirtiofs:
+		virtiofsdPath := cfg.VirtiofsdPath
+		if virtiofsdPath == "" {
+			virtiofsdPath = defaultVirtiofsdPath
+		}
+		if _, err := exec.LookPath(virtiofsdPath); err != nil {
+			return nil, fmt.Errorf("cannot find virtiofsd: %w", err)
+		}
+		socketDir := cfg.SocketDir
+		if socketDir == "" {
+			socketDir = defaultSocketDir
+		}
+		if err := os.MkdirAll(socketDir, 0700); err != nil {
+			return nil, err
+		}
+		return &virtiofsExporter{
+			virtiofsdPath: virtiofsdPath,
+			socketDir:     socketDir,
+			daemons:       make(map[string]*exec.Cmd),
+		}, nil
+	case ModeNFS:
+		// Layers are exported to every host matching the clients, so they must be chosen explicitly.
+		if cfg.NFSClients == "" {
+			return nil, fmt.Errorf("nfs_clients must be set to re-export layers over NFS")
+		}
+		if _, err := exec.LookPath(defaultExportfsPath); err != nil {
+			return nil, fmt.Errorf("cannot find exportfs: %w", err)
+		}
+		return &nfsExporter{
+			exportfsPath: defaultExportfsPath,
+			clients:      cfg.NFSClients,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown re-export mode %q; must be %q or %q", cfg.Mode, ModeVirtiofs, ModeNFS)
+	}
+}
+
+// exportID returns a stable, filesystem-safe ID of the export of mountpoint.
+func exportID(mountpoint string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(mountpoint)))[:16]
+}
+
+// SocketPath returns the path of the vhost-user socket a VMM should connect to
+// in order to mount the layer at mountpoint, when exporting over virtiofs.
+func SocketPath(socketDir, mountpoint string) string {
+	if socketDir == "" {
+		socketDir = defaultSocketDir
+	}
+	return filepath.Join(socketDir, exportID(mountpoint)+".sock")
+}
+
+type virtiofsExporter struct {
+	virtiofsdPath string
+	socketDir     string
+
+	mu      sync.Mutex
+	daemons map[string]*exec.Cmd // mountpoint -> virtiofsd
+}
+
+func (e *virtiofsExporter) args(mountpoint string) []string {
+	return []string{
+		"--socket-path=" + SocketPath(e.socketDir, mountpoint),
+		"--shared-dir=" + mountpoint,
+		"--readonly",
+		// The layer is already sandboxed by the FUSE filesystem, which only serves the layer contents.
+		"--sandbox=none",
+		"--cache=auto",
+	}
+}
+
+func (e *virtiofsExporter) Export(ctx context.Context, mountpoint string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.daemons[mountpoint]; ok {
+		return nil
+	}
+	// The daemon must outlive the request context, so it is not started with exec.CommandContext.
+	cmd := exec.Command(e.virtiofsdPath, e.args(mountpoint)...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start virtiofsd for %q: %w", mountpoint, err)
+	}
+	e.daemons[mountpoint] = cmd
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Debug("virtiofsd exited")
+		}
+	}()
+	log.G(ctx).WithField("mountpoint", mountpoint).WithField("socket", SocketPath(e.socketDir, mountpoint)).
+		Info("re-exported layer over virtiofs")
+	return nil
+}
+
+func (e *virtiofsExporter) Unexport(ctx context.Context, mountpoint string) error {
+	e.mu.Lock()
+	cmd, ok := e.daemons[mountpoint]
+	delete(e.daemons, mountpoint)
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		return fmt.Errorf("failed to stop virtiofsd for %q: %w", mountpoint, err)
+	}
+	os.Remove(SocketPath(e.socketDir, mountpoint))
+	return nil
+}
+
+type nfsExporter struct {
+	exportfsPath string
+	clients      string
+}
+
+func (e *nfsExporter) exportArgs(mountpoint string) []string {
+	// FUSE filesystems have no stable device number, so NFS needs an explicit fsid.
+	return []string{
+		"-o", "ro,no_subtree_check,fsid=" + nfsFsid(mountpoint),
+		e.clients + ":" + mountpoint,
+	}
+}
+
+func (e *nfsExporter) unexportArgs(mountpoint string) []string {
+	return []string{"-u", e.clients + ":" + mountpoint}
+}
+
+func (e *nfsExporter) Export(ctx context.Context, mountpoint string) error {
+	if out, err := exec.CommandContext(ctx, e.exportfsPath, e.exportArgs(mountpoint)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to export %q over NFS: %w: %s", mountpoint, err, out)
+	}
+	log.G(ctx).WithField("mountpoint", mountpoint).Info("re-exported layer over NFS")
+	return nil
+}
+
+func (e *nfsExporter) Unexport(ctx context.Context, mountpoint string) error {
+	if out, err := exec.CommandContext(ctx, e.exportfsPath, e.unexportArgs(mountpoint)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to unexport %q from NFS: %w: %s", mountpoint, err, out)
+	}
+	return nil
+}
+
+// nfsFsid derives an NFS fsid (a UUID) from the mountpoint, so the same layer
+// keeps the same fsid across snapshotter restarts.
+func nfsFsid(mountpoint string) string {
+	h := sha256.Sum256([]byte(mountpoint))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reexport
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNew(t *testing.T) {
+	e, err := New(config.ReexportConfig{})
+	if err != nil || e != nil {
+		t.Fatalf("expected no exporter when re-export is disabled; got = %v, err = %v", e, err)
+	}
+	if _, err := New(config.ReexportConfig{Mode: "iscsi"}); err == nil {
+		t.Fatalf("expected an error for an unknown re-export mode")
+	}
+}
+
+func TestVirtiofsArgs(t *testing.T) {
+	e := &virtiofsExporter{socketDir: "/run/test"}
+	mountpoint := "/var/lib/soci-snapshotter-grpc/snapshotter/snapshots/1/fs"
+	expected := []string{
+		"--socket-path=/run/test/" + exportID(mountpoint) + ".sock",
+		"--shared-dir=" + mountpoint,
+		"--readonly",
+		"--sandbox=none",
+		"--cache=auto",
+	}
+	if diff := cmp.Diff(expected, e.args(mountpoint)); diff != "" {
+		t.Fatalf("unexpected virtiofsd args, diff = %v", diff)
+	}
+}
+
+func TestNFSArgs(t *testing.T) {
+	e := &nfsExporter{clients: "10.0.0.0/8"}
+	mountpoint := "/var/lib/soci-snapshotter-grpc/snapshotter/snapshots/1/fs"
+	expected := []string{"-o", "ro,no_subtree_check,fsid=" + nfsFsid(mountpoint), "10.0.0.0/8:" + mountpoint}
+	if diff := cmp.Diff(expected, e.exportArgs(mountpoint)); diff != "" {
+		t.Fatalf("unexpected exportfs args, diff = %v", diff)
+	}
+	expected = []string{"-u", "10.0.0.0/8:" + mountpoint}
+	if diff := cmp.Diff(expected, e.unexportArgs(mountpoint)); diff != "" {
+		t.Fatalf("unexpected exportfs args, diff = %v", diff)
+	}
+}
+
+func TestNFSFsid(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	a := nfsFsid("/a/fs")
+	if !uuid.MatchString(a) {
+		t.Fatalf("fsid %q is not a UUID", a)
+	}
+	if a != nfsFsid("/a/fs") {
+		t.Fatalf("fsid is not stable")
+	}
+	if a == nfsFsid("/b/fs") {
+		t.Fatalf("different mountpoints have the same fsid")
+	}
+}
+
+func TestNFSRequiresClients(t *testing.T) {
+	if _, err := New(config.ReexportConfig{Mode: ModeNFS}); err == nil {
+		t.Fatalf("layers were re-exported over NFS without clients")
+	}
+}
@@ -0,0 +1,458 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package artifactstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/mtls"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testImage is an image with a layer, a SOCI index of its manifest, and a blob of its repository
+// which isn't part of the image.
+type testImage struct {
+	manifest, config, layer, sociIndex, ztoc, stray ocispec.Descriptor
+	blobs                                           map[digest.Digest][]byte
+	toc                                             *ztoc.Ztoc
+}
+
+func newTestImage(t *testing.T) *testImage {
+	contents := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(contents)
+	toc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{testutil.File("data", string(contents))}, gzip.BestCompression, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toc.MaxSpanID < 2 {
+		t.Fatalf("expected several spans, got %d", toc.MaxSpanID+1)
+	}
+	img := &testImage{blobs: make(map[digest.Digest][]byte), toc: toc}
+	add := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		img.blobs[desc.Digest] = b
+		return desc
+	}
+	layer, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.layer = add(ocispec.MediaTypeImageLayerGzip, layer)
+	img.config = add(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	img.stray = add(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"arm64","os":"linux"}`))
+	img.manifest = add(ocispec.MediaTypeImageManifest, mustMarshal(t, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    img.config,
+		Layers:    []ocispec.Descriptor{img.layer},
+	}))
+	zr, zdesc, err := ztoc.Marshal(toc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.ztoc = add(soci.SociLayerMediaType, b)
+	img.ztoc.Annotations = map[string]string{soci.IndexAnnotationImageLayerDigest: img.layer.Digest.String()}
+	if zdesc.Digest != img.ztoc.Digest {
+		t.Fatal("unexpected ztoc digest")
+	}
+	manifest := img.manifest
+	img.sociIndex = add(ocispec.MediaTypeImageManifest, mustMarshal(t, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: soci.SociIndexArtifactType, Digest: digest.FromString("{}"), Size: 2},
+		Layers:    []ocispec.Descriptor{img.ztoc},
+		Subject:   &manifest,
+	}))
+	return img
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testRegistry serves a test image at test/image:latest and records the
+// ranges of blobs requested, except the probes of the resolver.
+type testRegistry struct {
+	*httptest.Server
+	img *testImage
+
+	mu      sync.Mutex
+	fetches map[digest.Digest][]string
+	// corrupt flips a byte of the layer when it's served.
+	corrupt bool
+}
+
+func newTestRegistry(t *testing.T, img *testImage) *testRegistry {
+	r := &testRegistry{img: img, fetches: make(map[digest.Digest][]string)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Path, "/v2/test/image/")
+		kind, ref, _ := strings.Cut(path, "/")
+		var desc ocispec.Descriptor
+		switch {
+		case kind == "manifests" && (ref == "latest" || ref == img.manifest.Digest.String()):
+			desc = img.manifest
+			w.Header().Set("Content-Type", desc.MediaType)
+			w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		case kind == "blobs":
+			desc.Digest = digest.Digest(ref)
+		}
+		b, ok := img.blobs[desc.Digest]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		r.mu.Lock()
+		if kind == "blobs" && req.Header.Get("Range") != "bytes=0-1" {
+			r.fetches[desc.Digest] = append(r.fetches[desc.Digest], req.Header.Get("Range"))
+		}
+		if desc.Digest == img.layer.Digest && r.corrupt {
+			b = append([]byte{}, b...)
+			b[len(b)/2] ^= 0xff
+		}
+		r.mu.Unlock()
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(b))
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// ranges returns the ranges of a blob fetched from the registry.
+func (r *testRegistry) ranges(dgst digest.Digest) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.fetches[dgst]...)
+}
+
+func (r *testRegistry) ref(t *testing.T) reference.Spec {
+	refspec, err := reference.Parse(strings.TrimPrefix(r.URL, "http://") + "/test/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refspec
+}
+
+func newTestServer(t *testing.T, registry *testRegistry, blobCache cache.BlobCache, opts ...Option) *Server {
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := func(reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       registry.Client(),
+			Host:         u.Host,
+			Scheme:       "http",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+		}}, nil
+	}
+	if blobCache == nil {
+		var err error
+		if blobCache, err = cache.NewDirectoryCache(t.TempDir(), cache.DirectoryCacheConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { blobCache.Close() })
+	}
+	s, err := NewServer(hosts, remote.NewResolver(config.BlobConfig{}, nil, nil), blobCache, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func fetch(t *testing.T, s *Source, refspec reference.Spec, desc ocispec.Descriptor, off, size int64) (string, error) {
+	rc, err := s.Fetch(context.Background(), refspec, desc, off, size)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	return string(b), err
+}
+
+// spanRange returns the range of the compressed contents of spans first to last of a zTOC.
+func spanRange(t *testing.T, toc *ztoc.Ztoc, first, last compression.SpanID) (int64, int64) {
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zinfo.Close()
+	start := int64(zinfo.StartCompressedOffset(first))
+	return start, int64(zinfo.EndCompressedOffset(last, toc.CompressedArchiveSize)) - start
+}
+
+func TestArtifactStore(t *testing.T) {
+	img := newTestImage(t)
+	registry := newTestRegistry(t, img)
+	server := httptest.NewServer(newTestServer(t, registry, nil))
+	defer server.Close()
+	s, err := NewSource(config.ArtifactStoreConfig{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refspec := registry.ref(t)
+
+	// Blobs are only served for an image reference.
+	if _, err := fetch(t, s, reference.Spec{}, img.config, 0, img.config.Size); err == nil {
+		t.Fatal("expected blob without image reference not to be served")
+	}
+	// Blobs which aren't part of the image aren't served, even if the registry has them.
+	if _, err := fetch(t, s, refspec, img.stray, 0, img.stray.Size); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected blob outside of the image to be forbidden: %v", err)
+	}
+
+	// Documents are fetched whole and served by ranges from the cache.
+	for i := 0; i < 2; i++ {
+		if got, err := fetch(t, s, refspec, img.config, 2, 12); err != nil || got != string(img.blobs[img.config.Digest][2:14]) {
+			t.Fatalf("unexpected range of config: %q, %v", got, err)
+		}
+	}
+	if got := registry.ranges(img.config.Digest); len(got) != 1 {
+		t.Fatalf("expected config to be fetched once, got %v", got)
+	}
+
+	// The SOCI index of the manifest is served, which allows its zTOC to be served.
+	for _, desc := range []ocispec.Descriptor{img.sociIndex, img.ztoc} {
+		if got, err := fetch(t, s, refspec, desc, 0, desc.Size); err != nil || got != string(img.blobs[desc.Digest]) {
+			t.Fatalf("unexpected blob %s: %v", desc.Digest, err)
+		}
+	}
+
+	// Ranges of spans of the layer are fetched on their own, and fetched once.
+	layer := img.blobs[img.layer.Digest]
+	off, size := spanRange(t, img.toc, 1, 2)
+	for i := 0; i < 2; i++ {
+		if got, err := fetch(t, s, refspec, img.layer, off, size); err != nil || got != string(layer[off:off+size]) {
+			t.Fatalf("unexpected spans of layer: %v", err)
+		}
+	}
+	whole := fmt.Sprintf("bytes=0-%d", img.layer.Size-1)
+	if got := registry.ranges(img.layer.Digest); len(got) != 2 || got[0] == whole || got[1] == whole {
+		t.Fatalf("expected the two spans of the layer to be fetched once, got %v", got)
+	}
+
+	// Other ranges of the layer can't be verified on their own, so the whole layer is fetched.
+	if got, err := fetch(t, s, refspec, img.layer, off+1, 10); err != nil || got != string(layer[off+1:off+11]) {
+		t.Fatalf("unexpected range of layer: %v", err)
+	}
+	if got := registry.ranges(img.layer.Digest); len(got) != 3 || got[2] != whole {
+		t.Fatalf("expected the whole layer to be fetched, got %v", got)
+	}
+}
+
+func TestArtifactStoreVerification(t *testing.T) {
+	img := newTestImage(t)
+	registry := newTestRegistry(t, img)
+	registry.corrupt = true
+	server := httptest.NewServer(newTestServer(t, registry, nil))
+	defer server.Close()
+	s, err := NewSource(config.ArtifactStoreConfig{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refspec := registry.ref(t)
+	if _, err := fetch(t, s, refspec, img.sociIndex, 0, img.sociIndex.Size); err != nil {
+		t.Fatal(err)
+	}
+
+	// The corrupted span isn't served.
+	for id := compression.SpanID(0); id <= img.toc.MaxSpanID; id++ {
+		off, size := spanRange(t, img.toc, id, id)
+		if off > img.layer.Size/2 || off+size <= img.layer.Size/2 {
+			continue
+		}
+		if _, err := fetch(t, s, refspec, img.layer, off, size); err == nil || !strings.Contains(err.Error(), "doesn't match digest") {
+			t.Fatalf("expected corrupted span %d not to be served: %v", id, err)
+		}
+	}
+	// Neither are other ranges of the corrupted layer.
+	if _, err := fetch(t, s, refspec, img.layer, 0, 10); err == nil || !strings.Contains(err.Error(), "doesn't match digest") {
+		t.Fatalf("expected range of corrupted layer not to be served: %v", err)
+	}
+}
+
+func TestArtifactStoreRegistries(t *testing.T) {
+	img := newTestImage(t)
+	registry := newTestRegistry(t, img)
+	server := httptest.NewServer(newTestServer(t, registry, nil, WithRegistries([]string{"registry.example.com"})))
+	defer server.Close()
+	s, err := NewSource(config.ArtifactStoreConfig{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch(t, s, registry.ref(t), img.config, 0, img.config.Size); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected image of another registry to be forbidden: %v", err)
+	}
+	if len(registry.ranges(img.config.Digest)) != 0 {
+		t.Fatal("expected registry not to be contacted")
+	}
+}
+
+func TestArtifactStoreMaxCacheSize(t *testing.T) {
+	img := newTestImage(t)
+	registry := newTestRegistry(t, img)
+	dir := t.TempDir()
+	blobCache, err := cache.NewDirectoryCache(dir, cache.DirectoryCacheConfig{Direct: true, Persistent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blobCache.Close()
+	refspec := registry.ref(t)
+	ctx := context.Background()
+	serve := func(s *Server, desc ocispec.Descriptor) {
+		rc, err := s.open(ctx, refspec, desc, 0, desc.Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+	}
+	isCached := func(desc ocispec.Descriptor) bool {
+		_, err := blobCache.Get(cacheKey(desc.Digest, 0, desc.Size), cache.Direct())
+		return err == nil
+	}
+
+	// The cache holds the manifest and the config, but not the layer too.
+	maxSize := img.manifest.Size + img.config.Size
+	s := newTestServer(t, registry, blobCache, WithMaxCacheSize(dir, maxSize))
+	serve(s, img.manifest)
+	serve(s, img.config)
+	if !isCached(img.manifest) || !isCached(img.config) {
+		t.Fatal("expected manifest and config to be cached")
+	}
+	serve(s, img.manifest)
+	serve(s, img.layer)
+	if !isCached(img.layer) || isCached(img.manifest) || isCached(img.config) {
+		t.Fatal("expected manifest and config to be evicted by layer")
+	}
+
+	// Blobs cached by previous runs count towards the size of the cache.
+	s = newTestServer(t, registry, blobCache, WithMaxCacheSize(dir, maxSize))
+	serve(s, img.config)
+	if isCached(img.layer) || !isCached(img.config) {
+		t.Fatal("expected layer cached by previous run to be evicted")
+	}
+}
+
+func TestArtifactStoreUnixSocket(t *testing.T) {
+	img := newTestImage(t)
+	registry := newTestRegistry(t, img)
+	socket := filepath.Join(t.TempDir(), "artifacts.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newTestServer(t, registry, nil)}
+	go server.Serve(l)
+	defer server.Close()
+
+	s, err := NewSource(config.ArtifactStoreConfig{Address: "unix://" + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fetch(t, s, registry.ref(t), img.config, 0, 4); err != nil || got != string(img.blobs[img.config.Digest][:4]) {
+		t.Fatalf("unexpected range: %q, %v", got, err)
+	}
+}
+
+func TestArtifactStoreMutualTLS(t *testing.T) {
+	img := newTestImage(t)
+	registry := newTestRegistry(t, img)
+	certs := testutil.WriteCertificates(t, t.TempDir())
+	tlsConfig, err := mtls.ServerConfig(certs.ServerCert, certs.ServerKey, certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(newTestServer(t, registry, nil))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "https://")
+
+	s, err := NewSource(config.ArtifactStoreConfig{Address: address, TLS: config.TLSConfig{
+		CertFile: certs.ClientCert,
+		KeyFile:  certs.ClientKey,
+		CAFile:   certs.CA,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fetch(t, s, registry.ref(t), img.config, 0, 4); err != nil || got != string(img.blobs[img.config.Digest][:4]) {
+		t.Fatalf("unexpected range: %q, %v", got, err)
+	}
+
+	// TCP addresses require a client certificate.
+	if _, err := NewSource(config.ArtifactStoreConfig{Address: address}); err == nil {
+		t.Fatal("expected source without client certificate to fail")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		off, size  int64
+		shouldFail bool
+	}{
+		{header: "bytes=0-9", off: 0, size: 10},
+		{header: "bytes=4-", off: 4, size: 12},
+		{header: "bytes=4-100", off: 4, size: 12},
+		{header: "bytes=16-20", shouldFail: true},
+		{header: "bytes=0-1,4-5", shouldFail: true},
+		{header: "items=0-1", shouldFail: true},
+	}
+	for _, tt := range tests {
+		off, size, err := parseRange(tt.header, 16)
+		if tt.shouldFail {
+			if err == nil {
+				t.Fatalf("expected range %q to be invalid", tt.header)
+			}
+			continue
+		}
+		if err != nil || off != tt.off || size != tt.size {
+			t.Fatalf("unexpected range of %q: %d+%d, %v", tt.header, off, size, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package artifactstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/containerdutil"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// graphTTL is how long the contents of an image are served before its reference
+	// is resolved again, e.g. since its tag may have moved.
+	graphTTL = 10 * time.Minute
+
+	// maxDocumentSize is the size of the largest manifest, index or SOCI index fetched.
+	maxDocumentSize = 16 << 20
+
+	// maxIndexDepth is the depth of the deepest nested image index.
+	maxIndexDepth = 4
+)
+
+// blobKind is how a blob of an image is fetched and verified.
+type blobKind int
+
+const (
+	// kindDocument blobs (manifests, configs, SOCI indices and zTOCs) are fetched whole and
+	// verified against their digests.
+	kindDocument blobKind = iota
+	// kindLayer blobs are fetched by ranges, which are verified against the span digests of
+	// the zTOC of the layer.
+	kindLayer
+)
+
+// graph is the content of an image which is served for its reference: its manifests, configs and
+// layers, and the SOCI indices of its manifests with their zTOCs.
+type graph struct {
+	expires time.Time
+
+	mu        sync.Mutex
+	manifests map[digest.Digest]struct{}
+	blobs     map[digest.Digest]blobKind
+	// ztocs are the zTOCs of the layers of the image, by layer digest.
+	ztocs map[digest.Digest]ocispec.Descriptor
+}
+
+func newGraph(now time.Time) *graph {
+	return &graph{
+		expires:   now.Add(graphTTL),
+		manifests: make(map[digest.Digest]struct{}),
+		blobs:     make(map[digest.Digest]blobKind),
+		ztocs:     make(map[digest.Digest]ocispec.Descriptor),
+	}
+}
+
+// kind returns the kind of a blob of the image, or false if the blob isn't part of it.
+func (g *graph) kind(dgst digest.Digest) (blobKind, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	kind, ok := g.blobs[dgst]
+	return kind, ok
+}
+
+// ztoc returns the descriptor of the zTOC of a layer of the image, if a SOCI index of the image has one.
+func (g *graph) ztoc(layer digest.Digest) (ocispec.Descriptor, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	desc, ok := g.ztocs[layer]
+	return desc, ok
+}
+
+// addIndex adds the SOCI index `dgst` to the image if it's an index of a manifest of the image.
+func (g *graph) addIndex(dgst digest.Digest, index *soci.Index) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if index.ArtifactType != soci.SociIndexArtifactType || index.Subject == nil {
+		return false
+	}
+	if _, ok := g.manifests[index.Subject.Digest]; !ok {
+		return false
+	}
+	g.blobs[dgst] = kindDocument
+	for _, blob := range index.Blobs {
+		g.blobs[blob.Digest] = kindDocument
+		layer, err := digest.Parse(blob.Annotations[soci.IndexAnnotationImageLayerDigest])
+		if err != nil {
+			continue
+		}
+		if _, ok := g.ztocs[layer]; !ok {
+			g.ztocs[layer] = blob
+		}
+	}
+	return true
+}
+
+// graph returns the content of the image of refspec, which is resolved
+// with the credentials of the service unless it was resolved recently.
+func (s *Server) graph(ctx context.Context, refspec reference.Spec) (*graph, error) {
+	ref := refspec.String()
+	if g := s.cachedGraph(ref); g != nil {
+		return g, nil
+	}
+	s.resolveMu.Lock(ref)
+	defer s.resolveMu.Unlock(ref)
+	if g := s.cachedGraph(ref); g != nil {
+		return g, nil
+	}
+	g, err := s.resolveGraph(ctx, refspec)
+	if err != nil {
+		return nil, err
+	}
+
+	s.graphsMu.Lock()
+	defer s.graphsMu.Unlock()
+	for r, cached := range s.graphs {
+		if time.Now().After(cached.expires) {
+			delete(s.graphs, r)
+		}
+	}
+	s.graphs[ref] = g
+	return g, nil
+}
+
+func (s *Server) cachedGraph(ref string) *graph {
+	s.graphsMu.Lock()
+	defer s.graphsMu.Unlock()
+	if g, ok := s.graphs[ref]; ok && time.Now().Before(g.expires) {
+		return g
+	}
+	return nil
+}
+
+// resolveGraph resolves the reference of an image and walks its manifests.
+func (s *Server) resolveGraph(ctx context.Context, refspec reference.Spec) (*graph, error) {
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != refspec.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, refspec.String())
+			}
+			return s.hosts(refspec)
+		},
+	})
+	name, desc, err := resolver.Resolve(ctx, refspec.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", refspec.String(), err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	g := newGraph(time.Now())
+	sociIndices, err := g.walk(ctx, fetcher, desc, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", refspec.String(), err)
+	}
+	for dgst, sociIndex := range sociIndices {
+		g.addIndex(dgst, sociIndex)
+	}
+	return g, nil
+}
+
+// walk adds a manifest or image index and the blobs it refers to to the image. The manifests of
+// all the platforms of an index are walked, since snapshotters of any platform may use the service.
+// The SOCI indices found in indices are returned, to be added once all the manifests are known.
+func (g *graph) walk(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, depth int) (map[digest.Digest]*soci.Index, error) {
+	sociIndices := make(map[digest.Digest]*soci.Index)
+	g.blobs[desc.Digest] = kindDocument
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		if depth >= maxIndexDepth {
+			return nil, fmt.Errorf("image index %s is nested too deeply", desc.Digest)
+		}
+		b, err := containerdutil.FetchDocument(ctx, fetcher, desc, maxDocumentSize)
+		if err != nil {
+			return nil, err
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return nil, fmt.Errorf("invalid image index %s: %w", desc.Digest, err)
+		}
+		for _, m := range index.Manifests {
+			found, err := g.walk(ctx, fetcher, m, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			for dgst, sociIndex := range found {
+				sociIndices[dgst] = sociIndex
+			}
+		}
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		b, err := containerdutil.FetchDocument(ctx, fetcher, desc, maxDocumentSize)
+		if err != nil {
+			return nil, err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %w", desc.Digest, err)
+		}
+		if manifest.ArtifactType == soci.SociIndexArtifactType || manifest.Config.MediaType == soci.SociIndexArtifactType {
+			var sociIndex soci.Index
+			if err := soci.UnmarshalIndex(b, &sociIndex); err != nil {
+				return nil, fmt.Errorf("invalid SOCI index %s: %w", desc.Digest, err)
+			}
+			sociIndices[desc.Digest] = &sociIndex
+			return sociIndices, nil
+		}
+		g.manifests[desc.Digest] = struct{}{}
+		g.blobs[manifest.Config.Digest] = kindDocument
+		for _, layer := range manifest.Layers {
+			g.blobs[layer.Digest] = kindLayer
+		}
+	}
+	return sociIndices, nil
+}
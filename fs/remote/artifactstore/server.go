@@ -0,0 +1,526 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package artifactstore implements a content-addressable artifact service, which fetches,
+// caches and serves the blobs of images (SOCI indices, zTOCs and the spans of layers) for
+// several snapshotters, and the blob source with which snapshotters fetch blobs through it.
+//
+// Blobs are served over HTTP at `/v1/blobs/<digest>?size=<size>&ref=<image ref>`, optionally
+// with a single `Range` header. Only the blobs of the image of the reference are served: its
+// manifests, configs and layers, and the SOCI indices of its manifests with their zTOCs. Blobs
+// are verified before they are cached and served: whole blobs against their digests, and
+// ranges of layers against the span digests of their zTOCs.
+package artifactstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/awslabs/soci-snapshotter/util/lrucache"
+	"github.com/awslabs/soci-snapshotter/util/namedmutex"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// BlobsPath is the path under which blobs are served.
+	BlobsPath = "/v1/blobs/"
+
+	refParam  = "ref"
+	sizeParam = "size"
+
+	// fetchChunkSize is the size of the chunks blobs are fetched from the registry in,
+	// so that fetching a whole layer doesn't buffer it in memory.
+	fetchChunkSize = 4 << 20
+
+	// maxCachedZtocs is the number of zTOCs whose spans are kept in memory to verify ranges of layers.
+	maxCachedZtocs = 256
+)
+
+var (
+	errNotCached = errors.New("blob is not cached")
+	errForbidden = errors.New("blob is not part of the image")
+)
+
+// Option is an option of a Server.
+type Option func(*Server) error
+
+// WithRegistries restricts the images whose blobs are served to the images of registries,
+// e.g. `registry.example.com:5000`, so that snapshotters can't make the service send requests
+// to other hosts. Images of any registry are served if registries is empty.
+func WithRegistries(registries []string) Option {
+	return func(s *Server) error {
+		for _, r := range registries {
+			s.registries[r] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// WithMaxCacheSize bounds the size of the blobs cached in directory, the directory of the blob
+// cache, to maxSize bytes. The least recently served blobs are removed first, including those
+// cached by previous runs. The blob cache must implement cache.Remover.
+func WithMaxCacheSize(directory string, maxSize int64) Option {
+	return func(s *Server) error {
+		remover, ok := s.blobCache.(cache.Remover)
+		if !ok {
+			return errors.New("blob cache doesn't support removing blobs")
+		}
+		usage, err := newCacheUsage(directory, maxSize, func(key string) {
+			if err := remover.Remove(key); err != nil {
+				log.L.WithError(err).WithField("key", key).Warn("failed to remove blob from artifact cache")
+			}
+		})
+		s.usage = usage
+		return err
+	}
+}
+
+// Server serves the blobs of images, fetching them from registries when they aren't cached.
+type Server struct {
+	hosts      source.RegistryHosts
+	resolver   *remote.Resolver
+	blobCache  cache.BlobCache
+	registries map[string]struct{}
+	// usage bounds the size of blobCache. It's nil if blobCache is unbounded.
+	usage *cacheUsage
+
+	graphsMu sync.Mutex
+	graphs   map[string]*graph
+	// resolveMu serializes the resolutions of the same image reference.
+	resolveMu namedmutex.NamedMutex
+
+	// spans caches the spans of zTOCs, by zTOC digest.
+	spans *lrucache.Cache
+
+	// fetchMu serializes the fetches of the same range, so that concurrent
+	// requests of snapshotters for the same span fetch it once.
+	fetchMu namedmutex.NamedMutex
+}
+
+// NewServer returns a server which fetches blobs from the registries configured by hosts
+// with resolver, and caches them in blobCache.
+func NewServer(hosts source.RegistryHosts, resolver *remote.Resolver, blobCache cache.BlobCache, opts ...Option) (*Server, error) {
+	s := &Server{
+		hosts:      hosts,
+		resolver:   resolver,
+		blobCache:  blobCache,
+		registries: make(map[string]struct{}),
+		graphs:     make(map[string]*graph),
+		spans:      lrucache.New(maxCachedZtocs),
+	}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dgst, err := digest.Parse(strings.TrimPrefix(r.URL.Path, BlobsPath))
+	if err != nil || !strings.HasPrefix(r.URL.Path, BlobsPath) {
+		http.Error(w, "invalid blob path", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	blobSize, err := strconv.ParseInt(query.Get(sizeParam), 10, 64)
+	if err != nil || blobSize <= 0 {
+		http.Error(w, "invalid blob size", http.StatusBadRequest)
+		return
+	}
+	refspec, err := reference.Parse(query.Get(refParam))
+	if err != nil {
+		http.Error(w, "invalid image reference", http.StatusBadRequest)
+		return
+	}
+	off, size := int64(0), blobSize
+	ranged := r.Header.Get("Range") != ""
+	if ranged {
+		if off, size, err = parseRange(r.Header.Get("Range"), blobSize); err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", blobSize))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	ctx := logutil.WithLayer(r.Context(), dgst)
+	desc := ocispec.Descriptor{Digest: dgst, Size: blobSize}
+	cr, err := s.open(ctx, refspec, desc, off, size)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("failed to serve blob")
+		switch {
+		case errors.Is(err, errForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	defer cr.Close()
+
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+size-1, blobSize))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if _, err := io.Copy(w, cr); err != nil {
+		log.G(ctx).WithError(err).Debug("failed to write blob")
+	}
+}
+
+// open returns a reader of `size` bytes of the blob described by desc starting at `off`, if the
+// blob is part of the image of refspec. The blob is fetched from the registry of the image, verified
+// and cached unless it is cached already. Ranges of layers are fetched on their own if they are
+// made of spans of the zTOC of the layer; other ranges are served from the whole blob.
+func (s *Server) open(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, off, size int64) (io.ReadCloser, error) {
+	g, kind, err := s.authorize(ctx, refspec, desc)
+	if err != nil {
+		return nil, err
+	}
+	if rc, err := s.cached(desc, off, size); err == nil {
+		return rc, nil
+	}
+	fetchOff, fetchSize := int64(0), desc.Size
+	var spans []span
+	if kind == kindLayer && size != desc.Size {
+		spans, err = s.layerSpans(ctx, refspec, g, desc.Digest, off, size)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("failed to get spans of layer; fetching whole layer")
+		}
+		if spans != nil {
+			fetchOff, fetchSize = off, size
+		}
+	}
+	if err := s.fetchOnce(ctx, refspec, desc, fetchOff, fetchSize, spans); err != nil {
+		return nil, err
+	}
+	return s.cached(desc, off, size)
+}
+
+// authorize returns the image of refspec and the kind of the blob described by desc in the image,
+// or errForbidden if the blob isn't part of the image.
+func (s *Server) authorize(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) (*graph, blobKind, error) {
+	if len(s.registries) > 0 {
+		if _, ok := s.registries[refspec.Hostname()]; !ok {
+			return nil, 0, fmt.Errorf("registry %s is not allowed: %w", refspec.Hostname(), errForbidden)
+		}
+	}
+	g, err := s.graph(ctx, refspec)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind, ok := g.kind(desc.Digest); ok {
+		return g, kind, nil
+	}
+
+	// Other blobs may be SOCI indices of the manifests of the image, which can only be found
+	// through their referrers. They are fetched and verified to find out.
+	if desc.Size > maxDocumentSize {
+		return nil, 0, errForbidden
+	}
+	if err := s.fetchOnce(ctx, refspec, desc, 0, desc.Size, nil); err != nil {
+		return nil, 0, err
+	}
+	key := cacheKey(desc.Digest, 0, desc.Size)
+	r, err := s.blobCache.Get(key, cache.Direct())
+	if err != nil {
+		return nil, 0, err
+	}
+	var index soci.Index
+	err = soci.DecodeIndex(io.NewSectionReader(r, 0, desc.Size), &index)
+	r.Close()
+	if err != nil || !g.addIndex(desc.Digest, &index) {
+		s.remove(key)
+		return nil, 0, errForbidden
+	}
+	return g, kindDocument, nil
+}
+
+// cached returns a reader of a cached range, which is either the range itself
+// or a range of the whole blob.
+func (s *Server) cached(desc ocispec.Descriptor, off, size int64) (io.ReadCloser, error) {
+	for _, key := range []string{cacheKey(desc.Digest, off, size), cacheKey(desc.Digest, 0, desc.Size)} {
+		r, err := s.blobCache.Get(key, cache.Direct())
+		if err != nil {
+			continue
+		}
+		if s.usage != nil {
+			s.usage.used(key)
+		}
+		if key != cacheKey(desc.Digest, off, size) {
+			return &cacheReadCloser{io.NewSectionReader(r, off, size), r}, nil
+		}
+		return &cacheReadCloser{io.NewSectionReader(r, 0, size), r}, nil
+	}
+	return nil, errNotCached
+}
+
+// remove removes a blob from the cache.
+func (s *Server) remove(key string) {
+	if s.usage != nil {
+		s.usage.removed(key)
+		return
+	}
+	if remover, ok := s.blobCache.(cache.Remover); ok {
+		if err := remover.Remove(key); err != nil {
+			log.L.WithError(err).WithField("key", key).Warn("failed to remove blob from artifact cache")
+		}
+	}
+}
+
+// span is the range of the compressed contents of a span of a layer, and their digest.
+type span struct {
+	start, end int64
+	digest     digest.Digest
+}
+
+// layerSpans returns the spans of the zTOC of a layer which make up the range of `size` bytes
+// at `off`, or nil if the layer has no zTOC or the range doesn't start and end with spans.
+func (s *Server) layerSpans(ctx context.Context, refspec reference.Spec, g *graph, layer digest.Digest, off, size int64) ([]span, error) {
+	ztocDesc, ok := g.ztoc(layer)
+	if !ok {
+		return nil, nil
+	}
+	spans, err := s.ztocSpans(ctx, refspec, ztocDesc)
+	if err != nil {
+		return nil, err
+	}
+	first := sort.Search(len(spans), func(i int) bool { return spans[i].start >= off })
+	last := sort.Search(len(spans), func(i int) bool { return spans[i].end >= off+size })
+	if first == len(spans) || last == len(spans) || first > last ||
+		spans[first].start != off || spans[last].end != off+size {
+		return nil, nil
+	}
+	return spans[first : last+1], nil
+}
+
+// ztocSpans returns the spans of a zTOC, which is fetched and cached like other blobs.
+func (s *Server) ztocSpans(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) ([]span, error) {
+	if v, done, ok := s.spans.Get(desc.Digest.String()); ok {
+		defer done()
+		return v.([]span), nil
+	}
+	rc, err := s.cached(desc, 0, desc.Size)
+	if err != nil {
+		if err := s.fetchOnce(ctx, refspec, desc, 0, desc.Size, nil); err != nil {
+			return nil, err
+		}
+		if rc, err = s.cached(desc, 0, desc.Size); err != nil {
+			return nil, err
+		}
+	}
+	zt, err := ztoc.Unmarshal(rc)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ztoc %s: %w", desc.Digest, err)
+	}
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ztoc %s: %w", desc.Digest, err)
+	}
+	defer zinfo.Close()
+	spans := make([]span, 0, len(zt.SpanDigests))
+	for id := compression.SpanID(0); id <= zt.MaxSpanID && int(id) < len(zt.SpanDigests); id++ {
+		spans = append(spans, span{
+			start:  int64(zinfo.StartCompressedOffset(id)),
+			end:    int64(zinfo.EndCompressedOffset(id, zt.CompressedArchiveSize)),
+			digest: zt.SpanDigests[id],
+		})
+	}
+	_, done, _ := s.spans.Add(desc.Digest.String(), spans)
+	done()
+	return spans, nil
+}
+
+// fetchOnce fetches a range of a blob unless it is cached, or is being fetched by another request.
+func (s *Server) fetchOnce(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, off, size int64, spans []span) error {
+	key := cacheKey(desc.Digest, off, size)
+	s.fetchMu.Lock(key)
+	defer s.fetchMu.Unlock(key)
+	// The range may have been fetched while waiting for the lock.
+	if r, err := s.blobCache.Get(key, cache.Direct()); err == nil {
+		r.Close()
+		return nil
+	}
+	return s.fetch(ctx, refspec, desc, off, size, spans)
+}
+
+// fetch fetches a range of a blob from the registry, verifies it and caches it. Whole blobs are
+// verified against their digests, and other ranges against the digests of their spans.
+func (s *Server) fetch(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, off, size int64, spans []span) (retErr error) {
+	blob, err := s.resolver.Resolve(ctx, s.hosts, refspec, desc, nil)
+	if err != nil {
+		return fmt.Errorf("failed to resolve blob: %w", err)
+	}
+	defer blob.Close()
+
+	key := cacheKey(desc.Digest, off, size)
+	cw, err := s.blobCache.Add(key, cache.Direct())
+	if err != nil {
+		return fmt.Errorf("failed to add blob to cache: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			cw.Abort()
+		}
+		cw.Close()
+	}()
+
+	if spans != nil {
+		err = copySpans(cw, blob, off, spans)
+	} else {
+		err = copyBlob(cw, blob, desc)
+	}
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField(logutil.ImageField, refspec.String()).WithField("offset", off).WithField("size", size).
+		Debug("fetched blob range")
+	if err := cw.Commit(); err != nil {
+		return err
+	}
+	if s.usage != nil {
+		s.usage.added(key, size)
+	}
+	return nil
+}
+
+// copyBlob copies a whole blob to w in chunks and verifies it against its digest.
+func copyBlob(w io.Writer, blob remote.Blob, desc ocispec.Descriptor) error {
+	verifier := desc.Digest.Verifier()
+	buf := make([]byte, fetchChunkSize)
+	for n := int64(0); n < desc.Size; {
+		chunk := buf
+		if desc.Size-n < int64(len(chunk)) {
+			chunk = chunk[:desc.Size-n]
+		}
+		if err := readFull(blob, chunk, n); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("failed to write blob to cache: %w", err)
+		}
+		verifier.Write(chunk)
+		n += int64(len(chunk))
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("fetched blob doesn't match digest %s", desc.Digest)
+	}
+	return nil
+}
+
+// copySpans copies the range of a blob made of spans, starting at off, to w span by span, and
+// verifies each span against its digest. Consecutive spans may overlap, e.g. by a byte in gzip layers.
+func copySpans(w io.Writer, blob remote.Blob, off int64, spans []span) error {
+	var buf []byte
+	written := off
+	for _, sp := range spans {
+		if n := int(sp.end - sp.start); cap(buf) < n {
+			buf = make([]byte, n)
+		} else {
+			buf = buf[:n]
+		}
+		if err := readFull(blob, buf, sp.start); err != nil {
+			return err
+		}
+		if sp.digest.Algorithm().FromBytes(buf) != sp.digest {
+			return fmt.Errorf("fetched span %d-%d doesn't match digest %s", sp.start, sp.end-1, sp.digest)
+		}
+		if _, err := w.Write(buf[written-sp.start:]); err != nil {
+			return fmt.Errorf("failed to write blob to cache: %w", err)
+		}
+		written = sp.end
+	}
+	return nil
+}
+
+// readFull reads len(p) bytes of blob at off.
+func readFull(blob remote.Blob, p []byte, off int64) error {
+	read, err := blob.ReadAt(p, off)
+	if err != nil && !(err == io.EOF && read == len(p)) {
+		return fmt.Errorf("failed to fetch range %d-%d: %w", off, off+int64(len(p))-1, err)
+	}
+	if read != len(p) {
+		return fmt.Errorf("failed to fetch range %d-%d: short read of %d bytes", off, off+int64(len(p))-1, read)
+	}
+	return nil
+}
+
+// cacheKey returns the key of a range of a blob in the cache.
+func cacheKey(dgst digest.Digest, off, size int64) string {
+	return fmt.Sprintf("%s-%d-%d", dgst.Encoded(), off, size)
+}
+
+// parseRange parses a Range header with a single range of a blob of size blobSize.
+func parseRange(header string, blobSize int64) (off, size int64, err error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+	if off, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid range %q: %w", header, err)
+	}
+	end := blobSize - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid range %q: %w", header, err)
+		}
+		if end >= blobSize {
+			end = blobSize - 1
+		}
+	}
+	if off < 0 || off > end {
+		return 0, 0, fmt.Errorf("unsatisfiable range %q", header)
+	}
+	return off, end - off + 1, nil
+}
+
+type cacheReadCloser struct {
+	io.Reader
+	r cache.Reader
+}
+
+func (c *cacheReadCloser) Close() error {
+	return c.r.Close()
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package artifactstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/util/mtls"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultFetchTimeout = 10 * time.Second
+
+	unixScheme = "unix://"
+	// unixHost is the host of the URLs of requests to a service listening on a unix socket.
+	unixHost = "artifact-store"
+)
+
+var _ remote.BlobSource = &Source{}
+
+// Source fetches blobs through an artifact service.
+type Source struct {
+	baseURL      string
+	client       *http.Client
+	fetchTimeout time.Duration
+}
+
+// NewSource returns a blob source fetching blobs through the artifact service configured by `cfg`.
+func NewSource(cfg config.ArtifactStoreConfig) (*Source, error) {
+	fetchTimeout := time.Duration(cfg.FetchTimeoutMsec) * time.Millisecond
+	if fetchTimeout == 0 {
+		fetchTimeout = defaultFetchTimeout
+	}
+	baseURL, transport, err := dial(cfg.Address, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{
+		baseURL:      baseURL,
+		client:       &http.Client{Transport: transport},
+		fetchTimeout: fetchTimeout,
+	}, nil
+}
+
+// dial returns the base URL of the service at address and the transport to connect to it.
+// The address is either a `unix://` socket path or the URL of a service listening on TCP, which
+// requires mutual TLS with the certificates of tlsConfig. The scheme of URLs defaults to https.
+func dial(address string, tlsConfig config.TLSConfig) (string, http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(address, unixScheme) {
+		path := strings.TrimPrefix(address, unixScheme)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		return "http://" + unixHost, transport, nil
+	}
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return "", nil, fmt.Errorf("invalid artifact store address %q", address)
+	}
+	if u.Scheme == "https" {
+		if transport.TLSClientConfig, err = mtls.ClientConfig(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.CAFile); err != nil {
+			return "", nil, fmt.Errorf("invalid TLS config of artifact store: %w", err)
+		}
+	}
+	return strings.TrimSuffix(address, "/"), transport, nil
+}
+
+func (s *Source) Name() string {
+	return "artifact-store"
+}
+
+// Fetch returns `size` bytes of the blob starting at `off` from the artifact service, which fetches
+// it from the registry of the image `refspec` if it isn't cached yet.
+func (s *Source) Fetch(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, off, size int64) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set(sizeParam, strconv.FormatInt(desc.Size, 10))
+	if refspec.Locator != "" {
+		query.Set(refParam, refspec.String())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	// The timeout only applies until the service starts serving the blob,
+	// since it may have to fetch large ranges from the registry first.
+	timer := time.AfterFunc(s.fetchTimeout, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+BlobsPath+desc.Digest.String()+"?"+query.Encode(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+size-1))
+	resp, err := s.client.Do(req)
+	timedOut := !timer.Stop()
+	if err != nil {
+		cancel()
+		if timedOut {
+			return nil, fmt.Errorf("timed out after %v", s.fetchTimeout)
+		}
+		return nil, fmt.Errorf("failed to fetch %s from artifact store: %w", desc.Digest, err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		defer cancel()
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("failed to fetch %s from artifact store: unexpected status code %v: %s",
+			desc.Digest, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if resp.ContentLength != size {
+		cancel()
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected size of range of %s from artifact store: %d, expected %d",
+			desc.Digest, resp.ContentLength, size)
+	}
+	return &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// cancelReadCloser cancels the context of the request once its body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package artifactstore
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cacheUsage bounds the size of the cached blobs, removing the least recently served ones.
+type cacheUsage struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// lru holds the *usageEntry of the cached blobs, the most recently served first.
+	lru     *list.List
+	entries map[string]*list.Element
+	remove  func(key string)
+}
+
+type usageEntry struct {
+	key  string
+	size int64
+}
+
+// newCacheUsage returns the usage of the blob cache in directory, which already holds the blobs
+// cached by previous runs. remove removes a blob from the cache once it's evicted.
+func newCacheUsage(directory string, maxSize int64, remove func(key string)) (*cacheUsage, error) {
+	u := &cacheUsage{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		remove:  remove,
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read artifact cache: %w", err)
+	}
+	type cached struct {
+		key     string
+		size    int64
+		modTime int64
+	}
+	var blobs []cached
+	for _, e := range entries {
+		size, ok := parseCacheKey(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, cached{e.Name(), size, info.ModTime().UnixNano()})
+	}
+	// The blobs cached last are assumed to be the most recently served.
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].modTime < blobs[j].modTime })
+	for _, b := range blobs {
+		u.added(b.key, b.size)
+	}
+	return u, nil
+}
+
+// used marks a cached blob as served.
+func (u *cacheUsage) used(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e, ok := u.entries[key]; ok {
+		u.lru.MoveToFront(e)
+	}
+}
+
+// added records a blob added to the cache, and evicts the least recently served blobs
+// if the cache is full. The blob just added is kept even if it's larger than the cache.
+func (u *cacheUsage) added(key string, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e, ok := u.entries[key]; ok {
+		u.lru.MoveToFront(e)
+		return
+	}
+	u.entries[key] = u.lru.PushFront(&usageEntry{key: key, size: size})
+	u.size += size
+	for u.size > u.maxSize && u.lru.Len() > 1 {
+		e := u.lru.Back()
+		u.evict(e)
+	}
+}
+
+// removed records a blob removed from the cache.
+func (u *cacheUsage) removed(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e, ok := u.entries[key]; ok {
+		u.evict(e)
+	}
+}
+
+func (u *cacheUsage) evict(e *list.Element) {
+	entry := u.lru.Remove(e).(*usageEntry)
+	delete(u.entries, entry.key)
+	u.size -= entry.size
+	// Readers of the blob can keep reading it once it's removed.
+	u.remove(entry.key)
+}
+
+// parseCacheKey returns the size of the blob range of a cache key returned by cacheKey.
+func parseCacheKey(key string) (int64, bool) {
+	parts := strings.Split(key, "-")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	return size, err == nil && size >= 0
+}
@@ -48,6 +48,8 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -72,6 +74,20 @@ type blob struct {
 	lastCheckMu   sync.Mutex
 	checkInterval time.Duration
 	fetchTimeout  time.Duration
+	// retryBudget is shared by the fetches of the blob, so that they fail fast
+	// once it is exhausted. Nil means each fetch is retried up to MaxRetries times.
+	retryBudget *socihttp.RetryBudget
+
+	// fullFetchOnIgnoredRange makes the blob download itself in the background once its host
+	// is known to ignore Range headers. See config.BlobConfig.FullFetchOnIgnoredRange.
+	fullFetchOnIgnoredRange bool
+	// downloadDir is the directory of the background download. See Resolver.SetDownloadDir.
+	downloadDir string
+	full        *fullFetch
+	// fullyRead is set once every region of the blob has been read, after which the background
+	// download is released, since the regions are read from the span cache from then on.
+	fullyRead bool
+	fullMu    sync.Mutex
 
 	fetchedRegionSet   regionSet
 	fetchedRegionSetMu sync.Mutex
@@ -96,10 +112,17 @@ func makeBlob(fetcher fetcher, size int64, lastCheck time.Time, checkInterval ti
 
 func (b *blob) Close() error {
 	b.closedMu.Lock()
-	defer b.closedMu.Unlock()
 	if !b.closed {
 		b.closed = true
 	}
+	b.closedMu.Unlock()
+	// A background download started before the blob was closed is stopped here.
+	b.fullMu.Lock()
+	if b.full != nil {
+		b.full.close()
+		b.full = nil
+	}
+	b.fullMu.Unlock()
 	return nil
 }
 
@@ -220,16 +243,36 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 	fr := b.fetcher
 	b.fetcherMu.Unlock()
 
+	if ff := b.fullFetch(fr); ff != nil {
+		err := ff.readRegion(reg, w)
+		if err == nil {
+			b.fetchedRegionSetMu.Lock()
+			b.fetchedRegionSet.add(reg)
+			b.fetchedRegionSetMu.Unlock()
+			if b.FetchedSize() >= b.size {
+				b.releaseFullFetch(ff)
+			}
+			return nil
+		}
+		log.L.WithError(err).Warn("failed to read region from background download of blob; fetching it")
+		b.dropFullFetch(ff)
+	}
+
 	fetchCtx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
 	defer cancel()
 	if opts.ctx != nil {
 		fetchCtx = opts.ctx
 	}
+	if b.retryBudget != nil {
+		fetchCtx = socihttp.WithRetryBudget(fetchCtx, b.retryBudget)
+	}
 
 	var req []region
 	req = append(req, reg)
 	mr, err := fr.fetch(fetchCtx, req, true)
-
+	if b.resolver != nil {
+		b.resolver.recordFetch(err)
+	}
 	if err != nil {
 		return err
 	}
@@ -241,12 +284,18 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 	b.lastCheckMu.Unlock()
 
 	for {
-		_, p, err := mr.Next()
+		got, p, err := mr.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return fmt.Errorf("failed to read multipart resp: %w", err)
 		}
+		// Hosts which ignore Range headers return the whole blob.
+		if got.b < reg.b {
+			if _, err := io.CopyN(io.Discard, p, reg.b-got.b); err != nil {
+				return err
+			}
+		}
 
 		if _, err := io.CopyN(w, p, reg.size()); err != nil {
 			return err
@@ -265,6 +314,54 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 	return nil
 }
 
+// fullFetch returns the background download of the blob if its host ignores Range headers,
+// starting it if needed. It returns nil if the blob is fetched by ranges.
+func (b *blob) fullFetch(fr fetcher) *fullFetch {
+	if !b.fullFetchOnIgnoredRange {
+		return nil
+	}
+	b.fullMu.Lock()
+	defer b.fullMu.Unlock()
+	if b.full != nil || b.fullyRead {
+		return b.full
+	}
+	hf, ok := fr.(*httpFetcher)
+	if !ok || !socihttp.IgnoresRange(hf.host()) || b.isClosed() {
+		return nil
+	}
+	ff, err := startFullFetch(b.downloadDir, fr, b.size)
+	if err != nil {
+		log.L.WithError(err).Warn("failed to start background download of blob")
+		return nil
+	}
+	b.full = ff
+	return ff
+}
+
+// dropFullFetch discards the background download ff after it failed, so that
+// the next reads start a new one.
+func (b *blob) dropFullFetch(ff *fullFetch) {
+	b.fullMu.Lock()
+	if b.full == ff {
+		b.full = nil
+	}
+	b.fullMu.Unlock()
+	ff.close()
+}
+
+// releaseFullFetch releases the background download ff once every region of the blob has been
+// read from it, i.e. once the span cache holds the whole blob, rather than when the blob is closed.
+// Regions which are read again, e.g. after they are evicted, are fetched like for other hosts.
+func (b *blob) releaseFullFetch(ff *fullFetch) {
+	b.fullMu.Lock()
+	if b.full == ff {
+		b.full = nil
+		b.fullyRead = true
+	}
+	b.fullMu.Unlock()
+	ff.close()
+}
+
 // fetchRange fetches content from remote blob.
 func (b *blob) fetchRange(reg region, w io.Writer, opts *options) error {
 	return b.fetchRegion(reg, w, false, opts)
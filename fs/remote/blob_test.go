@@ -45,7 +45,9 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"net/textproto"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -53,6 +55,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
 )
 
 const (
@@ -291,11 +295,11 @@ func TestParallelDownloadingBehavior(t *testing.T) {
 		if tr.count != tst.roundtripCount {
 			t.Errorf("%v test failed: the round trip count should be %v, but was %v", tst.name, tst.roundtripCount, tr.count)
 		}
-		// Check for contents
+		// Check for contents. The round tripper returns the whole content, which each region is taken from.
 		for j := range contentBytes {
 			for i := 0; i < int(tst.regions[j].size()); i++ {
-				if contentBytes[j][i] != []byte(tst.content)[i] {
-					t.Errorf("%v test failed: the output sequence is wrong, wanted %v, got %v", tst.name, []byte(tst.content)[i], contentBytes[j])
+				if want := []byte(tst.content)[tst.regions[j].b+int64(i)]; contentBytes[j][i] != want {
+					t.Errorf("%v test failed: the output sequence is wrong, wanted %v, got %v", tst.name, want, contentBytes[j])
 					break
 				}
 			}
@@ -303,6 +307,72 @@ func TestParallelDownloadingBehavior(t *testing.T) {
 	}
 }
 
+func TestIgnoredRange(t *testing.T) {
+	contents := []byte(strings.Repeat(sampleData1, 1000))
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The Range header is ignored and the whole blob is returned.
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(contents)
+	}))
+	defer srv.Close()
+
+	config := socihttp.NewRetryableClientConfig()
+	config.MaxRetries = 0
+	b := makeBlob(&httpFetcher{
+		url: srv.URL,
+		tr:  socihttp.NewRetryableClient(config).Transport,
+	}, int64(len(contents)), time.Now(), 0, &Resolver{}, time.Duration(defaultFetchTimeoutSec)*time.Second)
+	b.fullFetchOnIgnoredRange = true
+	b.downloadDir = t.TempDir()
+	defer b.Close()
+
+	read := func(offset int64) {
+		p := make([]byte, 7)
+		if _, err := b.ReadAt(p, offset); err != nil {
+			t.Fatalf("failed to read at %d: %v", offset, err)
+		}
+		if want := contents[offset : offset+int64(len(p))]; !bytes.Equal(p, want) {
+			t.Fatalf("unexpected data at %d; want %q, got %q", offset, want, p)
+		}
+	}
+	// The region is taken from the whole blob.
+	read(3)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if !socihttp.IgnoresRange(host) {
+		t.Fatalf("host %s not detected to ignore Range headers", host)
+	}
+	// The next reads are served from a single background download of the blob.
+	for _, offset := range []int64{0, 4242, int64(len(contents)) - 7} {
+		read(offset)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("unexpected number of requests; want 2, got %d", n)
+	}
+
+	// The download is released once every region of the blob has been read from it.
+	for offset := int64(0); offset < int64(len(contents)); offset += 1000 {
+		p := make([]byte, 1000)
+		if _, err := b.ReadAt(p, offset); err != nil {
+			t.Fatalf("failed to read at %d: %v", offset, err)
+		}
+	}
+	b.fullMu.Lock()
+	released := b.full == nil && b.fullyRead
+	b.fullMu.Unlock()
+	if !released {
+		t.Fatal("background download wasn't released once the whole blob was read")
+	}
+	if entries, err := os.ReadDir(b.downloadDir); err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected files in the download directory: %v, %v", entries, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("unexpected number of requests; want 2, got %d", n)
+	}
+}
+
 func makeTestBlob(t *testing.T, size int64, fn RoundTripFunc) *blob {
 	var (
 		lastCheck     time.Time
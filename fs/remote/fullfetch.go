@@ -0,0 +1,145 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// fullFetch is the background download of a whole blob, for blobs of hosts which ignore
+// Range headers: each fetch of a region from such a host downloads the whole blob, so the blob
+// is downloaded once instead, and regions are read from the download once it has reached them.
+type fullFetch struct {
+	file   *os.File
+	size   int64
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written int64
+	done    bool
+	err     error
+	// reading is the number of reads of the file in progress, which close waits for.
+	reading int
+	closed  bool
+}
+
+// startFullFetch starts downloading the blob of `size` bytes with `fr` in the background, to a
+// file in `dir`, or in the default directory for temporary files if it's empty.
+func startFullFetch(dir string, fr fetcher, size int64) (*fullFetch, error) {
+	file, err := os.CreateTemp(dir, "soci-blob-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file for blob download: %w", err)
+	}
+	// The file is only used through its descriptor, so it's removed once it's closed.
+	os.Remove(file.Name())
+	ctx, cancel := context.WithCancel(context.Background())
+	ff := &fullFetch{file: file, size: size, cancel: cancel}
+	ff.cond = sync.NewCond(&ff.mu)
+	go ff.run(ctx, fr)
+	return ff, nil
+}
+
+func (ff *fullFetch) run(ctx context.Context, fr fetcher) {
+	err := ff.download(ctx, fr)
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	if err == nil && ff.written < ff.size {
+		err = io.ErrUnexpectedEOF
+	}
+	ff.err = err
+	ff.done = true
+	ff.cond.Broadcast()
+}
+
+func (ff *fullFetch) download(ctx context.Context, fr fetcher) error {
+	mr, err := fr.fetch(ctx, []region{{0, ff.size - 1}}, true)
+	if err != nil {
+		return err
+	}
+	defer mr.Close()
+	reg, p, err := mr.Next()
+	if err != nil {
+		return err
+	}
+	if reg.b != 0 {
+		return fmt.Errorf("unexpected region %v of blob download", reg)
+	}
+	_, err = io.CopyN(ff, p, ff.size)
+	return err
+}
+
+// Write appends p to the download and wakes up the reads waiting for it.
+func (ff *fullFetch) Write(p []byte) (int, error) {
+	ff.mu.Lock()
+	off := ff.written
+	ff.mu.Unlock()
+	n, err := ff.file.WriteAt(p, off)
+	ff.mu.Lock()
+	ff.written += int64(n)
+	ff.cond.Broadcast()
+	ff.mu.Unlock()
+	return n, err
+}
+
+// readRegion writes the region `reg` of the blob to `w` once the download has reached it.
+func (ff *fullFetch) readRegion(reg region, w io.Writer) error {
+	if reg.e >= ff.size {
+		reg.e = ff.size - 1
+	}
+	ff.mu.Lock()
+	for ff.written <= reg.e && !ff.done && !ff.closed {
+		ff.cond.Wait()
+	}
+	written, err, closed := ff.written, ff.err, ff.closed
+	if !closed {
+		ff.reading++
+	}
+	ff.mu.Unlock()
+	if closed {
+		return errors.New("background download of blob is closed")
+	}
+	defer func() {
+		ff.mu.Lock()
+		ff.reading--
+		ff.cond.Broadcast()
+		ff.mu.Unlock()
+	}()
+	if written <= reg.e {
+		return fmt.Errorf("background download of blob failed: %w", err)
+	}
+	_, err = io.Copy(w, io.NewSectionReader(ff.file, reg.b, reg.size()))
+	return err
+}
+
+// close stops the download and releases its file once the reads in progress are done.
+func (ff *fullFetch) close() {
+	ff.cancel()
+	ff.mu.Lock()
+	ff.closed = true
+	ff.cond.Broadcast()
+	for !ff.done || ff.reading > 0 {
+		ff.cond.Wait()
+	}
+	ff.mu.Unlock()
+	ff.file.Close()
+}
@@ -0,0 +1,217 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ipfs implements a blob source which fetches blobs from an IPFS node
+// through its (Kubo) RPC API, so that spans and zTOCs can be shared peer-to-peer.
+package ipfs
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultAPIAddress         = "http://127.0.0.1:5001"
+	defaultFetchTimeout       = 2 * time.Second
+	defaultUnavailableBackoff = 5 * time.Minute
+
+	urlScheme = "ipfs://"
+)
+
+var (
+	// ErrUnavailable is returned for blobs which IPFS recently failed to serve.
+	ErrUnavailable = errors.New("blob is unavailable on IPFS")
+
+	// cidV1RawSha256Prefix is the prefix of the binary CIDv1 of a raw block hashed with sha2-256:
+	// the CID version, the raw multicodec, the sha2-256 multihash code and the digest length.
+	cidV1RawSha256Prefix = []byte{0x01, 0x55, 0x12, 0x20}
+
+	// base32Encoding is the multibase base32 encoding (prefix `b`) used for CIDv1 by default.
+	base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+var _ remote.BlobSource = &Source{}
+
+// Source fetches blobs from an IPFS node.
+type Source struct {
+	apiAddress         string
+	client             *http.Client
+	fetchTimeout       time.Duration
+	unavailableBackoff time.Duration
+
+	mu          sync.Mutex
+	unavailable map[digest.Digest]time.Time // digest -> time until which IPFS is not asked for it
+
+	now func() time.Time
+}
+
+// NewSource returns a blob source fetching blobs from the IPFS node configured by `cfg`.
+func NewSource(cfg config.IPFSConfig) *Source {
+	apiAddress := cfg.APIAddress
+	if apiAddress == "" {
+		apiAddress = defaultAPIAddress
+	}
+	fetchTimeout := time.Duration(cfg.FetchTimeoutMsec) * time.Millisecond
+	if fetchTimeout == 0 {
+		fetchTimeout = defaultFetchTimeout
+	}
+	unavailableBackoff := time.Duration(cfg.UnavailableBackoffSec) * time.Second
+	if unavailableBackoff == 0 {
+		unavailableBackoff = defaultUnavailableBackoff
+	}
+	return &Source{
+		apiAddress:         strings.TrimSuffix(apiAddress, "/"),
+		client:             &http.Client{},
+		fetchTimeout:       fetchTimeout,
+		unavailableBackoff: unavailableBackoff,
+		unavailable:        make(map[digest.Digest]time.Time),
+		now:                time.Now,
+	}
+}
+
+func (s *Source) Name() string {
+	return "ipfs"
+}
+
+// Fetch returns `size` bytes of the blob starting at `off` from IPFS.
+// If IPFS fails to start serving the blob within the fetch timeout, the blob is
+// not requested from IPFS again until the unavailable backoff elapses.
+func (s *Source) Fetch(ctx context.Context, _ reference.Spec, desc ocispec.Descriptor, off, size int64) (io.ReadCloser, error) {
+	if s.isUnavailable(desc.Digest) {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, desc.Digest)
+	}
+	cid, err := CID(desc)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.cat(ctx, cid, off, size)
+	if err != nil {
+		// Don't blame IPFS if the caller gave up.
+		if ctx.Err() == nil {
+			s.markUnavailable(desc.Digest)
+		}
+		return nil, fmt.Errorf("failed to fetch %s (%s) from IPFS: %w", desc.Digest, cid, err)
+	}
+	return rc, nil
+}
+
+// cat reads `size` bytes of the file `cid` starting at `off` with the `cat` RPC.
+func (s *Source) cat(ctx context.Context, cid string, off, size int64) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("arg", "/ipfs/"+cid)
+	query.Set("offset", strconv.FormatInt(off, 10))
+	query.Set("length", strconv.FormatInt(size, 10))
+	ctx, cancel := context.WithCancel(ctx)
+	// The timeout only applies until the node starts serving the file,
+	// since large ranges may take much longer to transfer.
+	timer := time.AfterFunc(s.fetchTimeout, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiAddress+"/api/v0/cat?"+query.Encode(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	timedOut := !timer.Stop()
+	if err != nil {
+		cancel()
+		if timedOut {
+			return nil, fmt.Errorf("timed out after %v", s.fetchTimeout)
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		var rpcErr struct {
+			Message string
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&rpcErr); err == nil && rpcErr.Message != "" {
+			return nil, fmt.Errorf("unexpected status code %v: %s", resp.Status, rpcErr.Message)
+		}
+		return nil, fmt.Errorf("unexpected status code %v", resp.Status)
+	}
+	return &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+func (s *Source) isUnavailable(dgst digest.Digest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.unavailable[dgst]
+	if !ok {
+		return false
+	}
+	if s.now().Before(until) {
+		return true
+	}
+	delete(s.unavailable, dgst)
+	return false
+}
+
+func (s *Source) markUnavailable(dgst digest.Digest) {
+	s.mu.Lock()
+	s.unavailable[dgst] = s.now().Add(s.unavailableBackoff)
+	s.mu.Unlock()
+}
+
+// CID returns the IPFS CID of the blob described by `desc`. It is the CID of the first
+// `ipfs://<cid>` URL of the descriptor if any, or else the CIDv1 of a raw block with the
+// sha256 digest of the blob.
+func CID(desc ocispec.Descriptor) (string, error) {
+	for _, u := range desc.URLs {
+		if strings.HasPrefix(u, urlScheme) {
+			return strings.TrimPrefix(u, urlScheme), nil
+		}
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return "", err
+	}
+	if desc.Digest.Algorithm() != digest.SHA256 {
+		return "", fmt.Errorf("no IPFS CID for digest algorithm %s", desc.Digest.Algorithm())
+	}
+	hash, err := hex.DecodeString(desc.Digest.Encoded())
+	if err != nil {
+		return "", err
+	}
+	return "b" + strings.ToLower(base32Encoding.EncodeToString(append(append([]byte{}, cidV1RawSha256Prefix...), hash...))), nil
+}
+
+// cancelReadCloser cancels the context of the request once its body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCID(t *testing.T) {
+	tests := []struct {
+		name     string
+		desc     ocispec.Descriptor
+		expected string
+	}{
+		{
+			name:     "raw block of the sha256 digest",
+			desc:     ocispec.Descriptor{Digest: digest.FromBytes(nil)},
+			expected: "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku",
+		},
+		{
+			name: "ipfs url",
+			desc: ocispec.Descriptor{
+				Digest: digest.FromBytes(nil),
+				URLs:   []string{"https://example.com/blob", "ipfs://QmTest"},
+			},
+			expected: "QmTest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid, err := CID(tt.desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cid != tt.expected {
+				t.Fatalf("unexpected CID; expected = %s, got = %s", tt.expected, cid)
+			}
+		})
+	}
+}
+
+func TestSourceFetch(t *testing.T) {
+	contents := "0123456789abcdef"
+	desc := ocispec.Descriptor{Digest: digest.FromString(contents), Size: int64(len(contents))}
+	cid, err := CID(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v0/cat" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("arg") != "/ipfs/"+cid {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"Message": "block was not found locally (offline)", "Code": 0, "Type": "error"}`)
+			return
+		}
+		off, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		length, _ := strconv.Atoi(r.URL.Query().Get("length"))
+		io.WriteString(w, contents[off:off+length])
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	s := NewSource(config.IPFSConfig{APIAddress: server.URL, UnavailableBackoffSec: 60})
+	s.now = func() time.Time { return now }
+
+	rc, err := s.Fetch(context.Background(), reference.Spec{}, desc, 4, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != contents[4:10] {
+		t.Fatalf("unexpected content; expected = %q, got = %q", contents[4:10], b)
+	}
+
+	missing := ocispec.Descriptor{Digest: digest.FromString("missing"), Size: 7}
+	if _, err := s.Fetch(context.Background(), reference.Spec{}, missing, 0, 7); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected the error of the IPFS node; got = %v", err)
+	}
+	// The missing blob must not be requested again until the backoff elapses.
+	requests = 0
+	if _, err := s.Fetch(context.Background(), reference.Spec{}, missing, 0, 7); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("unexpected error; expected = %v, got = %v", ErrUnavailable, err)
+	}
+	if requests != 0 {
+		t.Fatalf("unavailable blob was requested from IPFS")
+	}
+	now = now.Add(time.Minute)
+	if _, err := s.Fetch(context.Background(), reference.Spec{}, missing, 0, 7); errors.Is(err, ErrUnavailable) || requests != 1 {
+		t.Fatalf("blob was not requested from IPFS after the backoff; err = %v", err)
+	}
+}
+
+func TestSourceFetchTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	s := NewSource(config.IPFSConfig{APIAddress: server.URL, FetchTimeoutMsec: 10})
+	desc := ocispec.Descriptor{Digest: digest.FromString("test"), Size: 4}
+	if _, err := s.Fetch(context.Background(), reference.Spec{}, desc, 0, 4); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the fetch to time out; got = %v", err)
+	}
+	if !s.isUnavailable(desc.Digest) {
+		t.Fatalf("blob which timed out is not marked unavailable")
+	}
+}
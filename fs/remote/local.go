@@ -0,0 +1,84 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrOffline is returned instead of contacting a registry when remote fetches are disabled.
+var ErrOffline = errors.New("remote fetches are disabled in offline mode")
+
+// LocalHandler serves the blobs stored in an OCI image layout directory, e.g. the layers
+// imported into the SOCI content store with `soci bundle import`.
+type LocalHandler struct {
+	dir string
+}
+
+// NewLocalHandler returns a handler of the blobs stored in the OCI image layout `dir`.
+func NewLocalHandler(dir string) *LocalHandler {
+	return &LocalHandler{dir: dir}
+}
+
+// Handle returns a fetcher of the blob described by `desc` if it's stored in the directory of the handler.
+func (h *LocalHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (Fetcher, int64, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, 0, err
+	}
+	path := filepath.Join(h.dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.Size() != desc.Size {
+		return nil, 0, fmt.Errorf("local blob %s has size %d, expected %d", desc.Digest, fi.Size(), desc.Size)
+	}
+	return &localFetcher{path: path}, fi.Size(), nil
+}
+
+type localFetcher struct {
+	path string
+}
+
+func (f *localFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, off, size), file}, nil
+}
+
+func (f *localFetcher) Check() error {
+	_, err := os.Stat(f.path)
+	return err
+}
+
+func (f *localFetcher) GenID(off int64, size int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.path, off, size)))
+	return fmt.Sprintf("%x", sum)
+}
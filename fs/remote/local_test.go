@@ -0,0 +1,80 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/containerd/containerd/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestOfflineResolver(t *testing.T) {
+	contents := []byte("0123456789abcdef")
+	dir := t.TempDir()
+	stored := ocispec.Descriptor{Digest: digest.FromBytes(contents), Size: int64(len(contents))}
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blobDir, stored.Digest.Encoded()), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := ocispec.Descriptor{Digest: digest.FromString("missing"), Size: 7}
+
+	r := NewResolver(config.BlobConfig{}, map[string]Handler{"local": NewLocalHandler(dir)}, nil)
+	r.SetOffline(true)
+	refspec, err := reference.Parse("example.com/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, size, err := r.resolveFetcher(context.Background(), nil, refspec, stored)
+	if err != nil {
+		t.Fatalf("failed to resolve a local blob: %v", err)
+	}
+	if size != stored.Size {
+		t.Fatalf("unexpected size; expected = %d, got = %d", stored.Size, size)
+	}
+	mr, err := f.fetch(context.Background(), []region{{2, 5}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rd, err := mr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, contents[2:6]) {
+		t.Fatalf("unexpected content %q", b)
+	}
+
+	if _, _, err := r.resolveFetcher(context.Background(), nil, refspec, missing); !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected ErrOffline for a blob which isn't stored locally, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package peercache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/mtls"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	defaultFetchTimeout       = 2 * time.Second
+	defaultUnavailableBackoff = 30 * time.Second
+)
+
+var (
+	// ErrNoPeers is returned if no peer could serve a span.
+	ErrNoPeers = errors.New("no peer serves the span")
+
+	errNotCached = errors.New("span is not cached by peer")
+)
+
+var _ spanmanager.SpanPeers = &Client{}
+
+// Client fetches spans from the peer caches of other snapshotters.
+type Client struct {
+	peers              []string
+	client             *http.Client
+	fetchTimeout       time.Duration
+	unavailableBackoff time.Duration
+
+	mu          sync.Mutex
+	unavailable map[string]time.Time // peer -> time until which the peer is not asked for spans
+
+	now func() time.Time
+}
+
+// NewClient returns a client fetching spans from the peers configured by `cfg`, which
+// it authenticates to with the certificate of cfg.TLS.
+func NewClient(cfg config.PeerCacheConfig) (*Client, error) {
+	var peers []string
+	for _, address := range cfg.Peers {
+		if !strings.Contains(address, "://") {
+			address = "https://" + address
+		}
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" || u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid peer address %q", address)
+		}
+		peers = append(peers, strings.TrimSuffix(address, "/"))
+	}
+	tlsConfig, err := mtls.ClientConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("peer cache requires mutual TLS: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	fetchTimeout := time.Duration(cfg.FetchTimeoutMsec) * time.Millisecond
+	if fetchTimeout == 0 {
+		fetchTimeout = defaultFetchTimeout
+	}
+	unavailableBackoff := time.Duration(cfg.UnavailableBackoffSec) * time.Second
+	if unavailableBackoff == 0 {
+		unavailableBackoff = defaultUnavailableBackoff
+	}
+	return &Client{
+		peers:              peers,
+		client:             &http.Client{Transport: transport},
+		fetchTimeout:       fetchTimeout,
+		unavailableBackoff: unavailableBackoff,
+		unavailable:        make(map[string]time.Time),
+		now:                time.Now,
+	}, nil
+}
+
+// FetchSpan returns the compressed contents of a span from the first peer which has cached it for
+// the containerd namespace of ctx. Peers which can't be reached are not asked again until the
+// unavailable backoff elapses.
+func (c *Client) FetchSpan(ctx context.Context, layerDigest digest.Digest, spanID compression.SpanID, spanDigest digest.Digest, size int64) ([]byte, error) {
+	for _, peer := range c.peers {
+		if c.isUnavailable(peer) {
+			continue
+		}
+		buf, err := c.fetch(ctx, peer, layerDigest, spanID, spanDigest, size)
+		if err == nil {
+			return buf, nil
+		}
+		if !errors.Is(err, errNotCached) && ctx.Err() == nil {
+			c.markUnavailable(peer)
+		}
+	}
+	return nil, fmt.Errorf("%w: span %d of %s", ErrNoPeers, spanID, layerDigest)
+}
+
+// fetch fetches a span from `peer`. It returns errNotCached if the peer doesn't have the span.
+func (c *Client) fetch(ctx context.Context, peer string, layerDigest digest.Digest, spanID compression.SpanID, spanDigest digest.Digest, size int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.fetchTimeout)
+	defer cancel()
+	query := url.Values{}
+	query.Set(digestParam, spanDigest.String())
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		query.Set(namespaceParam, ns)
+	}
+	u := fmt.Sprintf("%s%s%s/%d?%s", peer, SpansPath, layerDigest, spanID, query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch span from peer %s: %w", peer, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errNotCached
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("failed to fetch span from peer %s: unexpected status code %v", peer, resp.Status)
+	case resp.ContentLength != size:
+		return nil, fmt.Errorf("unexpected size of span from peer %s: %d, expected %d", peer, resp.ContentLength, size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, fmt.Errorf("failed to read span from peer %s: %w", peer, err)
+	}
+	return buf, nil
+}
+
+func (c *Client) isUnavailable(peer string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.unavailable[peer]
+	if !ok {
+		return false
+	}
+	if c.now().Before(until) {
+		return true
+	}
+	delete(c.unavailable, peer)
+	return false
+}
+
+func (c *Client) markUnavailable(peer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unavailable[peer] = c.now().Add(c.unavailableBackoff)
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package peercache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/mtls"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+)
+
+type spanKey struct {
+	ns    string
+	layer digest.Digest
+	id    compression.SpanID
+	dgst  digest.Digest
+}
+
+// testSpans serves the spans in the map and counts lookups.
+type testSpans struct {
+	spans   map[spanKey][]byte
+	lookups int32
+}
+
+func (s *testSpans) CachedSpan(ns string, layerDigest digest.Digest, spanID compression.SpanID, spanDigest digest.Digest) ([]byte, error) {
+	atomic.AddInt32(&s.lookups, 1)
+	buf, ok := s.spans[spanKey{ns, layerDigest, spanID, spanDigest}]
+	if !ok {
+		return nil, spanmanager.ErrSpanNotCached
+	}
+	return buf, nil
+}
+
+// newTestPeer serves spans to the peers with certificates signed by the CA of certs.
+func newTestPeer(t *testing.T, certs testutil.Certificates, spans Spans) *httptest.Server {
+	tlsConfig, err := mtls.ServerConfig(certs.ServerCert, certs.ServerKey, certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewUnstartedServer(NewServer(spans))
+	peer.TLS = tlsConfig
+	peer.StartTLS()
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func testConfig(certs testutil.Certificates, peers ...string) config.PeerCacheConfig {
+	return config.PeerCacheConfig{
+		Peers: peers,
+		TLS:   config.TLSConfig{CertFile: certs.ClientCert, KeyFile: certs.ClientKey, CAFile: certs.CA},
+	}
+}
+
+func TestClientFetchSpan(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	contents := []byte("compressed span")
+	spanDigest := digest.FromBytes(contents)
+	certs := testutil.WriteCertificates(t, t.TempDir())
+
+	empty := &testSpans{}
+	emptyPeer := newTestPeer(t, certs, empty)
+	spans := &testSpans{spans: map[spanKey][]byte{{"tenant", layerDigest, 3, spanDigest}: contents}}
+	peer := newTestPeer(t, certs, spans)
+
+	client, err := NewClient(testConfig(certs, emptyPeer.URL, peer.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "tenant")
+	buf, err := client.FetchSpan(ctx, layerDigest, 3, spanDigest, int64(len(contents)))
+	if err != nil {
+		t.Fatalf("failed to fetch span: %v", err)
+	}
+	if !bytes.Equal(buf, contents) {
+		t.Fatalf("unexpected span contents: %q", buf)
+	}
+	if lookups := atomic.LoadInt32(&empty.lookups); lookups != 1 {
+		t.Fatalf("first peer was asked %d times, expected once", lookups)
+	}
+
+	for name, fetch := range map[string]func() error{
+		"other span ID": func() error {
+			_, err := client.FetchSpan(ctx, layerDigest, 4, spanDigest, int64(len(contents)))
+			return err
+		},
+		"other span digest": func() error {
+			_, err := client.FetchSpan(ctx, layerDigest, 3, digest.FromString("other"), int64(len(contents)))
+			return err
+		},
+		"other size": func() error {
+			_, err := client.FetchSpan(ctx, layerDigest, 3, spanDigest, int64(len(contents))+1)
+			return err
+		},
+		"other namespace": func() error {
+			_, err := client.FetchSpan(namespaces.WithNamespace(context.Background(), "other"), layerDigest, 3, spanDigest, int64(len(contents)))
+			return err
+		},
+	} {
+		if err := fetch(); !errors.Is(err, ErrNoPeers) {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestClientUnavailablePeer(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	contents := []byte("compressed span")
+	spanDigest := digest.FromBytes(contents)
+
+	certs := testutil.WriteCertificates(t, t.TempDir())
+	spans := &testSpans{spans: map[spanKey][]byte{{"", layerDigest, 0, spanDigest}: contents}}
+	peer := newTestPeer(t, certs, spans)
+	address := peer.URL
+	peer.Close()
+
+	cfg := testConfig(certs, address)
+	cfg.UnavailableBackoffSec = 60
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	client.now = func() time.Time { return now }
+	if _, err := client.FetchSpan(context.Background(), layerDigest, 0, spanDigest, int64(len(contents))); !errors.Is(err, ErrNoPeers) {
+		t.Fatalf("unexpected error for unreachable peer: %v", err)
+	}
+	if !client.isUnavailable(address) {
+		t.Fatal("unreachable peer isn't marked unavailable")
+	}
+	now = now.Add(time.Minute)
+	if client.isUnavailable(address) {
+		t.Fatal("peer is still unavailable after the backoff")
+	}
+}
+
+func TestClientRequiresCertificate(t *testing.T) {
+	certs := testutil.WriteCertificates(t, t.TempDir())
+	peer := newTestPeer(t, certs, &testSpans{})
+	if _, err := NewClient(config.PeerCacheConfig{Peers: []string{peer.URL}}); err == nil {
+		t.Fatal("expected client without certificate to fail")
+	}
+	// Peers without a certificate signed by the CA are refused.
+	resp, err := peer.Client().Get(peer.URL + SpansPath)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected request without client certificate to be refused")
+	}
+}
+
+func TestServerInvalidRequests(t *testing.T) {
+	peer := httptest.NewServer(NewServer(&testSpans{}))
+	defer peer.Close()
+	layerDigest := digest.FromString("layer")
+	for path, status := range map[string]int{
+		"/v1/spans/" + layerDigest.String() + "/1?digest=" + layerDigest.String():  404,
+		"/v1/spans/" + layerDigest.String() + "/1":                                 400,
+		"/v1/spans/" + layerDigest.String() + "/-1?digest=" + layerDigest.String(): 404,
+		"/v1/spans/invalid/1?digest=" + layerDigest.String():                       404,
+		"/v1/spans/" + layerDigest.String() + "?digest=" + layerDigest.String():    404,
+	} {
+		resp, err := peer.Client().Get(peer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s: unexpected status %d, expected %d", path, resp.StatusCode, status)
+		}
+	}
+}
+
+func TestNewClientInvalidPeer(t *testing.T) {
+	certs := testutil.WriteCertificates(t, t.TempDir())
+	for _, address := range []string{"https://", "http://node-2:8091"} {
+		if _, err := NewClient(testConfig(certs, address)); err == nil {
+			t.Fatalf("expected error for invalid peer address %q", address)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package peercache implements the peer cache protocol, with which the snapshotters of a cluster
+// serve the spans they have cached to each other, so that spans are fetched from registries once.
+//
+// Spans are served over HTTPS at `/v1/spans/<layer digest>/<span id>?digest=<span digest>&namespace=<ns>`,
+// and peers authenticate each other with certificates signed by the CA of the cluster. The span
+// digest, which is recorded in the zTOC of the layer, identifies the span among the spans of the
+// zTOCs of the layer with other span sizes. Only the spans of the layers mounted for the containerd
+// namespace of the request are served, so that namespaces stay isolated across nodes. Spans are
+// served compressed, as they are stored in the layer, and are verified against their digests by
+// the snapshotters fetching them.
+package peercache
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/awslabs/soci-snapshotter/util/mtls"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// SpansPath is the path under which spans are served.
+	SpansPath = "/v1/spans/"
+
+	digestParam    = "digest"
+	namespaceParam = "namespace"
+)
+
+// Spans looks up the cached spans of layers, e.g. a spanmanager.SpanRegistry.
+type Spans interface {
+	CachedSpan(ns string, layerDigest digest.Digest, spanID compression.SpanID, spanDigest digest.Digest) ([]byte, error)
+}
+
+var _ Spans = &spanmanager.SpanRegistry{}
+
+// Server serves the cached spans of layers to peers.
+type Server struct {
+	spans Spans
+}
+
+// NewServer returns a server serving the spans cached in `spans`.
+func NewServer(spans Spans) *Server {
+	return &Server{spans: spans}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	layerDigest, spanID, err := parseSpanPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	spanDigest, err := digest.Parse(r.URL.Query().Get(digestParam))
+	if err != nil {
+		http.Error(w, "invalid span digest", http.StatusBadRequest)
+		return
+	}
+
+	buf, err := s.spans.CachedSpan(r.URL.Query().Get(namespaceParam), layerDigest, spanID, spanDigest)
+	if err != nil {
+		if !errors.Is(err, spanmanager.ErrSpanNotCached) {
+			log.G(logutil.WithLayer(r.Context(), layerDigest)).WithError(err).WithField("span", spanID).
+				Debug("failed to read cached span")
+		}
+		http.Error(w, "span is not cached", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// Listen listens for the requests of peers on the address configured by cfg, with mutual TLS.
+func Listen(cfg config.PeerCacheConfig) (net.Listener, error) {
+	tlsConfig, err := mtls.ServerConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("peer cache requires mutual TLS: %w", err)
+	}
+	l, err := tls.Listen("tcp", cfg.ListenAddress, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q: %w", cfg.ListenAddress, err)
+	}
+	return l, nil
+}
+
+// parseSpanPath parses the layer digest and span ID of the path of a span.
+func parseSpanPath(path string) (digest.Digest, compression.SpanID, error) {
+	rest := strings.TrimPrefix(path, SpansPath)
+	layer, id, ok := strings.Cut(rest, "/")
+	if rest == path || !ok {
+		return "", 0, errors.New("invalid span path")
+	}
+	layerDigest, err := digest.Parse(layer)
+	if err != nil {
+		return "", 0, errors.New("invalid layer digest")
+	}
+	spanID, err := strconv.ParseInt(id, 10, 32)
+	if err != nil || spanID < 0 {
+		return "", 0, errors.New("invalid span ID")
+	}
+	return layerDigest, compression.SpanID(spanID), nil
+}
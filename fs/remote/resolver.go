@@ -41,6 +41,7 @@ package remote
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -58,6 +59,7 @@ import (
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
@@ -71,9 +73,25 @@ import (
 const (
 	defaultValidIntervalSec int64 = 60
 	defaultFetchTimeoutSec  int64 = 300
+
+	defaultRetryBudget                 = 100
+	defaultRetryBudgetRefillMsec int64 = 1000
 )
 
-func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
+// ErrUnauthorized is returned when the registry refuses the credentials of a request for a blob.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// NewResolver returns a new resolver. Blobs are fetched from the blob sources,
+// if any, before falling back to the registry.
+func NewResolver(cfg config.BlobConfig, handlers map[string]Handler, sources []BlobSource) *Resolver {
+	return &Resolver{
+		blobConfig: blobConfigWithDefaults(cfg),
+		handlers:   handlers,
+		sources:    sources,
+	}
+}
+
+func blobConfigWithDefaults(cfg config.BlobConfig) config.BlobConfig {
 	if cfg.ValidInterval == 0 { // zero means "use default interval"
 		cfg.ValidInterval = defaultValidIntervalSec
 	}
@@ -92,16 +110,76 @@ func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
 	if cfg.MaxWaitMsec == 0 {
 		cfg.MaxWaitMsec = socihttp.DefaultMaxWaitMsec
 	}
-
-	return &Resolver{
-		blobConfig: cfg,
-		handlers:   handlers,
+	if cfg.RetryBudget == 0 {
+		cfg.RetryBudget = defaultRetryBudget
+	}
+	if cfg.RetryBudgetRefillMsec == 0 {
+		cfg.RetryBudgetRefillMsec = defaultRetryBudgetRefillMsec
 	}
+	return cfg
 }
 
 type Resolver struct {
-	blobConfig config.BlobConfig
-	handlers   map[string]Handler
+	blobConfig   config.BlobConfig
+	blobConfigMu sync.RWMutex
+	handlers     map[string]Handler
+	sources      []BlobSource
+	// offline makes blobs which no handler serves fail with ErrOffline instead of being fetched.
+	offline bool
+	// downloadDir is the directory of the background downloads of blobs.
+	downloadDir string
+
+	lastFetch   FetchStatus
+	lastFetchMu sync.Mutex
+}
+
+// FetchStatus is the outcome of a fetch of a blob region.
+type FetchStatus struct {
+	// Time is when the fetch completed. It is zero if nothing was fetched yet.
+	Time time.Time
+	// Err is the error of the fetch, if it failed.
+	Err error
+}
+
+// LastFetch returns the outcome of the last fetch of a region of any blob resolved by the resolver.
+func (r *Resolver) LastFetch() FetchStatus {
+	r.lastFetchMu.Lock()
+	defer r.lastFetchMu.Unlock()
+	return r.lastFetch
+}
+
+func (r *Resolver) recordFetch(err error) {
+	r.lastFetchMu.Lock()
+	r.lastFetch = FetchStatus{Time: time.Now(), Err: err}
+	r.lastFetchMu.Unlock()
+}
+
+// SetBlobConfig replaces the blob config of the resolver.
+// The new config (e.g. the retry policy) only applies to blobs resolved afterwards.
+func (r *Resolver) SetBlobConfig(cfg config.BlobConfig) {
+	r.blobConfigMu.Lock()
+	r.blobConfig = blobConfigWithDefaults(cfg)
+	r.blobConfigMu.Unlock()
+}
+
+// SetOffline makes the resolver refuse to fetch blobs from registries and blob sources,
+// so that only the blobs served by its handlers can be resolved.
+// It must be called before any blob is resolved.
+func (r *Resolver) SetOffline(offline bool) {
+	r.offline = offline
+}
+
+// SetDownloadDir sets the directory of the background downloads of blobs (see
+// config.BlobConfig.FullFetchOnIgnoredRange), which defaults to the directory for temporary files.
+// It must be called before any blob is resolved.
+func (r *Resolver) SetDownloadDir(dir string) {
+	r.downloadDir = dir
+}
+
+func (r *Resolver) getBlobConfig() config.BlobConfig {
+	r.blobConfigMu.RLock()
+	defer r.blobConfigMu.RUnlock()
+	return r.blobConfig
 }
 
 type fetcher interface {
@@ -115,17 +193,24 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	if err != nil {
 		return nil, err
 	}
-	blobConfig := &r.blobConfig
-	return makeBlob(f,
+	blobConfig := r.getBlobConfig()
+	b := makeBlob(f,
 		size,
 		time.Now(),
 		time.Duration(blobConfig.ValidInterval)*time.Second,
 		r,
-		time.Duration(blobConfig.FetchTimeoutSec)*time.Second), nil
+		time.Duration(blobConfig.FetchTimeoutSec)*time.Second)
+	b.fullFetchOnIgnoredRange = blobConfig.FullFetchOnIgnoredRange
+	b.downloadDir = r.downloadDir
+	if blobConfig.RetryBudget > 0 {
+		b.retryBudget = socihttp.NewRetryBudget(blobConfig.RetryBudget,
+			time.Duration(blobConfig.RetryBudgetRefillMsec)*time.Millisecond)
+	}
+	return b, nil
 }
 
 func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (f fetcher, size int64, err error) {
-	blobConfig := &r.blobConfig
+	blobConfig := r.getBlobConfig()
 	fc := &fetcherConfig{
 		hosts:      hosts,
 		refspec:    refspec,
@@ -142,16 +227,23 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 			handlersErr = multierror.Append(handlersErr, err)
 			continue
 		}
-		log.G(ctx).WithField("handler name", name).WithField("ref", refspec.String()).WithField("digest", desc.Digest).
+		log.G(ctx).WithField("handler name", name).WithField(logutil.ImageField, refspec.String()).WithField(logutil.LayerField, desc.Digest).
 			Debugf("contents is provided by a handler")
 		return &remoteFetcher{r}, size, nil
 	}
 
+	if r.offline {
+		if handlersErr != nil {
+			return nil, 0, fmt.Errorf("blob %s is not available locally: %v: %w", desc.Digest, handlersErr, ErrOffline)
+		}
+		return nil, 0, fmt.Errorf("blob %s is not available locally: %w", desc.Digest, ErrOffline)
+	}
+
 	logger := log.G(ctx)
 	if handlersErr != nil {
 		logger = logger.WithError(handlersErr)
 	}
-	logger.WithField("ref", refspec.String()).WithField("digest", desc.Digest).Debugf("using default handler")
+	logger.WithField(logutil.ImageField, refspec.String()).WithField(logutil.LayerField, desc.Digest).Debugf("using default handler")
 
 	hf, err := newHTTPFetcher(ctx, fc)
 	if err != nil {
@@ -160,6 +252,9 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 	if blobConfig.ForceSingleRangeMode {
 		hf.singleRangeMode()
 	}
+	if len(r.sources) > 0 {
+		return &sourceFetcher{sources: r.sources, refspec: refspec, desc: desc, fallback: hf}, desc.Size, nil
+	}
 	return hf, desc.Size, err
 }
 
@@ -301,6 +396,36 @@ func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+// NewRegistryClient returns the client of requests to the registry `host` for pulling from
+// the repository of `refspec`. Requests are sent with the client of the host, i.e. with its TLS
+// settings, timeouts and retries, and authorized by its Authorizer, so that every request of
+// the snapshotter to a registry uses the same credentials as the requests for layers.
+// Manifests fetched by tag, e.g. the referrers tag of an image, are revalidated by conditional
+// requests when they are fetched again, so that they are only downloaded again once they change.
+func NewRegistryClient(host docker.RegistryHost, refspec reference.Spec) (*http.Client, error) {
+	client := host.Client
+	if client == nil {
+		client = socihttp.NewRetryableClient(socihttp.NewRetryableClientConfig())
+	}
+	inner := client.Transport
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	if host.Authorizer != nil {
+		scope, err := repositoryScope(refspec, false)
+		if err != nil {
+			return nil, err
+		}
+		inner = &transport{inner: inner, auth: host.Authorizer, scope: scope}
+	}
+	return &http.Client{
+		Transport:     &revalidatingTransport{inner: inner, cache: defaultManifestCache},
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}, nil
+}
+
 func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout time.Duration) (url string, err error) {
 	if timeout > 0 {
 		var cancel context.CancelFunc
@@ -331,7 +456,7 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout
 		// TODO: Support nested redirection
 		url = redir
 	} else {
-		return "", fmt.Errorf("failed to access to the registry with code %v", res.StatusCode)
+		return "", unauthorized(res.StatusCode, fmt.Errorf("failed to access to the registry with code %v", res.StatusCode))
 	}
 
 	return
@@ -406,7 +531,8 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse Content-Length: %w", err)
 		}
-		return newSinglePartReader(region{0, size - 1}, res.Body), nil
+		reg := region{0, size - 1}
+		return newSinglePartReader(reg, f.resumable(ctx, reg, res.Body)), nil
 	} else if res.StatusCode == http.StatusPartialContent {
 		mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
 		if err != nil {
@@ -422,7 +548,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse Content-Range: %w", err)
 		}
-		return newSinglePartReader(reg, res.Body), nil
+		return newSinglePartReader(reg, f.resumable(ctx, reg, res.Body)), nil
 	} else if retry && res.StatusCode == http.StatusForbidden {
 		log.G(ctx).Infof("Received status code: %v. Refreshing URL and retrying...", res.Status)
 
@@ -439,7 +565,103 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		return f.fetch(ctx, rs, false) // retries with the single range mode
 	}
 
-	return nil, fmt.Errorf("unexpected status code: %v", res.Status)
+	return nil, unauthorized(res.StatusCode, fmt.Errorf("unexpected status code: %v", res.Status))
+}
+
+// resumable returns the body of a response carrying the region reg as a single part,
+// which resumes the region from where it was interrupted if reading the body fails midway.
+// Regions of multipart responses aren't resumed; their fetches are retried as a whole.
+func (f *httpFetcher) resumable(ctx context.Context, reg region, body io.ReadCloser) io.ReadCloser {
+	return &resumingBody{
+		ctx:  ctx,
+		f:    f,
+		reg:  reg,
+		body: body,
+	}
+}
+
+// fetchRemaining requests the region reg, the remaining bytes of an interrupted region.
+func (f *httpFetcher) fetchRemaining(ctx context.Context, reg region) (io.ReadCloser, error) {
+	f.urlMu.Lock()
+	url := f.url
+	f.urlMu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", reg.b, reg.e))
+	req.Header.Add("Accept-Encoding", "identity")
+	req.Close = false
+	res, err := f.tr.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, unauthorized(res.StatusCode, fmt.Errorf("unexpected status code: %v", res.Status))
+	}
+	got, _, err := parseRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to parse Content-Range: %w", err)
+	}
+	if got.b != reg.b || got.e < reg.e {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected Content-Range %v; requested %v", got, reg)
+	}
+	return res.Body, nil
+}
+
+// maxFetchResumes is how many times a region interrupted midway is resumed before its fetch fails.
+const maxFetchResumes = 3
+
+// resumingBody reads a region from the body of a response. If the body fails or ends
+// before the end of the region, e.g. because the connection was reset, it requests the
+// remaining bytes of the region and continues with them, instead of failing the fetch
+// and having it retried from the beginning of the region.
+type resumingBody struct {
+	ctx     context.Context
+	f       *httpFetcher
+	reg     region // the region remaining to be read
+	body    io.ReadCloser
+	resumes int
+}
+
+func (r *resumingBody) Read(p []byte) (int, error) {
+	for {
+		if r.reg.size() <= 0 {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > r.reg.size() {
+			p = p[:r.reg.size()]
+		}
+		n, err := r.body.Read(p)
+		r.reg.b += int64(n)
+		if err == nil || r.reg.size() <= 0 {
+			return n, nil
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if r.resumes >= maxFetchResumes || r.ctx.Err() != nil {
+			return n, err
+		}
+		r.resumes++
+		log.G(r.ctx).WithError(err).Debugf("resuming interrupted fetch of region %v", r.reg)
+		r.body.Close()
+		body, rerr := r.f.fetchRemaining(r.ctx, r.reg)
+		if rerr != nil {
+			return n, fmt.Errorf("failed to resume region %v after %v: %w", r.reg, err, rerr)
+		}
+		r.body = body
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingBody) Close() error {
+	return r.body.Close()
 }
 
 func (f *httpFetcher) check() error {
@@ -482,7 +704,45 @@ func (f *httpFetcher) check() error {
 		return fmt.Errorf("failed to refresh URL on status %v", res.Status)
 	}
 
-	return fmt.Errorf("unexpected status code %v", res.StatusCode)
+	return unauthorized(res.StatusCode, fmt.Errorf("unexpected status code %v", res.StatusCode))
+}
+
+// unauthorized marks `err` with ErrUnauthorized if the status `code` means that the registry
+// refused the credentials of the request.
+func unauthorized(code int, err error) error {
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		return &unauthorizedError{err: err}
+	}
+	return err
+}
+
+// unauthorizedError is the error of a request whose credentials the registry refused.
+// It is ErrUnauthorized and wraps the cause.
+type unauthorizedError struct {
+	err error
+}
+
+func (e *unauthorizedError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrUnauthorized, e.err)
+}
+
+func (e *unauthorizedError) Unwrap() error {
+	return e.err
+}
+
+func (e *unauthorizedError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// host returns the host the blob is currently fetched from, e.g. the host of a redirect.
+func (f *httpFetcher) host() string {
+	f.urlMu.Lock()
+	defer f.urlMu.Unlock()
+	u, err := url.Parse(f.url)
+	if err != nil {
+		return ""
+	}
+	return u.Host
 }
 
 func (f *httpFetcher) refreshURL(ctx context.Context) error {
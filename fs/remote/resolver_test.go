@@ -49,6 +49,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	socihttp "github.com/awslabs/soci-snapshotter/util/http"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
@@ -256,6 +257,23 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestSetBlobConfig(t *testing.T) {
+	r := NewResolver(config.BlobConfig{MaxRetries: 1}, nil, nil)
+	if got := r.getBlobConfig().MaxRetries; got != 1 {
+		t.Fatalf("unexpected max retries; expected = 1, got = %d", got)
+	}
+
+	r.SetBlobConfig(config.BlobConfig{MaxRetries: 3, MinWaitMsec: 10})
+	got := r.getBlobConfig()
+	if got.MaxRetries != 3 || got.MinWaitMsec != 10 {
+		t.Fatalf("blob config was not updated; got = %+v", got)
+	}
+	// unset fields must fall back to the defaults
+	if got.MaxWaitMsec != socihttp.DefaultMaxWaitMsec || got.FetchTimeoutSec != defaultFetchTimeoutSec {
+		t.Fatalf("defaults were not applied to the new blob config; got = %+v", got)
+	}
+}
+
 type breakRoundTripper struct {
 	success bool
 }
@@ -335,3 +353,95 @@ func (r *retryRoundTripper) RoundTrip(req *http.Request) (res *http.Response, er
 	}
 	return
 }
+
+func TestFetchResumesInterruptedRegion(t *testing.T) {
+	blob := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	testCases := []struct {
+		name       string
+		interrupts int
+		reg        region
+		fail       bool
+	}{
+		{name: "not interrupted", interrupts: 0, reg: region{2, 30}},
+		{name: "interrupted once", interrupts: 1, reg: region{2, 30}},
+		{name: "interrupted up to the limit", interrupts: maxFetchResumes, reg: region{0, 35}},
+		{name: "interrupted too often", interrupts: maxFetchResumes + 1, reg: region{0, 35}, fail: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &interruptingRoundTripper{blob: blob, interrupts: tc.interrupts}
+			f := &httpFetcher{url: "test", tr: tr}
+			mr, err := f.fetch(context.Background(), []region{tc.reg}, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer mr.Close()
+			_, p, err := mr.Next()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := io.ReadAll(p)
+			if tc.fail {
+				if err == nil {
+					t.Fatalf("fetch succeeded; wanted to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := blob[tc.reg.b : tc.reg.e+1]; !bytes.Equal(got, want) {
+				t.Fatalf("unexpected data; expected = %q, got = %q", want, got)
+			}
+			if want := tc.interrupts + 1; len(tr.ranges) != want {
+				t.Fatalf("unexpected number of requests; expected = %d, got = %d (%v)", want, len(tr.ranges), tr.ranges)
+			}
+			// Resumed requests must only ask for the remaining bytes.
+			for i, r := range tr.ranges[1:] {
+				if want := fmt.Sprintf("bytes=%d-%d", tc.reg.b+int64(i+1)*interruptAfter, tc.reg.e); r != want {
+					t.Fatalf("unexpected range of request %d; expected = %q, got = %q", i+1, want, r)
+				}
+			}
+		})
+	}
+}
+
+// interruptAfter is the number of bytes after which interruptingRoundTripper interrupts bodies.
+const interruptAfter = 5
+
+// interruptingRoundTripper serves ranges of a blob, interrupting the bodies of the first
+// responses after interruptAfter bytes.
+type interruptingRoundTripper struct {
+	blob       []byte
+	interrupts int
+	ranges     []string
+}
+
+func (tr *interruptingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rangeHeader := req.Header.Get("Range")
+	tr.ranges = append(tr.ranges, rangeHeader)
+	var b, e int64
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &b, &e); err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", b, e, len(tr.blob)))
+	var body io.Reader = bytes.NewReader(tr.blob[b : e+1])
+	if len(tr.ranges) <= tr.interrupts {
+		body = io.MultiReader(io.LimitReader(body, interruptAfter), &errorReader{fmt.Errorf("connection reset")})
+	}
+	return &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header:     header,
+		Body:       io.NopCloser(body),
+	}, nil
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	// maxRevalidatedManifestSize is the size of the largest manifest cached for revalidation.
+	maxRevalidatedManifestSize = 4 << 20
+	// maxRevalidatedManifests is the number of manifests cached for revalidation.
+	maxRevalidatedManifests = 1024
+)
+
+// defaultManifestCache holds the manifests fetched by tag by all of the registry clients, since
+// the same tags, e.g. the referrers tag of an image listing its SOCI indices, are fetched by
+// every pull of the image.
+var defaultManifestCache = newManifestCache(maxRevalidatedManifests)
+
+// cachedManifest is a manifest fetched by tag with the validators of its response.
+type cachedManifest struct {
+	header       http.Header
+	body         []byte
+	etag         string
+	lastModified string
+}
+
+// manifestCache caches the manifests fetched by tag so that fetching them again only revalidates
+// them with a conditional request, which the registry answers without the manifest unless it changed.
+type manifestCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*cachedManifest
+}
+
+func newManifestCache(maxEntries int) *manifestCache {
+	return &manifestCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cachedManifest),
+	}
+}
+
+func (c *manifestCache) get(key string) *cachedManifest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+func (c *manifestCache) add(key string, m *cachedManifest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		// Any manifest is evicted, since missing one only costs a full fetch.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = m
+}
+
+func (c *manifestCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// revalidatingTransport sends the requests for manifests by tag with the ETag and Last-Modified
+// of the previous response for the same manifest, if any, as If-None-Match and If-Modified-Since.
+// When the registry answers that the manifest didn't change, the cached manifest is returned
+// as if it was fetched again.
+type revalidatingTransport struct {
+	inner http.RoundTripper
+	cache *manifestCache
+}
+
+func (t *revalidatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || !isTagManifestPath(req.URL.Path) ||
+		req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return t.inner.RoundTrip(req)
+	}
+	key := req.URL.String() + "|" + req.Header.Get("Accept")
+	cached := t.cache.get(key)
+	if cached != nil {
+		req = req.Clone(req.Context())
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		log.G(req.Context()).WithField("url", req.URL.String()).Debug("manifest revalidated")
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        cached.header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       req,
+		}, nil
+	case resp.StatusCode == http.StatusOK:
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if etag == "" && lastModified == "" {
+			t.cache.remove(key)
+			return resp, nil
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevalidatedManifestSize+1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if len(body) > maxRevalidatedManifestSize {
+			// The manifest is too large to be cached, so the rest of it is read as usual.
+			t.cache.remove(key)
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return resp, nil
+		}
+		resp.Body.Close()
+		t.cache.add(key, &cachedManifest{header: resp.Header.Clone(), body: body, etag: etag, lastModified: lastModified})
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	case resp.StatusCode == http.StatusNotFound:
+		t.cache.remove(key)
+	}
+	return resp, nil
+}
+
+// isTagManifestPath returns whether `path` is that of a manifest referenced by tag, i.e.
+// /v2/<name>/manifests/<tag>. Manifests referenced by digest never change.
+func isTagManifestPath(path string) bool {
+	i := strings.LastIndex(path, "/manifests/")
+	if i < 0 || !strings.HasPrefix(path, "/v2/") {
+		return false
+	}
+	ref := path[i+len("/manifests/"):]
+	return ref != "" && !strings.ContainsAny(ref, ":/")
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRevalidatingTransport(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	etag := `"v1"`
+	var fetches, revalidations int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt64(&revalidations, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt64(&fetches, 1)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Docker-Content-Digest", "sha256:test")
+		w.Write(manifest)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &revalidatingTransport{inner: http.DefaultTransport, cache: newManifestCache(2)}}
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		return resp, b
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, b := get("/v2/foo/manifests/sha256-abc")
+		if resp.StatusCode != http.StatusOK || string(b) != string(manifest) {
+			t.Fatalf("unexpected response %d: %q", resp.StatusCode, b)
+		}
+		if resp.Header.Get("Docker-Content-Digest") != "sha256:test" {
+			t.Fatalf("headers of the manifest weren't kept: %v", resp.Header)
+		}
+	}
+	if fetches != 1 || revalidations != 2 {
+		t.Fatalf("unexpected requests; expected 1 fetch and 2 revalidations, got %d and %d", fetches, revalidations)
+	}
+
+	// Manifests fetched by digest are never revalidated.
+	get("/v2/foo/manifests/sha256:abc")
+	get("/v2/foo/manifests/sha256:abc")
+	if fetches != 3 || revalidations != 2 {
+		t.Fatalf("manifest fetched by digest was revalidated; got %d fetches and %d revalidations", fetches, revalidations)
+	}
+
+	// Once the manifest changes, it's fetched again.
+	etag = `"v2"`
+	get("/v2/foo/manifests/sha256-abc")
+	if fetches != 4 {
+		t.Fatalf("changed manifest wasn't fetched again; got %d fetches", fetches)
+	}
+}
+
+func TestIsTagManifestPath(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/v2/foo/manifests/latest":       true,
+		"/v2/foo/bar/manifests/sha256-a": true,
+		"/v2/foo/manifests/sha256:a":     false,
+		"/v2/foo/blobs/sha256:a":         false,
+		"/v2/foo/manifests/":             false,
+	} {
+		if got := isTagManifestPath(path); got != expected {
+			t.Errorf("unexpected result for %s; expected = %v, got = %v", path, expected, got)
+		}
+	}
+}
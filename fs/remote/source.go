@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var errNoBlobSources = errors.New("no blob sources")
+
+// BlobSource is a source of blob contents other than the registry, e.g. a peer-to-peer network.
+// Blob sources are tried in order before the registry, which is used as a fallback
+// when no source serves the requested range.
+type BlobSource interface {
+	// Name identifies the source in logs.
+	Name() string
+
+	// Fetch returns `size` bytes of the blob described by `desc` of the image `refspec`, starting at
+	// offset `off`. It returns an error if the source can't serve the range, so that the next source is tried.
+	Fetch(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, off, size int64) (io.ReadCloser, error)
+}
+
+// sourceFetcher fetches regions of a blob from blob sources and falls back
+// to the registry fetcher if none of them serves the regions.
+type sourceFetcher struct {
+	sources  []BlobSource
+	refspec  reference.Spec
+	desc     ocispec.Descriptor
+	fallback fetcher
+}
+
+func (f *sourceFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	var s regionSet
+	for _, reg := range rs {
+		s.add(reg)
+	}
+	reg := superRegion(s.rs)
+	for _, src := range f.sources {
+		rc, err := src.Fetch(ctx, f.refspec, f.desc, reg.b, reg.size())
+		if err == nil {
+			return newSinglePartReader(reg, rc), nil
+		}
+		log.G(ctx).WithError(err).WithField("source", src.Name()).WithField(logutil.LayerField, f.desc.Digest).
+			Debug("failed to fetch from blob source, falling back")
+	}
+	return f.fallback.fetch(ctx, rs, retry)
+}
+
+// check checks the registry, which must stay reachable as the fallback.
+func (f *sourceFetcher) check() error {
+	return f.fallback.check()
+}
+
+func (f *sourceFetcher) genID(reg region) string {
+	return f.fallback.genID(reg)
+}
+
+// FetchFromSources returns the whole blob described by `desc` of the image `refspec` from the first
+// blob source which serves it.
+func FetchFromSources(ctx context.Context, sources []BlobSource, refspec reference.Spec, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	var lastErr error
+	for _, src := range sources {
+		rc, err := src.Fetch(ctx, refspec, desc, 0, desc.Size)
+		if err == nil {
+			return rc, nil
+		}
+		log.G(ctx).WithError(err).WithField("source", src.Name()).WithField(logutil.LayerField, desc.Digest).
+			Debug("failed to fetch from blob source")
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errNoBlobSources
+	}
+	return nil, lastErr
+}
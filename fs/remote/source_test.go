@@ -0,0 +1,116 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type fakeBlobSource struct {
+	contents []byte
+	fetched  int
+}
+
+func (s *fakeBlobSource) Name() string { return "fake" }
+
+func (s *fakeBlobSource) Fetch(_ context.Context, _ reference.Spec, _ ocispec.Descriptor, off, size int64) (io.ReadCloser, error) {
+	if s.contents == nil {
+		return nil, fmt.Errorf("blob not found")
+	}
+	s.fetched++
+	return io.NopCloser(bytes.NewReader(s.contents[off : off+size])), nil
+}
+
+type fakeFetcher struct {
+	contents []byte
+	fetched  int
+}
+
+func (f *fakeFetcher) fetch(_ context.Context, rs []region, _ bool) (multipartReadCloser, error) {
+	f.fetched++
+	reg := rs[0]
+	return newSinglePartReader(reg, io.NopCloser(bytes.NewReader(f.contents[reg.b:reg.e+1]))), nil
+}
+
+func (f *fakeFetcher) check() error { return nil }
+
+func (f *fakeFetcher) genID(reg region) string { return fmt.Sprintf("%d-%d", reg.b, reg.e) }
+
+func TestSourceFetcher(t *testing.T) {
+	contents := []byte("0123456789abcdef")
+	tests := []struct {
+		name             string
+		sources          []*fakeBlobSource
+		expectedFallback bool
+	}{
+		{
+			name:    "first source serves the blob",
+			sources: []*fakeBlobSource{{contents: contents}, {contents: contents}},
+		},
+		{
+			name:    "second source serves the blob",
+			sources: []*fakeBlobSource{{}, {contents: contents}},
+		},
+		{
+			name:             "falls back to the registry",
+			sources:          []*fakeBlobSource{{}, {}},
+			expectedFallback: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallback := &fakeFetcher{contents: contents}
+			var sources []BlobSource
+			for _, s := range tt.sources {
+				sources = append(sources, s)
+			}
+			f := &sourceFetcher{sources: sources, fallback: fallback}
+			mr, err := f.fetch(context.Background(), []region{{2, 5}}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg, r, err := mr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reg != (region{2, 5}) || !bytes.Equal(b, contents[2:6]) {
+				t.Fatalf("unexpected region %v with content %q", reg, b)
+			}
+			if fetchedFallback := fallback.fetched > 0; fetchedFallback != tt.expectedFallback {
+				t.Fatalf("unexpected fallback; expected = %v, got = %v", tt.expectedFallback, fetchedFallback)
+			}
+			var sourceFetches int
+			for _, s := range tt.sources {
+				sourceFetches += s.fetched
+			}
+			if sourceFetches > 1 {
+				t.Fatalf("blob was fetched from %d sources; expected at most 1", sourceFetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/pkg/kmutex"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// sharedMountsDirName is the name of the directory in the root directory of the filesystem
+	// which holds the FUSE mounts of the shared layers.
+	sharedMountsDirName = "shared-mounts"
+
+	// sharedMountDirName is the name of the mountpoint of the FUSE mount of a shared layer,
+	// in the directory of the layer. The passthrough directory of the layer is next to it.
+	sharedMountDirName = "fs"
+)
+
+// sharedMounts shares a single FUSE mount between all the snapshots of the same layer.
+// The layer is mounted once in a directory of its own, which is bind-mounted read-only at the
+// mountpoint of each snapshot, and is unmounted once the last of these snapshots is unmounted.
+// Unless namespaces share their caches, only the snapshots of the same containerd namespace
+// share the mount of a layer.
+type sharedMounts struct {
+	root string
+	// isolateNamespaces mounts the layers of each containerd namespace apart.
+	isolateNamespaces bool
+	// unmountLayer unmounts the FUSE mount of a layer once no snapshot uses it.
+	unmountLayer func(ctx context.Context, source string) error
+
+	// locks serializes the mounts and unmounts of each layer digest.
+	locks kmutex.KeyedLocker
+
+	mu     sync.Mutex
+	layers map[string]*sharedLayer // layer key -> shared layer
+	binds  map[string]*sharedLayer // snapshot mountpoint -> shared layer bound to it
+
+	bind   func(source, mountpoint string) error
+	unbind func(mountpoint string) error
+}
+
+type sharedLayer struct {
+	digest string
+	// key is the digest of the layer, qualified by its namespace if namespaces are isolated.
+	key string
+	// source is the mountpoint of the FUSE mount of the layer.
+	source string
+	// refs is the number of snapshot mountpoints bound to the layer.
+	refs int
+}
+
+func newSharedMounts(ctx context.Context, root string, unmountLayer func(ctx context.Context, source string) error) (*sharedMounts, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create shared mounts directory: %w", err)
+	}
+	cleanupSharedMounts(ctx, root)
+	return &sharedMounts{
+		root:         root,
+		unmountLayer: unmountLayer,
+		locks:        kmutex.New(),
+		layers:       make(map[string]*sharedLayer),
+		binds:        make(map[string]*sharedLayer),
+		bind:         bindMountReadOnly,
+		unbind:       func(mountpoint string) error { return syscall.Unmount(mountpoint, syscall.MNT_DETACH) },
+	}, nil
+}
+
+// cleanupSharedMounts removes the shared layers left in `root` by a previous run of the
+// snapshotter. Their FUSE servers are gone, so they can't be reused.
+func cleanupSharedMounts(ctx context.Context, root string) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list shared mounts")
+		return
+	}
+	for _, e := range entries {
+		dir := filepath.Join(root, e.Name())
+		mountpoint := filepath.Join(dir, sharedMountDirName)
+		// The mountpoint holds the FUSE mount, and possibly a passthrough mount stacked on it.
+		// EINVAL means that nothing is mounted there anymore.
+		var err error
+		for i := 0; i < 2 && err == nil; i++ {
+			err = syscall.Unmount(mountpoint, syscall.MNT_DETACH)
+		}
+		if err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOENT) {
+			log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to unmount stale shared mount")
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.G(ctx).WithError(err).WithField("dir", dir).Warn("failed to remove stale shared mount")
+		}
+	}
+}
+
+// bindMountReadOnly bind-mounts `source` read-only at `mountpoint`.
+func bindMountReadOnly(source, mountpoint string) error {
+	if err := syscall.Mount(source, mountpoint, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount shared layer: %w", err)
+	}
+	if err := syscall.Mount("", mountpoint, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		syscall.Unmount(mountpoint, syscall.MNT_DETACH)
+		return fmt.Errorf("failed to remount shared layer read-only: %w", err)
+	}
+	return nil
+}
+
+// Acquire bind-mounts the FUSE mount of the layer `dgst` at `mountpoint`. If no snapshot uses
+// the layer yet, `mount` is called first to mount the layer at the source of the bind mount.
+func (s *sharedMounts) Acquire(ctx context.Context, dgst, mountpoint string, mount func(source string) error) error {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return fmt.Errorf("invalid layer digest %q: %w", dgst, err)
+	}
+	key, dirName := dgst, d.Encoded()
+	if ns, _ := namespaces.Namespace(ctx); s.isolateNamespaces && ns != "" {
+		// The namespace names a directory, so it must not escape the root.
+		if err := identifiers.Validate(ns); err != nil {
+			return fmt.Errorf("invalid namespace: %w", err)
+		}
+		key, dirName = ns+"/"+dgst, ns+"-"+d.Encoded()
+	}
+	if err := s.locks.Lock(ctx, key); err != nil {
+		return err
+	}
+	defer s.locks.Unlock(key)
+
+	s.mu.Lock()
+	l, ok := s.layers[key]
+	s.mu.Unlock()
+	if !ok {
+		dir := filepath.Join(s.root, dirName)
+		l = &sharedLayer{digest: dgst, key: key, source: filepath.Join(dir, sharedMountDirName)}
+		if err := os.MkdirAll(l.source, 0700); err != nil {
+			return fmt.Errorf("failed to create shared mountpoint: %w", err)
+		}
+		if err := mount(l.source); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		log.G(ctx).WithField("source", l.source).Debug("mounted shared layer")
+	}
+	if err := s.bind(l.source, mountpoint); err != nil {
+		if l.refs == 0 {
+			s.release(ctx, l)
+		}
+		return err
+	}
+	l.refs++
+	s.mu.Lock()
+	s.layers[key] = l
+	s.binds[mountpoint] = l
+	s.mu.Unlock()
+	return nil
+}
+
+// Release unmounts the bind mount at `mountpoint`, and the FUSE mount of its layer if no other
+// snapshot uses it. It returns false if `mountpoint` isn't bound to a shared layer.
+func (s *sharedMounts) Release(ctx context.Context, mountpoint string) (bool, error) {
+	s.mu.Lock()
+	l, ok := s.binds[mountpoint]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	// Unmounts can't be canceled, or the layer would never be released.
+	if err := s.locks.Lock(context.Background(), l.key); err != nil {
+		return true, err
+	}
+	defer s.locks.Unlock(l.key)
+
+	s.mu.Lock()
+	if s.binds[mountpoint] != l {
+		// Released concurrently.
+		s.mu.Unlock()
+		return true, nil
+	}
+	delete(s.binds, mountpoint)
+	l.refs--
+	if l.refs == 0 {
+		delete(s.layers, l.key)
+	}
+	s.mu.Unlock()
+
+	err := s.unbind(mountpoint)
+	if l.refs == 0 {
+		if rErr := s.release(ctx, l); err == nil {
+			err = rErr
+		}
+	}
+	return true, err
+}
+
+// release unmounts the FUSE mount of `l` and removes its directory.
+func (s *sharedMounts) release(ctx context.Context, l *sharedLayer) error {
+	log.G(ctx).WithField("source", l.source).Debug("unmounting shared layer")
+	if err := s.unmountLayer(ctx, l.source); err != nil {
+		return fmt.Errorf("failed to unmount shared layer %s: %w", l.digest, err)
+	}
+	return os.RemoveAll(filepath.Dir(l.source))
+}
+
+// Source returns the mountpoint of the FUSE mount bound at `mountpoint`,
+// or `mountpoint` itself if it isn't bound to a shared layer.
+func (s *sharedMounts) Source(mountpoint string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.binds[mountpoint]; ok {
+		return l.source
+	}
+	return mountpoint
+}
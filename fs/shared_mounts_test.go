@@ -0,0 +1,195 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+)
+
+func TestSharedMounts(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	var (
+		mounted   []string
+		unmounted []string
+		bound     = make(map[string]string)
+	)
+	s, err := newSharedMounts(ctx, root, func(_ context.Context, source string) error {
+		unmounted = append(unmounted, source)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bind = func(source, mountpoint string) error {
+		if mountpoint == "/mnt/broken" {
+			return errors.New("bind failed")
+		}
+		bound[mountpoint] = source
+		return nil
+	}
+	s.unbind = func(mountpoint string) error {
+		delete(bound, mountpoint)
+		return nil
+	}
+	mount := func(source string) error {
+		mounted = append(mounted, source)
+		return nil
+	}
+
+	const (
+		digest      = "sha256:4a1c0a2fdb0aecbb2e0bd1f3ca0ff9d8cb2a4d5c5a0f5d04ab1cd4c6e77ebbd4"
+		otherDigest = "sha256:0e5ca5a7dcb9a2e8b5d3f0ac34f8ea6a1b2f1c3c8d1d5a62f4cd2c2e3e6ee1a9"
+		newDigest   = "sha256:9b7e3c6f0d2a4e1c8a5b3d7f9e0c2a4b6d8f1e3a5c7b9d0f2e4a6c8b0d2f4e6a"
+	)
+	for _, mountpoint := range []string{"/mnt/1", "/mnt/2"} {
+		if err := s.Acquire(ctx, digest, mountpoint, mount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Acquire(ctx, otherDigest, "/mnt/3", mount); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounted) != 2 {
+		t.Fatalf("layers were mounted %d times; want 2: %v", len(mounted), mounted)
+	}
+	source := s.Source("/mnt/1")
+	if source != mounted[0] || bound["/mnt/1"] != source || bound["/mnt/2"] != source {
+		t.Fatalf("snapshots of the same layer are not bound to its mount: %v", bound)
+	}
+	if bound["/mnt/3"] != mounted[1] || mounted[1] == source {
+		t.Fatalf("snapshot of another layer is not bound to the mount of its layer: %v", bound)
+	}
+	if filepath.Dir(filepath.Dir(source)) != root {
+		t.Fatalf("layer is mounted at %q, outside of %q", source, root)
+	}
+	if s.Source("/mnt/other") != "/mnt/other" {
+		t.Fatal("unshared mountpoint was resolved to a shared mount")
+	}
+
+	// The layer stays mounted if binding it fails for another snapshot.
+	if err := s.Acquire(ctx, digest, "/mnt/broken", mount); err == nil {
+		t.Fatal("acquired layer which couldn't be bound")
+	}
+	if len(unmounted) != 0 {
+		t.Fatalf("layer in use was unmounted: %v", unmounted)
+	}
+
+	if shared, err := s.Release(ctx, "/mnt/1"); !shared || err != nil {
+		t.Fatalf("failed to release shared mount (shared: %v): %v", shared, err)
+	}
+	if len(unmounted) != 0 {
+		t.Fatalf("layer in use was unmounted: %v", unmounted)
+	}
+	if _, ok := bound["/mnt/1"]; ok {
+		t.Fatal("released snapshot is still bound")
+	}
+	if shared, err := s.Release(ctx, "/mnt/2"); !shared || err != nil {
+		t.Fatalf("failed to release shared mount (shared: %v): %v", shared, err)
+	}
+	if len(unmounted) != 1 || unmounted[0] != source {
+		t.Fatalf("layer was not unmounted once unused: %v", unmounted)
+	}
+	if _, err := os.Stat(filepath.Dir(source)); !os.IsNotExist(err) {
+		t.Fatalf("directory of unmounted layer was not removed: %v", err)
+	}
+	if shared, _ := s.Release(ctx, "/mnt/2"); shared {
+		t.Fatal("released mountpoint is still shared")
+	}
+
+	// The layer is mounted again by the next snapshot.
+	if err := s.Acquire(ctx, digest, "/mnt/4", mount); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounted) != 3 || mounted[2] != source {
+		t.Fatalf("layer was not mounted again: %v", mounted)
+	}
+
+	// The layer is unmounted if its first snapshot can't be bound.
+	if err := s.Acquire(ctx, newDigest, "/mnt/broken", mount); err == nil {
+		t.Fatal("acquired layer which couldn't be bound")
+	}
+	if len(unmounted) != 2 || unmounted[1] != mounted[3] {
+		t.Fatalf("unbound layer was not unmounted: %v", unmounted)
+	}
+}
+
+func TestSharedMountsMountFailure(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := newSharedMounts(ctx, root, func(context.Context, string) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bind = func(string, string) error { return nil }
+	errMount := errors.New("mount failed")
+	err = s.Acquire(ctx, "sha256:4a1c0a2fdb0aecbb2e0bd1f3ca0ff9d8cb2a4d5c5a0f5d04ab1cd4c6e77ebbd4", "/mnt/1", func(string) error { return errMount })
+	if !errors.Is(err, errMount) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Fatalf("mountpoint of layer which failed to mount was not removed: %v", entries)
+	}
+	if shared, _ := s.Release(ctx, "/mnt/1"); shared {
+		t.Fatal("layer which failed to mount was shared")
+	}
+	if err := s.Acquire(ctx, "latest", "/mnt/1", func(string) error { return nil }); err == nil {
+		t.Fatal("acquired layer with invalid digest")
+	}
+}
+
+func TestSharedMountsIsolateNamespaces(t *testing.T) {
+	const digest = "sha256:4a1c0a2fdb0aecbb2e0bd1f3ca0ff9d8cb2a4d5c5a0f5d04ab1cd4c6e77ebbd4"
+	ctx := context.Background()
+	s, err := newSharedMounts(ctx, t.TempDir(), func(context.Context, string) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.isolateNamespaces = true
+	s.bind = func(source, mountpoint string) error { return nil }
+	var mounted []string
+	mount := func(source string) error {
+		mounted = append(mounted, source)
+		return nil
+	}
+	for _, tc := range []struct {
+		namespace, mountpoint string
+	}{
+		{"tenant1", "/mnt/1"},
+		{"tenant1", "/mnt/2"},
+		{"tenant2", "/mnt/3"},
+	} {
+		if err := s.Acquire(namespaces.WithNamespace(ctx, tc.namespace), digest, tc.mountpoint, mount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(mounted) != 2 || mounted[0] == mounted[1] {
+		t.Fatalf("layer should be mounted once per namespace: %v", mounted)
+	}
+	if s.Source("/mnt/2") != mounted[0] || s.Source("/mnt/3") != mounted[1] {
+		t.Fatalf("snapshots are bound to the mount of another namespace")
+	}
+	if err := s.Acquire(namespaces.WithNamespace(ctx, "../escape"), digest, "/mnt/4", mount); err == nil {
+		t.Fatalf("acquired layer of an invalid namespace")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"fmt"
+
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// LabelNamespaceV1 is the namespace of version 1 of the snapshot labels of the snapshotter.
+// Orchestration layers can pass hints to the snapshotter with these labels through containerd,
+// e.g. as annotations of the layer descriptors which containerd passes to the snapshotter during
+// unpack. The labels of a version are never removed or repurposed; incompatible changes get a new
+// version.
+//
+// The snapshotter sets all the labels of the namespace on the snapshots of the layers it prepares,
+// so that clients can find out how a snapshot was mounted (e.g. with `ctr snapshot info`).
+const LabelNamespaceV1 = "containerd.io/snapshot/remote/soci/v1/"
+
+const (
+	// ImageRefLabelV1 is the reference of the image the layer is fetched from.
+	// It overrides containerd's target ref label.
+	ImageRefLabelV1 = LabelNamespaceV1 + "image.ref"
+
+	// LayerDigestLabelV1 is the digest of the layer. It must match containerd's target layer
+	// digest label if both are set.
+	LayerDigestLabelV1 = LabelNamespaceV1 + "layer.digest"
+
+	// IndexDigestLabelV1 is the digest of the SOCI index of the image. It overrides
+	// TargetSociIndexDigestLabel.
+	IndexDigestLabelV1 = LabelNamespaceV1 + "index.digest"
+
+	// PrefetchLabelV1 is the percentage of the spans of the layer to fetch when it's mounted.
+	// It overrides TargetPrefetchLabel.
+	PrefetchLabelV1 = LabelNamespaceV1 + "prefetch"
+
+	// PrefetchProfileDigestLabelV1 is the digest of a prefetch profile in the local content store
+	// of the snapshotter, listing the files whose contents are fetched when the layer is mounted.
+	PrefetchProfileDigestLabelV1 = LabelNamespaceV1 + "prefetch.profile.digest"
+)
+
+// versionedLabels maps the labels of LabelNamespaceV1 to the labels the snapshotter reads.
+var versionedLabels = []struct {
+	v1, target string
+	validate   func(string) error
+}{
+	{ImageRefLabelV1, ctdsnapshotters.TargetRefLabel, validateRef},
+	{LayerDigestLabelV1, ctdsnapshotters.TargetLayerDigestLabel, validateDigest},
+	{IndexDigestLabelV1, TargetSociIndexDigestLabel, validateDigest},
+	{PrefetchLabelV1, TargetPrefetchLabel, func(v string) error {
+		_, err := ParsePrefetchPercent(v)
+		return err
+	}},
+}
+
+// ApplyVersionedLabels returns a copy of `labels` in which the labels the snapshotter reads are
+// overridden by the labels of LabelNamespaceV1, and in which the labels of LabelNamespaceV1
+// are set from the labels the snapshotter reads where they are missing.
+func ApplyVersionedLabels(labels map[string]string) (map[string]string, error) {
+	applied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		applied[k] = v
+	}
+	for _, l := range versionedLabels {
+		v, ok := labels[l.v1]
+		if !ok {
+			if target, ok := labels[l.target]; ok {
+				applied[l.v1] = target
+			}
+			continue
+		}
+		if err := l.validate(v); err != nil {
+			return nil, fmt.Errorf("invalid label %s: %w", l.v1, err)
+		}
+		if l.v1 == LayerDigestLabelV1 {
+			if target, ok := labels[l.target]; ok && target != v {
+				return nil, fmt.Errorf("label %s (%s) doesn't match the layer of the snapshot (%s)", l.v1, v, target)
+			}
+		}
+		applied[l.target] = v
+	}
+	if v, ok := labels[PrefetchProfileDigestLabelV1]; ok {
+		if err := validateDigest(v); err != nil {
+			return nil, fmt.Errorf("invalid label %s: %w", PrefetchProfileDigestLabelV1, err)
+		}
+	}
+	return applied, nil
+}
+
+func validateRef(v string) error {
+	_, err := reference.Parse(v)
+	return err
+}
+
+func validateDigest(v string) error {
+	_, err := digest.Parse(v)
+	return err
+}
@@ -57,6 +57,11 @@ type GetSources func(labels map[string]string) (source []Source, err error)
 // RegistryHosts returns a list of registries that provides the specified image.
 type RegistryHosts func(reference.Spec) ([]docker.RegistryHost, error)
 
+// RefRewriter rewrites the reference of an image before it is resolved, e.g. so that the
+// image is resolved through a pull-through cache. It returns the reference unchanged if
+// no rewrite applies.
+type RefRewriter func(ref string) string
+
 // Source is a typed blob source information. This contains information about
 // a blob stored in registries and some contexts of the blob.
 type Source struct {
@@ -87,8 +92,28 @@ const (
 
 	// TargetSociIndexDigestLabel is a label which contains the digest of the soci index.
 	TargetSociIndexDigestLabel = "containerd.io/snapshot/remote/soci.index.digest"
+
+	// TargetPrefetchLabel is a label which contains the percentage of the spans of the layer
+	// to fetch when it's mounted, e.g. "25%".
+	TargetPrefetchLabel = "containerd.io/snapshot/remote/soci.prefetch"
+
+	// TargetLayerMediaTypeLabel is a label which contains the media type of the layer.
+	TargetLayerMediaTypeLabel = "containerd.io/snapshot/remote/soci.layer.media-type"
 )
 
+// IsForeignLayer returns whether the media type `mediaType` is of a foreign or non-distributable
+// layer, e.g. the base layers of Windows images, which must be fetched from the URLs of their
+// descriptor rather than the registry of the image.
+func IsForeignLayer(mediaType string) bool {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2LayerForeign, images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable, ocispec.MediaTypeImageLayerNonDistributableGzip,
+		ocispec.MediaTypeImageLayerNonDistributableZstd:
+		return true
+	}
+	return false
+}
+
 // FromDefaultLabels returns a function for converting snapshot labels to
 // source information based on labels.
 func FromDefaultLabels(hosts RegistryHosts) GetSources {
@@ -182,6 +207,7 @@ func AppendDefaultLabelsHandlerWrapper(indexDigest string, wrapper func(images.H
 						}
 
 						c.Annotations[TargetSizeLabel] = fmt.Sprintf("%d", c.Size)
+						c.Annotations[TargetLayerMediaTypeLabel] = c.MediaType
 						c.Annotations[TargetSociIndexDigestLabel] = indexDigest
 
 						var layerSizes string
@@ -204,3 +230,40 @@ func AppendDefaultLabelsHandlerWrapper(indexDigest string, wrapper func(images.H
 		})
 	}
 }
+
+// ParsePrefetchPercent parses the value of TargetPrefetchLabel, a percentage between 0 and 100
+// with or without a trailing "%".
+func ParsePrefetchPercent(v string) (int, error) {
+	percent, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "%"))
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid prefetch percentage %q: must be between 0%% and 100%%", v)
+	}
+	return percent, nil
+}
+
+// AppendPrefetchLabelHandlerWrapper makes a handler which sets TargetPrefetchLabel of each layer
+// descriptor to `prefetch` during unpack, so that the snapshotter fetches that percentage of the
+// spans of the layers when it mounts them.
+func AppendPrefetchLabelHandlerWrapper(prefetch string, wrapper func(images.Handler) images.Handler) func(f images.Handler) images.Handler {
+	return func(f images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := wrapper(f).Handle(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			switch desc.MediaType {
+			case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+				for i := range children {
+					c := &children[i]
+					if images.IsLayerType(c.MediaType) {
+						if c.Annotations == nil {
+							c.Annotations = make(map[string]string)
+						}
+						c.Annotations[TargetPrefetchLabel] = prefetch
+					}
+				}
+			}
+			return children, nil
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"testing"
+
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+)
+
+func TestParsePrefetchPercent(t *testing.T) {
+	tests := []struct {
+		value   string
+		percent int
+		wantErr bool
+	}{
+		{value: "25%", percent: 25},
+		{value: "25", percent: 25},
+		{value: " 100% ", percent: 100},
+		{value: "0%", percent: 0},
+		{value: "101%", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "half", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		percent, err := ParsePrefetchPercent(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expected an error for %q; got = %d", tt.value, percent)
+			}
+			continue
+		}
+		if err != nil || percent != tt.percent {
+			t.Errorf("unexpected percentage of %q; expected = %d, got = %d, err = %v", tt.value, tt.percent, percent, err)
+		}
+	}
+}
+
+func TestApplyVersionedLabels(t *testing.T) {
+	const (
+		layer   = "sha256:4a1c0a2fdb0aecbb2e0bd1f3ca0ff9d8cb2a4d5c5a0f5d04ab1cd4c6e77ebbd4"
+		index   = "sha256:0e5ca5a7dcb9a2e8b5d3f0ac34f8ea6a1b2f1c3c8d1d5a62f4cd2c2e3e6ee1a9"
+		hint    = "sha256:9b7e3c6f0d2a4e1c8a5b3d7f9e0c2a4b6d8f1e3a5c7b9d0f2e4a6c8b0d2f4e6a"
+		profile = "sha256:1d2c3b4a5f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b8a9f0e1d2c"
+	)
+	labels := map[string]string{
+		ctdsnapshotters.TargetRefLabel:         "registry.example.com/app:latest",
+		ctdsnapshotters.TargetLayerDigestLabel: layer,
+		TargetSociIndexDigestLabel:             index,
+		IndexDigestLabelV1:                     hint,
+		PrefetchLabelV1:                        "50%",
+		PrefetchProfileDigestLabelV1:           profile,
+	}
+	applied, err := ApplyVersionedLabels(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		// Versioned labels override the labels the snapshotter reads...
+		TargetSociIndexDigestLabel: hint,
+		TargetPrefetchLabel:        "50%",
+		// ...and are set from them where they are missing.
+		ImageRefLabelV1:                        "registry.example.com/app:latest",
+		LayerDigestLabelV1:                     layer,
+		ctdsnapshotters.TargetRefLabel:         "registry.example.com/app:latest",
+		ctdsnapshotters.TargetLayerDigestLabel: layer,
+		IndexDigestLabelV1:                     hint,
+		PrefetchLabelV1:                        "50%",
+		PrefetchProfileDigestLabelV1:           profile,
+	}
+	if len(applied) != len(expected) {
+		t.Fatalf("unexpected labels: %v", applied)
+	}
+	for k, v := range expected {
+		if applied[k] != v {
+			t.Errorf("unexpected label %s; expected = %q, got = %q", k, v, applied[k])
+		}
+	}
+	if labels[TargetSociIndexDigestLabel] != index {
+		t.Fatal("labels were modified")
+	}
+
+	for name, invalid := range map[string]map[string]string{
+		"layer mismatch":   {ctdsnapshotters.TargetLayerDigestLabel: layer, LayerDigestLabelV1: index},
+		"invalid digest":   {IndexDigestLabelV1: "latest"},
+		"invalid ref":      {ImageRefLabelV1: "Not A Ref"},
+		"invalid prefetch": {PrefetchLabelV1: "all"},
+		"invalid profile":  {PrefetchProfileDigestLabelV1: "profile"},
+	} {
+		if _, err := ApplyVersionedLabels(invalid); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"errors"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+)
+
+// ErrCompactionNotSupported is returned by Compact if the span cache can't pack its contents.
+var ErrCompactionNotSupported = errors.New("span cache does not support compaction")
+
+// Compact packs the cached spans into a single file if at least `minFiles` of them are
+// cached in files of their own, and returns the number of spans packed. Packed spans are
+// read from the pack file, so compaction is transparent to readers.
+func (m *SpanManager) Compact(minFiles int) (int, error) {
+	compactor, ok := m.cache.(cache.Compactor)
+	if !ok {
+		return 0, ErrCompactionNotSupported
+	}
+	return compactor.Compact(minFiles)
+}
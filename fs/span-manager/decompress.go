@@ -0,0 +1,206 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"io"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// backgroundJobsPerWorker bounds the spans queued for decompression ahead of reads by worker,
+// so that the reads of a layer don't queue up more spans than the workers can keep up with.
+const backgroundJobsPerWorker = 16
+
+// DecompressPool is a pool of workers decompressing spans. It limits the number of spans
+// decompressed at the same time across all layers, and decompresses the spans fetched ahead
+// of reads in the background, so that sequential reads of a layer, which read one span
+// at a time, don't decompress every span on a single core.
+//
+// Spans are decompressed in priority order, and in FIFO order within the same priority, so that
+// the spans reads wait for aren't decompressed after the spans decompressed ahead of reads.
+//
+// A nil *DecompressPool does not limit decompression and doesn't decompress in the background.
+type DecompressPool struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	jobs          [numPriorities][]func()
+	maxBackground int
+	closed        bool
+}
+
+// NewDecompressPool creates a DecompressPool with `workers` workers.
+// It returns nil (no pool) if `workers` is not positive.
+func NewDecompressPool(workers int) *DecompressPool {
+	if workers <= 0 {
+		return nil
+	}
+	p := &DecompressPool{maxBackground: workers * backgroundJobsPerWorker}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Close stops the workers once the spans which reads wait for are decompressed.
+// The spans queued for decompression ahead of reads are dropped.
+func (p *DecompressPool) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.jobs[PriorityBackground] = nil
+	p.cond.Broadcast()
+}
+
+func (p *DecompressPool) work() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		job, ok := p.next()
+		if !ok {
+			if p.closed {
+				return
+			}
+			p.cond.Wait()
+			continue
+		}
+		p.mu.Unlock()
+		job()
+		p.mu.Lock()
+	}
+}
+
+// next pops the oldest job with the highest priority. p.mu must be held.
+func (p *DecompressPool) next() (func(), bool) {
+	for prio := numPriorities - 1; prio >= 0; prio-- {
+		if q := p.jobs[prio]; len(q) > 0 {
+			job := q[0]
+			q[0] = nil
+			p.jobs[prio] = q[1:]
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// queue queues `job` with priority `prio`. It returns false if the pool is closed, or if
+// `prio` is PriorityBackground and enough jobs are queued with it already.
+func (p *DecompressPool) queue(prio Priority, job func()) bool {
+	if prio < 0 {
+		prio = 0
+	} else if prio >= numPriorities {
+		prio = numPriorities - 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || (prio == PriorityBackground && len(p.jobs[prio]) >= p.maxBackground) {
+		return false
+	}
+	p.jobs[prio] = append(p.jobs[prio], job)
+	p.cond.Signal()
+	return true
+}
+
+// run runs `fn` on a worker with priority `prio` and waits for it to return.
+// Without a pool, or once the pool is closed, `fn` runs on the calling goroutine.
+func (p *DecompressPool) run(prio Priority, fn func()) {
+	if p == nil {
+		fn()
+		return
+	}
+	done := make(chan struct{})
+	if !p.queue(prio, func() {
+		defer close(done)
+		fn()
+	}) {
+		fn()
+		return
+	}
+	<-done
+}
+
+// WithDecompressPool sets the pool used to decompress spans.
+func WithDecompressPool(p *DecompressPool) Option {
+	return func(m *SpanManager) {
+		m.decompressPool = p
+	}
+}
+
+// decompressAhead queues the spans from `first` to `last` which are fetched but not
+// uncompressed yet for decompression in the background by the workers of the decompress pool.
+// Spans which don't fit in the queue of the pool are decompressed when they are read.
+func (m *SpanManager) decompressAhead(first, last compression.SpanID) {
+	if m.decompressPool == nil {
+		return
+	}
+	for id := first; id <= last; id++ {
+		s := m.spans[id]
+		if !s.checkState(fetched) {
+			continue
+		}
+		queued := m.decompressPool.queue(PriorityBackground, func() {
+			// Spans locked by a read are decompressed by the read.
+			if !s.mu.TryLock() {
+				return
+			}
+			defer s.mu.Unlock()
+			if !s.checkState(fetched) {
+				return
+			}
+			// The job runs on a worker already, so the span isn't queued again to be extracted.
+			if _, err := m.uncompressCachedSpan(s, m.extractSpan); err != nil {
+				m.logger(s.id).WithError(err).Debug("failed to decompress span ahead")
+			}
+		})
+		if !queued {
+			return
+		}
+	}
+}
+
+// uncompressCachedSpan reads the compressed span from the cache, uncompresses it with `uncompress`
+// and caches it, and returns the uncompressed span. The caller must hold the lock of the span, which
+// must be fetched.
+// span state change: fetched -> uncompressed.
+func (m *SpanManager) uncompressCachedSpan(s *span, uncompress func(s *span, compressedBuf []byte) ([]byte, error)) ([]byte, error) {
+	compressedSize := s.endCompOffset - s.startCompOffset
+	r, err := m.getSpanFromCache(s.id, fetched, 0, compressedSize)
+	if err != nil {
+		return nil, err
+	}
+	compressedBuf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	uncompSpanBuf, err := uncompress(s, compressedBuf)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.addSpanToCache(s.id, uncompressed, uncompSpanBuf, m.cacheOpt...); err != nil {
+		return nil, err
+	}
+	if err := s.setState(uncompressed); err != nil {
+		return nil, err
+	}
+	m.recordCachedSpan(s.id, uncompressed, uncompSpanBuf)
+	return uncompSpanBuf, nil
+}
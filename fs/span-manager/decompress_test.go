@@ -0,0 +1,315 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// compressibleData returns `size` bytes of text-like data, so that
+// decompressing it costs about as much as decompressing real layers.
+func compressibleData(size int) []byte {
+	words := []string{"soci ", "snapshotter ", "span ", "layer ", "ztoc ", "lazy ", "loading ", "\n"}
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(words[rand.Intn(len(words))])
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestSpanManagerDecompressAhead(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-decompress-test", string(testutil.RandomByteData(int64(8*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	gzr, err := gzip.NewReader(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewDecompressPool(2)
+	defer pool.Close()
+	m := New(toc, r, cache.NewMemoryCache(), 0,
+		WithDecompressPool(pool),
+		WithReadTuning(ReadTuning{ReadaheadSize: int64(len(archive))}))
+
+	p := make([]byte, 100)
+	if _, err := m.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+	if !bytes.Equal(p, archive[:len(p)]) {
+		t.Fatal("unexpected archive contents")
+	}
+
+	if toc.MaxSpanID < 4 {
+		t.Fatalf("expected the layer to have several spans; got = %d", toc.MaxSpanID+1)
+	}
+
+	// All the spans read ahead are decompressed in the background.
+	deadline := time.Now().Add(10 * time.Second)
+	for id := compression.SpanID(1); id <= toc.MaxSpanID; id++ {
+		if m.spans[id].startUncompOffset == m.spans[id].endUncompOffset {
+			continue
+		}
+		for !m.spans[id].checkState(uncompressed) {
+			if time.Now().After(deadline) {
+				t.Fatalf("span %d wasn't decompressed ahead", id)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	_, misses := m.CacheStats()
+	for off := int64(0); off < int64(len(archive)); off += int64(len(p)) * 10 {
+		n, err := m.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("failed to read archive: %v", err)
+		}
+		if !bytes.Equal(p[:n], archive[off:off+int64(n)]) {
+			t.Fatalf("unexpected archive contents at offset %d", off)
+		}
+	}
+	if _, got := m.CacheStats(); got != misses {
+		t.Fatalf("expected all reads to hit the cache; misses = %d", got-misses)
+	}
+}
+
+func TestDecompressPool(t *testing.T) {
+	pool := NewDecompressPool(1)
+	defer pool.Close()
+	block := make(chan struct{})
+	if !pool.queue(PriorityNormal, func() { <-block }) {
+		t.Fatal("failed to queue job")
+	}
+
+	// Jobs queued while the worker is busy run in priority order, and in FIFO order within a priority.
+	var (
+		mu    sync.Mutex
+		order []string
+		done  = make(chan struct{}, 4)
+	)
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			done <- struct{}{}
+		}
+	}
+	pool.queue(PriorityBackground, record("background"))
+	pool.queue(PriorityNormal, record("normal1"))
+	pool.queue(PriorityExec, record("exec"))
+	pool.queue(PriorityNormal, record("normal2"))
+	// Spans decompressed ahead of reads are dropped once too many are queued.
+	for i := 1; i < backgroundJobsPerWorker; i++ {
+		if !pool.queue(PriorityBackground, func() {}) {
+			t.Fatalf("background job %d wasn't queued", i)
+		}
+	}
+	if pool.queue(PriorityBackground, func() {}) {
+		t.Fatal("background job was queued beyond the limit")
+	}
+	close(block)
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	want := []string{"exec", "normal1", "normal2", "background"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("jobs ran in order %v; want %v", order, want)
+	}
+}
+
+func TestDecompressPoolClosed(t *testing.T) {
+	pool := NewDecompressPool(1)
+	pool.Close()
+	ran := false
+	pool.run(PriorityNormal, func() { ran = true })
+	if !ran {
+		t.Fatal("job didn't run once the pool was closed")
+	}
+	if pool.queue(PriorityBackground, func() {}) {
+		t.Fatal("background job was queued once the pool was closed")
+	}
+}
+
+func TestSpanManagerAlignedSpans(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("small", "small file"),
+		testutil.File("large", string(compressibleData(int(5*spanSize)))),
+		testutil.File("after", string(compressibleData(int(spanSize/3)))),
+	}
+	toc, r, err := ztoc.BuildAlignedZtocReader(t, tarEntries, gzip.DefaultCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	if !toc.SpanAligned {
+		t.Fatal("ztoc of aligned layer isn't span aligned")
+	}
+	ztoc.CheckSpans(t, toc)
+	gzr, err := gzip.NewReader(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	for _, name := range []string{"small", "large", "after"} {
+		got, err := getFileContentFromSpans(m, toc, name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		entry, err := toc.GetMetadataEntry(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, archive[entry.UncompressedOffset:entry.UncompressedOffset+entry.UncompressedSize]) {
+			t.Fatalf("unexpected contents of %s", name)
+		}
+	}
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		s := m.spans[id]
+		if s.startUncompOffset != compression.Offset(id)*spanSize {
+			t.Fatalf("span %d starts at %d; want %d", id, s.startUncompOffset, compression.Offset(id)*spanSize)
+		}
+	}
+}
+
+// TestSpanManagerSmallMembers reads a layer of concatenated gzip members, each smaller
+// than a span, e.g. an eStargz layer. Its spans hold several members, so they aren't aligned.
+func TestSpanManagerSmallMembers(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	var tarEntries []testutil.TarEntry
+	for i := 0; i < 400; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		tarEntries = append(tarEntries, testutil.File(name, string(compressibleData(rand.Intn(int(spanSize/4))))))
+	}
+	archive, err := io.ReadAll(testutil.BuildTar(tarEntries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every member holds at most a few KiB of the archive, like the members of
+	// layers compressed one tar entry at a time.
+	var layer bytes.Buffer
+	for off := 0; off < len(archive); {
+		end := off + 512 + rand.Intn(int(spanSize/8))
+		if end > len(archive) {
+			end = len(archive)
+		}
+		writeStoredGzipMember(&layer, archive[off:end])
+		off = end
+	}
+	layerFileName, layerData, err := testutil.WriteTarToTempFile("tmp.*", &layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(layerFileName)
+	toc, err := ztoc.NewBuilder("test").BuildZtoc(layerFileName, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	if toc.SpanAligned {
+		t.Fatal("ztoc of a layer with small members is span aligned")
+	}
+	ztoc.CheckSpans(t, toc)
+
+	r := io.NewSectionReader(bytes.NewReader(layerData), 0, int64(len(layerData)))
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	got, err := io.ReadAll(io.NewSectionReader(m, 0, m.UncompressedArchiveSize()))
+	if err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+	if !bytes.Equal(got, archive) {
+		t.Fatalf("unexpected archive contents")
+	}
+}
+
+// writeStoredGzipMember writes `p` to `w` as a gzip member of a single, final stored block.
+// Unlike compress/gzip, which ends every member with an empty block, zlib ends members
+// with their last block of data, so no checkpoint can be added within small members.
+func writeStoredGzipMember(w *bytes.Buffer, p []byte) {
+	w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff})
+	w.WriteByte(1)
+	binary.Write(w, binary.LittleEndian, uint16(len(p)))
+	binary.Write(w, binary.LittleEndian, ^uint16(len(p)))
+	w.Write(p)
+	binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(p))
+	binary.Write(w, binary.LittleEndian, uint32(len(p)))
+}
+
+// BenchmarkSpanManagerSequentialRead reads a layer sequentially with FUSE-sized reads and read-ahead,
+// with and without decompressing the spans read ahead in the background.
+func BenchmarkSpanManagerSequentialRead(b *testing.B) {
+	const (
+		spanSize = 1 << 20   // 1 MiB
+		numSpans = 32        // 32 MiB layer
+		readSize = 128 << 10 // maximum FUSE read size
+	)
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-benchmark", string(compressibleData(spanSize*numSpans))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(b, tarEntries, gzip.DefaultCompression, spanSize)
+	if err != nil {
+		b.Fatalf("failed to create ztoc: %v", err)
+	}
+	for _, workers := range []int{0, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			p := make([]byte, readSize)
+			b.SetBytes(int64(toc.UncompressedArchiveSize))
+			for i := 0; i < b.N; i++ {
+				pool := NewDecompressPool(workers)
+				m := New(toc, r, cache.NewMemoryCache(), 0,
+					WithDecompressPool(pool),
+					WithReadTuning(ReadTuning{ReadaheadSize: 8 * spanSize, CoalesceSize: 8 * spanSize}))
+				for off := int64(0); off < int64(toc.UncompressedArchiveSize); off += readSize {
+					if _, err := m.ReadAt(p, off); err != nil && err != io.EOF {
+						b.Fatalf("failed to read archive: %v", err)
+					}
+				}
+				pool.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// ErrDemotionNotSupported is returned by Demote if the span cache can't remove contents.
+var ErrDemotionNotSupported = errors.New("span cache does not support demotion")
+
+// DemoteMode is how Demote demotes the cached spans.
+type DemoteMode string
+
+const (
+	// DemoteDrop removes the cached contents of the spans, which are fetched again when read.
+	DemoteDrop DemoteMode = "drop"
+	// DemoteCompress removes the uncompressed contents of the spans whose compressed contents
+	// are cached too (e.g. spans fetched in the background before they were read), which are
+	// uncompressed again when read. Other spans are left as is.
+	DemoteCompress DemoteMode = "compress"
+)
+
+// SetPinned pins or unpins the cached spans. Pinned spans aren't demoted, e.g. so that the
+// spans of the images which must always start instantly stay in the cache.
+func (m *SpanManager) SetPinned(pinned bool) {
+	var v int32
+	if pinned {
+		v = 1
+	}
+	atomic.StoreInt32(&m.pinned, v)
+}
+
+// Demote demotes the cached spans, e.g. of a layer which is no longer read, to bound
+// the size of the cache. It returns the number of spans demoted, which is 0 while they're pinned.
+func (m *SpanManager) Demote(mode DemoteMode) (int, error) {
+	if mode != DemoteDrop && mode != DemoteCompress {
+		return 0, fmt.Errorf("unknown demote mode %q", mode)
+	}
+	if atomic.LoadInt32(&m.pinned) == 1 {
+		return 0, nil
+	}
+	remover, ok := m.cache.(cache.Remover)
+	if !ok {
+		return 0, ErrDemotionNotSupported
+	}
+	var demoted int
+	for _, s := range m.spans {
+		ok, err := m.demoteSpan(s, mode, remover)
+		if err != nil {
+			return demoted, fmt.Errorf("failed to demote span %d: %w", s.id, err)
+		}
+		if ok {
+			demoted++
+		}
+	}
+	return demoted, nil
+}
+
+// demoteSpan demotes the span `s` and returns whether it was demoted.
+// span state change: uncompressed -> fetched (DemoteCompress), or fetched/uncompressed -> unrequested (DemoteDrop).
+func (m *SpanManager) demoteSpan(s *span, mode DemoteMode, remover cache.Remover) (bool, error) {
+	if s.checkState(unrequested) {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The state is changed before the contents are removed, so that readers don't look for
+	// removed contents. Readers which opened the contents already can keep reading them.
+	switch {
+	case s.checkState(uncompressed):
+		if mode == DemoteCompress {
+			if !m.isSpanCached(s.id, fetched) {
+				return false, nil
+			}
+			if err := s.setState(fetched); err != nil {
+				return false, err
+			}
+			return true, m.removeCachedSpan(remover, s.id, uncompressed)
+		}
+		if err := s.setState(unrequested); err != nil {
+			return false, err
+		}
+		if err := m.removeCachedSpan(remover, s.id, uncompressed); err != nil {
+			return true, err
+		}
+		// The compressed contents are cached too if the span was fetched in the background.
+		return true, m.removeCachedSpan(remover, s.id, fetched)
+	case s.checkState(fetched):
+		if mode == DemoteCompress {
+			return false, nil
+		}
+		if err := s.setState(unrequested); err != nil {
+			return false, err
+		}
+		return true, m.removeCachedSpan(remover, s.id, fetched)
+	}
+	return false, nil
+}
+
+// isSpanCached returns whether the contents of the span in `state` are cached.
+func (m *SpanManager) isSpanCached(spanID compression.SpanID, state spanState) bool {
+	r, err := m.cache.Get(spanCacheKey(spanID, state))
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// removeCachedSpan removes the contents of the span in `state` from the cache and the persistent index, if any.
+func (m *SpanManager) removeCachedSpan(remover cache.Remover, spanID compression.SpanID, state spanState) error {
+	key := spanCacheKey(spanID, state)
+	if m.index != nil {
+		// The record is removed first, so that removed contents are never restored.
+		if err := m.index.remove(m.layerDigest, m.ztocDigest, key); err != nil {
+			m.logger(spanID).WithError(err).Warn("failed to remove demoted span from the persistent index")
+		}
+	}
+	// Only contents which are cached are accounted as removed.
+	cached := m.meter != nil && m.isSpanCached(spanID, state)
+	if err := remover.Remove(key); err != nil {
+		return err
+	}
+	if cached {
+		s := m.spans[spanID]
+		size := s.endCompOffset - s.startCompOffset
+		if state == uncompressed {
+			size = s.endUncompOffset - s.startUncompOffset
+		}
+		m.addCached(-int64(size))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// ExportSpans writes the cached compressed contents of the spans fetched so far to `tw`, one
+// entry per span under the directory `dir`. Only compressed contents are exported, since they
+// are verified against the ztoc on import; spans whose compressed contents are no longer cached
+// are skipped. The entries can be imported with ImportSpan by a SpanManager of the same ztoc,
+// e.g. on another node, so that the spans are not fetched again.
+func (m *SpanManager) ExportSpans(tw *tar.Writer, dir string) error {
+	// The spans of uncompressed layers are cached as they are fetched.
+	state := fetched
+	if m.isUncompressedLayer() {
+		state = uncompressed
+	}
+	for _, s := range m.spans {
+		// The state of the span is checked under its lock, so that the span can't be demoted
+		// before its contents are opened. Opened contents can be read after they are demoted.
+		size := s.endCompOffset - s.startCompOffset
+		s.mu.Lock()
+		cached := s.checkState(state) ||
+			// Spans fetched in the background keep their compressed contents once uncompressed.
+			(state == fetched && s.checkState(uncompressed) && m.isSpanCached(s.id, fetched))
+		if !cached {
+			s.mu.Unlock()
+			continue
+		}
+		r, err := m.getSpanFromCache(s.id, state, 0, size)
+		s.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to read span %d: %w", s.id, err)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(dir, spanCacheKey(s.id, state)),
+			Mode:     0600,
+			Size:     int64(size),
+		}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, r, int64(size)); err != nil {
+			return fmt.Errorf("failed to export span %d: %w", s.id, err)
+		}
+	}
+	return nil
+}
+
+// ImportSpan caches the contents of the span read from `r`, which were exported by ExportSpans
+// under `name`. The contents are verified against the ztoc, so uncompressed contents, which
+// can't be verified, are rejected unless the layer is uncompressed. Spans which are already
+// cached are left as is.
+func (m *SpanManager) ImportSpan(name string, r io.Reader) error {
+	spanID, state, err := parseSpanCacheKey(name)
+	if err != nil {
+		return err
+	}
+	if spanID > m.ztoc.MaxSpanID {
+		return fmt.Errorf("span %d is out of range of the ztoc", spanID)
+	}
+	if state == uncompressed && !m.isUncompressedLayer() {
+		return fmt.Errorf("uncompressed contents of span %d can't be verified against the ztoc", spanID)
+	}
+	s := m.spans[spanID]
+	size := s.endCompOffset - s.startCompOffset
+	buf, err := io.ReadAll(io.LimitReader(r, int64(size)+1))
+	if err != nil {
+		return err
+	}
+	if len(buf) != int(size) {
+		return fmt.Errorf("unexpected size of span %d: got %d, want %d", spanID, len(buf), size)
+	}
+	if err := m.verifySpanContents(buf, spanID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkState(unrequested) {
+		return nil
+	}
+	// unrequested -> requested -> fetched/uncompressed, as if the span was fetched.
+	if err := s.setState(requested); err != nil {
+		return err
+	}
+	if err := m.addSpanToCache(spanID, state, buf, m.cacheOpt...); err != nil {
+		s.setState(unrequested)
+		return err
+	}
+	if err := s.setState(state); err != nil {
+		return err
+	}
+	m.recordCachedSpan(spanID, state, buf)
+	return nil
+}
+
+// parseSpanCacheKey is the inverse of spanCacheKey.
+func parseSpanCacheKey(key string) (compression.SpanID, spanState, error) {
+	state := uncompressed
+	if k := strings.TrimSuffix(key, ".compressed"); k != key {
+		key, state = k, fetched
+	}
+	id, err := strconv.ParseInt(key, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid span %q: %w", key, err)
+	}
+	if id < 0 {
+		return 0, 0, fmt.Errorf("invalid span %q", key)
+	}
+	return compression.SpanID(id), state, nil
+}
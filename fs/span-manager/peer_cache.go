@@ -0,0 +1,183 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrSpanNotCached is returned by SpanRegistry.CachedSpan if no SpanManager of the layer has
+// cached the requested span.
+var ErrSpanNotCached = errors.New("span is not cached")
+
+// SpanPeers is a cache of spans shared by the snapshotters of other nodes, e.g. of a cluster,
+// which is checked before spans are fetched from the remote, so that spans fetched by any node
+// are only fetched from the registry once.
+type SpanPeers interface {
+	// FetchSpan returns the compressed contents of the span `spanID` of the layer `layerDigest`,
+	// whose digest is `spanDigest` and size is `size`, cached by peers for the containerd namespace
+	// of ctx. It returns an error if no peer has cached it. The contents are verified by the caller.
+	FetchSpan(ctx context.Context, layerDigest digest.Digest, spanID compression.SpanID, spanDigest digest.Digest, size int64) ([]byte, error)
+}
+
+// WithPeers makes the SpanManager fetch spans from `peers` before the remote. Spans are only
+// fetched from peers if the layer digest is set with WithLayerDigest.
+func WithPeers(peers SpanPeers) Option {
+	return func(m *SpanManager) {
+		m.peers = peers
+	}
+}
+
+// fetchFromPeers returns the compressed contents of the span `s` if a peer serves them
+// and they match the span digest of the ztoc.
+func (m *SpanManager) fetchFromPeers(s *span) ([]byte, bool) {
+	if m.peers == nil || m.layerDigest == "" {
+		return nil, false
+	}
+	expected := m.ztoc.SpanDigests[s.id]
+	size := int64(s.endCompOffset - s.startCompOffset)
+	ctx := context.Background()
+	if m.namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, m.namespace)
+	}
+	buf, err := m.peers.FetchSpan(ctx, m.layerDigest, s.id, expected, size)
+	if err != nil {
+		m.logger(s.id).WithError(err).Debug("span not fetched from peers, falling back to the remote")
+		return nil, false
+	}
+	if err := m.verifySpanContents(buf, s.id); err != nil || int64(len(buf)) != size {
+		m.logger(s.id).WithError(err).Warn("span fetched from peers is invalid, falling back to the remote")
+		return nil, false
+	}
+	atomic.AddInt64(&m.peerBytes, size)
+	return buf, true
+}
+
+// SpanRegistry tracks the SpanManagers of the resolved layers, so that the spans they have
+// cached can be served to the snapshotters of other nodes for the same containerd namespace.
+type SpanRegistry struct {
+	mu       sync.Mutex
+	managers map[registryKey]map[*SpanManager]struct{}
+}
+
+// registryKey identifies the SpanManagers of a layer mounted for a namespace.
+type registryKey struct {
+	namespace   string
+	layerDigest digest.Digest
+}
+
+// NewSpanRegistry creates a SpanRegistry.
+func NewSpanRegistry() *SpanRegistry {
+	return &SpanRegistry{
+		managers: make(map[registryKey]map[*SpanManager]struct{}),
+	}
+}
+
+// SetSpanRegistry registers the SpanManager in `registry` until it's closed or registered in
+// another registry. A nil registry unregisters it, e.g. once its layer is no longer used, since
+// registered SpanManagers are never garbage collected. SpanManagers created without
+// WithLayerDigest aren't registered.
+func (m *SpanManager) SetSpanRegistry(registry *SpanRegistry) {
+	if m.registry != nil {
+		m.registry.remove(m)
+	}
+	m.registry = nil
+	if registry == nil || m.layerDigest == "" {
+		return
+	}
+	m.registry = registry
+	registry.add(m)
+}
+
+func (r *SpanRegistry) add(m *SpanManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := registryKey{m.namespace, m.layerDigest}
+	managers, ok := r.managers[key]
+	if !ok {
+		managers = make(map[*SpanManager]struct{})
+		r.managers[key] = managers
+	}
+	managers[m] = struct{}{}
+}
+
+func (r *SpanRegistry) remove(m *SpanManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := registryKey{m.namespace, m.layerDigest}
+	managers := r.managers[key]
+	delete(managers, m)
+	if len(managers) == 0 {
+		delete(r.managers, key)
+	}
+}
+
+// CachedSpan returns the compressed contents of the span `spanID` of the layer `layerDigest`
+// whose digest is `spanDigest`, if a SpanManager of the layer mounted for the namespace `ns` has
+// cached them. The span digest distinguishes the spans of ztocs of the layer with different span sizes.
+func (r *SpanRegistry) CachedSpan(ns string, layerDigest digest.Digest, spanID compression.SpanID, spanDigest digest.Digest) ([]byte, error) {
+	r.mu.Lock()
+	var managers []*SpanManager
+	for m := range r.managers[registryKey{ns, layerDigest}] {
+		managers = append(managers, m)
+	}
+	r.mu.Unlock()
+
+	for _, m := range managers {
+		if buf, err := m.cachedCompressedSpan(spanID, spanDigest); err == nil {
+			return buf, nil
+		}
+	}
+	return nil, ErrSpanNotCached
+}
+
+// cachedCompressedSpan returns the cached compressed contents of the span `spanID` if its
+// digest in the ztoc is `spanDigest`. The spans of uncompressed layers are cached as they
+// are fetched, so their uncompressed contents are returned.
+func (m *SpanManager) cachedCompressedSpan(spanID compression.SpanID, spanDigest digest.Digest) ([]byte, error) {
+	if spanID < 0 || spanID > m.ztoc.MaxSpanID || m.ztoc.SpanDigests[spanID] != spanDigest {
+		return nil, ErrSpanNotCached
+	}
+	state := fetched
+	if m.isUncompressedLayer() {
+		state = uncompressed
+	}
+	s := m.spans[spanID]
+	size := s.endCompOffset - s.startCompOffset
+	r, err := m.getSpanFromCache(spanID, state, 0, size)
+	if err != nil {
+		return nil, ErrSpanNotCached
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read cached span %d: %w", spanID, err)
+	}
+	// The cache may hold partially written or stale contents, which must not be served.
+	if err := m.verifySpanContents(buf, spanID); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
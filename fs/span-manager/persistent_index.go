@@ -0,0 +1,116 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Layout of the persistent index:
+//
+//	spans/                      - root bucket
+//	  <layer digest>/           - one bucket per layer
+//	    <ztoc digest>/          - one bucket per ztoc of the layer, since spans are defined by the ztoc
+//	      <cache key> : digest  - digest of the span contents stored in the cache under the key
+var bucketKeySpans = []byte("spans")
+
+// PersistentIndex records which spans are stored in persistent span caches,
+// so that they are reused instead of fetched again after the snapshotter restarts.
+// Entries are only hints: cached spans are validated against their digests before use.
+type PersistentIndex struct {
+	db *bolt.DB
+}
+
+// OpenPersistentIndex opens the persistent index stored at `path`, creating it if needed.
+func OpenPersistentIndex(path string) (*PersistentIndex, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open persistent span index %q: %w", path, err)
+	}
+	return &PersistentIndex{db: db}, nil
+}
+
+// Close closes the persistent index.
+func (idx *PersistentIndex) Close() error {
+	return idx.db.Close()
+}
+
+// put records that the span contents with digest `dgst` are cached under `key`.
+func (idx *PersistentIndex) put(layerDigest, ztocDigest digest.Digest, key string, dgst digest.Digest) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := createBucketIfNotExists(tx, bucketKeySpans, []byte(layerDigest), []byte(ztocDigest))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), []byte(dgst))
+	})
+}
+
+// remove removes the record of the span contents cached under `key`.
+func (idx *PersistentIndex) remove(layerDigest, ztocDigest digest.Digest, key string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		bkt := getBucket(tx, bucketKeySpans, []byte(layerDigest), []byte(ztocDigest))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+// load returns the digests of the span contents recorded for the ztoc of the layer, keyed by cache key.
+func (idx *PersistentIndex) load(layerDigest, ztocDigest digest.Digest) (map[string]digest.Digest, error) {
+	entries := make(map[string]digest.Digest)
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		bkt := getBucket(tx, bucketKeySpans, []byte(layerDigest), []byte(ztocDigest))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			entries[string(k)] = digest.Digest(v)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func createBucketIfNotExists(tx *bolt.Tx, keys ...[]byte) (*bolt.Bucket, error) {
+	bkt, err := tx.CreateBucketIfNotExists(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys[1:] {
+		if bkt, err = bkt.CreateBucketIfNotExists(k); err != nil {
+			return nil, err
+		}
+	}
+	return bkt, nil
+}
+
+func getBucket(tx *bolt.Tx, keys ...[]byte) *bolt.Bucket {
+	bkt := tx.Bucket(keys[0])
+	for _, k := range keys[1:] {
+		if bkt == nil {
+			return nil
+		}
+		bkt = bkt.Bucket(k)
+	}
+	return bkt
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultPrefetchCoalesceSize is the maximum number of compressed bytes of adjacent spans
+// prefetched with a single request, unless the ReadTuning of the layer sets a coalesce size.
+const defaultPrefetchCoalesceSize = 4 << 20 // 4 MiB
+
+// prefetchConcurrency is the number of runs of adjacent spans prefetched at the same time by
+// PrefetchRanges. Their fetches are scheduled with the other fetches by the FetchScheduler.
+const prefetchConcurrency = 8
+
+// ByteRange is the range of uncompressed bytes [Start, End) of a layer.
+type ByteRange struct {
+	Start, End compression.Offset
+}
+
+// Prefetch fetches the first `percent` percent of the spans of the layer, unless they are
+// fetched already, and returns once they are cached. Like spans read ahead, adjacent spans are
+// fetched with a single request of at most the coalesce size of the ReadTuning, or of
+// defaultPrefetchCoalesceSize if it's not set. Reads of the layer take precedence over prefetches.
+// span state change: unrequested -> requested -> fetched.
+func (m *SpanManager) Prefetch(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid prefetch percentage %d", percent)
+	}
+	n := (int(m.ztoc.MaxSpanID+1)*percent + 99) / 100
+	if n == 0 {
+		return nil
+	}
+	return m.fetchSpans(0, compression.SpanID(n-1), PriorityBackground, m.prefetchCoalesceSize(), false)
+}
+
+// PrefetchRange fetches the spans holding the uncompressed bytes [start, end) of the layer,
+// unless they are fetched already, and returns once they are cached. Spans are coalesced like by Prefetch.
+func (m *SpanManager) PrefetchRange(start, end compression.Offset) error {
+	if start >= end {
+		return nil
+	}
+	return m.fetchSpans(m.zinfo.UncompressedOffsetToSpanID(start), m.zinfo.UncompressedOffsetToSpanID(end-1), PriorityBackground, m.prefetchCoalesceSize(), false)
+}
+
+// PrefetchRanges fetches the spans holding the uncompressed bytes of `ranges`, unless they are
+// fetched already, and returns once they are cached. Unlike PrefetchRange, the runs of adjacent
+// spans of the ranges are fetched concurrently, so that the prefetch of many small files,
+// e.g. of a prefetch profile, isn't bound by the latency of the remote.
+func (m *SpanManager) PrefetchRanges(ranges []ByteRange) error {
+	type spanRange struct{ first, last compression.SpanID }
+	var spans []spanRange
+	for _, r := range ranges {
+		if r.Start < r.End {
+			spans = append(spans, spanRange{m.zinfo.UncompressedOffsetToSpanID(r.Start), m.zinfo.UncompressedOffsetToSpanID(r.End - 1)})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].first < spans[j].first })
+	var runs []spanRange
+	for _, s := range spans {
+		if n := len(runs); n > 0 && s.first <= runs[n-1].last+1 {
+			if s.last > runs[n-1].last {
+				runs[n-1].last = s.last
+			}
+			continue
+		}
+		runs = append(runs, s)
+	}
+
+	var eg errgroup.Group
+	eg.SetLimit(prefetchConcurrency)
+	coalesce := m.prefetchCoalesceSize()
+	for _, r := range runs {
+		r := r
+		eg.Go(func() error {
+			return m.fetchSpans(r.first, r.last, PriorityBackground, coalesce, false)
+		})
+	}
+	return eg.Wait()
+}
+
+// prefetchCoalesceSize returns the maximum number of compressed bytes of adjacent spans prefetched
+// with a single request.
+func (m *SpanManager) prefetchCoalesceSize() int64 {
+	if m.tuning.CoalesceSize > 0 {
+		return m.tuning.CoalesceSize
+	}
+	return defaultPrefetchCoalesceSize
+}
@@ -0,0 +1,270 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// ReadTuning tunes how the spans of a layer are fetched for reads, e.g. from build-time knowledge
+// of how the layer is read (see soci.IndexAnnotationReadaheadSize and soci.IndexAnnotationCoalesceSize).
+// The zero value fetches exactly the spans which are read, one request per span.
+type ReadTuning struct {
+	// ReadaheadSize is the number of bytes of the uncompressed layer after each read whose spans
+	// are fetched in the background, so that sequential reads of large files don't wait for every span.
+	ReadaheadSize int64
+	// CoalesceSize is the maximum number of compressed bytes of adjacent spans fetched with a single
+	// request, so that reads spanning many spans (including read-ahead) don't send a request per span.
+	CoalesceSize int64
+}
+
+// WithReadTuning sets how the spans of the layer are fetched for reads.
+func WithReadTuning(t ReadTuning) Option {
+	return func(m *SpanManager) {
+		m.tuning = t
+	}
+}
+
+// SequentialReadahead configures the read-ahead of files which are read sequentially.
+// Once a read of a file starts where the previous read of the file ended, the spans of
+// the window after the read are fetched in the background. The window starts at MinWindow
+// bytes, doubles with every further sequential read up to MaxWindow bytes and is reset
+// by a read elsewhere in the file. The zero value disables the read-ahead.
+type SequentialReadahead struct {
+	MinWindow int64
+	MaxWindow int64
+}
+
+// WithSequentialReadahead sets the read-ahead of files which are read sequentially.
+func WithSequentialReadahead(s SequentialReadahead) Option {
+	if s.MaxWindow < s.MinWindow {
+		s.MaxWindow = s.MinWindow
+	}
+	return func(m *SpanManager) {
+		m.sequential = s
+	}
+}
+
+// AccessPattern records the reads of an open file to detect sequential reads.
+// The zero value is ready to use.
+type AccessPattern struct {
+	mu sync.Mutex
+	// next is the offset in the layer where the last read ended.
+	next compression.Offset
+	// window is the current read-ahead window, 0 if the file isn't read sequentially.
+	window int64
+	// aheadEnd is the offset in the layer up to which spans were read ahead.
+	aheadEnd compression.Offset
+}
+
+// ObserveRead records a read of the uncompressed layer from `start` to `end` through the
+// file of `a`. If the file is read sequentially, the spans of the read-ahead window after
+// the read are fetched in the background, unless they were read ahead already.
+func (m *SpanManager) ObserveRead(a *AccessPattern, start, end compression.Offset) {
+	if m.sequential.MinWindow <= 0 || end <= start {
+		return
+	}
+	a.mu.Lock()
+	// Layers start with a tar header, so no file contents start at offset 0.
+	sequential := a.next != 0 && start == a.next
+	a.next = end
+	switch {
+	case !sequential:
+		a.window = 0
+		a.aheadEnd = 0
+	case a.window == 0:
+		a.window = m.sequential.MinWindow
+	case a.window < m.sequential.MaxWindow:
+		a.window *= 2
+		if a.window > m.sequential.MaxWindow {
+			a.window = m.sequential.MaxWindow
+		}
+	}
+	window := a.window
+	if window == 0 || end+compression.Offset(window) <= a.aheadEnd {
+		a.mu.Unlock()
+		return
+	}
+	a.aheadEnd = end + compression.Offset(window)
+	a.mu.Unlock()
+
+	go m.readahead(m.zinfo.UncompressedOffsetToSpanID(end-1), window)
+}
+
+// ReadaheadStats returns the number of spans fetched ahead of reads, and how many of them were read afterwards.
+func (m *SpanManager) ReadaheadStats() (spans, hits int64) {
+	return atomic.LoadInt64(&m.readaheadSpans), atomic.LoadInt64(&m.readaheadHits)
+}
+
+// recordReadaheadHit counts a read of the span if it was fetched ahead of reads and not read since.
+func (m *SpanManager) recordReadaheadHit(s *span) {
+	if atomic.CompareAndSwapInt32(&s.readAhead, 1, 0) {
+		atomic.AddInt64(&m.readaheadHits, 1)
+	}
+}
+
+// readahead fetches the spans of the `size` bytes after the span `last`
+// in the background, unless they are fetched already, and decompresses them with the
+// decompress pool, if any.
+func (m *SpanManager) readahead(last compression.SpanID, size int64) {
+	if last >= m.ztoc.MaxSpanID {
+		return
+	}
+	first := last + 1
+	end := m.spans[first].startUncompOffset + compression.Offset(size)
+	if end > m.ztoc.UncompressedArchiveSize {
+		end = m.ztoc.UncompressedArchiveSize
+	}
+	last = m.zinfo.UncompressedOffsetToSpanID(end - 1)
+	if last > m.ztoc.MaxSpanID {
+		last = m.ztoc.MaxSpanID
+	}
+	if err := m.fetchSpans(first, last, PriorityBackground, m.tuning.CoalesceSize, true); err != nil {
+		m.logger(first).WithError(err).Debug("failed to read ahead spans")
+	}
+	m.decompressAhead(first, last)
+}
+
+// fetchSpans fetches and caches the spans from `first` to `last` which are not fetched yet, without
+// uncompressing them. Adjacent spans are fetched with a single request of at most `coalesce` bytes.
+// Spans which are being fetched or read are skipped; callers read them the usual way.
+// `ahead` tells whether the spans are fetched ahead of reads, for ReadaheadStats.
+// span state change: unrequested -> requested -> fetched.
+func (m *SpanManager) fetchSpans(first, last compression.SpanID, p Priority, coalesce int64, ahead bool) error {
+	var (
+		run      []*span
+		firstErr error
+	)
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		if err := m.fetchAndCacheRun(run, p, ahead); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for _, s := range run {
+			s.mu.Unlock()
+		}
+		run = nil
+	}
+	for id := first; id <= last; id++ {
+		s := m.spans[id]
+		if !s.checkState(unrequested) || !s.mu.TryLock() {
+			flush()
+			continue
+		}
+		if !s.checkState(unrequested) {
+			s.mu.Unlock()
+			flush()
+			continue
+		}
+		if len(run) > 0 && s.endCompOffset-run[0].startCompOffset > compression.Offset(coalesce) {
+			flush()
+		}
+		run = append(run, s)
+	}
+	flush()
+	return firstErr
+}
+
+// fetchAndCacheRun fetches the adjacent spans of `run` with a single request and caches them.
+// Spans are asked from peers first, in order, until a peer misses one; the rest of the run is
+// fetched from the remote, sharing the fetches of the SpanManagers of the layer. The caller must
+// hold the locks of the spans, which must be unrequested. Spans which fail verification are left
+// unrequested, so that they are fetched again (with retries) when read.
+func (m *SpanManager) fetchAndCacheRun(run []*span, p Priority, ahead bool) (err error) {
+	for _, s := range run {
+		if err := s.setState(requested); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		for _, s := range run {
+			if s.checkState(requested) {
+				s.setState(unrequested)
+			}
+		}
+	}()
+
+	if err := m.checkFetch(); err != nil {
+		return err
+	}
+	for len(run) > 0 {
+		buf, ok := m.fetchFromPeers(run[0])
+		if !ok {
+			break
+		}
+		if err := m.cacheRunSpan(run[0], buf, ahead); err != nil {
+			return err
+		}
+		run = run[1:]
+	}
+	if len(run) == 0 {
+		return nil
+	}
+
+	start, end := run[0].startCompOffset, run[len(run)-1].endCompOffset
+	buf, err := m.sharedFetches.do(m.layerDigest, start, end, func() ([]byte, error) {
+		buf := make([]byte, end-start)
+		m.scheduler.AcquireFor(m, p)
+		n, err := m.r.ReadAt(buf, int64(start))
+		m.scheduler.ReleaseFor(m)
+		m.addFetched(n)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n != len(buf) {
+			return nil, fmt.Errorf("unexpected data size for reading compressed spans. read = %d, expected = %d", n, len(buf))
+		}
+		return buf, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range run {
+		compressedBuf := buf[s.startCompOffset-start : s.endCompOffset-start]
+		if err := m.verifySpanContents(compressedBuf, s.id); err != nil {
+			return err
+		}
+		if err := m.cacheRunSpan(s, compressedBuf, ahead); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheRunSpan caches the verified compressed contents of a span of a run.
+func (m *SpanManager) cacheRunSpan(s *span, compressedBuf []byte, ahead bool) error {
+	if err := m.addSpanToCache(s.id, fetched, compressedBuf, m.cacheOpt...); err != nil {
+		return err
+	}
+	if err := s.setState(fetched); err != nil {
+		return err
+	}
+	if ahead {
+		atomic.StoreInt32(&s.readAhead, 1)
+		atomic.AddInt64(&m.readaheadSpans, 1)
+	}
+	m.recordCachedSpan(s.id, fetched, compressedBuf)
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"math"
+	"sync"
+)
+
+// Priority is the scheduling priority of a span fetch.
+type Priority int
+
+const (
+	// PriorityBackground is used for spans fetched by the background fetcher.
+	PriorityBackground Priority = iota
+	// PriorityNormal is used for on-demand reads of regular file data.
+	PriorityNormal
+	// PriorityExec is used for on-demand reads of executables and shared libraries.
+	// These reads are usually on the critical path of process startup, so they
+	// should not queue up behind bulk data reads.
+	PriorityExec
+
+	numPriorities
+)
+
+// FetchScheduler limits the number of spans fetched from the remote at the same time.
+// When the limit is reached, waiting fetches are admitted in priority order and
+// in FIFO order within the same priority.
+//
+// Fetches can be made on behalf of an owner, e.g. the span manager of a mounted layer, with
+// AcquireFor. The fetches of each owner can be limited too, so that the random reads of a single
+// container can't take every slot. Within the same priority, waiting fetches are then admitted
+// from the owner with the fewest fetches in flight first, so that slots are shared fairly.
+//
+// A nil *FetchScheduler is valid and does not limit fetches.
+type FetchScheduler struct {
+	mu         sync.Mutex
+	limit      int
+	ownerLimit int
+	inflight   int
+	owners     map[interface{}]int // fetches in flight by owner
+	waiters    [numPriorities][]fetchWaiter
+}
+
+type fetchWaiter struct {
+	ch    chan struct{}
+	owner interface{}
+}
+
+// NewFetchScheduler creates a FetchScheduler which allows at most `limit` concurrent fetches.
+// It returns nil (no limit) if `limit` is not positive.
+func NewFetchScheduler(limit int) *FetchScheduler {
+	return NewFairFetchScheduler(limit, 0)
+}
+
+// NewFairFetchScheduler creates a FetchScheduler which allows at most `limit` concurrent fetches,
+// and at most `ownerLimit` concurrent fetches of each owner. A non-positive limit means no limit.
+// It returns nil if neither is limited.
+func NewFairFetchScheduler(limit, ownerLimit int) *FetchScheduler {
+	if ownerLimit < 0 {
+		ownerLimit = 0
+	}
+	if limit <= 0 {
+		if ownerLimit == 0 {
+			return nil
+		}
+		limit = math.MaxInt
+	}
+	return &FetchScheduler{limit: limit, ownerLimit: ownerLimit, owners: make(map[interface{}]int)}
+}
+
+// Acquire blocks until a fetch with priority `p` may proceed.
+// Every call to Acquire must be followed by a call to Release.
+func (s *FetchScheduler) Acquire(p Priority) {
+	s.AcquireFor(nil, p)
+}
+
+// Release ends a fetch started with Acquire. If any fetches are waiting,
+// the slot is handed over to the oldest waiter with the highest priority.
+func (s *FetchScheduler) Release() {
+	s.ReleaseFor(nil)
+}
+
+// AcquireFor blocks until a fetch of `owner` with priority `p` may proceed. A nil owner isn't
+// limited by the owner limit. Every call to AcquireFor must be followed by a call to ReleaseFor
+// with the same owner.
+func (s *FetchScheduler) AcquireFor(owner interface{}, p Priority) {
+	if s == nil {
+		return
+	}
+	if p < 0 {
+		p = 0
+	} else if p >= numPriorities {
+		p = numPriorities - 1
+	}
+	s.mu.Lock()
+	if s.admissible(owner) {
+		s.admit(owner)
+		s.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	s.waiters[p] = append(s.waiters[p], fetchWaiter{ch, owner})
+	s.mu.Unlock()
+	<-ch
+}
+
+// ReleaseFor ends a fetch of `owner` started with AcquireFor, and admits the waiting fetches
+// which may proceed.
+func (s *FetchScheduler) ReleaseFor(owner interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	if owner != nil {
+		if s.owners[owner]--; s.owners[owner] <= 0 {
+			delete(s.owners, owner)
+		}
+	}
+	for s.inflight < s.limit {
+		w, ok := s.next()
+		if !ok {
+			return
+		}
+		s.admit(w.owner)
+		close(w.ch)
+	}
+}
+
+func (s *FetchScheduler) admissible(owner interface{}) bool {
+	return s.inflight < s.limit && (owner == nil || s.ownerLimit == 0 || s.owners[owner] < s.ownerLimit)
+}
+
+func (s *FetchScheduler) admit(owner interface{}) {
+	s.inflight++
+	if owner != nil {
+		s.owners[owner]++
+	}
+}
+
+// next dequeues the waiting fetch to admit next: the one with the highest priority whose owner
+// is under its limit, preferring the owners with the fewest fetches in flight, then the oldest.
+func (s *FetchScheduler) next() (fetchWaiter, bool) {
+	for p := numPriorities - 1; p >= 0; p-- {
+		best := -1
+		for i, w := range s.waiters[p] {
+			if !s.admissible(w.owner) {
+				continue
+			}
+			if best < 0 || s.owners[w.owner] < s.owners[s.waiters[p][best].owner] {
+				best = i
+			}
+		}
+		if best >= 0 {
+			w := s.waiters[p][best]
+			s.waiters[p] = append(s.waiters[p][:best:best], s.waiters[p][best+1:]...)
+			return w, true
+		}
+	}
+	return fetchWaiter{}, false
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchSchedulerNilIsUnlimited(t *testing.T) {
+	s := NewFetchScheduler(0)
+	if s != nil {
+		t.Fatalf("expected nil scheduler for non-positive limit")
+	}
+	// must not block or panic
+	for i := 0; i < 10; i++ {
+		s.Acquire(PriorityNormal)
+	}
+	for i := 0; i < 10; i++ {
+		s.Release()
+	}
+}
+
+func TestFetchSchedulerPriorityOrder(t *testing.T) {
+	s := NewFetchScheduler(1)
+	// occupy the only slot
+	s.Acquire(PriorityNormal)
+
+	var (
+		mu    sync.Mutex
+		order []Priority
+		wg    sync.WaitGroup
+	)
+	enqueue := func(p Priority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Acquire(p)
+			mu.Lock()
+			order = append(order, p)
+			mu.Unlock()
+			s.Release()
+		}()
+		// wait until the goroutine is queued so that the enqueue order is deterministic
+		waitForWaiters(t, s, p)
+	}
+	enqueue(PriorityBackground)
+	enqueue(PriorityNormal)
+	enqueue(PriorityExec)
+
+	s.Release()
+	wg.Wait()
+
+	expected := []Priority{PriorityExec, PriorityNormal, PriorityBackground}
+	if len(order) != len(expected) {
+		t.Fatalf("unexpected number of fetches; expected = %d, got = %d", len(expected), len(order))
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("unexpected fetch order; expected = %v, got = %v", expected, order)
+		}
+	}
+}
+
+func TestFetchSchedulerOwnerLimit(t *testing.T) {
+	s := NewFairFetchScheduler(0, 1)
+	if s == nil {
+		t.Fatalf("expected a scheduler for a positive owner limit")
+	}
+	a, b := new(int), new(int)
+	s.AcquireFor(a, PriorityNormal)
+
+	admitted := make(chan struct{})
+	go func() {
+		s.AcquireFor(a, PriorityNormal)
+		close(admitted)
+	}()
+	waitForWaiters(t, s, PriorityNormal)
+
+	// other owners and fetches without an owner are not limited by the fetches of a
+	s.AcquireFor(b, PriorityNormal)
+	s.Acquire(PriorityNormal)
+	select {
+	case <-admitted:
+		t.Fatalf("fetch admitted over the owner limit")
+	default:
+	}
+
+	s.ReleaseFor(b)
+	s.Release()
+	s.ReleaseFor(a)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the fetch to be admitted")
+	}
+	s.ReleaseFor(a)
+}
+
+func TestFetchSchedulerFairness(t *testing.T) {
+	s := NewFairFetchScheduler(2, 2)
+	a, b := new(int), new(int)
+	// a takes every slot
+	s.AcquireFor(a, PriorityNormal)
+	s.AcquireFor(a, PriorityNormal)
+
+	var wg sync.WaitGroup
+	enqueue := func(owner *int, waiters int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.AcquireFor(owner, PriorityNormal)
+		}()
+		waitForNWaiters(t, s, PriorityNormal, waiters)
+	}
+	enqueue(a, 1)
+	enqueue(a, 2)
+	enqueue(b, 3)
+
+	// b has no fetch in flight, so it is admitted before the older fetches of a
+	s.ReleaseFor(a)
+	s.mu.Lock()
+	for _, w := range s.waiters[PriorityNormal] {
+		if w.owner == b {
+			s.mu.Unlock()
+			t.Fatalf("expected the fetch of b to be admitted first")
+		}
+	}
+	if n := len(s.waiters[PriorityNormal]); n != 2 {
+		s.mu.Unlock()
+		t.Fatalf("unexpected number of queued fetches; expected = 2, got = %d", n)
+	}
+	s.mu.Unlock()
+
+	s.ReleaseFor(a)
+	s.ReleaseFor(b)
+	wg.Wait()
+	s.ReleaseFor(a)
+	s.ReleaseFor(a)
+	if s.inflight != 0 || len(s.owners) != 0 {
+		t.Fatalf("unexpected fetches in flight: %d", s.inflight)
+	}
+}
+
+func waitForWaiters(t *testing.T, s *FetchScheduler, p Priority) {
+	waitForNWaiters(t, s, p, 1)
+}
+
+// waitForNWaiters waits until at least n fetches with priority p are queued.
+func waitForNWaiters(t *testing.T, s *FetchScheduler, p Priority, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		queued := len(s.waiters[p])
+		s.mu.Unlock()
+		if queued >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d fetches with priority %d to be queued", n, p)
+}
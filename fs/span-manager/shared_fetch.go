@@ -0,0 +1,97 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// SharedFetches deduplicates the fetches of the same compressed contents of a layer by different
+// SpanManagers, e.g. of a layer shared by images which are mounted at the same time, so that
+// concurrent fetches of a span share one download. A fetch of a span also shares the fetch of
+// a run of spans holding it, e.g. of a prefetch.
+//
+// A nil *SharedFetches doesn't deduplicate fetches.
+type SharedFetches struct {
+	mu       sync.Mutex
+	inflight map[digest.Digest][]*sharedFetch
+}
+
+// sharedFetch is a running fetch of the compressed contents from `start` to `end` of a layer.
+// `buf` and `err` are set once `done` is closed.
+type sharedFetch struct {
+	start, end compression.Offset
+	done       chan struct{}
+	buf        []byte
+	err        error
+}
+
+// NewSharedFetches creates a SharedFetches.
+func NewSharedFetches() *SharedFetches {
+	return &SharedFetches{inflight: make(map[digest.Digest][]*sharedFetch)}
+}
+
+// do calls `fetch` to fetch the compressed contents from `start` to `end` of the layer, unless
+// a running fetch covers them, in which case it waits for that fetch and returns a copy of
+// the contents from its result.
+func (f *SharedFetches) do(layerDigest digest.Digest, start, end compression.Offset, fetch func() ([]byte, error)) ([]byte, error) {
+	if f == nil || layerDigest == "" {
+		return fetch()
+	}
+	f.mu.Lock()
+	for _, sf := range f.inflight[layerDigest] {
+		if sf.start <= start && end <= sf.end {
+			f.mu.Unlock()
+			<-sf.done
+			if sf.err != nil {
+				return nil, sf.err
+			}
+			return append([]byte(nil), sf.buf[start-sf.start:end-sf.start]...), nil
+		}
+	}
+	sf := &sharedFetch{start: start, end: end, done: make(chan struct{})}
+	f.inflight[layerDigest] = append(f.inflight[layerDigest], sf)
+	f.mu.Unlock()
+
+	sf.buf, sf.err = fetch()
+	f.mu.Lock()
+	fetches := f.inflight[layerDigest]
+	for i, other := range fetches {
+		if other == sf {
+			fetches = append(fetches[:i], fetches[i+1:]...)
+			break
+		}
+	}
+	if len(fetches) == 0 {
+		delete(f.inflight, layerDigest)
+	} else {
+		f.inflight[layerDigest] = fetches
+	}
+	f.mu.Unlock()
+	close(sf.done)
+	return sf.buf, sf.err
+}
+
+// WithSharedFetches sets the fetches shared with the SpanManagers of the same layer.
+func WithSharedFetches(f *SharedFetches) Option {
+	return func(m *SpanManager) {
+		m.sharedFetches = f
+	}
+}
@@ -64,6 +64,14 @@ var stateTransitionMap = map[spanState][]spanState{
 	fetched: {
 		// when span data request comes and span is fetched by bg-fetcher; compressed span is available in cache
 		uncompressed,
+		// when the cached span is dropped by Demote
+		unrequested,
+	},
+	uncompressed: {
+		// when the uncompressed span is dropped by Demote but its compressed contents are still cached
+		fetched,
+		// when the cached span is dropped by Demote
+		unrequested,
 	},
 }
 
@@ -75,6 +83,8 @@ type span struct {
 	endUncompOffset   compression.Offset
 	state             atomic.Value
 	mu                sync.Mutex
+	// readAhead is 1 if the span was fetched ahead of reads and not read since. It's accessed atomically.
+	readAhead int32
 }
 
 func (s *span) checkState(expected spanState) bool {
@@ -18,16 +18,22 @@ package spanmanager
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"runtime"
+	"sync/atomic"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
 	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -40,6 +46,25 @@ var (
 
 // SpanManager fetches and caches spans of a given layer.
 type SpanManager struct {
+	// cacheHits and cacheMisses count span reads served from the cache and from the remote.
+	// They and the other counters are accessed atomically and kept first for 64-bit alignment.
+	cacheHits   int64
+	cacheMisses int64
+	// fetchedBytes counts the compressed bytes fetched from the remote, cachedBytes the
+	// uncompressed bytes read from the cache and reads the reads of the layer contents.
+	fetchedBytes int64
+	cachedBytes  int64
+	reads        int64
+	// readaheadSpans counts the spans fetched ahead of reads and readaheadHits those of them read afterwards.
+	readaheadSpans int64
+	readaheadHits  int64
+	// peerBytes counts the compressed bytes fetched from peers instead of the remote.
+	peerBytes int64
+	// meteredCacheBytes counts the bytes added to the cache which are accounted by the meter.
+	meteredCacheBytes int64
+	// pinned is 1 while the cached spans must not be demoted, e.g. for a pinned index.
+	pinned int32
+
 	cache                             cache.BlobCache
 	cacheOpt                          []cache.Option
 	zinfo                             compression.Zinfo
@@ -47,6 +72,25 @@ type SpanManager struct {
 	spans                             []*span
 	ztoc                              *ztoc.Ztoc
 	maxSpanVerificationFailureRetries int
+	scheduler                         *FetchScheduler
+	decompressPool                    *DecompressPool
+	sharedFetches                     *SharedFetches
+	peers                             SpanPeers
+	registry                          *SpanRegistry
+	// namespace is the containerd namespace the layer is mounted for, whose spans are
+	// only exchanged with peers for the same namespace.
+	namespace string
+
+	// index records the cached spans if the cache is persistent.
+	index       *PersistentIndex
+	layerDigest digest.Digest
+	ztocDigest  digest.Digest
+
+	tuning     ReadTuning
+	sequential SequentialReadahead
+
+	// meter, if set, accounts the spans fetched from the remote and cached.
+	meter UsageMeter
 }
 
 type spanInfo struct {
@@ -62,9 +106,19 @@ type spanInfo struct {
 	spanIndexInBuf []compression.Offset
 }
 
+// Option configures a SpanManager when it's created by New.
+type Option func(*SpanManager)
+
+// WithCacheOptions sets the options of the cache operations of the SpanManager.
+func WithCacheOptions(opts ...cache.Option) Option {
+	return func(m *SpanManager) {
+		m.cacheOpt = append(m.cacheOpt, opts...)
+	}
+}
+
 // New creates a SpanManager with given ztoc and content reader, and builds all
 // spans based on the ztoc.
-func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries int, cacheOpt ...cache.Option) *SpanManager {
+func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries int, opts ...Option) *SpanManager {
 	index, err := ztoc.Zinfo()
 	if err != nil {
 		return nil
@@ -72,7 +126,6 @@ func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries in
 	spans := make([]*span, ztoc.MaxSpanID+1)
 	m := &SpanManager{
 		cache:                             cache,
-		cacheOpt:                          cacheOpt,
 		zinfo:                             index,
 		r:                                 r,
 		spans:                             spans,
@@ -82,6 +135,9 @@ func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries in
 	if m.maxSpanVerificationFailureRetries < 0 {
 		m.maxSpanVerificationFailureRetries = defaultSpanVerificationFailureRetries
 	}
+	for _, o := range opts {
+		o(m)
+	}
 	m.buildAllSpans()
 	runtime.SetFinalizer(m, func(m *SpanManager) {
 		m.Close()
@@ -90,6 +146,171 @@ func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries in
 	return m
 }
 
+// WithFetchScheduler sets the scheduler used to order remote span fetches.
+func WithFetchScheduler(s *FetchScheduler) Option {
+	return func(m *SpanManager) {
+		m.scheduler = s
+	}
+}
+
+// UsageMeter accounts the usage of the spans of a layer as it changes, e.g. to enforce quotas.
+type UsageMeter interface {
+	// CheckFetch is called before spans are fetched from the remote. If it returns an error,
+	// the fetch fails with it.
+	CheckFetch() error
+	// AddFetched is called with the number of bytes fetched from the remote.
+	AddFetched(n int64)
+	// AddCached is called with the change of the number of bytes held in the cache.
+	AddCached(n int64)
+}
+
+// WithUsageMeter makes the SpanManager account its usage in `meter`. Spans restored from the
+// persistent index were accounted when they were cached, so they aren't accounted again.
+func WithUsageMeter(meter UsageMeter) Option {
+	return func(m *SpanManager) {
+		m.meter = meter
+	}
+}
+
+// checkFetch returns the error of the meter, if any, refusing to fetch spans from the remote.
+func (m *SpanManager) checkFetch() error {
+	if m.meter == nil {
+		return nil
+	}
+	return m.meter.CheckFetch()
+}
+
+// addFetched records that `n` bytes were fetched from the remote.
+func (m *SpanManager) addFetched(n int) {
+	atomic.AddInt64(&m.fetchedBytes, int64(n))
+	if m.meter != nil && n > 0 {
+		m.meter.AddFetched(int64(n))
+	}
+}
+
+// addCached records that the number of bytes held in the cache changed by `n`.
+func (m *SpanManager) addCached(n int64) {
+	if m.meter != nil {
+		atomic.AddInt64(&m.meteredCacheBytes, n)
+		m.meter.AddCached(n)
+	}
+}
+
+// WithNamespace sets the containerd namespace the layer is mounted for, or "" if the layer is
+// shared by all namespaces.
+func WithNamespace(ns string) Option {
+	return func(m *SpanManager) {
+		m.namespace = ns
+	}
+}
+
+// WithLayerDigest sets the digest of the layer of the SpanManager, which its log entries are about.
+func WithLayerDigest(layerDigest digest.Digest) Option {
+	return func(m *SpanManager) {
+		m.layerDigest = layerDigest
+	}
+}
+
+// logger returns the logger of the entries about the span `spanID` of the layer.
+func (m *SpanManager) logger(spanID compression.SpanID) *logrus.Entry {
+	entry := log.L.WithField(logutil.SpanField, spanID)
+	if m.layerDigest != "" {
+		entry = entry.WithField(logutil.LayerField, m.layerDigest)
+	}
+	return entry
+}
+
+// WithPersistentIndex makes the SpanManager record the spans it caches in `index`, so that
+// they can be restored with RestoreCachedSpans after a restart. The cache of the SpanManager
+// must be persistent and dedicated to the ztoc with digest `ztocDigest` of the layer.
+func WithPersistentIndex(index *PersistentIndex, layerDigest, ztocDigest digest.Digest) Option {
+	return func(m *SpanManager) {
+		m.index = index
+		m.layerDigest = layerDigest
+		m.ztocDigest = ztocDigest
+	}
+}
+
+// RestoreCachedSpans marks the spans recorded in the persistent index as cached, so that
+// they are not fetched again. The cached contents of each span are validated first:
+// compressed spans against the span digests of the ztoc and uncompressed spans against
+// the recorded digests. Invalid entries are removed from the index.
+// Spans which are requested in the meantime are skipped.
+func (m *SpanManager) RestoreCachedSpans() error {
+	if m.index == nil {
+		return nil
+	}
+	entries, err := m.index.load(m.layerDigest, m.ztocDigest)
+	if err != nil {
+		return fmt.Errorf("failed to load cached spans of %s: %w", m.layerDigest, err)
+	}
+	for _, s := range m.spans {
+		m.restoreSpan(s, entries)
+	}
+	return nil
+}
+
+// restoreSpan restores the span from its uncompressed cached contents if they are valid,
+// or else from its compressed cached contents.
+func (m *SpanManager) restoreSpan(s *span, entries map[string]digest.Digest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, state := range []spanState{uncompressed, fetched} {
+		if !s.checkState(unrequested) {
+			return
+		}
+		key := spanCacheKey(s.id, state)
+		expected, ok := entries[key]
+		if !ok {
+			continue
+		}
+		if state == fetched && expected != m.ztoc.SpanDigests[s.id] {
+			expected = ""
+		}
+		if err := m.validateCachedSpan(s, state, expected); err != nil {
+			m.logger(s.id).WithError(err).Debug("failed to restore cached span")
+			// Contents which can't be read (e.g. their write didn't complete) are recorded again once they are cached.
+			if errors.Is(err, ErrIncorrectSpanDigest) {
+				if err := m.index.remove(m.layerDigest, m.ztocDigest, key); err != nil {
+					m.logger(s.id).WithError(err).Warn("failed to remove cached span from the persistent index")
+				}
+			}
+			continue
+		}
+		// unrequested -> requested -> fetched/uncompressed, as if the span was fetched again.
+		if err := s.setState(requested); err != nil {
+			return
+		}
+		if err := s.setState(state); err != nil {
+			s.setState(unrequested)
+		}
+		return
+	}
+}
+
+// validateCachedSpan checks that the contents cached for the span in `state` have the digest `expected`.
+func (m *SpanManager) validateCachedSpan(s *span, state spanState, expected digest.Digest) error {
+	if expected == "" {
+		return fmt.Errorf("no valid digest recorded for span %d: %w", s.id, ErrIncorrectSpanDigest)
+	}
+	size := s.endUncompOffset - s.startUncompOffset
+	if state == fetched {
+		size = s.endCompOffset - s.startCompOffset
+	}
+	r, err := m.getSpanFromCache(s.id, state, 0, size)
+	if err != nil {
+		return err
+	}
+	verifier := expected.Verifier()
+	if _, err := io.Copy(verifier, r); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("cached span %d does not match %v: %w", s.id, expected, ErrIncorrectSpanDigest)
+	}
+	return nil
+}
+
 func (m *SpanManager) buildAllSpans() {
 	var i compression.SpanID
 	for i = 0; i <= m.ztoc.MaxSpanID; i++ {
@@ -127,7 +348,7 @@ func (m *SpanManager) FetchSingleSpan(spanID compression.SpanID) error {
 		return nil
 	}
 
-	_, err := m.fetchAndCacheSpan(spanID, false)
+	_, err := m.fetchAndCacheSpan(spanID, false, PriorityBackground)
 	return err
 }
 
@@ -139,24 +360,41 @@ func (m *SpanManager) resolveSpan(spanID compression.SpanID) error {
 	}
 
 	// this func itself doesn't use the returned span data
-	_, err := m.getSpanContent(spanID, 0, m.spans[spanID].endUncompOffset)
+	_, err := m.getSpanContent(spanID, 0, m.spans[spanID].endUncompOffset, PriorityNormal)
 	return err
 }
 
 // GetContents returns a reader for the requested contents. The contents may be
 // across multiple spans.
 func (m *SpanManager) GetContents(startUncompOffset, endUncompOffset compression.Offset) (io.Reader, error) {
+	return m.GetContentsWithPriority(startUncompOffset, endUncompOffset, PriorityNormal)
+}
+
+// GetContentsWithPriority is like GetContents, but spans that need to be fetched
+// from the remote are scheduled with priority `p`.
+func (m *SpanManager) GetContentsWithPriority(startUncompOffset, endUncompOffset compression.Offset, p Priority) (io.Reader, error) {
+	atomic.AddInt64(&m.reads, 1)
 	si := m.getSpanInfo(startUncompOffset, endUncompOffset)
 	numSpans := si.spanEnd - si.spanStart + 1
 	spanReaders := make([]io.Reader, numSpans)
 
+	if m.tuning.ReadaheadSize > 0 {
+		go m.readahead(si.spanEnd, m.tuning.ReadaheadSize)
+	}
+	if m.tuning.CoalesceSize > 0 && numSpans > 1 {
+		// Spans which failed to be fetched together are fetched one by one below.
+		if err := m.fetchSpans(si.spanStart, si.spanEnd, p, m.tuning.CoalesceSize, false); err != nil {
+			m.logger(si.spanStart).WithError(err).Debug("failed to fetch coalesced spans")
+		}
+	}
+
 	eg, _ := errgroup.WithContext(context.Background())
 	var i compression.SpanID
 	for i = 0; i < numSpans; i++ {
 		j := i
 		eg.Go(func() error {
 			spanID := j + si.spanStart
-			r, err := m.getSpanContent(spanID, si.startOffInSpan[j], si.endOffInSpan[j])
+			r, err := m.getSpanContent(spanID, si.startOffInSpan[j], si.endOffInSpan[j], p)
 			if err != nil {
 				return err
 			}
@@ -171,6 +409,101 @@ func (m *SpanManager) GetContents(startUncompOffset, endUncompOffset compression
 	return io.MultiReader(spanReaders...), nil
 }
 
+// TOC returns the files of the layer.
+func (m *SpanManager) TOC() ztoc.TOC {
+	return m.ztoc.TOC
+}
+
+// ReadAt reads the uncompressed layer archive (i.e. the tar stream) at offset,
+// fetching and uncompressing spans as needed.
+func (m *SpanManager) ReadAt(p []byte, offset int64) (int, error) {
+	size := int64(m.ztoc.UncompressedArchiveSize)
+	if offset >= size {
+		return 0, io.EOF
+	}
+	end := offset + int64(len(p))
+	if end > size {
+		end = size
+	}
+	r, err := m.GetContents(compression.Offset(offset), compression.Offset(end))
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r, p[:end-offset])
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// CacheStats returns how many span reads were served from the cache (hits),
+// and how many had to fetch the span from the remote (misses).
+// Spans fetched by FetchSingleSpan (e.g. in the background) are not counted.
+func (m *SpanManager) CacheStats() (hits, misses int64) {
+	return atomic.LoadInt64(&m.cacheHits), atomic.LoadInt64(&m.cacheMisses)
+}
+
+// FetchStats are statistics of how the contents of a layer were read.
+type FetchStats struct {
+	// FetchedBytes is the number of compressed bytes fetched from the remote, including
+	// spans fetched in the background or read ahead and spans fetched again.
+	FetchedBytes int64
+	// CachedBytes is the number of uncompressed bytes read from the cache.
+	CachedBytes int64
+	// Reads is the number of reads of the layer contents, e.g. by FUSE file reads.
+	Reads int64
+	// ReadaheadSpans is the number of spans fetched ahead of reads, and ReadaheadHits
+	// the number of them which were read afterwards.
+	ReadaheadSpans int64
+	ReadaheadHits  int64
+	// PeerBytes is the number of compressed bytes fetched from peers instead of the remote.
+	PeerBytes int64
+}
+
+// FetchStats returns statistics of how the contents of the layer were read so far.
+func (m *SpanManager) FetchStats() FetchStats {
+	return FetchStats{
+		FetchedBytes:   atomic.LoadInt64(&m.fetchedBytes),
+		CachedBytes:    atomic.LoadInt64(&m.cachedBytes),
+		Reads:          atomic.LoadInt64(&m.reads),
+		ReadaheadSpans: atomic.LoadInt64(&m.readaheadSpans),
+		ReadaheadHits:  atomic.LoadInt64(&m.readaheadHits),
+		PeerBytes:      atomic.LoadInt64(&m.peerBytes),
+	}
+}
+
+// SpanSize returns the uncompressed size of the spans of the layer, as recorded in its ztoc
+// or, for ztocs which don't record it, in its checkpoints.
+func (m *SpanManager) SpanSize() int64 {
+	if m.ztoc.SpanSize > 0 {
+		return int64(m.ztoc.SpanSize)
+	}
+	return int64(m.zinfo.SpanSize())
+}
+
+// CachedSize returns the number of bytes of the layer held in the cache: the compressed size
+// of the spans which are fetched and the uncompressed size of the spans which are uncompressed.
+func (m *SpanManager) CachedSize() int64 {
+	var size int64
+	for _, s := range m.spans {
+		switch {
+		case s.checkState(fetched):
+			size += int64(s.endCompOffset - s.startCompOffset)
+		case s.checkState(uncompressed):
+			size += int64(s.endUncompOffset - s.startUncompOffset)
+		}
+	}
+	return size
+}
+
+// UncompressedArchiveSize returns the size of the uncompressed layer archive.
+func (m *SpanManager) UncompressedArchiveSize() int64 {
+	return int64(m.ztoc.UncompressedArchiveSize)
+}
+
 // getSpanInfo returns spanInfo from the offsets of the requested file
 func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd compression.Offset) *spanInfo {
 	spanStart := m.zinfo.UncompressedOffsetToSpanID(offsetStart)
@@ -216,56 +549,49 @@ func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd compression.Offset) *sp
 //  3. For `unrequested` span, fetch-uncompress-cache the span data, return the reader
 //     from the uncompressed span
 //  4. No span state lock will be acquired in `requested` state.
-func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, offsetEnd compression.Offset) (io.Reader, error) {
+//
+// `p` is the priority used if the span has to be fetched from the remote.
+func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, offsetEnd compression.Offset, p Priority) (io.Reader, error) {
 	s := m.spans[spanID]
 	size := offsetEnd - offsetStart
+	m.recordReadaheadHit(s)
 
 	// return from cache directly if cached and uncompressed
 	if s.checkState(uncompressed) {
-		return m.getSpanFromCache(s.id, offsetStart, size)
+		// The span may be demoted in the meantime, in which case it's read under the lock below.
+		if r, err := m.getSpanFromCache(s.id, uncompressed, offsetStart, size); err == nil {
+			atomic.AddInt64(&m.cacheHits, 1)
+			atomic.AddInt64(&m.cachedBytes, int64(size))
+			return r, nil
+		}
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// check again after acquiring lock
 	if s.checkState(uncompressed) {
-		return m.getSpanFromCache(s.id, offsetStart, size)
+		atomic.AddInt64(&m.cacheHits, 1)
+		atomic.AddInt64(&m.cachedBytes, int64(size))
+		return m.getSpanFromCache(s.id, uncompressed, offsetStart, size)
 	}
 
 	// if cached but not uncompressed, uncompress and cache the span content
 	if s.checkState(fetched) {
-		// get compressed span from the cache
-		compressedSize := s.endCompOffset - s.startCompOffset
-		r, err := m.getSpanFromCache(s.id, 0, compressedSize)
-		if err != nil {
-			return nil, err
-		}
-
-		// read compressed span
-		compressedBuf, err := io.ReadAll(r)
-		if err != nil {
-			return nil, err
-		}
-
-		// uncompress span
-		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
+		atomic.AddInt64(&m.cacheHits, 1)
+		atomic.AddInt64(&m.cachedBytes, int64(size))
+		uncompSpanBuf, err := m.uncompressCachedSpan(s, func(s *span, compressedBuf []byte) ([]byte, error) {
+			return m.uncompressSpan(s, compressedBuf, p)
+		})
 		if err != nil {
 			return nil, err
 		}
-
-		// cache uncompressed span
-		if err := m.addSpanToCache(s.id, uncompSpanBuf, m.cacheOpt...); err != nil {
-			return nil, err
-		}
-		if err := s.setState(uncompressed); err != nil {
-			return nil, err
-		}
 		return bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size]), nil
 	}
 
 	// fetch-uncompress-cache span: span state can only be `unrequested` since
 	// no goroutine will release span state lock in `requested` state
-	uncompBuf, err := m.fetchAndCacheSpan(s.id, true)
+	atomic.AddInt64(&m.cacheMisses, 1)
+	uncompBuf, err := m.fetchAndCacheSpan(s.id, true, p)
 	if err != nil {
 		return nil, err
 	}
@@ -277,8 +603,8 @@ func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, off
 // caches and returns the span content. The span state is set to `fetched/uncompressed`,
 // depending on if `uncompress` is enabled.
 // The caller needs to check the span state (e.g. `unrequested`) and acquires the
-// span's state lock before calling.
-func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bool) (buf []byte, err error) {
+// span's state lock before calling. The remote fetch is scheduled with priority `p`.
+func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bool, p Priority) (buf []byte, err error) {
 	s := m.spans[spanID]
 
 	// change to `requested`; if fetch/cache fails, change back to `unrequested`
@@ -293,7 +619,9 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 	}()
 
 	// fetch compressed span
+	m.scheduler.AcquireFor(m, p)
 	compressedBuf, err := m.fetchSpanWithRetries(spanID)
+	m.scheduler.ReleaseFor(m)
 	if err != nil {
 		return nil, err
 	}
@@ -301,9 +629,10 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 	buf = compressedBuf
 	var state = fetched
 
-	if uncompress {
+	// The spans of uncompressed layers are cached as they are fetched, since they are already uncompressed.
+	if uncompress || m.isUncompressedLayer() {
 		// uncompress span
-		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
+		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf, p)
 		if err != nil {
 			return nil, err
 		}
@@ -312,12 +641,13 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 	}
 
 	// cache span data
-	if err := m.addSpanToCache(spanID, buf, m.cacheOpt...); err != nil {
+	if err := m.addSpanToCache(spanID, state, buf, m.cacheOpt...); err != nil {
 		return nil, err
 	}
 	if err := s.setState(state); err != nil {
 		return nil, err
 	}
+	m.recordCachedSpan(spanID, state, buf)
 	return buf, nil
 }
 
@@ -327,36 +657,62 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 // If there is an error fetching data from remote, it is not an transient error.
 func (m *SpanManager) fetchSpanWithRetries(spanID compression.SpanID) ([]byte, error) {
 	s := m.spans[spanID]
-	offset := s.startCompOffset
-	compressedSize := s.endCompOffset - s.startCompOffset
-	compressedBuf := make([]byte, compressedSize)
-
-	var (
-		err error
-		n   int
-	)
+	if err := m.checkFetch(); err != nil {
+		return []byte{}, err
+	}
+	var err error
 	for i := 0; i < m.maxSpanVerificationFailureRetries+1; i++ {
-		n, err = m.r.ReadAt(compressedBuf, int64(offset))
+		var compressedBuf []byte
+		compressedBuf, err = m.fetchCompressedSpan(s)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		if err = m.verifySpanContents(compressedBuf, spanID); err == nil {
+			return compressedBuf, nil
+		}
+	}
+	return []byte{}, err
+}
+
+// fetchCompressedSpan reads the compressed contents of the span `s` from peers, if any, or
+// the remote. Concurrent fetches of the same contents by the SpanManagers of the layer share one read.
+func (m *SpanManager) fetchCompressedSpan(s *span) ([]byte, error) {
+	return m.sharedFetches.do(m.layerDigest, s.startCompOffset, s.endCompOffset, func() ([]byte, error) {
+		if buf, ok := m.fetchFromPeers(s); ok {
+			return buf, nil
+		}
+		compressedBuf := make([]byte, s.endCompOffset-s.startCompOffset)
+		n, err := m.r.ReadAt(compressedBuf, int64(s.startCompOffset))
+		m.addFetched(n)
 		// if the n = len(p) bytes returned by ReadAt are at the end of the input source,
 		// ReadAt may return either err == EOF or err == nil: https://pkg.go.dev/io#ReaderAt
 		if err != nil && err != io.EOF {
-			return []byte{}, err
+			return nil, err
 		}
 
 		if n != len(compressedBuf) {
-			return []byte{}, fmt.Errorf("unexpected data size for reading compressed span. read = %d, expected = %d", n, len(compressedBuf))
+			return nil, fmt.Errorf("unexpected data size for reading compressed span. read = %d, expected = %d", n, len(compressedBuf))
 		}
+		return compressedBuf, nil
+	})
+}
 
-		if err = m.verifySpanContents(compressedBuf, spanID); err == nil {
-			return compressedBuf, nil
-		}
+// uncompressSpan extracts uncompressed span data from compressed span data on a worker of the
+// decompress pool, with priority `p`.
+func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte, p Priority) (buf []byte, err error) {
+	if s.startUncompOffset == s.endUncompOffset || m.isUncompressedLayer() {
+		return m.extractSpan(s, compressedBuf)
 	}
-	return []byte{}, err
+	m.decompressPool.run(p, func() {
+		buf, err = m.extractSpan(s, compressedBuf)
+	})
+	return buf, err
 }
 
-// uncompressSpan uses zinfo to extract uncompressed span data from compressed
+// extractSpan uses zinfo to extract uncompressed span data from compressed
 // span data.
-func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, error) {
+func (m *SpanManager) extractSpan(s *span, compressedBuf []byte) ([]byte, error) {
 	uncompSize := s.endUncompOffset - s.startUncompOffset
 
 	// Theoretically, a span can be empty. If that happens, just return an empty buffer.
@@ -364,6 +720,23 @@ func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, err
 		return []byte{}, nil
 	}
 
+	// The spans of uncompressed layers map directly to byte ranges of the layer.
+	if m.isUncompressedLayer() {
+		if compression.Offset(len(compressedBuf)) != uncompSize {
+			return nil, fmt.Errorf("unexpected size of uncompressed span %d. read = %d, expected = %d", s.id, len(compressedBuf), uncompSize)
+		}
+		return compressedBuf, nil
+	}
+
+	if m.ztoc.SpanAligned && m.ztoc.CompressionAlgorithm == compression.Gzip {
+		buf, err := uncompressAlignedSpan(compressedBuf, uncompSize)
+		if err == nil {
+			return buf, nil
+		}
+		// The span may not start a member after all, e.g. in ztocs built before the
+		// alignment of layers with members smaller than a span was detected.
+		log.L.WithError(err).Debugf("falling back to zinfo to decompress aligned span %d", s.id)
+	}
 	bytes, err := m.zinfo.ExtractDataFromBuffer(compressedBuf, uncompSize, s.startUncompOffset, s.id)
 	if err != nil {
 		return nil, err
@@ -371,10 +744,56 @@ func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, err
 	return bytes, nil
 }
 
-// addSpanToCache adds contents of the span to the cache.
+// isUncompressedLayer returns true if the layer is an uncompressed tar archive.
+func (m *SpanManager) isUncompressedLayer() bool {
+	return m.ztoc.CompressionAlgorithm == compression.Uncompressed
+}
+
+// uncompressAlignedSpan decompresses a span which starts a gzip member. The span starts with
+// the deflate stream of the member, so it's decompressed without the data preceding it. If the
+// member ends before the span, the span is decompressed through the members following it.
+func uncompressAlignedSpan(compressedBuf []byte, uncompSize compression.Offset) ([]byte, error) {
+	// flate reads bytes.Reader byte by byte, so the reader is left at the end of the member.
+	br := bytes.NewReader(compressedBuf)
+	fr := flate.NewReader(br)
+	defer fr.Close()
+	buf := make([]byte, uncompSize)
+	n, err := io.ReadFull(fr, buf)
+	if err == nil {
+		return buf, nil
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decompress aligned span: %w", err)
+	}
+	// Skip the trailer of the member: its CRC-32 and size.
+	if _, err := br.Seek(8, io.SeekCurrent); err != nil {
+		return nil, fmt.Errorf("failed to decompress aligned span: %w", err)
+	}
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress members following aligned span: %w", err)
+	}
+	defer gr.Close()
+	if _, err := io.ReadFull(gr, buf[n:]); err != nil {
+		return nil, fmt.Errorf("failed to decompress members following aligned span: %w", err)
+	}
+	return buf, nil
+}
+
+// spanCacheKey returns the cache key of the span contents in `state`. Compressed and
+// uncompressed contents are cached under different keys, so that SpanManagers sharing
+// a persistent cache never read contents in the wrong form.
+func spanCacheKey(spanID compression.SpanID, state spanState) string {
+	if state == fetched {
+		return fmt.Sprintf("%d.compressed", spanID)
+	}
+	return fmt.Sprintf("%d", spanID)
+}
+
+// addSpanToCache adds contents of the span in `state` to the cache.
 // A non-nil error is returned if the data is not written to the cache.
-func (m *SpanManager) addSpanToCache(spanID compression.SpanID, contents []byte, opts ...cache.Option) error {
-	w, err := m.cache.Add(fmt.Sprintf("%d", spanID), opts...)
+func (m *SpanManager) addSpanToCache(spanID compression.SpanID, state spanState, contents []byte, opts ...cache.Option) error {
+	w, err := m.cache.Add(spanCacheKey(spanID, state), opts...)
 	if err != nil {
 		return err
 	}
@@ -386,15 +805,32 @@ func (m *SpanManager) addSpanToCache(spanID compression.SpanID, contents []byte,
 		return err
 	}
 
-	w.Commit()
+	if err := w.Commit(); err == nil {
+		m.addCached(int64(len(contents)))
+	}
 	return nil
 }
 
-// getSpanFromCache returns the cached span content as an `io.Reader`.
+// recordCachedSpan records the span contents in `state` which were just cached in the
+// persistent index, if any. Failures are only logged, since the span is cached anyway.
+func (m *SpanManager) recordCachedSpan(spanID compression.SpanID, state spanState, contents []byte) {
+	if m.index == nil {
+		return
+	}
+	dgst := m.ztoc.SpanDigests[spanID]
+	if state == uncompressed {
+		dgst = digest.FromBytes(contents)
+	}
+	if err := m.index.put(m.layerDigest, m.ztocDigest, spanCacheKey(spanID, state), dgst); err != nil {
+		m.logger(spanID).WithError(err).Warn("failed to record cached span in the persistent index")
+	}
+}
+
+// getSpanFromCache returns the cached content of the span in `state` as an `io.Reader`.
 // `offset` is the offset of the requested contents within the span.
 // `size` is the size of the requested contents.
-func (m *SpanManager) getSpanFromCache(spanID compression.SpanID, offset, size compression.Offset) (io.Reader, error) {
-	r, err := m.cache.Get(fmt.Sprintf("%d", spanID))
+func (m *SpanManager) getSpanFromCache(spanID compression.SpanID, state spanState, offset, size compression.Offset) (io.Reader, error) {
+	r, err := m.cache.Get(spanCacheKey(spanID, state))
 	if err != nil {
 		return nil, ErrSpanNotAvailable
 	}
@@ -417,6 +853,15 @@ func (m *SpanManager) verifySpanContents(compressedData []byte, spanID compressi
 
 // Close closes both the underlying zinfo data and blob cache.
 func (m *SpanManager) Close() {
+	// Closed span managers must not be closed again when they are garbage collected.
+	runtime.SetFinalizer(m, nil)
+	if m.registry != nil {
+		m.registry.remove(m)
+	}
+	// Spans cached without a persistent index are gone once the cache is closed.
+	if m.index == nil {
+		m.addCached(-atomic.SwapInt64(&m.meteredCacheBytes, 0))
+	}
 	m.zinfo.Close()
 	m.cache.Close()
 }
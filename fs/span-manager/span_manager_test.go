@@ -17,18 +17,26 @@
 package spanmanager
 
 import (
+	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/util/testutil"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
 )
 
 func init() {
@@ -162,7 +170,7 @@ func TestSpanManagerCache(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Test resolveSpanFromCache
-			spanR, err := m.getSpanContent(compression.SpanID(spanID), tc.offset, tc.offset+tc.size)
+			spanR, err := m.getSpanContent(compression.SpanID(spanID), tc.offset, tc.offset+tc.size, PriorityNormal)
 			if err != nil {
 				t.Fatalf("error resolving span from cache")
 			}
@@ -177,6 +185,118 @@ func TestSpanManagerCache(t *testing.T) {
 	}
 }
 
+func TestSpanManagerReadAt(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(spanSize) * 3)
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-readat-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	gzr, err := gzip.NewReader(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+	if m.UncompressedArchiveSize() != int64(len(archive)) {
+		t.Fatalf("unexpected archive size; expected = %d, got = %d", len(archive), m.UncompressedArchiveSize())
+	}
+
+	testCases := []struct {
+		name   string
+		offset int64
+		size   int64
+	}{
+		{
+			name:   "within a span",
+			offset: 100,
+			size:   1000,
+		},
+		{
+			name:   "across spans",
+			offset: int64(spanSize) - 10,
+			size:   int64(spanSize) + 20,
+		},
+		{
+			name:   "past the end of the archive",
+			offset: int64(len(archive)) - 10,
+			size:   100,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := make([]byte, tc.size)
+			n, err := m.ReadAt(p, tc.offset)
+			expected := archive[tc.offset:]
+			if int64(len(expected)) > tc.size {
+				expected = expected[:tc.size]
+			} else if err != io.EOF {
+				t.Fatalf("expected EOF when reading past the end of the archive; got = %v", err)
+			}
+			if err != nil && err != io.EOF {
+				t.Fatalf("failed to read archive: %v", err)
+			}
+			if !bytes.Equal(p[:n], expected) {
+				t.Fatalf("unexpected archive contents at offset %d", tc.offset)
+			}
+		})
+	}
+}
+
+func TestSpanManagerUncompressedLayer(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(spanSize) * 3)
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-uncompressed-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildUncompressedZtocReader(t, tarEntries, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	if toc.CompressionAlgorithm != compression.Uncompressed {
+		t.Fatalf("unexpected compression algorithm; expected = %q, got = %q", compression.Uncompressed, toc.CompressionAlgorithm)
+	}
+	archive, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+
+	// Spans fetched in the background are cached as they are, ready to be read.
+	if err := m.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span: %v", err)
+	}
+	if !m.spans[1].checkState(uncompressed) {
+		t.Fatalf("span of an uncompressed layer should be cached uncompressed")
+	}
+	if _, err := m.cache.Get(spanCacheKey(1, fetched)); err == nil {
+		t.Fatalf("span of an uncompressed layer should not be cached twice")
+	}
+
+	got, err := io.ReadAll(io.NewSectionReader(m, 0, m.UncompressedArchiveSize()))
+	if err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+	if !bytes.Equal(got, archive) {
+		t.Fatalf("unexpected archive contents")
+	}
+	// Every byte of the layer is fetched once: spans map directly to the layer.
+	if fetched := m.FetchStats().FetchedBytes; fetched != int64(len(archive)) {
+		t.Fatalf("unexpected fetched bytes; expected = %d, got = %d", len(archive), fetched)
+	}
+}
+
 func TestStateTransition(t *testing.T) {
 	var spanSize compression.Offset = 65536 // 64 KiB
 	content := testutil.RandomByteData(int64(spanSize))
@@ -237,7 +357,7 @@ func TestStateTransition(t *testing.T) {
 					t.Fatalf("failed transitioning to Fetched state")
 				}
 			} else {
-				_, err := m.getSpanContent(tc.spanID, 0, s.endUncompOffset-s.startUncompOffset)
+				_, err := m.getSpanContent(tc.spanID, 0, s.endUncompOffset-s.startUncompOffset, PriorityNormal)
 				if err != nil {
 					t.Fatalf("failed getting the span for on-demand fetch: %v", err)
 				}
@@ -284,25 +404,25 @@ func TestValidateState(t *testing.T) {
 		{
 			name:         "span in Fetched state with valid new state",
 			currentState: fetched,
-			newState:     []spanState{uncompressed},
+			newState:     []spanState{unrequested, uncompressed},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Fetched state with invalid new state",
 			currentState: fetched,
-			newState:     []spanState{unrequested, requested, fetched},
+			newState:     []spanState{requested, fetched},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 		{
 			name:         "span in Uncompressed state with valid new state",
 			currentState: uncompressed,
-			newState:     []spanState{},
+			newState:     []spanState{unrequested, fetched},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Uncompressed state with invalid new state",
 			currentState: uncompressed,
-			newState:     []spanState{unrequested, requested, fetched, uncompressed},
+			newState:     []spanState{requested, uncompressed},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 	}
@@ -361,7 +481,7 @@ func TestSpanManagerRetries(t *testing.T) {
 			for i := 0; i < int(ztoc.MaxSpanID); i++ {
 				rdr.errCount = 0
 
-				_, err := sm.fetchAndCacheSpan(compression.SpanID(i), true)
+				_, err := sm.fetchAndCacheSpan(compression.SpanID(i), true, PriorityNormal)
 				if !errors.Is(err, tc.expectedErr) {
 					t.Fatalf("unexpected err; expected %v, got %v", tc.expectedErr, err)
 				}
@@ -423,3 +543,776 @@ type readerFn func([]byte, int64) (int, error)
 func (f readerFn) ReadAt(b []byte, n int64) (int, error) {
 	return f(b, n)
 }
+
+func TestSpanManagerPersistentCache(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-persistent-cache-test", string(testutil.RandomByteData(int64(4*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	layerDigest := digest.FromString("layer")
+	ztocDigest := digest.FromString("ztoc")
+
+	testCases := []struct {
+		name           string
+		corruptKey     string
+		expectedStates map[compression.SpanID]spanState
+	}{
+		{
+			name:           "valid spans are restored",
+			expectedStates: map[compression.SpanID]spanState{0: uncompressed, 1: fetched, 2: unrequested},
+		},
+		{
+			name:           "corrupted uncompressed span is discarded",
+			corruptKey:     spanCacheKey(0, uncompressed),
+			expectedStates: map[compression.SpanID]spanState{0: unrequested, 1: fetched, 2: unrequested},
+		},
+		{
+			name:           "corrupted compressed span is discarded",
+			corruptKey:     spanCacheKey(1, fetched),
+			expectedStates: map[compression.SpanID]spanState{0: uncompressed, 1: unrequested, 2: unrequested},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			index, err := OpenPersistentIndex(filepath.Join(dir, "index.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer index.Close()
+			newManager := func() *SpanManager {
+				c, err := cache.NewDirectoryCache(filepath.Join(dir, "cache"), cache.DirectoryCacheConfig{SyncAdd: true, Persistent: true})
+				if err != nil {
+					t.Fatalf("failed to create cache: %v", err)
+				}
+				m := New(toc, r, c, 0, WithPersistentIndex(index, layerDigest, ztocDigest))
+				return m
+			}
+
+			m := newManager()
+			if err := m.resolveSpan(0); err != nil {
+				t.Fatalf("failed to resolve span 0: %v", err)
+			}
+			if err := m.FetchSingleSpan(1); err != nil {
+				t.Fatalf("failed to fetch span 1: %v", err)
+			}
+			m.Close()
+
+			if tc.corruptKey != "" {
+				if err := os.WriteFile(filepath.Join(dir, "cache", tc.corruptKey), []byte("corrupted"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Simulate a restart.
+			m = newManager()
+			defer m.Close()
+			if err := m.RestoreCachedSpans(); err != nil {
+				t.Fatalf("failed to restore cached spans: %v", err)
+			}
+			for spanID, expected := range tc.expectedStates {
+				if !m.spans[spanID].checkState(expected) {
+					t.Fatalf("unexpected state of span %d; expected = %v, got = %v", spanID, expected, m.spans[spanID].state.Load())
+				}
+			}
+			entries, err := index.load(layerDigest, ztocDigest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := entries[tc.corruptKey]; tc.corruptKey != "" && ok {
+				t.Fatalf("corrupted span %s is still recorded in the persistent index", tc.corruptKey)
+			}
+			// Restored spans are served from the cache.
+			if _, err := m.GetContents(0, 2*spanSize); err != nil {
+				t.Fatalf("failed to read restored spans: %v", err)
+			}
+		})
+	}
+}
+
+func TestSpanManagerExportImport(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-export-test", string(testutil.RandomByteData(int64(4*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	src := New(toc, r, cache.NewMemoryCache(), 0)
+	defer src.Close()
+	if err := src.resolveSpan(0); err != nil {
+		t.Fatalf("failed to resolve span 0: %v", err)
+	}
+	if err := src.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span 1: %v", err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := src.ExportSpans(tw, "layer"); err != nil {
+		t.Fatalf("failed to export spans: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans of the destination can't be fetched, so they can only come from the import.
+	unreachable := io.NewSectionReader(readerFn(func([]byte, int64) (int, error) {
+		return 0, errors.New("unreachable")
+	}), 0, r.Size())
+	dst := New(toc, unreachable, cache.NewMemoryCache(), 0)
+	defer dst.Close()
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.ImportSpan(filepath.Base(h.Name), tr); err != nil {
+			t.Fatalf("failed to import %s: %v", h.Name, err)
+		}
+	}
+	// Span 0 is only cached uncompressed, which can't be verified, so it isn't exported.
+	for spanID, expected := range map[compression.SpanID]spanState{0: unrequested, 1: fetched, 2: unrequested} {
+		if !dst.spans[spanID].checkState(expected) {
+			t.Fatalf("unexpected state of span %d; expected = %v, got = %v", spanID, expected, dst.spans[spanID].state.Load())
+		}
+	}
+	// The end offset of a span is the start of the next one, so the last byte isn't read.
+	start, end := int64(dst.spans[1].startUncompOffset), int64(dst.spans[1].endUncompOffset)-1
+	want, err := io.ReadAll(io.NewSectionReader(src, start, end-start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(io.NewSectionReader(dst, start, end-start))
+	if err != nil {
+		t.Fatalf("failed to read imported spans: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("unexpected contents of imported spans")
+	}
+
+	uncompSize := dst.spans[0].endUncompOffset - dst.spans[0].startUncompOffset
+	if err := dst.ImportSpan(spanCacheKey(0, uncompressed), bytes.NewReader(make([]byte, uncompSize))); err == nil {
+		t.Fatal("uncompressed span was imported without being verified")
+	}
+	if !dst.spans[0].checkState(unrequested) {
+		t.Fatal("unverified span was imported")
+	}
+	size := dst.spans[2].endCompOffset - dst.spans[2].startCompOffset
+	if err := dst.ImportSpan(spanCacheKey(2, fetched), bytes.NewReader(make([]byte, size))); !errors.Is(err, ErrIncorrectSpanDigest) {
+		t.Fatalf("unexpected error importing a corrupted span: %v", err)
+	}
+	if !dst.spans[2].checkState(unrequested) {
+		t.Fatal("corrupted span was imported")
+	}
+}
+
+func TestSpanManagerDemote(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-demote-test", string(testutil.RandomByteData(int64(4*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	var fetches int
+	sr := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+		fetches++
+		return r.ReadAt(b, off)
+	}), 0, r.Size())
+	want, err := io.ReadAll(io.NewSectionReader(New(toc, r, cache.NewMemoryCache(), 0), 0, int64(3*spanSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMemoryCache().(*cache.MemoryCache)
+	m := New(toc, sr, c, 0)
+
+	// Span 0 is only cached uncompressed, span 1 is cached compressed and uncompressed
+	// and span 2 is only cached compressed.
+	if err := m.resolveSpan(0); err != nil {
+		t.Fatalf("failed to resolve span 0: %v", err)
+	}
+	for _, spanID := range []compression.SpanID{1, 2} {
+		if err := m.FetchSingleSpan(spanID); err != nil {
+			t.Fatalf("failed to fetch span %d: %v", spanID, err)
+		}
+	}
+	if _, err := m.GetContents(m.spans[1].startUncompOffset, m.spans[1].endUncompOffset-1); err != nil {
+		t.Fatalf("failed to read span 1: %v", err)
+	}
+	checkStates := func(expected map[compression.SpanID]spanState) {
+		t.Helper()
+		for spanID, state := range expected {
+			if !m.spans[spanID].checkState(state) {
+				t.Fatalf("unexpected state of span %d; expected = %v, got = %v", spanID, state, m.spans[spanID].state.Load())
+			}
+		}
+	}
+
+	demoted, err := m.Demote(DemoteCompress)
+	if err != nil || demoted != 1 {
+		t.Fatalf("unexpected compress demotion; demoted = %d, err = %v", demoted, err)
+	}
+	checkStates(map[compression.SpanID]spanState{0: uncompressed, 1: fetched, 2: fetched})
+	if _, ok := c.Membuf[spanCacheKey(1, uncompressed)]; ok {
+		t.Fatal("uncompressed contents of span 1 were not removed")
+	}
+
+	// Pinned spans stay cached.
+	m.SetPinned(true)
+	demoted, err = m.Demote(DemoteDrop)
+	if err != nil || demoted != 0 {
+		t.Fatalf("unexpected demotion of pinned spans; demoted = %d, err = %v", demoted, err)
+	}
+	checkStates(map[compression.SpanID]spanState{0: uncompressed, 1: fetched, 2: fetched})
+	m.SetPinned(false)
+
+	demoted, err = m.Demote(DemoteDrop)
+	if err != nil || demoted != 3 {
+		t.Fatalf("unexpected drop demotion; demoted = %d, err = %v", demoted, err)
+	}
+	checkStates(map[compression.SpanID]spanState{0: unrequested, 1: unrequested, 2: unrequested})
+	if len(c.Membuf) != 0 {
+		t.Fatalf("unexpected cached contents after drop: %d", len(c.Membuf))
+	}
+
+	// Demoted spans are fetched again when read.
+	fetches = 0
+	got, err := io.ReadAll(io.NewSectionReader(m, 0, int64(3*spanSize)))
+	if err != nil {
+		t.Fatalf("failed to read demoted spans: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("unexpected contents of demoted spans")
+	}
+	if fetches == 0 {
+		t.Fatal("demoted spans were not fetched again")
+	}
+}
+
+func TestSpanManagerReadTuning(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-read-tuning-test", string(testutil.RandomByteData(int64(8*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	want, err := io.ReadAll(io.NewSectionReader(New(toc, r, cache.NewMemoryCache(), 0), 0, int64(toc.UncompressedArchiveSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int
+	sr := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+		fetches++
+		return r.ReadAt(b, off)
+	}), 0, r.Size())
+	m := New(toc, sr, cache.NewMemoryCache(), 0, WithReadTuning(ReadTuning{CoalesceSize: 1 << 30}))
+
+	// A read of several spans fetches them with a single request.
+	end := m.spans[2].endUncompOffset - 1
+	got := make([]byte, end)
+	if _, err := m.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want[:end], got) {
+		t.Fatal("unexpected contents of coalesced spans")
+	}
+	if fetches != 1 {
+		t.Fatalf("unexpected number of fetches of coalesced spans: %d", fetches)
+	}
+
+	// Read-ahead fetches the spans after a read, coalesced up to the coalesce size.
+	fetches = 0
+	m.tuning = ReadTuning{
+		ReadaheadSize: int64(m.spans[5].endUncompOffset - m.spans[3].startUncompOffset),
+		CoalesceSize:  int64(m.spans[4].endCompOffset - m.spans[3].startCompOffset),
+	}
+	m.readahead(2, m.tuning.ReadaheadSize)
+	for id := compression.SpanID(3); id <= toc.MaxSpanID; id++ {
+		expected := unrequested
+		if id <= 5 {
+			expected = fetched
+		}
+		if !m.spans[id].checkState(expected) {
+			t.Fatalf("unexpected state of span %d after read-ahead; expected = %v, got = %v", id, expected, m.spans[id].state.Load())
+		}
+	}
+	if fetches != 2 {
+		t.Fatalf("unexpected number of fetches of read-ahead spans: %d", fetches)
+	}
+	got, err = io.ReadAll(io.NewSectionReader(m, 0, int64(toc.UncompressedArchiveSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("unexpected contents of read-ahead spans")
+	}
+}
+
+func TestSpanManagerPrefetch(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-prefetch-test", string(testutil.RandomByteData(int64(8*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	var fetches int
+	sr := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+		fetches++
+		return r.ReadAt(b, off)
+	}), 0, r.Size())
+	// Without a coalesce size in the ReadTuning, adjacent spans are prefetched together regardless.
+	m := New(toc, sr, cache.NewMemoryCache(), 0)
+
+	if err := m.Prefetch(101); err == nil {
+		t.Fatal("expected an error for an invalid percentage")
+	}
+	if err := m.Prefetch(0); err != nil || fetches != 0 {
+		t.Fatalf("unexpected prefetch of 0%%; fetches = %d, err = %v", fetches, err)
+	}
+
+	// The number of spans prefetched is rounded up, so that small layers are prefetched too.
+	numSpans := int(toc.MaxSpanID + 1)
+	expectedSpans := (numSpans*30 + 99) / 100
+	if err := m.Prefetch(30); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		expected := unrequested
+		if int(id) < expectedSpans {
+			expected = fetched
+		}
+		if !m.spans[id].checkState(expected) {
+			t.Fatalf("unexpected state of span %d after prefetch; expected = %v, got = %v", id, expected, m.spans[id].state.Load())
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("unexpected number of fetches of prefetched spans: %d", fetches)
+	}
+
+	// Spans which are fetched already are not fetched again.
+	fetches = 0
+	if err := m.Prefetch(100); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	if fetches != 1 {
+		t.Fatalf("unexpected number of fetches of the remaining spans: %d", fetches)
+	}
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		if !m.spans[id].checkState(fetched) {
+			t.Fatalf("span %d was not prefetched", id)
+		}
+	}
+}
+
+func TestSpanManagerPrefetchRange(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-prefetch-range-test", string(testutil.RandomByteData(int64(8*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+
+	if err := m.PrefetchRange(0, 0); err != nil {
+		t.Fatalf("failed to prefetch empty range: %v", err)
+	}
+	// The range ends at the first byte of span 4, so spans 2 to 4 are fetched.
+	if toc.MaxSpanID < 5 {
+		t.Fatalf("expected the layer to have several spans; got = %d", toc.MaxSpanID+1)
+	}
+	var first, last compression.SpanID = 2, 4
+	start, end := m.spans[first].startUncompOffset+1, m.spans[last].startUncompOffset+1
+	if err := m.PrefetchRange(start, end); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		expected := unrequested
+		if id >= first && id <= last {
+			expected = fetched
+		}
+		if !m.spans[id].checkState(expected) {
+			t.Fatalf("unexpected state of span %d after prefetch; expected = %v, got = %v", id, expected, m.spans[id].state.Load())
+		}
+	}
+}
+
+func TestSpanManagerPrefetchRanges(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-prefetch-ranges-test", string(testutil.RandomByteData(int64(8*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	if toc.MaxSpanID < 6 {
+		t.Fatalf("expected the layer to have several spans; got = %d", toc.MaxSpanID+1)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+
+	// Overlapping and unordered ranges of spans 1 to 2 and 5, and an empty range.
+	ranges := []ByteRange{
+		{Start: m.spans[5].startUncompOffset, End: m.spans[5].startUncompOffset + 1},
+		{Start: m.spans[2].startUncompOffset, End: m.spans[2].endUncompOffset},
+		{Start: m.spans[1].startUncompOffset + 1, End: m.spans[2].startUncompOffset + 1},
+		{Start: m.spans[3].startUncompOffset, End: m.spans[3].startUncompOffset},
+	}
+	if err := m.PrefetchRanges(ranges); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		expected := unrequested
+		if id == 1 || id == 2 || id == 5 {
+			expected = fetched
+		}
+		if !m.spans[id].checkState(expected) {
+			t.Fatalf("unexpected state of span %d after prefetch; expected = %v, got = %v", id, expected, m.spans[id].state.Load())
+		}
+	}
+}
+
+func TestSpanManagerSequentialReadahead(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-sequential-readahead-test", string(testutil.RandomByteData(int64(16*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0,
+		WithSequentialReadahead(SequentialReadahead{MinWindow: int64(spanSize), MaxWindow: int64(4 * spanSize)}))
+	defer m.Close()
+
+	var a AccessPattern
+	read := func(start, end compression.Offset) {
+		if _, err := m.GetContents(start, end); err != nil {
+			t.Fatal(err)
+		}
+		m.ObserveRead(&a, start, end)
+	}
+	waitFetched := func(id compression.SpanID) {
+		for i := 0; !m.spans[id].checkState(fetched); i++ {
+			if i == 1000 {
+				t.Fatalf("span %d wasn't read ahead", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	fileStart := toc.FileMetadata[0].UncompressedOffset
+	read(fileStart, fileStart+100)
+	if a.window != 0 {
+		t.Fatalf("unexpected read-ahead window after the first read: %d", a.window)
+	}
+	// The window grows with every sequential read, up to the max window.
+	for i, expected := range []int64{1, 2, 4, 4} {
+		start := fileStart + 100 + compression.Offset(i)*spanSize
+		read(start, start+spanSize)
+		if a.window != expected*int64(spanSize) {
+			t.Fatalf("unexpected read-ahead window after %d sequential reads; expected = %d, got = %d", i+1, expected*int64(spanSize), a.window)
+		}
+	}
+	// The spans after the last read are read ahead, and reading them counts as hits.
+	last := m.zinfo.UncompressedOffsetToSpanID(fileStart + 100 + 4*spanSize - 1)
+	lastAhead := m.zinfo.UncompressedOffsetToSpanID(m.spans[last+1].startUncompOffset + 4*spanSize - 1)
+	for id := last + 1; id <= lastAhead; id++ {
+		waitFetched(id)
+	}
+	spans, hits := m.ReadaheadStats()
+	if spans < int64(lastAhead-last) {
+		t.Fatalf("unexpected number of spans read ahead: %d", spans)
+	}
+	read(m.spans[last+1].startUncompOffset, m.spans[last+1].endUncompOffset-1)
+	if _, got := m.ReadaheadStats(); got != hits+1 {
+		t.Fatalf("unexpected read-ahead hits after reading a span read ahead; expected = %d, got = %d", hits+1, got)
+	}
+
+	// A read elsewhere resets the window.
+	read(fileStart, fileStart+100)
+	if a.window != 0 {
+		t.Fatalf("unexpected read-ahead window after a random read: %d", a.window)
+	}
+}
+
+func TestSpanManagerFetchStats(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-fetch-stats-test", string(testutil.RandomByteData(int64(4*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	defer m.Close()
+
+	s := m.spans[1]
+	size := int64(s.endUncompOffset - s.startUncompOffset)
+	buf := make([]byte, size-1)
+	if _, err := m.ReadAt(buf, int64(s.startUncompOffset)); err != nil {
+		t.Fatal(err)
+	}
+	stats := m.FetchStats()
+	if want := int64(s.endCompOffset - s.startCompOffset); stats.FetchedBytes != want || stats.CachedBytes != 0 || stats.Reads != 1 {
+		t.Fatalf("unexpected fetch statistics after first read: %+v; expected %d fetched bytes", stats, want)
+	}
+
+	// The span is served from the cache when it is read again.
+	if _, err := m.ReadAt(buf, int64(s.startUncompOffset)); err != nil {
+		t.Fatal(err)
+	}
+	fetched := stats.FetchedBytes
+	stats = m.FetchStats()
+	if stats.FetchedBytes != fetched || stats.CachedBytes != size-1 || stats.Reads != 2 {
+		t.Fatalf("unexpected fetch statistics after second read: %+v", stats)
+	}
+}
+
+// testMeter is a UsageMeter which refuses fetches while it's closed.
+type testMeter struct {
+	err             error
+	fetched, cached int64
+}
+
+func (m *testMeter) CheckFetch() error  { return m.err }
+func (m *testMeter) AddFetched(n int64) { atomic.AddInt64(&m.fetched, n) }
+func (m *testMeter) AddCached(n int64)  { atomic.AddInt64(&m.cached, n) }
+
+func TestSpanManagerUsageMeter(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-usage-meter-test", string(testutil.RandomByteData(int64(2*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	errQuota := errors.New("quota exceeded")
+	meter := &testMeter{err: errQuota}
+	m := New(toc, r, cache.NewMemoryCache(), 0, WithUsageMeter(meter))
+	if _, err := m.ReadAt(make([]byte, 10), 0); !errors.Is(err, errQuota) {
+		t.Fatalf("expected fetch to fail with the error of the meter: %v", err)
+	}
+	if stats := m.FetchStats(); stats.FetchedBytes != 0 || meter.fetched != 0 {
+		t.Fatalf("unexpected fetched bytes while fetches are refused: %d, %d", stats.FetchedBytes, meter.fetched)
+	}
+	if !m.spans[0].checkState(unrequested) {
+		t.Fatal("span is not unrequested after the meter refused to fetch it")
+	}
+
+	meter.err = nil
+	if _, err := m.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Fatalf("unexpected error once fetches are allowed: %v", err)
+	}
+	if stats := m.FetchStats(); meter.fetched != stats.FetchedBytes || meter.fetched == 0 {
+		t.Fatalf("unexpected fetched bytes accounted: %d, expected %d", meter.fetched, stats.FetchedBytes)
+	}
+	if size := m.CachedSize(); meter.cached != size || size <= 0 {
+		t.Fatalf("unexpected cached bytes accounted: %d, expected %d", meter.cached, size)
+	}
+	if _, err := m.Demote(DemoteDrop); err != nil {
+		t.Fatalf("failed to demote spans: %v", err)
+	}
+	if meter.cached != 0 {
+		t.Fatalf("unexpected cached bytes accounted after demotion: %d", meter.cached)
+	}
+
+	if err := m.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span 1: %v", err)
+	}
+	if meter.cached <= 0 {
+		t.Fatalf("unexpected cached bytes accounted after fetch: %d", meter.cached)
+	}
+	// The spans of a cache without a persistent index are gone once it's closed.
+	m.Close()
+	if meter.cached != 0 {
+		t.Fatalf("unexpected cached bytes accounted after close: %d", meter.cached)
+	}
+}
+
+func TestSpanManagerSharedFetches(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-shared-fetches-test", string(testutil.RandomByteData(int64(4*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	layerDigest := digest.FromString("layer")
+	shared := NewSharedFetches()
+
+	// The fetch of the first SpanManager blocks until the second one waits for it too.
+	started, release := make(chan struct{}), make(chan struct{})
+	blocking := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+		close(started)
+		<-release
+		return r.ReadAt(b, off)
+	}), 0, r.Size())
+	first := New(toc, blocking, cache.NewMemoryCache(), 0, WithLayerDigest(layerDigest), WithSharedFetches(shared))
+	defer first.Close()
+
+	// Spans of the second SpanManager can't be fetched, so they can only come from the shared fetch.
+	unreachable := io.NewSectionReader(readerFn(func([]byte, int64) (int, error) {
+		return 0, errors.New("unreachable")
+	}), 0, r.Size())
+	second := New(toc, unreachable, cache.NewMemoryCache(), 0, WithLayerDigest(layerDigest), WithSharedFetches(shared))
+	defer second.Close()
+
+	errs := make(chan error, 2)
+	go func() { errs <- first.FetchSingleSpan(1) }()
+	<-started
+	go func() { errs <- second.FetchSingleSpan(1) }()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to fetch span: %v", err)
+		}
+	}
+	if !second.spans[1].checkState(fetched) {
+		t.Fatalf("span of the second SpanManager wasn't fetched: %v", second.spans[1].state.Load())
+	}
+	if stats := second.FetchStats(); stats.FetchedBytes != 0 {
+		t.Fatalf("second SpanManager fetched %d bytes itself", stats.FetchedBytes)
+	}
+
+	// A span shares the fetch of a run of spans holding it.
+	started, release = make(chan struct{}), make(chan struct{})
+	go func() { errs <- first.PrefetchRange(first.spans[2].startUncompOffset, first.spans[3].endUncompOffset) }()
+	<-started
+	go func() { errs <- second.FetchSingleSpan(3) }()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to fetch spans: %v", err)
+		}
+	}
+	if !second.spans[3].checkState(fetched) {
+		t.Fatalf("span of the second SpanManager wasn't fetched: %v", second.spans[3].state.Load())
+	}
+	if stats := second.FetchStats(); stats.FetchedBytes != 0 {
+		t.Fatalf("second SpanManager fetched %d bytes itself", stats.FetchedBytes)
+	}
+}
+
+// registryPeers fetches spans from a SpanRegistry as a peer would, optionally corrupting them.
+type registryPeers struct {
+	registry *SpanRegistry
+	corrupt  bool
+}
+
+func (p registryPeers) FetchSpan(ctx context.Context, layerDigest digest.Digest, spanID compression.SpanID, spanDigest digest.Digest, _ int64) ([]byte, error) {
+	ns, _ := namespaces.Namespace(ctx)
+	buf, err := p.registry.CachedSpan(ns, layerDigest, spanID, spanDigest)
+	if err == nil && p.corrupt {
+		buf[0] ^= 0xff
+	}
+	return buf, err
+}
+
+func TestSpanManagerPeers(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-peers-test", string(testutil.RandomByteData(int64(4*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	layerDigest := digest.FromString("layer")
+
+	registry := NewSpanRegistry()
+	serving := New(toc, r, cache.NewMemoryCache(), 0, WithLayerDigest(layerDigest), WithNamespace("tenant"))
+	defer serving.Close()
+	serving.SetSpanRegistry(registry)
+	if err := serving.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span: %v", err)
+	}
+	if _, err := registry.CachedSpan("tenant", layerDigest, 2, toc.SpanDigests[2]); !errors.Is(err, ErrSpanNotCached) {
+		t.Fatalf("unexpected error for span which isn't cached: %v", err)
+	}
+	if _, err := registry.CachedSpan("tenant", layerDigest, 1, toc.SpanDigests[0]); !errors.Is(err, ErrSpanNotCached) {
+		t.Fatalf("unexpected error for span with another digest: %v", err)
+	}
+	if _, err := registry.CachedSpan("other", layerDigest, 1, toc.SpanDigests[1]); !errors.Is(err, ErrSpanNotCached) {
+		t.Fatalf("span was served for another namespace: %v", err)
+	}
+	unreachable := io.NewSectionReader(readerFn(func([]byte, int64) (int, error) {
+		return 0, errors.New("unreachable")
+	}), 0, r.Size())
+
+	t.Run("fetched from peer", func(t *testing.T) {
+		m := New(toc, unreachable, cache.NewMemoryCache(), 0,
+			WithLayerDigest(layerDigest), WithNamespace("tenant"), WithPeers(registryPeers{registry: registry}))
+		defer m.Close()
+		if err := m.FetchSingleSpan(1); err != nil {
+			t.Fatalf("failed to fetch span from peer: %v", err)
+		}
+		stats := m.FetchStats()
+		if stats.FetchedBytes != 0 || stats.PeerBytes != int64(m.spans[1].endCompOffset-m.spans[1].startCompOffset) {
+			t.Fatalf("unexpected fetch stats: %+v", stats)
+		}
+		if err := m.FetchSingleSpan(2); err == nil {
+			t.Fatal("span which no peer has cached was fetched without the remote")
+		}
+	})
+
+	t.Run("prefetched from peer", func(t *testing.T) {
+		m := New(toc, unreachable, cache.NewMemoryCache(), 0,
+			WithLayerDigest(layerDigest), WithNamespace("tenant"), WithPeers(registryPeers{registry: registry}))
+		defer m.Close()
+		if err := m.PrefetchRange(m.spans[1].startUncompOffset, m.spans[1].endUncompOffset); err != nil {
+			t.Fatalf("failed to prefetch span from peer: %v", err)
+		}
+		if stats := m.FetchStats(); stats.FetchedBytes != 0 || stats.PeerBytes == 0 || !m.spans[1].checkState(fetched) {
+			t.Fatalf("span wasn't prefetched from peer: %+v", stats)
+		}
+	})
+
+	t.Run("other namespace", func(t *testing.T) {
+		m := New(toc, unreachable, cache.NewMemoryCache(), 0,
+			WithLayerDigest(layerDigest), WithNamespace("other"), WithPeers(registryPeers{registry: registry}))
+		defer m.Close()
+		if err := m.FetchSingleSpan(1); err == nil {
+			t.Fatal("span of another namespace was fetched from peer")
+		}
+	})
+
+	t.Run("invalid span from peer", func(t *testing.T) {
+		m := New(toc, r, cache.NewMemoryCache(), 0,
+			WithLayerDigest(layerDigest), WithPeers(registryPeers{registry: registry, corrupt: true}))
+		defer m.Close()
+		if err := m.FetchSingleSpan(1); err != nil {
+			t.Fatalf("failed to fetch span: %v", err)
+		}
+		if stats := m.FetchStats(); stats.FetchedBytes == 0 || stats.PeerBytes != 0 {
+			t.Fatalf("invalid span from peer wasn't fetched from the remote: %+v", stats)
+		}
+	})
+
+	serving.SetSpanRegistry(nil)
+	if _, err := registry.CachedSpan("tenant", layerDigest, 1, toc.SpanDigests[1]); !errors.Is(err, ErrSpanNotCached) {
+		t.Fatalf("span of unregistered SpanManager was served: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MountState is the state of a layer mounted by the filesystem.
+type MountState struct {
+	Mountpoint string `json:"mountpoint"`
+	Namespace  string `json:"namespace"`
+	// ImageDigest is the digest of the manifest of the image the layer was mounted for.
+	ImageDigest string `json:"imageDigest"`
+	LayerDigest string `json:"layerDigest"`
+	// Size is the compressed size of the layer. FetchedSize is how much of it was fetched,
+	// and CachedSize is how much of it the span cache holds.
+	Size        int64 `json:"size"`
+	FetchedSize int64 `json:"fetchedSize"`
+	CachedSize  int64 `json:"cachedSize"`
+	// SpanSize is the uncompressed size of the spans the layer is fetched and cached in.
+	SpanSize int64     `json:"spanSize"`
+	ReadTime time.Time `json:"readTime"`
+}
+
+// CacheState sums up the state of the layers mounted by the filesystem.
+type CacheState struct {
+	Layers      int   `json:"layers"`
+	Size        int64 `json:"size"`
+	FetchedSize int64 `json:"fetchedSize"`
+	CachedSize  int64 `json:"cachedSize"`
+}
+
+// StateExporter reports the state of the layers mounted by the filesystem it is passed to
+// with WithStateExporter, e.g. to agents monitoring the snapshotter from the host.
+type StateExporter struct {
+	mu     sync.Mutex
+	mounts *mountRegistry
+}
+
+// NewStateExporter returns a StateExporter which reports no mounts until it's passed to a filesystem.
+func NewStateExporter() *StateExporter {
+	return &StateExporter{}
+}
+
+func (e *StateExporter) set(mounts *mountRegistry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mounts = mounts
+}
+
+// Mounts returns the state of the mounted layers, ordered by mountpoint.
+func (e *StateExporter) Mounts() []MountState {
+	e.mu.Lock()
+	registry := e.mounts
+	e.mu.Unlock()
+	if registry == nil {
+		return []MountState{}
+	}
+
+	mounts := registry.list()
+	states := make([]MountState, 0, len(mounts))
+	for mountpoint, m := range mounts {
+		info := m.layer.Info()
+		states = append(states, MountState{
+			Mountpoint:  mountpoint,
+			Namespace:   m.namespace,
+			ImageDigest: m.imageDigest,
+			LayerDigest: info.Digest.String(),
+			Size:        info.Size,
+			FetchedSize: info.FetchedSize,
+			CachedSize:  info.CachedSize,
+			SpanSize:    info.SpanSize,
+			ReadTime:    info.ReadTime,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Mountpoint < states[j].Mountpoint })
+	return states
+}
+
+// Cache returns the total sizes of the mounted layers. A layer mounted several times counts once.
+func (e *StateExporter) Cache() CacheState {
+	var (
+		state CacheState
+		seen  = make(map[string]bool)
+	)
+	for _, m := range e.Mounts() {
+		if seen[m.LayerDigest] {
+			continue
+		}
+		seen[m.LayerDigest] = true
+		state.Layers++
+		state.Size += m.Size
+		state.FetchedSize += m.FetchedSize
+		state.CachedSize += m.CachedSize
+	}
+	return state
+}
+
+// MountsHandler reports the state of the mounted layers as JSON.
+func (e *StateExporter) MountsHandler() http.Handler {
+	return jsonHandler(func() interface{} { return e.Mounts() })
+}
+
+// CacheHandler reports the total sizes of the mounted layers as JSON.
+func (e *StateExporter) CacheHandler() http.Handler {
+	return jsonHandler(func() interface{} { return e.Cache() })
+}
+
+func jsonHandler(state func() interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state())
+	})
+}
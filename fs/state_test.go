@@ -0,0 +1,75 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/opencontainers/go-digest"
+)
+
+type stateTestLayer struct {
+	breakableLayer
+	info layer.Info
+}
+
+func (l *stateTestLayer) Info() layer.Info { return l.info }
+
+func TestStateExporter(t *testing.T) {
+	const imageDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	e := NewStateExporter()
+	if mounts := e.Mounts(); len(mounts) != 0 {
+		t.Fatalf("unexpected mounts before the exporter is passed to a filesystem: %+v", mounts)
+	}
+	registry := newMountRegistry()
+	e.set(registry)
+	shared := &stateTestLayer{info: layer.Info{Digest: digest.FromString("shared"), Size: 100, FetchedSize: 50, CachedSize: 60}}
+	other := &stateTestLayer{info: layer.Info{Digest: digest.FromString("other"), Size: 10, FetchedSize: 10, CachedSize: 20}}
+	registry.add("/mnt/2", &layerMount{layer: shared, namespace: "default", imageDigest: imageDigest})
+	registry.add("/mnt/1", &layerMount{layer: shared, namespace: "k8s.io", imageDigest: imageDigest})
+	registry.add("/mnt/3", &layerMount{layer: other, namespace: "default", imageDigest: imageDigest})
+	registry.add("/mnt/4", &layerMount{layer: other, namespace: "default", imageDigest: imageDigest})
+	registry.remove("/mnt/4")
+
+	mounts := e.Mounts()
+	if len(mounts) != 3 || mounts[0].Mountpoint != "/mnt/1" || mounts[2].Mountpoint != "/mnt/3" {
+		t.Fatalf("unexpected mounts %+v", mounts)
+	}
+	if m := mounts[0]; m.Namespace != "k8s.io" || m.ImageDigest != imageDigest || m.LayerDigest != shared.info.Digest.String() || m.FetchedSize != 50 {
+		t.Fatalf("unexpected state of mount %+v", m)
+	}
+	want := CacheState{Layers: 2, Size: 110, FetchedSize: 60, CachedSize: 80}
+	if got := e.Cache(); got != want {
+		t.Fatalf("cache state = %+v; want %+v", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	e.CacheHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	var got CacheState
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got != want {
+		t.Fatalf("served cache state = %+v (%v); want %+v", got, err, want)
+	}
+	rec = httptest.NewRecorder()
+	e.MountsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/mounts", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("state must be read-only; status = %d", rec.Code)
+	}
+}
@@ -17,11 +17,17 @@
 package fs
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"runtime"
 	"strings"
 
+	"github.com/awslabs/soci-snapshotter/snapshot"
+
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/containerd/mount"
@@ -57,7 +63,31 @@ func (la *layerArchive) Apply(ctx context.Context, root string, r io.Reader, opt
 		return 0, fmt.Errorf("cannot decompress the stream: %w", err)
 	}
 	defer decompressReader.Close()
-	return archive.Apply(ctx, root, decompressReader, opts...)
+	br := bufio.NewReaderSize(decompressReader, windowsLayerPeekSize)
+	if isWindowsLayer(br) {
+		return 0, fmt.Errorf("cannot unpack Windows layer on %s, pull the image for a %s platform instead: %w", runtime.GOOS, runtime.GOOS, snapshot.ErrUnsupportedLayer)
+	}
+	return archive.Apply(ctx, root, br, opts...)
+}
+
+// windowsLayerPeekSize is how much of a layer is read to tell whether it's a Windows layer,
+// enough for the first header with the PAX records of its security descriptor.
+const windowsLayerPeekSize = 64 << 10
+
+// isWindowsLayer returns whether the uncompressed layer `br` is a Windows layer, whose entries have
+// PAX records of their Windows file attributes. It doesn't consume `br`.
+func isWindowsLayer(br *bufio.Reader) bool {
+	b, _ := br.Peek(windowsLayerPeekSize)
+	hdr, err := tar.NewReader(bytes.NewReader(b)).Next()
+	if err != nil {
+		return false
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "MSWINDOWS.") {
+			return true
+		}
+	}
+	return false
 }
 
 type layerUnpacker struct {
@@ -107,6 +137,33 @@ func (lu *layerUnpacker) Unpack(ctx context.Context, desc ocispec.Descriptor, mo
 	return nil
 }
 
+// meteredFetcher is a Fetcher which reports the bytes of the artifacts it reads from the remote.
+type meteredFetcher struct {
+	Fetcher
+	fetched func(n int64)
+}
+
+func (f *meteredFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, bool, error) {
+	rc, local, err := f.Fetcher.Fetch(ctx, desc)
+	if err != nil || local {
+		return rc, local, err
+	}
+	return &meteredReadCloser{ReadCloser: rc, fetched: f.fetched}, local, nil
+}
+
+type meteredReadCloser struct {
+	io.ReadCloser
+	fetched func(n int64)
+}
+
+func (r *meteredReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.fetched(int64(n))
+	}
+	return n, err
+}
+
 func getLayerParents(options []string) (lower []string, err error) {
 	const lowerdirPrefix = "lowerdir="
 
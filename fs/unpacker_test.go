@@ -17,12 +17,15 @@
 package fs
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/snapshot"
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/mount"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -143,6 +146,33 @@ func TestUnpackHappyPath(t *testing.T) {
 	}
 }
 
+func TestApplyWindowsLayer(t *testing.T) {
+	layer := func(hdr *tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Close()
+		return buf.Bytes()
+	}
+	windows := layer(&tar.Header{
+		Name:       "Files",
+		Typeflag:   tar.TypeDir,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{"MSWINDOWS.fileattr": "16"},
+	})
+	linux := layer(&tar.Header{Name: "Files", Typeflag: tar.TypeDir, Mode: 0755})
+
+	_, err := NewLayerArchive().Apply(context.Background(), t.TempDir(), bytes.NewReader(windows))
+	if !errors.Is(err, snapshot.ErrUnsupportedLayer) {
+		t.Fatalf("unexpected error applying Windows layer; expected = %v, got = %v", snapshot.ErrUnsupportedLayer, err)
+	}
+	if _, err := NewLayerArchive().Apply(context.Background(), t.TempDir(), bytes.NewReader(linux)); errors.Is(err, snapshot.ErrUnsupportedLayer) {
+		t.Fatalf("Linux layer was rejected: %v", err)
+	}
+}
+
 type fakeArtifactFetcher struct {
 	storeFails bool
 	fetchFails bool
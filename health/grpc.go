@@ -0,0 +1,56 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements the gRPC health protocol on top of a registry.
+// The empty service name is the snapshotter as a whole; any other name is a subsystem.
+type grpcServer struct {
+	healthpb.UnimplementedHealthServer
+	registry *Registry
+}
+
+// RegisterGRPC serves the gRPC health protocol from the registry on `s`.
+func (r *Registry) RegisterGRPC(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, &grpcServer{registry: r})
+}
+
+func (s *grpcServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	var healthy bool
+	if name := req.GetService(); name != "" {
+		st, ok := s.registry.CheckSubsystem(ctx, name)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "unknown subsystem %q", name)
+		}
+		healthy = st.Healthy
+	} else {
+		healthy = s.registry.Check(ctx).Healthy
+	}
+	resp := &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}
+	if healthy {
+		resp.Status = healthpb.HealthCheckResponse_SERVING
+	}
+	return resp, nil
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package health reports the status of the subsystems of the snapshotter,
+// over HTTP (e.g. for Kubernetes liveness probes) and over the gRPC health protocol.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultCheckTimeout is how long a subsystem check may take before the subsystem is reported unhealthy.
+const DefaultCheckTimeout = 5 * time.Second
+
+// Status is the status of a subsystem.
+type Status struct {
+	Healthy bool `json:"healthy"`
+	// Message describes the status, e.g. why the subsystem is unhealthy or how busy it is.
+	Message string `json:"message,omitempty"`
+}
+
+// Healthy returns a healthy status with a message built like fmt.Sprintf.
+func Healthy(format string, args ...interface{}) Status {
+	return Status{Healthy: true, Message: fmt.Sprintf(format, args...)}
+}
+
+// Unhealthy returns an unhealthy status with a message built like fmt.Sprintf.
+func Unhealthy(format string, args ...interface{}) Status {
+	return Status{Healthy: false, Message: fmt.Sprintf(format, args...)}
+}
+
+// Checker returns the current status of a subsystem.
+// It must return once `ctx` is done.
+type Checker func(ctx context.Context) Status
+
+// Report is the status of all the subsystems. The snapshotter is healthy if all of them are.
+type Report struct {
+	Healthy    bool              `json:"healthy"`
+	Subsystems map[string]Status `json:"subsystems"`
+}
+
+// Registry holds the checkers of the subsystems.
+type Registry struct {
+	timeout time.Duration
+
+	mu       sync.RWMutex
+	checkers map[string]Checker
+}
+
+// NewRegistry returns an empty registry. Checks taking longer than `timeout` are reported
+// unhealthy. A zero `timeout` means DefaultCheckTimeout.
+func NewRegistry(timeout time.Duration) *Registry {
+	if timeout == 0 {
+		timeout = DefaultCheckTimeout
+	}
+	return &Registry{
+		timeout:  timeout,
+		checkers: make(map[string]Checker),
+	}
+}
+
+// Register adds the checker of the subsystem `name`, replacing any previous one.
+func (r *Registry) Register(name string, checker Checker) {
+	r.mu.Lock()
+	r.checkers[name] = checker
+	r.mu.Unlock()
+}
+
+// Subsystems returns the sorted names of the registered subsystems.
+func (r *Registry) Subsystems() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.checkers))
+	for name := range r.checkers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check checks all the subsystems concurrently.
+func (r *Registry) Check(ctx context.Context) Report {
+	return r.check(ctx, r.Subsystems())
+}
+
+// check checks the registered subsystems `names` concurrently.
+func (r *Registry) check(ctx context.Context, names []string) Report {
+	statuses := make([]Status, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		i, name := i, name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], _ = r.CheckSubsystem(ctx, name)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Healthy: true, Subsystems: make(map[string]Status, len(names))}
+	for i, name := range names {
+		report.Subsystems[name] = statuses[i]
+		report.Healthy = report.Healthy && statuses[i].Healthy
+	}
+	return report
+}
+
+// CheckSubsystem checks the subsystem `name`. It returns false if the subsystem isn't registered.
+func (r *Registry) CheckSubsystem(ctx context.Context, name string) (Status, bool) {
+	r.mu.RLock()
+	checker, ok := r.checkers[name]
+	r.mu.RUnlock()
+	if !ok {
+		return Status{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	// Checkers must honour ctx, but a stuck checker (e.g. on a hung FUSE mount)
+	// must not stall the probe.
+	result := make(chan Status, 1)
+	go func() {
+		result <- checker(ctx)
+	}()
+	select {
+	case s := <-result:
+		return s, true
+	case <-ctx.Done():
+		return Unhealthy("check did not complete within %v", r.timeout), true
+	}
+}
+
+// ServeHTTP serves the report of all the subsystems as JSON, or of the subsystems listed
+// by the `subsystem` query parameters. The status code is 200 if healthy, or else 503.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	names := req.URL.Query()["subsystem"]
+	if len(names) == 0 {
+		names = r.Subsystems()
+	}
+	r.mu.RLock()
+	for _, name := range names {
+		if _, ok := r.checkers[name]; !ok {
+			r.mu.RUnlock()
+			http.Error(w, fmt.Sprintf("unknown subsystem %q", name), http.StatusNotFound)
+			return
+		}
+	}
+	r.mu.RUnlock()
+
+	report := r.check(req.Context(), names)
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func newTestRegistry() *Registry {
+	r := NewRegistry(50 * time.Millisecond)
+	r.Register("fuse", func(context.Context) Status { return Healthy("2 mounts") })
+	r.Register("registry", func(context.Context) Status { return Unhealthy("unreachable") })
+	r.Register("stuck", func(ctx context.Context) Status {
+		<-ctx.Done()
+		return Healthy("too late")
+	})
+	return r
+}
+
+func TestRegistryCheck(t *testing.T) {
+	report := newTestRegistry().Check(context.Background())
+	if report.Healthy {
+		t.Fatalf("report must be unhealthy if a subsystem is")
+	}
+	expected := map[string]bool{"fuse": true, "registry": false, "stuck": false}
+	for name, healthy := range expected {
+		if s, ok := report.Subsystems[name]; !ok || s.Healthy != healthy {
+			t.Fatalf("unexpected status of %s; expected healthy = %v, got = %+v", name, healthy, s)
+		}
+	}
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	testCases := []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedSubsystems []string
+	}{
+		{
+			name:               "all subsystems",
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedSubsystems: []string{"fuse", "registry", "stuck"},
+		},
+		{
+			name:               "healthy subsystem",
+			query:              "?subsystem=fuse",
+			expectedStatusCode: http.StatusOK,
+			expectedSubsystems: []string{"fuse"},
+		},
+		{
+			name:               "several subsystems",
+			query:              "?subsystem=fuse&subsystem=registry",
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedSubsystems: []string{"fuse", "registry"},
+		},
+		{
+			name:               "unknown subsystem",
+			query:              "?subsystem=unknown",
+			expectedStatusCode: http.StatusNotFound,
+		},
+	}
+	r := newTestRegistry()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz"+tc.query, nil))
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("unexpected status code; expected = %d, got = %d", tc.expectedStatusCode, w.Code)
+			}
+			if tc.expectedSubsystems == nil {
+				return
+			}
+			var report Report
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatalf("failed to decode report: %v", err)
+			}
+			if len(report.Subsystems) != len(tc.expectedSubsystems) {
+				t.Fatalf("unexpected subsystems in report: %+v", report.Subsystems)
+			}
+			for _, name := range tc.expectedSubsystems {
+				if _, ok := report.Subsystems[name]; !ok {
+					t.Fatalf("subsystem %s is missing from report: %+v", name, report.Subsystems)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCCheck(t *testing.T) {
+	testCases := []struct {
+		service        string
+		expectedStatus healthpb.HealthCheckResponse_ServingStatus
+		expectedCode   codes.Code
+	}{
+		{service: "", expectedStatus: healthpb.HealthCheckResponse_NOT_SERVING},
+		{service: "fuse", expectedStatus: healthpb.HealthCheckResponse_SERVING},
+		{service: "registry", expectedStatus: healthpb.HealthCheckResponse_NOT_SERVING},
+		{service: "unknown", expectedCode: codes.NotFound},
+	}
+	s := &grpcServer{registry: newTestRegistry()}
+	for _, tc := range testCases {
+		t.Run(tc.service, func(t *testing.T) {
+			resp, err := s.Check(context.Background(), &healthpb.HealthCheckRequest{Service: tc.service})
+			if status.Code(err) != tc.expectedCode {
+				t.Fatalf("unexpected error code; expected = %v, got = %v", tc.expectedCode, err)
+			}
+			if err == nil && resp.Status != tc.expectedStatus {
+				t.Fatalf("unexpected status; expected = %v, got = %v", tc.expectedStatus, resp.Status)
+			}
+		})
+	}
+}
@@ -34,10 +34,12 @@ package metadata
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"time"
 
-	"github.com/awslabs/soci-snapshotter/util/dbutil"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	bolt "go.etcd.io/bbolt"
 )
@@ -47,65 +49,46 @@ import (
 // - filesystems
 //   - *filesystem id*                      : bucket for each filesystem keyed by a unique string.
 //     - nodes
-//       - *node id*                        : bucket for each node keyed by a uniqe uint64.
-//         - size : <varint>                : size of the regular node.
-//         - modtime : <varint>             : modification time of the node.
-//         - linkName : <string>            : link target of symlink
-//         - mode : <uvarint>               : permission and mode bits (os.FileMode).
-//         - uid : <varint>                 : uid of the owner.
-//         - gid : <varint>                 : gid of the owner.
-//         - devMajor : <varint>            : the major device number for device
-//         - devMinor : <varint>            : the minor device number for device
-//         - xattrKey : <string>            : key of the first extended attribute.
-//         - xattrValue : <string>          : value of the first extended attribute
-//         - xattrsExtra                    : 2nd and the following extended attribute.
-//           - *key* : <string>             : map of key to value string
-//         - numLink : <varint>             : the number of links pointing to this node.
-//     - metadata
-//       - *node id*                        : bucket for each node keyed by a uniqe uint64.
-//         - childName : <string>           : base name of the first child
-//         - childID   : <node id>          : id of the first child
-//         - childrenExtra                  : 2nd and following child nodes of directory.
-//           - *basename* : <node id>       : map of basename string to the child node id
-//         - uncompressedOffset : <varint>  : the offset in the uncompressed data, where the node is stored.
+//       - *node id* : <node record>        : attributes of the node keyed by a unique uint32 (see encodeNode).
+//     - children
+//       - *parent id*|*basename* : <node id> : child of a directory, keyed by the id of the directory
+//                                              followed by the base name of the child.
+//
+// Paths are stored as the ids of their parent directories rather than as strings, and a node
+// is a single record rather than a bucket, so that layers with millions of files stay small.
 
 var (
 	bucketKeyFilesystems = []byte("filesystems")
-
 	bucketKeyNodes       = []byte("nodes")
-	bucketKeySize        = []byte("size")
-	bucketKeyModTime     = []byte("modtime")
-	bucketKeyLinkName    = []byte("linkName")
-	bucketKeyMode        = []byte("mode")
-	bucketKeyUID         = []byte("uid")
-	bucketKeyGID         = []byte("gid")
-	bucketKeyDevMajor    = []byte("devMajor")
-	bucketKeyDevMinor    = []byte("devMinor")
-	bucketKeyXattrKey    = []byte("xattrKey")
-	bucketKeyXattrValue  = []byte("xattrValue")
-	bucketKeyXattrsExtra = []byte("xattrsExtra")
-	bucketKeyNumLink     = []byte("numLink")
-
-	bucketKeyMetadata      = []byte("metadata")
-	bucketKeyChildName     = []byte("childName")
-	bucketKeyChildID       = []byte("childID")
-	bucketKeyChildrenExtra = []byte("childrenExtra")
-
-	bucketKeyUncompressedOffset = []byte("uncompressedOffset")
+	bucketKeyChildren    = []byte("children")
 )
 
-type childEntry struct {
-	base string
-	id   uint32
-}
+// The fields of a node record. A record is the uvarint bitmap of the fields which are set,
+// followed by the values of the fields in the order of their bits. Integers are varints
+// (except for the mode, a uvarint) and strings are prefixed by their uvarint length.
+const (
+	fieldMode = 1 << iota
+	fieldSize
+	fieldModTime
+	fieldLinkName
+	fieldUID
+	fieldGID
+	fieldDevMajor
+	fieldDevMinor
+	fieldNumLink
+	fieldUncompressedOffset
+	fieldXattrs
+)
+
+var errInvalidRecord = errors.New("invalid node record")
 
-type metadataEntry struct {
-	children           map[string]childEntry
-	UncompressedOffset compression.Offset
-	UncompressedSize   compression.Offset
+// node is a node of the filesystem as stored in the nodes bucket.
+type node struct {
+	attr               Attr
+	uncompressedOffset compression.Offset
 }
 
-func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
+func getFilesystem(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
 	filesystems := tx.Bucket(bucketKeyFilesystems)
 	if filesystems == nil {
 		return nil, fmt.Errorf("fs %q not found: no fs is registered", fsID)
@@ -114,6 +97,14 @@ func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
 	if lbkt == nil {
 		return nil, fmt.Errorf("fs bucket for %q not found", fsID)
 	}
+	return lbkt, nil
+}
+
+func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
+	lbkt, err := getFilesystem(tx, fsID)
+	if err != nil {
+		return nil, err
+	}
 	nodes := lbkt.Bucket(bucketKeyNodes)
 	if nodes == nil {
 		return nil, fmt.Errorf("nodes bucket for %q not found", fsID)
@@ -121,249 +112,231 @@ func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
 	return nodes, nil
 }
 
-func getMetadata(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
-	filesystems := tx.Bucket(bucketKeyFilesystems)
-	if filesystems == nil {
-		return nil, fmt.Errorf("fs %q not found: no fs is registered", fsID)
-	}
-	lbkt := filesystems.Bucket([]byte(fsID))
-	if lbkt == nil {
-		return nil, fmt.Errorf("fs bucket for %q not found", fsID)
+func getChildren(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
+	lbkt, err := getFilesystem(tx, fsID)
+	if err != nil {
+		return nil, err
 	}
-	md := lbkt.Bucket(bucketKeyMetadata)
-	if md == nil {
-		return nil, fmt.Errorf("metadata bucket for fs %q not found", fsID)
+	children := lbkt.Bucket(bucketKeyChildren)
+	if children == nil {
+		return nil, fmt.Errorf("children bucket for %q not found", fsID)
 	}
-	return md, nil
+	return children, nil
 }
 
-func getNodeBucketByID(nodes *bolt.Bucket, id uint32) (*bolt.Bucket, error) {
-	b := nodes.Bucket(encodeID(id))
+func getNode(nodes *bolt.Bucket, id uint32) (*node, error) {
+	b := nodes.Get(encodeID(id))
 	if b == nil {
-		return nil, fmt.Errorf("node bucket for %d not found", id)
+		return nil, fmt.Errorf("node %d not found", id)
+	}
+	n, err := decodeNode(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode node %d: %w", id, err)
 	}
-	return b, nil
+	return n, nil
 }
 
-func getMetadataBucketByID(md *bolt.Bucket, id uint32) (*bolt.Bucket, error) {
-	b := md.Bucket(encodeID(id))
-	if b == nil {
-		return nil, fmt.Errorf("metadata bucket for %d not found", id)
+func putNode(nodes *bolt.Bucket, id uint32, n *node) error {
+	return nodes.Put(encodeID(id), encodeNode(n))
+}
+
+// addNumLink adds `delta` to the number of links of the node.
+func addNumLink(nodes *bolt.Bucket, id uint32, delta int) error {
+	n, err := getNode(nodes, id)
+	if err != nil {
+		return err
+	}
+	n.attr.NumLink += delta
+	return putNode(nodes, id, n)
+}
+
+func readChild(children *bolt.Bucket, pid uint32, base string) (uint32, error) {
+	v := children.Get(childKey(pid, base))
+	if len(v) == 0 {
+		return 0, fmt.Errorf("child %q of %d not found", base, pid)
+	}
+	return decodeID(v), nil
+}
+
+func putChild(children *bolt.Bucket, pid uint32, base string, id uint32) error {
+	if err := children.Put(childKey(pid, base), encodeID(id)); err != nil {
+		return fmt.Errorf("failed to add child %q to %d: %w", base, pid, err)
 	}
-	return b, nil
+	return nil
 }
 
-func writeAttr(b *bolt.Bucket, attr *Attr) error {
+func childKey(pid uint32, base string) []byte {
+	k := make([]byte, 4+len(base))
+	binary.BigEndian.PutUint32(k, pid)
+	copy(k[4:], base)
+	return k
+}
+
+func encodeNode(n *node) []byte {
+	a := &n.attr
+	var fields uint64
+	buf := make([]byte, binary.MaxVarintLen64, 32+len(a.LinkName))
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) { buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...) }
+	putVarint := func(v int64) { buf = append(buf, tmp[:binary.PutVarint(tmp[:], v)]...) }
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	if a.Mode != 0 {
+		fields |= fieldMode
+		putUvarint(uint64(a.Mode))
+	}
+	if a.Size != 0 {
+		fields |= fieldSize
+		putVarint(a.Size)
+	}
+	if !a.ModTime.IsZero() {
+		fields |= fieldModTime
+		putVarint(a.ModTime.Unix())
+		putUvarint(uint64(a.ModTime.Nanosecond()))
+	}
+	if a.LinkName != "" {
+		fields |= fieldLinkName
+		putString(a.LinkName)
+	}
 	for _, v := range []struct {
-		key []byte
-		val int64
+		field uint64
+		val   int64
 	}{
-		{bucketKeySize, attr.Size},
-		{bucketKeyUID, int64(attr.UID)},
-		{bucketKeyGID, int64(attr.GID)},
-		{bucketKeyDevMajor, int64(attr.DevMajor)},
-		{bucketKeyDevMinor, int64(attr.DevMinor)},
-		{bucketKeyNumLink, int64(attr.NumLink - 1)}, // numLink = 0 means num link = 1 in DB
+		{fieldUID, int64(a.UID)},
+		{fieldGID, int64(a.GID)},
+		{fieldDevMajor, int64(a.DevMajor)},
+		{fieldDevMinor, int64(a.DevMinor)},
+		{fieldNumLink, int64(a.NumLink - 1)}, // numLink = 0 means num link = 1 in DB
+		{fieldUncompressedOffset, int64(n.uncompressedOffset)},
 	} {
 		if v.val != 0 {
-			val, err := dbutil.EncodeInt(v.val)
-			if err != nil {
-				return err
-			}
-			if err := b.Put(v.key, val); err != nil {
-				return err
-			}
-		}
-	}
-	if !attr.ModTime.IsZero() {
-		te, err := attr.ModTime.GobEncode()
-		if err != nil {
-			return err
-		}
-		if err := b.Put(bucketKeyModTime, te); err != nil {
-			return err
-		}
-	}
-	if len(attr.LinkName) > 0 {
-		if err := b.Put(bucketKeyLinkName, []byte(attr.LinkName)); err != nil {
-			return err
+			fields |= v.field
+			putVarint(v.val)
 		}
 	}
-	if attr.Mode != 0 {
-		val, err := encodeUint(uint64(attr.Mode))
-		if err != nil {
-			return err
+	if len(a.Xattrs) > 0 {
+		fields |= fieldXattrs
+		keys := make([]string, 0, len(a.Xattrs))
+		for k := range a.Xattrs {
+			keys = append(keys, k)
 		}
-		if err := b.Put(bucketKeyMode, val); err != nil {
-			return err
+		sort.Strings(keys)
+		putUvarint(uint64(len(keys)))
+		for _, k := range keys {
+			putString(k)
+			putString(string(a.Xattrs[k]))
 		}
 	}
-	if len(attr.Xattrs) > 0 {
-		var firstK string
-		var firstV []byte
-		for k, v := range attr.Xattrs {
-			firstK, firstV = k, v
-			break
-		}
-		if err := b.Put(bucketKeyXattrKey, []byte(firstK)); err != nil {
-			return err
-		}
-		if err := b.Put(bucketKeyXattrValue, firstV); err != nil {
-			return err
-		}
-		var xbkt *bolt.Bucket
-		for k, v := range attr.Xattrs {
-			if k == firstK || len(v) == 0 {
-				continue
-			}
-			if xbkt == nil {
-				if xbkt := b.Bucket(bucketKeyXattrsExtra); xbkt != nil {
-					// Reset
-					if err := b.DeleteBucket(bucketKeyXattrsExtra); err != nil {
-						return err
-					}
-				}
-				var err error
-				xbkt, err = b.CreateBucket(bucketKeyXattrsExtra)
-				if err != nil {
-					return err
-				}
-			}
-			if err := xbkt.Put([]byte(k), v); err != nil {
-				return fmt.Errorf("failed to set xattr %q=%q: %w", k, string(v), err)
-			}
-		}
-	}
-
-	return nil
+	// The bitmap is written in front of the fields, in the room left for it.
+	var head [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(head[:], fields)
+	start := binary.MaxVarintLen64 - l
+	copy(buf[start:], head[:l])
+	return buf[start:]
 }
 
-func readAttr(b *bolt.Bucket, attr *Attr) error {
-	return b.ForEach(func(k, v []byte) error {
-		switch string(k) {
-		case string(bucketKeySize):
-			attr.Size, _ = binary.Varint(v)
-		case string(bucketKeyModTime):
-			if err := (&attr.ModTime).GobDecode(v); err != nil {
-				return err
-			}
-		case string(bucketKeyLinkName):
-			attr.LinkName = string(v)
-		case string(bucketKeyMode):
-			mode, _ := binary.Uvarint(v)
-			attr.Mode = os.FileMode(uint32(mode))
-		case string(bucketKeyUID):
-			i, _ := binary.Varint(v)
-			attr.UID = int(i)
-		case string(bucketKeyGID):
-			i, _ := binary.Varint(v)
-			attr.GID = int(i)
-		case string(bucketKeyDevMajor):
-			i, _ := binary.Varint(v)
-			attr.DevMajor = int(i)
-		case string(bucketKeyDevMinor):
-			i, _ := binary.Varint(v)
-			attr.DevMinor = int(i)
-		case string(bucketKeyNumLink):
-			i, _ := binary.Varint(v)
-			attr.NumLink = int(i) + 1 // numLink = 0 means num link = 1 in DB
-		case string(bucketKeyXattrKey):
-			if attr.Xattrs == nil {
-				attr.Xattrs = make(map[string][]byte)
-			}
-			attr.Xattrs[string(v)] = b.Get(bucketKeyXattrValue)
-		case string(bucketKeyXattrsExtra):
-			if err := b.Bucket(k).ForEach(func(k, v []byte) error {
-				if attr.Xattrs == nil {
-					attr.Xattrs = make(map[string][]byte)
-				}
-				attr.Xattrs[string(k)] = v
-				return nil
-			}); err != nil {
-				return err
-			}
-		}
-		return nil
-	})
+// recordDecoder reads the fields of a node record.
+type recordDecoder struct {
+	b   []byte
+	err error
 }
 
-func readNumLink(b *bolt.Bucket) int {
-	// numLink = 0 means num link = 1 in BD
-	numLink, _ := binary.Varint(b.Get(bucketKeyNumLink))
-	return int(numLink) + 1
+func (d *recordDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errInvalidRecord
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
 }
 
-func readChild(md *bolt.Bucket, base string) (uint32, error) {
-	if base == string(md.Get(bucketKeyChildName)) {
-		return decodeID(md.Get(bucketKeyChildID)), nil
+func (d *recordDecoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errInvalidRecord
+		d.b = nil
+		return 0
 	}
-	cbkt := md.Bucket(bucketKeyChildrenExtra)
-	if cbkt == nil {
-		return 0, fmt.Errorf("extra children not found")
-	}
-	eid := cbkt.Get([]byte(base))
-	if len(eid) == 0 {
-		return 0, fmt.Errorf("children %q not found", base)
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *recordDecoder) bytes() []byte {
+	l := d.uvarint()
+	if l > uint64(len(d.b)) {
+		d.err = errInvalidRecord
+		d.b = nil
+		return nil
 	}
-	return decodeID(eid), nil
+	v := d.b[:l:l]
+	d.b = d.b[l:]
+	return v
 }
 
-func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
-	if len(m.children) > 0 {
-		var firstChildName string
-		var firstChild childEntry
-		for name, child := range m.children {
-			firstChildName, firstChild = name, child
-			break
-		}
-		if err := md.Put(bucketKeyChildID, encodeID(firstChild.id)); err != nil {
-			return fmt.Errorf("failed to put id of first child %q: %w", firstChildName, err)
-		}
-		if err := md.Put(bucketKeyChildName, []byte(firstChildName)); err != nil {
-			return fmt.Errorf("failed to put name first child %q: %w", firstChildName, err)
-		}
-		if len(m.children) > 1 {
-			var cbkt *bolt.Bucket
-			for k, c := range m.children {
-				if k == firstChildName {
-					continue
-				}
-				if cbkt == nil {
-					if cbkt := md.Bucket(bucketKeyChildrenExtra); cbkt != nil {
-						// Reset
-						if err := md.DeleteBucket(bucketKeyChildrenExtra); err != nil {
-							return err
-						}
-					}
-					var err error
-					cbkt, err = md.CreateBucket(bucketKeyChildrenExtra)
-					if err != nil {
-						return err
-					}
-				}
-				if err := cbkt.Put([]byte(c.base), encodeID(c.id)); err != nil {
-					return fmt.Errorf("failed to add child ID %q: %w", c.id, err)
-				}
-			}
+func decodeNode(b []byte) (*node, error) {
+	n := &node{attr: Attr{NumLink: 1}}
+	a := &n.attr
+	d := &recordDecoder{b: b}
+	fields := d.uvarint()
+	if fields&fieldMode != 0 {
+		a.Mode = os.FileMode(uint32(d.uvarint()))
+	}
+	if fields&fieldSize != 0 {
+		a.Size = d.varint()
+	}
+	if fields&fieldModTime != 0 {
+		sec := d.varint()
+		a.ModTime = time.Unix(sec, int64(d.uvarint()))
+	}
+	if fields&fieldLinkName != 0 {
+		a.LinkName = string(d.bytes())
+	}
+	if fields&fieldUID != 0 {
+		a.UID = int(d.varint())
+	}
+	if fields&fieldGID != 0 {
+		a.GID = int(d.varint())
+	}
+	if fields&fieldDevMajor != 0 {
+		a.DevMajor = int(d.varint())
+	}
+	if fields&fieldDevMinor != 0 {
+		a.DevMinor = int(d.varint())
+	}
+	if fields&fieldNumLink != 0 {
+		a.NumLink = int(d.varint()) + 1 // numLink = 0 means num link = 1 in DB
+	}
+	if fields&fieldUncompressedOffset != 0 {
+		n.uncompressedOffset = compression.Offset(d.varint())
+	}
+	if fields&fieldXattrs != 0 {
+		count := d.uvarint()
+		a.Xattrs = make(map[string][]byte)
+		for i := uint64(0); i < count && d.err == nil; i++ {
+			k := string(d.bytes())
+			b := d.bytes()
+			v := make([]byte, len(b))
+			copy(v, b)
+			a.Xattrs[k] = v
 		}
 	}
-	if err := putFileSize(md, bucketKeyUncompressedOffset, m.UncompressedOffset); err != nil {
-		return fmt.Errorf("failed to set UncompressedOffset value %d: %w", m.UncompressedOffset, err)
+	if d.err != nil {
+		return nil, d.err
 	}
-
-	return nil
+	return n, nil
 }
 
-func putFileSize(b *bolt.Bucket, k []byte, v compression.Offset) error {
-	return putInt(b, k, int64(v))
-}
-
-func putInt(b *bolt.Bucket, k []byte, v int64) error {
-	i, err := dbutil.EncodeInt(v)
-	if err != nil {
-		return err
+// decodeMode returns the mode of the node record without decoding the other fields.
+func decodeMode(b []byte) os.FileMode {
+	d := &recordDecoder{b: b}
+	if d.uvarint()&fieldMode == 0 {
+		return 0
 	}
-	return b.Put(k, i)
+	return os.FileMode(uint32(d.uvarint()))
 }
 
 func encodeID(id uint32) []byte {
@@ -375,16 +348,3 @@ func encodeID(id uint32) []byte {
 func decodeID(b []byte) uint32 {
 	return binary.BigEndian.Uint32(b)
 }
-
-func encodeUint(i uint64) ([]byte, error) {
-	var (
-		buf      [binary.MaxVarintLen64]byte
-		iEncoded = buf[:]
-	)
-	iEncoded = iEncoded[:binary.PutUvarint(iEncoded, i)]
-
-	if len(iEncoded) == 0 {
-		return nil, fmt.Errorf("failed encoding integer = %v", i)
-	}
-	return iEncoded, nil
-}
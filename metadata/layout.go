@@ -0,0 +1,134 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/rs/xid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Layouts of the metadata DB in the root directory of the snapshotter.
+const (
+	// SharedLayout keeps the metadata of all layers in one DB file, each layer in a bucket of its own.
+	SharedLayout = "shared"
+
+	// PerLayerLayout keeps the metadata of each layer in a DB file of its own, which is removed
+	// when the layer is closed. Layers are imported in parallel without contending for the
+	// writer of a shared DB, and the space of closed layers is returned to the filesystem.
+	PerLayerLayout = "per-layer"
+)
+
+const (
+	sharedDBFile  = "metadata.db"
+	perLayerDBDir = "metadata"
+)
+
+// OpenStore opens the metadata DB with `layout` in `root` and returns the Store of the layers in it.
+func OpenStore(root, layout string, opts *bolt.Options) (Store, error) {
+	switch layout {
+	case "", SharedLayout:
+		db, err := bolt.Open(filepath.Join(root, sharedDBFile), 0600, opts)
+		if err != nil {
+			return nil, err
+		}
+		return func(sr *io.SectionReader, toc ztoc.TOC, opts ...Option) (Reader, error) {
+			return NewReader(db, sr, toc, opts...)
+		}, nil
+	case PerLayerLayout:
+		return NewPerLayerStore(filepath.Join(root, perLayerDBDir), opts)
+	}
+	return nil, fmt.Errorf("unknown metadata layout %q; must be %q or %q", layout, SharedLayout, PerLayerLayout)
+}
+
+// MigrateLayout prepares `root` for the metadata DB with `layout` and returns the paths it removed.
+//
+// The metadata of a layer is imported from its ztoc whenever the layer is mounted, so nothing
+// is copied between the layouts: the DB files of the other layout, and the per-layer DB files
+// left behind by a previous run, are removed. It must be called before the store is opened.
+func MigrateLayout(root, layout string) ([]string, error) {
+	var stale []string
+	switch layout {
+	case "", SharedLayout:
+		stale = append(stale, filepath.Join(root, perLayerDBDir))
+	case PerLayerLayout:
+		stale = append(stale, filepath.Join(root, sharedDBFile))
+		dbs, err := filepath.Glob(filepath.Join(root, perLayerDBDir, "*.db"))
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, dbs...)
+	default:
+		return nil, fmt.Errorf("unknown metadata layout %q; must be %q or %q", layout, SharedLayout, PerLayerLayout)
+	}
+	var removed []string
+	for _, p := range stale {
+		if _, err := os.Lstat(p); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", p, err)
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
+
+// NewPerLayerStore returns a Store which keeps the metadata of each layer in a DB file of its
+// own in `dir`. The file is removed when the Reader is closed.
+func NewPerLayerStore(dir string, opts *bolt.Options) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return func(sr *io.SectionReader, toc ztoc.TOC, ropts ...Option) (Reader, error) {
+		path := filepath.Join(dir, xid.New().String()+".db")
+		db, err := bolt.Open(path, 0600, opts)
+		if err != nil {
+			return nil, err
+		}
+		r, err := NewReader(db, sr, toc, ropts...)
+		if err != nil {
+			db.Close()
+			os.Remove(path)
+			return nil, err
+		}
+		return &perLayerReader{Reader: r, db: db, path: path}, nil
+	}, nil
+}
+
+// perLayerReader is a Reader whose DB holds only its layer, so closing it removes the whole DB
+// rather than the bucket of the layer.
+type perLayerReader struct {
+	Reader
+	db   *bolt.DB
+	path string
+}
+
+func (r *perLayerReader) Close() error {
+	if err := r.db.Close(); err != nil {
+		return err
+	}
+	return os.Remove(r.path)
+}
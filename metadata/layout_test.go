@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPerLayerStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewPerLayerStore(dir, nil)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	var readers []Reader
+	for i := 0; i < 2; i++ {
+		r, err := store(nil, benchmarkTOC(10))
+		if err != nil {
+			t.Fatalf("failed to create reader: %v", err)
+		}
+		readers = append(readers, r)
+	}
+	dbs, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+	if len(dbs) != 2 {
+		t.Fatalf("expected a DB file per layer, got %v", dbs)
+	}
+	if _, _, err := readers[0].GetChild(readers[0].RootID(), "node_modules"); err != nil {
+		t.Fatalf("failed to read metadata: %v", err)
+	}
+	for _, r := range readers {
+		if err := r.Close(); err != nil {
+			t.Fatalf("failed to close reader: %v", err)
+		}
+	}
+	if dbs, _ := filepath.Glob(filepath.Join(dir, "*.db")); len(dbs) != 0 {
+		t.Fatalf("DB files of closed layers weren't removed: %v", dbs)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	root := t.TempDir()
+	shared := filepath.Join(root, sharedDBFile)
+	perLayer := filepath.Join(root, perLayerDBDir, "layer.db")
+	create := func() {
+		if err := os.MkdirAll(filepath.Dir(perLayer), 0700); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{shared, perLayer} {
+			if err := os.WriteFile(p, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	create()
+	removed, err := MigrateLayout(root, PerLayerLayout)
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if want := []string{shared, perLayer}; !reflect.DeepEqual(removed, want) {
+		t.Fatalf("unexpected removed paths; expected = %v, got = %v", want, removed)
+	}
+	if _, err := os.Stat(filepath.Dir(perLayer)); err != nil {
+		t.Fatalf("directory of per-layer DBs was removed: %v", err)
+	}
+
+	create()
+	removed, err = MigrateLayout(root, SharedLayout)
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if want := []string{filepath.Dir(perLayer)}; !reflect.DeepEqual(removed, want) {
+		t.Fatalf("unexpected removed paths; expected = %v, got = %v", want, removed)
+	}
+	if _, err := os.Stat(shared); err != nil {
+		t.Fatalf("shared DB was removed: %v", err)
+	}
+
+	if _, err := MigrateLayout(root, "unknown"); err == nil {
+		t.Fatal("unknown layout was accepted")
+	}
+}
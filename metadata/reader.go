@@ -34,15 +34,12 @@ package metadata
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path"
-	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -137,6 +134,13 @@ func (r *reader) init(toc ztoc.TOC, rOpts Options) (retErr error) {
 	}
 
 	if err := r.initNodes(toc); err != nil {
+		// The batches imported so far are committed, so remove them.
+		r.db.Update(func(tx *bolt.Tx) error {
+			if filesystems := tx.Bucket(bucketKeyFilesystems); filesystems != nil {
+				return filesystems.DeleteBucket([]byte(r.fsID))
+			}
+			return nil
+		})
 		return err
 	}
 	return nil
@@ -153,7 +157,7 @@ func (r *reader) initRootNode(fsID string) error {
 			return err
 		}
 		r.fsID = fsID
-		if _, err := lbkt.CreateBucket(bucketKeyMetadata); err != nil {
+		if _, err := lbkt.CreateBucket(bucketKeyChildren); err != nil {
 			return err
 		}
 		nodes, err := lbkt.CreateBucket(bucketKeyNodes)
@@ -164,14 +168,10 @@ func (r *reader) initRootNode(fsID string) error {
 		if err != nil {
 			return err
 		}
-		rootBucket, err := nodes.CreateBucket(encodeID(rootID))
-		if err != nil {
-			return err
-		}
-		if err := writeAttr(rootBucket, &Attr{
+		if err := putNode(nodes, rootID, &node{attr: Attr{
 			Mode:    os.ModeDir | 0755,
 			NumLink: 2, // The directory itself(.) and the parent link to this directory.
-		}); err != nil {
+		}}); err != nil {
 			return err
 		}
 		r.rootID = rootID
@@ -179,160 +179,217 @@ func (r *reader) initRootNode(fsID string) error {
 	})
 }
 
-func (r *reader) initNodes(toc ztoc.TOC) error {
-	md := make(map[uint32]*metadataEntry)
-	if err := r.db.Batch(func(tx *bolt.Tx) (err error) {
-		nodes, err := getNodes(tx, r.fsID)
-		if err != nil {
-			return err
-		}
-		nodes.FillPercent = 1.0 // we only do sequential write to this bucket
-		var attr Attr
-		for _, ent := range toc.FileMetadata {
-			var id uint32
-			var b *bolt.Bucket
-			ent.Name = cleanEntryName(ent.Name)
-			isLink := ent.Type == "hardlink"
-			if isLink {
-				id, err = getIDByName(md, ent.Linkname, r.rootID)
-				if err != nil {
-					return fmt.Errorf("%q is a hardlink but cannot get link destination %q: %w", ent.Name, ent.Linkname, err)
-				}
-				b, err = getNodeBucketByID(nodes, id)
-				if err != nil {
-					return fmt.Errorf("cannot get hardlink destination %q ==> %q (%d): %w", ent.Name, ent.Linkname, id, err)
-				}
-				numLink, _ := binary.Varint(b.Get(bucketKeyNumLink))
-				if err := putInt(b, bucketKeyNumLink, numLink+1); err != nil {
-					return fmt.Errorf("cannot put NumLink of %q ==> %q: %w", ent.Name, ent.Linkname, err)
-				}
-			} else {
-				// Write node bucket
-				var found bool
-				if ent.Type == "dir" {
-					// Check if this directory is already created, if so overwrite it.
-					id, err = getIDByName(md, ent.Name, r.rootID)
-					if err == nil {
-						b, err = getNodeBucketByID(nodes, id)
-						if err != nil {
-							return fmt.Errorf("failed to get directory bucket %d: %w", id, err)
-						}
-						found = true
-						attr.NumLink = readNumLink(b)
-					}
-				}
-				if !found {
-					// No existing node. Create a new one.
-					id, err = r.nextID()
-					if err != nil {
-						return err
-					}
-					b, err = nodes.CreateBucket(encodeID(id))
-					if err != nil {
-						return err
-					}
-					attr.NumLink = 1 // at least the parent dir references this directory.
-					if ent.Type == "dir" {
-						attr.NumLink++ // at least "." references this directory.
-					}
-				}
-				if err := writeAttr(b, attrFromZtocEntry(&ent, &attr)); err != nil {
-					return fmt.Errorf("failed to set attr to %d(%q): %w", id, ent.Name, err)
-				}
-			}
+// importBatchSize is the number of TOC entries imported per transaction. Transactions hold
+// the pages they write in memory until they are committed, so layers with millions of files
+// are imported in batches to bound the memory used by the import.
+const importBatchSize = 50000
+
+// importer imports the entries of a TOC. Only the directories are kept in memory, keyed by
+// their parent directory and base name, so that their paths take no more room than their names.
+type importer struct {
+	r     *reader
+	dirs  map[dirKey]uint32
+	names map[string]string // interned names of directories
+
+	// The parent directory of the last entry, since the entries of a directory are mostly adjacent.
+	lastDir   string
+	lastDirID uint32
+}
 
-			pdirName := parentDir(ent.Name)
-			pid, pb, err := r.getOrCreateDir(nodes, md, pdirName, r.rootID)
+type dirKey struct {
+	pid  uint32
+	base string
+}
+
+func (r *reader) initNodes(toc ztoc.TOC) error {
+	im := &importer{
+		r:     r,
+		dirs:  make(map[dirKey]uint32),
+		names: make(map[string]string),
+	}
+	entries := toc.FileMetadata
+	for len(entries) > 0 {
+		batch := entries
+		if len(batch) > importBatchSize {
+			batch = batch[:importBatchSize]
+		}
+		entries = entries[len(batch):]
+		if err := r.db.Update(func(tx *bolt.Tx) error {
+			nodes, err := getNodes(tx, r.fsID)
 			if err != nil {
-				return fmt.Errorf("failed to create parent directory %q of %q: %w", pdirName, ent.Name, err)
+				return err
 			}
-			if err := setChild(md, pb, pid, path.Base(ent.Name), id, ent.Type == "dir"); err != nil {
+			nodes.FillPercent = 1.0 // we only do sequential write to this bucket
+			children, err := getChildren(tx, r.fsID)
+			if err != nil {
 				return err
 			}
-
-			if !isLink {
-				if md[id] == nil {
-					md[id] = &metadataEntry{}
+			for i := range batch {
+				if err := im.add(nodes, children, &batch[i]); err != nil {
+					return err
 				}
-				md[id].UncompressedOffset = ent.UncompressedOffset
 			}
+			return nil
+		}); err != nil {
+			return err
 		}
-		return nil
-	}); err != nil {
-		return err
 	}
+	return nil
+}
 
-	addendum := make([]struct {
-		id []byte
-		md *metadataEntry
-	}, len(md))
-	i := 0
-	for id, d := range md {
-		addendum[i].id, addendum[i].md = encodeID(id), d
-		i++
+// add imports the entry `ent` of the TOC.
+func (im *importer) add(nodes, children *bolt.Bucket, ent *ztoc.FileMetadata) error {
+	name := cleanEntryName(ent.Name)
+	isDir := ent.Type == "dir"
+	if name == "" {
+		if !isDir {
+			return nil
+		}
+		// The entry of the root directory only updates its attributes.
+		root, err := getNode(nodes, im.r.rootID)
+		if err != nil {
+			return err
+		}
+		attrFromZtocEntry(ent, &root.attr)
+		return putNode(nodes, im.r.rootID, root)
 	}
-	sort.Slice(addendum, func(i, j int) bool {
-		return bytes.Compare(addendum[i].id, addendum[j].id) < 0
-	})
+	pdirName, base := parentDir(name), path.Base(name)
 
-	if err := r.db.Batch(func(tx *bolt.Tx) (err error) {
-		meta, err := getMetadata(tx, r.fsID)
+	if ent.Type == "hardlink" {
+		linkName := cleanEntryName(ent.Linkname)
+		id, err := im.lookup(children, linkName)
 		if err != nil {
-			return err
+			return fmt.Errorf("%q is a hardlink but cannot get link destination %q: %w", ent.Name, ent.Linkname, err)
+		}
+		if err := addNumLink(nodes, id, 1); err != nil {
+			return fmt.Errorf("cannot put NumLink of %q ==> %q: %w", ent.Name, ent.Linkname, err)
+		}
+		pid, err := im.getOrCreateDir(nodes, children, pdirName)
+		if err != nil {
+			return fmt.Errorf("failed to create parent directory %q of %q: %w", pdirName, ent.Name, err)
 		}
-		meta.FillPercent = 1.0 // we only do sequential write to this bucket
+		return putChild(children, pid, base, id)
+	}
 
-		for _, m := range addendum {
-			md, err := meta.CreateBucket(m.id)
+	pid, err := im.getOrCreateDir(nodes, children, pdirName)
+	if err != nil {
+		return fmt.Errorf("failed to create parent directory %q of %q: %w", pdirName, ent.Name, err)
+	}
+	key := dirKey{pid, base}
+	if isDir {
+		if id, ok := im.dirs[key]; ok {
+			// The directory is already created (e.g. as the parent of a previous entry), so overwrite it.
+			n, err := getNode(nodes, id)
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to get directory %d: %w", id, err)
 			}
-			if err := writeMetadataEntry(md, m.md); err != nil {
-				return err
+			numLink := n.attr.NumLink
+			attrFromZtocEntry(ent, &n.attr)
+			n.attr.NumLink = numLink
+			if err := putNode(nodes, id, n); err != nil {
+				return fmt.Errorf("failed to set attr to %d(%q): %w", id, ent.Name, err)
 			}
+			return nil
 		}
-		return nil
-	}); err != nil {
+	}
+	id, err := im.r.nextID()
+	if err != nil {
 		return err
 	}
-
-	return nil
+	n := &node{uncompressedOffset: ent.UncompressedOffset}
+	attrFromZtocEntry(ent, &n.attr)
+	n.attr.NumLink = 1 // at least the parent dir references this node.
+	if isDir {
+		n.attr.NumLink++ // at least "." references this directory.
+	}
+	if err := putNode(nodes, id, n); err != nil {
+		return fmt.Errorf("failed to set attr to %d(%q): %w", id, ent.Name, err)
+	}
+	if err := putChild(children, pid, base, id); err != nil {
+		return err
+	}
+	if !isDir {
+		delete(im.dirs, key) // replaces a directory of the same name, if any
+		return nil
+	}
+	im.dirs[dirKey{pid, im.intern(base)}] = id
+	// The ".." of the directory references its parent.
+	return addNumLink(nodes, pid, 1)
 }
 
-func (r *reader) getOrCreateDir(nodes *bolt.Bucket, md map[uint32]*metadataEntry, d string, rootID uint32) (id uint32, b *bolt.Bucket, err error) {
-	id, err = getIDByName(md, d, rootID)
-	if err != nil {
-		id, err = r.nextID()
-		if err != nil {
-			return 0, nil, err
+// getOrCreateDir returns the id of the directory `dir`, creating it and its parents if they don't exist.
+func (im *importer) getOrCreateDir(nodes, children *bolt.Bucket, dir string) (uint32, error) {
+	if dir == im.lastDir && im.lastDirID != 0 {
+		return im.lastDirID, nil
+	}
+	id := im.r.rootID
+	for rest := dir; rest != ""; {
+		var base string
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			base, rest = rest[:i], rest[i+1:]
+		} else {
+			base, rest = rest, ""
 		}
-		b, err = nodes.CreateBucket(encodeID(id))
+		if cid, ok := im.dirs[dirKey{id, base}]; ok {
+			id = cid
+			continue
+		}
+		cid, err := im.r.nextID()
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
-		attr := &Attr{
+		if err := putNode(nodes, cid, &node{attr: Attr{
 			Mode:    os.ModeDir | 0755,
 			NumLink: 2, // The directory itself(.) and the parent link to this directory.
+		}}); err != nil {
+			return 0, err
 		}
-		if err := writeAttr(b, attr); err != nil {
-			return 0, nil, err
+		if err := putChild(children, id, base, cid); err != nil {
+			return 0, err
 		}
-		if d != "" {
-			pid, pb, err := r.getOrCreateDir(nodes, md, parentDir(d), rootID)
-			if err != nil {
-				return 0, nil, err
-			}
-			if err := setChild(md, pb, pid, path.Base(d), id, true); err != nil {
-				return 0, nil, err
-			}
+		if err := addNumLink(nodes, id, 1); err != nil {
+			return 0, err
 		}
-	} else {
-		b, err = getNodeBucketByID(nodes, id)
-		if err != nil {
-			return 0, nil, fmt.Errorf("failed to get dir bucket %d: %w", id, err)
+		base = im.intern(base)
+		im.dirs[dirKey{id, base}] = cid
+		id = cid
+	}
+	im.lastDir, im.lastDirID = dir, id
+	return id, nil
+}
+
+// lookup returns the id of the node at `name`.
+func (im *importer) lookup(children *bolt.Bucket, name string) (uint32, error) {
+	if name == "" {
+		return im.r.rootID, nil
+	}
+	pid := im.r.rootID
+	dir := parentDir(name)
+	for rest := dir; rest != ""; {
+		var base string
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			base, rest = rest[:i], rest[i+1:]
+		} else {
+			base, rest = rest, ""
+		}
+		id, ok := im.dirs[dirKey{pid, base}]
+		if !ok {
+			return 0, fmt.Errorf("not found directory %q in %d", base, pid)
 		}
+		pid = id
 	}
-	return id, b, nil
+	return readChild(children, pid, path.Base(name))
+}
+
+// intern returns the canonical copy of the name, so that directories of the same name
+// (e.g. "src" or "node_modules") share it. The copy doesn't reference the TOC.
+func (im *importer) intern(name string) string {
+	if s, ok := im.names[name]; ok {
+		return s
+	}
+	s := string([]byte(name))
+	im.names[s] = s
+	return s
 }
 
 func (r *reader) waitInit() error {
@@ -375,32 +432,21 @@ func (r *reader) Close() error {
 
 // GetAttr returns file attribute of specified node.
 func (r *reader) GetAttr(id uint32) (attr Attr, _ error) {
+	view := r.view
 	if r.rootID == id { // no need to wait for root dir
-		if err := r.db.View(func(tx *bolt.Tx) error {
-			nodes, err := getNodes(tx, r.fsID)
-			if err != nil {
-				return fmt.Errorf("nodes bucket of %q not found for sarching attr %d: %w", r.fsID, id, err)
-			}
-			b, err := getNodeBucketByID(nodes, id)
-			if err != nil {
-				return fmt.Errorf("failed to get attr bucket %d: %w", id, err)
-			}
-			return readAttr(b, &attr)
-		}); err != nil {
-			return Attr{}, err
-		}
-		return attr, nil
+		view = r.db.View
 	}
-	if err := r.view(func(tx *bolt.Tx) error {
+	if err := view(func(tx *bolt.Tx) error {
 		nodes, err := getNodes(tx, r.fsID)
 		if err != nil {
 			return fmt.Errorf("nodes bucket of %q not found for sarching attr %d: %w", r.fsID, id, err)
 		}
-		b, err := getNodeBucketByID(nodes, id)
+		n, err := getNode(nodes, id)
 		if err != nil {
-			return fmt.Errorf("failed to get attr bucket %d: %w", id, err)
+			return fmt.Errorf("failed to get attr %d: %w", id, err)
 		}
-		return readAttr(b, &attr)
+		attr = n.attr
+		return nil
 	}); err != nil {
 		return Attr{}, err
 	}
@@ -410,15 +456,11 @@ func (r *reader) GetAttr(id uint32) (attr Attr, _ error) {
 // GetChild returns a child node that has the specified base name.
 func (r *reader) GetChild(pid uint32, base string) (id uint32, attr Attr, _ error) {
 	if err := r.view(func(tx *bolt.Tx) error {
-		metadataEntries, err := getMetadata(tx, r.fsID)
-		if err != nil {
-			return fmt.Errorf("metadata bucket of %q not found for getting child of %d: %w", r.fsID, pid, err)
-		}
-		md, err := getMetadataBucketByID(metadataEntries, pid)
+		children, err := getChildren(tx, r.fsID)
 		if err != nil {
-			return fmt.Errorf("failed to get parent metadata %d: %w", pid, err)
+			return fmt.Errorf("children bucket of %q not found for getting child of %d: %w", r.fsID, pid, err)
 		}
-		id, err = readChild(md, base)
+		id, err = readChild(children, pid, base)
 		if err != nil {
 			return fmt.Errorf("failed to read child %q of %d: %w", base, pid, err)
 		}
@@ -426,11 +468,12 @@ func (r *reader) GetChild(pid uint32, base string) (id uint32, attr Attr, _ erro
 		if err != nil {
 			return fmt.Errorf("nodes bucket of %q not found for getting child of %d: %w", r.fsID, pid, err)
 		}
-		child, err := getNodeBucketByID(nodes, id)
+		child, err := getNode(nodes, id)
 		if err != nil {
-			return fmt.Errorf("failed to get child bucket %d: %w", id, err)
+			return fmt.Errorf("failed to get child %d: %w", id, err)
 		}
-		return readAttr(child, &attr)
+		attr = child.attr
+		return nil
 	}); err != nil {
 		return 0, Attr{}, err
 	}
@@ -441,63 +484,36 @@ func (r *reader) GetChild(pid uint32, base string) (id uint32, attr Attr, _ erro
 // When the callback returns non-nil error, this stops the iteration.
 func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error {
 	type childInfo struct {
+		name string
 		id   uint32
 		mode os.FileMode
 	}
-	children := make(map[string]childInfo)
+	var children []childInfo
 	if err := r.view(func(tx *bolt.Tx) error {
-		metadataEntries, err := getMetadata(tx, r.fsID)
+		childrenBkt, err := getChildren(tx, r.fsID)
 		if err != nil {
-			return fmt.Errorf("nodes bucket of %q not found for getting child of %d: %w", r.fsID, id, err)
+			return fmt.Errorf("children bucket of %q not found for getting children of %d: %w", r.fsID, id, err)
 		}
-		md, err := getMetadataBucketByID(metadataEntries, id)
+		nodes, err := getNodes(tx, r.fsID)
 		if err != nil {
-			return nil // no child
+			return fmt.Errorf("nodes bucket of %q not found for getting children of %d: %w", r.fsID, id, err)
 		}
-
-		var nodes *bolt.Bucket
-		firstName := md.Get(bucketKeyChildName)
-		if len(firstName) != 0 {
-			firstID := decodeID(md.Get(bucketKeyChildID))
-			if nodes == nil {
-				nodes, err = getNodes(tx, r.fsID)
-				if err != nil {
-					return fmt.Errorf("nodes bucket of %q not found for getting children of %d: %w", r.fsID, id, err)
-				}
-			}
-			firstChild, err := getNodeBucketByID(nodes, firstID)
-			if err != nil {
-				return fmt.Errorf("failed to get first child bucket %d: %w", firstID, err)
-			}
-			mode, _ := binary.Uvarint(firstChild.Get(bucketKeyMode))
-			children[string(firstName)] = childInfo{firstID, os.FileMode(uint32(mode))}
-		}
-
-		cbkt := md.Bucket(bucketKeyChildrenExtra)
-		if cbkt == nil {
-			return nil // no child
-		}
-		if nodes == nil {
-			nodes, err = getNodes(tx, r.fsID)
-			if err != nil {
-				return fmt.Errorf("nodes bucket of %q not found for getting children of %d: %w", r.fsID, id, err)
+		prefix := encodeID(id)
+		c := childrenBkt.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			cid := decodeID(v)
+			b := nodes.Get(v)
+			if b == nil {
+				return fmt.Errorf("failed to get child %d: node not found", cid)
 			}
+			children = append(children, childInfo{string(k[len(prefix):]), cid, decodeMode(b)})
 		}
-		return cbkt.ForEach(func(k, v []byte) error {
-			id := decodeID(v)
-			child, err := getNodeBucketByID(nodes, id)
-			if err != nil {
-				return fmt.Errorf("failed to get child bucket %d: %w", id, err)
-			}
-			mode, _ := binary.Uvarint(child.Get(bucketKeyMode))
-			children[string(k)] = childInfo{id, os.FileMode(uint32(mode))}
-			return nil
-		})
+		return nil
 	}); err != nil {
 		return err
 	}
-	for k, e := range children {
-		if !f(k, e.id, e.mode) {
+	for _, e := range children {
+		if !f(e.name, e.id, e.mode) {
 			break
 		}
 	}
@@ -506,40 +522,24 @@ func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.
 
 // OpenFile returns a section reader of the specified node.
 func (r *reader) OpenFile(id uint32) (File, error) {
-	var size int64
-	var uncompressedOffset compression.Offset
-
-	if err := r.view(func(tx *bolt.Tx) error {
+	var n *node
+	if err := r.view(func(tx *bolt.Tx) (err error) {
 		nodes, err := getNodes(tx, r.fsID)
 		if err != nil {
 			return fmt.Errorf("nodes bucket of %q not found for opening %d: %w", r.fsID, id, err)
 		}
-		b, err := getNodeBucketByID(nodes, id)
+		n, err = getNode(nodes, id)
 		if err != nil {
-			return fmt.Errorf("failed to get file bucket %d: %w", id, err)
+			return fmt.Errorf("failed to get file %d: %w", id, err)
 		}
-		size, _ = binary.Varint(b.Get(bucketKeySize))
-		m, _ := binary.Uvarint(b.Get(bucketKeyMode))
-		if !os.FileMode(uint32(m)).IsRegular() {
+		if !n.attr.Mode.IsRegular() {
 			return fmt.Errorf("%q is not a regular file", id)
 		}
-		metadataEntries, err := getMetadata(tx, r.fsID)
-		if err != nil {
-			return fmt.Errorf("metadata bucket of %q not found for opening %d: %w", r.fsID, id, err)
-		}
-		if md, err := getMetadataBucketByID(metadataEntries, id); err == nil {
-			uncompressedOffset = getUncompressedOffset(md)
-		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	return &file{uncompressedOffset, compression.Offset(size)}, nil
-}
-
-func getUncompressedOffset(md *bolt.Bucket) compression.Offset {
-	ucompOffset, _ := binary.Varint(md.Get(bucketKeyUncompressedOffset))
-	return compression.Offset(ucompOffset)
+	return &file{n.uncompressedOffset, compression.Offset(n.attr.Size)}, nil
 }
 
 type file struct {
@@ -564,54 +564,10 @@ func attrFromZtocEntry(src *ztoc.FileMetadata, dst *Attr) *Attr {
 	dst.GID = src.GID
 	dst.DevMajor = int(src.Devmajor)
 	dst.DevMinor = int(src.Devminor)
-	xattrs := make(map[string][]byte)
-	for k, v := range src.Xattrs {
-		xattrs[k] = []byte(v)
-	}
-	dst.Xattrs = xattrs
+	dst.Xattrs = src.ExtendedAttributes()
 	return dst
 }
 
-func getIDByName(md map[uint32]*metadataEntry, name string, rootID uint32) (uint32, error) {
-	name = cleanEntryName(name)
-	if name == "" {
-		return rootID, nil
-	}
-	dir, base := filepath.Split(name)
-	pid, err := getIDByName(md, dir, rootID)
-	if err != nil {
-		return 0, err
-	}
-	if md[pid] == nil {
-		return 0, fmt.Errorf("not found metadata of %d", pid)
-	}
-	if md[pid].children == nil {
-		return 0, fmt.Errorf("not found children of %q", pid)
-	}
-	c, ok := md[pid].children[base]
-	if !ok {
-		return 0, fmt.Errorf("not found child %q in %d", base, pid)
-	}
-	return c.id, nil
-}
-
-func setChild(md map[uint32]*metadataEntry, pb *bolt.Bucket, pid uint32, base string, id uint32, isDir bool) error {
-	if md[pid] == nil {
-		md[pid] = &metadataEntry{}
-	}
-	if md[pid].children == nil {
-		md[pid].children = make(map[string]childEntry)
-	}
-	md[pid].children[base] = childEntry{base, id}
-	if isDir {
-		numLink, _ := binary.Varint(pb.Get(bucketKeyNumLink))
-		if err := putInt(pb, bucketKeyNumLink, numLink+1); err != nil {
-			return fmt.Errorf("cannot add numlink for children: %w", err)
-		}
-	}
-	return nil
-}
-
 func parentDir(p string) string {
 	dir, _ := path.Split(p)
 	return strings.TrimSuffix(dir, "/")
@@ -629,13 +585,8 @@ func (r *reader) NumOfNodes() (i int, _ error) {
 			return err
 		}
 		return nodes.ForEach(func(k, v []byte) error {
-			b := nodes.Bucket(k)
-			if b == nil {
-				return fmt.Errorf("entry bucket for %q not found", string(k))
-			}
-			var attr Attr
-			if err := readAttr(b, &attr); err != nil {
-				return err
+			if _, err := decodeNode(v); err != nil {
+				return fmt.Errorf("entry for %d: %w", decodeID(k), err)
 			}
 			i++
 			return nil
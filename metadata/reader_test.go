@@ -33,11 +33,17 @@
 package metadata
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -77,3 +83,129 @@ func (r *testableReadCloser) Close() error {
 	r.closeFn()
 	return r.testableReader.Close()
 }
+
+func TestNodeRecord(t *testing.T) {
+	modTime := time.Unix(1700000000, 123456789)
+	for _, n := range []*node{
+		{attr: Attr{NumLink: 1}},
+		{attr: Attr{Mode: os.ModeDir | 0755, NumLink: 3, ModTime: modTime}},
+		{
+			attr: Attr{
+				Size:     1 << 40,
+				ModTime:  time.Unix(-1, 0),
+				LinkName: "../target",
+				Mode:     os.ModeSymlink | os.ModeSetuid | 0777,
+				UID:      -1,
+				GID:      1000,
+				DevMajor: 10,
+				DevMinor: 11,
+				Xattrs:   map[string][]byte{"user.a": []byte("1"), "user.empty": {}},
+				NumLink:  2,
+			},
+			uncompressedOffset: 12345,
+		},
+	} {
+		got, err := decodeNode(encodeNode(n))
+		if err != nil {
+			t.Fatalf("failed to decode %+v: %v", n, err)
+		}
+		if !got.attr.ModTime.Equal(n.attr.ModTime) {
+			t.Fatalf("unexpected modtime; expected = %v, got = %v", n.attr.ModTime, got.attr.ModTime)
+		}
+		got.attr.ModTime = n.attr.ModTime
+		if len(n.attr.Xattrs) == 0 {
+			got.attr.Xattrs = n.attr.Xattrs
+		}
+		if !reflect.DeepEqual(got, n) {
+			t.Fatalf("unexpected node; expected = %+v, got = %+v", n, got)
+		}
+		if mode := decodeMode(encodeNode(n)); mode != n.attr.Mode {
+			t.Fatalf("unexpected mode; expected = %v, got = %v", n.attr.Mode, mode)
+		}
+	}
+	if _, err := decodeNode([]byte{fieldLinkName, 10, 'a'}); err == nil {
+		t.Fatal("truncated record was decoded")
+	}
+}
+
+// TestImportBatches tests that layers whose entries are imported in several transactions
+// are imported as a whole.
+func TestImportBatches(t *testing.T) {
+	n := 2*importBatchSize + 10
+	toc := benchmarkTOC(n)
+	// A hard link in the last batch to a file in the first one.
+	toc.FileMetadata = append(toc.FileMetadata, ztoc.FileMetadata{Name: "link", Type: "hardlink", Linkname: "node_modules/pkg0/lib/src0/file0.js"})
+	r, err := newTestableReader(nil, toc)
+	if err != nil {
+		t.Fatalf("failed to create new reader: %v", err)
+	}
+	defer r.Close()
+	// The entries, the root and the implicit node_modules, package and lib directories.
+	dirs := (n + 100) / 101
+	want := n + 1 + 1 + 2*((dirs+9)/10)
+	numOfNodes(want)(t, r)
+	last := toc.FileMetadata[n-1]
+	hasFile(last.Name, int64(last.UncompressedSize))(t, r)
+	sameNodes("node_modules/pkg0/lib/src0/file0.js", "link")(t, r)
+	hasNumLink("node_modules/pkg0/lib/src0/file0.js", 2)(t, r)
+	hasDirChildren("node_modules/pkg0/lib", "src0", "src1", "src2", "src3", "src4", "src5", "src6", "src7", "src8", "src9")(t, r)
+}
+
+// BenchmarkNewReader imports the metadata of layers with many files. Layers with millions
+// of files are only imported with e.g. `-bench 'NewReader/entries=5000000' -benchtime 1x`.
+func BenchmarkNewReader(b *testing.B) {
+	for _, n := range []int{10000, 100000, 1000000, 5000000} {
+		n := n
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			toc := benchmarkTOC(n)
+			runtime.GC()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				path := filepath.Join(b.TempDir(), "metadata.db")
+				db, err := bolt.Open(path, 0600, &bolt.Options{NoFreelistSync: true, FreelistType: bolt.FreelistMapType})
+				if err != nil {
+					b.Fatal(err)
+				}
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				r, err := NewReader(db, nil, toc)
+				if err != nil {
+					b.Fatalf("failed to import metadata: %v", err)
+				}
+				runtime.ReadMemStats(&after)
+				b.StopTimer()
+				if fi, err := os.Stat(path); err == nil {
+					b.ReportMetric(float64(fi.Size())/float64(n), "db-bytes/entry")
+				}
+				b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/float64(n), "alloc-bytes/entry")
+				r.Close()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// benchmarkTOC returns the TOC of a layer with `n` entries, laid out like a node_modules tree:
+// directories of 100 files each, nested in package directories which don't have entries of their own.
+func benchmarkTOC(n int) ztoc.TOC {
+	entries := make([]ztoc.FileMetadata, 0, n)
+	modTime := time.Unix(1700000000, 0)
+	var offset compression.Offset
+	for dirs := 0; len(entries) < n; dirs++ {
+		dir := fmt.Sprintf("node_modules/pkg%d/lib/src%d/", dirs/10, dirs%10)
+		entries = append(entries, ztoc.FileMetadata{Name: dir, Type: "dir", Mode: 0755, ModTime: modTime})
+		for i := 0; i < 100 && len(entries) < n; i++ {
+			entries = append(entries, ztoc.FileMetadata{
+				Name:               fmt.Sprintf("%sfile%d.js", dir, i),
+				Type:               "reg",
+				Mode:               0644,
+				UncompressedOffset: offset,
+				UncompressedSize:   1024,
+				ModTime:            modTime,
+			})
+			offset += 1536
+		}
+	}
+	return ztoc.TOC{FileMetadata: entries}
+}
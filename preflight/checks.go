@@ -0,0 +1,189 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LazyLoading is the feature degraded by the checks of FUSE. Images are still pulled, but their
+// layers are fetched and unpacked by containerd instead of being mounted lazily.
+const LazyLoading = "lazy loading"
+
+// socketTimeout is how long UnixSocket waits for the server to accept the connection.
+const socketTimeout = 3 * time.Second
+
+var (
+	fuseDevice     = "/dev/fuse"
+	fusermountBin  = "fusermount"
+	kernelRelease  = uname
+	procFilesystem = "/proc/filesystems"
+)
+
+// FUSEDevice checks that FUSE filesystems can be mounted.
+func FUSEDevice() Check {
+	return Check{
+		Name:     "fuse-device",
+		Degrades: []string{LazyLoading},
+		Remedy:   "load the fuse kernel module (modprobe fuse); in a container, give it access to /dev/fuse",
+		Run: func(ctx context.Context) error {
+			f, err := os.OpenFile(fuseDevice, os.O_RDWR, 0)
+			if err != nil {
+				if b, perr := os.ReadFile(procFilesystem); perr == nil && !strings.Contains(string(b), "\tfuse\n") {
+					return fmt.Errorf("the kernel doesn't support FUSE: %w", err)
+				}
+				return err
+			}
+			return f.Close()
+		},
+	}
+}
+
+// Fusermount checks that FUSE filesystems can be mounted without root privileges if the snapshotter
+// doesn't have them.
+func Fusermount() Check {
+	return Check{
+		Name:     "fusermount",
+		Degrades: []string{LazyLoading},
+		Remedy:   "install fuse (e.g. yum install fuse) or run the snapshotter as root",
+		Run: func(ctx context.Context) error {
+			if os.Geteuid() == 0 {
+				return nil
+			}
+			if _, err := exec.LookPath(fusermountBin); err != nil {
+				return fmt.Errorf("not running as root and %s is not installed: %w", fusermountBin, err)
+			}
+			return nil
+		},
+	}
+}
+
+// KernelVersion checks that the kernel is at least version `major`.`minor`, e.g. for overlayfs
+// to support the multiple lower directories of snapshots.
+func KernelVersion(major, minor int) Check {
+	return Check{
+		Name:   "kernel-version",
+		Remedy: fmt.Sprintf("upgrade the kernel to %d.%d or later", major, minor),
+		Run: func(ctx context.Context) error {
+			release, err := kernelRelease()
+			if err != nil {
+				return err
+			}
+			gotMajor, gotMinor, err := parseKernelRelease(release)
+			if err != nil {
+				return err
+			}
+			if gotMajor < major || (gotMajor == major && gotMinor < minor) {
+				return fmt.Errorf("kernel %s is older than %d.%d", release, major, minor)
+			}
+			return nil
+		},
+	}
+}
+
+func uname() (string, error) {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(u.Release[:]), nil
+}
+
+// parseKernelRelease returns the major and minor versions of a kernel release like "5.10.0-1-amd64".
+func parseKernelRelease(release string) (int, int, error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	m, err := strconv.Atoi(minor)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	return major, m, nil
+}
+
+// WritableDirectory checks that files can be created in the directory `dir` of the snapshotter,
+// creating it if needed.
+func WritableDirectory(name, dir string) Check {
+	return Check{
+		Name:   name,
+		Remedy: fmt.Sprintf("make %s a writable directory for the user of the snapshotter", dir),
+		Run: func(ctx context.Context) error {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+			f, err := os.CreateTemp(dir, ".preflight-*")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			return os.Remove(f.Name())
+		},
+	}
+}
+
+// FreeSpace checks that the filesystem of the directory `dir` has at least `min` bytes available.
+func FreeSpace(name, dir string, min int64, degrades []string) Check {
+	return Check{
+		Name:     name,
+		Degrades: degrades,
+		Remedy:   fmt.Sprintf("free up space on the filesystem of %s", dir),
+		Run: func(ctx context.Context) error {
+			var st unix.Statfs_t
+			if err := unix.Statfs(dir, &st); err != nil {
+				return err
+			}
+			if free := int64(st.Bavail) * int64(st.Bsize); free < min {
+				return fmt.Errorf("%d bytes available in %s, fewer than %d", free, dir, min)
+			}
+			return nil
+		},
+	}
+}
+
+// UnixSocket checks that a server listens on the Unix domain socket `address`.
+func UnixSocket(name, address string, degrades []string, remedy string) Check {
+	return Check{
+		Name:     name,
+		Degrades: degrades,
+		Remedy:   remedy,
+		Run: func(ctx context.Context) error {
+			conn, err := (&net.Dialer{Timeout: socketTimeout}).DialContext(ctx, "unix", strings.TrimPrefix(address, "unix://"))
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+	}
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package preflight checks the host before the snapshotter starts, so that missing requirements
+// are reported along with the features they break, instead of failing later with obscure errors.
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Check is a check of a requirement of the snapshotter.
+type Check struct {
+	// Name identifies the check in the report.
+	Name string
+
+	// Degrades lists the features which don't work if the check fails.
+	// The snapshotter can't run at all if the check fails and Degrades is empty.
+	Degrades []string
+
+	// Remedy tells how to fix a failure of the check.
+	Remedy string
+
+	// Run returns why the check failed, if it failed. It must return once `ctx` is done.
+	Run func(ctx context.Context) error
+}
+
+// Failure is a failed check.
+type Failure struct {
+	Check string `json:"check"`
+	Error string `json:"error"`
+	// Fatal is whether the snapshotter can't run at all.
+	Fatal    bool     `json:"fatal"`
+	Degrades []string `json:"degrades,omitempty"`
+	Remedy   string   `json:"remedy,omitempty"`
+}
+
+// Report is the result of the checks.
+type Report struct {
+	// Passed are the names of the checks which passed.
+	Passed   []string  `json:"passed"`
+	Failures []Failure `json:"failures"`
+}
+
+// Run runs `checks` in order.
+func Run(ctx context.Context, checks []Check) Report {
+	report := Report{Passed: []string{}, Failures: []Failure{}}
+	for _, c := range checks {
+		err := c.Run(ctx)
+		if err == nil {
+			report.Passed = append(report.Passed, c.Name)
+			continue
+		}
+		report.Failures = append(report.Failures, Failure{
+			Check:    c.Name,
+			Error:    err.Error(),
+			Fatal:    len(c.Degrades) == 0,
+			Degrades: c.Degrades,
+			Remedy:   c.Remedy,
+		})
+	}
+	return report
+}
+
+// Fatal returns whether a check failed which the snapshotter can't run without.
+func (r Report) Fatal() bool {
+	for _, f := range r.Failures {
+		if f.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// Degraded returns the sorted features which don't work because of the failed checks.
+func (r Report) Degraded() []string {
+	seen := make(map[string]bool)
+	var features []string
+	for _, f := range r.Failures {
+		for _, feature := range f.Degrades {
+			if !seen[feature] {
+				seen[feature] = true
+				features = append(features, feature)
+			}
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Err returns an error listing the failed checks, or nil if all of them passed.
+func (r Report) Err() error {
+	if len(r.Failures) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(r.Failures))
+	for _, f := range r.Failures {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Check, f.Error))
+	}
+	return fmt.Errorf("preflight checks failed: %s", strings.Join(msgs, "; "))
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package preflight
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	pass := func(context.Context) error { return nil }
+	fail := func(context.Context) error { return errors.New("failed") }
+	report := Run(context.Background(), []Check{
+		{Name: "ok", Run: pass},
+		{Name: "fuse", Degrades: []string{LazyLoading}, Run: fail},
+		{Name: "fusermount", Degrades: []string{LazyLoading, "b"}, Run: fail},
+	})
+	if !reflect.DeepEqual(report.Passed, []string{"ok"}) || len(report.Failures) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if report.Fatal() {
+		t.Fatal("checks degrading features must not be fatal")
+	}
+	if got := report.Degraded(); !reflect.DeepEqual(got, []string{"b", LazyLoading}) {
+		t.Fatalf("degraded features = %v", got)
+	}
+	if report.Err() == nil {
+		t.Fatal("failures must be reported")
+	}
+
+	report = Run(context.Background(), []Check{{Name: "kernel", Run: fail}})
+	if !report.Fatal() {
+		t.Fatal("checks degrading no feature must be fatal")
+	}
+	if report = Run(context.Background(), []Check{{Name: "ok", Run: pass}}); report.Err() != nil {
+		t.Fatalf("unexpected error %v", report.Err())
+	}
+}
+
+func TestKernelVersion(t *testing.T) {
+	defer func(f func() (string, error)) { kernelRelease = f }(kernelRelease)
+	for _, tc := range []struct {
+		release string
+		ok      bool
+	}{
+		{"5.10.0-1-amd64", true},
+		{"4.0.0", true},
+		{"6.1", true},
+		{"4.14-rc1", true},
+		{"3.19.8", false},
+		{"3.9.0", false},
+		{"invalid", false},
+	} {
+		kernelRelease = func() (string, error) { return tc.release, nil }
+		err := KernelVersion(4, 0).Run(context.Background())
+		if (err == nil) != tc.ok {
+			t.Errorf("release %q: unexpected result %v", tc.release, err)
+		}
+	}
+}
+
+func TestHostChecks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	defer func(path string) { fuseDevice = path }(fuseDevice)
+	fuseDevice = filepath.Join(dir, "fuse")
+	if err := FUSEDevice().Run(ctx); err == nil {
+		t.Error("missing FUSE device must fail")
+	}
+
+	if err := WritableDirectory("root", filepath.Join(dir, "root")).Run(ctx); err != nil {
+		t.Errorf("writable directory failed: %v", err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritableDirectory("root", filepath.Join(file, "root")).Run(ctx); err == nil {
+		t.Error("directory which can't be created must fail")
+	}
+
+	if err := FreeSpace("space", dir, 0, nil).Run(ctx); err != nil {
+		t.Errorf("free space failed: %v", err)
+	}
+	if err := FreeSpace("space", dir, 1<<62, nil).Run(ctx); err == nil {
+		t.Error("lack of free space must fail")
+	}
+
+	socket := filepath.Join(dir, "sock")
+	if err := UnixSocket("socket", socket, nil, "").Run(ctx); err == nil {
+		t.Error("socket without server must fail")
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := UnixSocket("socket", "unix://"+socket, nil, "").Run(ctx); err != nil {
+		t.Errorf("socket with server failed: %v", err)
+	}
+}
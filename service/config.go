@@ -46,6 +46,15 @@ type Config struct {
 	// CRIKeychainConfig is config for CRI-based keychain.
 	CRIKeychainConfig `toml:"cri_keychain"`
 
+	// TokenFileKeychainConfig is config for the keychain reading a bearer token from a file.
+	TokenFileKeychainConfig `toml:"token_file_keychain"`
+
+	// GCPKeychainConfig is config for the keychain of Google Artifact Registry and Container Registry.
+	GCPKeychainConfig `toml:"gcp_keychain"`
+
+	// ACRKeychainConfig is config for the keychain of Azure Container Registry.
+	ACRKeychainConfig `toml:"acr_keychain"`
+
 	// ResolverConfig is config for resolving registries.
 	ResolverConfig `toml:"resolver"`
 
@@ -72,6 +81,55 @@ type CRIKeychainConfig struct {
 	ImageServicePath string `toml:"image_service_path"`
 }
 
+// TokenFileKeychainConfig is config for the keychain reading a bearer token from a file.
+type TokenFileKeychainConfig struct {
+	// EnableKeychain enables the keychain reading a bearer token from a file
+	EnableKeychain bool `toml:"enable_keychain"`
+
+	// Path is the path to the file holding the token, e.g. a projected service account token.
+	// It is read again whenever it changes.
+	Path string `toml:"path"`
+
+	// Username, if set, is the username the token is presented with as a password.
+	// Otherwise the token is presented as an identity token.
+	Username string `toml:"username"`
+
+	// Hosts are the registries the token is presented to. It is presented to all registries if empty.
+	Hosts []string `toml:"hosts"`
+}
+
+// GCPKeychainConfig is config for the keychain presenting the Application Default Credentials
+// of Google Cloud to Artifact Registry and Container Registry.
+type GCPKeychainConfig struct {
+	// EnableKeychain enables the keychain of Google Cloud
+	EnableKeychain bool `toml:"enable_keychain"`
+
+	// CredentialsFile is the path to the credentials to use instead of the Application Default Credentials.
+	CredentialsFile string `toml:"credentials_file"`
+
+	// Hosts are the registries access tokens are presented to. They are presented to
+	// *.pkg.dev, gcr.io and *.gcr.io if empty.
+	Hosts []string `toml:"hosts"`
+}
+
+// ACRKeychainConfig is config for the keychain presenting the managed identity of the Azure VM
+// to Azure Container Registry.
+type ACRKeychainConfig struct {
+	// EnableKeychain enables the keychain of Azure Container Registry
+	EnableKeychain bool `toml:"enable_keychain"`
+
+	// ClientID is the client ID of the user-assigned managed identity to use.
+	// The system-assigned identity is used if empty.
+	ClientID string `toml:"client_id"`
+
+	// TenantID is the tenant access tokens are exchanged in, if the registry requires it.
+	TenantID string `toml:"tenant_id"`
+
+	// Hosts are the registries the identity is presented to. It is presented to
+	// the registries of ACR (e.g. *.azurecr.io) if empty.
+	Hosts []string `toml:"hosts"`
+}
+
 // ResolverConfig is config for resolving registries.
 type ResolverConfig resolver.Config
 
@@ -85,4 +143,8 @@ type SnapshotterConfig struct {
 	// NOTE: User needs to manually remove the snapshots from containerd's metadata store using
 	//       ctr (e.g. `ctr snapshot rm`).
 	AllowInvalidMountsOnRestart bool `toml:"allow_invalid_mounts_on_restart"`
+
+	// RejectForeignLayers fails the pull of images with foreign or non-distributable layers, e.g.
+	// the base layers of Windows images. By default, they are left to containerd to fetch and unpack.
+	RejectForeignLayers bool `toml:"reject_foreign_layers"`
 }
@@ -0,0 +1,299 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+)
+
+const (
+	// refreshTokenUsername is the username ACR expects refresh tokens with.
+	refreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+	defaultIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+	armResource         = "https://management.azure.com/"
+
+	// Tokens are refreshed this long before they expire.
+	expiryDelta = 5 * time.Minute
+	// defaultRefreshTokenLifetime is how long refresh tokens are used if their expiry can't be read.
+	defaultRefreshTokenLifetime = time.Hour
+	// fetchTimeout bounds the requests for tokens.
+	fetchTimeout = 30 * time.Second
+)
+
+var acrSuffixes = []string{".azurecr.io", ".azurecr.cn", ".azurecr.de", ".azurecr.us"}
+
+type options struct {
+	clientID string
+	tenantID string
+	hosts    []string
+	client   *http.Client
+}
+
+type Option func(*options)
+
+// WithClientID uses the user-assigned managed identity with the client ID `clientID`
+// instead of the system-assigned identity.
+func WithClientID(clientID string) Option {
+	return func(opts *options) {
+		opts.clientID = clientID
+	}
+}
+
+// WithTenantID sets the tenant the access tokens of the managed identity are exchanged in.
+func WithTenantID(tenantID string) Option {
+	return func(opts *options) {
+		opts.tenantID = tenantID
+	}
+}
+
+// WithHosts sets the registries refresh tokens are requested from. By default, they are
+// requested from the registries of Azure Container Registry (e.g. *.azurecr.io).
+func WithHosts(hosts ...string) Option {
+	return func(opts *options) {
+		opts.hosts = append(opts.hosts, hosts...)
+	}
+}
+
+// WithHTTPClient sets the client tokens are requested with.
+func WithHTTPClient(client *http.Client) Option {
+	return func(opts *options) {
+		opts.client = client
+	}
+}
+
+// NewACRKeychain provides a keychain which presents the managed identity of the Azure VM
+// (e.g. of an AKS node) to Azure Container Registry. An access token of the identity is requested
+// from the Instance Metadata Service and exchanged for a refresh token of each registry, which
+// is presented to the registry. Tokens are requested when needed and cached until they expire.
+// Requests for tokens are canceled once ctx is done.
+func NewACRKeychain(ctx context.Context, opts ...Option) (resolver.Credential, error) {
+	return newKeychain(ctx, opts...).credentials, nil
+}
+
+func newKeychain(ctx context.Context, opts ...Option) *keychain {
+	var acrOpts options
+	for _, o := range opts {
+		o(&acrOpts)
+	}
+	kc := &keychain{
+		ctx:           ctx,
+		clientID:      acrOpts.clientID,
+		tenantID:      acrOpts.tenantID,
+		client:        acrOpts.client,
+		imdsTokenURL:  defaultIMDSTokenURL,
+		scheme:        "https",
+		refreshTokens: make(map[string]*token),
+	}
+	if kc.client == nil {
+		kc.client = http.DefaultClient
+	}
+	if len(acrOpts.hosts) > 0 {
+		kc.hosts = make(map[string]bool)
+		for _, h := range acrOpts.hosts {
+			kc.hosts[h] = true
+		}
+	}
+	return kc
+}
+
+type token struct {
+	value  string
+	expiry time.Time
+}
+
+func (t *token) valid() bool {
+	return t != nil && time.Now().Add(expiryDelta).Before(t.expiry)
+}
+
+type keychain struct {
+	ctx          context.Context
+	clientID     string
+	tenantID     string
+	hosts        map[string]bool // nil if refresh tokens are requested from the registries of ACR
+	client       *http.Client
+	imdsTokenURL string
+	scheme       string // of the token exchange endpoints of registries
+
+	mu            sync.Mutex
+	accessToken   *token
+	refreshTokens map[string]*token // registry -> refresh token
+}
+
+func (kc *keychain) credentials(host string, refspec reference.Spec) (string, string, error) {
+	registry := host
+	if !kc.isACRHost(registry) {
+		if registry = refspec.Hostname(); !kc.isACRHost(registry) {
+			return "", "", nil
+		}
+	}
+	refreshToken, err := kc.refreshToken(registry)
+	if err != nil {
+		// Other keychains may still provide credentials for the registry.
+		log.G(kc.ctx).WithError(err).WithField("host", registry).Warn("failed to get refresh token of ACR")
+		return "", "", nil
+	}
+	return refreshTokenUsername, refreshToken, nil
+}
+
+func (kc *keychain) isACRHost(host string) bool {
+	if kc.hosts != nil {
+		return kc.hosts[host]
+	}
+	for _, suffix := range acrSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshToken returns the cached refresh token of the registry, or requests a new one if it's about to expire.
+func (kc *keychain) refreshToken(registry string) (string, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if t := kc.refreshTokens[registry]; t.valid() {
+		return t.value, nil
+	}
+	ctx, cancel := context.WithTimeout(kc.ctx, fetchTimeout)
+	defer cancel()
+	if !kc.accessToken.valid() {
+		t, err := kc.requestAccessToken(ctx)
+		if err != nil {
+			return "", err
+		}
+		kc.accessToken = t
+	}
+	t, err := kc.exchange(ctx, registry, kc.accessToken.value)
+	if err != nil {
+		return "", err
+	}
+	kc.refreshTokens[registry] = t
+	return t.value, nil
+}
+
+// requestAccessToken requests an access token of the managed identity from the Instance Metadata Service.
+func (kc *keychain) requestAccessToken(ctx context.Context) (*token, error) {
+	q := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {armResource},
+	}
+	if kc.clientID != "" {
+		q.Set("client_id", kc.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kc.imdsTokenURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		// ExpiresOn is the expiry in seconds since the epoch, as a string.
+		ExpiresOn string `json:"expires_on"`
+	}
+	if err := kc.do(req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to request access token of managed identity: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, errors.New("no access token in response of managed identity")
+	}
+	expiresOn, err := strconv.ParseInt(resp.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry of access token of managed identity: %w", err)
+	}
+	return &token{value: resp.AccessToken, expiry: time.Unix(expiresOn, 0)}, nil
+}
+
+// exchange exchanges the access token for a refresh token of the registry.
+func (kc *keychain) exchange(ctx context.Context, registry, accessToken string) (*token, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {accessToken},
+	}
+	if kc.tenantID != "" {
+		form.Set("tenant", kc.tenantID)
+	}
+	u := kc.scheme + "://" + registry + "/oauth2/exchange"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := kc.do(req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to exchange access token for refresh token of %s: %w", registry, err)
+	}
+	if resp.RefreshToken == "" {
+		return nil, fmt.Errorf("no refresh token in response of %s", registry)
+	}
+	return &token{value: resp.RefreshToken, expiry: jwtExpiry(resp.RefreshToken)}, nil
+}
+
+func (kc *keychain) do(req *http.Request, v interface{}) error {
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jwtExpiry returns the expiry of the JWT `t`. The JWT isn't verified, since it's only
+// used to know when to refresh it.
+func jwtExpiry(t string) time.Time {
+	defaultExpiry := time.Now().Add(defaultRefreshTokenLifetime)
+	parts := strings.Split(t, ".")
+	if len(parts) != 3 {
+		return defaultExpiry
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return defaultExpiry
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp == 0 {
+		return defaultExpiry
+	}
+	return time.Unix(claims.Exp, 0)
+}
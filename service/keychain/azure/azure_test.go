@@ -0,0 +1,111 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestACRKeychain(t *testing.T) {
+	var imdsRequests, exchanges int
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("client_id") != "client" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		imdsRequests++
+		fmt.Fprintf(w, `{"access_token":"aad","expires_on":"%d"}`, time.Now().Add(time.Hour).Unix())
+	}))
+	defer imds.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.URL.Path != "/oauth2/exchange" ||
+			r.PostForm.Get("access_token") != "aad" || r.PostForm.Get("grant_type") != "access_token" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		exchanges++
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(3*time.Hour).Unix())))
+		fmt.Fprintf(w, `{"refresh_token":"header.%s.sig"}`, claims)
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	kc := newKeychain(context.Background(), WithClientID("client"), WithHosts(host))
+	kc.imdsTokenURL = imds.URL
+	kc.scheme = "http"
+	f := kc.credentials
+
+	refspec, err := reference.Parse(host + "/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		username, secret, err := f(host, refspec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != refreshTokenUsername || !strings.HasPrefix(secret, "header.") {
+			t.Fatalf("unexpected credentials: %q/%q", username, secret)
+		}
+	}
+	if imdsRequests != 1 || exchanges != 1 {
+		t.Fatalf("tokens were not cached; imds requests = %d, exchanges = %d", imdsRequests, exchanges)
+	}
+
+	// Other registries get no credentials.
+	other, err := reference.Parse("registry.example.com/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username, secret, err := f(other.Hostname(), other); err != nil || username != "" || secret != "" {
+		t.Fatalf("unexpected credentials of other registry: %q/%q, %v", username, secret, err)
+	}
+}
+
+func TestACRHosts(t *testing.T) {
+	kc := &keychain{}
+	for host, want := range map[string]bool{
+		"myregistry.azurecr.io": true,
+		"myregistry.azurecr.cn": true,
+		"azurecr.io":            false,
+		"registry.example.com":  false,
+	} {
+		if got := kc.isACRHost(host); got != want {
+			t.Errorf("unexpected result for %s; expected = %v, got = %v", host, want, got)
+		}
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	exp := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+	if got := jwtExpiry("header." + claims + ".sig"); !got.Equal(exp) {
+		t.Fatalf("unexpected expiry; expected = %v, got = %v", exp, got)
+	}
+	if got := jwtExpiry("opaque"); got.After(time.Now().Add(defaultRefreshTokenLifetime)) || got.Before(time.Now()) {
+		t.Fatalf("unexpected default expiry: %v", got)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// accessTokenUsername is the username registries of Google Cloud expect access tokens with.
+	accessTokenUsername = "oauth2accesstoken"
+
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+type options struct {
+	credentialsFile string
+	hosts           []string
+	client          *http.Client
+}
+
+type Option func(*options)
+
+// WithCredentialsFile uses the credentials in the file at `path` (a service account key or the
+// credentials of a user written by `gcloud auth application-default login`) instead of looking
+// for the Application Default Credentials.
+func WithCredentialsFile(path string) Option {
+	return func(opts *options) {
+		opts.credentialsFile = path
+	}
+}
+
+// WithHosts sets the registries access tokens are presented to. By default, they are presented
+// to Artifact Registry (*.pkg.dev) and Container Registry (gcr.io and *.gcr.io).
+func WithHosts(hosts ...string) Option {
+	return func(opts *options) {
+		opts.hosts = append(opts.hosts, hosts...)
+	}
+}
+
+// WithHTTPClient sets the client access tokens are requested with. By default, a retryable
+// client with the default timeouts is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(opts *options) {
+		opts.client = client
+	}
+}
+
+// NewGCPKeychain provides a keychain which presents access tokens of the Application Default
+// Credentials of Google Cloud to Artifact Registry and Container Registry. The credentials are
+// looked up like the Google Cloud client libraries do: in the file at $GOOGLE_APPLICATION_CREDENTIALS,
+// then in the well-known file written by gcloud, then from the metadata server of the instance
+// (e.g. on GCE or GKE). Access tokens are requested when needed and cached until they expire.
+// Requests for access tokens are canceled once ctx is done.
+func NewGCPKeychain(ctx context.Context, opts ...Option) (resolver.Credential, error) {
+	var gcpOpts options
+	for _, o := range opts {
+		o(&gcpOpts)
+	}
+	client := gcpOpts.client
+	if client == nil {
+		client = socihttp.NewRetryableClient(socihttp.NewRetryableClientConfig())
+	}
+	creds, err := findDefaultCredentials(context.WithValue(ctx, oauth2.HTTPClient, client), gcpOpts.credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	kc := &keychain{
+		ctx:    ctx,
+		source: creds.TokenSource,
+	}
+	if len(gcpOpts.hosts) > 0 {
+		kc.hosts = make(map[string]bool)
+		for _, h := range gcpOpts.hosts {
+			kc.hosts[h] = true
+		}
+	}
+	return kc.credentials, nil
+}
+
+type keychain struct {
+	ctx    context.Context
+	source oauth2.TokenSource // caches access tokens until they expire
+	hosts  map[string]bool    // nil if tokens are presented to the registries of Google Cloud
+}
+
+func (kc *keychain) credentials(host string, refspec reference.Spec) (string, string, error) {
+	if !kc.isGoogleHost(host) && !kc.isGoogleHost(refspec.Hostname()) {
+		return "", "", nil
+	}
+	token, err := kc.source.Token()
+	if err != nil {
+		// Other keychains may still provide credentials for the registry.
+		log.G(kc.ctx).WithError(err).WithField("host", host).Warn("failed to get access token of Google Cloud")
+		return "", "", nil
+	}
+	return accessTokenUsername, token.AccessToken, nil
+}
+
+func (kc *keychain) isGoogleHost(host string) bool {
+	if kc.hosts != nil {
+		return kc.hosts[host]
+	}
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, ".pkg.dev")
+}
+
+// findDefaultCredentials returns the Application Default Credentials, or the credentials in
+// `path` if it's set. Access tokens are requested with the client in ctx.
+func findDefaultCredentials(ctx context.Context, path string) (*google.Credentials, error) {
+	if path == "" {
+		return google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, b, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file %q: %w", path, err)
+	}
+	return creds, nil
+}
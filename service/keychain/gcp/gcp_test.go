@@ -0,0 +1,166 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestGCPKeychainServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := verifyJWT(&key.PublicKey, r.PostForm.Get("assertion")); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token%d","token_type":"Bearer","expires_in":3600}`, requests)
+	}))
+	defer srv.Close()
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: mustMarshalPKCS8(t, key)})
+	creds, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "sa@project.iam.gserviceaccount.com",
+		"private_key_id": "key",
+		"private_key":    string(keyPEM),
+		"token_uri":      srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, creds, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kc, err := NewGCPKeychain(context.Background(), WithCredentialsFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"us-docker.pkg.dev/project/repo/image:latest", "gcr.io/project/image:latest"} {
+		checkCreds(t, kc, ref, accessTokenUsername, "token1")
+	}
+	// Other registries get no credentials.
+	checkCreds(t, kc, "registry.example.com/image:latest", "", "")
+	if requests != 1 {
+		t.Fatalf("access token was not cached; requests = %d", requests)
+	}
+}
+
+func TestGCPKeychainMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		// Tokens expiring within the expiry delta of oauth2 are requested again every time.
+		fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":5}`)
+	}))
+	defer srv.Close()
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	kc, err := NewGCPKeychain(context.Background(), WithHosts("registry.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCreds(t, kc, "registry.example.com/image:latest", accessTokenUsername, "token")
+	checkCreds(t, kc, "gcr.io/project/image:latest", "", "")
+
+	// Failures to get access tokens leave the registry to other keychains.
+	srv.Close()
+	checkCreds(t, kc, "registry.example.com/image:latest", "", "")
+}
+
+func checkCreds(t *testing.T, kc func(string, reference.Spec) (string, string, error), ref, wantUsername, wantSecret string) {
+	t.Helper()
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, secret, err := kc(refspec.Hostname(), refspec)
+	if err != nil {
+		t.Fatalf("failed to get credentials of %s: %v", ref, err)
+	}
+	if username != wantUsername || secret != wantSecret {
+		t.Fatalf("unexpected credentials of %s; expected = %q/%q, got = %q/%q", ref, wantUsername, wantSecret, username, secret)
+	}
+}
+
+func mustMarshalPKCS8(t *testing.T, key *rsa.PrivateKey) []byte {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func verifyJWT(key *rsa.PublicKey, jwt string) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return err
+	}
+	if claims["iss"] != "sa@project.iam.gserviceaccount.com" || claims["scope"] != cloudPlatformScope {
+		return fmt.Errorf("unexpected claims: %v", claims)
+	}
+	return nil
+}
@@ -53,9 +53,15 @@ type credentials struct {
 	expiration *time.Time
 }
 
+func (c credentials) expired() bool {
+	return c.expiration != nil && !c.expiration.After(time.Now())
+}
+
 type keychain struct {
 	mu    sync.Mutex
 	cache map[string]credentials
+	// hostCache holds credentials scoped to a registry host rather than to an image.
+	hostCache map[string]credentials
 	proto.UnimplementedLocalKeychainServer
 }
 
@@ -87,34 +93,64 @@ func (kc *keychain) init(port int) {
 }
 
 func (kc *keychain) PutCredentials(ctx context.Context, req *proto.PutCredentialsRequest) (res *proto.PutCredentialsResponse, err error) {
-	if req.ImageName != "" && req.Credentials != nil {
+	if req.Credentials == nil || (req.ImageName == "" && req.Host == "") {
+		return &proto.PutCredentialsResponse{}, nil
+	}
+	var expirationTime *time.Time
+	if req.ExpiresInSeconds > 0 {
+		timeout := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		expirationTime = &timeout
+	}
+	creds := credentials{
+		username:   req.Credentials.Username,
+		password:   req.Credentials.Password,
+		expiration: expirationTime,
+	}
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if req.ImageName != "" {
 		log.G(ctx).Infof("received credentials for image %s, caching for %d seconds", req.ImageName, req.ExpiresInSeconds)
-		var expirationTime *time.Time
-		if req.ExpiresInSeconds > 0 {
-			timeout := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
-			expirationTime = &timeout
-		}
-		kc.mu.Lock()
-		defer kc.mu.Unlock()
-		kc.cache[req.ImageName] = credentials{
-			username:   req.Credentials.Username,
-			password:   req.Credentials.Password,
-			expiration: expirationTime,
-		}
+		kc.cache[req.ImageName] = creds
+	}
+	if req.Host != "" {
+		log.G(ctx).Infof("received credentials for host %s, caching for %d seconds", req.Host, req.ExpiresInSeconds)
+		kc.hostCache[req.Host] = creds
 	}
 	return &proto.PutCredentialsResponse{}, nil
 }
 
+// RemoveCredentials removes the credentials of an image and/or a host, so that
+// future fetches fall back to the other keychains.
+func (kc *keychain) RemoveCredentials(ctx context.Context, req *proto.RemoveCredentialsRequest) (*proto.RemoveCredentialsResponse, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if req.ImageName != "" {
+		log.G(ctx).Infof("removing credentials for image %s", req.ImageName)
+		delete(kc.cache, req.ImageName)
+	}
+	if req.Host != "" {
+		log.G(ctx).Infof("removing credentials for host %s", req.Host)
+		delete(kc.hostCache, req.Host)
+	}
+	return &proto.RemoveCredentialsResponse{}, nil
+}
+
+// GetCredentials returns the credentials of the image, or else the credentials of the host.
+// Credentials are looked up on every call, so updates are used by the next authentication to the registry.
 func (kc *keychain) GetCredentials(host string, refspec reference.Spec) (string, string, error) {
 	kc.mu.Lock()
 	defer kc.mu.Unlock()
-	creds, found := kc.cache[refspec.String()]
-	if found && (creds.expiration == nil || creds.expiration.After(time.Now())) {
+	if creds, found := kc.cache[refspec.String()]; found && !creds.expired() {
 		return creds.username, creds.password, nil
 	} else if found {
 		// Credentials were cached but have expired, remove them.
 		delete(kc.cache, refspec.String())
 	}
+	if creds, found := kc.hostCache[host]; found && !creds.expired() {
+		return creds.username, creds.password, nil
+	} else if found {
+		delete(kc.hostCache, host)
+	}
 	return "", "", nil
 }
 
@@ -123,7 +159,8 @@ func Init(ctx context.Context, port int) *keychain {
 	defer lock.Unlock()
 	if singleton == nil {
 		singleton = &keychain{
-			cache: map[string]credentials{},
+			cache:     map[string]credentials{},
+			hostCache: map[string]credentials{},
 		}
 		singleton.init(port)
 	}
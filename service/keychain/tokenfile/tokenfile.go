@@ -0,0 +1,168 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tokenfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"golang.org/x/sys/unix"
+)
+
+type options struct {
+	username string
+	hosts    []string
+}
+
+type Option func(*options)
+
+// WithUsername presents the token as the password of `username` instead of as an identity token.
+func WithUsername(username string) Option {
+	return func(opts *options) {
+		opts.username = username
+	}
+}
+
+// WithHosts limits the registries the token is presented to. By default, it is presented to all registries.
+func WithHosts(hosts ...string) Option {
+	return func(opts *options) {
+		opts.hosts = append(opts.hosts, hosts...)
+	}
+}
+
+// NewTokenFileKeychain provides a keychain which presents the bearer token in the file at `path`
+// (e.g. a projected service account token) as the credential of registries. The token is
+// an identity token, which registries exchange for their own tokens, unless WithUsername is used.
+//
+// The file is read again whenever its directory changes, so that rotated tokens are used as soon as
+// they are written, including by replacing the file or a symlink to it. The file may not exist yet
+// (but its directory must); the keychain provides no credentials until it does. The file is watched
+// until ctx is done.
+func NewTokenFileKeychain(ctx context.Context, path string, opts ...Option) (resolver.Credential, error) {
+	var tfOpts options
+	for _, o := range opts {
+		o(&tfOpts)
+	}
+	kc := &keychain{
+		path:     path,
+		username: tfOpts.username,
+	}
+	if len(tfOpts.hosts) > 0 {
+		kc.hosts = make(map[string]bool)
+		for _, h := range tfOpts.hosts {
+			kc.hosts[h] = true
+		}
+	}
+	watcher, err := newDirWatcher(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch token file %q: %w", path, err)
+	}
+	kc.reload(ctx)
+	go func() {
+		<-ctx.Done()
+		watcher.Close()
+	}()
+	go func() {
+		for watcher.Wait() == nil {
+			kc.reload(ctx)
+		}
+	}()
+	return kc.credentials, nil
+}
+
+type keychain struct {
+	path     string
+	username string
+	hosts    map[string]bool // nil if the token is presented to all registries
+
+	mu    sync.RWMutex
+	token string
+}
+
+func (kc *keychain) credentials(host string, refspec reference.Spec) (string, string, error) {
+	if kc.hosts != nil && !kc.hosts[host] && !kc.hosts[refspec.Hostname()] {
+		return "", "", nil
+	}
+	kc.mu.RLock()
+	token := kc.token
+	kc.mu.RUnlock()
+	if token == "" {
+		return "", "", nil
+	}
+	return kc.username, token, nil
+}
+
+// reload reads the token from the file. The previous token is kept if the file can't be read,
+// e.g. while it is being replaced.
+func (kc *keychain) reload(ctx context.Context) {
+	b, err := os.ReadFile(kc.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.G(ctx).WithError(err).WithField("path", kc.path).Warn("failed to read token file")
+		}
+		return
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return
+	}
+	kc.mu.Lock()
+	changed := token != kc.token
+	kc.token = token
+	kc.mu.Unlock()
+	if changed {
+		log.G(ctx).WithField("path", kc.path).Debug("loaded token")
+	}
+}
+
+// dirWatcher waits for changes of the entries of a directory with inotify.
+type dirWatcher struct {
+	f *os.File
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	// The non-blocking file descriptor is read through the runtime poller, so that Close interrupts Wait.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	const mask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_ATTRIB
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &dirWatcher{f: os.NewFile(uintptr(fd), "inotify")}, nil
+}
+
+// Wait waits until an entry of the directory changes. It returns an error once the watcher is closed.
+func (w *dirWatcher) Wait() error {
+	// The events aren't needed, since any of them triggers a reload.
+	var buf [4096]byte
+	_, err := w.f.Read(buf[:])
+	return err
+}
+
+func (w *dirWatcher) Close() error {
+	return w.f.Close()
+}
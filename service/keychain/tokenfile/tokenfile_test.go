@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tokenfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/reference"
+)
+
+func TestTokenFileKeychain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	refspec, err := reference.Parse("registry.example.com/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kc, err := NewTokenFileKeychain(ctx, path, WithHosts("registry.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No credentials until the file exists.
+	checkCreds(t, kc, refspec, "", "")
+
+	writeToken := func(token string) {
+		// Tokens are rotated by replacing the file, like kubelet does for projected volumes.
+		tmp := filepath.Join(dir, ".token.tmp")
+		if err := os.WriteFile(tmp, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeToken("token1")
+	waitForCreds(t, kc, refspec, "token1")
+	writeToken("token2")
+	waitForCreds(t, kc, refspec, "token2")
+
+	// The token isn't presented to other registries.
+	other, err := reference.Parse("other.example.com/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCreds(t, kc, other, "", "")
+
+	// The last token is kept while the file is missing.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	checkCreds(t, kc, refspec, "", "token2")
+}
+
+func TestTokenFileKeychainWithUsername(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	refspec, err := reference.Parse("registry.example.com/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc, err := NewTokenFileKeychain(context.Background(), path, WithUsername("oauth2accesstoken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCreds(t, kc, refspec, "oauth2accesstoken", "token")
+}
+
+func checkCreds(t *testing.T, kc resolver.Credential, refspec reference.Spec, wantUsername, wantSecret string) {
+	t.Helper()
+	username, secret, err := kc(refspec.Hostname(), refspec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != wantUsername || secret != wantSecret {
+		t.Fatalf("unexpected credentials of %s; expected = %q:%q, got = %q:%q", refspec.Hostname(), wantUsername, wantSecret, username, secret)
+	}
+}
+
+func waitForCreds(t *testing.T, kc resolver.Credential, refspec reference.Spec, wantSecret string) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if _, secret, _ := kc(refspec.Hostname(), refspec); secret == wantSecret {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkCreds(t, kc, refspec, "", wantSecret)
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// LimitBandwidth returns RegistryHosts whose clients read responses no faster than the
+// bandwidth limits of cfg: the total limit shared by all hosts and the limit of each host.
+// It applies to the hosts of any RegistryHosts, including those configured by hosts.toml
+// files, and so to span fetches as well as SOCI index and zTOC fetches.
+func LimitBandwidth(hosts source.RegistryHosts, cfg Config) source.RegistryHosts {
+	total := socihttp.NewBandwidthLimiter(cfg.MaxBandwidthBytesPerSec)
+	perHost := make(map[string]*socihttp.BandwidthLimiter)
+	for host, hostConfig := range cfg.Host {
+		if l := socihttp.NewBandwidthLimiter(hostConfig.MaxBandwidthBytesPerSec); l != nil {
+			perHost[host] = l
+		}
+	}
+	if total == nil && len(perHost) == 0 {
+		return hosts
+	}
+	return func(ref reference.Spec) ([]docker.RegistryHost, error) {
+		registryHosts, err := hosts(ref)
+		if err != nil {
+			return nil, err
+		}
+		limited := make([]docker.RegistryHost, 0, len(registryHosts))
+		for _, h := range registryHosts {
+			client := http.DefaultClient
+			if h.Client != nil {
+				client = h.Client
+			}
+			inner := client.Transport
+			if inner == nil {
+				inner = http.DefaultTransport
+			}
+			limitedClient := *client
+			limitedClient.Transport = socihttp.NewBandwidthTransport(inner, total, perHost[bandwidthHostKey(h.Host)])
+			h.Client = &limitedClient
+			limited = append(limited, h)
+		}
+		return limited, nil
+	}
+}
+
+// bandwidthHostKey returns the key of the host config of the registry host h.
+func bandwidthHostKey(h string) string {
+	// RegistryHostsFromConfig replaces docker.io with the host actually serving it.
+	if h == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return h
+}
@@ -33,6 +33,10 @@
 package resolver
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/fs/source"
@@ -44,10 +48,67 @@ import (
 // Config is config for resolving registries.
 type Config struct {
 	Host map[string]HostConfig `toml:"host"`
+
+	// TraceHeader is the name of the header carrying the trace ID attached to every registry request,
+	// so that registry-side logs can be correlated with snapshotter-side failures.
+	// Defaults to socihttp.DefaultTraceHeader if empty. "-" disables trace IDs.
+	TraceHeader string `toml:"trace_header"`
+
+	// ConfigPath is a list of directories, separated like PATH, containing the hosts.toml files
+	// of registries in the format of containerd (e.g. /etc/containerd/certs.d), including their
+	// TLS settings. If set, Host is ignored.
+	ConfigPath string `toml:"config_path"`
+
+	// Rewrite rewrites the references of images before they are resolved, e.g. to resolve
+	// the images of a registry through a pull-through cache. The first matching rule applies.
+	Rewrite []RewriteConfig `toml:"rewrite"`
+
+	// MaxBandwidthBytesPerSec limits the total bandwidth used to fetch blobs from all the
+	// registries, so that lazily loading many images at once can't saturate the network of
+	// the node. Zero or less means unlimited. See LimitBandwidth.
+	MaxBandwidthBytesPerSec int64 `toml:"max_bandwidth_bytes_per_sec"`
+
+	// DNSCacheTTLMsec caches the resolved addresses of all registry hosts for this long, so that
+	// slow DNS lookups don't delay the connections of span fetches. Zero disables the cache.
+	// It can be overridden per host with `dns_cache_ttl_msec`.
+	DNSCacheTTLMsec int64 `toml:"dns_cache_ttl_msec"`
+
+	// FallbackDelayMsec is how long the addresses of one address family of dual-stack registry
+	// hosts are dialed before the other family is dialed in parallel ("happy eyeballs").
+	// Defaults to 300. A negative value dials the addresses one after another.
+	// It can be overridden per host with `fallback_delay_msec`.
+	FallbackDelayMsec int64 `toml:"fallback_delay_msec"`
 }
 
 type HostConfig struct {
 	Mirrors []MirrorConfig `toml:"mirrors"`
+
+	// RetryableClientConfigOverride overrides the retry policy and timeouts of requests
+	// to this host. Hosts without a HostConfig use the defaults of socihttp.NewRetryableClientConfig.
+	socihttp.RetryableClientConfigOverride
+
+	// TLS is the TLS configuration of the connections to this host, e.g. the CA of a
+	// self-hosted registry or a client certificate. Hosts without TLS use the system CAs.
+	// It applies to fetching SOCI indices and zTOCs as well as layers.
+	TLS *TLSConfig `toml:"tls"`
+
+	// Signer signs the requests to this host, e.g. with AWS SigV4 for registries backed by
+	// an object store or fronted by a gateway. Hosts without Signer send unsigned requests.
+	Signer *SignerConfig `toml:"signer"`
+
+	// MaxBandwidthBytesPerSec limits the bandwidth used to fetch blobs from this host,
+	// in addition to Config.MaxBandwidthBytesPerSec. Zero or less means unlimited.
+	MaxBandwidthBytesPerSec int64 `toml:"max_bandwidth_bytes_per_sec"`
+
+	// IndexRequired makes the images of this host fail to pull if their SOCI index can't be found
+	// or verified, instead of being unpacked locally. It applies to the hosts the references of
+	// images are rewritten from and to, and also if ConfigPath is set.
+	IndexRequired bool `toml:"index_required"`
+}
+
+// IndexRequired returns whether the images of `ref` must be lazily loaded with a verified SOCI index.
+func (cfg Config) IndexRequired(ref reference.Spec) bool {
+	return cfg.Host[ref.Hostname()].IndexRequired
 }
 
 type MirrorConfig struct {
@@ -68,19 +129,31 @@ type Credential func(string, reference.Spec) (string, string, error)
 
 // RegistryHostsFromConfig creates RegistryHosts (a set of registry configuration) from Config.
 func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.RegistryHosts {
+	if cfg.ConfigPath != "" {
+		return RegistryHostsFromCRIConfig(context.Background(), Registry{ConfigPath: cfg.ConfigPath}, credsFuncs...)
+	}
+	// Clients are shared by all the refs of a host, so that their connections are pooled
+	// instead of each layer opening its own.
+	var (
+		clientsMu sync.Mutex
+		clients   = make(map[MirrorConfig]*http.Client)
+	)
 	return func(ref reference.Spec) (hosts []docker.RegistryHost, _ error) {
 		host := ref.Hostname()
 		for _, h := range append(cfg.Host[host].Mirrors, MirrorConfig{
 			Host: host,
 		}) {
-			clientConfig := socihttp.NewRetryableClientConfig()
-			if h.RequestTimeoutSec < 0 {
-				clientConfig.RequestTimeout = 0
-			}
-			if h.RequestTimeoutSec > 0 {
-				clientConfig.RequestTimeout = time.Duration(h.RequestTimeoutSec) * time.Second
+			clientsMu.Lock()
+			client, ok := clients[h]
+			if !ok {
+				var err error
+				if client, err = newHostClient(cfg, h); err != nil {
+					clientsMu.Unlock()
+					return nil, err
+				}
+				clients[h] = client
 			}
-			client := socihttp.NewRetryableClient(clientConfig)
+			clientsMu.Unlock()
 			config := docker.RegistryHost{
 				Client:       client,
 				Host:         h.Host,
@@ -103,6 +176,39 @@ func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.Regist
 	}
 }
 
+// newHostClient creates the client of the host or mirror h.
+func newHostClient(cfg Config, h MirrorConfig) (*http.Client, error) {
+	clientConfig := socihttp.RetryableClientConfigOverride{
+		DNSCacheTTLMsec:   cfg.DNSCacheTTLMsec,
+		FallbackDelayMsec: cfg.FallbackDelayMsec,
+	}.Apply(socihttp.NewRetryableClientConfig())
+	clientConfig = cfg.Host[h.Host].Apply(clientConfig)
+	if cfg.TraceHeader == "-" {
+		clientConfig.TraceConfig.Header = ""
+	} else if cfg.TraceHeader != "" {
+		clientConfig.TraceConfig.Header = cfg.TraceHeader
+	}
+	if h.RequestTimeoutSec < 0 {
+		clientConfig.RequestTimeout = 0
+	}
+	if h.RequestTimeoutSec > 0 {
+		clientConfig.RequestTimeout = time.Duration(h.RequestTimeoutSec) * time.Second
+	}
+	if tlsConfig := cfg.Host[h.Host].TLS; tlsConfig != nil {
+		var err error
+		if clientConfig.TLSClientConfig, err = getTLSConfig(*tlsConfig); err != nil {
+			return nil, fmt.Errorf("get TLSConfig for registry %q: %w", h.Host, err)
+		}
+	}
+	if signerConfig := cfg.Host[h.Host].Signer; signerConfig != nil {
+		var err error
+		if clientConfig.Signer, err = newSigner(*signerConfig); err != nil {
+			return nil, fmt.Errorf("create signer for registry %q: %w", h.Host, err)
+		}
+	}
+	return socihttp.NewRetryableClient(clientConfig), nil
+}
+
 func multiCredsFuncs(ref reference.Spec, credsFuncs ...Credential) func(string) (string, string, error) {
 	return func(host string) (string, string, error) {
 		for _, f := range credsFuncs {
@@ -0,0 +1,245 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+	"github.com/containerd/containerd/reference"
+)
+
+func TestRegistryHostsFromConfigTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	refspec, err := reference.Parse(u.Host + "/test/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noRetries := socihttp.RetryableClientConfigOverride{MaxRetries: -1}
+
+	tests := []struct {
+		name    string
+		tls     *TLSConfig
+		wantErr bool
+	}{
+		{name: "system CAs", wantErr: true},
+		{name: "custom CA", tls: &TLSConfig{CAFile: caFile}},
+		{name: "skip verify", tls: &TLSConfig{InsecureSkipVerify: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := RegistryHostsFromConfig(Config{
+				Host: map[string]HostConfig{
+					u.Host: {RetryableClientConfigOverride: noRetries, TLS: tt.tls},
+				},
+			})(refspec)
+			if err != nil {
+				t.Fatalf("failed to configure hosts: %v", err)
+			}
+			// The test server listens on localhost, which is served over plain HTTP by default,
+			// so the request is sent to its URL directly.
+			resp, err := hosts[len(hosts)-1].Client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected result of request; want error = %v, got = %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRegistryHostsFromConfigInvalidTLS(t *testing.T) {
+	refspec, err := reference.Parse("example.com/test/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RegistryHostsFromConfig(Config{
+		Host: map[string]HostConfig{
+			"example.com": {TLS: &TLSConfig{CertFile: "client.pem"}},
+		},
+	})(refspec)
+	if err == nil {
+		t.Fatalf("a client certificate without a key should be rejected")
+	}
+}
+
+func TestRegistryHostsFromConfigPath(t *testing.T) {
+	configPath := t.TempDir()
+	hostDir := filepath.Join(configPath, "example.com")
+	if err := os.Mkdir(hostDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	hostsToml := `server = "https://example.com"
+
+[host."https://mirror.example.com"]
+  capabilities = ["pull", "resolve"]
+  skip_verify = true
+`
+	if err := os.WriteFile(filepath.Join(hostDir, "hosts.toml"), []byte(hostsToml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	refspec, err := reference.Parse("example.com/test/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := RegistryHostsFromConfig(Config{ConfigPath: configPath})(refspec)
+	if err != nil {
+		t.Fatalf("failed to configure hosts: %v", err)
+	}
+	if len(hosts) != 2 || hosts[0].Host != "mirror.example.com" || hosts[1].Host != "example.com" {
+		t.Fatalf("unexpected hosts: %+v", hosts)
+	}
+	tr, ok := hosts[0].Client.Transport.(*http.Transport)
+	if !ok || tr.TLSClientConfig == nil || !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Fatalf("the TLS settings of hosts.toml were not applied to the mirror")
+	}
+}
+
+func TestRegistryHostsFromConfigSharesClients(t *testing.T) {
+	registryHosts := RegistryHostsFromConfig(Config{
+		Host: map[string]HostConfig{
+			"example.com": {Mirrors: []MirrorConfig{{Host: "mirror.example.com"}}},
+		},
+	})
+	var clients []*http.Client
+	for _, ref := range []string{"example.com/app1:latest", "example.com/app2:latest"} {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts, err := registryHosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to configure hosts: %v", err)
+		}
+		if len(hosts) != 2 {
+			t.Fatalf("unexpected number of hosts; expected = 2, got = %d", len(hosts))
+		}
+		clients = append(clients, hosts[0].Client, hosts[1].Client)
+	}
+	if clients[0] == clients[1] {
+		t.Fatalf("the mirror and the registry should not share a client")
+	}
+	if clients[0] != clients[2] || clients[1] != clients[3] {
+		t.Fatalf("the refs of a host should share its client")
+	}
+}
+
+func TestRegistryHostsFromConfigSigner(t *testing.T) {
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Test-Signature")
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterSigner("test", func(options map[string]string) (socihttp.Signer, error) {
+		return socihttp.SignerFunc(func(req *http.Request) error {
+			req.Header.Set("X-Test-Signature", options["value"])
+			return nil
+		}), nil
+	})
+	refspec, err := reference.Parse(u.Host + "/test/image:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := RegistryHostsFromConfig(Config{
+		Host: map[string]HostConfig{
+			u.Host: {Signer: &SignerConfig{Type: "test", Options: map[string]string{"value": "signed"}}},
+		},
+	})(refspec)
+	if err != nil {
+		t.Fatalf("failed to configure hosts: %v", err)
+	}
+	resp, err := hosts[0].Client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if signature != "signed" {
+		t.Fatalf("unexpected signature; expected = %q, got = %q", "signed", signature)
+	}
+
+	_, err = RegistryHostsFromConfig(Config{
+		Host: map[string]HostConfig{
+			u.Host: {Signer: &SignerConfig{Type: "unknown"}},
+		},
+	})(refspec)
+	if err == nil {
+		t.Fatal("expected an error for an unknown signer type")
+	}
+}
+
+func TestLimitBandwidth(t *testing.T) {
+	cfg := Config{
+		Host: map[string]HostConfig{
+			"example.com": {Mirrors: []MirrorConfig{{Host: "mirror.example.com"}}, MaxBandwidthBytesPerSec: 1 << 20},
+		},
+	}
+	registryHosts := RegistryHostsFromConfig(cfg)
+	refspec, err := reference.Parse("example.com/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlimited, err := registryHosts(refspec)
+	if err != nil {
+		t.Fatalf("failed to configure hosts: %v", err)
+	}
+
+	// Only the host with a limit is limited as long as there is no total limit.
+	hosts, err := LimitBandwidth(registryHosts, cfg)(refspec)
+	if err != nil {
+		t.Fatalf("failed to configure hosts: %v", err)
+	}
+	if hosts[0].Client.Transport != unlimited[0].Client.Transport {
+		t.Fatalf("the mirror should not be limited")
+	}
+	if hosts[1].Client.Transport == unlimited[1].Client.Transport {
+		t.Fatalf("the registry should be limited")
+	}
+	if again, _ := registryHosts(refspec); again[1].Client != unlimited[1].Client || again[1].Client.Transport != unlimited[1].Client.Transport {
+		t.Fatalf("the shared client of the registry should not be modified")
+	}
+
+	cfg.MaxBandwidthBytesPerSec = 1 << 20
+	hosts, err = LimitBandwidth(registryHosts, cfg)(refspec)
+	if err != nil {
+		t.Fatalf("failed to configure hosts: %v", err)
+	}
+	if hosts[0].Client.Transport == unlimited[0].Client.Transport {
+		t.Fatalf("the mirror should be limited by the total limit")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+)
+
+// RewriteConfig is a rule rewriting image references, which are normalized by containerd
+// (e.g. docker.io/library/ubuntu:latest). A rule has either a Prefix or a Regex.
+type RewriteConfig struct {
+	// Prefix matches the references starting with it. It is replaced by Replace,
+	// e.g. "docker.io/" with "registry.internal/docker-hub/".
+	Prefix string `toml:"prefix"`
+	// Regex matches the references it matches entirely. The references are replaced by
+	// Replace, in which $1 or ${name} refer to the submatches of the regex.
+	Regex string `toml:"regex"`
+	// Replace is the replacement of the matched prefix or reference.
+	Replace string `toml:"replace"`
+}
+
+// RefRewriterFromConfig creates a source.RefRewriter applying the first of the rules which matches
+// a reference. It returns nil if there are no rules.
+func RefRewriterFromConfig(rules []RewriteConfig) (source.RefRewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	rewrites := make([]func(string) (string, bool), 0, len(rules))
+	for i, rule := range rules {
+		switch {
+		case rule.Prefix != "" && rule.Regex != "":
+			return nil, fmt.Errorf("rewrite rule %d has both a prefix and a regex", i)
+		case rule.Prefix != "":
+			prefix, replace := rule.Prefix, rule.Replace
+			rewrites = append(rewrites, func(ref string) (string, bool) {
+				if !strings.HasPrefix(ref, prefix) {
+					return ref, false
+				}
+				return replace + strings.TrimPrefix(ref, prefix), true
+			})
+		case rule.Regex != "":
+			re, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex of rewrite rule %d: %w", i, err)
+			}
+			replace := rule.Replace
+			rewrites = append(rewrites, func(ref string) (string, bool) {
+				if !re.MatchString(ref) {
+					return ref, false
+				}
+				return re.ReplaceAllString(ref, replace), true
+			})
+		default:
+			return nil, fmt.Errorf("rewrite rule %d has neither a prefix nor a regex", i)
+		}
+	}
+	return func(ref string) string {
+		for _, rewrite := range rewrites {
+			if rewritten, ok := rewrite(ref); ok {
+				return rewritten
+			}
+		}
+		return ref
+	}, nil
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"testing"
+)
+
+func TestRefRewriterFromConfig(t *testing.T) {
+	rules := []RewriteConfig{
+		{Prefix: "docker.io/", Replace: "registry.internal/docker-hub/"},
+		{Regex: `ghcr\.io/(?P<org>[^/]+)/(.*)`, Replace: "registry.internal/ghcr/${org}-$2"},
+		{Prefix: "ghcr.io/", Replace: "unused.internal/"},
+	}
+	rewrite, err := RefRewriterFromConfig(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "docker.io/library/ubuntu:latest", want: "registry.internal/docker-hub/library/ubuntu:latest"},
+		{ref: "ghcr.io/org/image@sha256:abc", want: "registry.internal/ghcr/org-image@sha256:abc"},
+		// Regexes match entire references.
+		{ref: "mirror.ghcr.io/org/image:latest", want: "mirror.ghcr.io/org/image:latest"},
+		{ref: "public.ecr.aws/docker.io/image:latest", want: "public.ecr.aws/docker.io/image:latest"},
+	}
+	for _, tt := range tests {
+		if got := rewrite(tt.ref); got != tt.want {
+			t.Errorf("unexpected rewrite of %q; expected = %q, got = %q", tt.ref, tt.want, got)
+		}
+	}
+}
+
+func TestRefRewriterFromConfigInvalid(t *testing.T) {
+	for name, rule := range map[string]RewriteConfig{
+		"no match":      {Replace: "registry.internal/"},
+		"both matches":  {Prefix: "docker.io/", Regex: "docker.io/.*", Replace: "registry.internal/"},
+		"invalid regex": {Regex: "docker.io/(", Replace: "registry.internal/"},
+	} {
+		if _, err := RefRewriterFromConfig([]RewriteConfig{rule}); err == nil {
+			t.Errorf("%s: expected error, but got nil", name)
+		}
+	}
+	if rewrite, err := RefRewriterFromConfig(nil); err != nil || rewrite != nil {
+		t.Fatalf("unexpected rewriter without rules: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	socihttp "github.com/awslabs/soci-snapshotter/util/http"
+)
+
+const (
+	// SignerTypeSigV4 signs requests with AWS Signature Version 4. Its options are
+	// `region`, `service` (default "s3") and optionally `access_key_id`, `secret_access_key`
+	// and `session_token`, which default to the AWS_* environment variables of the snapshotter.
+	SignerTypeSigV4 = "sigv4"
+	// SignerTypeHMAC signs requests with an HMAC-SHA256 of a shared secret (see socihttp.HMACSigner).
+	// Its options are `key_id`, `secret_file`, the file holding the secret, and optionally `header`.
+	SignerTypeHMAC = "hmac"
+)
+
+// SignerConfig is the config of the signer of the requests to a host.
+type SignerConfig struct {
+	// Type is the type of the signer: SignerTypeSigV4, SignerTypeHMAC or a type added with RegisterSigner.
+	Type string `toml:"type"`
+	// Options are the options of the signer, which depend on its type.
+	Options map[string]string `toml:"options"`
+}
+
+// SignerFactory creates a signer from the options of its SignerConfig.
+type SignerFactory func(options map[string]string) (socihttp.Signer, error)
+
+var (
+	signersMu sync.RWMutex
+	signers   = map[string]SignerFactory{
+		SignerTypeSigV4: newSigV4Signer,
+		SignerTypeHMAC:  newHMACSigner,
+	}
+)
+
+// RegisterSigner adds the signer type `typ`, so that hosts can be configured to sign
+// their requests with the signers created by `factory`. It replaces any previous factory of `typ`.
+func RegisterSigner(typ string, factory SignerFactory) {
+	signersMu.Lock()
+	signers[typ] = factory
+	signersMu.Unlock()
+}
+
+// newSigner creates the signer configured by cfg.
+func newSigner(cfg SignerConfig) (socihttp.Signer, error) {
+	signersMu.RLock()
+	factory, ok := signers[cfg.Type]
+	signersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signer type %q", cfg.Type)
+	}
+	return factory(cfg.Options)
+}
+
+func newSigV4Signer(options map[string]string) (socihttp.Signer, error) {
+	option := func(name, env string) string {
+		if v := options[name]; v != "" {
+			return v
+		}
+		return os.Getenv(env)
+	}
+	s := &socihttp.SigV4Signer{
+		Region:          option("region", "AWS_REGION"),
+		Service:         options["service"],
+		AccessKeyID:     option("access_key_id", "AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: option("secret_access_key", "AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    option("session_token", "AWS_SESSION_TOKEN"),
+	}
+	if s.Service == "" {
+		s.Service = "s3"
+	}
+	if s.Region == "" {
+		return nil, fmt.Errorf("%s signer requires a region", SignerTypeSigV4)
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return nil, fmt.Errorf("%s signer requires AWS credentials", SignerTypeSigV4)
+	}
+	return s, nil
+}
+
+func newHMACSigner(options map[string]string) (socihttp.Signer, error) {
+	if options["key_id"] == "" || options["secret_file"] == "" {
+		return nil, fmt.Errorf("%s signer requires a key_id and a secret_file", SignerTypeHMAC)
+	}
+	secret, err := os.ReadFile(options["secret_file"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HMAC secret: %w", err)
+	}
+	return &socihttp.HMACSigner{
+		KeyID:  options["key_id"],
+		Secret: []byte(strings.TrimSpace(string(secret))),
+		Header: options["header"],
+	}, nil
+}
@@ -34,13 +34,18 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 
 	socifs "github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/chaos"
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 	snbase "github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
@@ -52,6 +57,15 @@ type options struct {
 	credsFuncs    []resolver.Credential
 	registryHosts source.RegistryHosts
 	fsOpts        []socifs.Option
+	snOpts        []snbase.Opt
+	unpacker      *containerdServices
+}
+
+// containerdServices are the services of containerd layers are unpacked with.
+type containerdServices struct {
+	ingester content.Ingester
+	applier  diff.Applier
+	leases   leases.Manager
 }
 
 // WithCredsFuncs specifies credsFuncs to be used for connecting to the registries.
@@ -75,6 +89,22 @@ func WithFilesystemOptions(opts ...socifs.Option) Option {
 	}
 }
 
+// WithSnapshotterOptions passes options to the snapshotter, after the ones of the config.
+func WithSnapshotterOptions(opts ...snbase.Opt) Option {
+	return func(o *options) {
+		o.snOpts = append(o.snOpts, opts...)
+	}
+}
+
+// WithContainerdUnpack makes the snapshotter fetch the layers it can neither mount lazily nor unpack
+// itself into the content store of containerd with `ingester`, and apply them with the diff service
+// of containerd, `applier`, under leases of `lm` (see snapshot.NewContainerdUnpacker).
+func WithContainerdUnpack(ingester content.Ingester, applier diff.Applier, lm leases.Manager) Option {
+	return func(o *options) {
+		o.unpacker = &containerdServices{ingester: ingester, applier: applier, leases: lm}
+	}
+}
+
 // NewSociSnapshotterService returns soci snapshotter.
 func NewSociSnapshotterService(ctx context.Context, root string, config *Config, opts ...Option) (snapshots.Snapshotter, error) {
 	var sOpts options
@@ -87,6 +117,15 @@ func NewSociSnapshotterService(ctx context.Context, root string, config *Config,
 		// Use RegistryHosts based on ResolverConfig and keychain
 		hosts = resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...)
 	}
+	hosts = resolver.LimitBandwidth(hosts, resolver.Config(config.ResolverConfig))
+	faults, err := chaos.New(config.Config.FaultInjectionConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fault injection config: %w", err)
+	}
+	if faults != nil {
+		log.G(ctx).Warn("fault injection is enabled: requests to registries and FUSE operations fail on purpose, never use it in production")
+		hosts = faults.RegistryHosts(hosts)
+	}
 	userxattr, err := overlayutils.NeedsUserXAttr(snapshotterRoot(root))
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
@@ -95,10 +134,15 @@ func NewSociSnapshotterService(ctx context.Context, root string, config *Config,
 	if userxattr {
 		opq = layer.OverlayOpaqueUser
 	}
+	rewriteRef, err := resolver.RefRewriterFromConfig(config.ResolverConfig.Rewrite)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite rules of image references: %w", err)
+	}
 	// Configure filesystem and snapshotter
 	fsOpts := append(sOpts.fsOpts, socifs.WithGetSources(
 		source.FromDefaultLabels(hosts), // provides source info based on default labels
-	), socifs.WithOverlayOpaqueType(opq))
+	), socifs.WithRegistryHosts(hosts), socifs.WithOverlayOpaqueType(opq), socifs.WithRefRewriter(rewriteRef),
+		socifs.WithIndexRequired(resolver.Config(config.ResolverConfig).IndexRequired))
 	fs, _, err := socifs.NewFilesystem(ctx, fsRoot(root), config.Config, fsOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
@@ -113,7 +157,14 @@ func NewSociSnapshotterService(ctx context.Context, root string, config *Config,
 	if config.SnapshotterConfig.AllowInvalidMountsOnRestart {
 		snOpts = append(snOpts, snbase.AllowInvalidMountsOnRestart)
 	}
+	if config.SnapshotterConfig.RejectForeignLayers {
+		snOpts = append(snOpts, snbase.RejectForeignLayers)
+	}
 
+	if u := sOpts.unpacker; u != nil {
+		snOpts = append(snOpts, snbase.WithFallbackUnpacker(snbase.NewContainerdUnpacker(u.ingester, u.applier, u.leases, hosts)))
+	}
+	snOpts = append(snOpts, sOpts.snOpts...)
 	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to create new snapshotter")
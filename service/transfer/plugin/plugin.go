@@ -0,0 +1,182 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package plugin registers the soci transfer plugin, which replaces containerd's local transfer
+// plugin so that the images pulled with the transfer service are lazily loaded by the soci
+// snapshotter. Transfer plugins can't be proxied, so this package is built into containerd,
+// separately from the snapshotter.
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/service/transfer"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/pkg/transfer/local"
+	"github.com/containerd/containerd/pkg/unpack"
+	"github.com/containerd/containerd/platforms"
+	ctdplugin "github.com/containerd/containerd/plugin"
+
+	// Load packages with type registrations
+	_ "github.com/containerd/containerd/pkg/transfer/archive"
+	_ "github.com/containerd/containerd/pkg/transfer/image"
+	_ "github.com/containerd/containerd/pkg/transfer/registry"
+)
+
+// TransferConfig represents configuration for the soci transfer plugin. It is the configuration
+// of containerd's local transfer plugin, which the soci transfer plugin replaces.
+type TransferConfig struct {
+	// MaxConcurrentDownloads is the max concurrent content downloads for pull.
+	MaxConcurrentDownloads int `toml:"max_concurrent_downloads"`
+
+	// MaxConcurrentUploadedLayers is the max concurrent uploads for push
+	MaxConcurrentUploadedLayers int `toml:"max_concurrent_uploaded_layers"`
+
+	// UnpackConfiguration is the platforms and snapshotters images are unpacked for.
+	// It defaults to the soci snapshotter for the host platform.
+	UnpackConfiguration []UnpackConfiguration `toml:"unpack_config"`
+
+	// RegistryConfigPath is a path to the root directory containing registry-specific configurations
+	RegistryConfigPath string `toml:"config_path"`
+}
+
+// UnpackConfiguration is a platform and the snapshotter images of it are unpacked with.
+type UnpackConfiguration struct {
+	// Platform is the target unpack platform to match
+	Platform string `toml:"platform"`
+
+	// Snapshotter is the snapshotter to use to unpack
+	Snapshotter string `toml:"snapshotter"`
+
+	// Differ is the diff plugin to be used for apply
+	Differ string `toml:"differ"`
+}
+
+func init() {
+	ctdplugin.Register(&ctdplugin.Registration{
+		Type: ctdplugin.TransferPlugin,
+		ID:   "soci",
+		Requires: []ctdplugin.Type{
+			ctdplugin.LeasePlugin,
+			ctdplugin.MetadataPlugin,
+			ctdplugin.DiffPlugin,
+		},
+		Config: &TransferConfig{
+			MaxConcurrentDownloads:      3,
+			MaxConcurrentUploadedLayers: 3,
+			UnpackConfiguration: []UnpackConfiguration{
+				{
+					Platform:    platforms.Format(platforms.DefaultSpec()),
+					Snapshotter: "soci",
+				},
+			},
+		},
+		InitFn: func(ic *ctdplugin.InitContext) (interface{}, error) {
+			config, ok := ic.Config.(*TransferConfig)
+			if !ok {
+				return nil, fmt.Errorf("invalid soci transfer configuration")
+			}
+			m, err := ic.Get(ctdplugin.MetadataPlugin)
+			if err != nil {
+				return nil, err
+			}
+			ms := m.(*metadata.DB)
+			l, err := ic.Get(ctdplugin.LeasePlugin)
+			if err != nil {
+				return nil, err
+			}
+
+			lc := local.TransferConfig{
+				MaxConcurrentDownloads:      config.MaxConcurrentDownloads,
+				MaxConcurrentUploadedLayers: config.MaxConcurrentUploadedLayers,
+				RegistryConfigPath:          config.RegistryConfigPath,
+			}
+			for _, uc := range config.UnpackConfiguration {
+				up, err := unpackPlatform(ic, ms, uc)
+				if err != nil {
+					return nil, err
+				}
+				lc.UnpackPlatforms = append(lc.UnpackPlatforms, up)
+			}
+			return transfer.NewTransferrer(local.NewTransferService(l.(leases.Manager), ms.ContentStore(), metadata.NewImageStore(ms), &lc)), nil
+		},
+	})
+}
+
+// unpackPlatform returns the platform to unpack images for, with its snapshotter and differ,
+// as containerd's local transfer plugin does.
+func unpackPlatform(ic *ctdplugin.InitContext, ms *metadata.DB, uc UnpackConfiguration) (unpack.Platform, error) {
+	p, err := platforms.Parse(uc.Platform)
+	if err != nil {
+		return unpack.Platform{}, fmt.Errorf("%s: platform configuration %v invalid", ctdplugin.TransferPlugin, uc.Platform)
+	}
+	sn := ms.Snapshotter(uc.Snapshotter)
+	if sn == nil {
+		return unpack.Platform{}, fmt.Errorf("snapshotter %q not found: %w", uc.Snapshotter, errdefs.ErrNotFound)
+	}
+	diffPlugins, err := ic.GetByType(ctdplugin.DiffPlugin)
+	if err != nil {
+		return unpack.Platform{}, fmt.Errorf("error loading diff plugins: %w", err)
+	}
+
+	var applier diff.Applier
+	target := platforms.OnlyStrict(p)
+	if uc.Differ != "" {
+		plugin, ok := diffPlugins[uc.Differ]
+		if !ok {
+			return unpack.Platform{}, fmt.Errorf("diff plugin %q: %w", uc.Differ, errdefs.ErrNotFound)
+		}
+		inst, err := plugin.Instance()
+		if err != nil {
+			return unpack.Platform{}, fmt.Errorf("failed to get instance for diff plugin %q: %w", uc.Differ, err)
+		}
+		applier = inst.(diff.Applier)
+	} else {
+		for name, plugin := range diffPlugins {
+			var matched bool
+			for _, p := range plugin.Meta.Platforms {
+				if target.Match(p) {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+			if applier != nil {
+				log.G(ic.Context).Warnf("multiple differs match for platform, set `differ` option to choose, skipping %q", name)
+				continue
+			}
+			inst, err := plugin.Instance()
+			if err != nil {
+				return unpack.Platform{}, fmt.Errorf("failed to get instance for diff plugin %q: %w", name, err)
+			}
+			applier = inst.(diff.Applier)
+		}
+	}
+	if applier == nil {
+		return unpack.Platform{}, fmt.Errorf("no matching diff plugins: %w", errdefs.ErrNotFound)
+	}
+	return unpack.Platform{
+		Platform:       target,
+		SnapshotterKey: uc.Snapshotter,
+		Snapshotter:    sn,
+		Applier:        applier,
+	}, nil
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package transfer makes the transfer service of containerd pull images for the soci snapshotter:
+// it wraps a transferrer, e.g. containerd's local transfer service, so that the layers of the
+// images it pulls are labeled like `soci image rpull` labels them, which lets the snapshotter
+// mount them lazily with the SOCI index it discovers for the image.
+package transfer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	ctdtransfer "github.com/containerd/containerd/pkg/transfer"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type transferrer struct {
+	next ctdtransfer.Transferrer
+}
+
+// NewTransferrer returns a transferrer which labels the layers of the images pulled by `next`
+// for the soci snapshotter. Other transfers, e.g. pushes and imports, are left to `next` as is.
+func NewTransferrer(next ctdtransfer.Transferrer) ctdtransfer.Transferrer {
+	return &transferrer{next: next}
+}
+
+func (t *transferrer) Transfer(ctx context.Context, src interface{}, dst interface{}, opts ...ctdtransfer.Opt) error {
+	fetcher, ok := src.(ctdtransfer.ImageFetcher)
+	if !ok {
+		return t.next.Transfer(ctx, src, dst, opts...)
+	}
+	storer, ok := dst.(ctdtransfer.ImageStorer)
+	if !ok {
+		return t.next.Transfer(ctx, src, dst, opts...)
+	}
+	s := &pullSource{ImageFetcher: fetcher}
+	return t.next.Transfer(ctx, s, &pullDestination{ImageStorer: storer, src: s}, opts...)
+}
+
+// pullSource records the name of the image resolved by a pull.
+type pullSource struct {
+	ctdtransfer.ImageFetcher
+	name string
+}
+
+func (s *pullSource) Resolve(ctx context.Context) (string, ocispec.Descriptor, error) {
+	name, desc, err := s.ImageFetcher.Resolve(ctx)
+	if err == nil {
+		s.name = name
+	}
+	return name, desc, err
+}
+
+func (s *pullSource) String() string {
+	return fmt.Sprint(s.ImageFetcher)
+}
+
+// pullDestination labels the layers of the image pulled from src, which is resolved before the
+// children of its manifests are walked.
+type pullDestination struct {
+	ctdtransfer.ImageStorer
+	src *pullSource
+}
+
+func (d *pullDestination) ImageFilter(h images.HandlerFunc, cs content.Store) images.HandlerFunc {
+	if f, ok := d.ImageStorer.(ctdtransfer.ImageFilterer); ok {
+		h = f.ImageFilter(h, cs)
+	}
+	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		// The index digest is left empty, so that the snapshotter discovers the index of the image.
+		wrapper := source.AppendDefaultLabelsHandlerWrapper("", ctdsnapshotters.AppendInfoHandlerWrapper(d.src.name))
+		return wrapper(h).Handle(ctx, desc)
+	}
+}
+
+func (d *pullDestination) UnpackPlatforms() []ctdtransfer.UnpackConfiguration {
+	if u, ok := d.ImageStorer.(ctdtransfer.ImageUnpacker); ok {
+		return u.UnpackPlatforms()
+	}
+	return nil
+}
+
+func (d *pullDestination) String() string {
+	return fmt.Sprint(d.ImageStorer)
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transfer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	ctdtransfer "github.com/containerd/containerd/pkg/transfer"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type recordingTransferrer struct {
+	src, dst interface{}
+}
+
+func (t *recordingTransferrer) Transfer(ctx context.Context, src interface{}, dst interface{}, opts ...ctdtransfer.Opt) error {
+	t.src, t.dst = src, dst
+	return nil
+}
+
+type testFetcher struct {
+	name string
+	desc ocispec.Descriptor
+}
+
+func (f *testFetcher) Resolve(context.Context) (string, ocispec.Descriptor, error) {
+	return f.name, f.desc, nil
+}
+
+func (f *testFetcher) Fetcher(context.Context, string) (ctdtransfer.Fetcher, error) {
+	return nil, nil
+}
+
+type testStorer struct {
+	unpacks []ctdtransfer.UnpackConfiguration
+}
+
+func (s *testStorer) Store(context.Context, ocispec.Descriptor, images.Store) ([]images.Image, error) {
+	return nil, nil
+}
+
+func (s *testStorer) UnpackPlatforms() []ctdtransfer.UnpackConfiguration {
+	return s.unpacks
+}
+
+func TestTransferLabelsPulledLayers(t *testing.T) {
+	ctx := context.Background()
+	manifest := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("manifest")}
+	layers := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("config"), Size: 10},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer1"), Size: 100},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer2"), Size: 200},
+	}
+	children := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		return append([]ocispec.Descriptor(nil), layers...), nil
+	})
+
+	next := &recordingTransferrer{}
+	storer := &testStorer{unpacks: []ctdtransfer.UnpackConfiguration{{Snapshotter: "soci"}}}
+	if err := NewTransferrer(next).Transfer(ctx, &testFetcher{name: "example.com/image:latest", desc: manifest}, storer); err != nil {
+		t.Fatal(err)
+	}
+	src, ok := next.src.(ctdtransfer.ImageFetcher)
+	if !ok {
+		t.Fatalf("source of pull is a %T, not an image fetcher", next.src)
+	}
+	dst, ok := next.dst.(interface {
+		ctdtransfer.ImageStorer
+		ctdtransfer.ImageFilterer
+		ctdtransfer.ImageUnpacker
+	})
+	if !ok {
+		t.Fatalf("destination of pull is a %T, not a filtering image unpacker", next.dst)
+	}
+	if got := dst.UnpackPlatforms(); len(got) != 1 || got[0].Snapshotter != "soci" {
+		t.Fatalf("unexpected unpack platforms %v", got)
+	}
+
+	name, _, err := src.Resolve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cs content.Store
+	got, err := dst.ImageFilter(children, cs)(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(layers) {
+		t.Fatalf("got %d children, expected %d", len(got), len(layers))
+	}
+	if len(got[0].Annotations) != 0 {
+		t.Fatalf("config was labeled: %v", got[0].Annotations)
+	}
+	for _, l := range got[1:] {
+		expected := map[string]string{
+			ctdsnapshotters.TargetRefLabel:            name,
+			ctdsnapshotters.TargetLayerDigestLabel:    l.Digest.String(),
+			ctdsnapshotters.TargetManifestDigestLabel: manifest.Digest.String(),
+			source.TargetSociIndexDigestLabel:         "",
+		}
+		for k, v := range expected {
+			if a, ok := l.Annotations[k]; !ok || a != v {
+				t.Fatalf("layer %s has label %s=%q, expected %q", l.Digest, k, a, v)
+			}
+		}
+	}
+}
+
+func TestTransferPassesThroughOtherTransfers(t *testing.T) {
+	next := &recordingTransferrer{}
+	src, dst := &testStorer{}, &testStorer{}
+	if err := NewTransferrer(next).Transfer(context.Background(), src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if next.src != src || next.dst != dst {
+		t.Fatalf("transfer from %T to %T was wrapped", src, dst)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl/v2"
+)
+
+// Where a layer which can't be mounted lazily is unpacked instead.
+const (
+	// FallbackLocal is when the snapshotter fetches and unpacks the layer itself.
+	FallbackLocal = "local"
+	// FallbackContainerd is when the snapshotter fetches and unpacks the layer with the content and
+	// diff services of containerd, because it can't unpack the layer itself.
+	FallbackContainerd = "containerd"
+	// FallbackRuntime is when the snapshotter leaves the layer to the container runtime to fetch and unpack.
+	FallbackRuntime = "runtime"
+)
+
+// maxFallbackEvents is how many of the latest fallbacks are kept.
+const maxFallbackEvents = 100
+
+// FallbackEventTopic is the topic FallbackEvents are published on.
+const FallbackEventTopic = "/soci/snapshot/fallback"
+
+// publishTimeout bounds the publishing of an event, which doesn't hold up Prepare.
+const publishTimeout = 10 * time.Second
+
+func init() {
+	// FallbackEvents are published as JSON with this type URL.
+	typeurl.Register(&FallbackEvent{}, "github.com/awslabs/soci-snapshotter/snapshot", "FallbackEvent")
+}
+
+// FallbackEvent records that a layer couldn't be prepared the preferred way and why.
+type FallbackEvent struct {
+	Time  time.Time `json:"time"`
+	Key   string    `json:"key"`
+	Image string    `json:"image"`
+	Layer string    `json:"layer"`
+	// To is where the layer is unpacked instead: FallbackLocal, FallbackContainerd or FallbackRuntime.
+	To    string `json:"to"`
+	Cause string `json:"cause"`
+}
+
+// FallbackReporter reports the layers which fell back from lazy loading.
+type FallbackReporter interface {
+	// Fallbacks returns the latest fallbacks, oldest first.
+	Fallbacks() []FallbackEvent
+}
+
+var _ FallbackReporter = &snapshotter{}
+
+// Fallbacks implements FallbackReporter.
+func (o *snapshotter) Fallbacks() []FallbackEvent {
+	return o.fallbacks.events()
+}
+
+// publishFallback publishes the fallback `e` in the background, in the namespace of ctx.
+func (o *snapshotter) publishFallback(ctx context.Context, e FallbackEvent) {
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok {
+		log.G(ctx).Debug("not publishing fallback without namespace")
+		return
+	}
+	logger := log.G(ctx)
+	go func() {
+		ctx, cancel := context.WithTimeout(namespaces.WithNamespace(context.Background(), ns), publishTimeout)
+		defer cancel()
+		if err := o.publisher.Publish(ctx, FallbackEventTopic, &e); err != nil {
+			logger.WithError(err).Warn("failed to publish fallback event")
+		}
+	}()
+}
+
+// fallbackLog keeps the latest fallbacks.
+type fallbackLog struct {
+	mu   sync.Mutex
+	ring []FallbackEvent
+	next int
+}
+
+func (l *fallbackLog) add(e FallbackEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.ring) < maxFallbackEvents {
+		l.ring = append(l.ring, e)
+		return
+	}
+	l.ring[l.next] = e
+	l.next = (l.next + 1) % maxFallbackEvents
+}
+
+func (l *fallbackLog) events() []FallbackEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := make([]FallbackEvent, 0, len(l.ring))
+	events = append(events, l.ring[l.next:]...)
+	return append(events, l.ring[:l.next]...)
+}
@@ -0,0 +1,330 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// Layout of the state of a snapshot exported by ExportState:
+//
+//	layers/<layer digest>/<span>  - contents of a span fetched for a lazily loaded layer
+//	upper/<path>                  - contents of the upper directory of an active snapshot
+const (
+	stateLayersDir = "layers"
+	stateUpperDir  = "upper"
+
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// SpanMigrator is implemented by filesystems which can export and import the spans fetched
+// for their layers.
+type SpanMigrator interface {
+	// ExportSpans writes the spans fetched for the layer mounted at mountpoint to tw, under dir.
+	ExportSpans(ctx context.Context, mountpoint string, tw *tar.Writer, dir string) error
+	// ImportSpan caches the contents of a span exported by ExportSpans under name.
+	ImportSpan(ctx context.Context, mountpoint, name string, r io.Reader) error
+}
+
+// StateMigrator exports and imports the lazy-loading state of snapshots, so that a container
+// can be migrated to another node without fetching the data it already read again.
+type StateMigrator interface {
+	// ExportState writes the state of the snapshot `key` to w as a tar stream: the spans fetched
+	// for the lazily loaded layers of the snapshot and its parents and, if the snapshot is active,
+	// the contents of its upper directory.
+	ExportState(ctx context.Context, key string, w io.Writer) error
+	// ImportState imports the state exported by ExportState into the snapshot `key`. Spans are
+	// imported into the layers with the same digests. The upper directory can only be imported
+	// into an active snapshot, which must not be mounted by a container yet.
+	ImportState(ctx context.Context, key string, r io.Reader) error
+}
+
+var _ StateMigrator = &snapshotter{}
+
+// ExportState implements StateMigrator.
+func (o *snapshotter) ExportState(ctx context.Context, key string, w io.Writer) error {
+	upper, layers, err := o.stateDirs(ctx, key)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if sm, ok := o.fs.(SpanMigrator); ok {
+		for dgst, mountpoint := range layers {
+			if err := sm.ExportSpans(ctx, mountpoint, tw, path.Join(stateLayersDir, dgst.String())); err != nil {
+				return fmt.Errorf("failed to export spans of layer %s: %w", dgst, err)
+			}
+		}
+	}
+	if upper != "" {
+		if err := writeUpperDir(tw, upper); err != nil {
+			return fmt.Errorf("failed to export upper directory: %w", err)
+		}
+	}
+	return tw.Close()
+}
+
+// ImportState implements StateMigrator.
+func (o *snapshotter) ImportState(ctx context.Context, key string, r io.Reader) error {
+	upper, layers, err := o.stateDirs(ctx, key)
+	if err != nil {
+		return err
+	}
+	sm, _ := o.fs.(SpanMigrator)
+	var spans, skipped int
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(h.Name)
+		switch dir, rel, _ := strings.Cut(name, "/"); dir {
+		case stateLayersDir:
+			layer, span, _ := strings.Cut(rel, "/")
+			mountpoint, ok := layers[digest.Digest(layer)]
+			if !ok || sm == nil {
+				skipped++
+				continue
+			}
+			if err := sm.ImportSpan(ctx, mountpoint, span, tr); err != nil {
+				return fmt.Errorf("failed to import span %s of layer %s: %w", span, layer, err)
+			}
+			spans++
+		case stateUpperDir:
+			if upper == "" {
+				return fmt.Errorf("snapshot %q is not active: %w", key, errdefs.ErrFailedPrecondition)
+			}
+			if err := extractUpperEntry(upper, rel, h, tr); err != nil {
+				return fmt.Errorf("failed to import %q into upper directory: %w", rel, err)
+			}
+		default:
+			return fmt.Errorf("unexpected entry %q in snapshot state", h.Name)
+		}
+	}
+	log.G(ctx).WithField(logutil.SnapshotKeyField, key).Infof("imported snapshot state: %d spans imported, %d spans of unknown layers skipped", spans, skipped)
+	return nil
+}
+
+// stateDirs returns the upper directory of the snapshot `key` if it is active, and the
+// mountpoints of the lazily loaded layers of the snapshot and its parents by layer digest.
+func (o *snapshotter) stateDirs(ctx context.Context, key string) (string, map[digest.Digest]string, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return "", nil, err
+	}
+	defer t.Rollback()
+
+	var upper string
+	layers := make(map[digest.Digest]string)
+	for cKey := key; cKey != ""; {
+		id, info, _, err := storage.GetInfo(ctx, cKey)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get info of %q: %w", cKey, err)
+		}
+		if cKey == key && info.Kind == snapshots.KindActive {
+			upper = o.upperPath(id)
+		}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			if dgst, err := digest.Parse(info.Labels[ctdsnapshotters.TargetLayerDigestLabel]); err == nil {
+				layers[dgst] = o.upperPath(id)
+			}
+		}
+		cKey = info.Parent
+	}
+	return upper, layers, nil
+}
+
+// writeUpperDir writes the contents of the upper directory to tw, including the overlayfs
+// whiteouts (character devices) and extended attributes (e.g. opaque directories).
+func writeUpperDir(tw *tar.Writer, upper string) error {
+	return filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil // sockets can't be archived, and are recreated by their owners anyway
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		h, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		h.Name = path.Join(stateUpperDir, filepath.ToSlash(rel))
+		h.Uname, h.Gname = "", ""
+		if h.PAXRecords, err = xattrRecords(p); err != nil {
+			return err
+		}
+		if h.PAXRecords != nil {
+			h.Format = tar.FormatPAX
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// xattrRecords returns the extended attributes of the file at p as PAX records.
+func xattrRecords(p string) (map[string]string, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreNotSupported(err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+	records := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(p, string(name), value); err != nil {
+			return nil, err
+		}
+		records[paxXattrPrefix+string(name)] = string(value[:vsize])
+	}
+	return records, nil
+}
+
+func ignoreNotSupported(err error) error {
+	if err == unix.ENOTSUP {
+		return nil
+	}
+	return err
+}
+
+// extractUpperEntry creates the entry of the upper directory described by h at rel in upper.
+// Symlinks in upper are resolved within upper, so that entries can't be created outside of it.
+func extractUpperEntry(upper, rel string, h *tar.Header, r io.Reader) error {
+	parent, err := fs.RootPath(upper, filepath.Dir(rel))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	p := filepath.Join(parent, filepath.Base(rel))
+	// Existing entries other than directories are replaced rather than opened, so that
+	// a symlink at p isn't followed outside of upper.
+	if fi, err := os.Lstat(p); err == nil && !(h.Typeflag == tar.TypeDir && fi.IsDir()) {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := uint32(h.Mode & 07777)
+	switch h.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(p, os.FileMode(mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(h.Linkname, p); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[h.Typeflag]
+		if err := unix.Mknod(p, devMode|mode, int(unix.Mkdev(uint32(h.Devmajor), uint32(h.Devminor)))); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", h.Typeflag)
+	}
+
+	if err := os.Lchown(p, h.Uid, h.Gid); err != nil {
+		return err
+	}
+	for k, v := range h.PAXRecords {
+		if name := strings.TrimPrefix(k, paxXattrPrefix); name != k {
+			if err := unix.Lsetxattr(p, name, []byte(v), 0); err != nil {
+				return fmt.Errorf("failed to set xattr %q: %w", name, err)
+			}
+		}
+	}
+	if h.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// Set the mode again since the file was created with the umask applied,
+	// and chown cleared the setuid and setgid bits.
+	// p isn't a symlink, since it was created above.
+	if err := unix.Chmod(p, mode); err != nil {
+		return err
+	}
+	atime := h.AccessTime
+	if atime.IsZero() {
+		atime = h.ModTime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(h.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -36,15 +36,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
@@ -80,6 +84,14 @@ const (
 var (
 	// Error returned by `fs.Mount` when there is no ztoc for a particular layer.
 	ErrNoZtoc = errors.New("no ztoc for layer")
+
+	// ErrUnsupportedLayer is returned when preparing the snapshot of a layer which can't be unpacked
+	// on this host, e.g. a Windows layer, or a foreign layer if the snapshotter rejects them.
+	ErrUnsupportedLayer = fmt.Errorf("unsupported layer: %w", errdefs.ErrNotImplemented)
+
+	// ErrIndexRequired is returned when preparing the snapshot of a layer of an image which must be
+	// lazily loaded with a verified SOCI index, but whose index can't be found or verified.
+	ErrIndexRequired = fmt.Errorf("soci index required: %w", errdefs.ErrFailedPrecondition)
 )
 
 // FileSystem is a backing filesystem abstraction.
@@ -110,6 +122,9 @@ type SnapshotterConfig struct {
 	// minLayerSize skips remote mounting of smaller layers
 	minLayerSize                int64
 	allowInvalidMountsOnRestart bool
+	rejectForeignLayers         bool
+	publisher                   events.Publisher
+	unpacker                    LayerUnpacker
 }
 
 // Opt is an option to configure the remote snapshotter
@@ -137,6 +152,32 @@ func AllowInvalidMountsOnRestart(config *SnapshotterConfig) error {
 	return nil
 }
 
+// RejectForeignLayers makes Prepare fail with ErrUnsupportedLayer for foreign layers, instead of
+// leaving them to the container runtime to fetch and unpack.
+func RejectForeignLayers(config *SnapshotterConfig) error {
+	config.rejectForeignLayers = true
+	return nil
+}
+
+// WithEventPublisher publishes the events of the snapshotter, e.g. fallbacks (FallbackEventTopic),
+// with `publisher`, e.g. to the events service of containerd.
+func WithEventPublisher(publisher events.Publisher) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.publisher = publisher
+		return nil
+	}
+}
+
+// WithFallbackUnpacker unpacks the layers which the filesystem can neither mount lazily nor unpack
+// with `unpacker` (FallbackContainerd), e.g. with the services of containerd (see NewContainerdUnpacker),
+// instead of leaving them to the container runtime.
+func WithFallbackUnpacker(unpacker LayerUnpacker) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.unpacker = unpacker
+		return nil
+	}
+}
+
 type snapshotter struct {
 	root        string
 	ms          *storage.MetaStore
@@ -147,6 +188,10 @@ type snapshotter struct {
 	userxattr                   bool  // whether to enable "userxattr" mount option
 	minLayerSize                int64 // minimum layer size for remote mounting
 	allowInvalidMountsOnRestart bool
+	rejectForeignLayers         bool
+	fallbacks                   fallbackLog
+	publisher                   events.Publisher
+	unpacker                    LayerUnpacker
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -197,6 +242,9 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 		userxattr:                   userxattr,
 		minLayerSize:                config.minLayerSize,
 		allowInvalidMountsOnRestart: config.allowInvalidMountsOnRestart,
+		rejectForeignLayers:         config.rejectForeignLayers,
+		publisher:                   config.publisher,
+		unpacker:                    config.unpacker,
 	}
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
@@ -222,6 +270,17 @@ func (o *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, err
 		return snapshots.Info{}, err
 	}
 
+	if stats := o.fetchStatsLabels(ctx, key); stats != nil {
+		labels := make(map[string]string, len(info.Labels)+len(stats))
+		for k, v := range info.Labels {
+			labels[k] = v
+		}
+		for k, v := range stats {
+			labels[k] = v
+		}
+		info.Labels = labels
+	}
+
 	return info, nil
 }
 
@@ -280,6 +339,7 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 }
 
 func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	start := time.Now()
 	s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
 	if err != nil {
 		return nil, err
@@ -298,12 +358,35 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 	if !ok {
 		return o.mounts(ctx, s, parent)
 	}
+	// Hints passed with the versioned labels override the labels the snapshotter reads,
+	// and the snapshot is labeled with all the versioned labels.
+	if labels, err := source.ApplyVersionedLabels(base.Labels); err != nil {
+		log.G(ctx).WithError(err).WithField("key", key).Warn("ignoring invalid versioned snapshot labels")
+	} else {
+		base.Labels = labels
+	}
 
 	// NOTE: If passed labels include a target of the remote snapshot, `Prepare`
 	//       must log whether this method succeeded to prepare that remote snapshot
 	//       or not, using the key `remoteSnapshotLogKey` defined in the above. This
 	//       log is used by tests in this project.
-	lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", key).WithField("parent", parent))
+	lCtx := logutil.WithSnapshotKey(ctx, key)
+	lCtx = logutil.WithImage(lCtx, base.Labels[ctdsnapshotters.TargetRefLabel])
+	lCtx = logutil.WithLayer(lCtx, digest.Digest(base.Labels[ctdsnapshotters.TargetLayerDigestLabel]))
+	lCtx = log.WithLogger(lCtx, log.G(lCtx).WithField("parent", parent))
+
+	// Foreign layers, e.g. the base layers of Windows images, are fetched from the URLs of their
+	// descriptor, which the snapshotter doesn't know, so they are left to the container runtime.
+	if mediaType := base.Labels[source.TargetLayerMediaTypeLabel]; source.IsForeignLayer(mediaType) {
+		err := fmt.Errorf("layer %s has foreign media type %s: %w", base.Labels[ctdsnapshotters.TargetLayerDigestLabel], mediaType, ErrUnsupportedLayer)
+		if o.rejectForeignLayers {
+			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Warn("rejecting foreign layer")
+			return nil, o.rejectLayer(ctx, key, err)
+		}
+		log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Info("layer is foreign; deferring to container runtime")
+		o.recordFallback(lCtx, key, base.Labels, FallbackRuntime, err)
+		return o.mounts(ctx, s, parent)
+	}
 
 	// remote snapshot prepare
 	if !o.skipRemoteSnapshotPrepare(lCtx, base.Labels) {
@@ -314,6 +397,7 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 			if err == nil || errdefs.IsAlreadyExists(err) {
 				// count also AlreadyExists as "success"
 				log.G(lCtx).WithField(remoteSnapshotLogKey, prepareSucceeded).Info("remote snapshot successfully prepared.")
+				commonmetrics.MeasureMountLatency(digest.Digest(base.Labels[ctdsnapshotters.TargetManifestDigestLabel]), start)
 				return nil, fmt.Errorf("target snapshot %q: %w", target, errdefs.ErrAlreadyExists)
 			}
 			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Warn("failed to internally commit remote snapshot")
@@ -321,9 +405,17 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 			// possible has done some work on this "upper" directory.
 			return nil, err
 		}
-		log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Warn("failed to prepare remote snapshot")
-		if !errors.Is(err, ErrNoZtoc) {
+		if errors.Is(err, ErrIndexRequired) {
+			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Warn("rejecting layer without a verified SOCI index")
+			return nil, o.rejectLayer(ctx, key, err)
+		}
+		if errors.Is(err, ErrNoZtoc) {
+			// Layers which aren't in the SOCI index (e.g. small layers) are expected to be unpacked locally.
+			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).Info("layer has no zTOC, unpacking it locally")
+		} else {
+			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Warn("failed to prepare remote snapshot")
 			commonmetrics.IncOperationCount(commonmetrics.FuseMountFailureCount, digest.Digest(""))
+			o.recordFallback(lCtx, key, base.Labels, FallbackLocal, err)
 		}
 	}
 
@@ -334,8 +426,13 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		return nil, err
 	}
 
-	log.G(ctx).WithField("layerDigest", base.Labels[ctdsnapshotters.TargetLayerDigestLabel]).Info("preparing snapshot as local snapshot")
+	log.G(lCtx).Info("preparing snapshot as local snapshot")
 	err = o.prepareLocalSnapshot(lCtx, key, base.Labels, mounts)
+	if err != nil && o.unpacker != nil && !errors.Is(err, ErrUnsupportedLayer) && !errors.Is(err, ErrIndexRequired) {
+		log.G(lCtx).WithError(err).Warn("failed to prepare local snapshot; unpacking it with containerd")
+		o.recordFallback(lCtx, key, base.Labels, FallbackContainerd, err)
+		err = o.prepareContainerdSnapshot(lCtx, key, base.Labels, mounts)
+	}
 	if err == nil {
 		err := o.commit(ctx, false, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
 		if err == nil || errdefs.IsAlreadyExists(err) {
@@ -351,10 +448,42 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		return nil, err
 	}
 
+	if errors.Is(err, ErrUnsupportedLayer) || errors.Is(err, ErrIndexRequired) {
+		// The container runtime can't unpack the layer on this host either, or mustn't.
+		log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Warn("rejecting layer")
+		return nil, o.rejectLayer(ctx, key, err)
+	}
 	log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Warn("failed to prepare snapshot; deferring to container runtime")
+	o.recordFallback(lCtx, key, base.Labels, FallbackRuntime, err)
 	return mounts, nil
 }
 
+// rejectLayer removes the active snapshot `key` of a layer which can't be unpacked because of `cause`,
+// so that it doesn't outlive the failed pull, and returns the error to fail Prepare with.
+func (o *snapshotter) rejectLayer(ctx context.Context, key string, cause error) error {
+	if err := o.Remove(ctx, key); err != nil {
+		log.G(ctx).WithError(err).WithField("key", key).Warn("failed to remove snapshot of rejected layer")
+	}
+	return fmt.Errorf("cannot prepare snapshot %q: %w", key, cause)
+}
+
+// recordFallback records that the layer of the snapshot `key` is unpacked `to` instead because of `cause`,
+// and publishes it if the snapshotter has an event publisher.
+func (o *snapshotter) recordFallback(ctx context.Context, key string, labels map[string]string, to string, cause error) {
+	e := FallbackEvent{
+		Time:  time.Now(),
+		Key:   key,
+		Image: labels[ctdsnapshotters.TargetRefLabel],
+		Layer: labels[ctdsnapshotters.TargetLayerDigestLabel],
+		To:    to,
+		Cause: cause.Error(),
+	}
+	o.fallbacks.add(e)
+	if o.publisher != nil {
+		o.publishFallback(ctx, e)
+	}
+}
+
 func (o *snapshotter) skipRemoteSnapshotPrepare(ctx context.Context, labels map[string]string) bool {
 	if o.minLayerSize > 0 {
 		if strVal, ok := labels[source.TargetSizeLabel]; ok {
@@ -528,7 +657,7 @@ func (o *snapshotter) cleanupDirectories(ctx context.Context, cleanupCommitted b
 
 func (o *snapshotter) getCleanupDirectories(ctx context.Context, t storage.Transactor, cleanupCommitted bool) ([]string, error) {
 	ids, err := storage.IDMap(ctx)
-	if err != nil {
+	if err != nil && !errdefs.IsNotFound(err) { // not found if no snapshot has been created yet
 		return nil, err
 	}
 
@@ -749,6 +878,12 @@ func (o *snapshotter) Close() error {
 	if err := o.cleanup(ctx, cleanupCommitted); err != nil {
 		log.G(ctx).WithError(err).Warn("failed to cleanup")
 	}
+	// Filesystems may hold resources of their own, e.g. the persistent index of span caches.
+	if c, ok := o.fs.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to close filesystem")
+		}
+	}
 	return o.ms.Close()
 }
 
@@ -768,6 +903,32 @@ func (o *snapshotter) prepareLocalSnapshot(ctx context.Context, key string, labe
 	return o.fs.MountLocal(ctx, mountpoint, labels, mounts)
 }
 
+// prepareContainerdSnapshot tries to prepare the snapshot as a local snapshot unpacked by the
+// fallback unpacker, after discarding whatever the filesystem failed to unpack.
+func (o *snapshotter) prepareContainerdSnapshot(ctx context.Context, key string, labels map[string]string, mounts []mount.Mount) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	id, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+	upper := o.upperPath(id)
+	entries, err := os.ReadDir(upper)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(upper, e.Name())); err != nil {
+			return err
+		}
+	}
+	log.G(ctx).Infof("unpacking layer with containerd at mountpoint=%v", upper)
+	return o.unpacker.Unpack(ctx, labels, mounts)
+}
+
 // prepareRemoteSnapshot tries to prepare the snapshot as a remote snapshot
 // using filesystems registered in this snapshotter.
 func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, labels map[string]string) error {
@@ -790,7 +951,7 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 // checkAvailability checks avaiability of the specified layer and all lower
 // layers using filesystem's checking functionality.
 func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
-	ctx = log.WithLogger(ctx, log.G(ctx).WithField("key", key))
+	ctx = logutil.WithSnapshotKey(ctx, key)
 	log.G(ctx).Debug("checking layer availability")
 
 	ctx, t, err := o.ms.TransactionContext(ctx, false)
@@ -829,19 +990,45 @@ func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
 	return true
 }
 
+// restoreRemoteSnapshot reconciles the mounts of the snapshotter on startup.
+// Mounts left under the snapshots directory by a previous daemon are unmounted. If the daemon
+// was killed, its FUSE mounts are stale ("transport endpoint is not connected") and may still be
+// used by containers, so they are detached instead of failing the startup. The directories of
+// snapshots which are no longer in the metadata store are removed, and the remote snapshots
+// which are still referenced are mounted again.
 func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 	mounts, err := mountinfo.GetMounts(nil)
 	if err != nil {
 		return err
 	}
 	for _, m := range mounts {
-		if strings.HasPrefix(m.Mountpoint, filepath.Join(o.root, "snapshots")) {
-			if err := syscall.Unmount(m.Mountpoint, syscall.MNT_FORCE); err != nil {
+		if !strings.HasPrefix(m.Mountpoint, filepath.Join(o.root, "snapshots")) {
+			continue
+		}
+		if isStaleFuseMount(m) {
+			log.G(ctx).WithField("mountpoint", m.Mountpoint).Warn("found stale FUSE mount left by a previous snapshotter")
+			// Mounts of running containers keep using the stale mount even once the layer is
+			// mounted again, so those containers get I/O errors until they are restarted.
+			for _, dep := range dependentMounts(mounts, m.Mountpoint) {
+				log.G(ctx).WithField("mountpoint", dep).Warnf("mount depends on stale FUSE mount %s; containers using it need to be restarted", m.Mountpoint)
+			}
+		}
+		if err := syscall.Unmount(m.Mountpoint, syscall.MNT_FORCE); err != nil {
+			// The mount is busy, e.g. because it is a lower dir of a running container.
+			// Detach it so that the layer can be mounted again; the kernel releases it once unused.
+			log.G(ctx).WithError(err).WithField("mountpoint", m.Mountpoint).Debug("failed to unmount, detaching")
+			if err := syscall.Unmount(m.Mountpoint, syscall.MNT_DETACH); err != nil {
 				return fmt.Errorf("failed to unmount %s: %w", m.Mountpoint, err)
 			}
 		}
 	}
 
+	// Snapshots may have been removed from the metadata store without their directories being
+	// removed, e.g. if the daemon was killed during Remove.
+	if err := o.Cleanup(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to clean up orphaned snapshot directories")
+	}
+
 	var task []snapshots.Info
 	if err := o.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
 		if _, ok := info.Labels[remoteLabel]; ok {
@@ -867,3 +1054,33 @@ func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 
 	return nil
 }
+
+// isStaleFuseMount returns whether m is a FUSE mount whose server is gone.
+func isStaleFuseMount(m *mountinfo.Info) bool {
+	if !strings.HasPrefix(m.FSType, "fuse") {
+		return false
+	}
+	var st syscall.Stat_t
+	return errors.Is(syscall.Stat(m.Mountpoint, &st), syscall.ENOTCONN)
+}
+
+// dependentMounts returns the mountpoints of the overlay mounts which use mountpoint as a lower dir.
+func dependentMounts(mounts []*mountinfo.Info, mountpoint string) []string {
+	var deps []string
+	for _, m := range mounts {
+		if m.FSType != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(m.VFSOptions, ",") {
+			if !strings.HasPrefix(opt, "lowerdir=") {
+				continue
+			}
+			for _, lower := range strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":") {
+				if filepath.Clean(lower) == mountpoint {
+					deps = append(deps, m.Mountpoint)
+				}
+			}
+		}
+	}
+	return deps
+}
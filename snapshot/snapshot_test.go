@@ -33,20 +33,42 @@
 package snapshot
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	_ "crypto/sha256"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/diff/apply"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
 	"github.com/containerd/containerd/pkg/testutil"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
+	"github.com/containerd/typeurl/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/moby/sys/mountinfo"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
 
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -367,6 +389,133 @@ func TestFailureDetection(t *testing.T) {
 	}
 }
 
+func TestRestoreRemovesOrphans(t *testing.T) {
+	root := t.TempDir()
+	orphan := filepath.Join(root, "snapshots", "1")
+	if err := os.MkdirAll(filepath.Join(orphan, "fs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	sn, err := NewSnapshotter(context.TODO(), root, dummyFileSystem())
+	if err != nil {
+		t.Fatalf("failed to make new snapshotter: %v", err)
+	}
+	defer sn.Close()
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("orphaned snapshot directory wasn't removed: %v", err)
+	}
+}
+
+func TestStateMigration(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	newActive := func() (snapshots.Snapshotter, string) {
+		root := t.TempDir()
+		sn, err := NewSnapshotter(ctx, root, dummyFileSystem())
+		if err != nil {
+			t.Fatalf("failed to make new snapshotter: %v", err)
+		}
+		t.Cleanup(func() { sn.Close() })
+		if _, err := sn.Prepare(ctx, "active", ""); err != nil {
+			t.Fatalf("failed to prepare snapshot: %v", err)
+		}
+		return sn, filepath.Join(getBasePath(ctx, sn, root, "active"), "fs")
+	}
+
+	src, srcUpper := newActive()
+	if err := os.Mkdir(filepath.Join(srcUpper, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(filepath.Join(srcUpper, "dir"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcUpper, "dir", "file"), []byte("contents"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(srcUpper, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(srcUpper, "whiteout"), unix.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var state bytes.Buffer
+	if err := src.(StateMigrator).ExportState(ctx, "active", &state); err != nil {
+		t.Fatalf("failed to export state: %v", err)
+	}
+	dst, dstUpper := newActive()
+	if err := dst.(StateMigrator).ImportState(ctx, "active", &state); err != nil {
+		t.Fatalf("failed to import state: %v", err)
+	}
+
+	opaque := make([]byte, 1)
+	if _, err := unix.Getxattr(filepath.Join(dstUpper, "dir"), "trusted.overlay.opaque", opaque); err != nil || string(opaque) != "y" {
+		t.Errorf("opaque xattr wasn't imported: %q, %v", opaque, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dstUpper, "dir")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("unexpected directory: %v, %v", fi, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dstUpper, "dir", "file")); err != nil || string(b) != "contents" {
+		t.Errorf("unexpected file contents: %q, %v", b, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dstUpper, "dir", "file")); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("unexpected file: %v, %v", fi, err)
+	}
+	if l, err := os.Readlink(filepath.Join(dstUpper, "link")); err != nil || l != "dir/file" {
+		t.Errorf("unexpected symlink: %q, %v", l, err)
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(dstUpper, "whiteout"), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("unexpected whiteout: %+v, %v", st, err)
+	}
+}
+
+func TestExtractUpperEntrySymlink(t *testing.T) {
+	upper, outside := t.TempDir(), filepath.Join(t.TempDir(), "target")
+	if err := os.WriteFile(outside, []byte("outside"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(upper, "file")); err != nil {
+		t.Fatal(err)
+	}
+	h := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "file",
+		Mode:     0600,
+		Size:     int64(len("contents")),
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+		ModTime:  time.Now(),
+	}
+	if err := extractUpperEntry(upper, "file", h, strings.NewReader("contents")); err != nil {
+		t.Fatalf("failed to extract entry: %v", err)
+	}
+	if b, err := os.ReadFile(outside); err != nil || string(b) != "outside" {
+		t.Fatalf("file outside of the upper directory was modified: %q, %v", b, err)
+	}
+	fi, err := os.Lstat(filepath.Join(upper, "file"))
+	if err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("symlink wasn't replaced: %v, %v", fi, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(upper, "file")); err != nil || string(b) != "contents" {
+		t.Fatalf("unexpected file contents: %q, %v", b, err)
+	}
+}
+
+func TestDependentMounts(t *testing.T) {
+	mounts := []*mountinfo.Info{
+		{Mountpoint: "/root/snapshots/1/fs", FSType: "fuse.rawBridge", VFSOptions: "rw,user_id=0"},
+		{Mountpoint: "/run/rootfs/a", FSType: "overlay", VFSOptions: "rw,lowerdir=/root/snapshots/2/fs:/root/snapshots/1/fs/,upperdir=/u,workdir=/w"},
+		{Mountpoint: "/run/rootfs/b", FSType: "overlay", VFSOptions: "rw,lowerdir=/root/snapshots/10/fs,upperdir=/root/snapshots/1/fs"},
+		{Mountpoint: "/run/rootfs/c", FSType: "overlay", VFSOptions: "ro,lowerdir=/root/snapshots/1/fs"},
+		{Mountpoint: "/mnt", FSType: "ext4", VFSOptions: "rw,lowerdir=/root/snapshots/1/fs"},
+	}
+	got := dependentMounts(mounts, "/root/snapshots/1/fs")
+	want := []string{"/run/rootfs/a", "/run/rootfs/c"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected dependent mounts (-want +got):\n%s", diff)
+	}
+}
+
 func bindFileSystem(t *testing.T) FileSystem {
 	root := t.TempDir()
 	if err := os.WriteFile(filepath.Join(root, remoteSampleFile), []byte(remoteSampleFileContents), 0660); err != nil {
@@ -423,6 +572,426 @@ func (fs *bindFs) MountLocal(ctx context.Context, mountpoint string, labels map[
 	return nil
 }
 
+// sparseIndexFs is a FileSystem whose SOCI index has no zTOC for the layers with noZtocLabel.
+// It doesn't mount anything, but records how each layer was prepared.
+type sparseIndexFs struct {
+	remote []string
+	local  []string
+	// labels are the labels of the layers mounted remotely.
+	labels []map[string]string
+}
+
+const noZtocLabel = "containerd.io/snapshot/no-ztoc"
+
+func (fs *sparseIndexFs) GetZtocForLayer(ctx context.Context, imageRef, indexDigest, imageManifestDigest, layerDigest string) (ocispec.Descriptor, error) {
+	return ocispec.Descriptor{}, nil
+}
+
+func (fs *sparseIndexFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if _, ok := labels[noZtocLabel]; ok {
+		return ErrNoZtoc
+	}
+	fs.remote = append(fs.remote, labels[targetSnapshotLabel])
+	fs.labels = append(fs.labels, labels)
+	return nil
+}
+
+func (fs *sparseIndexFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return nil
+}
+
+func (fs *sparseIndexFs) Unmount(ctx context.Context, mountpoint string) error {
+	return nil
+}
+
+func (fs *sparseIndexFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	fs.local = append(fs.local, labels[targetSnapshotLabel])
+	return nil
+}
+
+func TestPrepareSparseIndex(t *testing.T) {
+	ctx := context.TODO()
+	fs := &sparseIndexFs{}
+	sn, err := NewSnapshotter(ctx, t.TempDir(), fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	// Layers without a zTOC are unpacked locally, while the other layers are mounted remotely.
+	lower := prepareWithTarget(t, sn, "lower", "/tmp/prepareLower", "", map[string]string{noZtocLabel: ""})
+	upper := prepareWithTarget(t, sn, "upper", "/tmp/prepareUpper", lower, nil)
+	if diff := cmp.Diff([]string{lower}, fs.local); diff != "" {
+		t.Fatalf("unexpected layers unpacked locally (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{upper}, fs.remote); diff != "" {
+		t.Fatalf("unexpected layers mounted remotely (-want +got):\n%s", diff)
+	}
+	for target, remote := range map[string]bool{lower: false, upper: true} {
+		info, err := sn.Stat(ctx, target)
+		if err != nil {
+			t.Fatalf("failed to stat snapshot %q: %v", target, err)
+		}
+		if _, ok := info.Labels[remoteLabel]; ok != remote {
+			t.Fatalf("unexpected remote label of snapshot %q; expected = %v, got = %v", target, remote, ok)
+		}
+	}
+}
+
+func TestPrepareVersionedLabels(t *testing.T) {
+	ctx := context.TODO()
+	fs := &sparseIndexFs{}
+	sn, err := NewSnapshotter(ctx, t.TempDir(), fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	const (
+		index = "sha256:0e5ca5a7dcb9a2e8b5d3f0ac34f8ea6a1b2f1c3c8d1d5a62f4cd2c2e3e6ee1a9"
+		hint  = "sha256:9b7e3c6f0d2a4e1c8a5b3d7f9e0c2a4b6d8f1e3a5c7b9d0f2e4a6c8b0d2f4e6a"
+	)
+	target := prepareWithTarget(t, sn, "versioned", "/tmp/prepareVersioned", "", map[string]string{
+		source.TargetSociIndexDigestLabel: index,
+		source.IndexDigestLabelV1:         hint,
+		ctdsnapshotters.TargetRefLabel:    "registry.example.com/app:latest",
+	})
+	// The filesystem reads the hints of the versioned labels...
+	if len(fs.labels) != 1 || fs.labels[0][source.TargetSociIndexDigestLabel] != hint {
+		t.Fatalf("versioned label was not applied: %v", fs.labels)
+	}
+	// ...and the snapshot is labeled with all the versioned labels.
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat snapshot %q: %v", target, err)
+	}
+	if info.Labels[source.ImageRefLabelV1] != "registry.example.com/app:latest" || info.Labels[source.IndexDigestLabelV1] != hint {
+		t.Fatalf("snapshot is missing versioned labels: %v", info.Labels)
+	}
+
+	// Invalid versioned labels are ignored.
+	prepareWithTarget(t, sn, "invalid", "/tmp/prepareInvalid", "", map[string]string{
+		source.TargetSociIndexDigestLabel: index,
+		source.IndexDigestLabelV1:         "latest",
+	})
+	if len(fs.labels) != 2 || fs.labels[1][source.TargetSociIndexDigestLabel] != index {
+		t.Fatalf("invalid versioned label was applied: %v", fs.labels)
+	}
+}
+
+// fallbackFs is a FileSystem which can't mount layers lazily, and can't unpack the layers
+// labelled with noLocalLabel either.
+type fallbackFs struct {
+	sparseIndexFs
+}
+
+const noLocalLabel = "containerd.io/snapshot/no-local"
+
+func (fs *fallbackFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return errors.New("registry unavailable")
+}
+
+func (fs *fallbackFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	if _, ok := labels[noLocalLabel]; ok {
+		return errors.New("layer unavailable")
+	}
+	return fs.sparseIndexFs.MountLocal(ctx, mountpoint, labels, mounts)
+}
+
+func TestPrepareFallbacks(t *testing.T) {
+	ctx := context.TODO()
+	sn, err := NewSnapshotter(ctx, t.TempDir(), &fallbackFs{})
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	lower := prepareWithTarget(t, sn, "lower", "/tmp/prepareLower", "", nil)
+	labels := map[string]string{targetSnapshotLabel: "upper", noLocalLabel: ""}
+	if _, err := sn.Prepare(ctx, "/tmp/prepareUpper", lower, snapshots.WithLabels(labels)); err != nil {
+		t.Fatalf("layer which can't be unpacked by the snapshotter wasn't left to the runtime: %v", err)
+	}
+
+	var got []FallbackEvent
+	for _, e := range sn.(FallbackReporter).Fallbacks() {
+		got = append(got, FallbackEvent{Key: e.Key, To: e.To, Cause: e.Cause})
+	}
+	want := []FallbackEvent{
+		{Key: "/tmp/prepareLower", To: FallbackLocal, Cause: "registry unavailable"},
+		{Key: "/tmp/prepareUpper", To: FallbackLocal, Cause: "registry unavailable"},
+		{Key: "/tmp/prepareUpper", To: FallbackRuntime, Cause: "layer unavailable"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected fallbacks (-want +got):\n%s", diff)
+	}
+}
+
+// channelPublisher sends the published events to a channel.
+type channelPublisher chan publishedEvent
+
+type publishedEvent struct {
+	namespace, topic string
+	event            events.Event
+}
+
+func (p channelPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	ns, _ := namespaces.Namespace(ctx)
+	p <- publishedEvent{ns, topic, event}
+	return nil
+}
+
+func TestPublishFallbacks(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.TODO(), "test")
+	published := make(channelPublisher, 1)
+	sn, err := NewSnapshotter(ctx, t.TempDir(), &fallbackFs{}, WithEventPublisher(published))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	labels := map[string]string{targetSnapshotLabel: "lower"}
+	if _, err := sn.Prepare(ctx, "/tmp/prepareLower", "", snapshots.WithLabels(labels)); !errdefs.IsAlreadyExists(err) {
+		t.Fatalf("failed to prepare snapshot: %v", err)
+	}
+	select {
+	case e := <-published:
+		if e.namespace != "test" || e.topic != FallbackEventTopic {
+			t.Fatalf("unexpected namespace and topic of event: %q %q", e.namespace, e.topic)
+		}
+		any, err := typeurl.MarshalAny(e.event)
+		if err != nil {
+			t.Fatalf("failed to marshal event: %v", err)
+		}
+		v, err := typeurl.UnmarshalAny(any)
+		if err != nil {
+			t.Fatalf("failed to unmarshal event: %v", err)
+		}
+		fallback, ok := v.(*FallbackEvent)
+		if !ok || fallback.Key != "/tmp/prepareLower" || fallback.To != FallbackLocal {
+			t.Fatalf("unexpected event: %#v", v)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("fallback wasn't published")
+	}
+}
+
+// unsupportedLayerFs is a FileSystem which can't mount layers lazily, and rejects the layers
+// labelled with unsupportedLabel as Windows layers.
+type unsupportedLayerFs struct {
+	fallbackFs
+}
+
+const (
+	unsupportedLabel   = "containerd.io/snapshot/unsupported"
+	indexRequiredLabel = "containerd.io/snapshot/index-required"
+)
+
+func (fs *unsupportedLayerFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if _, ok := labels[indexRequiredLabel]; ok {
+		return fmt.Errorf("no soci index: %w", ErrIndexRequired)
+	}
+	return fs.fallbackFs.Mount(ctx, mountpoint, labels)
+}
+
+func (fs *unsupportedLayerFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	if _, ok := labels[unsupportedLabel]; ok {
+		return fmt.Errorf("windows layer: %w", ErrUnsupportedLayer)
+	}
+	return fs.fallbackFs.MountLocal(ctx, mountpoint, labels, mounts)
+}
+
+func TestPrepareRejectedLayers(t *testing.T) {
+	ctx := context.TODO()
+	foreign := map[string]string{source.TargetLayerMediaTypeLabel: images.MediaTypeDockerSchema2LayerForeignGzip}
+	tests := []struct {
+		name    string
+		opts    []Opt
+		labels  map[string]string
+		wantErr error
+	}{
+		{name: "foreign layers are left to the runtime", labels: foreign},
+		{name: "foreign layers are rejected", opts: []Opt{RejectForeignLayers}, labels: foreign, wantErr: ErrUnsupportedLayer},
+		{name: "layers rejected by the filesystem", labels: map[string]string{unsupportedLabel: ""}, wantErr: ErrUnsupportedLayer},
+		{name: "layers without a required index", labels: map[string]string{indexRequiredLabel: ""}, wantErr: ErrIndexRequired},
+		{name: "other layers are unpacked", opts: []Opt{RejectForeignLayers}, labels: map[string]string{
+			source.TargetLayerMediaTypeLabel: ocispec.MediaTypeImageLayerGzip,
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sn, err := NewSnapshotter(ctx, t.TempDir(), &unsupportedLayerFs{}, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to make new remote snapshotter: %q", err)
+			}
+			defer sn.Close()
+
+			tc.labels[targetSnapshotLabel] = "layer"
+			_, err = sn.Prepare(ctx, "/tmp/prepare", "", snapshots.WithLabels(tc.labels))
+			if tc.wantErr == nil {
+				if err != nil && !errdefs.IsAlreadyExists(err) {
+					t.Fatalf("failed to prepare snapshot: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error preparing rejected layer; expected = %v, got = %v", tc.wantErr, err)
+			}
+			if _, err := sn.Stat(ctx, "/tmp/prepare"); !errdefs.IsNotFound(err) {
+				t.Fatalf("snapshot of rejected layer wasn't removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestFallbackLog(t *testing.T) {
+	var l fallbackLog
+	for i := 0; i < maxFallbackEvents+10; i++ {
+		l.add(FallbackEvent{Key: fmt.Sprint(i)})
+	}
+	events := l.events()
+	if len(events) != maxFallbackEvents {
+		t.Fatalf("unexpected number of events: %d", len(events))
+	}
+	if first, last := events[0].Key, events[len(events)-1].Key; first != "10" || last != fmt.Sprint(maxFallbackEvents+9) {
+		t.Fatalf("unexpected events kept; first = %s, last = %s", first, last)
+	}
+}
+
+// gzipLayer returns a gzip compressed layer with the file `name` of `contents`.
+func gzipLayer(t *testing.T, name, contents string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPrepareContainerdFallback(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := namespaces.WithNamespace(context.TODO(), "test")
+	layer := gzipLayer(t, "foo", "unpacked by containerd")
+	layerDigest := digest.FromBytes(layer)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/blobs/"+layerDigest.String() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(layer)
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+	hosts := func(reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{Client: registry.Client(), Host: host, Scheme: "http", Path: "/v2", Capabilities: docker.HostCapabilityPull}}, nil
+	}
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacker := NewContainerdUnpacker(cs, apply.NewFileSystemApplier(cs), nil, hosts)
+	sn, err := NewSnapshotter(ctx, t.TempDir(), &fallbackFs{}, WithFallbackUnpacker(unpacker))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	// The filesystem can neither mount the layer lazily nor unpack it.
+	labels := func(dgst digest.Digest) map[string]string {
+		return map[string]string{
+			noLocalLabel:                           "",
+			ctdsnapshotters.TargetRefLabel:         host + "/app:latest",
+			ctdsnapshotters.TargetLayerDigestLabel: dgst.String(),
+			source.TargetSizeLabel:                 fmt.Sprint(len(layer)),
+		}
+	}
+	target := prepareWithTarget(t, sn, "layer", "/tmp/prepare", "", labels(layerDigest))
+	mounts, err := sn.View(ctx, "/tmp/view", target)
+	if err != nil {
+		t.Fatalf("failed to view snapshot: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(mounts[0].Source, "foo"))
+	if err != nil || string(b) != "unpacked by containerd" {
+		t.Fatalf("layer wasn't unpacked by containerd: %q, %v", b, err)
+	}
+
+	// Layers which can't be fetched are left to the runtime.
+	missingLabels := labels(digest.FromString("missing"))
+	missingLabels[targetSnapshotLabel] = "missing"
+	if _, err := sn.Prepare(ctx, "/tmp/prepareMissing", "", snapshots.WithLabels(missingLabels)); err != nil {
+		t.Fatalf("layer which can't be unpacked with containerd wasn't left to the runtime: %v", err)
+	}
+
+	var got []string
+	for _, e := range sn.(FallbackReporter).Fallbacks() {
+		got = append(got, e.Key+" "+e.To)
+	}
+	want := []string{
+		"/tmp/prepare " + FallbackLocal,
+		"/tmp/prepare " + FallbackContainerd,
+		"/tmp/prepareMissing " + FallbackLocal,
+		"/tmp/prepareMissing " + FallbackContainerd,
+		"/tmp/prepareMissing " + FallbackRuntime,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected fallbacks (-want +got):\n%s", diff)
+	}
+}
+
+// fetchStatsFs is a FileSystem whose layers all report the same fetch statistics.
+type fetchStatsFs struct {
+	sparseIndexFs
+}
+
+func (fs *fetchStatsFs) FetchStats(ctx context.Context, mountpoint string) (FetchStats, error) {
+	return FetchStats{FetchedBytes: 100, CachedBytes: 10, Reads: 1}, nil
+}
+
+func TestStatFetchStats(t *testing.T) {
+	ctx := context.TODO()
+	sn, err := NewSnapshotter(ctx, t.TempDir(), &fetchStatsFs{})
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	local := prepareWithTarget(t, sn, "local", "/tmp/prepareLocal", "", map[string]string{noZtocLabel: ""})
+	lower := prepareWithTarget(t, sn, "lower", "/tmp/prepareLower", local, nil)
+	upper := prepareWithTarget(t, sn, "upper", "/tmp/prepareUpper", lower, nil)
+	for target, want := range map[string]map[string]string{
+		local: nil,
+		lower: {FetchedBytesLabel: "100", CachedBytesLabel: "10", OnDemandReadsLabel: "1"},
+		// The statistics of the parents are included.
+		upper: {FetchedBytesLabel: "200", CachedBytesLabel: "20", OnDemandReadsLabel: "2"},
+	} {
+		info, err := sn.Stat(ctx, target)
+		if err != nil {
+			t.Fatalf("failed to stat snapshot %q: %v", target, err)
+		}
+		got := make(map[string]string)
+		for _, k := range []string{FetchedBytesLabel, CachedBytesLabel, OnDemandReadsLabel} {
+			if v, ok := info.Labels[k]; ok {
+				got[k] = v
+			}
+		}
+		if want == nil {
+			want = map[string]string{}
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected fetch statistics of snapshot %q (-want +got):\n%s", target, diff)
+		}
+	}
+}
+
 func dummyFileSystem() FileSystem { return &dummyFs{} }
 
 type dummyFs struct{}
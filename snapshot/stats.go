@@ -0,0 +1,88 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// Labels of the fetch statistics of a snapshot, added to the info returned by Stat
+// (e.g. `ctr snapshot info`). The statistics cover the lazily loaded layers of the
+// snapshot and its parents since they were mounted.
+const (
+	// FetchedBytesLabel is the number of compressed bytes fetched from the remote.
+	FetchedBytesLabel = "containerd.io/snapshot/soci.fetched-bytes"
+	// CachedBytesLabel is the number of bytes served from the local cache.
+	CachedBytesLabel = "containerd.io/snapshot/soci.cached-bytes"
+	// OnDemandReadsLabel is the number of reads of the contents of files.
+	OnDemandReadsLabel = "containerd.io/snapshot/soci.on-demand-reads"
+)
+
+// FetchStats are statistics of how the contents of a lazily loaded layer were read.
+type FetchStats struct {
+	FetchedBytes int64
+	CachedBytes  int64
+	Reads        int64
+}
+
+// FetchStatsProvider is implemented by filesystems which record how the contents of their layers are read.
+type FetchStatsProvider interface {
+	// FetchStats returns the fetch statistics of the layer mounted at mountpoint.
+	FetchStats(ctx context.Context, mountpoint string) (FetchStats, error)
+}
+
+// fetchStatsLabels returns the labels of the fetch statistics of the snapshot `key` and its parents,
+// or nil if none of them is lazily loaded. ctx must hold a transaction of the metadata store.
+func (o *snapshotter) fetchStatsLabels(ctx context.Context, key string) map[string]string {
+	p, ok := o.fs.(FetchStatsProvider)
+	if !ok {
+		return nil
+	}
+	var (
+		total  FetchStats
+		remote bool
+	)
+	for cKey := key; cKey != ""; {
+		id, info, _, err := storage.GetInfo(ctx, cKey)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to get info of %q", cKey)
+			return nil
+		}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			// Layers which aren't mounted (e.g. after an invalid restore) have no statistics.
+			if s, err := p.FetchStats(ctx, o.upperPath(id)); err == nil {
+				total.FetchedBytes += s.FetchedBytes
+				total.CachedBytes += s.CachedBytes
+				total.Reads += s.Reads
+				remote = true
+			}
+		}
+		cKey = info.Parent
+	}
+	if !remote {
+		return nil
+	}
+	return map[string]string{
+		FetchedBytesLabel:  strconv.FormatInt(total.FetchedBytes, 10),
+		CachedBytesLabel:   strconv.FormatInt(total.CachedBytes, 10),
+		OnDemandReadsLabel: strconv.FormatInt(total.Reads, 10),
+	}
+}
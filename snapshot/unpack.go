@@ -0,0 +1,133 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// unpackLeaseExpiration is how long the content of a layer unpacked with containerd is kept
+// if the snapshotter fails to delete the lease protecting it from garbage collection.
+const unpackLeaseExpiration = time.Hour
+
+// LayerUnpacker fetches a layer and unpacks it into the mounts of its snapshot.
+type LayerUnpacker interface {
+	// Unpack unpacks the layer of the snapshot with `labels` into `mounts`.
+	Unpack(ctx context.Context, labels map[string]string, mounts []mount.Mount) error
+}
+
+type containerdUnpacker struct {
+	ingester content.Ingester
+	applier  diff.Applier
+	leases   leases.Manager
+	hosts    source.RegistryHosts
+}
+
+// NewContainerdUnpacker returns a LayerUnpacker which fetches layers from the registries of `hosts`
+// into the content store of containerd with `ingester`, and applies them with the diff service of
+// containerd, `applier`. If `lm` isn't nil, the layers are fetched under a lease of it, so that
+// they aren't garbage collected before they are applied.
+func NewContainerdUnpacker(ingester content.Ingester, applier diff.Applier, lm leases.Manager, hosts source.RegistryHosts) LayerUnpacker {
+	return &containerdUnpacker{
+		ingester: ingester,
+		applier:  applier,
+		leases:   lm,
+		hosts:    hosts,
+	}
+}
+
+func (u *containerdUnpacker) Unpack(ctx context.Context, labels map[string]string, mounts []mount.Mount) error {
+	refspec, err := reference.Parse(labels[ctdsnapshotters.TargetRefLabel])
+	if err != nil {
+		return fmt.Errorf("cannot parse image ref: %w", err)
+	}
+	desc, err := layerDescriptor(labels)
+	if err != nil {
+		return err
+	}
+	// The services of containerd are called in the namespace of the snapshot.
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	if u.leases != nil {
+		l, err := u.leases.Create(ctx, leases.WithRandomID(), leases.WithExpiration(unpackLeaseExpiration))
+		if err != nil {
+			return fmt.Errorf("cannot create lease: %w", err)
+		}
+		defer func() {
+			if err := u.leases.Delete(ctx, l); err != nil {
+				log.G(ctx).WithError(err).WithField("lease", l.ID).Warn("failed to delete lease of unpacked layer")
+			}
+		}()
+		ctx = leases.WithLease(ctx, l.ID)
+	}
+
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != refspec.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, refspec.String())
+			}
+			return u.hosts(refspec)
+		},
+	})
+	fetcher, err := resolver.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return fmt.Errorf("cannot create fetcher: %w", err)
+	}
+	if _, err := remotes.FetchHandler(u.ingester, fetcher)(ctx, desc); err != nil {
+		return fmt.Errorf("cannot fetch layer: %w", err)
+	}
+	if _, err := u.applier.Apply(ctx, desc, mounts); err != nil {
+		return fmt.Errorf("cannot apply layer: %w", err)
+	}
+	return nil
+}
+
+// layerDescriptor returns the descriptor of the layer of the snapshot with `labels`.
+// Layers without a media type are applied as gzip layers, whose compression is detected.
+func layerDescriptor(labels map[string]string) (ocispec.Descriptor, error) {
+	dgst, err := digest.Parse(labels[ctdsnapshotters.TargetLayerDigestLabel])
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid layer digest: %w", err)
+	}
+	size, err := strconv.ParseInt(labels[source.TargetSizeLabel], 10, 64)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid layer size: %w", err)
+	}
+	mediaType := labels[source.TargetLayerMediaTypeLabel]
+	if mediaType == "" {
+		mediaType = ocispec.MediaTypeImageLayerGzip
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: size}, nil
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/estargz"
+	ztoccompression "github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/labels"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AlignedLayerConvertFunc returns a converter.ConvertFunc which recompresses the layers of an image
+// into gzip members holding `spanSize` uncompressed bytes each, so that every span of their zTOCs
+// built with the same span size starts a member and is decompressed without the data preceding it.
+// The tar archives of the layers aren't changed, so neither are their diff IDs.
+func AlignedLayerConvertFunc(spanSize int64) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			return nil, nil
+		}
+		info, err := cs.Info(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer ra.Close()
+		r, err := compression.DecompressStream(io.NewSectionReader(ra, 0, desc.Size))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		ref := fmt.Sprintf("convert-aligned-gzip-from-%s", desc.Digest)
+		w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		// Discard the data of an interrupted conversion.
+		if err := w.Truncate(0); err != nil {
+			return nil, err
+		}
+		aw, err := ztoccompression.NewAlignedGzipWriter(w, spanSize, gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		diffID := digest.Canonical.Digester()
+		if _, err := io.Copy(aw, io.TeeReader(r, diffID.Hash())); err != nil {
+			return nil, fmt.Errorf("failed to recompress layer %s: %w", desc.Digest, err)
+		}
+		if err := aw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to recompress layer %s: %w", desc.Digest, err)
+		}
+		// Keep the labels of the layer (e.g. its distribution sources), but not its diff ID.
+		layerLabels := make(map[string]string, len(info.Labels)+1)
+		for k, v := range info.Labels {
+			layerLabels[k] = v
+		}
+		layerLabels[labels.LabelUncompressed] = diffID.Digest().String()
+		if err := w.Commit(ctx, 0, "", content.WithLabels(layerLabels)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, err
+		}
+		newInfo, err := cs.Info(ctx, w.Digest())
+		if err != nil {
+			return nil, err
+		}
+
+		newDesc := desc
+		newDesc.Digest = newInfo.Digest
+		newDesc.Size = newInfo.Size
+		newDesc.MediaType = estargz.GzipMediaType(desc.MediaType)
+		// The layer isn't an eStargz layer anymore, even if it was one.
+		newDesc.Annotations = make(map[string]string, len(desc.Annotations))
+		for k, v := range desc.Annotations {
+			if k == estargz.TOCJSONDigestAnnotation || k == estargz.StoreUncompressedSizeAnnotation {
+				continue
+			}
+			newDesc.Annotations[k] = v
+		}
+		return &newDesc, nil
+	}
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/estargz"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/labels"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestAlignedLayerConvertFunc(t *testing.T) {
+	const spanSize = 4096
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), memoryLabelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarBytes, err := io.ReadAll(testutil.BuildTar([]testutil.TarEntry{
+		testutil.File("foo", strings.Repeat("foo bar baz\n", 2000)),
+		testutil.File("bar", "bar"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(tarBytes),
+		Size:      int64(len(tarBytes)),
+		Annotations: map[string]string{
+			"foo":                           "bar",
+			estargz.TOCJSONDigestAnnotation: digest.FromString("toc").String(),
+		},
+	}
+	if err := content.WriteBlob(ctx, cs, "layer", bytes.NewReader(tarBytes), desc); err != nil {
+		t.Fatal(err)
+	}
+
+	newDesc, err := AlignedLayerConvertFunc(spanSize)(ctx, cs, desc)
+	if err != nil {
+		t.Fatalf("failed to convert layer: %v", err)
+	}
+	if newDesc == nil || newDesc.MediaType != ocispec.MediaTypeImageLayerGzip {
+		t.Fatalf("unexpected converted layer: %+v", newDesc)
+	}
+	if newDesc.Annotations["foo"] != "bar" {
+		t.Fatalf("annotations of the layer weren't kept: %v", newDesc.Annotations)
+	}
+	if _, ok := newDesc.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+		t.Fatalf("converted layer is annotated as an eStargz layer: %v", newDesc.Annotations)
+	}
+	info, err := cs.Info(ctx, newDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Labels[labels.LabelUncompressed]; got != desc.Digest.String() {
+		t.Fatalf("unexpected diff ID of converted layer: got %s, want %s", got, desc.Digest)
+	}
+
+	blob, err := content.ReadBlob(ctx, cs, *newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uncompressed, tarBytes) {
+		t.Fatal("the tar archive of the converted layer was changed")
+	}
+
+	path := filepath.Join(t.TempDir(), "layer.tar.gz")
+	if err := os.WriteFile(path, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+	toc, err := ztoc.NewBuilder("test").BuildZtoc(path, spanSize)
+	if err != nil {
+		t.Fatalf("failed to build ztoc of converted layer: %v", err)
+	}
+	if !toc.SpanAligned || toc.MaxSpanID == 0 {
+		t.Fatalf("ztoc of converted layer isn't span aligned; aligned = %t, spans = %d", toc.SpanAligned, toc.MaxSpanID+1)
+	}
+}
+
+// memoryLabelStore keeps the labels of a local content store in memory.
+type memoryLabelStore map[digest.Digest]map[string]string
+
+func (s memoryLabelStore) Get(d digest.Digest) (map[string]string, error) {
+	return s[d], nil
+}
+
+func (s memoryLabelStore) Set(d digest.Digest, labels map[string]string) error {
+	s[d] = labels
+	return nil
+}
+
+func (s memoryLabelStore) Update(d digest.Digest, update map[string]string) (map[string]string, error) {
+	labels := s[d]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s[d] = labels
+	return labels, nil
+}
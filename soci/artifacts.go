@@ -18,8 +18,10 @@ package soci
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path"
@@ -29,6 +31,7 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
@@ -37,7 +40,7 @@ import (
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	bolt "go.etcd.io/bbolt"
-	"oras.land/oras-go/v2/content/oci"
+	orascontent "oras.land/oras-go/v2/content"
 )
 
 // Artifacts package stores SOCI artifacts info in the following schema.
@@ -49,7 +52,11 @@ import (
 //         - imageDigest: <string>      : the digest of the image index
 //         - platform: <string>         : the platform for the index
 //         - location: <string>         : the location of the artifact
-//         - type: <string>             : the type of the artifact (can be either "soci_index" or "soci_layer")
+//         - type: <string>             : the type of the artifact ("soci_index", "soci_index_list" or "soci_layer")
+//         - pinned_by                  : bucket of the digests of the indexes pinning the artifact
+//           - *soci_index_digest* : <empty>
+// - soci_meta
+//       - schema_version : <varint>    : the version of this schema, see migrations.
 
 // ArtifactsDB is a store for SOCI artifact metadata
 type ArtifactsDb struct {
@@ -73,20 +80,41 @@ var (
 	bucketKeyType           = []byte("type")
 	bucketKeyMediaType      = []byte("media_type")
 	bucketKeyCreatedAt      = []byte("created_at")
+	bucketKeyPinnedBy       = []byte("pinned_by")
+	bucketKeyMeta           = []byte("soci_meta")
+	bucketKeySchemaVersion  = []byte("schema_version")
 
 	// ArtifactEntryTypeIndex indicates that an ArtifactEntry is a SOCI index artifact
 	ArtifactEntryTypeIndex ArtifactEntryType = "soci_index"
 	// ArtifactEntryTypeLayer indicates that an ArtifactEntry is a SOCI layer artifact
 	ArtifactEntryTypeLayer ArtifactEntryType = "soci_layer"
+	// ArtifactEntryTypeIndexList indicates that an ArtifactEntry is a SOCI index list artifact
+	ArtifactEntryTypeIndexList ArtifactEntryType = "soci_index_list"
+	// ArtifactEntryTypeImageBlob indicates that an ArtifactEntry is an image manifest, config or layer
+	// of the image of a SOCI index, e.g. imported from a bundle to serve the layers without the registry
+	ArtifactEntryTypeImageBlob ArtifactEntryType = "image_blob"
 
-	db   *ArtifactsDb
-	once sync.Once
+	db    *ArtifactsDb
+	dbErr error
+	once  sync.Once
 )
 
 var (
 	ErrArtifactBucketNotFound = errors.New("soci_artifacts not found")
+	// ErrArtifactPinned is returned when removing an artifact which is pinned.
+	ErrArtifactPinned = errors.New("artifact is pinned")
+	// ErrUnsupportedSchema is returned when opening an artifacts database written by a newer version.
+	ErrUnsupportedSchema = errors.New("unsupported artifacts db schema")
 )
 
+// migrations upgrade the schema of the artifacts database, the i-th one from version i to i+1.
+// The version of the schema is the number of migrations.
+var migrations = []func(tx *bolt.Tx) error{
+	// Databases created before the schema was versioned may hold entries left by interrupted
+	// writes which can't be decoded.
+	dropUndecodableEntries,
+}
+
 // Get the default artifacts db path
 func ArtifactsDbPath() string {
 	return path.Join(config.DefaultSociSnapshotterRootPath, artifactsDbName)
@@ -114,32 +142,100 @@ type ArtifactEntry struct {
 	MediaType string
 	// Creation time of SOCI artifact.
 	CreatedAt time.Time
+	// Pinned is whether the artifact is pinned by an index, and so must not be removed.
+	// It is ignored by WriteArtifactEntry; artifacts are pinned with PinIndex.
+	Pinned bool
 }
 
-// NewDB returns an instance of an ArtifactsDB
+// NewDB returns an instance of an ArtifactsDB. The schema of the database is upgraded
+// to the current version the first time it's opened by a process.
 func NewDB(path string) (*ArtifactsDb, error) {
 	once.Do(func() {
-		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			log.G(context.Background()).Errorf("can't create or open the file %s", path)
-			return
-		}
-		defer f.Close()
-		database, err := bolt.Open(f.Name(), 0600, nil)
-		if err != nil {
-			log.G(context.Background()).Errorf("can't open the db")
-			return
+		db, dbErr = openDB(path)
+		if dbErr != nil {
+			log.G(context.Background()).WithError(dbErr).Errorf("can't open the db %s", path)
 		}
-		db = &ArtifactsDb{db: database}
 	})
 
 	if db == nil {
-		return nil, fmt.Errorf("artifacts.db is not available")
+		return nil, fmt.Errorf("artifacts.db is not available: %w", dbErr)
 	}
 
 	return db, nil
 }
 
+func openDB(path string) (*ArtifactsDb, error) {
+	database, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(database); err != nil {
+		database.Close()
+		return nil, err
+	}
+	return &ArtifactsDb{db: database}, nil
+}
+
+// migrate upgrades the schema of the database to the current version in a single transaction,
+// so that a database whose upgrade was interrupted is still at the previous version.
+func migrate(database *bolt.DB) error {
+	return database.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketKeyMeta)
+		if err != nil {
+			return err
+		}
+		var version int64
+		if b := meta.Get(bucketKeySchemaVersion); b != nil {
+			if version, err = dbutil.DecodeInt(b); err != nil {
+				return fmt.Errorf("invalid schema version: %w", err)
+			}
+		}
+		if version > int64(len(migrations)) {
+			return fmt.Errorf("schema version %d is newer than version %d: %w", version, len(migrations), ErrUnsupportedSchema)
+		}
+		if version == int64(len(migrations)) {
+			return nil
+		}
+		for i := version; i < int64(len(migrations)); i++ {
+			if err := migrations[i](tx); err != nil {
+				return fmt.Errorf("failed to migrate schema from version %d: %w", i, err)
+			}
+		}
+		b, err := dbutil.EncodeInt(int64(len(migrations)))
+		if err != nil {
+			return err
+		}
+		log.L.WithField("from", version).WithField("to", len(migrations)).Info("migrated artifacts db schema")
+		return meta.Put(bucketKeySchemaVersion, b)
+	})
+}
+
+// dropUndecodableEntries removes the artifact entries which can't be decoded.
+func dropUndecodableEntries(tx *bolt.Tx) error {
+	bucket := tx.Bucket(bucketKeySociArtifacts)
+	if bucket == nil {
+		return nil
+	}
+	var bucketsToRemove [][]byte
+	err := bucket.ForEachBucket(func(k []byte) error {
+		if _, err := loadArtifact(bucket.Bucket(k), string(k)); err != nil {
+			log.L.WithError(err).WithField(logutil.DigestField, string(k)).Warn("removing artifact entry which can't be decoded")
+			bucketsToRemove = append(bucketsToRemove, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Buckets cannot be modified while iterating (see removeOldArtifacts).
+	for _, k := range bucketsToRemove {
+		if err := bucket.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *ArtifactsDb) getIndexArtifactEntries(indexDigest string) ([]ArtifactEntry, error) {
 	artifactEntries := []ArtifactEntry{}
 	err := db.Walk(func(ae *ArtifactEntry) error {
@@ -153,6 +249,17 @@ func (db *ArtifactsDb) getIndexArtifactEntries(indexDigest string) ([]ArtifactEn
 
 }
 
+func (db *ArtifactsDb) getIndexListArtifactEntries(imageDigest string) ([]ArtifactEntry, error) {
+	artifactEntries := []ArtifactEntry{}
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type == ArtifactEntryTypeIndexList && ae.OriginalDigest == imageDigest {
+			artifactEntries = append(artifactEntries, *ae)
+		}
+		return nil
+	})
+	return artifactEntries, err
+}
+
 // Walk applys a function to all ArtifactEntries in the ArtifactsDB
 func (db *ArtifactsDb) Walk(f func(*ArtifactEntry) error) error {
 	err := db.db.View(func(tx *bolt.Tx) error {
@@ -174,22 +281,436 @@ func (db *ArtifactsDb) Walk(f func(*ArtifactEntry) error) error {
 }
 
 // SyncWithLocalStore will sync the artifacts databse with SOCIs local content store, either adding new or removing old artifacts.
-func (db *ArtifactsDb) SyncWithLocalStore(ctx context.Context, blobStore *oci.Store, blobStorePath string, cs content.Store) error {
+// The blobs of the content store are in the directories blobStorePaths, one for each of its tiers.
+func (db *ArtifactsDb) SyncWithLocalStore(ctx context.Context, blobStore orascontent.ReadOnlyStorage, blobStorePaths []string, cs content.Store) error {
 	if err := db.removeOldArtifacts(blobStore); err != nil {
 		return fmt.Errorf("failed to remove old artifacts from db: %w", err)
 	}
-	if err := db.addNewArtifacts(ctx, blobStorePath, cs); err != nil {
+	if err := db.addNewArtifacts(ctx, blobStorePaths, cs); err != nil {
 		return fmt.Errorf("failed to add new artifacts to db: %w", err)
 	}
 	return nil
 }
 
+// VerifyResult summarizes the problems found and fixed by VerifyLocalStore.
+type VerifyResult struct {
+	// RemovedBlobs are the digests of the blobs removed from SOCIs local content store
+	// because their content did not match their digest.
+	RemovedBlobs []string
+	// RepairedEntries are the digests of the artifacts whose size was corrected in the artifacts database.
+	RepairedEntries []string
+	// RemovedEntries are the digests of the artifacts removed from the artifacts database
+	// because their entry could not be decoded.
+	RemovedEntries []string
+}
+
+// VerifyLocalStore validates every blob in SOCIs local content store against its digest and the size
+// recorded for it in the artifacts database. Corrupted blobs are removed from the content store,
+// so that they are fetched or rebuilt again, and corrupted or inconsistent entries are removed or repaired.
+// Entries of removed blobs are cleaned up by the next SyncWithLocalStore.
+func (db *ArtifactsDb) VerifyLocalStore(ctx context.Context, blobStorePaths []string) (VerifyResult, error) {
+	var result VerifyResult
+	sizes := make(map[string]int64)
+	err := walkBlobs(blobStorePaths, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// Blobs are stored in <blobStorePath>/<algorithm>/<encoded digest>
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(path))), d.Name())
+		if err := dgst.Validate(); err != nil {
+			log.G(ctx).WithField("path", path).Debug("skipping file which is not a blob")
+			return nil
+		}
+		size, err := verifyBlob(path, dgst)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField(logutil.DigestField, dgst).Warn("removing corrupted blob")
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			result.RemovedBlobs = append(result.RemovedBlobs, dgst.String())
+			return nil
+		}
+		sizes[dgst.String()] = size
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to verify blobs: %w", err)
+	}
+
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return nil
+		}
+		var (
+			bucketsToRemove [][]byte
+			entriesToRepair []*ArtifactEntry
+		)
+		bucket.ForEachBucket(func(k []byte) error {
+			ae, err := loadArtifact(bucket.Bucket(k), string(k))
+			if err != nil {
+				log.G(ctx).WithError(err).WithField(logutil.DigestField, string(k)).Warn("removing corrupted artifact entry")
+				bucketsToRemove = append(bucketsToRemove, k)
+				return nil
+			}
+			if size, ok := sizes[ae.Digest]; ok && size != ae.Size {
+				log.G(ctx).WithField(logutil.DigestField, ae.Digest).WithField("recorded", ae.Size).WithField("actual", size).
+					Warn("repairing size of artifact entry")
+				ae.Size = size
+				entriesToRepair = append(entriesToRepair, ae)
+			}
+			return nil
+		})
+		// Buckets cannot be modified while iterating (see removeOldArtifacts).
+		for _, k := range bucketsToRemove {
+			if err := bucket.DeleteBucket(k); err != nil {
+				return err
+			}
+			result.RemovedEntries = append(result.RemovedEntries, string(k))
+		}
+		for _, ae := range entriesToRepair {
+			if err := putArtifactEntry(bucket, ae); err != nil {
+				return err
+			}
+			result.RepairedEntries = append(result.RepairedEntries, ae.Digest)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to verify artifacts db: %w", err)
+	}
+	return result, nil
+}
+
+// GCResult summarizes the artifacts removed by GarbageCollect.
+type GCResult struct {
+	// RemovedIndexes are the digests of the removed indexes.
+	RemovedIndexes []string
+	// RemovedIndexLists are the digests of the removed index lists.
+	RemovedIndexLists []string
+	// RemovedZtocs are the digests of the removed zTOCs.
+	RemovedZtocs []string
+	// RemovedImageBlobs are the digests of the removed image manifests, configs and layers.
+	RemovedImageBlobs []string
+}
+
+// LiveFunc returns whether the image for which the index or index list `ae` was created still exists,
+// or the artifact is still in use otherwise. It's called before the artifacts database is locked.
+type LiveFunc func(ae *ArtifactEntry) (bool, error)
+
+// GarbageCollect removes the indexes and index lists whose image doesn't exist anymore according to `isLive`,
+// the zTOCs which aren't referenced by any of the remaining indexes, and the image blobs whose image has
+// no remaining index, from the artifacts database and from SOCIs local content store whose blobs are in
+// blobStorePaths. Pinned artifacts are never removed.
+// Which artifacts are removed is decided from a snapshot of the database, so that the database isn't
+// locked while `isLive` asks e.g. containerd. Artifacts written or pinned since, and the artifacts they
+// reference, are kept.
+// If dryRun is true, the artifacts which would be removed are returned but nothing is removed.
+func (db *ArtifactsDb) GarbageCollect(ctx context.Context, blobStorePaths []string, isLive LiveFunc, dryRun bool) (GCResult, error) {
+	snapshot, err := db.gcSnapshot()
+	if err != nil {
+		return GCResult{}, fmt.Errorf("failed to garbage collect artifacts: %w", err)
+	}
+	result, err := gcCandidates(blobStorePaths, snapshot, isLive)
+	if err != nil {
+		return GCResult{}, fmt.Errorf("failed to garbage collect artifacts: %w", err)
+	}
+	if dryRun {
+		return result, nil
+	}
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return nil
+		}
+		keep := make(map[string]struct{})
+		keepImages := make(map[string]struct{})
+		err = bucket.ForEachBucket(func(k []byte) error {
+			ae, err := loadArtifact(bucket.Bucket(k), string(k))
+			if err != nil {
+				return err
+			}
+			if old, ok := snapshot[ae.Digest]; ok && old.CreatedAt.Equal(ae.CreatedAt) && !ae.Pinned {
+				return nil
+			}
+			keep[ae.Digest] = struct{}{}
+			if ae.Type == ArtifactEntryTypeIndex {
+				keepImages[ae.ImageDigest] = struct{}{}
+			}
+			refs, err := gcReferences(blobStorePaths, ae)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				keep[ref] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		kept := func(dgst string) bool {
+			if _, ok := keep[dgst]; ok {
+				return true
+			}
+			if ae := snapshot[dgst]; ae.Type == ArtifactEntryTypeImageBlob {
+				_, ok := keepImages[ae.ImageDigest]
+				return ok
+			}
+			return false
+		}
+		result.RemovedIndexLists = filterDigests(result.RemovedIndexLists, kept)
+		result.RemovedIndexes = filterDigests(result.RemovedIndexes, kept)
+		result.RemovedZtocs = filterDigests(result.RemovedZtocs, kept)
+		result.RemovedImageBlobs = filterDigests(result.RemovedImageBlobs, kept)
+
+		var removed []string
+		removed = append(removed, result.RemovedIndexLists...)
+		removed = append(removed, result.RemovedIndexes...)
+		removed = append(removed, result.RemovedZtocs...)
+		removed = append(removed, result.RemovedImageBlobs...)
+		for _, dgst := range removed {
+			if err := bucket.DeleteBucket([]byte(dgst)); err != nil {
+				return err
+			}
+			// Blobs are removed before the transaction commits. If it fails, the entries are left
+			// to the next GarbageCollect, which tolerates their blobs being removed already.
+			if d, err := digest.Parse(dgst); err == nil {
+				for _, blobStorePath := range blobStorePaths {
+					if err := os.Remove(blobPath(blobStorePath, d)); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+			log.G(ctx).WithField(logutil.DigestField, dgst).Debug("removed unused artifact")
+		}
+		return nil
+	})
+	if err != nil {
+		return GCResult{}, fmt.Errorf("failed to garbage collect artifacts: %w", err)
+	}
+	return result, nil
+}
+
+// gcSnapshot returns the entries of the artifacts database by digest.
+func (db *ArtifactsDb) gcSnapshot() (map[string]*ArtifactEntry, error) {
+	snapshot := make(map[string]*ArtifactEntry)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return nil
+		}
+		return bucket.ForEachBucket(func(k []byte) error {
+			ae, err := loadArtifact(bucket.Bucket(k), string(k))
+			if err != nil {
+				return err
+			}
+			snapshot[ae.Digest] = ae
+			return nil
+		})
+	})
+	return snapshot, err
+}
+
+// gcCandidates returns the artifacts of `snapshot` which GarbageCollect removes.
+func gcCandidates(blobStorePaths []string, snapshot map[string]*ArtifactEntry, isLive LiveFunc) (GCResult, error) {
+	var (
+		result                            GCResult
+		lists, indexes, ztocs, imageBlobs []*ArtifactEntry
+	)
+	for _, ae := range snapshot {
+		switch ae.Type {
+		case ArtifactEntryTypeIndexList:
+			lists = append(lists, ae)
+		case ArtifactEntryTypeIndex:
+			indexes = append(indexes, ae)
+		case ArtifactEntryTypeImageBlob:
+			imageBlobs = append(imageBlobs, ae)
+		default:
+			ztocs = append(ztocs, ae)
+		}
+	}
+
+	// The indexes of the remaining index lists are kept, even if their own image manifest
+	// doesn't exist locally, so that the lists can still be pushed.
+	referenced := make(map[string]struct{})
+	liveImages := make(map[string]struct{})
+	for _, ae := range lists {
+		live, err := isLive(ae)
+		if err != nil {
+			return result, fmt.Errorf("failed to check whether the image of index list %s exists: %w", ae.Digest, err)
+		}
+		if !live && !ae.Pinned {
+			result.RemovedIndexLists = append(result.RemovedIndexLists, ae.Digest)
+			continue
+		}
+		refs, err := gcReferences(blobStorePaths, ae)
+		if err != nil {
+			return result, err
+		}
+		for _, ref := range refs {
+			referenced[ref] = struct{}{}
+		}
+	}
+	for _, ae := range indexes {
+		live, err := isLive(ae)
+		if err != nil {
+			return result, fmt.Errorf("failed to check whether the image of index %s exists: %w", ae.Digest, err)
+		}
+		if _, ok := referenced[ae.Digest]; !ok && !live && !ae.Pinned {
+			result.RemovedIndexes = append(result.RemovedIndexes, ae.Digest)
+			continue
+		}
+		liveImages[ae.ImageDigest] = struct{}{}
+		refs, err := gcReferences(blobStorePaths, ae)
+		if err != nil {
+			return result, err
+		}
+		for _, ref := range refs {
+			referenced[ref] = struct{}{}
+		}
+	}
+	for _, ae := range ztocs {
+		if _, ok := referenced[ae.Digest]; !ok && !ae.Pinned {
+			result.RemovedZtocs = append(result.RemovedZtocs, ae.Digest)
+		}
+	}
+	for _, ae := range imageBlobs {
+		if _, ok := liveImages[ae.ImageDigest]; !ok && !ae.Pinned {
+			result.RemovedImageBlobs = append(result.RemovedImageBlobs, ae.Digest)
+		}
+	}
+	return result, nil
+}
+
+// gcReferences returns the digests of the artifacts referenced by the index or index list `ae`:
+// the indexes of an index list, which are only known from its contents, and the zTOCs of an index.
+func gcReferences(blobStorePaths []string, ae *ArtifactEntry) ([]string, error) {
+	var refs []string
+	switch ae.Type {
+	case ArtifactEntryTypeIndexList:
+		list, err := readIndexListBlob(blobStorePaths, ae.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index list %s, the artifacts database may need to be rebuilt: %w", ae.Digest, err)
+		}
+		for _, desc := range list.Manifests {
+			refs = append(refs, desc.Digest.String())
+		}
+	case ArtifactEntryTypeIndex:
+		index, err := readIndexBlob(blobStorePaths, ae.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index %s, the artifacts database may need to be rebuilt: %w", ae.Digest, err)
+		}
+		for _, blob := range index.Blobs {
+			refs = append(refs, blob.Digest.String())
+		}
+	}
+	return refs, nil
+}
+
+// filterDigests returns the digests for which `kept` returns false.
+func filterDigests(digests []string, kept func(string) bool) []string {
+	var filtered []string
+	for _, dgst := range digests {
+		if !kept(dgst) {
+			filtered = append(filtered, dgst)
+		}
+	}
+	return filtered
+}
+
+// blobPath returns the path of the blob `dgst` in SOCIs local content store at blobStorePath.
+func blobPath(blobStorePath string, dgst digest.Digest) string {
+	return filepath.Join(blobStorePath, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// walkBlobs walks the blobs of SOCIs local content store in each of blobStorePaths.
+func walkBlobs(blobStorePaths []string, fn fs.WalkDirFunc) error {
+	for _, blobStorePath := range blobStorePaths {
+		if _, err := os.Stat(blobStorePath); os.IsNotExist(err) {
+			continue
+		}
+		if err := filepath.WalkDir(blobStorePath, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openBlob opens the blob `dgst` from the first of blobStorePaths which has it.
+func openBlob(blobStorePaths []string, dgst string) (*os.File, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return nil, err
+	}
+	for _, blobStorePath := range blobStorePaths {
+		f, err := os.Open(blobPath(blobStorePath, d))
+		if err == nil || !os.IsNotExist(err) {
+			return f, err
+		}
+	}
+	return nil, fmt.Errorf("blob %s: %w", dgst, os.ErrNotExist)
+}
+
+// readIndexListBlob reads the index list `dgst` from SOCIs local content store.
+func readIndexListBlob(blobStorePaths []string, dgst string) (*ocispec.Index, error) {
+	f, err := openBlob(blobStorePaths, dgst)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var list ocispec.Index
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// readIndexBlob reads the index `dgst` from SOCIs local content store.
+func readIndexBlob(blobStorePaths []string, dgst string) (*Index, error) {
+	f, err := openBlob(blobStorePaths, dgst)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var index Index
+	if err := DecodeIndex(f, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// verifyBlob checks that the content of the file at path matches dgst and returns its size.
+func verifyBlob(path string, dgst digest.Digest) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	verifier := dgst.Verifier()
+	size, err := io.Copy(verifier, f)
+	if err != nil {
+		return 0, err
+	}
+	if !verifier.Verified() {
+		return 0, fmt.Errorf("content does not match digest %s", dgst)
+	}
+	return size, nil
+}
+
 // removeOldArtifacts will remove any artifacts from the artifacts database that
 // no longer exist in SOCIs local content store. NOTE: Removing buckets while iterating
 // (bucket.ForEach) causes unexpected behavior (see: https://github.com/boltdb/bolt/issues/426).
 // This implementation works around this issue by appending buckets to a slice when
 // iterating and removing them after.
-func (db *ArtifactsDb) removeOldArtifacts(blobStore *oci.Store) error {
+func (db *ArtifactsDb) removeOldArtifacts(blobStore orascontent.ReadOnlyStorage) error {
 	err := db.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := getArtifactsBucket(tx)
 		if err != nil {
@@ -224,14 +745,14 @@ func (db *ArtifactsDb) removeOldArtifacts(blobStore *oci.Store) error {
 }
 
 // addNewArtifacts will add any new artifacts discovered in SOCIs local content store to the artifacts database.
-func (db *ArtifactsDb) addNewArtifacts(ctx context.Context, blobStorePath string, cs content.Store) error {
+func (db *ArtifactsDb) addNewArtifacts(ctx context.Context, blobStorePaths []string, cs content.Store) error {
 	addHashPrefix := func(name string) string {
 		if len(name) == 64 {
 			return fmt.Sprintf("sha256:%s", name)
 		}
 		return fmt.Sprintf("sha512:%s", name)
 	}
-	return filepath.WalkDir(blobStorePath, func(path string, d fs.DirEntry, err error) error {
+	return walkBlobs(blobStorePaths, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -246,13 +767,12 @@ func (db *ArtifactsDb) addNewArtifacts(ctx context.Context, blobStorePath string
 		if info.Size() < 10 {
 			return nil
 		}
-		f, err := os.Open(path)
+		b, err := os.ReadFile(path)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 		var sociIndex Index
-		if err = DecodeIndex(f, &sociIndex); err != nil {
+		if err = UnmarshalIndex(b, &sociIndex); err != nil {
 			// skip: entry is a ztoc
 			return nil
 		}
@@ -261,7 +781,31 @@ func (db *ArtifactsDb) addNewArtifacts(ctx context.Context, blobStorePath string
 		if err != nil && !errors.Is(err, ErrArtifactBucketNotFound) && !errors.Is(err, errdefs.ErrNotFound) {
 			return err
 		}
-		if ae == nil {
+		if ae != nil {
+			return nil
+		}
+		if sociIndex.MediaType == ocispec.MediaTypeImageIndex {
+			var list ocispec.Index
+			if err := json.Unmarshal(b, &list); err != nil {
+				return err
+			}
+			imageDigest, ok := list.Annotations[IndexListAnnotationImageDigest]
+			if !ok {
+				// skip: entry isn't a SOCI index list
+				return nil
+			}
+			return db.WriteArtifactEntry(&ArtifactEntry{
+				Size:           info.Size(),
+				Digest:         indexDigest,
+				OriginalDigest: imageDigest,
+				ImageDigest:    imageDigest,
+				Type:           ArtifactEntryTypeIndexList,
+				Location:       imageDigest,
+				MediaType:      ocispec.MediaTypeImageIndex,
+				CreatedAt:      time.Now(),
+			})
+		}
+		if sociIndex.Subject != nil {
 			manifestDigest := sociIndex.Subject.Digest.String()
 			platform, err := images.Platforms(ctx, cs, ocispec.Descriptor{
 				MediaType: ocispec.MediaTypeImageManifest,
@@ -270,7 +814,21 @@ func (db *ArtifactsDb) addNewArtifacts(ctx context.Context, blobStorePath string
 				return err
 			}
 
-			indexEntry := &ArtifactEntry{
+			// The index is added along with its zTOCs, so that an interrupted sync doesn't leave
+			// an index whose zTOCs are never added.
+			var entries []*ArtifactEntry
+			for _, zt := range sociIndex.Blobs {
+				entries = append(entries, &ArtifactEntry{
+					Size:           zt.Size,
+					Digest:         zt.Digest.String(),
+					OriginalDigest: zt.Annotations[IndexAnnotationImageLayerDigest],
+					Type:           ArtifactEntryTypeLayer,
+					Location:       zt.Annotations[IndexAnnotationImageLayerDigest],
+					MediaType:      SociLayerMediaType,
+					CreatedAt:      time.Now(),
+				})
+			}
+			entries = append(entries, &ArtifactEntry{
 				Size:           info.Size(),
 				Digest:         indexDigest,
 				OriginalDigest: manifestDigest,
@@ -280,24 +838,10 @@ func (db *ArtifactsDb) addNewArtifacts(ctx context.Context, blobStorePath string
 				Location:       manifestDigest,
 				MediaType:      sociIndex.MediaType,
 				CreatedAt:      time.Now(),
-			}
-			if err = db.WriteArtifactEntry(indexEntry); err != nil {
+			})
+			if err = db.WriteArtifactEntries(entries...); err != nil {
 				return err
 			}
-			for _, zt := range sociIndex.Blobs {
-				ztocEntry := &ArtifactEntry{
-					Size:           zt.Size,
-					Digest:         zt.Digest.String(),
-					OriginalDigest: zt.Annotations[IndexAnnotationImageLayerDigest],
-					Type:           ArtifactEntryTypeLayer,
-					Location:       zt.Annotations[IndexAnnotationImageLayerDigest],
-					MediaType:      SociLayerMediaType,
-					CreatedAt:      time.Now(),
-				}
-				if err := db.WriteArtifactEntry(ztocEntry); err != nil {
-					return err
-				}
-			}
 		}
 		return nil
 	})
@@ -347,14 +891,18 @@ func (db *ArtifactsDb) RemoveArtifactEntryByIndexDigest(digest string) error {
 			return fmt.Errorf("the index of the digest %v doesn't exist", digest)
 		}
 
-		if indexBucket(dgstBucket) {
-			return bucket.DeleteBucket([]byte(digest))
+		if !indexBucket(dgstBucket) {
+			return fmt.Errorf("the digest %v does not correspond to an index", digest)
 		}
-		return fmt.Errorf("the digest %v does not correspond to an index", digest)
+		if pinnedBucket(dgstBucket) {
+			return fmt.Errorf("index %v: %w", digest, ErrArtifactPinned)
+		}
+		return bucket.DeleteBucket([]byte(digest))
 	})
 }
 
-// RemoveArtifactEntryByIndexDigest removes an index's artifact entry using the image digest
+// RemoveArtifactEntryByIndexDigest removes an index's artifact entry using the image digest.
+// No entry is removed if any of the indexes of the image is pinned.
 func (db *ArtifactsDb) RemoveArtifactEntryByImageDigest(digest string) error {
 	return db.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := getArtifactsBucket(tx)
@@ -362,21 +910,120 @@ func (db *ArtifactsDb) RemoveArtifactEntryByImageDigest(digest string) error {
 			return err
 		}
 
+		var bucketsToRemove [][]byte
 		c := bucket.Cursor()
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
 			artifactBucket := bucket.Bucket(k)
 			if indexBucket(artifactBucket) && hasImageDigest(artifactBucket, digest) {
-				bucket.DeleteBucket(k)
+				if pinnedBucket(artifactBucket) {
+					return fmt.Errorf("index %s of image %s: %w", k, digest, ErrArtifactPinned)
+				}
+				bucketsToRemove = append(bucketsToRemove, k)
+			}
+		}
+		for _, k := range bucketsToRemove {
+			if err := bucket.DeleteBucket(k); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
 }
 
-// Determines whether a bucket represents an index, as opposed to a zTOC
+// PinIndex pins the index `indexDigest` and the zTOCs it references, so that they can't be
+// removed from the artifacts database (e.g. by `soci index rm`) until the index is unpinned.
+// This is meant for images which must always start lazily, e.g. under disk pressure.
+// The index is read from `store` to find its zTOCs.
+func (db *ArtifactsDb) PinIndex(ctx context.Context, store orascontent.Fetcher, indexDigest string) error {
+	ae, err := db.GetArtifactEntry(indexDigest)
+	if err != nil {
+		return err
+	}
+	if ae.Type != ArtifactEntryTypeIndex {
+		return fmt.Errorf("the digest %v does not correspond to an index", indexDigest)
+	}
+	r, err := store.Fetch(ctx, ocispec.Descriptor{
+		MediaType: ae.MediaType,
+		Digest:    digest.Digest(ae.Digest),
+		Size:      ae.Size,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch index %v: %w", indexDigest, err)
+	}
+	defer r.Close()
+	var index Index
+	if err := DecodeIndex(r, &index); err != nil {
+		return fmt.Errorf("failed to decode index %v: %w", indexDigest, err)
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return err
+		}
+		// The index may have been removed since it was read.
+		if bucket.Bucket([]byte(indexDigest)) == nil {
+			return fmt.Errorf("couldn't retrieve artifact for %s, %w", indexDigest, errdefs.ErrNotFound)
+		}
+		digests := []string{indexDigest}
+		for _, blob := range index.Blobs {
+			digests = append(digests, blob.Digest.String())
+		}
+		for _, dgst := range digests {
+			artifactBkt := bucket.Bucket([]byte(dgst))
+			if artifactBkt == nil {
+				// zTOCs removed from the database by a sync can't be pinned;
+				// they are added back by the next sync and pinned again by the next PinIndex.
+				log.G(ctx).WithField(logutil.DigestField, dgst).Debug("skipping pinning of artifact which is not in the db")
+				continue
+			}
+			pinnedBy, err := artifactBkt.CreateBucketIfNotExists(bucketKeyPinnedBy)
+			if err != nil {
+				return err
+			}
+			if err := pinnedBy.Put([]byte(indexDigest), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UnpinIndex unpins the index `indexDigest` and the zTOCs it pinned.
+// zTOCs shared with other pinned indexes remain pinned.
+func (db *ArtifactsDb) UnpinIndex(indexDigest string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if bucket.Bucket([]byte(indexDigest)) == nil {
+			return fmt.Errorf("couldn't retrieve artifact for %s, %w", indexDigest, errdefs.ErrNotFound)
+		}
+		return bucket.ForEachBucket(func(k []byte) error {
+			pinnedBy := bucket.Bucket(k).Bucket(bucketKeyPinnedBy)
+			if pinnedBy == nil {
+				return nil
+			}
+			return pinnedBy.Delete([]byte(indexDigest))
+		})
+	})
+}
+
+// Determines whether a bucket represents an index or an index list, as opposed to a zTOC
 func indexBucket(b *bolt.Bucket) bool {
 	mt := string(b.Get(bucketKeyMediaType))
-	return mt == ocispec.MediaTypeImageManifest
+	return mt == ocispec.MediaTypeImageManifest || ArtifactEntryType(b.Get(bucketKeyType)) == ArtifactEntryTypeIndexList
+}
+
+// Determines whether a bucket represents a pinned artifact
+func pinnedBucket(b *bolt.Bucket) bool {
+	pinnedBy := b.Bucket(bucketKeyPinnedBy)
+	if pinnedBy == nil {
+		return false
+	}
+	k, _ := pinnedBy.Cursor().First()
+	return k != nil
 }
 
 // Determines whether a bucket's image digest is the same as digest
@@ -392,15 +1039,28 @@ func (db *ArtifactsDb) WriteArtifactEntry(entry *ArtifactEntry) error {
 	if entry == nil {
 		return fmt.Errorf("no entry to write")
 	}
-	err := db.db.Update(func(tx *bolt.Tx) error {
+	return db.WriteArtifactEntries(entry)
+}
+
+// WriteArtifactEntries stores `entries` into the ArtifactsDB in a single transaction,
+// so that either all or none of them are stored. Like WriteArtifactEntry, it overwrites
+// the artifacts which are already in the ArtifactsDB.
+func (db *ArtifactsDb) WriteArtifactEntries(entries ...*ArtifactEntry) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(bucketKeySociArtifacts)
 		if err != nil {
 			return err
 		}
-		err = putArtifactEntry(bucket, entry)
-		return err
+		for _, entry := range entries {
+			if entry == nil {
+				return fmt.Errorf("no entry to write")
+			}
+			if err := putArtifactEntry(bucket, entry); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
-	return err
 }
 
 func getArtifactsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
@@ -443,6 +1103,7 @@ func loadArtifact(artifactBkt *bolt.Bucket, digest string) (*ArtifactEntry, erro
 	ae.Platform = string(artifactBkt.Get(bucketKeyPlatform))
 	ae.MediaType = string(artifactBkt.Get(bucketKeyMediaType))
 	ae.CreatedAt = createdAt
+	ae.Pinned = pinnedBucket(artifactBkt)
 	return &ae, nil
 }
 
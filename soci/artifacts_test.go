@@ -17,10 +17,25 @@
 package soci
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	bolt "go.etcd.io/bbolt"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
 )
 
 func TestGetIndexArtifactEntries(t *testing.T) {
@@ -185,6 +200,433 @@ func TestArtifactEntry_ReadWrite_AtomicDbOperations(t *testing.T) {
 	})
 }
 
+func TestVerifyLocalStore(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStorePath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(blobStorePath, "sha256"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeBlob := func(dgst digest.Digest, content string) string {
+		path := filepath.Join(blobStorePath, "sha256", dgst.Encoded())
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	validDgst := digest.FromString("valid ztoc")
+	writeBlob(validDgst, "valid ztoc")
+	corruptedDgst := digest.FromString("corrupted ztoc")
+	corruptedPath := writeBlob(corruptedDgst, "corrupted zto")
+
+	// The entry of the valid ztoc has a wrong size.
+	if err := db.WriteArtifactEntry(&ArtifactEntry{
+		Size:   1,
+		Digest: validDgst.String(),
+		Type:   ArtifactEntryTypeLayer,
+	}); err != nil {
+		t.Fatalf("can't put ArtifactEntry to a bucket")
+	}
+
+	result, err := db.VerifyLocalStore(context.Background(), []string{blobStorePath})
+	if err != nil {
+		t.Fatalf("failed to verify local store: %v", err)
+	}
+	if len(result.RemovedBlobs) != 1 || result.RemovedBlobs[0] != corruptedDgst.String() {
+		t.Fatalf("unexpected removed blobs; expected = [%s], got = %v", corruptedDgst, result.RemovedBlobs)
+	}
+	if _, err := os.Stat(corruptedPath); !os.IsNotExist(err) {
+		t.Fatalf("corrupted blob was not removed")
+	}
+	if len(result.RepairedEntries) != 1 || result.RepairedEntries[0] != validDgst.String() {
+		t.Fatalf("unexpected repaired entries; expected = [%s], got = %v", validDgst, result.RepairedEntries)
+	}
+	ae, err := db.GetArtifactEntry(validDgst.String())
+	if err != nil {
+		t.Fatalf("cannot get artifact entry with the digest=%s", validDgst)
+	}
+	if ae.Size != int64(len("valid ztoc")) {
+		t.Fatalf("unexpected size of repaired entry; expected = %d, got = %d", len("valid ztoc"), ae.Size)
+	}
+}
+
+func TestPinIndex(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	ctx := context.Background()
+	store := memory.New()
+	imageDigest := digest.FromString("image").String()
+	ztocDgst := digest.FromString("shared ztoc")
+
+	// Two indexes of the same image share a zTOC.
+	var indexDigests []string
+	for _, name := range []string{"index1", "index2"} {
+		ztocs := []ocispec.Descriptor{{MediaType: SociLayerMediaType, Digest: ztocDgst, Size: 11}}
+		b, err := MarshalIndex(NewIndex(ztocs, nil, map[string]string{"name": name}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.WriteArtifactEntry(&ArtifactEntry{
+			Size:        desc.Size,
+			Digest:      desc.Digest.String(),
+			ImageDigest: imageDigest,
+			Type:        ArtifactEntryTypeIndex,
+			MediaType:   desc.MediaType,
+		}); err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+		indexDigests = append(indexDigests, desc.Digest.String())
+	}
+	if err := db.WriteArtifactEntry(&ArtifactEntry{Size: 11, Digest: ztocDgst.String(), Type: ArtifactEntryTypeLayer}); err != nil {
+		t.Fatalf("can't put ArtifactEntry to a bucket")
+	}
+
+	pinned := func(dgst string) bool {
+		ae, err := db.GetArtifactEntry(dgst)
+		if err != nil {
+			t.Fatalf("cannot get artifact entry with the digest=%s", dgst)
+		}
+		return ae.Pinned
+	}
+	for _, dgst := range indexDigests {
+		if err := db.PinIndex(ctx, store, dgst); err != nil {
+			t.Fatalf("failed to pin index %s: %v", dgst, err)
+		}
+	}
+	if !pinned(indexDigests[0]) || !pinned(ztocDgst.String()) {
+		t.Fatalf("index and ztoc should be pinned")
+	}
+	if err := db.RemoveArtifactEntryByIndexDigest(indexDigests[0]); !errors.Is(err, ErrArtifactPinned) {
+		t.Fatalf("removing a pinned index should fail with ErrArtifactPinned, got %v", err)
+	}
+	if err := db.RemoveArtifactEntryByImageDigest(imageDigest); !errors.Is(err, ErrArtifactPinned) {
+		t.Fatalf("removing the indexes of an image with a pinned index should fail with ErrArtifactPinned, got %v", err)
+	}
+
+	if err := db.UnpinIndex(indexDigests[0]); err != nil {
+		t.Fatalf("failed to unpin index: %v", err)
+	}
+	if pinned(indexDigests[0]) {
+		t.Fatalf("index should not be pinned after unpinning it")
+	}
+	if !pinned(ztocDgst.String()) {
+		t.Fatalf("ztoc should remain pinned by the other index")
+	}
+	if err := db.RemoveArtifactEntryByIndexDigest(indexDigests[0]); err != nil {
+		t.Fatalf("failed to remove unpinned index: %v", err)
+	}
+	if err := db.RemoveArtifactEntryByImageDigest(imageDigest); !errors.Is(err, ErrArtifactPinned) {
+		t.Fatalf("removing the indexes of an image with a pinned index should fail with ErrArtifactPinned, got %v", err)
+	}
+	if !pinned(indexDigests[1]) {
+		t.Fatalf("no index should be removed when removing the indexes of an image fails")
+	}
+
+	if err := db.UnpinIndex(indexDigests[1]); err != nil {
+		t.Fatalf("failed to unpin index: %v", err)
+	}
+	if pinned(ztocDgst.String()) {
+		t.Fatalf("ztoc should not be pinned once all its indexes are unpinned")
+	}
+	if err := db.RemoveArtifactEntryByImageDigest(imageDigest); err != nil {
+		t.Fatalf("failed to remove the indexes of the image: %v", err)
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	ctx := context.Background()
+	storePath := t.TempDir()
+	store, err := oci.New(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobStorePath := filepath.Join(storePath, "blobs")
+
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	ztocs := make([]ocispec.Descriptor, 5)
+	for i := range ztocs {
+		ztocs[i] = push(SociLayerMediaType, []byte(fmt.Sprintf("ztoc%d", i)))
+		if err := db.WriteArtifactEntry(&ArtifactEntry{Size: ztocs[i].Size, Digest: ztocs[i].Digest.String(), Type: ArtifactEntryTypeLayer}); err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+	}
+	writeIndex := func(image string, blobs ...ocispec.Descriptor) string {
+		b, err := MarshalIndex(NewIndex(blobs, nil, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := push(ocispec.MediaTypeImageManifest, b)
+		if err := db.WriteArtifactEntry(&ArtifactEntry{
+			Size:        desc.Size,
+			Digest:      desc.Digest.String(),
+			ImageDigest: image,
+			Type:        ArtifactEntryTypeIndex,
+			MediaType:   desc.MediaType,
+		}); err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+		return desc.Digest.String()
+	}
+	writeIndexList := func(image string, indexes ...string) string {
+		list := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex}
+		for _, dgst := range indexes {
+			list.Manifests = append(list.Manifests, ocispec.Descriptor{Digest: digest.Digest(dgst)})
+		}
+		b, err := json.Marshal(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := push(ocispec.MediaTypeImageIndex, b)
+		if err := db.WriteArtifactEntry(&ArtifactEntry{
+			Size:        desc.Size,
+			Digest:      desc.Digest.String(),
+			ImageDigest: image,
+			Type:        ArtifactEntryTypeIndexList,
+			MediaType:   desc.MediaType,
+		}); err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+		return desc.Digest.String()
+	}
+	const liveImage = "live"
+	writeIndex(liveImage, ztocs[0], ztocs[1])
+	removedIndex := writeIndex("removed", ztocs[1], ztocs[2])
+	pinnedIndex := writeIndex("pinned", ztocs[3])
+	if err := db.PinIndex(ctx, store, pinnedIndex); err != nil {
+		t.Fatalf("failed to pin index: %v", err)
+	}
+	// The index of a platform whose manifest isn't in containerd is kept by the live index list.
+	listedIndex := writeIndex("listed")
+	writeIndexList(liveImage, listedIndex)
+	removedList := writeIndexList("removed", removedIndex)
+	// Image blobs are removed along with the last index of their image.
+	writeImageBlob := func(image, content string) string {
+		desc := push(ocispec.MediaTypeImageLayerGzip, []byte(content))
+		if err := db.WriteArtifactEntry(&ArtifactEntry{
+			Size:        desc.Size,
+			Digest:      desc.Digest.String(),
+			ImageDigest: image,
+			Type:        ArtifactEntryTypeImageBlob,
+			MediaType:   desc.MediaType,
+		}); err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+		return desc.Digest.String()
+	}
+	writeImageBlob(liveImage, "live layer")
+	removedBlob := writeImageBlob("removed", "removed layer")
+	isLive := func(ae *ArtifactEntry) (bool, error) {
+		return ae.ImageDigest == liveImage, nil
+	}
+
+	// ztoc1 is shared with the live index, ztoc4 isn't referenced by any index.
+	expected := GCResult{
+		RemovedIndexes:    []string{removedIndex},
+		RemovedIndexLists: []string{removedList},
+		RemovedZtocs:      []string{ztocs[2].Digest.String(), ztocs[4].Digest.String()},
+		RemovedImageBlobs: []string{removedBlob},
+	}
+	sort.Strings(expected.RemovedZtocs)
+	for _, dryRun := range []bool{true, false} {
+		result, err := db.GarbageCollect(ctx, []string{blobStorePath}, isLive, dryRun)
+		if err != nil {
+			t.Fatalf("failed to garbage collect (dry run: %v): %v", dryRun, err)
+		}
+		sort.Strings(result.RemovedZtocs)
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("unexpected result (dry run: %v); expected = %+v, got = %+v", dryRun, expected, result)
+		}
+		_, err = db.GetArtifactEntry(removedIndex)
+		if removed := errors.Is(err, errdefs.ErrNotFound); removed == dryRun {
+			t.Fatalf("unexpected removal of index (dry run: %v): %v", dryRun, err)
+		}
+	}
+	removed := append(append(expected.RemovedIndexes, expected.RemovedIndexLists...), expected.RemovedZtocs...)
+	for _, dgst := range append(removed, expected.RemovedImageBlobs...) {
+		if _, err := os.Stat(blobPath(blobStorePath, digest.Digest(dgst))); !os.IsNotExist(err) {
+			t.Fatalf("blob %s was not removed", dgst)
+		}
+	}
+	var remaining int
+	db.Walk(func(ae *ArtifactEntry) error {
+		remaining++
+		return nil
+	})
+	if remaining != 8 {
+		t.Fatalf("unexpected number of remaining artifacts; expected = 8, got = %d", remaining)
+	}
+}
+
+func TestGarbageCollectConcurrentWrite(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	ctx := context.Background()
+	storePath := t.TempDir()
+	store, err := oci.New(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobStorePath := filepath.Join(storePath, "blobs")
+
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	ztoc := push(SociLayerMediaType, []byte("ztoc"))
+	if err := db.WriteArtifactEntry(&ArtifactEntry{Size: ztoc.Size, Digest: ztoc.Digest.String(), Type: ArtifactEntryTypeLayer}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := MarshalIndex(NewIndex([]ocispec.Descriptor{ztoc}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := push(ocispec.MediaTypeImageManifest, b)
+	if err := db.WriteArtifactEntry(&ArtifactEntry{Size: index.Size, Digest: index.Digest.String(), ImageDigest: "removed", Type: ArtifactEntryTypeIndex}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index is rewritten for a new image while its liveness is checked, e.g. by `soci create`,
+	// which the database isn't locked against.
+	isLive := func(ae *ArtifactEntry) (bool, error) {
+		err := db.WriteArtifactEntry(&ArtifactEntry{
+			Size:        index.Size,
+			Digest:      index.Digest.String(),
+			ImageDigest: "new",
+			Type:        ArtifactEntryTypeIndex,
+			CreatedAt:   time.Now(),
+		})
+		return false, err
+	}
+	result, err := db.GarbageCollect(ctx, []string{blobStorePath}, isLive, false)
+	if err != nil {
+		t.Fatalf("failed to garbage collect: %v", err)
+	}
+	if len(result.RemovedIndexes) != 0 || len(result.RemovedZtocs) != 0 {
+		t.Fatalf("removed artifacts written during garbage collection: %+v", result)
+	}
+	for _, dgst := range []digest.Digest{index.Digest, ztoc.Digest} {
+		if _, err := db.GetArtifactEntry(dgst.String()); err != nil {
+			t.Fatalf("entry of %s was removed: %v", dgst, err)
+		}
+		if _, err := os.Stat(blobPath(blobStorePath, dgst)); err != nil {
+			t.Fatalf("blob %s was removed: %v", dgst, err)
+		}
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "artifacts.db")
+	const (
+		good    = "sha256:10d6aec48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		corrupt = "sha256:20d6a9c48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+	)
+	// A database created before the schema was versioned, with an entry which can't be decoded.
+	unversioned, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unversioned.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketKeySociArtifacts)
+		if err != nil {
+			return err
+		}
+		if err := putArtifactEntry(bucket, &ArtifactEntry{Digest: good, Size: 10, Type: ArtifactEntryTypeLayer}); err != nil {
+			return err
+		}
+		_, err = bucket.CreateBucket([]byte(corrupt))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unversioned.Close()
+
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatalf("failed to migrate db: %v", err)
+	}
+	if _, err := db.GetArtifactEntry(good); err != nil {
+		t.Fatalf("entry was lost by the migration: %v", err)
+	}
+	if _, err := db.GetArtifactEntry(corrupt); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("entry which can't be decoded was not removed: %v", err)
+	}
+	// The database is opened again without migrating it.
+	db.db.Close()
+	if db, err = openDB(path); err != nil {
+		t.Fatalf("failed to open migrated db: %v", err)
+	}
+	// Databases written by newer versions are not opened.
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		b, err := dbutil.EncodeInt(int64(len(migrations) + 1))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketKeyMeta).Put(bucketKeySchemaVersion, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.db.Close()
+	if _, err := openDB(path); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Fatalf("db of a newer schema was opened: %v", err)
+	}
+}
+
+func TestWriteArtifactEntries(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	const (
+		index = "sha256:10d6aec48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		ztoc  = "sha256:20d6a9c48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+	)
+	// Either all or none of the entries are written.
+	err = db.WriteArtifactEntries(&ArtifactEntry{Digest: ztoc, Size: 10, Type: ArtifactEntryTypeLayer}, nil)
+	if err == nil {
+		t.Fatal("nil entry was written")
+	}
+	if _, err := db.GetArtifactEntry(ztoc); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("entries of a failed write were stored: %v", err)
+	}
+	err = db.WriteArtifactEntries(
+		&ArtifactEntry{Digest: ztoc, Size: 10, Type: ArtifactEntryTypeLayer},
+		&ArtifactEntry{Digest: index, Size: 20, Type: ArtifactEntryTypeIndex},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range []string{index, ztoc} {
+		if _, err := db.GetArtifactEntry(dgst); err != nil {
+			t.Fatalf("entry %s was not stored: %v", dgst, err)
+		}
+	}
+}
+
 func newTestableDb() (*ArtifactsDb, error) {
 	f, err := os.CreateTemp("", "readertestdb")
 	if err != nil {
@@ -0,0 +1,161 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/util/containerdutil"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// BuildResult is the SOCI index built by BuildIndex.
+type BuildResult struct {
+	// Index is the SOCI index. Its blobs are the descriptors of the zTOCs of the indexed layers,
+	// in the order of the layers.
+	Index *Index
+	// IndexDescriptor is the descriptor of the SOCI index written to the store.
+	IndexDescriptor ocispec.Descriptor
+	// ManifestDescriptor is the descriptor of the image manifest the SOCI index is for, which is the
+	// subject of the index.
+	ManifestDescriptor ocispec.Descriptor
+}
+
+// BuildIndex builds the SOCI index of the image `img` for embedding index creation in other Go
+// programs, e.g. build systems. The image is an image manifest, or an image index whose manifest of
+// the platform of WithPlatform (the default platform if not given) is indexed. The image and its
+// layers are read from `src`, and the zTOCs and the SOCI index are written to `dst`, which can be
+// the same storage, e.g. an OCI image layout or a registry repository.
+//
+// Unlike IndexBuilder, it doesn't need containerd nor the artifacts database of the soci CLI: the
+// index can be pushed from `dst` like any other manifest, with the image manifest as its subject.
+func BuildIndex(ctx context.Context, img ocispec.Descriptor, src orascontent.ReadOnlyStorage, dst orascontent.Storage, opts ...BuildOption) (*BuildResult, error) {
+	builder, err := NewIndexBuilder(storageProvider{src}, dst, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc, _, err := containerdutil.ResolveManifest(ctx, src, img, platforms.OnlyStrict(builder.config.platform))
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve image manifest: %w", err)
+	}
+	// The manifest of the platform is indexed as is, whatever the platforms of the image index.
+	indexWithMetadata, err := builder.Build(ctx, images.Image{Target: manifestDesc})
+	if err != nil {
+		return nil, err
+	}
+	indexWithMetadata.ImageDigest = img.Digest
+	indexDesc, err := writeIndex(ctx, indexWithMetadata.Index, dst)
+	if err != nil {
+		return nil, err
+	}
+	return &BuildResult{
+		Index:              indexWithMetadata.Index,
+		IndexDescriptor:    indexDesc,
+		ManifestDescriptor: manifestDesc,
+	}, nil
+}
+
+// writeIndex writes the SOCI index to `store` under its full descriptor, unlike WriteSociIndex,
+// so that stores keyed by media type find it, and returns the descriptor.
+func writeIndex(ctx context.Context, index *Index, store orascontent.Storage) (ocispec.Descriptor, error) {
+	b, err := MarshalIndex(index)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if index.MediaType == ocispec.MediaTypeImageManifest {
+		err = store.Push(ctx, indexConfigDescriptor(index), bytes.NewReader(defaultConfigContent))
+		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return ocispec.Descriptor{}, fmt.Errorf("error creating OCI 1.0 empty config: %w", err)
+		}
+	}
+	desc := ocispec.Descriptor{
+		MediaType:    index.MediaType,
+		ArtifactType: indexArtifactType(index),
+		Digest:       digest.FromBytes(b),
+		Size:         int64(len(b)),
+	}
+	if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot write SOCI index: %w", err)
+	}
+	return desc, nil
+}
+
+// storageProvider provides the contents of an oras storage to IndexBuilder.
+type storageProvider struct {
+	storage orascontent.ReadOnlyStorage
+}
+
+func (p storageProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return &fetchReaderAt{ctx: ctx, fetcher: p.storage, desc: desc}, nil
+}
+
+// fetchReaderAt reads a content from its storage as it's read, sequentially by IndexBuilder.
+// Reading backwards fetches the content again.
+type fetchReaderAt struct {
+	ctx     context.Context
+	fetcher orascontent.Fetcher
+	desc    ocispec.Descriptor
+	rc      io.ReadCloser
+	off     int64
+}
+
+func (r *fetchReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.rc == nil || off < r.off {
+		r.Close()
+		rc, err := r.fetcher.Fetch(r.ctx, r.desc)
+		if err != nil {
+			return 0, err
+		}
+		r.rc, r.off = rc, 0
+	}
+	if off > r.off {
+		n, err := io.CopyN(io.Discard, r.rc, off-r.off)
+		r.off += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.off += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *fetchReaderAt) Size() int64 {
+	return r.desc.Size
+}
+
+func (r *fetchReaderAt) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
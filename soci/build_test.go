@@ -0,0 +1,150 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestBuildIndex(t *testing.T) {
+	ctx := context.Background()
+	src := memory.New()
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := src.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatalf("failed to push %s: %v", mediaType, err)
+		}
+		return desc
+	}
+	pushJSON := func(mediaType string, v interface{}) ocispec.Descriptor {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return push(mediaType, b)
+	}
+
+	layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+		testutil.File("foo", string(testutil.RandomByteData(100000))),
+	}, gzip.BestCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDesc := push(ocispec.MediaTypeImageLayerGzip, layer)
+	configDesc := pushJSON(ocispec.MediaTypeImageConfig, ocispec.Image{})
+	manifestDesc := pushJSON(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	})
+	platform := ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	manifestDesc.Platform = &platform
+	imageIndexDesc := pushJSON(ocispec.MediaTypeImageIndex, ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifestDesc},
+	})
+	manifestDesc.Platform = nil
+
+	for _, tc := range []struct {
+		name  string
+		image ocispec.Descriptor
+		opts  []BuildOption
+	}{
+		{name: "manifest", image: manifestDesc},
+		{name: "image index", image: imageIndexDesc, opts: []BuildOption{WithPlatform(platform)}},
+		{name: "OCI 1.1 artifact", image: manifestDesc, opts: []BuildOption{
+			WithIndexPackaging(IndexPackagingOCI11),
+			WithIndexAnnotations(map[string]string{"build-id": "42"}),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := memory.New()
+			var progress []LayerProgress
+			res, err := BuildIndex(ctx, tc.image, src, dst, append(tc.opts, WithMinLayerSize(0), WithProgress(func(p LayerProgress) {
+				progress = append(progress, p)
+			}))...)
+			if err != nil {
+				t.Fatalf("failed to build index: %v", err)
+			}
+			if len(progress) != 1 || progress[0].Layer.Digest != layerDesc.Digest || progress[0].Ztoc == nil || progress[0].Reused {
+				t.Fatalf("unexpected progress: %+v", progress)
+			}
+			if res.ManifestDescriptor.Digest != manifestDesc.Digest {
+				t.Fatalf("unexpected manifest; expected = %s, got = %s", manifestDesc.Digest, res.ManifestDescriptor.Digest)
+			}
+			if res.Index.Subject == nil || res.Index.Subject.Digest != manifestDesc.Digest {
+				t.Fatalf("unexpected subject of index: %v", res.Index.Subject)
+			}
+			if len(res.Index.Blobs) != 1 || res.Index.Blobs[0].Annotations[IndexAnnotationImageLayerDigest] != layerDesc.Digest.String() {
+				t.Fatalf("unexpected zTOCs of index: %v", res.Index.Blobs)
+			}
+			for _, desc := range []ocispec.Descriptor{res.IndexDescriptor, res.Index.Blobs[0]} {
+				if ok, err := dst.Exists(ctx, desc); err != nil || !ok {
+					t.Fatalf("%s wasn't written to the store: %v", desc.Digest, err)
+				}
+			}
+
+			rc, err := dst.Fetch(ctx, res.IndexDescriptor)
+			if err != nil {
+				t.Fatalf("failed to fetch index: %v", err)
+			}
+			defer rc.Close()
+			index, err := NewIndexFromReader(rc)
+			if err != nil {
+				t.Fatalf("failed to read index: %v", err)
+			}
+			if index.Subject.Digest != manifestDesc.Digest {
+				t.Fatalf("unexpected subject of written index: %v", index.Subject)
+			}
+
+			var manifest ocispec.Manifest
+			b, err := orascontent.FetchAll(ctx, dst, res.IndexDescriptor)
+			if err != nil {
+				t.Fatalf("failed to fetch index: %v", err)
+			}
+			if err := json.Unmarshal(b, &manifest); err != nil {
+				t.Fatalf("failed to read index manifest: %v", err)
+			}
+			if ok, err := dst.Exists(ctx, manifest.Config); err != nil || !ok {
+				t.Fatalf("config %s of index wasn't written to the store: %v", manifest.Config.MediaType, err)
+			}
+			if res.Index.Packaging == IndexPackagingOCI11 {
+				if manifest.ArtifactType != SociIndexArtifactType || manifest.Config.MediaType != MediaTypeEmptyJSON {
+					t.Fatalf("index isn't packaged as an OCI 1.1 artifact: %s", b)
+				}
+				if manifest.Annotations["build-id"] != "42" || manifest.Annotations[IndexAnnotationBuildToolIdentifier] == "" {
+					t.Fatalf("unexpected annotations of index: %v", manifest.Annotations)
+				}
+			}
+		})
+	}
+
+	if _, err := BuildIndex(ctx, imageIndexDesc, src, memory.New(), WithPlatform(ocispec.Platform{OS: "linux", Architecture: "s390x"})); err == nil {
+		t.Fatal("built index of a platform missing from the image index")
+	}
+}
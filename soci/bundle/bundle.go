@@ -0,0 +1,392 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package bundle packages SOCI indices, their zTOCs and optionally the layers of their images
+// into a tarball in the OCI image layout, to move them to hosts which can't reach the registry,
+// e.g. in air-gapped environments.
+//
+// The index.json of a bundle lists its SOCI indices. The image manifests they are for are their
+// subjects; they are only in the bundle along with their configs and layers if it was exported
+// with WithLayers.
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const indexFile = "index.json"
+
+// Image is a SOCI index to export, for the image manifest which is its subject.
+type Image struct {
+	Index ocispec.Descriptor
+	// Platform is the platform of the image manifest, if known. It's recorded in the bundle.
+	Platform *ocispec.Platform
+}
+
+// Imported is a SOCI index imported from a bundle.
+type Imported struct {
+	// Index is the descriptor of the SOCI index, with the platform of its image manifest if it was recorded.
+	Index ocispec.Descriptor
+	// Manifest is the digest of the image manifest the index is for.
+	Manifest digest.Digest
+	// Ztocs are the descriptors of the zTOCs of the index.
+	Ztocs []ocispec.Descriptor
+	// Image are the descriptors of the image manifest, its config and its layers, if they were in the bundle.
+	Image []ocispec.Descriptor
+}
+
+// ExportOption configures Export.
+type ExportOption func(*exportConfig)
+
+type exportConfig struct {
+	layers orascontent.Fetcher
+}
+
+// WithLayers adds the image manifests of the indices, their configs and their layers, read from
+// `fetcher`, to the bundle, so that the layers can be served without the registry.
+func WithLayers(fetcher orascontent.Fetcher) ExportOption {
+	return func(cfg *exportConfig) {
+		cfg.layers = fetcher
+	}
+}
+
+// Export writes a bundle of the SOCI indices of `images` and their zTOCs, read from `artifacts`, to `w`.
+func Export(ctx context.Context, w io.Writer, artifacts orascontent.Fetcher, images []Image, opts ...ExportOption) error {
+	var cfg exportConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	bw := &bundleWriter{tw: tar.NewWriter(w), written: make(map[digest.Digest]bool)}
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := bw.writeFile(ocispec.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	for _, img := range images {
+		desc := img.Index
+		if desc.MediaType == "" {
+			desc.MediaType = ocispec.MediaTypeImageManifest
+		}
+		b, err := orascontent.FetchAll(ctx, artifacts, desc)
+		if err != nil {
+			return fmt.Errorf("cannot read SOCI index %s: %w", desc.Digest, err)
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return fmt.Errorf("cannot parse SOCI index %s: %w", desc.Digest, err)
+		}
+		if manifest.Subject == nil {
+			return fmt.Errorf("SOCI index %s has no subject", desc.Digest)
+		}
+		if err := bw.writeBlob(desc.Digest, b); err != nil {
+			return err
+		}
+		blobs := manifest.Layers
+		if manifest.Config.Digest != "" {
+			blobs = append([]ocispec.Descriptor{manifest.Config}, blobs...)
+		}
+		for _, blob := range blobs {
+			if err := bw.copyBlob(ctx, artifacts, blob); err != nil {
+				return fmt.Errorf("cannot export artifact %s of SOCI index %s: %w", blob.Digest, desc.Digest, err)
+			}
+		}
+		if cfg.layers != nil {
+			if err := bw.writeImage(ctx, cfg.layers, *manifest.Subject); err != nil {
+				return fmt.Errorf("cannot export image manifest %s: %w", manifest.Subject.Digest, err)
+			}
+		}
+		desc.Platform = img.Platform
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := bw.writeFile(indexFile, b); err != nil {
+		return err
+	}
+	return bw.tw.Close()
+}
+
+// bundleWriter writes each blob once to the tarball of a bundle.
+type bundleWriter struct {
+	tw      *tar.Writer
+	written map[digest.Digest]bool
+}
+
+func (bw *bundleWriter) writeFile(name string, b []byte) error {
+	if err := bw.tw.WriteHeader(&tar.Header{Name: name, Mode: 0444, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := bw.tw.Write(b)
+	return err
+}
+
+func (bw *bundleWriter) writeBlob(dgst digest.Digest, b []byte) error {
+	if bw.written[dgst] {
+		return nil
+	}
+	bw.written[dgst] = true
+	return bw.writeFile(blobPath(dgst), b)
+}
+
+func (bw *bundleWriter) copyBlob(ctx context.Context, fetcher orascontent.Fetcher, desc ocispec.Descriptor) error {
+	if bw.written[desc.Digest] {
+		return nil
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := bw.tw.WriteHeader(&tar.Header{Name: blobPath(desc.Digest), Mode: 0444, Size: desc.Size, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	vr := orascontent.NewVerifyReader(rc, desc)
+	if _, err := io.Copy(bw.tw, vr); err != nil {
+		return err
+	}
+	if err := vr.Verify(); err != nil {
+		return err
+	}
+	bw.written[desc.Digest] = true
+	return nil
+}
+
+// writeImage writes the image manifest described by `desc`, its config and its layers.
+func (bw *bundleWriter) writeImage(ctx context.Context, fetcher orascontent.Fetcher, desc ocispec.Descriptor) error {
+	b, err := orascontent.FetchAll(ctx, fetcher, desc)
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return err
+	}
+	if err := bw.writeBlob(desc.Digest, b); err != nil {
+		return err
+	}
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := bw.copyBlob(ctx, fetcher, blob); err != nil {
+			return fmt.Errorf("cannot export blob %s: %w", blob.Digest, err)
+		}
+	}
+	return nil
+}
+
+// Import reads the bundle from `r` into `store` and returns its SOCI indices. The blobs which are
+// already in the store are skipped. It fails if the bundle lacks a SOCI index or zTOC it lists, or
+// a config or layer of an image manifest it has. Blobs are staged in a temporary directory until the
+// bundle is read, so that each of them is pushed with the media type it's referenced with, which
+// places it in the right tier of the store.
+func Import(ctx context.Context, r io.Reader, store orascontent.Storage) ([]Imported, error) {
+	staged, err := os.MkdirTemp("", "soci-bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staged)
+
+	var (
+		tr     = tar.NewReader(r)
+		layout *ocispec.ImageLayout
+		index  *ocispec.Index
+		blobs  = stagedBlobs{dir: staged, sizes: make(map[digest.Digest]int64)}
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch name := path.Clean(hdr.Name); {
+		case name == ocispec.ImageLayoutFile:
+			layout = &ocispec.ImageLayout{}
+			if err := json.NewDecoder(tr).Decode(layout); err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %w", name, err)
+			}
+		case name == indexFile:
+			index = &ocispec.Index{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %w", name, err)
+			}
+		case strings.HasPrefix(name, "blobs/"):
+			if err := blobs.stage(name, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if layout == nil || layout.Version != ocispec.ImageLayoutVersion {
+		return nil, fmt.Errorf("not a bundle: missing or unsupported %s", ocispec.ImageLayoutFile)
+	}
+	if index == nil {
+		return nil, fmt.Errorf("not a bundle: missing %s", indexFile)
+	}
+
+	imported := make([]Imported, 0, len(index.Manifests))
+	for _, desc := range index.Manifests {
+		if desc.MediaType == "" {
+			desc.MediaType = ocispec.MediaTypeImageManifest
+		}
+		manifest, err := blobs.importManifest(ctx, store, desc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot import SOCI index %s: %w", desc.Digest, err)
+		}
+		if manifest.Subject == nil {
+			return nil, fmt.Errorf("SOCI index %s has no subject", desc.Digest)
+		}
+		for _, ztoc := range manifest.Layers {
+			if err := blobs.importBlob(ctx, store, ztoc); err != nil {
+				return nil, fmt.Errorf("cannot import ztoc %s of SOCI index %s: %w", ztoc.Digest, desc.Digest, err)
+			}
+		}
+		im := Imported{
+			Index:    desc,
+			Manifest: manifest.Subject.Digest,
+			Ztocs:    manifest.Layers,
+		}
+		if blobs.has(manifest.Subject.Digest) {
+			image, err := blobs.importManifest(ctx, store, *manifest.Subject)
+			if err != nil {
+				return nil, fmt.Errorf("cannot import image manifest %s: %w", manifest.Subject.Digest, err)
+			}
+			im.Image = append([]ocispec.Descriptor{*manifest.Subject, image.Config}, image.Layers...)
+			for _, layer := range image.Layers {
+				if err := blobs.importBlob(ctx, store, layer); err != nil {
+					return nil, fmt.Errorf("cannot import layer %s of image manifest %s: %w", layer.Digest, manifest.Subject.Digest, err)
+				}
+			}
+		}
+		imported = append(imported, im)
+	}
+	return imported, nil
+}
+
+// stagedBlobs are the blobs of a bundle staged in a directory until they're imported.
+type stagedBlobs struct {
+	dir   string
+	sizes map[digest.Digest]int64
+}
+
+// stage writes the blob of the bundle at `name` to the staging directory.
+func (s *stagedBlobs) stage(name string, r io.Reader) error {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid blob path %s in bundle", name)
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+	if err := dgst.Validate(); err != nil {
+		return fmt.Errorf("invalid blob path %s in bundle: %w", name, err)
+	}
+	f, err := os.Create(s.path(dgst))
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot stage blob %s: %w", dgst, err)
+	}
+	s.sizes[dgst] = size
+	return nil
+}
+
+func (s *stagedBlobs) path(dgst digest.Digest) string {
+	return filepath.Join(s.dir, dgst.Algorithm().String()+"-"+dgst.Encoded())
+}
+
+func (s *stagedBlobs) has(dgst digest.Digest) bool {
+	_, ok := s.sizes[dgst]
+	return ok
+}
+
+// importBlob pushes the staged blob `desc` to `store`, unless the store already has it. The store
+// verifies its content against the digest.
+func (s *stagedBlobs) importBlob(ctx context.Context, store orascontent.Storage, desc ocispec.Descriptor) error {
+	if ok, err := store.Exists(ctx, desc); err == nil && ok {
+		return nil
+	}
+	size, ok := s.sizes[desc.Digest]
+	if !ok {
+		return errors.New("missing from the bundle")
+	}
+	if size != desc.Size {
+		return fmt.Errorf("size %d in the bundle, expected %d", size, desc.Size)
+	}
+	f, err := os.Open(s.path(desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := store.Push(ctx, desc, f); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// importManifest imports the staged manifest `desc` and its config, and returns the manifest.
+func (s *stagedBlobs) importManifest(ctx context.Context, store orascontent.Storage, desc ocispec.Descriptor) (*ocispec.Manifest, error) {
+	if err := s.importBlob(ctx, store, desc); err != nil {
+		return nil, err
+	}
+	b, err := orascontent.FetchAll(ctx, store, desc)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %w", err)
+	}
+	if manifest.Config.Digest != "" {
+		if err := s.importBlob(ctx, store, manifest.Config); err != nil {
+			return nil, fmt.Errorf("cannot import config %s: %w", manifest.Config.Digest, err)
+		}
+	}
+	return &manifest, nil
+}
+
+func blobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func push(t *testing.T, store orascontent.Pusher, mediaType string, b []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	if err := store.Push(context.Background(), desc, bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func pushJSON(t *testing.T, store orascontent.Pusher, mediaType string, v interface{}) ocispec.Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return push(t, store, mediaType, b)
+}
+
+// newTestImage returns a store holding an image manifest and its blobs, and a store holding a SOCI index for it.
+func newTestImage(t *testing.T) (images, artifacts *memory.Store, index ocispec.Descriptor, ztocs, layers []ocispec.Descriptor) {
+	images, artifacts = memory.New(), memory.New()
+	config := push(t, images, ocispec.MediaTypeImageConfig, []byte("{}"))
+	for i := 0; i < 2; i++ {
+		layer := push(t, images, ocispec.MediaTypeImageLayerGzip, bytes.Repeat([]byte{byte(i)}, 100))
+		layers = append(layers, layer)
+		ztoc := push(t, artifacts, soci.SociLayerMediaType, bytes.Repeat([]byte{byte(i + 10)}, 50))
+		ztoc.Annotations = map[string]string{soci.IndexAnnotationImageLayerDigest: layer.Digest.String()}
+		ztocs = append(ztocs, ztoc)
+	}
+	manifest := pushJSON(t, images, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+	b, err := soci.MarshalIndex(soci.NewIndex(ztocs, &manifest, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index is serialized as an OCI 1.0 manifest, with an empty config.
+	push(t, artifacts, soci.SociIndexArtifactType, []byte("{}"))
+	index = push(t, artifacts, ocispec.MediaTypeImageManifest, b)
+	return images, artifacts, index, ztocs, layers
+}
+
+// mediaTypeStore records the media type each blob is pushed with, which places it in a tier of SOCIs local content store.
+type mediaTypeStore struct {
+	orascontent.Storage
+	pushed map[digest.Digest]string
+}
+
+func (s *mediaTypeStore) Push(ctx context.Context, expected ocispec.Descriptor, r io.Reader) error {
+	s.pushed[expected.Digest] = expected.MediaType
+	return s.Storage.Push(ctx, expected, r)
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	images, artifacts, index, ztocs, layers := newTestImage(t)
+	platform := &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+
+	for _, withLayers := range []bool{false, true} {
+		var opts []ExportOption
+		if withLayers {
+			opts = append(opts, WithLayers(images))
+		}
+		var buf bytes.Buffer
+		if err := Export(ctx, &buf, artifacts, []Image{{Index: index, Platform: platform}}, opts...); err != nil {
+			t.Fatalf("failed to export: %v", err)
+		}
+
+		ociStore, err := oci.New(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := &mediaTypeStore{Storage: ociStore, pushed: make(map[digest.Digest]string)}
+		imported, err := Import(ctx, &buf, store)
+		if err != nil {
+			t.Fatalf("failed to import: %v", err)
+		}
+		if len(imported) != 1 {
+			t.Fatalf("imported %d indices, expected 1", len(imported))
+		}
+		got := imported[0]
+		if got.Index.Digest != index.Digest || got.Index.Platform == nil || got.Index.Platform.Architecture != platform.Architecture {
+			t.Fatalf("unexpected index %v", got.Index)
+		}
+		if (len(got.Image) > 0) != withLayers || len(got.Ztocs) != len(ztocs) {
+			t.Fatalf("unexpected import %+v", got)
+		}
+		for _, desc := range ztocs {
+			if mt, ok := store.pushed[desc.Digest]; !ok || mt != soci.SociLayerMediaType {
+				t.Fatalf("ztoc %s imported = %v with media type %q", desc.Digest, ok, mt)
+			}
+		}
+		for _, desc := range layers {
+			mt, ok := store.pushed[desc.Digest]
+			if ok != withLayers {
+				t.Fatalf("layer %s imported = %v, expected %v", desc.Digest, ok, withLayers)
+			}
+			if ok && mt != desc.MediaType {
+				t.Fatalf("layer %s imported with media type %q, expected %q", desc.Digest, mt, desc.MediaType)
+			}
+		}
+	}
+}
+
+func TestImportInvalidBundle(t *testing.T) {
+	ctx := context.Background()
+	images, artifacts, index, ztocs, layers := newTestImage(t)
+	emptyConfig := digest.FromBytes([]byte("{}"))
+
+	tarball := func(files map[string][]byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, b := range files {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0444, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			tw.Write(b)
+		}
+		tw.Close()
+		return &buf
+	}
+	layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	indexJSON, _ := json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{index}})
+	indexBlob, err := orascontent.FetchAll(ctx, artifacts, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sociIndex ocispec.Manifest
+	if err := json.Unmarshal(indexBlob, &sociIndex); err != nil {
+		t.Fatal(err)
+	}
+	manifest := *sociIndex.Subject
+	manifestBlob, err := orascontent.FetchAll(ctx, images, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		files map[string][]byte
+	}{
+		{
+			name:  "not an OCI image layout",
+			files: map[string][]byte{indexFile: indexJSON},
+		},
+		{
+			name:  "missing index.json",
+			files: map[string][]byte{ocispec.ImageLayoutFile: layout},
+		},
+		{
+			name:  "missing SOCI index",
+			files: map[string][]byte{ocispec.ImageLayoutFile: layout, indexFile: indexJSON},
+		},
+		{
+			name: "missing ztoc",
+			files: map[string][]byte{
+				ocispec.ImageLayoutFile:   layout,
+				indexFile:                 indexJSON,
+				blobPath(index.Digest):    indexBlob,
+				blobPath(emptyConfig):     []byte("{}"),
+				blobPath(ztocs[0].Digest): bytes.Repeat([]byte{10}, 50),
+			},
+		},
+		{
+			name: "missing layer",
+			files: map[string][]byte{
+				ocispec.ImageLayoutFile:    layout,
+				indexFile:                  indexJSON,
+				blobPath(index.Digest):     indexBlob,
+				blobPath(emptyConfig):      []byte("{}"),
+				blobPath(ztocs[0].Digest):  bytes.Repeat([]byte{10}, 50),
+				blobPath(ztocs[1].Digest):  bytes.Repeat([]byte{11}, 50),
+				blobPath(manifest.Digest):  manifestBlob,
+				blobPath(layers[0].Digest): bytes.Repeat([]byte{0}, 100),
+			},
+		},
+		{
+			name: "corrupted blob",
+			files: map[string][]byte{
+				ocispec.ImageLayoutFile: layout,
+				indexFile:               indexJSON,
+				blobPath(index.Digest):  []byte("corrupted"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := oci.New(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Import(ctx, tarball(tt.files), store); err == nil {
+				t.Fatal("expected the import to fail")
+			}
+		})
+	}
+}
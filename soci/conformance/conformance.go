@@ -0,0 +1,507 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package conformance checks SOCI indices and zTOCs produced by other tools against what the
+// snapshotter expects of them, so that third-party producers can be validated before their
+// artifacts are pushed to registries.
+//
+// Check returns the violations of the rules as a Report. Test runs the same checks from a Go test
+// of a producer, e.g. on the artifacts it wrote to an OCI image layout.
+package conformance
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// Rule identifies a requirement of the snapshotter on SOCI artifacts.
+type Rule string
+
+const (
+	// RuleIndexContent: the index matches the digest and size of its descriptor and is a JSON OCI image manifest.
+	RuleIndexContent Rule = "index-content"
+	// RuleIndexMediaType: the media type of the index is the OCI image manifest media type.
+	RuleIndexMediaType Rule = "index-media-type"
+	// RuleIndexConfig: the config of the index has the SOCI index artifact type as media type,
+	// which is how the referrers of images are filtered, or, for an index packaged as an OCI 1.1
+	// artifact, the index has the SOCI index artifact type and the empty JSON object as config.
+	RuleIndexConfig Rule = "index-config"
+	// RuleIndexSubject: the subject of the index, if any, is the image manifest the index is checked against.
+	RuleIndexSubject Rule = "index-subject"
+	// RuleZtocMediaType: the media type of zTOCs is the SOCI layer media type.
+	RuleZtocMediaType Rule = "ztoc-media-type"
+	// RuleZtocAnnotations: zTOCs are annotated with the digest and media type of their layer,
+	// and their optional annotations are valid.
+	RuleZtocAnnotations Rule = "ztoc-annotations"
+	// RuleZtocDuplicate: an index has at most one zTOC per layer.
+	RuleZtocDuplicate Rule = "ztoc-duplicate"
+	// RuleZtocContent: zTOCs match the digest and size of their descriptor.
+	RuleZtocContent Rule = "ztoc-content"
+	// RuleZtocFlatbuffer: zTOCs are valid flatbuffers of the zTOC schema with consistent sizes and offsets.
+	RuleZtocFlatbuffer Rule = "ztoc-flatbuffer"
+	// RuleZtocVersion: zTOCs have a version the snapshotter supports.
+	RuleZtocVersion Rule = "ztoc-version"
+	// RuleZtocSpans: the checkpoints of zTOCs can be decoded and their spans are ordered and
+	// within the archive.
+	RuleZtocSpans Rule = "ztoc-spans"
+	// RuleZtocFiles: the files of zTOCs have known types and non-empty names.
+	RuleZtocFiles Rule = "ztoc-files"
+	// RuleZtocLayer: the layers of zTOCs are layers of the image manifest the index is checked
+	// against, with the same media type and size.
+	RuleZtocLayer Rule = "ztoc-layer"
+	// RuleZtocSpanDigests: the span digests of zTOCs match the layers fetched with WithLayerFetcher
+	// or read with WithLayerReader.
+	RuleZtocSpanDigests Rule = "ztoc-span-digests"
+	// RuleZtocFileOffsets: the regular files of zTOCs start right after their tar header in the
+	// layers read with WithLayerReader, which records the same size.
+	RuleZtocFileOffsets Rule = "ztoc-file-offsets"
+)
+
+// supportedVersions are the zTOC versions the snapshotter can read.
+var supportedVersions = map[ztoc.Version]bool{ztoc.Version09: true}
+
+// fileTypes are the types of the files of zTOCs.
+var fileTypes = map[string]bool{
+	"reg": true, "dir": true, "symlink": true, "hardlink": true, "char": true, "block": true, "fifo": true,
+}
+
+// maxIndexSize bounds the size of the indices read by Check.
+const maxIndexSize = 50 << 20
+
+// Violation is a rule which an artifact doesn't follow.
+type Violation struct {
+	Rule Rule `json:"rule"`
+	// Artifact is the digest of the index or zTOC which violates the rule.
+	Artifact digest.Digest `json:"artifact"`
+	Message  string        `json:"message"`
+}
+
+// Report is the result of Check.
+type Report struct {
+	Index digest.Digest `json:"index"`
+	// Ztocs is the number of zTOCs of the index which were checked.
+	Ztocs int `json:"ztocs"`
+	// SampledSpans is the number of spans read with WithLayerReader and checked.
+	SampledSpans int         `json:"sampledSpans,omitempty"`
+	Violations   []Violation `json:"violations"`
+}
+
+// Passed returns whether the artifacts follow all the rules.
+func (r Report) Passed() bool {
+	return len(r.Violations) == 0
+}
+
+type config struct {
+	manifest     *ocispec.Manifest
+	manifestDesc ocispec.Descriptor
+	layers       orascontent.Fetcher
+	layerReader  LayerReader
+	samples      int
+}
+
+// LayerReader opens a layer for random reads, e.g. with range requests to a registry.
+type LayerReader func(ctx context.Context, layer ocispec.Descriptor) (io.ReaderAt, error)
+
+// Option is an option of Check.
+type Option func(*config)
+
+// WithImageManifest checks the index against the image manifest `manifest` described by `desc`,
+// which it must be the index of (RuleIndexSubject and RuleZtocLayer).
+func WithImageManifest(desc ocispec.Descriptor, manifest ocispec.Manifest) Option {
+	return func(c *config) {
+		c.manifestDesc = desc
+		c.manifest = &manifest
+	}
+}
+
+// WithLayerFetcher checks the span digests of the zTOCs against their layers fetched from `f`
+// (RuleZtocSpanDigests). Layers are fetched in full.
+func WithLayerFetcher(f orascontent.Fetcher) Option {
+	return func(c *config) {
+		c.layers = f
+	}
+}
+
+// WithLayerReader checks the zTOCs against their layers read with `r`, without fetching the layers
+// in full: `samples` spans of each zTOC, including its first and last span, are read and their digests
+// checked (RuleZtocSpanDigests). The spans are then decompressed with the checkpoints of the zTOC
+// (RuleZtocSpans), and the tar headers of the regular files starting in them are checked against
+// the files of the zTOC (RuleZtocFileOffsets). A non-positive `samples` checks every span.
+func WithLayerReader(r LayerReader, samples int) Option {
+	return func(c *config) {
+		c.layerReader = r
+		c.samples = samples
+	}
+}
+
+// Check checks the SOCI index described by `desc` and its zTOCs, fetched from `f`. It returns
+// an error only if the artifacts can't be fetched; violations of the rules are reported.
+func Check(ctx context.Context, f orascontent.Fetcher, desc ocispec.Descriptor, opts ...Option) (Report, error) {
+	var cfg config
+	for _, o := range opts {
+		o(&cfg)
+	}
+	c := &checker{cfg: cfg, report: Report{Index: desc.Digest, Violations: []Violation{}}}
+
+	b, err := fetch(ctx, f, desc, maxIndexSize)
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to fetch index %s: %w", desc.Digest, err)
+	}
+	manifest, ok := c.checkIndex(desc, b)
+	if !ok {
+		return c.report, nil
+	}
+
+	layers := make(map[digest.Digest]bool)
+	for _, ztocDesc := range manifest.Layers {
+		c.report.Ztocs++
+		layerDesc, ok := c.checkZtocDescriptor(ztocDesc)
+		if ok {
+			if layers[layerDesc.Digest] {
+				c.violate(RuleZtocDuplicate, ztocDesc.Digest, "layer %s has several zTOCs", layerDesc.Digest)
+			}
+			layers[layerDesc.Digest] = true
+		}
+		b, err := fetch(ctx, f, ztocDesc, -1)
+		if err != nil {
+			return Report{}, fmt.Errorf("failed to fetch zTOC %s: %w", ztocDesc.Digest, err)
+		}
+		zt, ok := c.checkZtoc(ztocDesc, b)
+		if !ok {
+			continue
+		}
+		if layerDesc.Digest != "" {
+			c.checkZtocLayer(ztocDesc, zt, &layerDesc)
+			if cfg.layers != nil {
+				if err := c.checkSpanDigests(ctx, ztocDesc, zt, layerDesc); err != nil {
+					return Report{}, err
+				}
+			}
+			if cfg.layerReader != nil {
+				if err := c.checkSampledSpans(ctx, ztocDesc, zt, layerDesc); err != nil {
+					return Report{}, err
+				}
+			}
+		}
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	cfg    config
+	report Report
+}
+
+func (c *checker) violate(rule Rule, artifact digest.Digest, format string, args ...interface{}) {
+	c.report.Violations = append(c.report.Violations, Violation{
+		Rule:     rule,
+		Artifact: artifact,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkIndex checks the index `b` and returns it as an OCI image manifest, unless it can't be decoded.
+func (c *checker) checkIndex(desc ocispec.Descriptor, b []byte) (ocispec.Manifest, bool) {
+	if got := digest.FromBytes(b); got != desc.Digest || int64(len(b)) != desc.Size {
+		c.violate(RuleIndexContent, desc.Digest, "index has digest %s and size %d, expected %s and %d", got, len(b), desc.Digest, desc.Size)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		c.violate(RuleIndexContent, desc.Digest, "index is not an OCI image manifest: %v", err)
+		return manifest, false
+	}
+	if manifest.MediaType != ocispec.MediaTypeImageManifest {
+		c.violate(RuleIndexMediaType, desc.Digest, "index has media type %q, expected %q", manifest.MediaType, ocispec.MediaTypeImageManifest)
+	}
+	if desc.MediaType != "" && desc.MediaType != ocispec.MediaTypeImageManifest {
+		c.violate(RuleIndexMediaType, desc.Digest, "index descriptor has media type %q, expected %q", desc.MediaType, ocispec.MediaTypeImageManifest)
+	}
+	if manifest.ArtifactType != "" {
+		// The index is packaged as an OCI 1.1 artifact.
+		if manifest.ArtifactType != soci.SociIndexArtifactType {
+			c.violate(RuleIndexConfig, desc.Digest, "index has artifact type %q, expected %q", manifest.ArtifactType, soci.SociIndexArtifactType)
+		}
+		if manifest.Config.MediaType != soci.MediaTypeEmptyJSON {
+			c.violate(RuleIndexConfig, desc.Digest, "index config has media type %q, expected %q", manifest.Config.MediaType, soci.MediaTypeEmptyJSON)
+		}
+	} else if manifest.Config.MediaType != soci.SociIndexArtifactType {
+		c.violate(RuleIndexConfig, desc.Digest, "index config has media type %q, expected %q", manifest.Config.MediaType, soci.SociIndexArtifactType)
+	}
+	if c.cfg.manifest != nil && manifest.Subject != nil && manifest.Subject.Digest != c.cfg.manifestDesc.Digest {
+		c.violate(RuleIndexSubject, desc.Digest, "index subject is %s, expected the image manifest %s", manifest.Subject.Digest, c.cfg.manifestDesc.Digest)
+	}
+	return manifest, true
+}
+
+// checkZtocDescriptor checks the descriptor of a zTOC and returns the descriptor of its layer
+// from its annotations, with an empty digest if it's invalid.
+func (c *checker) checkZtocDescriptor(desc ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	if desc.MediaType != soci.SociLayerMediaType {
+		c.violate(RuleZtocMediaType, desc.Digest, "zTOC has media type %q, expected %q", desc.MediaType, soci.SociLayerMediaType)
+	}
+	var layer ocispec.Descriptor
+	ok := true
+	layerDigest, err := digest.Parse(desc.Annotations[soci.IndexAnnotationImageLayerDigest])
+	if err != nil {
+		c.violate(RuleZtocAnnotations, desc.Digest, "invalid %s annotation: %v", soci.IndexAnnotationImageLayerDigest, err)
+		ok = false
+	} else {
+		layer.Digest = layerDigest
+	}
+	layer.MediaType = desc.Annotations[soci.IndexAnnotationImageLayerMediaType]
+	if !images.IsLayerType(layer.MediaType) {
+		c.violate(RuleZtocAnnotations, desc.Digest, "%s annotation %q is not a layer media type", soci.IndexAnnotationImageLayerMediaType, layer.MediaType)
+	}
+	if v, ok := desc.Annotations[soci.IndexAnnotationBackgroundFetchPriority]; ok {
+		if _, err := strconv.Atoi(v); err != nil {
+			c.violate(RuleZtocAnnotations, desc.Digest, "%s annotation %q is not an integer", soci.IndexAnnotationBackgroundFetchPriority, v)
+		}
+	}
+	for _, key := range []string{soci.IndexAnnotationReadaheadSize, soci.IndexAnnotationCoalesceSize} {
+		if v, ok := desc.Annotations[key]; ok {
+			if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+				c.violate(RuleZtocAnnotations, desc.Digest, "%s annotation %q is not a non-negative integer", key, v)
+			}
+		}
+	}
+	return layer, ok
+}
+
+// checkZtoc checks the zTOC `b` and returns it, unless it can't be decoded.
+func (c *checker) checkZtoc(desc ocispec.Descriptor, b []byte) (*ztoc.Ztoc, bool) {
+	if got := digest.FromBytes(b); got != desc.Digest || int64(len(b)) != desc.Size {
+		c.violate(RuleZtocContent, desc.Digest, "zTOC has digest %s and size %d, expected %s and %d", got, len(b), desc.Digest, desc.Size)
+	}
+	zt, err := ztoc.Unmarshal(bytes.NewReader(b))
+	if err != nil {
+		c.violate(RuleZtocFlatbuffer, desc.Digest, "%v", err)
+		return nil, false
+	}
+	if !supportedVersions[zt.Version] {
+		c.violate(RuleZtocVersion, desc.Digest, "unsupported zTOC version %q", zt.Version)
+	}
+	for _, f := range zt.FileMetadata {
+		if f.Name == "" {
+			c.violate(RuleZtocFiles, desc.Digest, "file with an empty name")
+		}
+		if !fileTypes[f.Type] {
+			c.violate(RuleZtocFiles, desc.Digest, "file %q has unknown type %q", f.Name, f.Type)
+		}
+	}
+	c.checkSpans(desc, zt)
+	return zt, true
+}
+
+// checkSpans checks that the spans of `zt` are ordered and within the archive.
+func (c *checker) checkSpans(desc ocispec.Descriptor, zt *ztoc.Ztoc) {
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		c.violate(RuleZtocSpans, desc.Digest, "%v", err)
+		return
+	}
+	defer zinfo.Close()
+	if zinfo.StartUncompressedOffset(0) != 0 {
+		c.violate(RuleZtocSpans, desc.Digest, "first span starts at uncompressed offset %d, expected 0", zinfo.StartUncompressedOffset(0))
+	}
+	for id := compression.SpanID(1); id <= zt.MaxSpanID; id++ {
+		if zinfo.StartCompressedOffset(id) <= zinfo.StartCompressedOffset(id-1) ||
+			zinfo.StartUncompressedOffset(id) <= zinfo.StartUncompressedOffset(id-1) {
+			c.violate(RuleZtocSpans, desc.Digest, "span %d doesn't start after span %d", id, id-1)
+			return
+		}
+	}
+}
+
+// checkZtocLayer checks the layer of a zTOC against the image manifest, and sets the size of `layer`.
+func (c *checker) checkZtocLayer(desc ocispec.Descriptor, zt *ztoc.Ztoc, layer *ocispec.Descriptor) {
+	layer.Size = int64(zt.CompressedArchiveSize)
+	if c.cfg.manifest == nil {
+		return
+	}
+	for _, l := range c.cfg.manifest.Layers {
+		if l.Digest != layer.Digest {
+			continue
+		}
+		if l.MediaType != layer.MediaType {
+			c.violate(RuleZtocLayer, desc.Digest, "layer %s has media type %q, annotated as %q", l.Digest, l.MediaType, layer.MediaType)
+		}
+		if l.Size != int64(zt.CompressedArchiveSize) {
+			c.violate(RuleZtocLayer, desc.Digest, "layer %s has %d bytes, zTOC has a compressed archive of %d bytes", l.Digest, l.Size, zt.CompressedArchiveSize)
+		}
+		layer.Size = l.Size
+		return
+	}
+	c.violate(RuleZtocLayer, desc.Digest, "layer %s is not a layer of image manifest %s", layer.Digest, c.cfg.manifestDesc.Digest)
+}
+
+// checkSpanDigests checks the span digests of `zt` against its layer.
+func (c *checker) checkSpanDigests(ctx context.Context, desc ocispec.Descriptor, zt *ztoc.Ztoc, layer ocispec.Descriptor) error {
+	rc, err := c.cfg.layers.Fetch(ctx, layer)
+	if err != nil {
+		return fmt.Errorf("failed to fetch layer %s: %w", layer.Digest, err)
+	}
+	defer rc.Close()
+	// The spans of gzip layers may overlap by a byte, so the layer is read from a file.
+	f, err := os.CreateTemp("", "soci-conformance-layer-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	size, err := io.Copy(f, rc)
+	if err != nil {
+		return fmt.Errorf("failed to fetch layer %s: %w", layer.Digest, err)
+	}
+
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return nil // reported by checkSpans
+	}
+	defer zinfo.Close()
+	for id := compression.SpanID(0); id <= zt.MaxSpanID; id++ {
+		start := zinfo.StartCompressedOffset(id)
+		end := zinfo.EndCompressedOffset(id, compression.Offset(size))
+		if start > end || int64(end) > size {
+			c.violate(RuleZtocSpanDigests, desc.Digest, "span %d at %d-%d is outside of layer %s of %d bytes", id, start, end, layer.Digest, size)
+			return nil
+		}
+		dgst, err := digest.FromReader(io.NewSectionReader(f, int64(start), int64(end-start)))
+		if err != nil {
+			return err
+		}
+		if dgst != zt.SpanDigests[id] {
+			c.violate(RuleZtocSpanDigests, desc.Digest, "span %d of layer %s has digest %s, expected %s", id, layer.Digest, dgst, zt.SpanDigests[id])
+		}
+	}
+	return nil
+}
+
+// checkSampledSpans checks sampled spans of `zt` and the files starting in them against its layer,
+// read with the LayerReader of the checker.
+func (c *checker) checkSampledSpans(ctx context.Context, desc ocispec.Descriptor, zt *ztoc.Ztoc, layer ocispec.Descriptor) error {
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return nil // reported by checkSpans
+	}
+	defer zinfo.Close()
+	ra, err := c.cfg.layerReader(ctx, layer)
+	if err != nil {
+		return fmt.Errorf("failed to open layer %s: %w", layer.Digest, err)
+	}
+	for _, id := range sampleSpans(zt.MaxSpanID, c.cfg.samples) {
+		c.report.SampledSpans++
+		start := zinfo.StartCompressedOffset(id)
+		end := zinfo.EndCompressedOffset(id, zt.CompressedArchiveSize)
+		if start > end {
+			c.violate(RuleZtocSpans, desc.Digest, "span %d ends at %d before it starts at %d", id, end, start)
+			continue
+		}
+		buf := make([]byte, end-start)
+		if _, err := ra.ReadAt(buf, int64(start)); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read span %d of layer %s: %w", id, layer.Digest, err)
+		}
+		if dgst := digest.FromBytes(buf); dgst != zt.SpanDigests[id] {
+			c.violate(RuleZtocSpanDigests, desc.Digest, "span %d of layer %s has digest %s, expected %s", id, layer.Digest, dgst, zt.SpanDigests[id])
+			continue
+		}
+		uncompressedStart := zinfo.StartUncompressedOffset(id)
+		uncompressedEnd := zinfo.EndUncompressedOffset(id, zt.UncompressedArchiveSize)
+		data, err := zinfo.ExtractDataFromBuffer(buf, uncompressedEnd-uncompressedStart, uncompressedStart, id)
+		if err != nil {
+			c.violate(RuleZtocSpans, desc.Digest, "span %d of layer %s can't be decompressed from its checkpoint: %v", id, layer.Digest, err)
+			continue
+		}
+		c.checkFileOffsets(desc, zt, layer, data, uncompressedStart)
+	}
+	return nil
+}
+
+// checkFileOffsets checks the tar headers of the regular files of `zt` whose header and start
+// are in `data`, the uncompressed data of the layer at `offset`.
+func (c *checker) checkFileOffsets(desc ocispec.Descriptor, zt *ztoc.Ztoc, layer ocispec.Descriptor, data []byte, offset compression.Offset) {
+	end := offset + compression.Offset(len(data))
+	for _, f := range zt.FileMetadata {
+		if f.Type != "reg" || f.UncompressedOffset-tarBlockSize < offset || f.UncompressedOffset > end {
+			continue
+		}
+		block := data[f.UncompressedOffset-tarBlockSize-offset : f.UncompressedOffset-offset]
+		// The header right before the data of a file is its ustar header, even if PAX or GNU
+		// headers precede it. GNU sparse files are followed by their sparse map instead.
+		if block[156] == tar.TypeGNUSparse {
+			continue
+		}
+		hdr, err := tar.NewReader(bytes.NewReader(block)).Next()
+		if err != nil {
+			c.violate(RuleZtocFileOffsets, desc.Digest, "file %q of layer %s at %d isn't preceded by a tar header: %v", f.Name, layer.Digest, f.UncompressedOffset, err)
+			continue
+		}
+		if hdr.Size != int64(f.UncompressedSize) {
+			c.violate(RuleZtocFileOffsets, desc.Digest, "file %q of layer %s at %d has %d bytes, its tar header records %d", f.Name, layer.Digest, f.UncompressedOffset, f.UncompressedSize, hdr.Size)
+		}
+	}
+}
+
+// tarBlockSize is the size of tar headers.
+const tarBlockSize = 512
+
+// sampleSpans returns `n` spans spread evenly from the first to the last span `max`,
+// or every span if `n` is not positive or covers them all.
+func sampleSpans(max compression.SpanID, n int) []compression.SpanID {
+	total := int(max) + 1
+	if n <= 0 || n >= total {
+		n = total
+	}
+	spans := make([]compression.SpanID, 0, n)
+	for i := 0; i < n; i++ {
+		id := compression.SpanID(0)
+		if n > 1 {
+			id = compression.SpanID(i * (total - 1) / (n - 1))
+		}
+		spans = append(spans, id)
+	}
+	return spans
+}
+
+// fetch fetches the content of `desc` from `f`, reading at most `limit` bytes unless it's negative.
+// The content isn't verified, so that the checks can report contents which don't match `desc`.
+func fetch(ctx context.Context, f orascontent.Fetcher, desc ocispec.Descriptor, limit int64) ([]byte, error) {
+	rc, err := f.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if limit >= 0 {
+		r = io.LimitReader(rc, limit)
+	}
+	return io.ReadAll(r)
+}
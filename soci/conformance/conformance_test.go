@@ -0,0 +1,377 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package conformance
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// memoryFetcher fetches contents from memory.
+type memoryFetcher map[digest.Digest][]byte
+
+func (m memoryFetcher) Fetch(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	b, ok := m[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", desc.Digest)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m memoryFetcher) add(mediaType string, b []byte) ocispec.Descriptor {
+	dgst := digest.FromBytes(b)
+	m[dgst] = b
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(b))}
+}
+
+// testArtifacts are an image manifest with a single layer and its SOCI index.
+type testArtifacts struct {
+	store        memoryFetcher
+	manifestDesc ocispec.Descriptor
+	manifest     ocispec.Manifest
+	layer        ocispec.Descriptor
+	ztoc         *ztoc.Ztoc
+}
+
+func newTestArtifacts(t *testing.T) *testArtifacts {
+	toc, r, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file", string(testutil.RandomByteData(200000))),
+	}, gzip.BestCompression, 65536)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	layerBytes, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testArtifacts{store: make(memoryFetcher), ztoc: toc}
+	a.layer = a.store.add(ocispec.MediaTypeImageLayerGzip, layerBytes)
+	a.manifest = ocispec.Manifest{Layers: []ocispec.Descriptor{a.layer}}
+	a.manifestDesc = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("manifest")}
+	return a
+}
+
+// index stores the SOCI index of the artifacts, with the zTOC and its descriptor changed by `modify`.
+func (a *testArtifacts) index(t *testing.T, modify func(zt *ztoc.Ztoc, desc *ocispec.Descriptor) []byte) ocispec.Descriptor {
+	zt := *a.ztoc
+	var ztocBytes []byte
+	desc := ocispec.Descriptor{
+		MediaType: soci.SociLayerMediaType,
+		Annotations: map[string]string{
+			soci.IndexAnnotationImageLayerMediaType: a.layer.MediaType,
+			soci.IndexAnnotationImageLayerDigest:    a.layer.Digest.String(),
+		},
+	}
+	if modify != nil {
+		ztocBytes = modify(&zt, &desc)
+	}
+	if ztocBytes == nil {
+		r, _, err := ztoc.Marshal(&zt)
+		if err != nil {
+			t.Fatalf("failed to marshal ztoc: %v", err)
+		}
+		if ztocBytes, err = io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	added := a.store.add(desc.MediaType, ztocBytes)
+	desc.Digest, desc.Size = added.Digest, added.Size
+	b, err := soci.MarshalIndex(soci.NewIndex([]ocispec.Descriptor{desc}, &a.manifestDesc, nil))
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	return a.store.add(ocispec.MediaTypeImageManifest, b)
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(zt *ztoc.Ztoc, desc *ocispec.Descriptor) []byte
+		expected []Rule
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "wrong media type",
+			modify: func(_ *ztoc.Ztoc, desc *ocispec.Descriptor) []byte {
+				desc.MediaType = "application/vnd.example.ztoc"
+				return nil
+			},
+			expected: []Rule{RuleZtocMediaType},
+		},
+		{
+			name: "missing layer digest",
+			modify: func(_ *ztoc.Ztoc, desc *ocispec.Descriptor) []byte {
+				delete(desc.Annotations, soci.IndexAnnotationImageLayerDigest)
+				return nil
+			},
+			expected: []Rule{RuleZtocAnnotations},
+		},
+		{
+			name: "invalid optional annotation",
+			modify: func(_ *ztoc.Ztoc, desc *ocispec.Descriptor) []byte {
+				desc.Annotations[soci.IndexAnnotationReadaheadSize] = "-1"
+				return nil
+			},
+			expected: []Rule{RuleZtocAnnotations},
+		},
+		{
+			name: "not a flatbuffer",
+			modify: func(_ *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+				return []byte("not a ztoc")
+			},
+			expected: []Rule{RuleZtocFlatbuffer},
+		},
+		{
+			name: "unsupported version",
+			modify: func(zt *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+				zt.Version = "2.0"
+				return nil
+			},
+			expected: []Rule{RuleZtocVersion},
+		},
+		{
+			name: "unknown file type",
+			modify: func(zt *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+				zt.FileMetadata = append([]ztoc.FileMetadata{}, zt.FileMetadata...)
+				zt.FileMetadata[0].Type = "socket"
+				return nil
+			},
+			expected: []Rule{RuleZtocFiles},
+		},
+		{
+			name: "wrong compressed archive size",
+			modify: func(zt *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+				zt.CompressedArchiveSize++
+				return nil
+			},
+			expected: []Rule{RuleZtocLayer},
+		},
+		{
+			name: "wrong span digest",
+			modify: func(zt *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+				zt.SpanDigests = append([]digest.Digest{digest.FromString("span")}, zt.SpanDigests[1:]...)
+				return nil
+			},
+			expected: []Rule{RuleZtocSpanDigests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestArtifacts(t)
+			indexDesc := a.index(t, tt.modify)
+			report, err := Check(context.Background(), a.store, indexDesc,
+				WithImageManifest(a.manifestDesc, a.manifest), WithLayerFetcher(a.store))
+			if err != nil {
+				t.Fatalf("failed to check: %v", err)
+			}
+			if report.Ztocs != 1 {
+				t.Fatalf("unexpected number of checked zTOCs: %d", report.Ztocs)
+			}
+			rules := make(map[Rule]bool)
+			for _, v := range report.Violations {
+				rules[v.Rule] = true
+			}
+			for _, rule := range tt.expected {
+				if !rules[rule] {
+					t.Errorf("expected a violation of %s; got = %+v", rule, report.Violations)
+				}
+				delete(rules, rule)
+			}
+			if len(rules) > 0 {
+				t.Errorf("unexpected violations: %+v", report.Violations)
+			}
+			if report.Passed() != (len(tt.expected) == 0) {
+				t.Errorf("unexpected result: %v", report.Passed())
+			}
+		})
+	}
+}
+
+func TestCheckSampledSpans(t *testing.T) {
+	a := newTestArtifacts(t)
+	reader := func(_ context.Context, layer ocispec.Descriptor) (io.ReaderAt, error) {
+		return bytes.NewReader(a.store[layer.Digest]), nil
+	}
+	tests := []struct {
+		name     string
+		modify   func(zt *ztoc.Ztoc, desc *ocispec.Descriptor) []byte
+		expected Rule
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "wrong span digest",
+			modify: func(zt *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+				zt.SpanDigests = append([]digest.Digest{digest.FromString("span")}, zt.SpanDigests[1:]...)
+				return nil
+			},
+			expected: RuleZtocSpanDigests,
+		},
+		{
+			name: "wrong file offset",
+			modify: func(zt *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+				zt.FileMetadata = append([]ztoc.FileMetadata{}, zt.FileMetadata...)
+				for i := range zt.FileMetadata {
+					if zt.FileMetadata[i].Type == "reg" {
+						zt.FileMetadata[i].UncompressedOffset += 512
+						zt.FileMetadata[i].UncompressedSize -= 512
+					}
+				}
+				return nil
+			},
+			expected: RuleZtocFileOffsets,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := Check(context.Background(), a.store, a.index(t, tt.modify), WithLayerReader(reader, 2))
+			if err != nil {
+				t.Fatalf("failed to check: %v", err)
+			}
+			if report.SampledSpans != 2 {
+				t.Fatalf("unexpected number of sampled spans: %d", report.SampledSpans)
+			}
+			if tt.expected == "" {
+				if !report.Passed() {
+					t.Fatalf("unexpected violations: %+v", report.Violations)
+				}
+				return
+			}
+			if len(report.Violations) != 1 || report.Violations[0].Rule != tt.expected {
+				t.Fatalf("expected a violation of %s; got = %+v", tt.expected, report.Violations)
+			}
+		})
+	}
+}
+
+func TestSampleSpans(t *testing.T) {
+	if spans := sampleSpans(9, 0); len(spans) != 10 {
+		t.Fatalf("expected every span; got %v", spans)
+	}
+	spans := sampleSpans(9, 4)
+	if fmt.Sprint(spans) != "[0 3 6 9]" {
+		t.Fatalf("unexpected sampled spans: %v", spans)
+	}
+	if spans := sampleSpans(0, 4); fmt.Sprint(spans) != "[0]" {
+		t.Fatalf("unexpected sampled spans of a single span: %v", spans)
+	}
+}
+
+func TestCheckIndex(t *testing.T) {
+	a := newTestArtifacts(t)
+	indexDesc := a.index(t, nil)
+
+	// An index of another image.
+	other := ocispec.Descriptor{Digest: digest.FromString("other")}
+	report, err := Check(context.Background(), a.store, indexDesc, WithImageManifest(other, a.manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 1 || report.Violations[0].Rule != RuleIndexSubject {
+		t.Fatalf("unexpected violations: %+v", report.Violations)
+	}
+
+	// An index whose config isn't the SOCI index artifact type.
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = Check(context.Background(), a.store, a.store.add(ocispec.MediaTypeImageManifest, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 1 || report.Violations[0].Rule != RuleIndexConfig {
+		t.Fatalf("unexpected violations: %+v", report.Violations)
+	}
+
+	// An index packaged as an OCI 1.1 artifact.
+	var index soci.Index
+	if err := soci.UnmarshalIndex(a.store[indexDesc.Digest], &index); err != nil {
+		t.Fatal(err)
+	}
+	index.Packaging = soci.IndexPackagingOCI11
+	if b, err = soci.MarshalIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Check(context.Background(), a.store, a.store.add(ocispec.MediaTypeImageManifest, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 0 {
+		t.Fatalf("unexpected violations: %+v", report.Violations)
+	}
+
+	// A descriptor which doesn't match the index.
+	indexDesc.Size++
+	report, err = Check(context.Background(), a.store, indexDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 1 || report.Violations[0].Rule != RuleIndexContent {
+		t.Fatalf("unexpected violations: %+v", report.Violations)
+	}
+}
+
+// recordingTB records the failures of Test.
+type recordingTB struct {
+	errors, fatals []string
+}
+
+func (r *recordingTB) Helper() {}
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+func (r *recordingTB) Fatalf(format string, args ...interface{}) {
+	r.fatals = append(r.fatals, fmt.Sprintf(format, args...))
+}
+
+func TestTest(t *testing.T) {
+	a := newTestArtifacts(t)
+	tb := &recordingTB{}
+	Test(tb, a.store, a.index(t, nil), WithLayerFetcher(a.store))
+	if len(tb.errors) != 0 || len(tb.fatals) != 0 {
+		t.Fatalf("unexpected failures of a valid index: %v %v", tb.errors, tb.fatals)
+	}
+	Test(tb, a.store, a.index(t, func(zt *ztoc.Ztoc, _ *ocispec.Descriptor) []byte {
+		zt.Version = "2.0"
+		return nil
+	}))
+	if len(tb.errors) != 1 || !strings.HasPrefix(tb.errors[0], string(RuleZtocVersion)) {
+		t.Fatalf("unexpected failures of an invalid index: %v", tb.errors)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package conformance
+
+import (
+	"context"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// TB is the subset of testing.TB used by Test, so that this package doesn't depend on testing.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// Test checks the SOCI index described by `desc` and its zTOCs, fetched from `f`, and fails
+// the test `t` with every violation of the rules. For example, a producer writing its artifacts
+// to an OCI image layout can check them with:
+//
+//	store, _ := oci.New(layoutDir)
+//	conformance.Test(t, store, indexDesc, conformance.WithLayerFetcher(store))
+func Test(t TB, f orascontent.Fetcher, desc ocispec.Descriptor, opts ...Option) {
+	t.Helper()
+	report, err := Check(context.Background(), f, desc, opts...)
+	if err != nil {
+		t.Fatalf("failed to check SOCI index %s: %v", desc.Digest, err)
+	}
+	for _, v := range report.Violations {
+		t.Errorf("%s: %s: %s", v.Rule, v.Artifact, v.Message)
+	}
+}
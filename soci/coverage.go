@@ -0,0 +1,60 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Coverage is how much of the layers of an image manifest are indexed by a SOCI index,
+// i.e. have a ztoc and so can be lazily loaded.
+type Coverage struct {
+	// Layers is the number of layers of the image manifest.
+	Layers int
+	// IndexedLayers is the number of layers of the image manifest with a ztoc.
+	IndexedLayers int
+	// Size is the total size of the layers of the image manifest.
+	Size int64
+	// IndexedSize is the total size of the layers of the image manifest with a ztoc.
+	IndexedSize int64
+}
+
+// NewCoverage returns the coverage of the layers of manifest by index.
+// A nil index covers no layers.
+func NewCoverage(manifest ocispec.Manifest, index *Index) Coverage {
+	indexed := make(map[string]struct{})
+	if index != nil {
+		for _, blob := range index.Blobs {
+			if blob.MediaType != SociLayerMediaType {
+				continue
+			}
+			if layerDigest, ok := blob.Annotations[IndexAnnotationImageLayerDigest]; ok {
+				indexed[layerDigest] = struct{}{}
+			}
+		}
+	}
+	var c Coverage
+	for _, layer := range manifest.Layers {
+		c.Layers++
+		c.Size += layer.Size
+		if _, ok := indexed[layer.Digest.String()]; ok {
+			c.IndexedLayers++
+			c.IndexedSize += layer.Size
+		}
+	}
+	return c
+}
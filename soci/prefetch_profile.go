@@ -0,0 +1,51 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PrefetchProfileMediaType is the media type of prefetch profiles.
+const PrefetchProfileMediaType = "application/vnd.amazon.soci.prefetch-profile.v1+json"
+
+// PrefetchProfile lists the files of an image whose contents the snapshotter fetches when it
+// mounts the layers of the image, e.g. the files read while a container of the image starts.
+// Its digest is passed to the snapshotter with the prefetch profile label of the snapshots.
+type PrefetchProfile struct {
+	MediaType string `json:"mediaType"`
+	// Files are the paths of the files, relative to the root of the image.
+	Files []string `json:"files"`
+}
+
+// NewPrefetchProfile returns the prefetch profile of `files`.
+func NewPrefetchProfile(files []string) PrefetchProfile {
+	return PrefetchProfile{MediaType: PrefetchProfileMediaType, Files: files}
+}
+
+// ParsePrefetchProfile parses the prefetch profile `b`.
+func ParsePrefetchProfile(b []byte) (PrefetchProfile, error) {
+	var profile PrefetchProfile
+	if err := json.Unmarshal(b, &profile); err != nil {
+		return profile, fmt.Errorf("cannot parse prefetch profile: %w", err)
+	}
+	if profile.MediaType != PrefetchProfileMediaType {
+		return profile, fmt.Errorf("unexpected media type of prefetch profile %q", profile.MediaType)
+	}
+	return profile, nil
+}
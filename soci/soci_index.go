@@ -27,6 +27,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/estargz"
+	"github.com/awslabs/soci-snapshotter/util/logutil"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/content"
@@ -34,6 +36,7 @@ import (
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/platforms"
 	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	orascontent "oras.land/oras-go/v2/content"
@@ -51,6 +54,19 @@ const (
 	IndexAnnotationImageLayerDigest = "com.amazon.soci.image-layer-digest"
 	// IndexAnnotationBuildToolIdentifier is the index annotation for build tool identifier
 	IndexAnnotationBuildToolIdentifier = "com.amazon.soci.build-tool-identifier"
+	// IndexAnnotationBackgroundFetchPriority is the (optional) index annotation for the background fetch
+	// priority of an image layer, an integer. It overrides the priority derived from the layer position.
+	IndexAnnotationBackgroundFetchPriority = "com.amazon.soci.background-fetch-priority"
+	// IndexAnnotationReadaheadSize is the (optional) index annotation for the number of bytes of an image layer
+	// to read ahead after each read, e.g. for layers holding large files which are read sequentially.
+	IndexAnnotationReadaheadSize = "com.amazon.soci.readahead-size"
+	// IndexAnnotationCoalesceSize is the (optional) index annotation for the maximum number of bytes of
+	// adjacent spans of an image layer fetched with a single request, e.g. "67108864" for 64MiB reads.
+	IndexAnnotationCoalesceSize = "com.amazon.soci.coalesce-size"
+	// IndexListAnnotationImageDigest is the index list annotation for the digest of the multi-architecture image
+	IndexListAnnotationImageDigest = "com.amazon.soci.image-digest"
+	// MediaTypeEmptyJSON is the media type of the empty JSON object, the config of OCI 1.1 artifacts
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
 
 	defaultSpanSize            = int64(1 << 22) // 4MiB
 	defaultMinLayerSize        = 10 << 20       // 10MiB
@@ -78,6 +94,27 @@ var (
 	}
 )
 
+// IndexPackaging is how a SOCI index is packaged into an OCI image manifest.
+type IndexPackaging string
+
+const (
+	// IndexPackagingLegacy packages a SOCI index as an OCI 1.0 image manifest whose config has the
+	// artifact type of the index as media type. It's the default, understood by every registry.
+	IndexPackagingLegacy IndexPackaging = "legacy"
+	// IndexPackagingOCI11 packages a SOCI index as an OCI 1.1 artifact: an image manifest with the
+	// artifact type of the index as `artifactType` and the empty JSON object as config.
+	IndexPackagingOCI11 IndexPackaging = "oci-1.1"
+)
+
+// ParseIndexPackaging parses the name of an IndexPackaging.
+func ParseIndexPackaging(s string) (IndexPackaging, error) {
+	switch p := IndexPackaging(s); p {
+	case IndexPackagingLegacy, IndexPackagingOCI11:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown soci index packaging %q, expected %q or %q", s, IndexPackagingLegacy, IndexPackagingOCI11)
+}
+
 // Index represents a SOCI index manifest.
 type Index struct {
 	// MediaType represents the type of document into which the SOCI index manifest will be serialized
@@ -94,6 +131,9 @@ type Index struct {
 
 	// Annotations are optional additional metadata for the index.
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Packaging is how the index is packaged into an OCI image manifest, IndexPackagingLegacy if empty.
+	Packaging IndexPackaging `json:"-"`
 }
 
 // IndexWithMetadata has a soci `Index` and its metadata.
@@ -136,22 +176,52 @@ func UnmarshalIndex(b []byte, index *Index) error {
 	return nil
 }
 
-// fromManifest converts an OCI 1.0 Manifest to a SOCI Index
+// fromManifest converts an OCI 1.0 Manifest, or an OCI 1.1 artifact manifest, to a SOCI Index
 func fromManifest(manifest ocispec.Manifest, index *Index) {
 	index.MediaType = manifest.MediaType
 	index.ArtifactType = SociIndexArtifactType
+	index.Packaging = IndexPackagingLegacy
+	if manifest.ArtifactType != "" {
+		index.ArtifactType = manifest.ArtifactType
+		index.Packaging = IndexPackagingOCI11
+	} else if manifest.Config.MediaType != "" {
+		index.ArtifactType = manifest.Config.MediaType
+	}
 	index.Blobs = manifest.Layers
 	index.Subject = manifest.Subject
 	index.Annotations = manifest.Annotations
 }
 
+// indexArtifactType returns the artifact type of the index `i`, SociIndexArtifactType if not set.
+func indexArtifactType(i *Index) string {
+	if i.ArtifactType == "" {
+		return SociIndexArtifactType
+	}
+	return i.ArtifactType
+}
+
+// indexConfigDescriptor returns the descriptor of the config of the manifest the index `i` is
+// serialized into, whose content is defaultConfigContent.
+func indexConfigDescriptor(i *Index) ocispec.Descriptor {
+	config := defaultConfigDescriptor
+	if i.Packaging == IndexPackagingOCI11 {
+		config.MediaType = MediaTypeEmptyJSON
+	} else {
+		config.MediaType = indexArtifactType(i)
+	}
+	return config
+}
+
 // MarshalIndex serializes a SOCI index into a JSON blob.
 // The JSON blob is an OCI 1.0 Manifest
 func MarshalIndex(i *Index) ([]byte, error) {
 	var manifest ocispec.Manifest
 	manifest.SchemaVersion = 2
 	manifest.MediaType = ocispec.MediaTypeImageManifest
-	manifest.Config = defaultConfigDescriptor
+	manifest.Config = indexConfigDescriptor(i)
+	if i.Packaging == IndexPackagingOCI11 {
+		manifest.ArtifactType = indexArtifactType(i)
+	}
 	manifest.Layers = i.Blobs
 	manifest.Subject = i.Subject
 	manifest.Annotations = i.Annotations
@@ -197,12 +267,42 @@ func GetIndexDescriptorCollection(ctx context.Context, cs content.Store, artifac
 	return descriptors, indexDesc, nil
 }
 
+// GetIndexListDescriptors returns all `IndexDescriptorInfo` of the index lists of the multi-architecture image `img`.
+func GetIndexListDescriptors(artifactsDb *ArtifactsDb, img images.Image) ([]IndexDescriptorInfo, error) {
+	entries, err := artifactsDb.getIndexListArtifactEntries(img.Target.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	var descriptors []IndexDescriptorInfo
+	for _, entry := range entries {
+		dgst, err := digest.Parse(entry.Digest)
+		if err != nil {
+			continue
+		}
+		descriptors = append(descriptors, IndexDescriptorInfo{
+			Descriptor: ocispec.Descriptor{
+				MediaType: entry.MediaType,
+				Digest:    dgst,
+				Size:      entry.Size,
+			},
+			CreatedAt: entry.CreatedAt,
+		})
+	}
+	return descriptors, nil
+}
+
 type buildConfig struct {
 	spanSize            int64
+	spanSizeRules       []SpanSizeRule
 	minLayerSize        int64
 	buildToolIdentifier string
 	artifactsDb         *ArtifactsDb
 	platform            ocispec.Platform
+	ztocSources         []ZtocSource
+	artifactType        string
+	packaging           IndexPackaging
+	annotations         map[string]string
+	progress            func(LayerProgress)
 }
 
 // BuildOption specifies a config change to build soci indices.
@@ -248,9 +348,63 @@ func WithArtifactsDb(db *ArtifactsDb) BuildOption {
 	}
 }
 
+// WithArtifactType specifies the artifact type of the soci indices, SociIndexArtifactType by default.
+// The snapshotter only discovers soci indices with the default artifact type.
+func WithArtifactType(artifactType string) BuildOption {
+	return func(c *buildConfig) error {
+		c.artifactType = artifactType
+		return nil
+	}
+}
+
+// WithIndexPackaging specifies how the soci indices are packaged, IndexPackagingLegacy by default.
+func WithIndexPackaging(packaging IndexPackaging) BuildOption {
+	return func(c *buildConfig) error {
+		if _, err := ParseIndexPackaging(string(packaging)); err != nil {
+			return err
+		}
+		c.packaging = packaging
+		return nil
+	}
+}
+
+// WithIndexAnnotations adds annotations to the soci indices, e.g. the ID of the build which created them.
+func WithIndexAnnotations(annotations map[string]string) BuildOption {
+	return func(c *buildConfig) error {
+		if c.annotations == nil {
+			c.annotations = make(map[string]string)
+		}
+		for k, v := range annotations {
+			c.annotations[k] = v
+		}
+		return nil
+	}
+}
+
+// LayerProgress reports what the builder did with a layer of the image.
+type LayerProgress struct {
+	// Layer is the descriptor of the layer.
+	Layer ocispec.Descriptor
+	// Ztoc is the descriptor of the zTOC of the layer, or nil if the layer was skipped.
+	Ztoc *ocispec.Descriptor
+	// Reused is true if the zTOC was reused from a zTOC source rather than built.
+	Reused bool
+	// SkipReason is why the layer was skipped, if it was.
+	SkipReason string
+}
+
+// WithProgress calls `fn` once the zTOC of each layer is built or reused, or the layer is skipped.
+// Layers are indexed concurrently, so `fn` may be called concurrently.
+func WithProgress(fn func(LayerProgress)) BuildOption {
+	return func(c *buildConfig) error {
+		c.progress = fn
+		return nil
+	}
+}
+
 // IndexBuilder creates soci indices.
 type IndexBuilder struct {
-	contentStore content.Store
+	contentStore content.Provider
 	blobStore    orascontent.Storage
 	ArtifactsDb  *ArtifactsDb
 	config       *buildConfig
@@ -258,13 +412,16 @@ type IndexBuilder struct {
 }
 
 // NewIndexBuilder returns an `IndexBuilder` that is used to create soci indices.
-func NewIndexBuilder(contentStore content.Store, blobStore orascontent.Storage, artifactsDb *ArtifactsDb, opts ...BuildOption) (*IndexBuilder, error) {
+// The images and their layers are read from `contentStore`, and the zTOCs are written to `blobStore`
+// and recorded in `artifactsDb`, unless it's nil.
+func NewIndexBuilder(contentStore content.Provider, blobStore orascontent.Storage, artifactsDb *ArtifactsDb, opts ...BuildOption) (*IndexBuilder, error) {
 	defaultPlatform := platforms.DefaultSpec()
 	config := &buildConfig{
 		spanSize:            defaultSpanSize,
 		minLayerSize:        defaultMinLayerSize,
 		buildToolIdentifier: defaultBuildToolIdentifier,
 		platform:            defaultPlatform,
+		packaging:           IndexPackagingLegacy,
 	}
 
 	for _, opt := range opts {
@@ -352,6 +509,9 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 	annotations := map[string]string{
 		IndexAnnotationBuildToolIdentifier: b.config.buildToolIdentifier,
 	}
+	for k, v := range b.config.annotations {
+		annotations[k] = v
+	}
 
 	refers := &ocispec.Descriptor{
 		MediaType: imgManifestDesc.MediaType,
@@ -360,6 +520,10 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 	}
 
 	index := NewIndex(ztocsDesc, refers, annotations)
+	if b.config.artifactType != "" {
+		index.ArtifactType = b.config.artifactType
+	}
+	index.Packaging = b.config.packaging
 	return &IndexWithMetadata{
 		Index:       index,
 		Platform:    &b.config.platform,
@@ -368,6 +532,20 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 	}, nil
 }
 
+// detectCompression returns the compression algorithm of a layer from its magic number:
+// gzip if it starts like a gzip stream, uncompressed otherwise.
+func detectCompression(r io.ReaderAt) (string, error) {
+	magic := make([]byte, 2)
+	n, err := r.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if n == len(magic) && magic[0] == 0x1f && magic[1] == 0x8b {
+		return compression.Gzip, nil
+	}
+	return compression.Uncompressed, nil
+}
+
 // buildSociLayer builds a ztoc for an image layer (`desc`) and returns ztoc descriptor.
 // It may skip building ztoc (e.g., if layer size < `minLayerSize`) and return nil.
 func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
@@ -376,10 +554,29 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 	}
 	// check if we need to skip building the zTOC
 	if skip, reason := skipBuildingZtoc(desc, b.config); skip {
-		fmt.Printf("ztoc skipped - layer %s (%s) %s\n", desc.Digest, desc.MediaType, reason)
+		b.reportLayer(ctx, LayerProgress{Layer: desc, SkipReason: reason})
 		return nil, nil
 	}
 
+	ztocDesc, err := b.reuseZtoc(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	if ztocDesc == nil {
+		if ztocDesc, err = b.buildZtoc(ctx, desc); err != nil {
+			return nil, err
+		}
+	}
+
+	ztocDesc.Annotations = map[string]string{
+		IndexAnnotationImageLayerMediaType: desc.MediaType,
+		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+	}
+	return ztocDesc, nil
+}
+
+// buildZtoc builds the ztoc of an image layer (`desc`), writes it to the blob store and returns its descriptor.
+func (b *IndexBuilder) buildZtoc(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 	compressionAlgo, err := images.DiffCompression(ctx, desc.MediaType)
 	if err != nil {
 		return nil, fmt.Errorf("could not determine layer compression: %w", err)
@@ -387,15 +584,17 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 
 	if compressionAlgo == "" {
 		switch desc.MediaType {
-		case ocispec.MediaTypeImageLayer:
+		case ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayerNonDistributable: // nolint:staticcheck
 			// for OCI image layers, empty is returned for an uncompressed layer.
 			compressionAlgo = compression.Uncompressed
 		}
 	}
 
 	if !b.ztocBuilder.CheckCompressionAlgorithm(compressionAlgo) {
-		fmt.Printf("ztoc skipped - layer %s (%s) is compressed in an unsupported format. expect: [tar, gzip, unknown] but got %q\n",
-			desc.Digest, desc.MediaType, compressionAlgo)
+		b.reportLayer(ctx, LayerProgress{
+			Layer:      desc,
+			SkipReason: fmt.Sprintf("is compressed in an unsupported format. expect: [tar, gzip, unknown] but got %q", compressionAlgo),
+		})
 		return nil, errUnsupportedLayerFormat
 	}
 
@@ -418,8 +617,28 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 	if n != desc.Size {
 		return nil, errors.New("the size of the temp file doesn't match that of the layer")
 	}
+	if compressionAlgo == compression.Unknown {
+		// Docker tar layers may be compressed regardless of their media type.
+		if compressionAlgo, err = detectCompression(tmpFile); err != nil {
+			return nil, fmt.Errorf("could not detect layer compression: %w", err)
+		}
+	}
 
-	toc, err := b.ztocBuilder.BuildZtoc(tmpFile.Name(), b.config.spanSize, ztoc.WithCompression(compressionAlgo))
+	ztocOpts := []ztoc.BuildOption{ztoc.WithCompression(compressionAlgo)}
+	if _, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; ok && compressionAlgo == compression.Gzip {
+		// The files of eStargz layers are listed by their TOC, so the TOC of the zTOC is built
+		// from it rather than from the tar archive of the layer.
+		layer, err := estargz.OpenDescriptor(tmpFile, desc)
+		if err != nil {
+			return nil, err
+		}
+		toc, err := layer.ZtocTOC()
+		if err != nil {
+			return nil, fmt.Errorf("could not build TOC of eStargz layer %s: %w", desc.Digest, err)
+		}
+		ztocOpts = append(ztocOpts, ztoc.WithTOC(toc, compression.Offset(layer.UncompressedSize)))
+	}
+	toc, err := b.ztocBuilder.BuildZtoc(tmpFile.Name(), b.config.layerSpanSize(desc), ztocOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -429,9 +648,35 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 		return nil, err
 	}
 
-	err = b.blobStore.Push(ctx, ztocDesc, ztocReader)
+	// Stores keyed by the media type of contents, e.g. memory stores, need it to find the zTOC.
+	ztocDesc.MediaType = SociLayerMediaType
+	if err := b.writeZtoc(ctx, ztocDesc, ztocReader, desc); err != nil {
+		return nil, err
+	}
+
+	b.reportLayer(ctx, LayerProgress{Layer: desc, Ztoc: &ztocDesc})
+	return &ztocDesc, nil
+}
+
+// reportLayer logs what was done with a layer and reports it to the progress callback, if any.
+func (b *IndexBuilder) reportLayer(ctx context.Context, p LayerProgress) {
+	entry := log.G(ctx).WithField(logutil.LayerField, p.Layer.Digest)
+	if p.Ztoc == nil {
+		entry.WithField("reason", p.SkipReason).Debug("ztoc skipped")
+	} else {
+		entry.WithField("ztoc", p.Ztoc.Digest).WithField("reused", p.Reused).Debug("ztoc created")
+	}
+	if b.config.progress != nil {
+		b.config.progress(p)
+	}
+}
+
+// writeZtoc writes the ztoc `ztocDesc` of an image layer (`desc`) to the blob store and records
+// it in the artifacts database.
+func (b *IndexBuilder) writeZtoc(ctx context.Context, ztocDesc ocispec.Descriptor, r io.Reader, desc ocispec.Descriptor) error {
+	err := b.blobStore.Push(ctx, ztocDesc, r)
 	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
-		return nil, fmt.Errorf("cannot push ztoc to local store: %w", err)
+		return fmt.Errorf("cannot push ztoc to local store: %w", err)
 	}
 
 	// write the artifact entry for soci layer
@@ -445,19 +690,12 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 		MediaType:      SociLayerMediaType,
 		CreatedAt:      time.Now(),
 	}
-	err = b.ArtifactsDb.WriteArtifactEntry(entry)
-	if err != nil {
-		return nil, err
-	}
-
-	fmt.Printf("layer %s -> ztoc %s\n", desc.Digest, ztocDesc.Digest)
-
-	ztocDesc.MediaType = SociLayerMediaType
-	ztocDesc.Annotations = map[string]string{
-		IndexAnnotationImageLayerMediaType: desc.MediaType,
-		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+	if b.ArtifactsDb != nil {
+		if err := b.ArtifactsDb.WriteArtifactEntry(entry); err != nil {
+			return err
+		}
 	}
-	return &ztocDesc, err
+	return nil
 }
 
 // NewIndex returns a new index.
@@ -468,7 +706,40 @@ func NewIndex(blobs []ocispec.Descriptor, subject *ocispec.Descriptor, annotatio
 		Annotations:  annotations,
 		Subject:      subject,
 		MediaType:    ocispec.MediaTypeImageManifest,
+		Packaging:    IndexPackagingLegacy,
+	}
+}
+
+// NewIndexList returns an OCI image index referencing the SOCI indices of the platforms of
+// a multi-architecture image, so that they can be handled as a single artifact.
+// The manifest descriptors carry the platform of each SOCI index.
+func NewIndexList(indices []*IndexWithMetadata, imageDigest digest.Digest, annotations map[string]string) (*ocispec.Index, error) {
+	manifests := make([]ocispec.Descriptor, 0, len(indices))
+	for _, i := range indices {
+		b, err := MarshalIndex(i.Index)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, ocispec.Descriptor{
+			MediaType:    i.Index.MediaType,
+			ArtifactType: indexArtifactType(i.Index),
+			Digest:       digest.FromBytes(b),
+			Size:         int64(len(b)),
+			Platform:     i.Platform,
+		})
+	}
+	listAnnotations := map[string]string{
+		IndexListAnnotationImageDigest: imageDigest.String(),
 	}
+	for k, v := range annotations {
+		listAnnotations[k] = v
+	}
+	return &ocispec.Index{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageIndex,
+		Manifests:   manifests,
+		Annotations: listAnnotations,
+	}, nil
 }
 
 // NewIndexFromReader returns a new index from a Reader.
@@ -492,7 +763,7 @@ func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) (bool, string)
 }
 
 // GetImageManifestDescriptor gets the descriptor of image manifest
-func GetImageManifestDescriptor(ctx context.Context, cs content.Store, imageTarget ocispec.Descriptor, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
+func GetImageManifestDescriptor(ctx context.Context, cs content.Provider, imageTarget ocispec.Descriptor, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
 	if images.IsIndexType(imageTarget.MediaType) {
 		manifests, err := images.Children(ctx, cs, imageTarget)
 		if err != nil {
@@ -525,7 +796,7 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, s
 	// empty config objct in the store as well. We will need to push this to the
 	// registry later.
 	if indexWithMetadata.Index.MediaType == ocispec.MediaTypeImageManifest {
-		err = store.Push(ctx, defaultConfigDescriptor, bytes.NewReader(defaultConfigContent))
+		err = store.Push(ctx, indexConfigDescriptor(indexWithMetadata.Index), bytes.NewReader(defaultConfigContent))
 		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
 			return fmt.Errorf("error creating OCI 1.0 empty config: %w", err)
 		}
@@ -543,7 +814,7 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, s
 		return fmt.Errorf("cannot write SOCI index to local store: %w", err)
 	}
 
-	log.G(ctx).WithField("digest", dgst.String()).Debugf("soci index has been written")
+	log.G(ctx).WithField(logutil.DigestField, dgst.String()).Debugf("soci index has been written")
 
 	refers := indexWithMetadata.Index.Subject
 
@@ -565,3 +836,42 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, s
 	}
 	return artifactsDb.WriteArtifactEntry(entry)
 }
+
+// WriteSociIndexList writes a SOCI index list to the local store, records it in the artifacts database
+// and returns its descriptor. The SOCI indices it references must be written with WriteSociIndex.
+func WriteSociIndexList(ctx context.Context, indexList *ocispec.Index, store orascontent.Storage, artifactsDb *ArtifactsDb) (*ocispec.Descriptor, error) {
+	imageDigest, err := digest.Parse(indexList.Annotations[IndexListAnnotationImageDigest])
+	if err != nil {
+		return nil, fmt.Errorf("cannot write soci index list: invalid image digest annotation: %w", err)
+	}
+	b, err := json.Marshal(indexList)
+	if err != nil {
+		return nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	err = store.Push(ctx, desc, bytes.NewReader(b))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return nil, fmt.Errorf("cannot write SOCI index list to local store: %w", err)
+	}
+	log.G(ctx).WithField(logutil.DigestField, desc.Digest.String()).Debugf("soci index list has been written")
+
+	// this entry is persisted to be used by cli push and gc
+	entry := &ArtifactEntry{
+		Digest:         desc.Digest.String(),
+		OriginalDigest: imageDigest.String(),
+		ImageDigest:    imageDigest.String(),
+		Type:           ArtifactEntryTypeIndexList,
+		Location:       imageDigest.String(),
+		Size:           desc.Size,
+		MediaType:      desc.MediaType,
+		CreatedAt:      time.Now(),
+	}
+	if err := artifactsDb.WriteArtifactEntry(entry); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
@@ -18,11 +18,15 @@ package soci
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/images"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
@@ -84,6 +88,34 @@ func TestSkipBuildingZtoc(t *testing.T) {
 	}
 }
 
+func TestDetectCompression(t *testing.T) {
+	entries := []testutil.TarEntry{testutil.File("file", "contents")}
+	testCases := []struct {
+		name     string
+		layer    io.Reader
+		expected string
+	}{
+		{name: "gzip", layer: testutil.BuildTarGz(entries, gzip.DefaultCompression), expected: compression.Gzip},
+		{name: "tar", layer: testutil.BuildTar(entries), expected: compression.Uncompressed},
+		{name: "empty", layer: bytes.NewReader(nil), expected: compression.Uncompressed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := io.ReadAll(tc.layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := detectCompression(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Fatalf("unexpected compression; expected = %q, got = %q", tc.expected, got)
+			}
+		})
+	}
+}
+
 func TestBuildSociIndexNotLayer(t *testing.T) {
 	testcases := []struct {
 		name      string
@@ -338,15 +370,37 @@ func TestMarshalIndex(t *testing.T) {
 		"foo": "bar",
 	}
 
+	oci11Index := NewIndex(blobs, &subject, annotations)
+	oci11Index.Packaging = IndexPackagingOCI11
+	customTypeIndex := NewIndex(blobs, &subject, annotations)
+	customTypeIndex.ArtifactType = "application/vnd.example.index"
+
 	testcases := []struct {
 		name  string
 		index *Index
 		ty    interface{}
+		// manifestArtifactType and configMediaType are those of the serialized manifest.
+		manifestArtifactType string
+		configMediaType      string
 	}{
 		{
-			name:  "successfully roundtrip as Image Manifest",
-			index: NewIndex(blobs, &subject, annotations),
-			ty:    ocispec.Manifest{},
+			name:            "successfully roundtrip as Image Manifest",
+			index:           NewIndex(blobs, &subject, annotations),
+			ty:              ocispec.Manifest{},
+			configMediaType: SociIndexArtifactType,
+		},
+		{
+			name:                 "successfully roundtrip as OCI 1.1 artifact",
+			index:                oci11Index,
+			ty:                   ocispec.Manifest{},
+			manifestArtifactType: SociIndexArtifactType,
+			configMediaType:      MediaTypeEmptyJSON,
+		},
+		{
+			name:            "successfully roundtrip with a custom artifact type",
+			index:           customTypeIndex,
+			ty:              ocispec.Manifest{},
+			configMediaType: "application/vnd.example.index",
 		},
 	}
 
@@ -360,6 +414,14 @@ func TestMarshalIndex(t *testing.T) {
 			if err != nil {
 				t.Fatalf("could not unmarshal index as underlying type: %v", err)
 			}
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(b, &manifest); err != nil {
+				t.Fatalf("could not unmarshal index as manifest: %v", err)
+			}
+			if manifest.ArtifactType != tc.manifestArtifactType || manifest.Config.MediaType != tc.configMediaType {
+				t.Fatalf("unexpected packaging; expected artifact type %q and config %q, got %q and %q",
+					tc.manifestArtifactType, tc.configMediaType, manifest.ArtifactType, manifest.Config.MediaType)
+			}
 			var unmarshalled Index
 			err = UnmarshalIndex(b, &unmarshalled)
 			if err != nil {
@@ -372,3 +434,137 @@ func TestMarshalIndex(t *testing.T) {
 		})
 	}
 }
+
+func TestNewIndexList(t *testing.T) {
+	blobs := []ocispec.Descriptor{
+		{
+			Size:   4,
+			Digest: digest.FromBytes([]byte("test")),
+		},
+	}
+	imageDigest := digest.FromBytes([]byte("image index"))
+	platforms := []ocispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+	var indices []*IndexWithMetadata
+	for i := range platforms {
+		subject := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Size:      int64(i),
+			Digest:    digest.FromBytes([]byte(platforms[i].Architecture)),
+		}
+		indices = append(indices, &IndexWithMetadata{
+			Index:       NewIndex(blobs, &subject, nil),
+			Platform:    &platforms[i],
+			ImageDigest: imageDigest,
+		})
+	}
+
+	indexList, err := NewIndexList(indices, imageDigest, map[string]string{"foo": "bar"})
+	if err != nil {
+		t.Fatalf("could not create index list: %v", err)
+	}
+	if indexList.MediaType != ocispec.MediaTypeImageIndex {
+		t.Fatalf("unexpected media type; expected = %v, got = %v", ocispec.MediaTypeImageIndex, indexList.MediaType)
+	}
+	if got := indexList.Annotations[IndexListAnnotationImageDigest]; got != imageDigest.String() {
+		t.Fatalf("unexpected image digest annotation; expected = %v, got = %v", imageDigest, got)
+	}
+	if got := indexList.Annotations["foo"]; got != "bar" {
+		t.Fatalf("unexpected annotation; expected = bar, got = %v", got)
+	}
+	if len(indexList.Manifests) != len(indices) {
+		t.Fatalf("unexpected number of manifests; expected = %d, got = %d", len(indices), len(indexList.Manifests))
+	}
+
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db: %v", err)
+	}
+	store := memory.New()
+	for i, desc := range indexList.Manifests {
+		if diff := cmp.Diff(desc.Platform, &platforms[i]); diff != "" {
+			t.Fatalf("unexpected platform; diff = %v", diff)
+		}
+		if err := WriteSociIndex(context.Background(), indices[i], store, artifactsDb); err != nil {
+			t.Fatalf("could not write index: %v", err)
+		}
+		// soci indices are written without a media type
+		exists, err := store.Exists(context.Background(), ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size})
+		if err != nil || !exists {
+			t.Fatalf("soci index %d is not written under the digest referenced by the index list", i)
+		}
+	}
+
+	desc, err := WriteSociIndexList(context.Background(), indexList, store, artifactsDb)
+	if err != nil {
+		t.Fatalf("could not write index list: %v", err)
+	}
+	exists, err := store.Exists(context.Background(), *desc)
+	if err != nil || !exists {
+		t.Fatalf("soci index list was not written to the store")
+	}
+	ae, err := artifactsDb.GetArtifactEntry(desc.Digest.String())
+	if err != nil {
+		t.Fatalf("soci index list was not written to the artifacts db: %v", err)
+	}
+	if ae.Type != ArtifactEntryTypeIndexList || ae.OriginalDigest != imageDigest.String() || ae.Size != desc.Size {
+		t.Fatalf("unexpected artifact entry of the index list: %+v", ae)
+	}
+	lists, err := GetIndexListDescriptors(artifactsDb, images.Image{Target: ocispec.Descriptor{Digest: imageDigest}})
+	if err != nil {
+		t.Fatalf("could not get index lists: %v", err)
+	}
+	if len(lists) != 1 || lists[0].Digest != desc.Digest {
+		t.Fatalf("unexpected index lists of the image: %+v", lists)
+	}
+}
+
+func TestNewCoverage(t *testing.T) {
+	layers := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer1"), Size: 100},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer2"), Size: 200},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer3"), Size: 300},
+	}
+	manifest := ocispec.Manifest{Layers: layers}
+	ztocDesc := func(layer ocispec.Descriptor) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType:   SociLayerMediaType,
+			Digest:      digest.FromString("ztoc of " + layer.Digest.String()),
+			Annotations: map[string]string{IndexAnnotationImageLayerDigest: layer.Digest.String()},
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		index    *Index
+		expected Coverage
+	}{
+		{
+			name:     "no index",
+			expected: Coverage{Layers: 3, Size: 600},
+		},
+		{
+			name:     "partial index",
+			index:    NewIndex([]ocispec.Descriptor{ztocDesc(layers[0]), ztocDesc(layers[2])}, nil, nil),
+			expected: Coverage{Layers: 3, IndexedLayers: 2, Size: 600, IndexedSize: 400},
+		},
+		{
+			name: "blobs other than ztocs",
+			index: NewIndex([]ocispec.Descriptor{{
+				MediaType:   PrefetchProfileMediaType,
+				Digest:      digest.FromString("prefetch profile"),
+				Annotations: map[string]string{IndexAnnotationImageLayerDigest: layers[1].Digest.String()},
+			}}, nil, nil),
+			expected: Coverage{Layers: 3, Size: 600},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewCoverage(manifest, tc.index); got != tc.expected {
+				t.Fatalf("unexpected coverage; expected = %+v, got = %+v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SpanSizeRule overrides the span size of the zTOCs of the layers it matches.
+// Smaller spans suit layers of many small files, since reading a file fetches less data
+// around it, while larger spans suit layers of large files, since they are fetched with
+// fewer requests and checkpoints.
+type SpanSizeRule struct {
+	// MediaType matches the layers of this media type, if it's set.
+	MediaType string
+	// MinLayerSize matches the layers of at least this size, if it's set.
+	MinLayerSize int64
+	// SpanSize is the span size of the zTOCs of the matched layers.
+	SpanSize int64
+}
+
+func (r SpanSizeRule) matches(desc ocispec.Descriptor) bool {
+	if r.MediaType != "" && r.MediaType != desc.MediaType {
+		return false
+	}
+	return desc.Size >= r.MinLayerSize
+}
+
+// ParseSpanSizeRule parses a rule of the form
+// "[media-type=<media type>,][min-layer-size=<bytes>,]span-size=<bytes>".
+func ParseSpanSizeRule(s string) (SpanSizeRule, error) {
+	var rule SpanSizeRule
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return SpanSizeRule{}, fmt.Errorf("invalid span size rule %q: expected key=value, got %q", s, field)
+		}
+		var err error
+		switch kv[0] {
+		case "media-type":
+			rule.MediaType = kv[1]
+		case "min-layer-size":
+			rule.MinLayerSize, err = strconv.ParseInt(kv[1], 10, 64)
+		case "span-size":
+			rule.SpanSize, err = strconv.ParseInt(kv[1], 10, 64)
+		default:
+			return SpanSizeRule{}, fmt.Errorf("invalid span size rule %q: unknown key %q", s, kv[0])
+		}
+		if err != nil {
+			return SpanSizeRule{}, fmt.Errorf("invalid span size rule %q: %w", s, err)
+		}
+	}
+	if err := rule.validate(); err != nil {
+		return SpanSizeRule{}, fmt.Errorf("invalid span size rule %q: %w", s, err)
+	}
+	return rule, nil
+}
+
+func (r SpanSizeRule) validate() error {
+	if r.SpanSize <= 0 {
+		return fmt.Errorf("span size must be positive, got %d", r.SpanSize)
+	}
+	if r.MinLayerSize < 0 {
+		return fmt.Errorf("min layer size must not be negative, got %d", r.MinLayerSize)
+	}
+	if r.MediaType == "" && r.MinLayerSize == 0 {
+		return fmt.Errorf("a media type or a min layer size must be set")
+	}
+	return nil
+}
+
+// WithSpanSizeRules overrides the span size of the layers matching `rules`.
+// The first rule matching a layer applies, and layers matching none use the span size
+// set by WithSpanSize.
+func WithSpanSizeRules(rules ...SpanSizeRule) BuildOption {
+	return func(c *buildConfig) error {
+		for _, r := range rules {
+			if err := r.validate(); err != nil {
+				return err
+			}
+		}
+		c.spanSizeRules = append(c.spanSizeRules, rules...)
+		return nil
+	}
+}
+
+// layerSpanSize returns the span size of the zTOC of the layer `desc`.
+func (c *buildConfig) layerSpanSize(desc ocispec.Descriptor) int64 {
+	for _, r := range c.spanSizeRules {
+		if r.matches(desc) {
+			return r.SpanSize
+		}
+	}
+	return c.spanSize
+}
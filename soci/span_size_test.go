@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseSpanSizeRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		expected SpanSizeRule
+		wantErr  bool
+	}{
+		{
+			rule:     "media-type=application/vnd.oci.image.layer.v1.tar,span-size=1048576",
+			expected: SpanSizeRule{MediaType: ocispec.MediaTypeImageLayer, SpanSize: 1 << 20},
+		},
+		{
+			rule:     "min-layer-size=104857600,span-size=8388608",
+			expected: SpanSizeRule{MinLayerSize: 100 << 20, SpanSize: 8 << 20},
+		},
+		{
+			rule:     "media-type=application/vnd.oci.image.layer.v1.tar+gzip,min-layer-size=1024,span-size=65536",
+			expected: SpanSizeRule{MediaType: ocispec.MediaTypeImageLayerGzip, MinLayerSize: 1024, SpanSize: 1 << 16},
+		},
+		{rule: "span-size=1048576", wantErr: true},
+		{rule: "min-layer-size=1024", wantErr: true},
+		{rule: "min-layer-size=1024,span-size=0", wantErr: true},
+		{rule: "min-layer-size=-1,span-size=1024", wantErr: true},
+		{rule: "min-layer-size=1KiB,span-size=1024", wantErr: true},
+		{rule: "size=1024,span-size=1024", wantErr: true},
+		{rule: "media-type", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			rule, err := ParseSpanSizeRule(tt.rule)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got rule %+v", rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rule != tt.expected {
+				t.Fatalf("unexpected rule; expected = %+v, got = %+v", tt.expected, rule)
+			}
+		})
+	}
+}
+
+func TestLayerSpanSize(t *testing.T) {
+	cfg := &buildConfig{spanSize: 4 << 20}
+	err := WithSpanSizeRules(
+		SpanSizeRule{MediaType: ocispec.MediaTypeImageLayer, SpanSize: 1 << 20},
+		SpanSizeRule{MinLayerSize: 100 << 20, SpanSize: 16 << 20},
+		SpanSizeRule{MinLayerSize: 50 << 20, SpanSize: 8 << 20},
+	)(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		name     string
+		desc     ocispec.Descriptor
+		expected int64
+	}{
+		{
+			name:     "no rule matches",
+			desc:     ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Size: 10 << 20},
+			expected: 4 << 20,
+		},
+		{
+			name:     "media type matches",
+			desc:     ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Size: 200 << 20},
+			expected: 1 << 20,
+		},
+		{
+			name:     "first matching size rule applies",
+			desc:     ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Size: 200 << 20},
+			expected: 16 << 20,
+		},
+		{
+			name:     "second size rule matches",
+			desc:     ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Size: 60 << 20},
+			expected: 8 << 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.layerSpanSize(tt.desc); got != tt.expected {
+				t.Fatalf("unexpected span size; expected = %d, got = %d", tt.expected, got)
+			}
+		})
+	}
+
+	if err := WithSpanSizeRules(SpanSizeRule{SpanSize: 1 << 20})(cfg); err == nil {
+		t.Fatalf("expected an error for a rule matching every layer")
+	}
+}
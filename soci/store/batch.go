@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// Blob is a content pushed by PushAll.
+type Blob struct {
+	Descriptor ocispec.Descriptor
+	Reader     io.Reader
+}
+
+// Batch writes contents as soon as they are read, and makes them available at once with Commit,
+// which takes fewer syncs of the store than pushing them one at a time.
+type Batch interface {
+	// Add writes the content `r` described by `desc`, unless it exists already. The content is read
+	// before Add returns, but it's only available once committed. Add is safe for concurrent use.
+	Add(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error
+	// Commit makes the contents added to the batch available.
+	Commit(ctx context.Context) error
+	// Discard removes the contents added to the batch which aren't committed.
+	Discard()
+}
+
+// BatchPusher is implemented by the stores which push several contents at once faster than
+// one at a time, e.g. with fewer syncs.
+type BatchPusher interface {
+	// NewBatch returns a batch of contents pushed to the store.
+	NewBatch(ctx context.Context) (Batch, error)
+}
+
+var (
+	_ BatchPusher = &SharedStore{}
+	_ BatchPusher = &TieredStore{}
+)
+
+// NewBatch returns a batch of contents pushed to `store`: the batch of the store if it's a
+// BatchPusher, or else a batch which pushes each content as it's added.
+func NewBatch(ctx context.Context, store content.Pusher) (Batch, error) {
+	if bp, ok := store.(BatchPusher); ok {
+		return bp.NewBatch(ctx)
+	}
+	return &pushBatch{store: store}, nil
+}
+
+// PushAll pushes the contents `blobs` to `store` concurrently in a batch, skipping the contents
+// which exist already.
+func PushAll(ctx context.Context, store content.Pusher, blobs []Blob) error {
+	batch, err := NewBatch(ctx, store)
+	if err != nil {
+		return err
+	}
+	var eg errgroup.Group
+	for _, b := range blobs {
+		b := b
+		eg.Go(func() error {
+			return batch.Add(ctx, b.Descriptor, b.Reader)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		batch.Discard()
+		return err
+	}
+	if err := batch.Commit(ctx); err != nil {
+		batch.Discard()
+		return err
+	}
+	return nil
+}
+
+// pushBatch is the batch of the stores which aren't BatchPushers, whose contents are available
+// as soon as they are added.
+type pushBatch struct {
+	store content.Pusher
+}
+
+func (b *pushBatch) Add(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	err := b.store.Push(ctx, desc, r)
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+func (b *pushBatch) Commit(context.Context) error {
+	return nil
+}
+
+func (b *pushBatch) Discard() {}
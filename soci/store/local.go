@@ -0,0 +1,75 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// tiersDbName is the name of the database of the placements of the content store tiers.
+const tiersDbName = "content_tiers.db"
+
+// OpenLocalStore returns SOCIs local content store configured by `cfg`, the same for the snapshotter
+// and the soci CLI: the content store at cfg.ContentStorePath, spread over cfg.ContentStoreTiers if any.
+// The placements of the tiers are recorded in the directory `root` of the snapshotter.
+func OpenLocalStore(root string, cfg config.Config) (content.Storage, error) {
+	var (
+		store content.Storage
+		err   error
+	)
+	if cfg.SharedContentStore {
+		store, err = NewSharedStore(cfg.ContentStorePath)
+	} else {
+		store, err = oci.New(cfg.ContentStorePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create local store: %w", err)
+	}
+	if len(cfg.ContentStoreTiers) == 0 {
+		return store, nil
+	}
+
+	var tiers []Tier
+	for _, t := range cfg.ContentStoreTiers {
+		tiers = append(tiers, Tier{
+			Path:       t.Path,
+			MediaTypes: t.MediaTypes,
+			MinSize:    t.MinSize,
+			MaxSize:    t.MaxSize,
+		})
+	}
+	tiered, err := NewTieredStore(store, cfg.ContentStorePath, tiers, filepath.Join(root, tiersDbName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create tiered local store: %w", err)
+	}
+	return tiered, nil
+}
+
+// LocalBlobPaths returns the directories of the blobs of SOCIs local content store configured by `cfg`,
+// one for each of its tiers.
+func LocalBlobPaths(cfg config.Config) []string {
+	paths := []string{filepath.Join(cfg.ContentStorePath, "blobs")}
+	for _, t := range cfg.ContentStoreTiers {
+		paths = append(paths, filepath.Join(t.Path, "blobs"))
+	}
+	return paths
+}
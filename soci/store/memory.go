@@ -0,0 +1,139 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package store provides content stores for SOCI artifacts.
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// ErrStoreFull is returned when pushing content would make a MemoryStore exceed its maximum size.
+var ErrStoreFull = errors.New("memory store is full")
+
+var _ content.Storage = &MemoryStore{}
+
+// MemoryStore is a bounded content store which keeps SOCI artifacts in memory.
+// It can be used as the local store of `fs.FetchSociArtifacts` by services which
+// resolve and inspect SOCI indices without writing to disk.
+//
+// Pushed contents are verified against the size and digest of their descriptor.
+type MemoryStore struct {
+	maxSize int64
+
+	mu       sync.RWMutex
+	size     int64
+	contents map[digest.Digest][]byte
+}
+
+// NewMemoryStore returns a MemoryStore which holds at most `maxSize` bytes of contents.
+// A non-positive `maxSize` means the size of the store is unlimited.
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{
+		maxSize:  maxSize,
+		contents: make(map[digest.Digest][]byte),
+	}
+}
+
+// Exists returns whether the content described by `desc` is in the store.
+func (s *MemoryStore) Exists(_ context.Context, desc ocispec.Descriptor) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.contents[desc.Digest]
+	return ok, nil
+}
+
+// Fetch returns a reader for the content described by `desc`.
+func (s *MemoryStore) Fetch(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.contents[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", desc.Digest, errdef.ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Push stores the content read from `r` after verifying it against `expected`.
+func (s *MemoryStore) Push(ctx context.Context, expected ocispec.Descriptor, r io.Reader) error {
+	if exists, _ := s.Exists(ctx, expected); exists {
+		return fmt.Errorf("%s: %w", expected.Digest, errdef.ErrAlreadyExists)
+	}
+	if err := s.reserve(expected.Size); err != nil {
+		return err
+	}
+	b, err := content.ReadAll(r, expected)
+	if err != nil {
+		s.release(expected.Size)
+		return fmt.Errorf("failed to verify %s: %w", expected.Digest, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.contents[expected.Digest]; ok {
+		s.size -= expected.Size
+		return fmt.Errorf("%s: %w", expected.Digest, errdef.ErrAlreadyExists)
+	}
+	s.contents[expected.Digest] = b
+	return nil
+}
+
+// Delete removes the content described by `desc` from the store, freeing its space.
+func (s *MemoryStore) Delete(_ context.Context, desc ocispec.Descriptor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.contents[desc.Digest]
+	if !ok {
+		return fmt.Errorf("%s: %w", desc.Digest, errdef.ErrNotFound)
+	}
+	delete(s.contents, desc.Digest)
+	s.size -= int64(len(b))
+	return nil
+}
+
+// Size returns the total size of the contents in the store.
+func (s *MemoryStore) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// reserve reserves space for `size` bytes of contents, so that concurrent pushes can't exceed the maximum size.
+func (s *MemoryStore) reserve(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize > 0 && s.size+size > s.maxSize {
+		return fmt.Errorf("%w: pushing %d bytes to a store holding %d of %d bytes", ErrStoreFull, size, s.size, s.maxSize)
+	}
+	s.size += size
+	return nil
+}
+
+func (s *MemoryStore) release(size int64) {
+	s.mu.Lock()
+	s.size -= size
+	s.mu.Unlock()
+}
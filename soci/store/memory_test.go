@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+func descFor(b []byte) ocispec.Descriptor {
+	return ocispec.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b))}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	foo, bar := []byte("foo"), []byte("bar")
+	s := NewMemoryStore(5)
+
+	if err := s.Push(ctx, descFor(foo), bytes.NewReader(foo)); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	if err := s.Push(ctx, descFor(foo), bytes.NewReader(foo)); !errors.Is(err, errdef.ErrAlreadyExists) {
+		t.Fatalf("unexpected error pushing existing content; expected = %v, got = %v", errdef.ErrAlreadyExists, err)
+	}
+	rc, err := s.Fetch(ctx, descFor(foo))
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	b, err := io.ReadAll(rc)
+	if err != nil || !bytes.Equal(b, foo) {
+		t.Fatalf("unexpected content %q: %v", b, err)
+	}
+
+	// The store holds 3 of 5 bytes.
+	if err := s.Push(ctx, descFor(bar), bytes.NewReader(bar)); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("unexpected error pushing to a full store; expected = %v, got = %v", ErrStoreFull, err)
+	}
+	if err := s.Delete(ctx, descFor(foo)); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, err := s.Fetch(ctx, descFor(foo)); !errors.Is(err, errdef.ErrNotFound) {
+		t.Fatalf("unexpected error fetching deleted content; expected = %v, got = %v", errdef.ErrNotFound, err)
+	}
+	if err := s.Push(ctx, descFor(bar), bytes.NewReader(bar)); err != nil {
+		t.Fatalf("failed to push after delete: %v", err)
+	}
+	if s.Size() != 3 {
+		t.Fatalf("unexpected size; expected = 3, got = %d", s.Size())
+	}
+}
+
+func TestMemoryStoreVerifiesContent(t *testing.T) {
+	ctx := context.Background()
+	foo := []byte("foo")
+	testCases := []struct {
+		name        string
+		content     []byte
+		expectedErr error
+	}{
+		{
+			name:        "mismatched digest",
+			content:     []byte("baz"),
+			expectedErr: content.ErrMismatchedDigest,
+		},
+		{
+			name:        "trailing data",
+			content:     []byte("foobar"),
+			expectedErr: content.ErrTrailingData,
+		},
+		{
+			name:        "truncated content",
+			content:     []byte("fo"),
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewMemoryStore(0)
+			if err := s.Push(ctx, descFor(foo), bytes.NewReader(tc.content)); !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected error; expected = %v, got = %v", tc.expectedErr, err)
+			}
+			if exists, _ := s.Exists(ctx, descFor(foo)); exists {
+				t.Fatalf("unverified content was stored")
+			}
+			if s.Size() != 0 {
+				t.Fatalf("space of unverified content was not released")
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/pkg/kmutex"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const (
+	// staleIngestAge is how old the temporary files of a SharedStore must be to be removed
+	// as left behind by a writer which crashed.
+	staleIngestAge = time.Hour
+	// lockRetryInterval is how often a SharedStore retries to lock a content held by another process.
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+var _ content.Storage = &SharedStore{}
+
+// sharedLocks serializes the writers of a content in the process, keyed by the path of the lock file.
+// Record locks are held by processes, so they don't exclude writers of the same process, and closing
+// any descriptor of a lock file releases the locks of the process on it.
+var sharedLocks = kmutex.New()
+
+// SharedStore is a content store in the blobs of an OCI image layout directory which is safe to
+// share between processes and nodes, e.g. on NFS or EFS:
+//
+//   - Contents are written to a temporary file in the directory and renamed into place once they
+//     are complete and verified, so that other processes never read a partially written blob.
+//   - Writers of the same content hold an advisory lock of the content. The locks are POSIX record
+//     locks, which NFS supports, so that the content is written once while other writers wait.
+//   - Blobs whose size doesn't match their descriptor, e.g. left by a writer which crashed on a
+//     filesystem without atomic renames, are treated as missing and replaced by the next push.
+//     Blobs whose digest doesn't match fail the read which reaches their end.
+//
+// Unlike oci.Store, it doesn't maintain the index.json of the layout, which several writers can't
+// update safely.
+type SharedStore struct {
+	root string
+}
+
+// NewSharedStore returns a SharedStore in the directory `root`, and removes the temporary files
+// left behind in it by crashed writers.
+func NewSharedStore(root string) (*SharedStore, error) {
+	s := &SharedStore{root: root}
+	for _, dir := range []string{s.ingestDir(), s.lockDir(), filepath.Join(root, "blobs")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create shared content store: %w", err)
+		}
+	}
+	if err := s.ensureLayoutFile(); err != nil {
+		return nil, err
+	}
+	s.removeStaleIngests()
+	return s, nil
+}
+
+func (s *SharedStore) ingestDir() string {
+	return filepath.Join(s.root, "ingest")
+}
+
+func (s *SharedStore) lockDir() string {
+	return filepath.Join(s.root, "locks")
+}
+
+func (s *SharedStore) blobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", fmt.Errorf("%s: %w", dgst, errdef.ErrInvalidDigest)
+	}
+	return filepath.Join(s.root, "blobs", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+// ensureLayoutFile writes the oci-layout file of the directory, unless another process did.
+func (s *SharedStore) ensureLayoutFile() error {
+	path := filepath.Join(s.root, ocispec.ImageLayoutFile)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	b, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.ingestDir(), path, func(f *os.File) error {
+		_, err := f.Write(b)
+		return err
+	})
+}
+
+// removeStaleIngests removes the temporary files which are too old to belong to a writer which is still running.
+func (s *SharedStore) removeStaleIngests() {
+	entries, err := os.ReadDir(s.ingestDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < staleIngestAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.ingestDir(), e.Name())); err == nil {
+			log.L.WithField("file", e.Name()).Debug("removed stale ingest of shared content store")
+		}
+	}
+}
+
+// complete returns whether the blob `info` holds all of the content `desc`.
+// A descriptor without a size can't tell.
+func complete(info os.FileInfo, desc ocispec.Descriptor) bool {
+	return desc.Size == 0 || info.Size() == desc.Size
+}
+
+// Exists returns whether the content described by `desc` is completely written.
+func (s *SharedStore) Exists(_ context.Context, desc ocispec.Descriptor) (bool, error) {
+	path, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return complete(info, desc), nil
+}
+
+// Fetch returns a reader of the content described by `desc`, which fails at the end of the
+// content if it doesn't match the digest of `desc`.
+func (s *SharedStore) Fetch(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	path, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %s: %w", desc.Digest, desc.MediaType, errdef.ErrNotFound)
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !complete(info, desc) {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s: partially written blob of %d bytes: %w", desc.Digest, desc.MediaType, info.Size(), errdef.ErrNotFound)
+	}
+	if desc.Size == 0 {
+		return f, nil
+	}
+	return &verifiedReadCloser{f, content.NewVerifyReader(f, desc)}, nil
+}
+
+// verifiedReadCloser fails the read which reaches the end of a content that doesn't match its descriptor.
+type verifiedReadCloser struct {
+	io.Closer
+	r *content.VerifyReader
+}
+
+func (v *verifiedReadCloser) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if err == io.EOF {
+		if vErr := v.r.Verify(); vErr != nil {
+			return n, vErr
+		}
+	}
+	return n, err
+}
+
+// Push writes the content `r` described by `expected`, unless another writer did first.
+func (s *SharedStore) Push(ctx context.Context, expected ocispec.Descriptor, r io.Reader) error {
+	path, err := s.blobPath(expected.Digest)
+	if err != nil {
+		return err
+	}
+	if ok, err := s.Exists(ctx, expected); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%s: %s: %w", expected.Digest, expected.MediaType, errdef.ErrAlreadyExists)
+	}
+
+	unlock, err := s.lock(ctx, expected.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", expected.Digest, err)
+	}
+	defer unlock()
+	// Another writer may have written the content while this one waited for the lock.
+	if ok, err := s.Exists(ctx, expected); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%s: %s: %w", expected.Digest, expected.MediaType, errdef.ErrAlreadyExists)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeAtomic(s.ingestDir(), path, func(f *os.File) error {
+		vr := content.NewVerifyReader(r, expected)
+		if _, err := io.Copy(f, vr); err != nil {
+			return err
+		}
+		return vr.Verify()
+	})
+}
+
+// NewBatch returns a batch of contents written at once. Contents are written to temporary files
+// as they are added, which are synced by a single sync of the filesystem of the store rather
+// than one by one, and renamed into place on Commit. Unlike Push, the batch doesn't lock the
+// contents, since renaming a content over the same content written by another writer is harmless.
+func (s *SharedStore) NewBatch(context.Context) (Batch, error) {
+	return &sharedBatch{s: s}, nil
+}
+
+type sharedBatch struct {
+	s *SharedStore
+
+	mu      sync.Mutex
+	ingests []sharedIngest
+}
+
+type sharedIngest struct {
+	tmp, path string
+}
+
+func (b *sharedBatch) Add(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	path, err := b.s.blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if ok, err := b.s.Exists(ctx, desc); err != nil || ok {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := writeIngest(b.s.ingestDir(), path, func(f *os.File) error {
+		vr := content.NewVerifyReader(r, desc)
+		if _, err := io.Copy(f, vr); err != nil {
+			return err
+		}
+		return vr.Verify()
+	}, false)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.ingests = append(b.ingests, sharedIngest{tmp, path})
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *sharedBatch) Commit(context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.ingests) == 0 {
+		return nil
+	}
+	if err := syncFilesystem(b.s.ingestDir()); err != nil {
+		return fmt.Errorf("failed to sync shared content store: %w", err)
+	}
+	for len(b.ingests) > 0 {
+		in := b.ingests[0]
+		if err := os.Rename(in.tmp, in.path); err != nil {
+			return err
+		}
+		b.ingests = b.ingests[1:]
+	}
+	return nil
+}
+
+func (b *sharedBatch) Discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, in := range b.ingests {
+		os.Remove(in.tmp)
+	}
+	b.ingests = nil
+}
+
+// syncFilesystem writes all the data of the filesystem of `dir` to disk.
+func syncFilesystem(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Syncfs(int(f.Fd()))
+}
+
+// lock takes the advisory lock of the content `dgst`, and returns the function releasing it.
+func (s *SharedStore) lock(ctx context.Context, dgst digest.Digest) (func(), error) {
+	return s.lockFile(ctx, dgst.Algorithm().String()+"-"+dgst.Encoded())
+}
+
+// lockMove takes the advisory lock of moving the content `dgst` between the tiers of a TieredStore,
+// which is apart from the lock of writing it, since moving the content writes it.
+func (s *SharedStore) lockMove(ctx context.Context, dgst digest.Digest) (func(), error) {
+	return s.lockFile(ctx, "move-"+dgst.Algorithm().String()+"-"+dgst.Encoded())
+}
+
+// lockFile takes the advisory lock of the file `name` of the lock directory, and returns the
+// function releasing it.
+func (s *SharedStore) lockFile(ctx context.Context, name string) (func(), error) {
+	key, err := filepath.Abs(filepath.Join(s.lockDir(), name))
+	if err != nil {
+		return nil, err
+	}
+	if err := sharedLocks.Lock(ctx, key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(key, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		sharedLocks.Unlock(key)
+		return nil, err
+	}
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	for {
+		err := unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lk)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EAGAIN) && !errors.Is(err, unix.EACCES) && !errors.Is(err, unix.EINTR) {
+			f.Close()
+			sharedLocks.Unlock(key)
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			sharedLocks.Unlock(key)
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+	return func() {
+		lk.Type = unix.F_UNLCK
+		unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lk)
+		// The lock files are kept, since removing one could let two processes lock different files of the same content.
+		f.Close()
+		sharedLocks.Unlock(key)
+	}, nil
+}
+
+// writeAtomic writes the file `path` with `write` through a temporary file in `tmpDir`, which is
+// synced and renamed to `path` once it's complete.
+func writeAtomic(tmpDir, path string, write func(f *os.File) error) error {
+	tmp, err := writeIngest(tmpDir, path, write, true)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeIngest writes the content of the file `path` with `write` to a temporary file in `tmpDir`,
+// which is synced if `sync` is set, and returns the name of the temporary file.
+func writeIngest(tmpDir, path string, write func(f *os.File) error, sync bool) (_ string, retErr error) {
+	f, err := os.CreateTemp(tmpDir, filepath.Base(path)+"_*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create ingest file: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := write(f); err != nil {
+		return "", fmt.Errorf("failed to ingest %s: %w", filepath.Base(path), err)
+	}
+	if err := f.Chmod(0444); err != nil {
+		return "", err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,235 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"oras.land/oras-go/v2/errdef"
+)
+
+func TestSharedStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	foo := []byte("foo")
+	s, err := NewSharedStore(root)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	if err := s.Push(ctx, descFor(foo), bytes.NewReader(foo)); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	if err := s.Push(ctx, descFor(foo), bytes.NewReader(foo)); !errors.Is(err, errdef.ErrAlreadyExists) {
+		t.Fatalf("unexpected error pushing existing content; expected = %v, got = %v", errdef.ErrAlreadyExists, err)
+	}
+	rc, err := s.Fetch(ctx, descFor(foo))
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(b, foo) {
+		t.Fatalf("unexpected content %q: %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "oci-layout")); err != nil {
+		t.Fatalf("oci-layout wasn't written: %v", err)
+	}
+	if entries, _ := os.ReadDir(s.ingestDir()); len(entries) != 0 {
+		t.Fatalf("unexpected ingest files left: %v", entries)
+	}
+
+	// Content which doesn't match its digest isn't stored.
+	bar := descFor([]byte("bar"))
+	if err := s.Push(ctx, bar, bytes.NewReader([]byte("baz"))); err == nil {
+		t.Fatal("pushing mismatching content succeeded")
+	}
+	if ok, err := s.Exists(ctx, bar); err != nil || ok {
+		t.Fatalf("mismatching content exists: %v, %v", ok, err)
+	}
+}
+
+func TestSharedStorePushAll(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewSharedStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	foo, bar, baz := []byte("foo"), []byte("bar"), []byte("baz")
+	if err := s.Push(ctx, descFor(foo), bytes.NewReader(foo)); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+
+	// Existing contents are skipped.
+	blobs := []Blob{
+		{descFor(foo), bytes.NewReader(foo)},
+		{descFor(bar), bytes.NewReader(bar)},
+		{descFor(baz), bytes.NewReader(baz)},
+	}
+	if err := PushAll(ctx, s, blobs); err != nil {
+		t.Fatalf("failed to push all: %v", err)
+	}
+	for _, c := range [][]byte{foo, bar, baz} {
+		rc, err := s.Fetch(ctx, descFor(c))
+		if err != nil {
+			t.Fatalf("failed to fetch %q: %v", c, err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(b, c) {
+			t.Fatalf("unexpected content %q: %v", b, err)
+		}
+	}
+	if entries, _ := os.ReadDir(s.ingestDir()); len(entries) != 0 {
+		t.Fatalf("unexpected ingest files left: %v", entries)
+	}
+
+	// None of the contents is stored if one doesn't match its digest.
+	qux, quux := []byte("qux"), []byte("quux")
+	blobs = []Blob{
+		{descFor(qux), bytes.NewReader(qux)},
+		{descFor(quux), bytes.NewReader([]byte("corge"))},
+	}
+	if err := PushAll(ctx, s, blobs); err == nil {
+		t.Fatal("pushing mismatching content succeeded")
+	}
+	for _, c := range [][]byte{qux, quux} {
+		if ok, err := s.Exists(ctx, descFor(c)); err != nil || ok {
+			t.Fatalf("content %q of a failed push exists: %v, %v", c, ok, err)
+		}
+	}
+	if entries, _ := os.ReadDir(s.ingestDir()); len(entries) != 0 {
+		t.Fatalf("unexpected ingest files left: %v", entries)
+	}
+}
+
+func TestSharedStorePartialBlob(t *testing.T) {
+	ctx := context.Background()
+	foo := []byte("foo")
+	desc := descFor(foo)
+	s, err := NewSharedStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	path, _ := s.blobPath(desc.Digest)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, foo[:1], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := s.Exists(ctx, desc); err != nil || ok {
+		t.Fatalf("partially written blob exists: %v, %v", ok, err)
+	}
+	if _, err := s.Fetch(ctx, desc); !errors.Is(err, errdef.ErrNotFound) {
+		t.Fatalf("unexpected error fetching partially written blob; expected = %v, got = %v", errdef.ErrNotFound, err)
+	}
+	// The next push replaces the partially written blob.
+	if err := s.Push(ctx, desc, bytes.NewReader(foo)); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	if ok, err := s.Exists(ctx, desc); err != nil || !ok {
+		t.Fatalf("pushed blob doesn't exist: %v, %v", ok, err)
+	}
+
+	// A corrupted blob of the right size fails the read reaching its end.
+	os.Chmod(path, 0644)
+	if err := os.WriteFile(path, []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := s.Fetch(ctx, desc)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); err == nil {
+		t.Fatal("reading corrupted blob succeeded")
+	}
+}
+
+func TestSharedStoreConcurrentPush(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("foo"), 1<<16)
+	desc := descFor(content)
+
+	// Each store stands for a writer sharing the directory.
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		pushed  int
+		pushErr error
+	)
+	for i := 0; i < 8; i++ {
+		s, err := NewSharedStore(root)
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Push(ctx, desc, bytes.NewReader(content))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				pushed++
+			case !errors.Is(err, errdef.ErrAlreadyExists):
+				pushErr = err
+			}
+		}()
+	}
+	wg.Wait()
+	if pushErr != nil {
+		t.Fatalf("failed to push: %v", pushErr)
+	}
+	if pushed != 1 {
+		t.Fatalf("unexpected number of writes; expected = 1, got = %d", pushed)
+	}
+}
+
+func TestSharedStoreRemovesStaleIngests(t *testing.T) {
+	root := t.TempDir()
+	if _, err := NewSharedStore(root); err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	stale, fresh := filepath.Join(root, "ingest", "stale"), filepath.Join(root, "ingest", "fresh")
+	for _, f := range []string{stale, fresh} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleIngestAge)
+	os.Chtimes(stale, old, old)
+
+	if _, err := NewSharedStore(root); err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale ingest wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("fresh ingest was removed: %v", err)
+	}
+}
@@ -0,0 +1,489 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	bolt "go.etcd.io/bbolt"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+var bucketKeyPlacements = []byte("placements")
+
+const (
+	// dbTimeout bounds the wait for another process using the database of the placements.
+	dbTimeout = time.Minute
+	// maxDocumentSize is the size of the largest content whose media type is read from its content.
+	maxDocumentSize = 4 << 20
+	// rawMediaType is the media type of zTOCs, which don't carry their media type.
+	rawMediaType = "application/octet-stream"
+)
+
+var _ content.Storage = &TieredStore{}
+
+// Tier is a directory of a TieredStore and the rules of the contents placed in it.
+type Tier struct {
+	// Path is the directory of the tier. Contents are stored like the blobs of an OCI image layout.
+	Path string
+	// MediaTypes are the media types of the contents placed in the tier. Empty means any media type.
+	MediaTypes []string
+	// MinSize is the size of the smallest content placed in the tier. Zero means no minimum.
+	MinSize int64
+	// MaxSize is the size of the largest content placed in the tier. Zero means no maximum.
+	MaxSize int64
+}
+
+func (t Tier) matches(desc ocispec.Descriptor) bool {
+	if t.MinSize > 0 && desc.Size < t.MinSize {
+		return false
+	}
+	if t.MaxSize > 0 && desc.Size > t.MaxSize {
+		return false
+	}
+	if len(t.MediaTypes) == 0 {
+		return true
+	}
+	for _, mt := range t.MediaTypes {
+		if mt == desc.MediaType {
+			return true
+		}
+	}
+	return false
+}
+
+type tier struct {
+	path    string
+	rules   Tier
+	storage content.Storage
+}
+
+// placement is where a content pushed to a TieredStore was placed.
+type placement struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Path      string `json:"path"`
+}
+
+// TieredStore is a content store which spreads contents over multiple directories by their
+// media type and size, e.g. to keep zTOCs on a fast disk and large artifacts on a bulk disk.
+// Contents are placed in the first tier whose rules they match, or else in the default store.
+// Contents are looked up in all the tiers, so contents placed by other tools (e.g. in the
+// default store) are found too. If the default store is a SharedStore, so are the tiers, and
+// contents are moved between tiers under an advisory lock, so that several snapshotters
+// sharing the tiers don't move the same content at once.
+//
+// The placement of the contents pushed to the store is recorded in a bolt database, so that
+// Migrate can move them when the tiers change. The database is only open while it is used, so
+// that the snapshotter and the soci CLI can open the same store.
+type TieredStore struct {
+	tiers  []tier // the default store is the last tier
+	dbPath string
+}
+
+// NewTieredStore returns a TieredStore which places contents in `tiers`, or else in `defaultStore`
+// whose directory is `defaultPath`. The placements are recorded in the database at `dbPath`.
+func NewTieredStore(defaultStore content.Storage, defaultPath string, tiers []Tier, dbPath string) (*TieredStore, error) {
+	s := &TieredStore{}
+	for _, t := range tiers {
+		if t.Path == "" {
+			return nil, errors.New("content store tier must have a path")
+		}
+		var (
+			storage content.Storage
+			err     error
+		)
+		if _, ok := defaultStore.(*SharedStore); ok {
+			storage, err = NewSharedStore(t.Path)
+		} else {
+			storage, err = oci.NewStorage(t.Path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create content store tier %s: %w", t.Path, err)
+		}
+		s.tiers = append(s.tiers, tier{path: filepath.Clean(t.Path), rules: t, storage: storage})
+	}
+	s.tiers = append(s.tiers, tier{path: filepath.Clean(defaultPath), storage: defaultStore})
+
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0700); err != nil {
+		return nil, err
+	}
+	s.dbPath = dbPath
+	if err := s.update(func(*bolt.Bucket) error { return nil }); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Exists returns whether the content described by `desc` is in any tier.
+func (s *TieredStore) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	for _, t := range s.tiers {
+		exists, err := t.storage.Exists(ctx, desc)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// Fetch returns a reader for the content described by `desc` from the tier which holds it.
+func (s *TieredStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	for _, t := range s.tiers {
+		rc, err := t.storage.Fetch(ctx, desc)
+		if err == nil || !errors.Is(err, errdef.ErrNotFound) {
+			return rc, err
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", desc.Digest, errdef.ErrNotFound)
+}
+
+// Push stores the content read from `r` in the tier it is placed in.
+func (s *TieredStore) Push(ctx context.Context, expected ocispec.Descriptor, r io.Reader) error {
+	exists, err := s.Exists(ctx, expected)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%s: %w", expected.Digest, errdef.ErrAlreadyExists)
+	}
+	t := s.placement(expected)
+	if err := t.storage.Push(ctx, expected, r); err != nil {
+		return err
+	}
+	return s.record(expected.Digest, placement{MediaType: expected.MediaType, Size: expected.Size, Path: t.path})
+}
+
+// NewBatch returns a batch of contents stored in the tiers they are placed in. The contents of
+// each tier are added to a batch of the tier, and their placements are recorded in a single
+// transaction once all the batches are committed.
+func (s *TieredStore) NewBatch(context.Context) (Batch, error) {
+	return &tieredBatch{s: s, batches: make(map[string]Batch), placed: make(map[digest.Digest]placement)}, nil
+}
+
+type tieredBatch struct {
+	s *TieredStore
+
+	mu      sync.Mutex
+	batches map[string]Batch
+	placed  map[digest.Digest]placement
+}
+
+func (b *tieredBatch) Add(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	if exists, err := b.s.Exists(ctx, desc); err != nil || exists {
+		return err
+	}
+	t := b.s.placement(desc)
+	b.mu.Lock()
+	batch, ok := b.batches[t.path]
+	if !ok {
+		var err error
+		if batch, err = NewBatch(ctx, t.storage); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		b.batches[t.path] = batch
+	}
+	b.mu.Unlock()
+	if err := batch.Add(ctx, desc, r); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.placed[desc.Digest] = placement{MediaType: desc.MediaType, Size: desc.Size, Path: t.path}
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *tieredBatch) Commit(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range b.s.tiers {
+		if batch, ok := b.batches[t.path]; ok {
+			if err := batch.Commit(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if len(b.placed) == 0 {
+		return nil
+	}
+	err := b.s.update(func(bucket *bolt.Bucket) error {
+		for dgst, p := range b.placed {
+			v, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(dgst), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.placed = make(map[digest.Digest]placement)
+	return nil
+}
+
+func (b *tieredBatch) Discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, batch := range b.batches {
+		batch.Discard()
+	}
+}
+
+// Migrate moves the contents of the store which are not in the tier they are placed in by the
+// current tiers, e.g. after the tiers were reconfigured. The contents which were not pushed to the
+// store are recorded first, so that they are moved too. Contents are only removed from their
+// previous tier once they are stored in the new one. It returns the number of contents moved.
+func (s *TieredStore) Migrate(ctx context.Context) (int, error) {
+	if err := s.recordExisting(ctx); err != nil {
+		return 0, fmt.Errorf("failed to record the placement of existing contents: %w", err)
+	}
+	placements := make(map[digest.Digest]placement)
+	if err := s.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(k, v []byte) error {
+			var p placement
+			if err := json.Unmarshal(v, &p); err != nil {
+				return fmt.Errorf("invalid placement of %s: %w", k, err)
+			}
+			placements[digest.Digest(k)] = p
+			return nil
+		})
+	}); err != nil {
+		return 0, err
+	}
+
+	var moved int
+	for dgst, p := range placements {
+		desc := ocispec.Descriptor{MediaType: p.MediaType, Digest: dgst, Size: p.Size}
+		t := s.placement(desc)
+		if t.path == p.Path {
+			continue
+		}
+		if err := s.move(ctx, p.Path, t, desc); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				if exists, err := t.storage.Exists(ctx, desc); err == nil && exists {
+					// Another snapshotter sharing the tiers moved the content already.
+					p.Path = t.path
+					if err := s.record(dgst, p); err != nil {
+						return moved, err
+					}
+					continue
+				}
+				// The content was removed (e.g. by garbage collection), so there is nothing to move.
+				log.G(ctx).WithField(logutil.DigestField, dgst).Debug("forgetting placement of missing content")
+				if err := s.forget(dgst); err != nil {
+					return moved, err
+				}
+				continue
+			}
+			return moved, fmt.Errorf("failed to move %s from %s to %s: %w", dgst, p.Path, t.path, err)
+		}
+		p.Path = t.path
+		if err := s.record(dgst, p); err != nil {
+			return moved, err
+		}
+		log.G(ctx).WithField(logutil.DigestField, dgst).Debugf("moved content to %s", t.path)
+		moved++
+	}
+	return moved, nil
+}
+
+// recordExisting records the placement of the contents in the tiers which were not pushed to
+// the store, e.g. stored by the soci CLI before it used the tiers or copied by other tools.
+// The media type of documents is read from their content, other contents are zTOCs.
+func (s *TieredStore) recordExisting(ctx context.Context) error {
+	found := make(map[digest.Digest]placement)
+	for _, t := range s.tiers {
+		blobs := filepath.Join(t.path, "blobs")
+		err := filepath.WalkDir(blobs, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(path))), d.Name())
+			if dgst.Validate() != nil {
+				return nil
+			}
+			if _, ok := found[dgst]; ok {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			found[dgst] = placement{Size: info.Size(), Path: t.path}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.view(func(bucket *bolt.Bucket) error {
+		for dgst := range found {
+			if bucket.Get([]byte(dgst)) != nil {
+				delete(found, dgst)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	for dgst, p := range found {
+		mediaType, err := readMediaType(filepath.Join(p.Path, "blobs", dgst.Algorithm().String(), dgst.Encoded()), p.Size)
+		if err != nil {
+			return err
+		}
+		p.MediaType = mediaType
+		found[dgst] = p
+	}
+	log.G(ctx).WithField("count", len(found)).Debug("recording the placement of existing contents")
+	return s.update(func(bucket *bolt.Bucket) error {
+		for dgst, p := range found {
+			v, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(dgst), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readMediaType returns the media type of the content at `path` of `size` bytes: the media type
+// of the document, or else the media type of zTOCs.
+func readMediaType(path string, size int64) (string, error) {
+	if size > maxDocumentSize {
+		return rawMediaType, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var doc struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(b, &doc) != nil || doc.MediaType == "" {
+		return rawMediaType, nil
+	}
+	return doc.MediaType, nil
+}
+
+// update runs `fn` with the bucket of the placements in a read-write transaction.
+func (s *TieredStore) update(fn func(*bolt.Bucket) error) error {
+	db, err := bolt.Open(s.dbPath, 0600, &bolt.Options{Timeout: dbTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open content store tier database: %w", err)
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketKeyPlacements)
+		if err != nil {
+			return err
+		}
+		return fn(bucket)
+	})
+}
+
+// view runs `fn` with the bucket of the placements in a read-only transaction.
+func (s *TieredStore) view(fn func(*bolt.Bucket) error) error {
+	db, err := bolt.Open(s.dbPath, 0600, &bolt.Options{Timeout: dbTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open content store tier database: %w", err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(bucketKeyPlacements))
+	})
+}
+
+// placement returns the tier the content described by `desc` is placed in.
+func (s *TieredStore) placement(desc ocispec.Descriptor) tier {
+	for _, t := range s.tiers[:len(s.tiers)-1] {
+		if t.rules.matches(desc) {
+			return t
+		}
+	}
+	return s.tiers[len(s.tiers)-1]
+}
+
+func (s *TieredStore) record(dgst digest.Digest, p placement) error {
+	v, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.update(func(bucket *bolt.Bucket) error {
+		return bucket.Put([]byte(dgst), v)
+	})
+}
+
+func (s *TieredStore) forget(dgst digest.Digest) error {
+	return s.update(func(bucket *bolt.Bucket) error {
+		return bucket.Delete([]byte(dgst))
+	})
+}
+
+// move moves the content described by `desc` from the directory `from` to the tier `to`.
+func (s *TieredStore) move(ctx context.Context, from string, to tier, desc ocispec.Descriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	if shared, ok := s.tiers[len(s.tiers)-1].storage.(*SharedStore); ok {
+		unlock, err := shared.lockMove(ctx, desc.Digest)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	src := filepath.Join(from, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := to.storage.Push(ctx, desc, f); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,240 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+func TestTieredStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	defaultPath, fastPath, bulkPath := filepath.Join(root, "default"), filepath.Join(root, "fast"), filepath.Join(root, "bulk")
+	dbPath := filepath.Join(root, "tiers.db")
+
+	ztoc, index, other := []byte("ztoc"), []byte("index"), []byte("other content")
+	ztocDesc, indexDesc, otherDesc := descFor(ztoc), descFor(index), descFor(other)
+	ztocDesc.MediaType = "application/octet-stream"
+	indexDesc.MediaType = ocispec.MediaTypeImageManifest
+	otherDesc.MediaType = "application/octet-stream"
+	contents := map[string][]byte{ztocDesc.Digest.String(): ztoc, indexDesc.Digest.String(): index, otherDesc.Digest.String(): other}
+
+	open := func(tiers []Tier) *TieredStore {
+		defaultStore, err := oci.NewStorage(defaultPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewTieredStore(defaultStore, defaultPath, tiers, dbPath)
+		if err != nil {
+			t.Fatalf("failed to create tiered store: %v", err)
+		}
+		return s
+	}
+	checkTier := func(s *TieredStore, desc ocispec.Descriptor, path string) {
+		t.Helper()
+		for _, p := range []string{defaultPath, fastPath, bulkPath} {
+			_, err := os.Stat(filepath.Join(p, "blobs", "sha256", desc.Digest.Encoded()))
+			if exists := err == nil; exists != (p == path) {
+				t.Fatalf("unexpected placement of %s in %s; expected = %s", desc.Digest, p, path)
+			}
+		}
+		rc, err := s.Fetch(ctx, desc)
+		if err != nil {
+			t.Fatalf("failed to fetch %s: %v", desc.Digest, err)
+		}
+		defer rc.Close()
+		if b, err := io.ReadAll(rc); err != nil || !bytes.Equal(b, contents[desc.Digest.String()]) {
+			t.Fatalf("unexpected content %q: %v", b, err)
+		}
+	}
+
+	// Small octet-streams (zTOCs) go to the fast tier, other octet-streams to the bulk tier
+	// and manifests to the default store.
+	s := open([]Tier{
+		{Path: fastPath, MediaTypes: []string{"application/octet-stream"}, MaxSize: 5},
+		{Path: bulkPath, MediaTypes: []string{"application/octet-stream"}},
+	})
+	for _, desc := range []ocispec.Descriptor{ztocDesc, indexDesc, otherDesc} {
+		if err := s.Push(ctx, desc, bytes.NewReader(contents[desc.Digest.String()])); err != nil {
+			t.Fatalf("failed to push %s: %v", desc.Digest, err)
+		}
+	}
+	if err := s.Push(ctx, ztocDesc, bytes.NewReader(ztoc)); !errors.Is(err, errdef.ErrAlreadyExists) {
+		t.Fatalf("unexpected error pushing existing content; expected = %v, got = %v", errdef.ErrAlreadyExists, err)
+	}
+	checkTier(s, ztocDesc, fastPath)
+	checkTier(s, otherDesc, bulkPath)
+	checkTier(s, indexDesc, defaultPath)
+
+	// Without the fast tier, zTOCs move to the bulk tier. Manifests move to the fast tier,
+	// which is now used for them.
+	s = open([]Tier{
+		{Path: fastPath, MediaTypes: []string{ocispec.MediaTypeImageManifest}},
+		{Path: bulkPath, MediaTypes: []string{"application/octet-stream"}},
+	})
+	moved, err := s.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if moved != 2 {
+		t.Fatalf("unexpected number of contents moved; expected = 2, got = %d", moved)
+	}
+	checkTier(s, ztocDesc, bulkPath)
+	checkTier(s, otherDesc, bulkPath)
+	checkTier(s, indexDesc, fastPath)
+
+	// Contents removed from their tier are forgotten.
+	if err := os.Remove(filepath.Join(bulkPath, "blobs", "sha256", otherDesc.Digest.Encoded())); err != nil {
+		t.Fatal(err)
+	}
+	s.tiers[1].rules.MaxSize = 5
+	if moved, err := s.Migrate(ctx); err != nil || moved != 0 {
+		t.Fatalf("unexpected migration of missing content; moved = %d, err = %v", moved, err)
+	}
+}
+
+func TestTieredStorePushAll(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	defaultPath, fastPath := filepath.Join(root, "default"), filepath.Join(root, "fast")
+	defaultStore, err := oci.NewStorage(defaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewTieredStore(defaultStore, defaultPath, []Tier{{Path: fastPath, MediaTypes: []string{"application/octet-stream"}}}, filepath.Join(root, "tiers.db"))
+	if err != nil {
+		t.Fatalf("failed to create tiered store: %v", err)
+	}
+
+	ztoc, index := []byte("ztoc"), []byte("index")
+	ztocDesc, indexDesc := descFor(ztoc), descFor(index)
+	ztocDesc.MediaType = "application/octet-stream"
+	indexDesc.MediaType = ocispec.MediaTypeImageManifest
+	if err := PushAll(ctx, s, []Blob{{ztocDesc, bytes.NewReader(ztoc)}, {indexDesc, bytes.NewReader(index)}}); err != nil {
+		t.Fatalf("failed to push all: %v", err)
+	}
+	for desc, path := range map[*ocispec.Descriptor]string{&ztocDesc: fastPath, &indexDesc: defaultPath} {
+		if _, err := os.Stat(filepath.Join(path, "blobs", "sha256", desc.Digest.Encoded())); err != nil {
+			t.Fatalf("%s isn't placed in %s: %v", desc.Digest, path, err)
+		}
+	}
+
+	// The placements are recorded, so that the contents are migrated when the tiers change.
+	s.tiers[0].rules.MediaTypes = []string{ocispec.MediaTypeImageManifest}
+	if moved, err := s.Migrate(ctx); err != nil || moved != 2 {
+		t.Fatalf("unexpected migration; moved = %d, err = %v", moved, err)
+	}
+}
+
+func TestTieredStoreMigrateExisting(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	defaultPath, fastPath := filepath.Join(root, "default"), filepath.Join(root, "fast")
+	defaultStore, err := oci.NewStorage(defaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contents stored without the tiered store, e.g. by an older soci CLI, have no recorded placement.
+	ztoc, index := []byte("ztoc"), []byte(`{"mediaType":"`+ocispec.MediaTypeImageManifest+`"}`)
+	ztocDesc, indexDesc := descFor(ztoc), descFor(index)
+	for _, b := range []Blob{{ztocDesc, bytes.NewReader(ztoc)}, {indexDesc, bytes.NewReader(index)}} {
+		if err := defaultStore.Push(ctx, b.Descriptor, b.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewTieredStore(defaultStore, defaultPath, []Tier{{Path: fastPath, MediaTypes: []string{"application/octet-stream"}}}, filepath.Join(root, "tiers.db"))
+	if err != nil {
+		t.Fatalf("failed to create tiered store: %v", err)
+	}
+	if moved, err := s.Migrate(ctx); err != nil || moved != 1 {
+		t.Fatalf("unexpected migration; moved = %d, err = %v", moved, err)
+	}
+	for desc, path := range map[*ocispec.Descriptor]string{&ztocDesc: fastPath, &indexDesc: defaultPath} {
+		if _, err := os.Stat(filepath.Join(path, "blobs", "sha256", desc.Digest.Encoded())); err != nil {
+			t.Fatalf("%s isn't placed in %s: %v", desc.Digest, path, err)
+		}
+	}
+
+	// The placement of the manifest was recorded with its media type.
+	s.tiers[0].rules.MediaTypes = []string{ocispec.MediaTypeImageManifest}
+	if moved, err := s.Migrate(ctx); err != nil || moved != 2 {
+		t.Fatalf("unexpected migration; moved = %d, err = %v", moved, err)
+	}
+}
+
+func TestTieredStoreSharedMigrate(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	defaultPath, fastPath := filepath.Join(root, "default"), filepath.Join(root, "fast")
+	ztoc := []byte("ztoc")
+	ztocDesc := descFor(ztoc)
+	ztocDesc.MediaType = "application/octet-stream"
+
+	// Two snapshotters share the tiers, each with a database of its own.
+	open := func(node string, tiers []Tier) *TieredStore {
+		defaultStore, err := NewSharedStore(defaultPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewTieredStore(defaultStore, defaultPath, tiers, filepath.Join(root, node, "tiers.db"))
+		if err != nil {
+			t.Fatalf("failed to create tiered store: %v", err)
+		}
+		return s
+	}
+	if err := open("node1", nil).Push(ctx, ztocDesc, bytes.NewReader(ztoc)); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	tiers := []Tier{{Path: fastPath, MediaTypes: []string{"application/octet-stream"}}}
+	nodes := []*TieredStore{open("node1", tiers), open("node2", tiers)}
+	if _, ok := nodes[0].tiers[0].storage.(*SharedStore); !ok {
+		t.Fatalf("the tiers of a shared store aren't shared")
+	}
+
+	errs := make(chan error, len(nodes))
+	for _, s := range nodes {
+		go func(s *TieredStore) {
+			_, err := s.Migrate(ctx)
+			errs <- err
+		}(s)
+	}
+	for range nodes {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(fastPath, "blobs", "sha256", ztocDesc.Digest.Encoded())); err != nil {
+		t.Fatalf("content wasn't moved to its tier: %v", err)
+	}
+	// Both snapshotters know where the content is now.
+	for i, s := range nodes {
+		if moved, err := s.Migrate(ctx); err != nil || moved != 0 {
+			t.Fatalf("unexpected migration of node %d; moved = %d, err = %v", i+1, moved, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/util/logutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// ZtocSource looks up the zTOCs built for layers by earlier index builds, so that rebuilding
+// the SOCI index of an image which only changes some of its layers doesn't build the zTOCs
+// of the others again (see `WithZtocSources`).
+type ZtocSource interface {
+	// FindZtocs returns the descriptors of the zTOCs built for the layer `layerDigest`.
+	FindZtocs(ctx context.Context, layerDigest digest.Digest) ([]ocispec.Descriptor, error)
+	// Fetch fetches a zTOC returned by `FindZtocs`.
+	Fetch(ctx context.Context, target ocispec.Descriptor) (io.ReadCloser, error)
+}
+
+// WithZtocSources makes the builder reuse the zTOCs of layers found in `sources`, in order,
+// instead of building them. A zTOC is only reused if it was built with the span size the
+// layer would be indexed with.
+func WithZtocSources(sources ...ZtocSource) BuildOption {
+	return func(c *buildConfig) error {
+		c.ztocSources = append(c.ztocSources, sources...)
+		return nil
+	}
+}
+
+type artifactsDbZtocSource struct {
+	orascontent.Fetcher
+	db *ArtifactsDb
+}
+
+// NewArtifactsDbZtocSource returns a `ZtocSource` of the zTOCs recorded in `db`, which are
+// read from `store`, e.g. the local SOCI content store.
+func NewArtifactsDbZtocSource(db *ArtifactsDb, store orascontent.Fetcher) ZtocSource {
+	return &artifactsDbZtocSource{Fetcher: store, db: db}
+}
+
+func (s *artifactsDbZtocSource) FindZtocs(ctx context.Context, layerDigest digest.Digest) ([]ocispec.Descriptor, error) {
+	var descs []ocispec.Descriptor
+	err := s.db.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type != ArtifactEntryTypeLayer || ae.OriginalDigest != layerDigest.String() {
+			return nil
+		}
+		dgst, err := digest.Parse(ae.Digest)
+		if err != nil {
+			return nil
+		}
+		descs = append(descs, ocispec.Descriptor{
+			MediaType: SociLayerMediaType,
+			Digest:    dgst,
+			Size:      ae.Size,
+		})
+		return nil
+	})
+	return descs, err
+}
+
+type indexZtocSource struct {
+	orascontent.Fetcher
+	ztocs map[digest.Digest][]ocispec.Descriptor
+}
+
+// NewIndexZtocSource returns a `ZtocSource` of the zTOCs of the SOCI `indices`, which are
+// read from `fetcher`, e.g. the remote repository the indices were pushed to.
+func NewIndexZtocSource(fetcher orascontent.Fetcher, indices ...*Index) ZtocSource {
+	ztocs := make(map[digest.Digest][]ocispec.Descriptor)
+	for _, index := range indices {
+		for _, blob := range index.Blobs {
+			layerDigest, err := digest.Parse(blob.Annotations[IndexAnnotationImageLayerDigest])
+			if err != nil {
+				continue
+			}
+			ztocs[layerDigest] = append(ztocs[layerDigest], blob)
+		}
+	}
+	return &indexZtocSource{Fetcher: fetcher, ztocs: ztocs}
+}
+
+func (s *indexZtocSource) FindZtocs(ctx context.Context, layerDigest digest.Digest) ([]ocispec.Descriptor, error) {
+	return s.ztocs[layerDigest], nil
+}
+
+// FetchIndices fetches the SOCI index `desc` from `fetcher`, or every SOCI index of the SOCI
+// index list `desc`.
+func FetchIndices(ctx context.Context, fetcher orascontent.Fetcher, desc ocispec.Descriptor) ([]*Index, error) {
+	b, err := orascontent.FetchAll(ctx, fetcher, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch %s: %w", desc.Digest, err)
+	}
+	if desc.MediaType == ocispec.MediaTypeImageIndex {
+		var indexList ocispec.Index
+		if err := json.Unmarshal(b, &indexList); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal soci index list %s: %w", desc.Digest, err)
+		}
+		var indices []*Index
+		for _, m := range indexList.Manifests {
+			mIndices, err := FetchIndices(ctx, fetcher, m)
+			if err != nil {
+				return nil, err
+			}
+			indices = append(indices, mIndices...)
+		}
+		return indices, nil
+	}
+
+	var index Index
+	if err := UnmarshalIndex(b, &index); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal soci index %s: %w", desc.Digest, err)
+	}
+	return []*Index{&index}, nil
+}
+
+// reuseZtoc looks up a zTOC of the layer `desc` in the zTOC sources of the builder and writes it
+// to the blob store. It returns nil if no zTOC can be reused.
+func (b *IndexBuilder) reuseZtoc(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	spanSize := b.config.layerSpanSize(desc)
+	for _, source := range b.config.ztocSources {
+		candidates, err := source.FindZtocs(ctx, desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up ztocs of layer %s: %w", desc.Digest, err)
+		}
+		for _, candidate := range candidates {
+			ztocBytes, err := orascontent.FetchAll(ctx, source, candidate)
+			if err != nil {
+				log.G(ctx).WithError(err).WithField(logutil.LayerField, desc.Digest).WithField("ztoc", candidate.Digest).Debug("ztoc not reused")
+				continue
+			}
+			if err := checkReusableZtoc(ztocBytes, desc, spanSize); err != nil {
+				log.G(ctx).WithError(err).WithField(logutil.LayerField, desc.Digest).WithField("ztoc", candidate.Digest).Debug("ztoc not reused")
+				continue
+			}
+
+			ztocDesc := ocispec.Descriptor{
+				MediaType: SociLayerMediaType,
+				Digest:    candidate.Digest,
+				Size:      candidate.Size,
+			}
+			if err := b.writeZtoc(ctx, ztocDesc, bytes.NewReader(ztocBytes), desc); err != nil {
+				return nil, err
+			}
+			b.reportLayer(ctx, LayerProgress{Layer: desc, Ztoc: &ztocDesc, Reused: true})
+			return &ztocDesc, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkReusableZtoc checks that a zTOC is a valid zTOC of the layer `desc` with the span size `spanSize`.
+func checkReusableZtoc(ztocBytes []byte, desc ocispec.Descriptor, spanSize int64) error {
+	toc, err := ztoc.Unmarshal(bytes.NewReader(ztocBytes))
+	if err != nil {
+		return err
+	}
+	if int64(toc.CompressedArchiveSize) != desc.Size {
+		return fmt.Errorf("built for a layer of %d bytes, but the layer has %d bytes", toc.CompressedArchiveSize, desc.Size)
+	}
+	if int64(toc.SpanSize) != spanSize {
+		return fmt.Errorf("built with span size %d, but the layer is indexed with span size %d", toc.SpanSize, spanSize)
+	}
+	return nil
+}
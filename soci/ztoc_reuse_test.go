@@ -0,0 +1,136 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestReuseZtocs(t *testing.T) {
+	ctx := context.Background()
+	src := memory.New()
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := src.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatalf("failed to push %s: %v", mediaType, err)
+		}
+		return desc
+	}
+	configDesc := push(ocispec.MediaTypeImageConfig, []byte("{}"))
+	pushImage := func(layers ...ocispec.Descriptor) ocispec.Descriptor {
+		b, err := json.Marshal(ocispec.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    configDesc,
+			Layers:    layers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return push(ocispec.MediaTypeImageManifest, b)
+	}
+	pushLayer := func(name string) ocispec.Descriptor {
+		layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+			testutil.File(name, string(testutil.RandomByteData(100000))),
+		}, gzip.BestCompression))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return push(ocispec.MediaTypeImageLayerGzip, layer)
+	}
+	ztocs := func(res *BuildResult) map[string]digest.Digest {
+		m := make(map[string]digest.Digest)
+		for _, blob := range res.Index.Blobs {
+			m[blob.Annotations[IndexAnnotationImageLayerDigest]] = blob.Digest
+		}
+		return m
+	}
+
+	base, top := pushLayer("base"), pushLayer("top")
+	oldStore := memory.New()
+	old, err := BuildIndex(ctx, pushImage(base), src, oldStore, WithMinLayerSize(0), WithBuildToolIdentifier("old"))
+	if err != nil {
+		t.Fatalf("failed to build index: %v", err)
+	}
+	oldZtoc := old.Index.Blobs[0]
+
+	// zTOCs built by another tool have other digests, so reused zTOCs are told apart.
+	newImage := pushImage(base, top)
+	rebuilt, err := BuildIndex(ctx, newImage, src, memory.New(), WithMinLayerSize(0), WithBuildToolIdentifier("new"))
+	if err != nil {
+		t.Fatalf("failed to build index: %v", err)
+	}
+	if ztocs(rebuilt)[base.Digest.String()] == oldZtoc.Digest {
+		t.Fatalf("zTOCs of different build tools have the same digest")
+	}
+
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db: %v", err)
+	}
+	if err := db.WriteArtifactEntry(&ArtifactEntry{
+		Size:           oldZtoc.Size,
+		Digest:         oldZtoc.Digest.String(),
+		OriginalDigest: base.Digest.String(),
+		Type:           ArtifactEntryTypeLayer,
+		MediaType:      SociLayerMediaType,
+	}); err != nil {
+		t.Fatalf("failed to write artifact entry: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		source   ZtocSource
+		spanSize int64
+		reused   bool
+	}{
+		{name: "index", source: NewIndexZtocSource(oldStore, old.Index), spanSize: defaultSpanSize, reused: true},
+		{name: "artifacts db", source: NewArtifactsDbZtocSource(db, oldStore), spanSize: defaultSpanSize, reused: true},
+		{name: "other span size", source: NewIndexZtocSource(oldStore, old.Index), spanSize: 1 << 16, reused: false},
+		{name: "zTOC missing from the store", source: NewIndexZtocSource(memory.New(), old.Index), spanSize: defaultSpanSize, reused: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := memory.New()
+			res, err := BuildIndex(ctx, newImage, src, dst, WithMinLayerSize(0), WithBuildToolIdentifier("new"),
+				WithSpanSize(tc.spanSize), WithZtocSources(tc.source))
+			if err != nil {
+				t.Fatalf("failed to build index: %v", err)
+			}
+			got := ztocs(res)
+			if reused := got[base.Digest.String()] == oldZtoc.Digest; reused != tc.reused {
+				t.Fatalf("unexpected reuse of the zTOC of the unchanged layer; expected = %t, got = %t", tc.reused, reused)
+			}
+			if _, ok := got[top.Digest.String()]; !ok {
+				t.Fatalf("the zTOC of the new layer wasn't built")
+			}
+			for _, blob := range res.Index.Blobs {
+				if ok, err := dst.Exists(ctx, blob); err != nil || !ok {
+					t.Fatalf("zTOC %s wasn't written to the store: %v", blob.Digest, err)
+				}
+			}
+		})
+	}
+}
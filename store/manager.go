@@ -46,12 +46,14 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/snapshot"
+	socistore "github.com/awslabs/soci-snapshotter/soci/store"
 	"github.com/awslabs/soci-snapshotter/util/namedmutex"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/docker/go-metrics"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/oci"
 )
 
@@ -75,7 +77,12 @@ func NewLayerManager(ctx context.Context, root string, hosts source.RegistryHost
 	if cfg.ContentStorePath == "" {
 		return nil, fmt.Errorf("config store path is empty")
 	}
-	store, err := oci.New(cfg.ContentStorePath)
+	var store content.Storage
+	if cfg.SharedContentStore {
+		store, err = socistore.NewSharedStore(cfg.ContentStorePath)
+	} else {
+		store, err = oci.New(cfg.ContentStorePath)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SOCI store: %w", err)
 	}
@@ -84,6 +91,7 @@ func NewLayerManager(ctx context.Context, root string, hosts source.RegistryHost
 		root,
 		cfg,
 		/* resolveHandlers map[string]remote.Handler= */ nil,
+		/* blobSources []remote.BlobSource= */ nil,
 		metadataStore,
 		store,
 		layer.OverlayOpaqueAll,
@@ -284,7 +292,8 @@ func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec,
 		refspec,
 		target,
 		ztocDesc,
-		nil)
+		nil,
+		0)
 	if err != nil {
 		return nil, err
 	}
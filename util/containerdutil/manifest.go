@@ -35,8 +35,10 @@ package containerdutil
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"time"
 
 	"github.com/containerd/containerd/images"
@@ -86,61 +88,123 @@ func ValidateMediaType(b []byte, mt string) error {
 	return nil
 }
 
+const (
+	// maxManifestSize is the maximum size of the image manifests and indices read, as read by containerd.
+	maxManifestSize = 4 << 20 // 4 MiB
+	// maxIndexDepth is how deeply image indices may be nested, e.g. an index of the indices of the
+	// variants of an image, before resolving their manifest gives up.
+	maxIndexDepth = 8
+	// attestationManifestAnnotation annotates the manifests of the provenance and SBOM attestations
+	// added to image indices by buildkit, whose platform is unknown/unknown.
+	attestationManifestAnnotation = "vnd.docker.reference.type"
+)
+
+// ErrNoPlatformManifest is returned when an image has no manifest of the requested platform.
+var ErrNoPlatformManifest = errors.New("no manifest found for platform")
+
 // Fetch manifest of the specified platform
 func FetchManifestPlatform(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, platform ocispec.Platform) (ocispec.Manifest, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 
-	r, err := fetcher.Fetch(ctx, desc)
-	if err != nil {
-		return ocispec.Manifest{}, err
-	}
-	defer r.Close()
+	_, manifest, err := ResolveManifest(ctx, fetcher, desc, platforms.Ordered(platform))
+	return manifest, err
+}
+
+// ResolveManifest returns the descriptor and the content of the best match of `platform` among the
+// manifests of the image `desc`. The image can be a manifest, a Docker manifest list or an OCI image
+// index, whose manifests can in turn be nested indices. Manifests without a platform are of the
+// default platform, and attestation manifests are skipped.
+func ResolveManifest(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, platform platforms.MatchComparer) (ocispec.Descriptor, ocispec.Manifest, error) {
+	return resolveManifest(ctx, fetcher, desc, platform, 0)
+}
 
+func resolveManifest(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, platform platforms.MatchComparer, depth int) (ocispec.Descriptor, ocispec.Manifest, error) {
 	var manifest ocispec.Manifest
-	switch desc.MediaType {
-	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
-		p, err := io.ReadAll(r)
-		if err != nil {
-			return ocispec.Manifest{}, err
-		}
-		if err := ValidateMediaType(p, desc.MediaType); err != nil {
-			return ocispec.Manifest{}, err
-		}
+	if !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType) {
+		return ocispec.Descriptor{}, manifest, fmt.Errorf("unknown mediatype %q", desc.MediaType)
+	}
+	p, err := FetchDocument(ctx, fetcher, desc, maxManifestSize)
+	if err != nil {
+		return ocispec.Descriptor{}, manifest, err
+	}
+	if images.IsManifestType(desc.MediaType) {
 		if err := json.Unmarshal(p, &manifest); err != nil {
-			return ocispec.Manifest{}, err
-		}
-		return manifest, nil
-	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
-		var index ocispec.Index
-		p, err := io.ReadAll(r)
-		if err != nil {
-			return ocispec.Manifest{}, err
+			return ocispec.Descriptor{}, manifest, err
 		}
-		if err := ValidateMediaType(p, desc.MediaType); err != nil {
-			return ocispec.Manifest{}, err
+		return desc, manifest, nil
+	}
+
+	if depth >= maxIndexDepth {
+		return ocispec.Descriptor{}, manifest, fmt.Errorf("image index %s is nested more than %d levels deep", desc.Digest, maxIndexDepth)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(p, &index); err != nil {
+		return ocispec.Descriptor{}, manifest, err
+	}
+	for _, m := range platformManifests(index, platform) {
+		target, manifest, err := resolveManifest(ctx, fetcher, m, platform, depth+1)
+		if errors.Is(err, ErrNoPlatformManifest) {
+			// A nested index without a platform may not have a manifest of it.
+			continue
 		}
-		if err = json.Unmarshal(p, &index); err != nil {
-			return ocispec.Manifest{}, err
+		return target, manifest, err
+	}
+	return ocispec.Descriptor{}, manifest, fmt.Errorf("image index %s: %w", desc.Digest, ErrNoPlatformManifest)
+}
+
+// platformManifests returns the manifests of `index` which can be of `platform`, best match first,
+// followed by the nested indices without a platform.
+func platformManifests(index ocispec.Index, platform platforms.MatchComparer) []ocispec.Descriptor {
+	platformOf := func(m ocispec.Descriptor) ocispec.Platform {
+		if m.Platform == nil {
+			return platforms.DefaultSpec()
 		}
-		var target ocispec.Descriptor
-		found := false
-		for _, m := range index.Manifests {
-			p := platforms.DefaultSpec()
-			if m.Platform != nil {
-				p = *m.Platform
-			}
-			if !platforms.NewMatcher(platform).Match(p) {
-				continue
-			}
-			target = m
-			found = true
-			break
+		return *m.Platform
+	}
+	var matches, nested []ocispec.Descriptor
+	for _, m := range index.Manifests {
+		if _, ok := m.Annotations[attestationManifestAnnotation]; ok {
+			continue
 		}
-		if !found {
-			return ocispec.Manifest{}, fmt.Errorf("no manifest found for platform")
+		if m.Platform == nil && images.IsIndexType(m.MediaType) {
+			nested = append(nested, m)
+		} else if platform.Match(platformOf(m)) {
+			matches = append(matches, m)
 		}
-		return FetchManifestPlatform(ctx, fetcher, target, platform)
 	}
-	return ocispec.Manifest{}, fmt.Errorf("unknown mediatype %q", desc.MediaType)
+	sort.SliceStable(matches, func(i, j int) bool {
+		return platform.Less(platformOf(matches[i]), platformOf(matches[j]))
+	})
+	return append(matches, nested...)
+}
+
+// FetchDocument fetches the manifest or index `desc` of at most `maxSize` bytes, verifies
+// it against its digest and validates its media type.
+func FetchDocument(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, maxSize int64) ([]byte, error) {
+	if desc.Size > maxSize {
+		return nil, fmt.Errorf("%s %s is larger than %d bytes", desc.MediaType, desc.Digest, maxSize)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", desc.MediaType, desc.Digest, err)
+	}
+	r, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	p, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(p)) > maxSize {
+		return nil, fmt.Errorf("%s %s is larger than %d bytes", desc.MediaType, desc.Digest, maxSize)
+	}
+	if desc.Digest.Algorithm().FromBytes(p) != desc.Digest {
+		return nil, fmt.Errorf("fetched %s %s doesn't match its digest", desc.MediaType, desc.Digest)
+	}
+	if err := ValidateMediaType(p, desc.MediaType); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
@@ -0,0 +1,186 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerdutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type fakeFetcher map[digest.Digest][]byte
+
+func (f fakeFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	b, ok := f[desc.Digest]
+	if !ok {
+		return nil, errdefs.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (f fakeFetcher) add(t *testing.T, mediaType string, v interface{}, platform *ocispec.Platform) ocispec.Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f[digest.FromBytes(b)] = b
+	return ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b)), Platform: platform}
+}
+
+func (f fakeFetcher) addManifest(t *testing.T, mediaType string, platform *ocispec.Platform) ocispec.Descriptor {
+	// The config makes the manifest of each platform unique.
+	config := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString(platforms.Format(platforms.DefaultSpec()))}
+	if platform != nil {
+		config.Digest = digest.FromString(platforms.Format(*platform))
+	}
+	return f.add(t, mediaType, ocispec.Manifest{MediaType: mediaType, Config: config}, platform)
+}
+
+func (f fakeFetcher) addIndex(t *testing.T, mediaType string, platform *ocispec.Platform, manifests ...ocispec.Descriptor) ocispec.Descriptor {
+	return f.add(t, mediaType, ocispec.Index{MediaType: mediaType, Manifests: manifests}, platform)
+}
+
+func TestResolveManifest(t *testing.T) {
+	ctx := context.Background()
+	var (
+		amd64 = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+		armv6 = &ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}
+		armv7 = &ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	)
+	f := make(fakeFetcher)
+	amd64Manifest := f.addManifest(t, images.MediaTypeDockerSchema2Manifest, amd64)
+	armv6Manifest := f.addManifest(t, ocispec.MediaTypeImageManifest, armv6)
+	armv7Manifest := f.addManifest(t, ocispec.MediaTypeImageManifest, armv7)
+	// Attestations are of the unknown/unknown platform, but must be skipped whatever their platform.
+	attestation := f.add(t, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("attestation")},
+	}, amd64)
+	attestation.Annotations = map[string]string{attestationManifestAnnotation: "attestation-manifest"}
+
+	tests := []struct {
+		name     string
+		image    ocispec.Descriptor
+		platform ocispec.Platform
+		expected ocispec.Descriptor
+	}{
+		{
+			name:     "manifest",
+			image:    amd64Manifest,
+			platform: *amd64,
+			expected: amd64Manifest,
+		},
+		{
+			name:     "docker manifest list",
+			image:    f.addIndex(t, images.MediaTypeDockerSchema2ManifestList, nil, armv7Manifest, amd64Manifest),
+			platform: *amd64,
+			expected: amd64Manifest,
+		},
+		{
+			name:     "best match first",
+			image:    f.addIndex(t, ocispec.MediaTypeImageIndex, nil, armv6Manifest, armv7Manifest),
+			platform: *armv7,
+			expected: armv7Manifest,
+		},
+		{
+			name:     "attestation manifests are skipped",
+			image:    f.addIndex(t, ocispec.MediaTypeImageIndex, nil, attestation, amd64Manifest),
+			platform: *amd64,
+			expected: amd64Manifest,
+		},
+		{
+			name: "nested indices",
+			image: f.addIndex(t, ocispec.MediaTypeImageIndex, nil,
+				f.addIndex(t, ocispec.MediaTypeImageIndex, nil, armv7Manifest),
+				f.addIndex(t, images.MediaTypeDockerSchema2ManifestList, nil, attestation, amd64Manifest),
+			),
+			platform: *amd64,
+			expected: amd64Manifest,
+		},
+		{
+			name: "nested indices with a platform",
+			image: f.addIndex(t, ocispec.MediaTypeImageIndex, nil,
+				f.addIndex(t, ocispec.MediaTypeImageIndex, amd64, amd64Manifest),
+				armv7Manifest,
+			),
+			platform: *amd64,
+			expected: amd64Manifest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			desc, manifest, err := ResolveManifest(ctx, f, tc.image, platforms.Only(tc.platform))
+			if err != nil {
+				t.Fatalf("failed to resolve manifest: %v", err)
+			}
+			if desc.Digest != tc.expected.Digest {
+				t.Fatalf("unexpected manifest; expected = %s, got = %s", tc.expected.Digest, desc.Digest)
+			}
+			if manifest.Config.Digest == "" {
+				t.Fatal("manifest wasn't read")
+			}
+		})
+	}
+
+	t.Run("no manifest of platform", func(t *testing.T) {
+		image := f.addIndex(t, ocispec.MediaTypeImageIndex, nil, f.addIndex(t, ocispec.MediaTypeImageIndex, nil, armv7Manifest))
+		windows := ocispec.Platform{OS: "windows", Architecture: "amd64"}
+		if _, _, err := ResolveManifest(ctx, f, image, platforms.Only(windows)); !errors.Is(err, ErrNoPlatformManifest) {
+			t.Fatalf("unexpected error; expected = %v, got = %v", ErrNoPlatformManifest, err)
+		}
+	})
+
+	t.Run("deeply nested indices", func(t *testing.T) {
+		image := amd64Manifest
+		for i := 0; i <= maxIndexDepth; i++ {
+			image = f.addIndex(t, ocispec.MediaTypeImageIndex, nil, image)
+		}
+		if _, _, err := ResolveManifest(ctx, f, image, platforms.Only(*amd64)); err == nil || errors.Is(err, ErrNoPlatformManifest) {
+			t.Fatalf("unexpected error resolving deeply nested indices: %v", err)
+		}
+	})
+}
+
+func TestFetchDocument(t *testing.T) {
+	ctx := context.Background()
+	f := make(fakeFetcher)
+	desc := f.addManifest(t, ocispec.MediaTypeImageManifest, nil)
+	if _, err := FetchDocument(ctx, f, desc, maxManifestSize); err != nil {
+		t.Fatalf("failed to fetch manifest: %v", err)
+	}
+
+	// The registry serves other contents for the digest of the manifest.
+	tampered := append([]byte(nil), f[desc.Digest]...)
+	tampered[len(tampered)-2] = ' '
+	f[desc.Digest] = tampered
+	if _, err := FetchDocument(ctx, f, desc, maxManifestSize); err == nil {
+		t.Fatal("fetched a manifest which doesn't match its digest")
+	}
+
+	if _, err := FetchDocument(ctx, f, desc, desc.Size-1); err == nil {
+		t.Fatal("fetched a manifest larger than the maximum size")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// BandwidthLimiter is a token bucket limiting the rate at which the bodies of responses
+// are read, in bytes per second. A limiter can be shared by the transports of several
+// hosts to limit the total bandwidth they use.
+type BandwidthLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewBandwidthLimiter creates a limiter allowing bytesPerSec bytes per second, in bursts
+// of up to one second worth of bytes. It returns nil if bytesPerSec isn't positive.
+func NewBandwidthLimiter(bytesPerSec int64) *BandwidthLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &BandwidthLimiter{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec)),
+	}
+}
+
+// NewBandwidthTransport returns an http.RoundTripper whose response bodies are read no
+// faster than all the limiters allow. Nil limiters are ignored.
+func NewBandwidthTransport(next http.RoundTripper, limiters ...*BandwidthLimiter) http.RoundTripper {
+	var ls []*BandwidthLimiter
+	for _, l := range limiters {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	if len(ls) == 0 {
+		return next
+	}
+	return &bandwidthTransport{
+		limiters: ls,
+		next:     next,
+	}
+}
+
+type bandwidthTransport struct {
+	limiters []*BandwidthLimiter
+	next     http.RoundTripper
+}
+
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Body == nil || resp.Body == http.NoBody {
+		return resp, err
+	}
+	resp.Body = &limitedBody{
+		ReadCloser: resp.Body,
+		ctx:        req.Context(),
+		limiters:   t.limiters,
+	}
+	return resp, nil
+}
+
+// limitedBody is a response body which waits for the bytes it read to be allowed
+// by all the limiters before returning them.
+type limitedBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*BandwidthLimiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// A single wait can't exceed the burst of a limiter.
+	for _, l := range b.limiters {
+		if burst := l.limiter.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		for _, l := range b.limiters {
+			if werr := l.limiter.WaitN(b.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthTransport(t *testing.T) {
+	const size = 10000
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{'a'}, size))
+	}))
+	defer server.Close()
+
+	// A limiter shared by two transports limits the total bandwidth of both: after the
+	// initial burst, the remaining bytes are read at the limit.
+	const bytesPerSec = 10000
+	limiter := NewBandwidthLimiter(bytesPerSec)
+	clients := []*http.Client{
+		{Transport: NewBandwidthTransport(http.DefaultTransport, limiter)},
+		{Transport: NewBandwidthTransport(http.DefaultTransport, nil, limiter)},
+	}
+	start := time.Now()
+	for _, c := range clients {
+		resp, err := c.Get(server.URL)
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil || n != size {
+			t.Fatalf("unexpected read; expected = %d bytes, got = %d bytes, err = %v", size, n, err)
+		}
+	}
+	expected := time.Duration(2*size-bytesPerSec) * time.Second / bytesPerSec
+	if elapsed := time.Since(start); elapsed < expected*9/10 {
+		t.Fatalf("read too fast; expected at least %v, got %v", expected, elapsed)
+	}
+
+	// Reads stop waiting when the request is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := clients[0].Do(req)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	defer resp.Body.Close()
+	cancel()
+	if _, err := io.Copy(io.Discard, resp.Body); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; expected = %v, got = %v", context.Canceled, err)
+	}
+}
+
+func TestBandwidthTransportUnlimited(t *testing.T) {
+	if NewBandwidthLimiter(0) != nil || NewBandwidthLimiter(-1) != nil {
+		t.Fatalf("limiters without a positive limit must be nil")
+	}
+	if tr := NewBandwidthTransport(http.DefaultTransport, nil); tr != http.DefaultTransport {
+		t.Fatalf("transports without limiters must not be wrapped")
+	}
+}
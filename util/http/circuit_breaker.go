@@ -0,0 +1,139 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// ErrCircuitOpen is returned for requests to a host whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreakers holds the circuit breakers of all hosts. They are shared by all clients so that
+// the state of a host is tracked globally, even though clients are created per image reference.
+// The config of the first client talking to a host is used for that host.
+var circuitBreakers sync.Map // host -> *circuitBreaker
+
+// circuitBreaker tracks consecutive failures to a single host.
+// After `threshold` consecutive failures, the circuit opens and requests fail fast for `cooldown`.
+// Once the cooldown has passed, a single trial request is let through: if it succeeds the circuit
+// closes, otherwise it stays open for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+
+	now func() time.Time
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: config.FailureThreshold,
+		cooldown:  config.Cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a request may be sent to the host.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a request allowed by allow.
+// It returns true if the record caused the circuit to open.
+func (b *circuitBreaker) record(success bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+// release ends a request allowed by allow without recording an outcome,
+// e.g. because the request was canceled by the caller.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// circuitBreakerTransport is an http.RoundTripper which fails fast with ErrCircuitOpen
+// for hosts with an open circuit breaker.
+type circuitBreakerTransport struct {
+	config CircuitBreakerConfig
+	next   http.RoundTripper
+}
+
+func (t *circuitBreakerTransport) breaker(host string) *circuitBreaker {
+	b, _ := circuitBreakers.LoadOrStore(host, newCircuitBreaker(t.config))
+	return b.(*circuitBreaker)
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	b := t.breaker(host)
+	if !b.allow() {
+		return nil, fmt.Errorf("%w for host %s", ErrCircuitOpen, host)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil && errors.Is(err, context.Canceled) {
+		// The caller gave up on the request; this says nothing about the host.
+		b.release()
+		return resp, err
+	}
+	if b.record(err == nil && !isServerFailure(resp)) {
+		log.G(req.Context()).WithField("host", host).WithField("cooldown", b.cooldown).
+			Warn("too many consecutive failures, opening circuit breaker")
+	}
+	return resp, err
+}
+
+// isServerFailure reports whether the response indicates that the host is unhealthy or overloaded.
+func isServerFailure(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented)
+}
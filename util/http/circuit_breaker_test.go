@@ -0,0 +1,100 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Second})
+	b.now = func() time.Time { return now }
+
+	b.record(false)
+	if !b.allow() {
+		t.Fatalf("circuit opened before reaching the failure threshold")
+	}
+	b.record(true)
+	b.record(false)
+	if !b.allow() {
+		t.Fatalf("a success did not reset the consecutive failure count")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatalf("circuit did not open after reaching the failure threshold")
+	}
+
+	now = now.Add(time.Second)
+	if !b.allow() {
+		t.Fatalf("trial request was not allowed after the cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("more than one trial request was allowed after the cooldown")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatalf("circuit did not reopen after a failed trial request")
+	}
+
+	now = now.Add(time.Second)
+	if !b.allow() {
+		t.Fatalf("trial request was not allowed after the cooldown")
+	}
+	b.record(true)
+	if !b.allow() || !b.allow() {
+		t.Fatalf("circuit did not close after a successful trial request")
+	}
+}
+
+func TestRetryableClientCircuitBreaker(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := NewRetryableClientConfig()
+	config.MaxRetries = 5
+	config.MinWait = time.Millisecond
+	config.MaxWait = time.Millisecond
+	config.FailureThreshold = 3
+	config.Cooldown = time.Hour
+	client := NewRetryableClient(config)
+
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("unexpected error; expected = %v, got = %v", ErrCircuitOpen, err)
+	}
+	if requests != 3 {
+		t.Fatalf("unexpected number of requests; expected = 3, got = %d", requests)
+	}
+
+	// Subsequent requests fail fast without reaching the server.
+	_, err = client.Get(server.URL)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("unexpected error; expected = %v, got = %v", ErrCircuitOpen, err)
+	}
+	if requests != 3 {
+		t.Fatalf("unexpected number of requests; expected = 3, got = %d", requests)
+	}
+}
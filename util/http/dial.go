@@ -0,0 +1,222 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultFallbackDelayMsec is the default delay before dialing the addresses of the other
+// address family of a dual-stack host, as recommended by RFC 6555 and used by net.Dialer.
+const DefaultFallbackDelayMsec = 300
+
+// hostResolver resolves the addresses of hosts. It's net.DefaultResolver, except in tests.
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dnsCache caches the addresses of hosts for all clients, so that the lookups of the
+// connections opened by concurrent span fetches to the same registry are shared.
+type dnsCache struct {
+	resolver hostResolver
+	lookups  singleflight.Group
+	entries  sync.Map // host -> *dnsEntry
+	now      func() time.Time
+}
+
+type dnsEntry struct {
+	addrs      []net.IPAddr
+	resolvedAt time.Time
+}
+
+var defaultDNSCache = &dnsCache{resolver: net.DefaultResolver, now: time.Now}
+
+// lookup returns the addresses of host, which are resolved again once they're older than ttl.
+func (c *dnsCache) lookup(ctx context.Context, host string, ttl time.Duration) ([]net.IPAddr, error) {
+	if e, ok := c.entries.Load(host); ok {
+		entry := e.(*dnsEntry)
+		if c.now().Sub(entry.resolvedAt) < ttl {
+			return entry.addrs, nil
+		}
+	}
+	// The lookup isn't cancelled with the dial that started it, since other dials share it.
+	ch := c.lookups.DoChan(host, func() (interface{}, error) {
+		addrs, err := c.resolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		c.entries.Store(host, &dnsEntry{addrs: addrs, resolvedAt: c.now()})
+		return addrs, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]net.IPAddr), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// forget drops the cached addresses of host, e.g. once none of them can be dialed.
+func (c *dnsCache) forget(host string) {
+	c.entries.Delete(host)
+}
+
+// cachingDialer dials hosts at the addresses cached in a dnsCache. Like net.Dialer, it dials
+// the addresses of dual-stack hosts with "happy eyeballs" (RFC 6555): the addresses of the
+// other address family are dialed in parallel if the first address family doesn't connect
+// within the fallback delay.
+type cachingDialer struct {
+	dialer        *net.Dialer
+	cache         *dnsCache
+	ttl           time.Duration
+	fallbackDelay time.Duration
+}
+
+func (d *cachingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	if d.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+		defer cancel()
+	}
+	addrs, err := d.cache.lookup(ctx, host, d.ttl)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	primaries, fallbacks := partitionAddrs(addrs)
+	conn, err := d.dialParallel(ctx, network, port, primaries, fallbacks)
+	if err != nil && ctx.Err() == nil {
+		// The host may have moved to other addresses.
+		d.cache.forget(host)
+	}
+	return conn, err
+}
+
+// dialParallel dials the primary addresses and, if they don't connect within the fallback delay,
+// the fallback addresses in parallel. It returns the first connection established.
+func (d *cachingDialer) dialParallel(ctx context.Context, network, port string, primaries, fallbacks []net.IPAddr) (net.Conn, error) {
+	if len(fallbacks) == 0 || d.fallbackDelay < 0 {
+		return d.dialSerial(ctx, network, port, append(primaries, fallbacks...))
+	}
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	dial := func(addrs []net.IPAddr, primary bool) {
+		conn, err := d.dialSerial(ctx, network, port, addrs)
+		results <- result{conn, err, primary}
+	}
+	go dial(primaries, true)
+	fallbackTimer := time.NewTimer(d.fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var firstErr error
+	pending, fallbackStarted := 1, false
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go dial(fallbacks, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close the connection of the other dial if it also succeeds.
+				if pending > 0 {
+					go func() {
+						if other := <-results; other.err == nil {
+							other.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil || res.primary {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				// Don't wait for the fallback delay once the primary addresses failed.
+				fallbackStarted = true
+				pending++
+				go dial(fallbacks, false)
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial dials addrs in order until one connects.
+func (d *cachingDialer) dialSerial(ctx context.Context, network, port string, addrs []net.IPAddr) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, firstErr
+}
+
+// partitionAddrs splits addrs into the addresses of the address family of the first
+// address, which are dialed first, and the addresses of the other address family.
+func partitionAddrs(addrs []net.IPAddr) (primaries, fallbacks []net.IPAddr) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	isIPv4 := addrs[0].IP.To4() != nil
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == isIPv4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
@@ -0,0 +1,137 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testResolver resolves every host to addrs and counts lookups.
+type testResolver struct {
+	addrs   []net.IPAddr
+	lookups int32
+}
+
+func (r *testResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return r.addrs, nil
+}
+
+func ipAddrs(ips ...string) []net.IPAddr {
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs
+}
+
+func TestDNSCache(t *testing.T) {
+	resolver := &testResolver{addrs: ipAddrs("127.0.0.1")}
+	now := time.Now()
+	cache := &dnsCache{resolver: resolver, now: func() time.Time { return now }}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.lookup(context.Background(), "registry.example.com", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&resolver.lookups); got != 1 {
+		t.Fatalf("unexpected lookups within the TTL; expected = 1, got = %d", got)
+	}
+	now = now.Add(time.Minute)
+	if _, err := cache.lookup(context.Background(), "registry.example.com", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&resolver.lookups); got != 2 {
+		t.Fatalf("unexpected lookups after the TTL; expected = 2, got = %d", got)
+	}
+	cache.forget("registry.example.com")
+	if _, err := cache.lookup(context.Background(), "registry.example.com", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&resolver.lookups); got != 3 {
+		t.Fatalf("unexpected lookups after forgetting the host; expected = 3, got = %d", got)
+	}
+}
+
+func TestCachingDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The IPv6 address is dialed first, and either can't be dialed or refuses the connection,
+	// so the connection is made to the IPv4 address.
+	resolver := &testResolver{addrs: ipAddrs("::1", "127.0.0.1")}
+	d := &cachingDialer{
+		dialer:        &net.Dialer{Timeout: 5 * time.Second},
+		cache:         &dnsCache{resolver: resolver, now: time.Now},
+		ttl:           time.Minute,
+		fallbackDelay: 10 * time.Second,
+	}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("registry.example.com", port))
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		if remote := conn.RemoteAddr().String(); remote != l.Addr().String() {
+			t.Fatalf("unexpected remote address %s", remote)
+		}
+		conn.Close()
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("fallback addresses weren't dialed once the primary addresses failed: %v", elapsed)
+		}
+	}
+	if got := atomic.LoadInt32(&resolver.lookups); got != 1 {
+		t.Fatalf("unexpected lookups; expected = 1, got = %d", got)
+	}
+
+	// Addresses which can't be dialed are resolved again.
+	l.Close()
+	if _, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("registry.example.com", port)); err == nil {
+		t.Fatal("expected dial to fail")
+	}
+	if _, ok := d.cache.entries.Load("registry.example.com"); ok {
+		t.Fatal("addresses which can't be dialed are still cached")
+	}
+}
+
+func TestPartitionAddrs(t *testing.T) {
+	primaries, fallbacks := partitionAddrs(ipAddrs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"))
+	if len(primaries) != 2 || primaries[0].IP.To4() != nil || primaries[1].IP.To4() != nil {
+		t.Fatalf("unexpected primary addresses: %v", primaries)
+	}
+	if len(fallbacks) != 2 || fallbacks[0].IP.To4() == nil || fallbacks[1].IP.To4() == nil {
+		t.Fatalf("unexpected fallback addresses: %v", fallbacks)
+	}
+}
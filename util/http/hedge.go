@@ -0,0 +1,192 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// hedgeLatencyWindow is the number of recent response latencies of a host the hedge delay is computed from.
+	hedgeLatencyWindow = 200
+	// hedgeMinSamples is the number of response latencies of a host needed before the hedge delay
+	// follows their percentile. Until then, the hedge delay is `HedgingConfig.MaxDelay`.
+	hedgeMinSamples = 20
+
+	hedgePrimary = "primary"
+	hedgeHedge   = "hedge"
+)
+
+// hedgeLatencies holds the recent response latencies of all hosts. They are shared by all clients,
+// like the circuit breakers, so that the delay of a host doesn't start over for every image reference.
+var hedgeLatencies sync.Map // host -> *latencyWindow
+
+// latencyWindow is a ring buffer of the most recent response latencies of a host.
+type latencyWindow struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.latencies) < hedgeLatencyWindow {
+		w.latencies = append(w.latencies, d)
+		return
+	}
+	w.latencies[w.next] = d
+	w.next = (w.next + 1) % hedgeLatencyWindow
+}
+
+// percentile returns the p-th percentile of the latencies in the window and whether
+// there are enough latencies for it to be meaningful.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if len(w.latencies) < hedgeMinSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	latencies := append([]time.Duration(nil), w.latencies...)
+	w.mu.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	i := int(p / 100 * float64(len(latencies)))
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i], true
+}
+
+// hedgingTransport is an http.RoundTripper which sends a second, parallel attempt of a ranged GET,
+// e.g. a span fetch, if the first attempt didn't return response headers within the hedge delay.
+// Whichever attempt returns response headers first is used and the other one is canceled.
+//
+// The hedge delay is the `Percentile`-th percentile of the recent response latencies of the host,
+// so that only the slowest requests are hedged.
+type hedgingTransport struct {
+	config HedgingConfig
+	next   http.RoundTripper
+}
+
+// hedgeResult is the outcome of one of the attempts of a hedged request.
+type hedgeResult struct {
+	resp  *http.Response
+	err   error
+	hedge bool
+}
+
+func (t *hedgingTransport) latencies(host string) *latencyWindow {
+	w, _ := hedgeLatencies.LoadOrStore(host, &latencyWindow{})
+	return w.(*latencyWindow)
+}
+
+// delay returns how long to wait for response headers before hedging a request to host.
+func (t *hedgingTransport) delay(host string) time.Duration {
+	d, ok := t.latencies(host).percentile(t.config.Percentile)
+	if !ok || d > t.config.MaxDelay {
+		return t.config.MaxDelay
+	}
+	if d < t.config.MinDelay {
+		return t.config.MinDelay
+	}
+	return d
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only idempotent requests without a body can be sent twice.
+	if req.Method != http.MethodGet || req.Header.Get("Range") == "" || (req.Body != nil && req.Body != http.NoBody) {
+		return t.next.RoundTrip(req)
+	}
+	host := req.URL.Host
+	results := make(chan hedgeResult, 2)
+	send := func(ctx context.Context, hedge bool) {
+		start := time.Now()
+		resp, err := t.next.RoundTrip(req.Clone(ctx))
+		if err == nil {
+			t.latencies(host).add(time.Since(start))
+		}
+		results <- hedgeResult{resp: resp, err: err, hedge: hedge}
+	}
+
+	// cancels[false] cancels the first attempt and cancels[true] the hedged attempt.
+	cancels := make(map[bool]context.CancelFunc, 2)
+	ctx, cancel := context.WithCancel(req.Context())
+	cancels[false] = cancel
+	go send(ctx, false)
+	pending := 1
+
+	timer := time.NewTimer(t.delay(host))
+	defer timer.Stop()
+	var res hedgeResult
+	select {
+	case res = <-results:
+		pending--
+	case <-timer.C:
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[true] = cancel
+		go send(ctx, true)
+		pending++
+		res = <-results
+		pending--
+		if res.err != nil {
+			// The other attempt may still succeed.
+			cancels[res.hedge]()
+			res = <-results
+			pending--
+		}
+	}
+	if pending > 0 {
+		// Cancel the attempt which lost the race and release its response, if any.
+		cancels[!res.hedge]()
+		go func() {
+			if loser := <-results; loser.resp != nil {
+				loser.resp.Body.Close()
+			}
+		}()
+	}
+	if res.err != nil {
+		cancels[res.hedge]()
+		return nil, res.err
+	}
+	if len(cancels) > 1 {
+		winner := hedgePrimary
+		if res.hedge {
+			winner = hedgeHedge
+		}
+		hedgedRequestCount.WithLabelValues(host, winner).Inc()
+	}
+	// The winning attempt must not be canceled before its body is read.
+	res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.hedge]}
+	return res.resp, nil
+}
+
+// cancelOnClose cancels the context of a response once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	var w latencyWindow
+	for i := 1; i < hedgeMinSamples; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := w.percentile(50); ok {
+		t.Fatal("percentile is known before there are enough latencies")
+	}
+	for i := hedgeMinSamples; i <= 2*hedgeLatencyWindow; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	// Only the most recent latencies are kept.
+	if d, ok := w.percentile(0); !ok || d != (hedgeLatencyWindow+1)*time.Millisecond {
+		t.Fatalf("unexpected minimum latency: %v", d)
+	}
+	if d, _ := w.percentile(100); d != 2*hedgeLatencyWindow*time.Millisecond {
+		t.Fatalf("unexpected maximum latency: %v", d)
+	}
+	if d, _ := w.percentile(50); d != (hedgeLatencyWindow+hedgeLatencyWindow/2+1)*time.Millisecond {
+		t.Fatalf("unexpected median latency: %v", d)
+	}
+}
+
+func TestHedgedRequests(t *testing.T) {
+	var requests int32
+	canceled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// The first attempt is stuck until the hedged attempt wins.
+			<-r.Context().Done()
+			close(canceled)
+			return
+		}
+		w.Write([]byte("hedged"))
+	}))
+	defer server.Close()
+
+	config := NewRetryableClientConfig()
+	config.MaxRetries = 0
+	config.FailureThreshold = 0
+	config.Percentile = 95
+	config.HedgingConfig.MaxDelay = 50 * time.Millisecond
+	client := NewRetryableClient(config)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-5")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "hedged" {
+		t.Fatalf("unexpected response: %q, %v", body, err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow attempt was not canceled")
+	}
+
+	// Requests which aren't ranged GETs are not hedged.
+	atomic.StoreInt32(&requests, 0)
+	canceled = make(chan struct{})
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("unexpected number of attempts of request which is not ranged: %d", n)
+	}
+	server.CloseClientConnections()
+	<-done
+}
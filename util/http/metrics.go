@@ -0,0 +1,281 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// RetryCountKey is the key for the metric counting retries of requests.
+	RetryCountKey = "retry_count"
+	// RetriesExhaustedCountKey is the key for the metric counting requests which failed after their last retry.
+	RetriesExhaustedCountKey = "retries_exhausted_count"
+	// RetryBackoffKeyMilliseconds is the key for the metric counting the time spent backing off before retries.
+	RetryBackoffKeyMilliseconds = "retry_backoff_milliseconds"
+
+	// HedgedRequestCountKey is the key for the metric counting hedged requests.
+	HedgedRequestCountKey = "hedged_request_count"
+
+	// TimeToFirstByteKeyMilliseconds is the key for the metric of the time registries take to respond.
+	TimeToFirstByteKeyMilliseconds = "time_to_first_byte_milliseconds"
+	// ThroughputKeyBytesPerSecond is the key for the metric of the throughput of response bodies of registries.
+	ThroughputKeyBytesPerSecond = "throughput_bytes_per_second"
+
+	// RangeIgnoredCountKey is the key for the metric counting ranged requests answered with the whole content.
+	RangeIgnoredCountKey = "range_ignored_count"
+
+	metricsNamespace = "soci"
+	metricsSubsystem = "http"
+
+	// statusError is the status code label of attempts which failed without a response.
+	statusError = "error"
+
+	// minThroughputBytes is the size of the smallest response bodies whose throughput is measured,
+	// since the throughput of small bodies, e.g. of tokens and manifests, is dominated by latency.
+	minThroughputBytes = 64 << 10
+)
+
+var (
+	// retryCount counts retries by host and by the status code of the attempt which was retried.
+	retryCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      RetryCountKey,
+			Help:      "The count of retried requests to registries. Broken down by host and status code of the retried attempt.",
+		},
+		[]string{"host", "status_code"},
+	)
+
+	// retriesExhaustedCount counts requests which still failed after their last retry,
+	// by host and by the status code of the last attempt.
+	retriesExhaustedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      RetriesExhaustedCountKey,
+			Help:      "The count of requests to registries which failed after exhausting their retries. Broken down by host and status code of the last attempt.",
+		},
+		[]string{"host", "status_code"},
+	)
+
+	// retryBackoffMilliseconds counts the time spent backing off before retries by host.
+	retryBackoffMilliseconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      RetryBackoffKeyMilliseconds,
+			Help:      "The time in milliseconds spent backing off before retrying requests to registries. Broken down by host.",
+		},
+		[]string{"host"},
+	)
+
+	// hedgedRequestCount counts hedged requests by host and by the attempt which won, "primary" or "hedge".
+	hedgedRequestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      HedgedRequestCountKey,
+			Help:      "The count of requests to registries for which a second attempt was sent because the first one was slow. Broken down by host and by the attempt which returned first.",
+		},
+		[]string{"host", "winner"},
+	)
+
+	// timeToFirstByteMilliseconds measures the time from sending each attempt of a request
+	// until the response headers are received, by host.
+	timeToFirstByteMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      TimeToFirstByteKeyMilliseconds,
+			Help:      "The time in milliseconds registries take to respond to requests, until the response headers are received. Broken down by host.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 16), // 1ms to ~33s
+		},
+		[]string{"host"},
+	)
+
+	// throughputBytesPerSecond measures the rate at which successful response bodies of at least
+	// minThroughputBytes are received, by host.
+	throughputBytesPerSecond = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      ThroughputKeyBytesPerSecond,
+			Help:      "The throughput in bytes per second of response bodies of registries, from the response headers until the end of the body. Broken down by host.",
+			Buckets:   prometheus.ExponentialBuckets(64<<10, 2, 14), // 64KiB/s to 512MiB/s
+		},
+		[]string{"host"},
+	)
+
+	// rangeIgnoredCount counts the ranged requests which hosts answered with the whole content, by host.
+	rangeIgnoredCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      RangeIgnoredCountKey,
+			Help:      "The count of requests for a range of a blob which registries answered with the whole blob. Broken down by host.",
+		},
+		[]string{"host"},
+	)
+)
+
+var registerMetrics sync.Once
+
+// RegisterMetrics registers the retry, hedging, latency, throughput and range metrics of the retryable clients.
+// This is always called only once.
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		prometheus.MustRegister(retryCount)
+		prometheus.MustRegister(retriesExhaustedCount)
+		prometheus.MustRegister(retryBackoffMilliseconds)
+		prometheus.MustRegister(hedgedRequestCount)
+		prometheus.MustRegister(timeToFirstByteMilliseconds)
+		prometheus.MustRegister(throughputBytesPerSecond)
+		prometheus.MustRegister(rangeIgnoredCount)
+	})
+}
+
+type retryStateKey struct{}
+
+// retryState follows the attempts of a request through the retry loop, which only
+// reports them through RetryStrategy and the request hook.
+type retryState struct {
+	host string
+
+	// status is the status code of the last attempt which RetryStrategy decided to retry,
+	// and retryAt when it did. status is empty if the last attempt was not to be retried.
+	status  string
+	retryAt time.Time
+}
+
+// retried records that RetryStrategy decided to retry an attempt which ended with resp.
+func (s *retryState) retried(resp *http.Response) {
+	s.status = statusError
+	if resp != nil {
+		s.status = strconv.Itoa(resp.StatusCode)
+	}
+	s.retryAt = time.Now()
+}
+
+// attempting records that an attempt is starting. If it's a retry, the retry and the time
+// spent backing off since the previous attempt are counted.
+func (s *retryState) attempting() {
+	if s.status == "" {
+		return
+	}
+	retryCount.WithLabelValues(s.host, s.status).Inc()
+	retryBackoffMilliseconds.WithLabelValues(s.host).Add(float64(time.Since(s.retryAt)) / float64(time.Millisecond))
+	s.status = ""
+}
+
+func retryStateFrom(ctx context.Context) *retryState {
+	s, _ := ctx.Value(retryStateKey{}).(*retryState)
+	return s
+}
+
+// retryMetricsTransport is an http.RoundTripper which sits above the retry loop
+// and counts the retries of each request.
+type retryMetricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *retryMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := &retryState{host: req.URL.Host}
+	req = req.Clone(context.WithValue(req.Context(), retryStateKey{}, s))
+	resp, err := t.next.RoundTrip(req)
+	// The retry loop gave up on an attempt RetryStrategy wanted to retry,
+	// unless the request was cancelled while backing off.
+	if s.status != "" && req.Context().Err() == nil {
+		retriesExhaustedCount.WithLabelValues(s.host, s.status).Inc()
+	}
+	return resp, err
+}
+
+// onAttempt is the request hook of the retry loop, which is called before each attempt.
+func onAttempt(req *http.Request) {
+	if s := retryStateFrom(req.Context()); s != nil {
+		s.attempting()
+	}
+}
+
+// latencyMetricsTransport is an http.RoundTripper which measures the time to first byte of
+// every attempt and the throughput of its response body, so that the registries and mirrors
+// responsible for slow reads can be told apart.
+type latencyMetricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *latencyMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	firstByte := time.Now()
+	host := req.URL.Host
+	timeToFirstByteMilliseconds.WithLabelValues(host).Observe(float64(firstByte.Sub(start)) / float64(time.Millisecond))
+	if resp.StatusCode/100 == 2 && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &throughputBody{ReadCloser: resp.Body, host: host, start: firstByte, length: resp.ContentLength}
+	}
+	return resp, nil
+}
+
+// throughputBody measures the throughput of a response body once it's read to the end, i.e.
+// its Content-Length is read or it returns io.EOF, or else once it's closed, since readers of
+// ranges, e.g. with io.CopyN, stop reading bodies at their last byte rather than at io.EOF.
+type throughputBody struct {
+	io.ReadCloser
+	host   string
+	start  time.Time
+	length int64 // the Content-Length of the body, or -1 if it's unknown
+	n      int64
+	done   bool
+}
+
+func (b *throughputBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF || (b.length >= 0 && b.n >= b.length) {
+		b.observe()
+	}
+	return n, err
+}
+
+func (b *throughputBody) Close() error {
+	b.observe()
+	return b.ReadCloser.Close()
+}
+
+// observe records the throughput of the body the first time it's called.
+func (b *throughputBody) observe() {
+	if b.done {
+		return
+	}
+	b.done = true
+	elapsed := time.Since(b.start)
+	if b.n >= minThroughputBytes && elapsed > 0 {
+		throughputBytesPerSecond.WithLabelValues(b.host).Observe(float64(b.n) / elapsed.Seconds())
+	}
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryMetrics(t *testing.T) {
+	// The server fails the first 2 requests to each path.
+	var attempts [2]int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := 0
+		if r.URL.Path == "/exhausted" {
+			i = 1
+		}
+		if atomic.AddInt32(&attempts[i], 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := u.Host
+
+	config := NewRetryableClientConfig()
+	config.MinWait = 10 * time.Millisecond
+	config.MaxWait = 10 * time.Millisecond
+	config.FailureThreshold = 0
+	client := NewRetryableClient(config)
+	resp, err := client.Get(server.URL + "/retried")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := testutil.ToFloat64(retryCount.WithLabelValues(host, "503")); got != 2 {
+		t.Fatalf("unexpected retry count; expected = 2, got = %v", got)
+	}
+	if got := testutil.ToFloat64(retriesExhaustedCount.WithLabelValues(host, "503")); got != 0 {
+		t.Fatalf("unexpected exhausted retries count; expected = 0, got = %v", got)
+	}
+	if got := testutil.ToFloat64(retryBackoffMilliseconds.WithLabelValues(host)); got < 20 {
+		t.Fatalf("unexpected backoff time; expected >= 20ms, got = %vms", got)
+	}
+
+	config.MaxRetries = 1
+	client = NewRetryableClient(config)
+	if resp, err := client.Get(server.URL + "/exhausted"); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the request to fail after exhausting its retries")
+	}
+	if got := testutil.ToFloat64(retryCount.WithLabelValues(host, "503")); got != 3 {
+		t.Fatalf("unexpected retry count; expected = 3, got = %v", got)
+	}
+	if got := testutil.ToFloat64(retriesExhaustedCount.WithLabelValues(host, "503")); got != 1 {
+		t.Fatalf("unexpected exhausted retries count; expected = 1, got = %v", got)
+	}
+}
+
+// histogramCount returns the number of observations of the histogram of `vec` for `host`.
+func histogramCount(t *testing.T, vec *prometheus.HistogramVec, host string) uint64 {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(vec)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "host" && l.GetValue() == host {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), minThroughputBytes)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Write(large)
+		case "/small":
+			w.Write([]byte("small"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := u.Host
+
+	client := NewRetryableClient(NewRetryableClientConfig())
+	get := func(path string, read bool) {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read {
+			io.Copy(io.Discard, resp.Body)
+		}
+		resp.Body.Close()
+	}
+
+	get("/large", true)
+	if got := histogramCount(t, timeToFirstByteMilliseconds, host); got != 1 {
+		t.Fatalf("unexpected time to first byte count; expected = 1, got = %v", got)
+	}
+	if got := histogramCount(t, throughputBytesPerSecond, host); got != 1 {
+		t.Fatalf("unexpected throughput count; expected = 1, got = %v", got)
+	}
+
+	// Small bodies, including bodies closed before much of them is read, and unsuccessful
+	// responses are only counted in the time to first byte.
+	get("/small", true)
+	get("/large", false)
+	get("/missing", true)
+	if got := histogramCount(t, timeToFirstByteMilliseconds, host); got != 4 {
+		t.Fatalf("unexpected time to first byte count; expected = 4, got = %v", got)
+	}
+	if got := histogramCount(t, throughputBytesPerSecond, host); got != 1 {
+		t.Fatalf("unexpected throughput count; expected = 1, got = %v", got)
+	}
+
+	// Bodies read up to their length are counted, although they're never read to io.EOF.
+	resp, err := client.Get(server.URL + "/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, int64(len(large))); err != nil {
+		t.Fatal(err)
+	}
+	if got := histogramCount(t, throughputBytesPerSecond, host); got != 2 {
+		t.Fatalf("unexpected throughput count; expected = 2, got = %v", got)
+	}
+	resp.Body.Close()
+	if got := histogramCount(t, throughputBytesPerSecond, host); got != 2 {
+		t.Fatalf("unexpected throughput count after close; expected = 2, got = %v", got)
+	}
+}
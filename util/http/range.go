@@ -0,0 +1,60 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+)
+
+// ignoredRangeHosts holds the hosts which answered ranged requests with the whole content.
+// It is shared by all clients, like the circuit breakers, since it's a property of the host.
+var ignoredRangeHosts sync.Map // host -> struct{}
+
+// IgnoresRange returns whether `host` answered a request for a range of a content with the whole
+// content, e.g. a registry or a proxy in front of it which doesn't support Range headers.
+func IgnoresRange(host string) bool {
+	_, ok := ignoredRangeHosts.Load(host)
+	return ok
+}
+
+// ignoredRangeTransport is an http.RoundTripper which detects the hosts which answer GETs of a range
+// with 200 and the whole content instead of 206 and the range. Lazily loading a layer from such a
+// host downloads the whole layer for every read, so every such response is counted and a warning
+// is logged the first time for each host.
+type ignoredRangeTransport struct {
+	next http.RoundTripper
+}
+
+func (t *ignoredRangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	if size := rangeSize(req.Header.Get("Range")); size > 0 && resp.ContentLength > size {
+		host := req.URL.Host
+		rangeIgnoredCount.WithLabelValues(host).Inc()
+		if _, loaded := ignoredRangeHosts.LoadOrStore(host, struct{}{}); !loaded {
+			log.G(req.Context()).WithField("host", host).Warn("host ignores Range headers and returns whole blobs: " +
+				"every lazily loaded read from it downloads the whole layer; " +
+				"configure a registry or proxy which supports Range headers, or enable full_fetch_on_ignored_range")
+		}
+	}
+	return resp, nil
+}
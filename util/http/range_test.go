@@ -0,0 +1,76 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIgnoredRangeDetection(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 100)
+	serve := func(ignoreRange bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ignoreRange {
+				w.Write(contents)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+		}))
+	}
+	config := NewRetryableClientConfig()
+	config.MaxRetries = 0
+	client := NewRetryableClient(config)
+	get := func(url, r string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", r)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	supported := serve(false)
+	defer supported.Close()
+	get(supported.URL, "bytes=0-9")
+	if IgnoresRange(strings.TrimPrefix(supported.URL, "http://")) {
+		t.Fatal("host which supports Range headers detected to ignore them")
+	}
+
+	ignored := serve(true)
+	defer ignored.Close()
+	host := strings.TrimPrefix(ignored.URL, "http://")
+	// The whole content is expected for a range covering it.
+	get(ignored.URL, "bytes=0-999")
+	if IgnoresRange(host) {
+		t.Fatal("host detected to ignore Range headers for a request of the whole content")
+	}
+	get(ignored.URL, "bytes=0-9")
+	if !IgnoresRange(host) {
+		t.Fatal("host which ignores Range headers not detected")
+	}
+}
@@ -18,6 +18,8 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"math/rand"
 	"net"
 	"net/http"
@@ -26,6 +28,7 @@ import (
 	"github.com/containerd/containerd/log"
 	rhttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -44,6 +47,25 @@ const (
 	DefaultMinWaitMsec = 30
 	// DefaultMaxWaitMsec is the default maxmimum number of millisends between attempts. See `RetryConfig.MaxWait`.
 	DefaultMaxWaitMsec = 300_000
+
+	// DefaultCircuitBreakerFailureThreshold is the default number of consecutive failed attempts to a host
+	// before its circuit breaker opens. See `CircuitBreakerConfig.FailureThreshold`.
+	DefaultCircuitBreakerFailureThreshold = 20
+	// DefaultCircuitBreakerCooldownMsec is the default number of milliseconds a circuit breaker stays open.
+	// See `CircuitBreakerConfig.Cooldown`.
+	DefaultCircuitBreakerCooldownMsec = 10_000
+
+	// DefaultHedgeMinDelayMsec is the default minimum number of milliseconds before a request is hedged. See `HedgingConfig.MinDelay`.
+	DefaultHedgeMinDelayMsec = 10
+	// DefaultHedgeMaxDelayMsec is the default maximum number of milliseconds before a request is hedged. See `HedgingConfig.MaxDelay`.
+	DefaultHedgeMaxDelayMsec = 1000
+
+	// http2ReadIdleTimeout is how long an HTTP/2 connection may be idle before a health check ping
+	// is sent, so that a dead connection doesn't fail all the requests multiplexed over it until they time out.
+	http2ReadIdleTimeout = 15 * time.Second
+
+	// DefaultTraceHeader is the default name of the header carrying the trace ID of a request. See `TraceConfig.Header`.
+	DefaultTraceHeader = "X-Request-Id"
 )
 
 // RetryConfig represents the settings for retries in a retryable http client.
@@ -70,12 +92,94 @@ type TimeoutConfig struct {
 	// RequestTimeout is the maximum duration before the entire request attempt is timed out. This starts when the
 	// client starts the connection attempt and ends when the entire response body is read.
 	RequestTimeout time.Duration
+	// RequestTimeoutPerMB scales the request timeout with the size of the payload of a request:
+	// each attempt may take RequestTimeout plus RequestTimeoutPerMB for each MiB of the requested
+	// range, or of the response body if it is larger, so that large span fetches over slow links
+	// aren't timed out while small reads can use a short RequestTimeout. Zero disables the scaling.
+	// It has no effect if RequestTimeout is zero.
+	RequestTimeoutPerMB time.Duration
+}
+
+// CircuitBreakerConfig represents the settings for the per-host circuit breaker in a retryable http client.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed attempts to a host after which requests to the host
+	// fail fast with ErrCircuitOpen instead of being sent (and retried). Zero disables the circuit breaker.
+	FailureThreshold int
+	// Cooldown is how long requests fail fast once the circuit is open. After the cooldown,
+	// a single trial request is sent to decide whether to close the circuit.
+	Cooldown time.Duration
+}
+
+// TraceConfig represents the settings for correlating requests of a retryable http client with registry-side logs.
+type TraceConfig struct {
+	// Header is the name of the header carrying a unique trace ID that is attached to every request
+	// and logged with its failures. Retries of a request use the same trace ID. Empty disables trace IDs.
+	Header string
+}
+
+// ConnectionConfig represents the settings for the connection pool of a retryable http client.
+// Zero values leave the defaults of the transport (see cleanhttp.DefaultPooledTransport).
+type ConnectionConfig struct {
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept per host. Raising it
+	// avoids closing and reopening connections when many spans are fetched concurrently.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the number of connections per host, including connections in use.
+	// Requests wait for a connection once the limit is reached. Zero means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept before it is closed.
+	IdleConnTimeout time.Duration
+	// ForceHTTP2 configures HTTP/2 explicitly instead of relying on the automatic upgrade of the
+	// transport, and sends health check pings over idle HTTP/2 connections, so that a dead connection
+	// doesn't stall all the span fetches multiplexed over it until they time out.
+	// Hosts which don't support HTTP/2 are still served over HTTP/1.1.
+	ForceHTTP2 bool
+}
+
+// DialConfig represents the settings for resolving and dialing the hosts of a retryable http client.
+type DialConfig struct {
+	// DNSCacheTTL is how long the resolved addresses of a host are cached, so that connections
+	// to a registry aren't held back by slow DNS lookups. The cache is shared by all clients,
+	// and cached addresses are dropped once none of them can be dialed. Zero disables the cache.
+	DNSCacheTTL time.Duration
+	// FallbackDelay is how long the addresses of the first address family of a dual-stack
+	// host are dialed before the addresses of the other family are dialed in parallel
+	// ("happy eyeballs", RFC 6555). Zero means DefaultFallbackDelayMsec. A negative value
+	// disables the parallel dials: the addresses are dialed one after another.
+	FallbackDelay time.Duration
+}
+
+// HedgingConfig represents the settings for hedging the ranged GETs (e.g. span fetches) of a retryable
+// http client: if an attempt hasn't returned response headers within the hedge delay, a second attempt
+// is sent in parallel and whichever returns response headers first is used.
+type HedgingConfig struct {
+	// Percentile is the percentile of the recent response latencies of a host which is used as the
+	// hedge delay, e.g. 95 to hedge the slowest 5% of the requests. Zero disables hedging.
+	Percentile float64
+	// MinDelay is the minimum hedge delay, so that fast hosts don't get twice the requests
+	// because of small variations in latency.
+	MinDelay time.Duration
+	// MaxDelay is the maximum hedge delay. It is also the hedge delay until enough latencies
+	// of a host are known.
+	MaxDelay time.Duration
 }
 
 // RetryableClientConfig is the complete config for a retryable http client
 type RetryableClientConfig struct {
 	TimeoutConfig
 	RetryConfig
+	CircuitBreakerConfig
+	TraceConfig
+	ConnectionConfig
+	HedgingConfig
+	DialConfig
+
+	// TLSClientConfig is the TLS configuration of the connections, e.g. with the CAs of a
+	// self-hosted registry or a client certificate. Nil means the default configuration.
+	TLSClientConfig *tls.Config
+
+	// Signer signs every attempt of the requests, e.g. with AWS SigV4 for registries backed by
+	// an object store. Nil means requests are not signed.
+	Signer Signer
 }
 
 // NewRetryableClientConfig creates a new config with default values.
@@ -93,9 +197,139 @@ func NewRetryableClientConfig() RetryableClientConfig {
 			MinWait:    DefaultMinWaitMsec * time.Millisecond,
 			MaxWait:    DefaultMaxWaitMsec * time.Millisecond,
 		},
+		CircuitBreakerConfig{
+			FailureThreshold: DefaultCircuitBreakerFailureThreshold,
+			Cooldown:         DefaultCircuitBreakerCooldownMsec * time.Millisecond,
+		},
+		TraceConfig{
+			Header: DefaultTraceHeader,
+		},
+		ConnectionConfig{},
+		HedgingConfig{
+			MinDelay: DefaultHedgeMinDelayMsec * time.Millisecond,
+			MaxDelay: DefaultHedgeMaxDelayMsec * time.Millisecond,
+		},
+		DialConfig{},
+		nil,
+		nil,
 	}
 }
 
+// RetryableClientConfigOverride is a partial RetryableClientConfig that can be specified in a config file,
+// e.g. per registry host. Zero values leave the corresponding setting of the base config unchanged.
+type RetryableClientConfigOverride struct {
+	// MaxRetries overrides `RetryConfig.MaxRetries`. A negative value disables retries.
+	MaxRetries int `toml:"max_retries"`
+	// MinWaitMsec overrides `RetryConfig.MinWait`.
+	MinWaitMsec int64 `toml:"min_wait_msec"`
+	// MaxWaitMsec overrides `RetryConfig.MaxWait`.
+	MaxWaitMsec int64 `toml:"max_wait_msec"`
+	// DialTimeoutMsec overrides `TimeoutConfig.DialTimeout`.
+	DialTimeoutMsec int64 `toml:"dial_timeout_msec"`
+	// ResponseHeaderTimeoutMsec overrides `TimeoutConfig.ResponseHeaderTimeout`.
+	ResponseHeaderTimeoutMsec int64 `toml:"response_header_timeout_msec"`
+	// RequestTimeoutMsec overrides `TimeoutConfig.RequestTimeout`. A negative value disables the timeout.
+	RequestTimeoutMsec int64 `toml:"request_timeout_msec"`
+	// RequestTimeoutPerMBMsec overrides `TimeoutConfig.RequestTimeoutPerMB`. A negative value disables
+	// the scaling of the timeout.
+	RequestTimeoutPerMBMsec int64 `toml:"request_timeout_per_mb_msec"`
+	// CircuitBreakerFailureThreshold overrides `CircuitBreakerConfig.FailureThreshold`.
+	// A negative value disables the circuit breaker.
+	CircuitBreakerFailureThreshold int `toml:"circuit_breaker_failure_threshold"`
+	// CircuitBreakerCooldownMsec overrides `CircuitBreakerConfig.Cooldown`.
+	CircuitBreakerCooldownMsec int64 `toml:"circuit_breaker_cooldown_msec"`
+	// MaxIdleConnsPerHost overrides `ConnectionConfig.MaxIdleConnsPerHost`.
+	MaxIdleConnsPerHost int `toml:"max_idle_conns_per_host"`
+	// MaxConnsPerHost overrides `ConnectionConfig.MaxConnsPerHost`.
+	MaxConnsPerHost int `toml:"max_conns_per_host"`
+	// IdleConnTimeoutMsec overrides `ConnectionConfig.IdleConnTimeout`.
+	IdleConnTimeoutMsec int64 `toml:"idle_conn_timeout_msec"`
+	// ForceHTTP2 overrides `ConnectionConfig.ForceHTTP2`.
+	ForceHTTP2 bool `toml:"force_http2"`
+	// HedgePercentile overrides `HedgingConfig.Percentile`. A negative value disables hedging.
+	HedgePercentile float64 `toml:"hedge_percentile"`
+	// HedgeMinDelayMsec overrides `HedgingConfig.MinDelay`.
+	HedgeMinDelayMsec int64 `toml:"hedge_min_delay_msec"`
+	// HedgeMaxDelayMsec overrides `HedgingConfig.MaxDelay`.
+	HedgeMaxDelayMsec int64 `toml:"hedge_max_delay_msec"`
+	// DNSCacheTTLMsec overrides `DialConfig.DNSCacheTTL`. A negative value disables the cache.
+	DNSCacheTTLMsec int64 `toml:"dns_cache_ttl_msec"`
+	// FallbackDelayMsec overrides `DialConfig.FallbackDelay`. A negative value disables
+	// dialing the addresses of both address families in parallel.
+	FallbackDelayMsec int64 `toml:"fallback_delay_msec"`
+}
+
+// Apply returns config with the settings specified in the override applied on top of it.
+func (o RetryableClientConfigOverride) Apply(config RetryableClientConfig) RetryableClientConfig {
+	if o.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if o.MaxRetries > 0 {
+		config.MaxRetries = o.MaxRetries
+	}
+	if o.MinWaitMsec > 0 {
+		config.MinWait = time.Duration(o.MinWaitMsec) * time.Millisecond
+	}
+	if o.MaxWaitMsec > 0 {
+		config.MaxWait = time.Duration(o.MaxWaitMsec) * time.Millisecond
+	}
+	if o.DialTimeoutMsec > 0 {
+		config.DialTimeout = time.Duration(o.DialTimeoutMsec) * time.Millisecond
+	}
+	if o.ResponseHeaderTimeoutMsec > 0 {
+		config.ResponseHeaderTimeout = time.Duration(o.ResponseHeaderTimeoutMsec) * time.Millisecond
+	}
+	if o.RequestTimeoutMsec < 0 {
+		config.RequestTimeout = 0
+	} else if o.RequestTimeoutMsec > 0 {
+		config.RequestTimeout = time.Duration(o.RequestTimeoutMsec) * time.Millisecond
+	}
+	if o.RequestTimeoutPerMBMsec < 0 {
+		config.RequestTimeoutPerMB = 0
+	} else if o.RequestTimeoutPerMBMsec > 0 {
+		config.RequestTimeoutPerMB = time.Duration(o.RequestTimeoutPerMBMsec) * time.Millisecond
+	}
+	if o.CircuitBreakerFailureThreshold < 0 {
+		config.FailureThreshold = 0
+	} else if o.CircuitBreakerFailureThreshold > 0 {
+		config.FailureThreshold = o.CircuitBreakerFailureThreshold
+	}
+	if o.CircuitBreakerCooldownMsec > 0 {
+		config.Cooldown = time.Duration(o.CircuitBreakerCooldownMsec) * time.Millisecond
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		config.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost > 0 {
+		config.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.IdleConnTimeoutMsec > 0 {
+		config.IdleConnTimeout = time.Duration(o.IdleConnTimeoutMsec) * time.Millisecond
+	}
+	if o.ForceHTTP2 {
+		config.ForceHTTP2 = true
+	}
+	if o.HedgePercentile < 0 {
+		config.Percentile = 0
+	} else if o.HedgePercentile > 0 {
+		config.Percentile = o.HedgePercentile
+	}
+	if o.HedgeMinDelayMsec > 0 {
+		config.HedgingConfig.MinDelay = time.Duration(o.HedgeMinDelayMsec) * time.Millisecond
+	}
+	if o.HedgeMaxDelayMsec > 0 {
+		config.HedgingConfig.MaxDelay = time.Duration(o.HedgeMaxDelayMsec) * time.Millisecond
+	}
+	if o.DNSCacheTTLMsec < 0 {
+		config.DNSCacheTTL = 0
+	} else if o.DNSCacheTTLMsec > 0 {
+		config.DNSCacheTTL = time.Duration(o.DNSCacheTTLMsec) * time.Millisecond
+	}
+	if o.FallbackDelayMsec != 0 {
+		config.FallbackDelay = time.Duration(o.FallbackDelayMsec) * time.Millisecond
+	}
+	return config
+}
+
 // NewRetryableClient creates a go http.Client which will automatically
 // retry on non-fatal errors
 func NewRetryableClient(config RetryableClientConfig) *http.Client {
@@ -109,44 +343,165 @@ func NewRetryableClient(config RetryableClientConfig) *http.Client {
 	rhttpClient.RetryWaitMax = config.MaxWait
 	rhttpClient.Backoff = BackoffStrategy
 	rhttpClient.CheckRetry = RetryStrategy
+	rhttpClient.RequestLogHook = func(_ rhttp.Logger, req *http.Request, _ int) {
+		onAttempt(req)
+	}
 	rhttpClient.HTTPClient.Timeout = config.RequestTimeout
 
 	// set timeouts
 	innerTransport := rhttpClient.HTTPClient.Transport
 	if t, ok := innerTransport.(*http.Transport); ok {
-		t.DialContext = (&net.Dialer{
-			Timeout: config.DialTimeout,
-		}).DialContext
+		t.DialContext = newDialContext(config.DialTimeout, config.DialConfig)
 		t.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+		if config.TLSClientConfig != nil {
+			t.TLSClientConfig = config.TLSClientConfig
+		}
+		configureConnections(t, config.ConnectionConfig)
+	}
+	// Latency is measured right above the connection, so that it doesn't include
+	// signing, throttling or the backoff between retries.
+	innerTransport = &latencyMetricsTransport{next: innerTransport}
+	innerTransport = &ignoredRangeTransport{next: innerTransport}
+
+	if config.Signer != nil {
+		innerTransport = &signingTransport{
+			signer: config.Signer,
+			next:   innerTransport,
+		}
+	}
+
+	// Rate limits signaled by a host hold back the attempts of all clients to that host.
+	transport := http.RoundTripper(&throttleTransport{
+		maxWait: config.MaxWait,
+		next:    innerTransport,
+		now:     time.Now,
+	})
+	// The circuit breaker sits below the retry loop so that each attempt is counted
+	// and retries of a request to a host with an open circuit fail fast.
+	if config.FailureThreshold > 0 {
+		transport = &circuitBreakerTransport{
+			config: config.CircuitBreakerConfig,
+			next:   transport,
+		}
+	}
+	// Hedging sits below the retry loop so that each attempt is hedged, and above the circuit
+	// breaker and the throttle so that both attempts of a hedged request go through them.
+	if config.Percentile > 0 {
+		transport = &hedgingTransport{
+			config: config.HedgingConfig,
+			next:   transport,
+		}
+	}
+	// The scaled timeout replaces the fixed timeout of each attempt, so it sits at the top of
+	// the attempt, above hedging, like the timeout of the client it replaces.
+	if config.RequestTimeout > 0 && config.RequestTimeoutPerMB > 0 {
+		rhttpClient.HTTPClient.Timeout = 0
+		transport = &requestTimeoutTransport{
+			config: config.TimeoutConfig,
+			next:   transport,
+		}
 	}
+	rhttpClient.HTTPClient.Transport = transport
 
-	return rhttpClient.StandardClient()
+	client := rhttpClient.StandardClient()
+	client.Transport = &retryMetricsTransport{next: client.Transport}
+	if config.TraceConfig.Header != "" {
+		client.Transport = &traceTransport{
+			header: config.TraceConfig.Header,
+			next:   client.Transport,
+		}
+	}
+	return client
+}
+
+// configureConnections applies config to the connection pool of t.
+func configureConnections(t *http.Transport, config ConnectionConfig) {
+	if config.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+		if t.MaxIdleConns > 0 && t.MaxIdleConns < config.MaxIdleConnsPerHost {
+			t.MaxIdleConns = config.MaxIdleConnsPerHost
+		}
+	}
+	if config.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = config.MaxConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.ForceHTTP2 {
+		// This only fails if t was configured for HTTP/2 already, and t is new.
+		if h2, err := http2.ConfigureTransports(t); err == nil {
+			h2.ReadIdleTimeout = http2ReadIdleTimeout
+		}
+	}
 }
 
 // Jitter returns a number in the range duration to duration+(duration/divisor)-1, inclusive
 func Jitter(duration time.Duration, divisor int64) time.Duration {
+	if int64(duration)/divisor <= 0 {
+		return duration
+	}
 	return time.Duration(rand.Int63n(int64(duration)/divisor) + int64(duration))
 }
 
 // BackoffStrategy extends retryablehttp's DefaultBackoff to add a random jitter to avoid
 // overwhelming the repository when it comes back online
 // DefaultBackoff either tries to parse the 'Retry-After' header of the response; or, it uses an
-// exponential backoff 2 ^ numAttempts, limited by max
+// exponential backoff 2 ^ numAttempts, limited by max. Unlike DefaultBackoff, a 'Retry-After'
+// longer than max is limited by max too; the shared host throttle holds the attempt back further if needed.
 func BackoffStrategy(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
 	delayTime := rhttp.DefaultBackoff(min, max, attemptNum, resp)
+	if delayTime > max {
+		delayTime = max
+	}
 	return Jitter(delayTime, 8)
 }
 
 // RetryStrategy extends retryablehttp's DefaultRetryPolicy to log the error and response when retrying
+// and to not retry requests rejected by an open circuit breaker or a rate limit outlasting the request,
+// nor requests whose retry budget (see WithRetryBudget) is exhausted.
 // DefaultRetryPolicy retries whenever err is non-nil (except for some url errors) or if returned
 // status code is 429 or 5xx (except 501)
+// Retries of requests sent by a retryable client are counted by host and status code
+// (see RegisterMetrics).
 func RetryStrategy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrRateLimited) {
+		return false, err
+	}
 	retry, err2 := rhttp.DefaultRetryPolicy(ctx, resp, err)
 	if retry {
+		if b := retryBudgetFrom(ctx); b != nil && !b.Take() {
+			log.G(ctx).WithError(err).Debug("not retrying request: retry budget exhausted")
+			return false, ErrRetryBudgetExhausted
+		}
 		log.G(ctx).WithFields(logrus.Fields{
 			"error":    err,
 			"response": resp,
 		}).Debugf("retrying request")
+		if s := retryStateFrom(ctx); s != nil {
+			s.retried(resp)
+		}
 	}
 	return retry, err2
 }
+
+// newDialContext returns the function dialing the hosts of a client.
+func newDialContext(timeout time.Duration, config DialConfig) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       timeout,
+		FallbackDelay: config.FallbackDelay,
+	}
+	if config.DNSCacheTTL <= 0 {
+		return dialer.DialContext
+	}
+	fallbackDelay := config.FallbackDelay
+	if fallbackDelay == 0 {
+		fallbackDelay = DefaultFallbackDelayMsec * time.Millisecond
+	}
+	return (&cachingDialer{
+		dialer:        dialer,
+		cache:         defaultDNSCache,
+		ttl:           config.DNSCacheTTL,
+		fallbackDelay: fallbackDelay,
+	}).DialContext
+}
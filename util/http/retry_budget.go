@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is returned for requests which failed and would have been retried,
+// but whose retry budget has no retries left.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// RetryBudget is a token bucket of retries shared by related requests, e.g. the in-flight
+// fetches of a layer. While a registry is down, the requests spend the budget quickly and then
+// fail fast instead of each of them backing off up to `RetryConfig.MaxRetries` times.
+// Spent retries are returned to the budget over time, so that occasional failures are retried.
+type RetryBudget struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	// refill is the time after which one spent retry is returned to the budget.
+	refill time.Duration
+	last   time.Time
+
+	now func() time.Time
+}
+
+// NewRetryBudget returns a full budget of `retries` retries, one of which is
+// returned to the budget every `refill` once spent.
+func NewRetryBudget(retries int, refill time.Duration) *RetryBudget {
+	return &RetryBudget{
+		capacity: float64(retries),
+		tokens:   float64(retries),
+		refill:   refill,
+		last:     time.Now(),
+		now:      time.Now,
+	}
+}
+
+// Take spends a retry. It returns false if no retry is left.
+func (b *RetryBudget) Take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replenish()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Remaining returns the number of retries left.
+func (b *RetryBudget) Remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replenish()
+	return int(b.tokens)
+}
+
+func (b *RetryBudget) replenish() {
+	now := b.now()
+	if b.refill > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.refill)
+	}
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a context whose requests sent by a retryable client
+// spend their retries from budget.
+func WithRetryBudget(ctx context.Context, budget *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+func retryBudgetFrom(ctx context.Context) *RetryBudget {
+	b, _ := ctx.Value(retryBudgetKey{}).(*RetryBudget)
+	return b
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewRetryBudget(2, time.Second)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	for i := 0; i < 2; i++ {
+		if !b.Take() {
+			t.Fatalf("expected retry %d to be in the budget", i)
+		}
+	}
+	if b.Take() {
+		t.Fatal("expected budget to be exhausted")
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if got := b.Remaining(); got != 1 {
+		t.Fatalf("unexpected remaining retries after refill; expected = 1, got = %d", got)
+	}
+	if !b.Take() || b.Take() {
+		t.Fatal("expected exactly one retry to be refilled")
+	}
+
+	// The budget never exceeds its capacity.
+	now = now.Add(time.Hour)
+	if got := b.Remaining(); got != 2 {
+		t.Fatalf("unexpected remaining retries of idle budget; expected = 2, got = %d", got)
+	}
+}
+
+func TestRetryBudgetIsSharedAcrossRequests(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := NewRetryableClientConfig()
+	config.MaxRetries = 5
+	config.MinWait = time.Millisecond
+	config.MaxWait = time.Millisecond
+	config.FailureThreshold = 0
+	client := NewRetryableClient(config)
+
+	ctx := WithRetryBudget(context.Background(), NewRetryBudget(3, time.Hour))
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, ErrRetryBudgetExhausted) {
+			t.Fatalf("expected retry budget to be exhausted: %v", err)
+		}
+	}
+	// Both requests are attempted once, and share 3 retries instead of retrying 5 times each.
+	if got := atomic.LoadInt32(&attempts); got != 5 {
+		t.Fatalf("unexpected number of attempts; expected = 5, got = %d", got)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSigV4Signer(t *testing.T) {
+	// The get-vanilla case of the AWS SigV4 test suite.
+	s := &SigV4Signer{
+		Region:          "us-east-1",
+		Service:         "service",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		now:             func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sign(req); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Fatalf("unexpected signature; expected = %q, got = %q", expected, got)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Fatalf("unexpected date %q", got)
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	s := &HMACSigner{KeyID: "key", Secret: []byte("secret"), now: func() time.Time { return time.Unix(1000, 0) }}
+	req, err := http.NewRequest(http.MethodGet, "https://registry.example.com/v2/app/blobs/sha256:abc?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sign(req); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("GET\n/v2/app/blobs/sha256:abc?x=1\nregistry.example.com\n1000"))
+	expected := "keyId=key,algorithm=hmac-sha256,signature=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get(DefaultHMACSignatureHeader); got != expected {
+		t.Fatalf("unexpected signature; expected = %q, got = %q", expected, got)
+	}
+	if got := req.Header.Get(HMACTimestampHeader); got != "1000" {
+		t.Fatalf("unexpected timestamp %q", got)
+	}
+}
+
+func TestSignerSignsEveryAttempt(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		if r.Header.Get("X-Attempt") != strconv.Itoa(int(n)) {
+			t.Errorf("attempt %d was signed for attempt %q", n, r.Header.Get("X-Attempt"))
+		}
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	var signed int32
+	config := NewRetryableClientConfig()
+	config.MinWait, config.MaxWait = time.Millisecond, time.Millisecond
+	config.Signer = SignerFunc(func(req *http.Request) error {
+		req.Header.Set("X-Attempt", strconv.Itoa(int(atomic.AddInt32(&signed, 1))))
+		return nil
+	})
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewRetryableClient(config).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if attempts != 2 {
+		t.Fatalf("unexpected number of attempts; expected = 2, got = %d", attempts)
+	}
+	if req.Header.Get("X-Attempt") != "" {
+		t.Fatalf("the request of the caller was modified")
+	}
+}
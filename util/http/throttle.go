@@ -0,0 +1,151 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// ErrRateLimited is returned for requests to a rate-limited host when the request
+// would time out before the host accepts requests again.
+var ErrRateLimited = errors.New("host is rate limiting requests")
+
+// hostThrottles holds the throttle of all hosts. Like circuit breakers, they are shared by all
+// clients so that a rate limit hit by one fetch pauses all other fetches from the same host.
+var hostThrottles sync.Map // host -> *hostThrottle
+
+// hostThrottle tracks until when a host asked clients to stop sending requests.
+type hostThrottle struct {
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+func getHostThrottle(host string) *hostThrottle {
+	t, _ := hostThrottles.LoadOrStore(host, &hostThrottle{})
+	return t.(*hostThrottle)
+}
+
+func (t *hostThrottle) until() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.blockedUntil
+}
+
+// block extends the time until which requests to the host are held back.
+func (t *hostThrottle) block(until time.Time) {
+	t.mu.Lock()
+	if until.After(t.blockedUntil) {
+		t.blockedUntil = until
+	}
+	t.mu.Unlock()
+}
+
+// throttleTransport is an http.RoundTripper which holds back requests to hosts
+// that signaled a rate limit, either with a Retry-After header on a 429/503 response
+// or with RateLimit-Remaining: 0 and RateLimit-Reset headers.
+type throttleTransport struct {
+	// maxWait caps how long a single rate limit signal holds back requests.
+	maxWait time.Duration
+	next    http.RoundTripper
+
+	now func() time.Time
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	throttle := getHostThrottle(host)
+	if wait := throttle.until().Sub(t.now()); wait > 0 {
+		ctx := req.Context()
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(t.now().Add(wait)) {
+			return nil, fmt.Errorf("%w: host %s accepts requests again in %v", ErrRateLimited, host, wait)
+		}
+		log.G(ctx).WithField("host", host).WithField("wait", wait).Debug("waiting for registry rate limit")
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if wait, ok := rateLimitWait(resp, t.now()); ok {
+		if wait > t.maxWait {
+			wait = t.maxWait
+		}
+		throttle.block(t.now().Add(wait))
+	}
+	return resp, err
+}
+
+// rateLimitWait returns how long the response asks clients to wait before sending more requests.
+func rateLimitWait(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			return wait, true
+		}
+	}
+	// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+	if remaining, ok := parseRateLimitValue(resp.Header.Get("RateLimit-Remaining")); ok && remaining == 0 {
+		if reset, ok := parseRateLimitValue(resp.Header.Get("RateLimit-Reset")); ok {
+			return time.Duration(reset) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(v); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// parseRateLimitValue parses the leading integer of a RateLimit-* header,
+// ignoring parameters such as Docker Hub's `;w=21600`.
+func parseRateLimitValue(v string) (int64, bool) {
+	if i := strings.IndexByte(v, ';'); i >= 0 {
+		v = v[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
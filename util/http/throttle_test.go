@@ -0,0 +1,119 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name       string
+		statusCode int
+		header     map[string]string
+		wait       time.Duration
+		ok         bool
+	}{
+		{
+			name:       "retry-after seconds",
+			statusCode: http.StatusTooManyRequests,
+			header:     map[string]string{"Retry-After": "5"},
+			wait:       5 * time.Second,
+			ok:         true,
+		},
+		{
+			name:       "retry-after date",
+			statusCode: http.StatusServiceUnavailable,
+			header:     map[string]string{"Retry-After": now.Add(time.Minute).Format(http.TimeFormat)},
+			wait:       time.Minute,
+			ok:         true,
+		},
+		{
+			name:       "retry-after is ignored on success",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"Retry-After": "5"},
+		},
+		{
+			name:       "ratelimit headers with docker hub parameters",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"RateLimit-Remaining": "0;w=21600", "RateLimit-Reset": "30"},
+			wait:       30 * time.Second,
+			ok:         true,
+		},
+		{
+			name:       "ratelimit not exhausted",
+			statusCode: http.StatusOK,
+			header:     map[string]string{"RateLimit-Remaining": "10;w=21600", "RateLimit-Reset": "30"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tc.statusCode, Header: make(http.Header)}
+			for k, v := range tc.header {
+				resp.Header.Set(k, v)
+			}
+			wait, ok := rateLimitWait(resp, now)
+			if wait != tc.wait || ok != tc.ok {
+				t.Fatalf("unexpected wait; expected = (%v, %v), got = (%v, %v)", tc.wait, tc.ok, wait, ok)
+			}
+		})
+	}
+}
+
+func TestThrottleIsSharedAcrossClients(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	config := NewRetryableClientConfig()
+	config.MaxRetries = 0
+	config.FailureThreshold = 0
+	config.RequestTimeout = time.Second
+
+	// The client gives up on the 429 response since it must not retry.
+	if _, err := NewRetryableClient(config).Get(server.URL); errors.Is(err, ErrRateLimited) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Another client must not send a request to the rate-limited host, and fail fast
+	// since the rate limit outlasts its request timeout.
+	_, err := NewRetryableClient(config).Get(server.URL)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("unexpected error; expected = %v, got = %v", ErrRateLimited, err)
+	}
+	if requests != 1 {
+		t.Fatalf("unexpected number of requests; expected = 1, got = %d", requests)
+	}
+
+	// Requests without a deadline wait until the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	config.RequestTimeout = 0
+	if _, err := NewRetryableClient(config).Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; expected = %v, got = %v", context.Canceled, err)
+	}
+}
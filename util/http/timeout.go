@@ -0,0 +1,130 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRequestTimeout is returned when an attempt of a request isn't complete within its timeout
+// scaled with the size of its payload. See `TimeoutConfig.RequestTimeoutPerMB`.
+var ErrRequestTimeout = errors.New("request timed out")
+
+// requestTimeoutTransport is an http.RoundTripper which times out each attempt of a request after
+// `RequestTimeout` plus `RequestTimeoutPerMB` for each MiB of its expected payload, instead of a fixed
+// duration. The expected payload is the size of the requested byte ranges, and it is raised to the
+// Content-Length of the response once its headers are read, e.g. for requests without a range.
+type requestTimeoutTransport struct {
+	config TimeoutConfig
+	next   http.RoundTripper
+}
+
+// timeout returns how long an attempt with a payload of size bytes may take.
+func (t *requestTimeoutTransport) timeout(size int64) time.Duration {
+	return t.config.RequestTimeout + time.Duration(float64(t.config.RequestTimeoutPerMB)*float64(size)/(1<<20))
+}
+
+func (t *requestTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	size := rangeSize(req.Header.Get("Range"))
+	ctx, cancel := context.WithCancel(req.Context())
+	b := &timeoutBody{cancel: cancel, timeout: t.timeout(size)}
+	b.timer = time.AfterFunc(b.timeout, b.expire)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		b.stop()
+		return nil, b.wrap(err)
+	}
+	if resp.ContentLength > size && b.timer.Stop() {
+		b.timeout = t.timeout(resp.ContentLength)
+		b.timer.Reset(time.Until(start.Add(b.timeout)))
+	}
+	b.ReadCloser = resp.Body
+	resp.Body = b
+	return resp, nil
+}
+
+// timeoutBody is the body of a response whose attempt times out once the timer fires.
+type timeoutBody struct {
+	io.ReadCloser
+	timer    *time.Timer
+	timeout  time.Duration
+	cancel   context.CancelFunc
+	timedOut int32
+}
+
+func (b *timeoutBody) expire() {
+	atomic.StoreInt32(&b.timedOut, 1)
+	b.cancel()
+}
+
+func (b *timeoutBody) stop() {
+	b.timer.Stop()
+	b.cancel()
+}
+
+// wrap returns ErrRequestTimeout if err was caused by the timeout of the attempt.
+func (b *timeoutBody) wrap(err error) error {
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.timedOut) == 1 {
+		return fmt.Errorf("%w after %v: %v", ErrRequestTimeout, b.timeout, err)
+	}
+	return err
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	return n, b.wrap(err)
+}
+
+func (b *timeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	return err
+}
+
+// rangeSize returns the number of bytes requested by the Range header `r`, e.g. "bytes=0-1023".
+// Ranges without both bounds, whose size depends on the size of the content, are not counted.
+func rangeSize(r string) int64 {
+	if !strings.HasPrefix(r, "bytes=") {
+		return 0
+	}
+	var size int64
+	for _, spec := range strings.Split(strings.TrimPrefix(r, "bytes="), ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			continue
+		}
+		l, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || l < f {
+			continue
+		}
+		size += l - f + 1
+	}
+	return size
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRangeSize(t *testing.T) {
+	tests := []struct {
+		r    string
+		size int64
+	}{
+		{"", 0},
+		{"bytes=0-0", 1},
+		{"bytes=0-1023", 1024},
+		{"bytes=0-9, 20-29", 20},
+		{"bytes=100-", 0},
+		{"bytes=-100", 0},
+		{"bytes=10-5", 0},
+		{"items=0-9", 0},
+	}
+	for _, tc := range tests {
+		if size := rangeSize(tc.r); size != tc.size {
+			t.Errorf("unexpected size of %q; expected = %d, got = %d", tc.r, tc.size, size)
+		}
+	}
+}
+
+func TestScaledRequestTimeout(t *testing.T) {
+	const (
+		delay = 200 * time.Millisecond
+		mib   = 1 << 20
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			// The timeout is scaled with the size of the response once its headers are read.
+			w.Header().Set("Content-Length", strconv.Itoa(mib))
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(delay)
+			w.Write(bytes.Repeat([]byte{0}, mib))
+			return
+		}
+		time.Sleep(delay)
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	config := NewRetryableClientConfig()
+	config.MaxRetries = 0
+	config.FailureThreshold = 0
+	config.RequestTimeout = delay / 4
+	config.RequestTimeoutPerMB = 10 * delay
+	client := NewRetryableClient(config)
+
+	get := func(r string) error {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != "" {
+			req.Header.Set("Range", r)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+
+	if err := get("bytes=0-9"); !errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("expected a small read to time out, got: %v", err)
+	}
+	if err := get("bytes=0-1048575"); err != nil {
+		t.Fatalf("unexpected error of a large read: %v", err)
+	}
+	if err := get(""); err != nil {
+		t.Fatalf("unexpected error of a large response: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/containerd/containerd/log"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// traceTransport is an http.RoundTripper which attaches a trace ID to every request
+// so that registry-side logs can be correlated with snapshotter-side failures.
+// It sits above the retry loop, so all attempts of a request share the same trace ID.
+type traceTransport struct {
+	header string
+	next   http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := req.Header.Get(t.header)
+	if id == "" {
+		id = uuid.New().String()
+	}
+	// Everything logged for this request (e.g. retries) carries the trace ID.
+	ctx := log.WithLogger(req.Context(), log.G(req.Context()).WithField("trace_id", id))
+	req = req.Clone(ctx)
+	req.Header.Set(t.header, id)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s: %s)", err, t.header, id)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		log.G(ctx).WithFields(logrus.Fields{
+			"host":   req.URL.Host,
+			"status": resp.Status,
+		}).Warn("registry request failed")
+	}
+	return resp, nil
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceIDIsSharedByRetries(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ids []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids = append(ids, r.Header.Get("X-Trace"))
+		attempt := len(ids)
+		mu.Unlock()
+		if attempt == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := NewRetryableClientConfig()
+	config.MinWait = time.Millisecond
+	config.MaxWait = time.Millisecond
+	config.TraceConfig.Header = "X-Trace"
+
+	client := NewRetryableClient(config)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(ids) != 3 {
+		t.Fatalf("unexpected number of attempts; expected = 3, got = %d", len(ids))
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Fatalf("retries of a request must share the trace ID; got = %v", ids)
+	}
+	if ids[1] == ids[2] {
+		t.Fatalf("different requests must have different trace IDs; got = %v", ids)
+	}
+}
+
+func TestTraceIDInError(t *testing.T) {
+	config := NewRetryableClientConfig()
+	config.MaxRetries = 0
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:1", nil)
+	req.Header.Set(DefaultTraceHeader, "test-trace-id")
+	_, err := NewRetryableClient(config).Do(req)
+	if err == nil {
+		t.Fatalf("expected the request to fail")
+	}
+	if !strings.Contains(err.Error(), "test-trace-id") {
+		t.Fatalf("error does not contain the trace ID: %v", err)
+	}
+}
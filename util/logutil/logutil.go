@@ -0,0 +1,85 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package logutil defines the fields which correlate log entries with the images, layers,
+// spans and snapshots they are about, so that log pipelines can aggregate entries per image.
+package logutil
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ImageField is the reference of the image (e.g. "registry.example.com/app:v1"),
+	// or the digest of its manifest where the reference isn't known.
+	ImageField = "image"
+	// LayerField is the digest of the layer.
+	LayerField = "layer"
+	// SpanField is the ID of a span of the layer.
+	SpanField = "span"
+	// SnapshotKeyField is the key of the snapshot.
+	SnapshotKeyField = "key"
+	// DigestField is the digest of the content an entry is about, e.g. a SOCI index, a zTOC or
+	// an image manifest, where it isn't an image or layer field.
+	DigestField = "digest"
+)
+
+const (
+	// JSONFormat formats log entries as JSON objects, one per line.
+	JSONFormat = "json"
+	// TextFormat formats log entries as logfmt lines.
+	TextFormat = "text"
+)
+
+// WithImage returns a context whose logger adds the image `ref` to the entries.
+func WithImage(ctx context.Context, ref string) context.Context {
+	return withField(ctx, ImageField, ref)
+}
+
+// WithLayer returns a context whose logger adds the layer `dgst` to the entries.
+func WithLayer(ctx context.Context, dgst digest.Digest) context.Context {
+	return withField(ctx, LayerField, dgst.String())
+}
+
+// WithSnapshotKey returns a context whose logger adds the snapshot `key` to the entries.
+func WithSnapshotKey(ctx context.Context, key string) context.Context {
+	return withField(ctx, SnapshotKeyField, key)
+}
+
+func withField(ctx context.Context, key, value string) context.Context {
+	if value == "" {
+		return ctx
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithField(key, value))
+}
+
+// Formatter returns the formatter of log entries in `format`. Timestamps have a fixed
+// number of digits so that entries sort by time.
+func Formatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "", JSONFormat:
+		return &logrus.JSONFormatter{TimestampFormat: log.RFC3339NanoFixed}, nil
+	case TextFormat:
+		return &logrus.TextFormatter{TimestampFormat: log.RFC3339NanoFixed, FullTimestamp: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q; must be %q or %q", format, JSONFormat, TextFormat)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	formatter, err := Formatter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetFormatter(formatter)
+
+	dgst := digest.FromString("layer")
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+	ctx = WithSnapshotKey(WithLayer(WithImage(ctx, "example.com/app:v1"), dgst), "")
+	log.G(ctx).Info("test")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("entry isn't JSON: %v: %q", err, buf.String())
+	}
+	if entry[ImageField] != "example.com/app:v1" {
+		t.Errorf("image = %v; want %q", entry[ImageField], "example.com/app:v1")
+	}
+	if entry[LayerField] != dgst.String() {
+		t.Errorf("layer = %v; want %q", entry[LayerField], dgst)
+	}
+	if _, ok := entry[SnapshotKeyField]; ok {
+		t.Errorf("empty snapshot key must be left out: %q", buf.String())
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	text, err := Formatter(TextFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := text.Format(logrus.NewEntry(logrus.New()).WithField(LayerField, "sha256:abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `layer="sha256:abc"`) {
+		t.Errorf("unexpected text entry %q", b)
+	}
+	if _, err := Formatter("xml"); err == nil {
+		t.Error("unknown format must be rejected")
+	}
+}
@@ -166,3 +166,31 @@ func TestEviction(t *testing.T) {
 		return
 	}
 }
+
+func TestClear(t *testing.T) {
+	var evicted []string
+	c := New(10)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+
+	_, done1, _ := c.Add("key1", "abcd")
+	done1()
+	_, done2, _ := c.Add("key2", "efgh")
+
+	c.Clear()
+	if len(evicted) != 1 || evicted[0] != "key1" {
+		t.Fatalf("unexpected evicted contents %v; want [key1]", evicted)
+	}
+	if _, _, ok := c.Get("key1"); ok {
+		t.Fatalf("key1 must be removed")
+	}
+	done2()
+	if len(evicted) != 2 || evicted[1] != "key2" {
+		t.Fatalf("key2 must be evicted once released; evicted %v", evicted)
+	}
+
+	if _, _, added := c.Add("key1", "abcd"); !added {
+		t.Fatalf("failed to add key1 after clear")
+	}
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mtls
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+)
+
+func TestMutualTLS(t *testing.T) {
+	certs := testutil.WriteCertificates(t, t.TempDir())
+	serverConfig, err := ServerConfig(certs.ServerCert, certs.ServerKey, certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	clientConfig, err := ClientConfig(certs.ClientCert, certs.ClientKey, certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("failed to connect with client certificate: %v", err)
+	}
+	resp.Body.Close()
+
+	// Clients without certificates are refused.
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: clientConfig.RootCAs}}}
+	if resp, err := anonymous.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected client without certificate to be refused")
+	}
+
+	if _, err := ServerConfig(certs.ServerCert, certs.ServerKey, ""); err == nil {
+		t.Fatal("expected server config without client CA to fail")
+	}
+}
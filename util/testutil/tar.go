@@ -335,6 +335,7 @@ type fileOpts struct {
 	uid     int
 	gid     int
 	xattrs  map[string]string
+	pax     map[string]string
 	mode    *os.FileMode
 	modTime time.Time
 }
@@ -354,6 +355,14 @@ func WithFileXattrs(xattrs map[string]string) FileBuildTarOption {
 	}
 }
 
+// WithFilePAXRecords specifies raw PAX records of the file, e.g. the extended attributes
+// written by libarchive.
+func WithFilePAXRecords(records map[string]string) FileBuildTarOption {
+	return func(o *fileOpts) {
+		o.pax = records
+	}
+}
+
 // WithFileModTime specifies the modtime of the file.
 func WithFileModTime(modTime time.Time) FileBuildTarOption {
 	return func(o *fileOpts) {
@@ -383,14 +392,15 @@ func File(name, contents string, opts ...FileBuildTarOption) TarEntry {
 			mode = permAndExtraMode2TarMode(*fOpts.mode)
 		}
 		if err := tw.WriteHeader(&tar.Header{
-			Typeflag: tar.TypeReg,
-			Name:     buildOpts.Prefix + name,
-			Mode:     mode,
-			ModTime:  fOpts.modTime,
-			Xattrs:   fOpts.xattrs,
-			Size:     int64(len(contents)),
-			Uid:      fOpts.uid,
-			Gid:      fOpts.gid,
+			Typeflag:   tar.TypeReg,
+			Name:       buildOpts.Prefix + name,
+			Mode:       mode,
+			ModTime:    fOpts.modTime,
+			Xattrs:     fOpts.xattrs,
+			PAXRecords: fOpts.pax,
+			Size:       int64(len(contents)),
+			Uid:        fOpts.uid,
+			Gid:        fOpts.gid,
 		}); err != nil {
 			return err
 		}
@@ -0,0 +1,104 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// AlignedGzipWriter compresses the data written to it into a gzip stream of members holding
+// `spanSize` bytes each, except the last one. The spans of zinfo built from the stream with the
+// same span size each start a member, so they are decompressed without the data preceding them.
+type AlignedGzipWriter struct {
+	w        io.Writer
+	gz       *gzip.Writer
+	level    int
+	spanSize int64
+	// n is the number of bytes written to the current member.
+	n       int64
+	written bool
+}
+
+// NewAlignedGzipWriter returns an AlignedGzipWriter writing to `w` with the compression `level`
+// of compress/gzip.
+func NewAlignedGzipWriter(w io.Writer, spanSize int64, level int) (*AlignedGzipWriter, error) {
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("span size must be positive, got %d", spanSize)
+	}
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return &AlignedGzipWriter{w: w, level: level, spanSize: spanSize}, nil
+}
+
+func (aw *AlignedGzipWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if aw.gz == nil {
+			gz, err := gzip.NewWriterLevel(aw.w, aw.level)
+			if err != nil {
+				return written, err
+			}
+			aw.gz = gz
+			aw.written = true
+		}
+		chunk := p
+		if room := aw.spanSize - aw.n; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := aw.gz.Write(chunk)
+		written += n
+		aw.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if aw.n == aw.spanSize {
+			if err := aw.closeMember(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// closeMember ends the current gzip member, if any.
+func (aw *AlignedGzipWriter) closeMember() error {
+	if aw.gz == nil {
+		return nil
+	}
+	err := aw.gz.Close()
+	aw.gz = nil
+	aw.n = 0
+	return err
+}
+
+// Close ends the gzip stream. An empty stream is written as a single empty member, so that it's
+// a valid gzip stream. It doesn't close the underlying writer.
+func (aw *AlignedGzipWriter) Close() error {
+	if !aw.written {
+		gz, err := gzip.NewWriterLevel(aw.w, aw.level)
+		if err != nil {
+			return err
+		}
+		aw.gz = gz
+		aw.written = true
+	}
+	return aw.closeMember()
+}
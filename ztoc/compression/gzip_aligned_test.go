@@ -0,0 +1,230 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testSpanSize = 1 << 16
+
+// compressibleData returns `size` bytes which compress into many deflate blocks.
+func compressibleData(size int) []byte {
+	r := rand.New(rand.NewSource(int64(size)))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = "abcdefgh"[r.Intn(8)]
+	}
+	return data
+}
+
+// writeGzipFile writes `data` as a gzip file with members of at most `memberSize` bytes each.
+func writeGzipFile(t *testing.T, data []byte, memberSize int) string {
+	var buf bytes.Buffer
+	for start := 0; start == 0 || start < len(data); start += memberSize {
+		end := start + memberSize
+		if end > len(data) {
+			end = len(data)
+		}
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data[start:end]); err != nil {
+			t.Fatalf("failed to write gzip member: %v", err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatalf("failed to close gzip member: %v", err)
+		}
+	}
+	return writeTestFile(t, buf.Bytes())
+}
+
+func writeTestFile(t *testing.T, contents []byte) string {
+	path := filepath.Join(t.TempDir(), "layer.tar.gz")
+	if err := os.WriteFile(path, contents, 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	return path
+}
+
+// checkZinfoExtraction checks that every span of `zinfo` of the gzip file `path` and ranges
+// across spans extract to `data`.
+func checkZinfoExtraction(t *testing.T, zinfo *GzipZinfo, path string, data []byte) {
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	for id := SpanID(0); id <= zinfo.MaxSpanID(); id++ {
+		start := zinfo.StartUncompressedOffset(id)
+		end := zinfo.EndUncompressedOffset(id, Offset(len(data)))
+		buf := compressed[zinfo.StartCompressedOffset(id):zinfo.EndCompressedOffset(id, Offset(len(compressed)))]
+		got, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, id)
+		if err != nil {
+			t.Fatalf("failed to extract span %d: %v", id, err)
+		}
+		if !bytes.Equal(got, data[start:end]) {
+			t.Fatalf("unexpected data of span %d", id)
+		}
+	}
+	for _, r := range [][2]int{{0, len(data)}, {testSpanSize / 2, len(data) - testSpanSize/2}} {
+		if r[1] <= r[0] {
+			continue
+		}
+		got, err := zinfo.ExtractDataFromFile(path, Offset(r[1]-r[0]), Offset(r[0]))
+		if err != nil {
+			t.Fatalf("failed to extract [%d, %d): %v", r[0], r[1], err)
+		}
+		if !bytes.Equal(got, data[r[0]:r[1]]) {
+			t.Fatalf("unexpected data of [%d, %d)", r[0], r[1])
+		}
+	}
+}
+
+func TestAlignedGzipWriter(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "less than a span", size: testSpanSize / 2},
+		{name: "multiple of span size", size: 4 * testSpanSize},
+		{name: "not a multiple of span size", size: 4*testSpanSize + 123},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			data := compressibleData(tc.size)
+			var buf bytes.Buffer
+			aw, err := NewAlignedGzipWriter(&buf, testSpanSize, gzip.DefaultCompression)
+			if err != nil {
+				t.Fatalf("failed to create writer: %v", err)
+			}
+			// Write in chunks which don't match the span size.
+			for r := bytes.NewReader(data); r.Len() > 0; {
+				if _, err := io.CopyN(aw, r, 10000); err != nil && err != io.EOF {
+					t.Fatalf("failed to write: %v", err)
+				}
+			}
+			if err := aw.Close(); err != nil {
+				t.Fatalf("failed to close writer: %v", err)
+			}
+
+			// Every member but the last one holds a span.
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				t.Fatalf("failed to read gzip stream: %v", err)
+			}
+			var members []int64
+			for {
+				zr.Multistream(false)
+				n, err := io.Copy(io.Discard, zr)
+				if err != nil {
+					t.Fatalf("failed to read gzip member: %v", err)
+				}
+				members = append(members, n)
+				if err := zr.Reset(br); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("failed to read gzip member header: %v", err)
+				}
+			}
+			for i, n := range members {
+				last := i == len(members)-1
+				if (!last && n != testSpanSize) || (last && (n > testSpanSize || (n == 0 && tc.size != 0))) {
+					t.Fatalf("member %d of %d holds %d bytes; span size is %d", i, len(members), n, testSpanSize)
+				}
+			}
+
+			path := writeTestFile(t, buf.Bytes())
+			zinfo, err := newGzipZinfoFromFile(path, testSpanSize)
+			if err != nil {
+				t.Fatalf("failed to build zinfo: %v", err)
+			}
+			defer zinfo.Close()
+			if !zinfo.MemberAligned() {
+				t.Fatalf("zinfo of aligned gzip stream isn't member aligned")
+			}
+			for id := SpanID(0); id <= zinfo.MaxSpanID(); id++ {
+				if got, want := zinfo.StartUncompressedOffset(id), Offset(id)*testSpanSize; got != want {
+					t.Fatalf("span %d starts at %d; want %d", id, got, want)
+				}
+				if zinfo.hasBits(id) {
+					t.Fatalf("span %d doesn't start at a byte boundary", id)
+				}
+			}
+			checkZinfoExtraction(t, zinfo, path, data)
+
+			// Aligned spans are raw deflate streams, decompressed without the data preceding them.
+			for id := SpanID(0); id <= zinfo.MaxSpanID(); id++ {
+				start := zinfo.StartUncompressedOffset(id)
+				end := zinfo.EndUncompressedOffset(id, Offset(len(data)))
+				fr := flate.NewReader(bytes.NewReader(buf.Bytes()[zinfo.StartCompressedOffset(id):zinfo.EndCompressedOffset(id, Offset(buf.Len()))]))
+				got := make([]byte, end-start)
+				if _, err := io.ReadFull(fr, got); err != nil {
+					t.Fatalf("failed to inflate span %d: %v", id, err)
+				}
+				if !bytes.Equal(got, data[start:end]) {
+					t.Fatalf("unexpected data of inflated span %d", id)
+				}
+			}
+		})
+	}
+}
+
+func TestGzipZinfoMultipleMembers(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name       string
+		size       int
+		memberSize int
+		aligned    bool
+	}{
+		{name: "single member", size: 6 * testSpanSize, memberSize: 6 * testSpanSize, aligned: false},
+		{name: "small members", size: 6 * testSpanSize, memberSize: testSpanSize / 3, aligned: false},
+		{name: "large members", size: 6 * testSpanSize, memberSize: 5 * testSpanSize / 2, aligned: false},
+		{name: "span members", size: 6*testSpanSize + 1, memberSize: testSpanSize, aligned: true},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			data := compressibleData(tc.size)
+			path := writeGzipFile(t, data, tc.memberSize)
+			zinfo, err := newGzipZinfoFromFile(path, testSpanSize)
+			if err != nil {
+				t.Fatalf("failed to build zinfo: %v", err)
+			}
+			defer zinfo.Close()
+			if zinfo.MemberAligned() != tc.aligned {
+				t.Fatalf("unexpected member alignment: got %t, want %t", zinfo.MemberAligned(), tc.aligned)
+			}
+			// All the members are indexed.
+			if last := zinfo.StartUncompressedOffset(zinfo.MaxSpanID()); int(last) < tc.size-2*testSpanSize {
+				t.Fatalf("last span starts at %d, before the last members of %d bytes", last, tc.size)
+			}
+			checkZinfoExtraction(t, zinfo, path, data)
+		})
+	}
+}
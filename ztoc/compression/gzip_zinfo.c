@@ -90,6 +90,19 @@ static uint8_t get_bits(struct gzip_zinfo *index, int checkpoint) {
     return index->list[checkpoint].bits;
 }
 
+/* Prepares strm to inflate the gzip member following the one it has just
+   inflated, so that multi-member gzip files (e.g. eStargz layers) are read
+   whole. A member inflated raw from a checkpoint is followed by its 8 bytes
+   trailer, which the caller must skip before inflating the next member. */
+static int next_member(z_stream *strm, int *raw, unsigned *trailer) {
+    if (*raw) {
+        *raw = 0;
+        *trailer = 8;
+        return inflateReset2(strm, 31); /* gzip decoding */
+    }
+    return inflateReset(strm);
+}
+
 // zinfo - internal helpers end.
 
 // zinfo - metadata starts.
@@ -199,12 +212,28 @@ static struct gzip_zinfo *add_checkpoint(struct gzip_zinfo *index, uint8_t bits,
     return index;
 }
 
-/* Pretty much the same as from zran.c */
-int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
+/* Receives a checkpoint of scan_checkpoints. window holds the preceding 32K
+   of uncompressed data, of which the oldest left bytes are at its end. */
+typedef int (*checkpoint_fn)(void* arg, uint8_t bits, offset_t in, offset_t out,
+    unsigned left, unsigned char* window);
+
+/* Pretty much the same as from zran.c, except that all the members of the
+   gzip file are indexed and that checkpoints are handed to add as they're
+   found instead of being kept in a list. A checkpoint is added at the start
+   of a member once span bytes follow the previous one, so that spans of
+   members holding span bytes each start a member. aligned is set if every
+   checkpoint starts a member, i.e. if spans can be inflated without the data
+   preceding them. */
+static int scan_checkpoints(FILE* in, offset_t span, checkpoint_fn add, void* arg,
+    int32_t* have, int* aligned) {
     int ret;
     offset_t totin, totout;        /* our own total counters to avoid 4GB limit */
     offset_t last;                 /* totout value of last access point */
-    struct gzip_zinfo *index;       /* access points being generated */
+    int member_start = 1;          /* whether the header of a member was just inflated */
+    int member_end = 0;            /* whether the input ends a member */
+    int added;                     /* whether an access point was just added */
+    int raw = 0;                   /* the file is inflated from its start, never raw */
+    unsigned trailer = 0;
     z_stream strm;
     unsigned char input[CHUNK], window[WINSIZE];
     memset(window, 0, WINSIZE);
@@ -218,7 +247,8 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
        also validates the integrity of the compressed data using the check
        information at the end of the gzip or zlib stream */
     totin = totout = last = 0;
-    index = NULL;               /* will be allocated by first add_checkpoint() */
+    *have = 0;
+    *aligned = 1;
     strm.avail_out = 0;
     do {
         /* get some compressed data from input file */
@@ -226,11 +256,13 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
         strm.avail_in = fread(input, 1, CHUNK, in);
         if (ferror(in)) {
             ret = Z_ERRNO;
-            goto build_index_error;
+            goto scan_error;
         }
         if (strm.avail_in == 0) {
+            if (member_end && *have > 0)
+                break;
             ret = Z_DATA_ERROR;
-            goto build_index_error;
+            goto scan_error;
         }
         strm.next_in = input;
 
@@ -252,9 +284,17 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
-                goto build_index_error;
-            if (ret == Z_STREAM_END)
-                break;
+                goto scan_error;
+            if (ret == Z_STREAM_END) {
+                /* index the next member, if any */
+                ret = next_member(&strm, &raw, &trailer);
+                if (ret != Z_OK)
+                    goto scan_error;
+                member_start = 1;
+                member_end = 1;
+                continue;
+            }
+            member_end = 0;
 
             /* if at end of block, consider adding an index entry (note that if
                data_type indicates an end-of-block, then all of the
@@ -265,21 +305,58 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
                index always has at least one access point; we avoid creating an
                access point after the last block by checking bit 6 of data_type
              */
+            added = 0;
             if ((strm.data_type & 128) && !(strm.data_type & 64) &&
-                (totout == 0 || totout - last > span)) {
-                index = add_checkpoint(index, (uint8_t)(strm.data_type & 7), totin,
-                                 totout, strm.avail_out, window);
-                if (index == NULL) {
-                    ret = Z_MEM_ERROR;
-                    goto build_index_error;
-                }
+                (totout == 0 || totout - last > span ||
+                 (member_start && totout - last >= span))) {
+                ret = add(arg, (uint8_t)(strm.data_type & 7), totin,
+                          totout, strm.avail_out, window);
+                if (ret != Z_OK)
+                    goto scan_error;
+                (*have)++;
+                if (!member_start)
+                    *aligned = 0;
+                added = 1;
                 last = totout;
             }
+            if (strm.data_type & 128) {
+                /* a member starting without an access point shares its span
+                   with the members before it, so spans don't start members */
+                if (member_start && !added)
+                    *aligned = 0;
+                member_start = 0;
+            }
         } while (strm.avail_in != 0);
-    } while (ret != Z_STREAM_END);
+    } while (1);
 
-    /* clean up and return index (release unused entries in list) */
     (void)inflateEnd(&strm);
+    return Z_OK;
+
+    /* return error */
+  scan_error:
+    (void)inflateEnd(&strm);
+    return ret;
+}
+
+static int add_checkpoint_to_list(void* arg, uint8_t bits, offset_t in, offset_t out,
+    unsigned left, unsigned char* window) {
+    struct gzip_zinfo **index = arg;
+    *index = add_checkpoint(*index, bits, in, out, left, window);
+    return *index == NULL ? Z_MEM_ERROR : Z_OK;
+}
+
+int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx, int* aligned) {
+    int ret;
+    int32_t have;
+    struct gzip_zinfo *index = NULL; /* will be allocated by first add_checkpoint() */
+
+    ret = scan_checkpoints(in, span, add_checkpoint_to_list, &index, &have, aligned);
+    if (ret != Z_OK) {
+        free_zinfo(index);
+        return ret;
+    }
+
+    /* clean up and return index (release unused entries in list) */
     index->list = realloc(index->list, sizeof(struct gzip_checkpoint) * index->have);
     index->size = index->have;
     index->have = encode_int32(index->have);
@@ -289,25 +366,77 @@ int generate_zinfo_from_fp(FILE* in, offset_t span, struct gzip_zinfo** idx) {
     index->version = encode_int32(ZINFO_VERSION_CUR);
     *idx = index;
     return sz;
-
-    /* return error */
-  build_index_error:
-    (void)inflateEnd(&strm);
-    free_zinfo(index);
-    return ret;
 }
 
-int generate_zinfo_from_file(const char *filepath, offset_t span, struct gzip_zinfo **index) {
+int generate_zinfo_from_file(const char *filepath, offset_t span, struct gzip_zinfo **index, int *aligned) {
     FILE *fp = fopen(filepath, "rb");
     if (fp == NULL)
         return GZIP_ZINFO_FILE_NOT_FOUND;
-    int ret = generate_zinfo_from_fp(fp, span, index);
+    int ret = generate_zinfo_from_fp(fp, span, index, aligned);
     fclose(fp);
     return ret;
 }
 
+/* Appends a checkpoint to out in the layout of zinfo_to_blob. */
+static int write_checkpoint(void* arg, uint8_t bits, offset_t in, offset_t out,
+    unsigned left, unsigned char* window) {
+    FILE *fp = arg;
+    in = encode_offset(in);
+    out = encode_offset(out);
+    if (fwrite(&in, 8, 1, fp) != 1 || fwrite(&out, 8, 1, fp) != 1 || fwrite(&bits, 1, 1, fp) != 1)
+        return Z_ERRNO;
+    if (left && fwrite(window + WINSIZE - left, left, 1, fp) != 1)
+        return Z_ERRNO;
+    if (left < WINSIZE && fwrite(window, WINSIZE - left, 1, fp) != 1)
+        return Z_ERRNO;
+    return Z_OK;
+}
+
+/* Writes the zinfo blob of in to out, like generate_zinfo_from_fp followed by
+   zinfo_to_blob, except that each checkpoint is written as soon as it's found
+   so that memory use doesn't grow with the size of in. out must be seekable,
+   since the header is written once the number of checkpoints is known. */
+int write_zinfo_from_fp(FILE* in, offset_t span, FILE* out, int* aligned) {
+    int ret;
+    int32_t have, encoded_have;
+    offset_t encoded_span;
+    unsigned char header[BLOB_HEADER_SIZE];
+    memset(header, 0, BLOB_HEADER_SIZE);
+
+    if (fwrite(header, BLOB_HEADER_SIZE, 1, out) != 1)
+        return Z_ERRNO;
+    ret = scan_checkpoints(in, span, write_checkpoint, out, &have, aligned);
+    if (ret != Z_OK)
+        return ret;
+
+    encoded_have = encode_int32(have);
+    encoded_span = encode_offset(span);
+    if (fseeko(out, 0, SEEK_SET) != 0 || fwrite(&encoded_have, 4, 1, out) != 1 ||
+        fwrite(&encoded_span, 8, 1, out) != 1 || fflush(out) != 0)
+        return Z_ERRNO;
+    return have;
+}
+
+int write_zinfo_from_file(const char *filepath, offset_t span, const char *zinfo_path, int *aligned) {
+    FILE *in = fopen(filepath, "rb");
+    if (in == NULL)
+        return GZIP_ZINFO_FILE_NOT_FOUND;
+    FILE *out = fopen(zinfo_path, "wb");
+    if (out == NULL) {
+        fclose(in);
+        return Z_ERRNO;
+    }
+    int ret = write_zinfo_from_fp(in, span, out, aligned);
+    fclose(in);
+    if (fclose(out) != 0 && ret >= 0)
+        ret = Z_ERRNO;
+    return ret;
+}
+
 int extract_data_from_fp(FILE *in, struct gzip_zinfo *index, offset_t offset, void *buffer, int len) {
     int ret, skip;
+    int raw = 1, member_end = 0;
+    unsigned trailer = 0;
     z_stream strm;
     struct gzip_checkpoint *here;
     unsigned char input[CHUNK], discard[WINSIZE];
@@ -369,18 +498,35 @@ int extract_data_from_fp(FILE *in, struct gzip_zinfo *index, offset_t offset, vo
                     goto extract_ret;
                 }
                 if (strm.avail_in == 0) {
+                    if (member_end) {
+                        ret = Z_STREAM_END;
+                        break;
+                    }
                     ret = Z_DATA_ERROR;
                     goto extract_ret;
                 }
                 strm.next_in = input;
             }
+            if (trailer) {                          /* skip the trailer of a member */
+                unsigned n = min(trailer, strm.avail_in);
+                strm.next_in += n;
+                strm.avail_in -= n;
+                trailer -= n;
+                continue;
+            }
             ret = inflate(&strm, Z_NO_FLUSH);       /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {              /* inflate the next member */
+                ret = next_member(&strm, &raw, &trailer);
+                if (ret != Z_OK)
+                    goto extract_ret;
+                member_end = 1;
+                continue;
+            }
+            member_end = 0;
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -414,6 +560,8 @@ int extract_data_from_buffer(void *d, offset_t datalen,
                              struct gzip_zinfo *index, offset_t offset,
                              void *buffer, offset_t len, int first_checkpoint) {
     int ret, skip;
+    int raw = 1, member_end = 0;
+    unsigned trailer = 0;
     z_stream strm;
     unsigned char input[CHUNK], discard[WINSIZE];
     uchar *buf = buffer;
@@ -460,19 +608,36 @@ int extract_data_from_buffer(void *d, offset_t datalen,
         do {
             if (strm.avail_in == 0) {
                 int read = min(remaining, CHUNK);
+                if (read == 0 && member_end) {
+                    ret = Z_STREAM_END;
+                    break;
+                }
                 remaining -= read;
                 memcpy(input, data, read);
                 data += read;
                 strm.avail_in = read;
                 strm.next_in = input;
             }
+            if (trailer) { /* skip the trailer of a member */
+                unsigned n = min(trailer, strm.avail_in);
+                strm.next_in += n;
+                strm.avail_in -= n;
+                trailer -= n;
+                continue;
+            }
             ret = inflate(&strm, Z_NO_FLUSH); /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) { /* inflate the next member */
+                ret = next_member(&strm, &raw, &trailer);
+                if (ret != Z_OK)
+                    goto extract_ret;
+                member_end = 1;
+                continue;
+            }
+            member_end = 0;
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -561,6 +726,7 @@ struct gzip_zinfo* blob_to_zinfo(void* buf, offset_t len) {
         version = ZINFO_VERSION_ONE;
     } else {
         // size is invalid. don't attempt to deserialize any more data.
+        free(index);
         return NULL;
     }
 
@@ -24,6 +24,7 @@ package compression
 import "C"
 
 import (
+	"encoding/binary"
 	"fmt"
 	"unsafe"
 )
@@ -31,6 +32,9 @@ import (
 // GzipZinfo is a go struct wrapper of the gzip zinfo's C implementation.
 type GzipZinfo struct {
 	cZinfo *C.struct_gzip_zinfo
+	// memberAligned is set if every span starts a gzip member. It's only known for zinfo built
+	// from files.
+	memberAligned bool
 }
 
 // newGzipZinfo creates a new instance of `GzipZinfo` from cZinfo byte blob on zTOC.
@@ -42,9 +46,30 @@ func newGzipZinfo(zinfoBytes []byte) (*GzipZinfo, error) {
 	if cZinfo == nil {
 		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
 	}
-	return &GzipZinfo{
+	zinfo := &GzipZinfo{
 		cZinfo: cZinfo,
-	}, nil
+	}
+	if err := zinfo.validate(); err != nil {
+		zinfo.Close()
+		return nil, err
+	}
+	return zinfo, nil
+}
+
+// validate checks that the checkpoints of a deserialized zinfo are usable, since the
+// offsets of spans are read from them without bounds checks. A zinfo without checkpoints
+// is valid, but it doesn't match any ztoc (see Ztoc.Zinfo).
+func (i *GzipZinfo) validate() error {
+	for id := SpanID(0); id <= i.MaxSpanID(); id++ {
+		if i.StartCompressedOffset(id) < 0 || i.StartUncompressedOffset(id) < 0 {
+			return fmt.Errorf("gzip zinfo checkpoint %d has a negative offset", id)
+		}
+		if id > 0 && (i.getCompressedOffset(id) < i.getCompressedOffset(id-1) ||
+			i.getUncompressedOffset(id) < i.getUncompressedOffset(id-1)) {
+			return fmt.Errorf("gzip zinfo checkpoint %d is out of order", id)
+		}
+	}
+	return nil
 }
 
 // newGzipZinfoFromFile creates a new instance of `GzipZinfo` given gzip file name and span size.
@@ -53,20 +78,111 @@ func newGzipZinfoFromFile(gzipFile string, spanSize int64) (*GzipZinfo, error) {
 	defer C.free(unsafe.Pointer(cstr))
 
 	var cZinfo *C.struct_gzip_zinfo
-	ret := C.generate_zinfo_from_file(cstr, C.off_t(spanSize), &cZinfo)
+	var aligned C.int
+	ret := C.generate_zinfo_from_file(cstr, C.off_t(spanSize), &cZinfo, &aligned)
 	if int(ret) < 0 {
 		return nil, fmt.Errorf("could not generate gzip zinfo. gzip error: %v", ret)
 	}
 
 	return &GzipZinfo{
-		cZinfo: cZinfo,
+		cZinfo:        cZinfo,
+		memberAligned: aligned != 0,
 	}, nil
 }
 
-// Close calls `C.free` on the pointer to `C.struct_gzip_zinfo`.
+// WriteGzipZinfoFromFile writes the zinfo of a gzip file, serialized as by `GzipZinfo.Bytes`,
+// to `zinfoFile`. Unlike `NewZinfoFromFile`, which keeps every checkpoint in memory, each
+// checkpoint is written as soon as it's generated, so that memory use doesn't grow with the
+// size of the gzip file. It returns whether the zinfo is member aligned (see `MemberAligned`).
+func WriteGzipZinfoFromFile(gzipFile string, spanSize int64, zinfoFile string) (bool, error) {
+	cGzipFile := C.CString(gzipFile)
+	defer C.free(unsafe.Pointer(cGzipFile))
+	cZinfoFile := C.CString(zinfoFile)
+	defer C.free(unsafe.Pointer(cZinfoFile))
+
+	var aligned C.int
+	ret := C.write_zinfo_from_file(cGzipFile, C.off_t(spanSize), cZinfoFile, &aligned)
+	if int(ret) < 0 {
+		return false, fmt.Errorf("could not write gzip zinfo. gzip error: %v", ret)
+	}
+	return aligned != 0, nil
+}
+
+// GzipSpans are the offsets of the spans of a zinfo serialized by `WriteGzipZinfoFromFile`. They
+// are read from the serialized zinfo as needed, rather than copied with the windows of its
+// checkpoints like `NewZinfo` does, which make up most of the zinfo.
+type GzipSpans []byte
+
+// NewGzipSpans returns the offsets of the spans of the serialized zinfo `zinfoBytes`.
+func NewGzipSpans(zinfoBytes []byte) (GzipSpans, error) {
+	if len(zinfoBytes) < C.BLOB_HEADER_SIZE {
+		return nil, fmt.Errorf("gzip zinfo of %d bytes has no header", len(zinfoBytes))
+	}
+	s := GzipSpans(zinfoBytes)
+	if n := int64(s.MaxSpanID()) + 1; n <= 0 || n*C.PACKED_CHECKPOINT_SIZE+C.BLOB_HEADER_SIZE != int64(len(zinfoBytes)) {
+		return nil, fmt.Errorf("gzip zinfo of %d bytes doesn't have %d checkpoints", len(zinfoBytes), n)
+	}
+	for id := SpanID(0); id <= s.MaxSpanID(); id++ {
+		if s.StartCompressedOffset(id) < 0 {
+			return nil, fmt.Errorf("gzip zinfo checkpoint %d has a negative offset", id)
+		}
+		if id > 0 && s.compressedOffset(id) < s.compressedOffset(id-1) {
+			return nil, fmt.Errorf("gzip zinfo checkpoint %d is out of order", id)
+		}
+	}
+	return s, nil
+}
+
+// MaxSpanID returns the max span ID.
+func (s GzipSpans) MaxSpanID() SpanID {
+	return SpanID(int32(binary.LittleEndian.Uint32(s))) - 1
+}
+
+// SpanSize returns the span size of the zinfo.
+func (s GzipSpans) SpanSize() Offset {
+	return Offset(binary.LittleEndian.Uint64(s[4:]))
+}
+
+// StartCompressedOffset returns the start offset of the span in the compressed stream.
+func (s GzipSpans) StartCompressedOffset(spanID SpanID) Offset {
+	start := s.compressedOffset(spanID)
+	if s.checkpoint(spanID)[16] != 0 {
+		start--
+	}
+	return start
+}
+
+// EndCompressedOffset returns the end offset of the span in the compressed stream. If
+// it's the last span, returns the size of the compressed stream.
+func (s GzipSpans) EndCompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == s.MaxSpanID() {
+		return fileSize
+	}
+	return s.compressedOffset(spanID + 1)
+}
+
+// checkpoint returns the checkpoint of a span, laid out as by `zinfo_to_blob`.
+func (s GzipSpans) checkpoint(spanID SpanID) []byte {
+	return s[C.BLOB_HEADER_SIZE+int64(spanID)*C.PACKED_CHECKPOINT_SIZE:]
+}
+
+func (s GzipSpans) compressedOffset(spanID SpanID) Offset {
+	return Offset(binary.LittleEndian.Uint64(s.checkpoint(spanID)))
+}
+
+// MemberAligned returns whether every span of a zinfo built from a gzip file starts a gzip
+// member, e.g. for layers written by AlignedGzipWriter, so that spans can be decompressed
+// without the data preceding them. It's false for deserialized zinfo.
+func (i *GzipZinfo) MemberAligned() bool {
+	return i.memberAligned
+}
+
+// Close calls `C.free_zinfo` on the pointer to `C.struct_gzip_zinfo`, which
+// frees its checkpoints too.
 func (i *GzipZinfo) Close() {
 	if i.cZinfo != nil {
-		C.free(unsafe.Pointer(i.cZinfo))
+		C.free_zinfo(i.cZinfo)
+		i.cZinfo = nil
 	}
 }
 
@@ -109,9 +109,11 @@ int         has_bits(struct gzip_zinfo *index, int checkpoint);
 // zinfo - metadata ends.
 
 // zinfo - generation/extraction starts.
-int generate_zinfo_from_file(const char* filepath, offset_t span, struct gzip_zinfo** index);
+int generate_zinfo_from_file(const char* filepath, offset_t span, struct gzip_zinfo** index, int* aligned);
+int write_zinfo_from_file(const char* filepath, offset_t span, const char* zinfo_path, int* aligned);
 int extract_data_from_file(const char* file, struct gzip_zinfo* index, offset_t offset, void* buf, int len);
 int extract_data_from_buffer(void* d, offset_t datalen, struct gzip_zinfo* index, offset_t offset, void* buffer, offset_t len, int first_checkpoint);
+void free_zinfo(struct gzip_zinfo* index);
 // zinfo - generation/extraction ends.
 
 // zinfo -  zinfo <-> blob conversion starts.
@@ -17,6 +17,9 @@
 package compression
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -169,3 +172,73 @@ func TestExtractDataFromFile(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteGzipZinfoFromFile(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name       string
+		size       int
+		memberSize int
+	}{
+		{name: "less than a span", size: testSpanSize / 2, memberSize: testSpanSize},
+		{name: "single member", size: 6 * testSpanSize, memberSize: 6 * testSpanSize},
+		{name: "small members", size: 6 * testSpanSize, memberSize: testSpanSize / 3},
+		{name: "span members", size: 6*testSpanSize + 1, memberSize: testSpanSize},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			path := writeGzipFile(t, compressibleData(tc.size), tc.memberSize)
+			zinfo, err := newGzipZinfoFromFile(path, testSpanSize)
+			if err != nil {
+				t.Fatalf("failed to build zinfo: %v", err)
+			}
+			defer zinfo.Close()
+			want, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize zinfo: %v", err)
+			}
+
+			zinfoPath := filepath.Join(t.TempDir(), "zinfo")
+			aligned, err := WriteGzipZinfoFromFile(path, testSpanSize, zinfoPath)
+			if err != nil {
+				t.Fatalf("failed to write zinfo: %v", err)
+			}
+			if aligned != zinfo.MemberAligned() {
+				t.Fatalf("unexpected member alignment: got %t, want %t", aligned, zinfo.MemberAligned())
+			}
+			got, err := os.ReadFile(zinfoPath)
+			if err != nil {
+				t.Fatalf("failed to read zinfo: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("written zinfo of %d bytes doesn't match the serialized zinfo of %d bytes", len(got), len(want))
+			}
+
+			// The offsets of spans read from the written zinfo match those of the zinfo.
+			spans, err := NewGzipSpans(got)
+			if err != nil {
+				t.Fatalf("failed to read spans: %v", err)
+			}
+			if spans.MaxSpanID() != zinfo.MaxSpanID() || spans.SpanSize() != zinfo.SpanSize() {
+				t.Fatalf("unexpected spans; got %d of %d bytes, want %d of %d bytes", spans.MaxSpanID(), spans.SpanSize(), zinfo.MaxSpanID(), zinfo.SpanSize())
+			}
+			for id := SpanID(0); id <= zinfo.MaxSpanID(); id++ {
+				if spans.StartCompressedOffset(id) != zinfo.StartCompressedOffset(id) || spans.EndCompressedOffset(id, 1<<20) != zinfo.EndCompressedOffset(id, 1<<20) {
+					t.Fatalf("unexpected offsets of span %d", id)
+				}
+			}
+			if _, err := NewGzipSpans(got[:len(got)-1]); err == nil {
+				t.Fatalf("expected an error for truncated spans")
+			}
+		})
+	}
+
+	t.Run("invalid gzip file", func(t *testing.T) {
+		path := writeTestFile(t, []byte("not a gzip file"))
+		if _, err := WriteGzipZinfoFromFile(path, testSpanSize, filepath.Join(t.TempDir(), "zinfo")); err == nil {
+			t.Fatalf("expected an error for an invalid gzip file")
+		}
+	})
+}
@@ -45,7 +45,7 @@ func newTarZinfo(zinfoBytes []byte) (zinfo *TarZinfo, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			zinfo = nil
-			err = fmt.Errorf("cannot unmarshal tar zinfo: %w", err)
+			err = fmt.Errorf("cannot unmarshal tar zinfo: %v", r)
 		}
 	}()
 
@@ -54,6 +54,9 @@ func newTarZinfo(zinfoBytes []byte) (zinfo *TarZinfo, err error) {
 	zinfo.version = zinfoFlatbuf.Version()
 	zinfo.spanSize = zinfoFlatbuf.SpanSize()
 	zinfo.size = zinfoFlatbuf.Size()
+	if zinfo.spanSize <= 0 || zinfo.size <= 0 {
+		return nil, fmt.Errorf("invalid tar zinfo: span size %d, size %d", zinfo.spanSize, zinfo.size)
+	}
 
 	return zinfo, nil
 }
@@ -108,8 +108,32 @@ func (rcv *CompressionInfo) MutateCheckpoints(j int, n byte) bool {
 	return false
 }
 
+func (rcv *CompressionInfo) SpanSize() int64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(12))
+	if o != 0 {
+		return rcv._tab.GetInt64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *CompressionInfo) MutateSpanSize(n int64) bool {
+	return rcv._tab.MutateInt64Slot(12, n)
+}
+
+func (rcv *CompressionInfo) SpanAligned() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(14))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *CompressionInfo) MutateSpanAligned(n bool) bool {
+	return rcv._tab.MutateBoolSlot(14, n)
+}
+
 func CompressionInfoStart(builder *flatbuffers.Builder) {
-	builder.StartObject(4)
+	builder.StartObject(6)
 }
 func CompressionInfoAddCompressionAlgorithm(builder *flatbuffers.Builder, compressionAlgorithm CompressionAlgorithm) {
 	builder.PrependInt8Slot(0, int8(compressionAlgorithm), 1)
@@ -129,6 +153,12 @@ func CompressionInfoAddCheckpoints(builder *flatbuffers.Builder, checkpoints fla
 func CompressionInfoStartCheckpointsVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(1, numElems, 1)
 }
+func CompressionInfoAddSpanSize(builder *flatbuffers.Builder, spanSize int64) {
+	builder.PrependInt64Slot(4, spanSize, 0)
+}
+func CompressionInfoAddSpanAligned(builder *flatbuffers.Builder, spanAligned bool) {
+	builder.PrependBoolSlot(5, spanAligned, false)
+}
 func CompressionInfoEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
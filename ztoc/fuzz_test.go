@@ -0,0 +1,220 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// The fuzz targets below run their seeds with `go test`. To fuzz one of them, run e.g.
+// `go test ./ztoc -run '^$' -fuzz FuzzUnmarshal`.
+
+// seedZtocs returns serialized ztocs of gzip and uncompressed layers.
+func seedZtocs(f *testing.F) [][]byte {
+	entries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file", string(testutil.RandomByteData(100000))),
+		testutil.Symlink("dir/link", "file"),
+		testutil.File("empty", ""),
+	}
+	gzipZtoc, _, err := BuildZtocReader(f, entries, gzip.DefaultCompression, 16384)
+	if err != nil {
+		f.Fatal(err)
+	}
+	tarFile, _, err := testutil.WriteTarToTempFile("fuzz.*.tar", testutil.BuildTar(entries))
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer os.Remove(tarFile)
+	tarZtoc, err := NewBuilder("test").BuildZtoc(tarFile, 16384, WithCompression(compression.Uncompressed))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	var seeds [][]byte
+	for _, zt := range []*Ztoc{gzipZtoc, tarZtoc} {
+		r, _, err := Marshal(zt)
+		if err != nil {
+			f.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, b)
+	}
+	return seeds
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, seed := range seedZtocs(f) {
+		f.Add(seed)
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		zt, err := Unmarshal(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if err := zt.Validate(); err != nil {
+			t.Fatalf("unmarshaled invalid ztoc: %v", err)
+		}
+		if _, err := zt.Zinfo(); err != nil {
+			return
+		}
+		CheckSpans(t, zt)
+	})
+}
+
+// FuzzZinfo fuzzes the checkpoints of a valid ztoc, which are parsed by C code.
+func FuzzZinfo(f *testing.F) {
+	for _, seed := range seedZtocs(f) {
+		zt, err := Unmarshal(bytes.NewReader(seed))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(zt.CompressionAlgorithm, zt.Checkpoints, int64(zt.CompressedArchiveSize), int64(zt.UncompressedArchiveSize))
+	}
+	f.Fuzz(func(t *testing.T, algorithm string, checkpoints []byte, compressedSize, uncompressedSize int64) {
+		zinfo, err := compression.NewZinfo(algorithm, checkpoints)
+		if err != nil {
+			return
+		}
+		maxSpanID := zinfo.MaxSpanID()
+		zinfo.Close()
+		// Ztocs must have a digest per span, which bounds the number of spans to check.
+		if maxSpanID < 0 || maxSpanID > 1<<16 {
+			return
+		}
+		zt := &Ztoc{
+			CompressionInfo: CompressionInfo{
+				MaxSpanID:            maxSpanID,
+				SpanDigests:          make([]digest.Digest, maxSpanID+1),
+				Checkpoints:          checkpoints,
+				CompressionAlgorithm: algorithm,
+			},
+			CompressedArchiveSize:   compression.Offset(compressedSize),
+			UncompressedArchiveSize: compression.Offset(uncompressedSize),
+		}
+		for i := range zt.SpanDigests {
+			zt.SpanDigests[i] = digest.FromString(fmt.Sprint(i))
+		}
+		if zt.Validate() != nil {
+			return
+		}
+		if _, err := zt.Zinfo(); err != nil {
+			return
+		}
+		CheckSpans(t, zt)
+	})
+}
+
+func FuzzMetadataFromTarReader(f *testing.F) {
+	for _, entries := range [][]testutil.TarEntry{
+		{testutil.File("file", "contents")},
+		{
+			testutil.Dir("dir/"),
+			testutil.File("dir/file", string(testutil.RandomByteData(3000))),
+			testutil.Link("dir/hardlink", "dir/file"),
+			testutil.Symlink("dir/symlink", "file"),
+			testutil.Fifo("fifo"),
+		},
+	} {
+		b, err := io.ReadAll(testutil.BuildTar(entries))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		md, size, err := metadataFromTarReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if size > compression.Offset(len(data)) {
+			t.Fatalf("archive of %d bytes has size %d", len(data), size)
+		}
+		var prevEnd compression.Offset
+		for _, m := range md {
+			if m.UncompressedOffset < prevEnd || m.UncompressedSize < 0 || m.UncompressedOffset+m.UncompressedSize > size {
+				t.Fatalf("entry %q at %d+%d overlaps the previous entry or is outside of the archive of %d bytes",
+					m.Name, m.UncompressedOffset, m.UncompressedSize, size)
+			}
+			prevEnd = m.UncompressedOffset + m.UncompressedSize
+		}
+	})
+}
+
+// FuzzBuildZtoc checks the properties of the ztocs of random layers: they survive serialization,
+// their spans are consistent and every file can be extracted from the layer with them.
+func FuzzBuildZtoc(f *testing.F) {
+	f.Add(int64(1), uint8(1), uint16(0))
+	f.Add(int64(2), uint8(10), uint16(4096))
+	f.Add(int64(3), uint8(30), uint16(65535))
+	f.Fuzz(func(t *testing.T, seed int64, numFiles uint8, spanSize uint16) {
+		rnd := rand.New(rand.NewSource(seed))
+		contents := make(map[string][]byte)
+		var entries []testutil.TarEntry
+		for i := 0; i < int(numFiles%32)+1; i++ {
+			name := fmt.Sprintf("file%d", i)
+			b := make([]byte, rnd.Intn(1<<17))
+			rnd.Read(b[:len(b)/2]) // half random, half compressible
+			contents[name] = b
+			entries = append(entries, testutil.File(name, string(b)))
+		}
+		zt, r, err := BuildZtocReader(t, entries, gzip.DefaultCompression, int64(spanSize)+1024)
+		if err != nil {
+			t.Fatalf("failed to build ztoc: %v", err)
+		}
+		if err := zt.Validate(); err != nil {
+			t.Fatalf("built invalid ztoc: %v", err)
+		}
+		CheckSpans(t, zt)
+
+		serialized, desc, err := Marshal(zt)
+		if err != nil {
+			t.Fatalf("failed to marshal ztoc: %v", err)
+		}
+		unmarshaled, err := Unmarshal(serialized)
+		if err != nil {
+			t.Fatalf("failed to unmarshal ztoc: %v", err)
+		}
+		if _, desc2, err := Marshal(unmarshaled); err != nil || desc2.Digest != desc.Digest {
+			t.Fatalf("ztoc changed after serialization: %v", err)
+		}
+
+		for name, expected := range contents {
+			got, err := unmarshaled.ExtractFile(r, name)
+			if err != nil {
+				t.Fatalf("failed to extract %s: %v", name, err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Fatalf("unexpected contents of %s", name)
+			}
+		}
+	})
+}
@@ -24,10 +24,11 @@ import (
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 )
 
 // BuildZtocReader creates the tar gz file for tar entries. It returns ztoc and io.SectionReader of the file.
-func BuildZtocReader(_ *testing.T, ents []testutil.TarEntry, compressionLevel int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+func BuildZtocReader(_ testing.TB, ents []testutil.TarEntry, compressionLevel int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
 	tarReader := testutil.BuildTarGz(ents, compressionLevel, opts...)
 
 	tarFileName, tarData, err := testutil.WriteTarToTempFile("tmp.*", tarReader)
@@ -43,3 +44,100 @@ func BuildZtocReader(_ *testing.T, ents []testutil.TarEntry, compressionLevel in
 	}
 	return ztoc, sr, nil
 }
+
+// BuildAlignedZtocReader is like BuildZtocReader, but the layer is compressed by
+// compression.AlignedGzipWriter, so that every span of the ztoc starts a gzip member.
+func BuildAlignedZtocReader(_ testing.TB, ents []testutil.TarEntry, compressionLevel int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+	var buf bytes.Buffer
+	aw, err := compression.NewAlignedGzipWriter(&buf, spanSize, compressionLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(aw, testutil.BuildTar(ents, opts...)); err != nil {
+		return nil, nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	tarFileName, tarData, err := testutil.WriteTarToTempFile("tmp.*", &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tarFileName)
+
+	sr := io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData)))
+	ztoc, err := NewBuilder("test").BuildZtoc(tarFileName, spanSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build sample ztoc: %v", err)
+	}
+	return ztoc, sr, nil
+}
+
+// BuildUncompressedZtocReader is like BuildZtocReader, but the layer is an uncompressed tar archive.
+func BuildUncompressedZtocReader(_ testing.TB, ents []testutil.TarEntry, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+	tarFileName, tarData, err := testutil.WriteTarToTempFile("tmp.*", testutil.BuildTar(ents, opts...))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tarFileName)
+
+	sr := io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData)))
+	ztoc, err := NewBuilder("test").BuildZtoc(tarFileName, spanSize, WithCompression(compression.Uncompressed))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build sample ztoc: %v", err)
+	}
+	return ztoc, sr, nil
+}
+
+// CheckSpans checks the properties of the span arithmetic of a valid ztoc: the spans are
+// ordered and cover the compressed and uncompressed archives, every span contains the
+// uncompressed offsets it starts and ends with, and every file is within the spans.
+// Ztocs fetched from registries are only usable if they have these properties.
+func CheckSpans(t testing.TB, zt *Ztoc) {
+	t.Helper()
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		t.Fatalf("failed to get zinfo: %v", err)
+	}
+	defer zinfo.Close()
+
+	var prevCompEnd, prevUncompEnd compression.Offset
+	for id := compression.SpanID(0); id <= zt.MaxSpanID; id++ {
+		compStart, compEnd := zinfo.StartCompressedOffset(id), zinfo.EndCompressedOffset(id, zt.CompressedArchiveSize)
+		uncompStart, uncompEnd := zinfo.StartUncompressedOffset(id), zinfo.EndUncompressedOffset(id, zt.UncompressedArchiveSize)
+		if compStart < 0 || compStart > compEnd || compEnd > zt.CompressedArchiveSize {
+			t.Fatalf("invalid compressed range of span %d: %d-%d of %d bytes", id, compStart, compEnd, zt.CompressedArchiveSize)
+		}
+		if uncompStart < 0 || uncompStart > uncompEnd || uncompEnd > zt.UncompressedArchiveSize {
+			t.Fatalf("invalid uncompressed range of span %d: %d-%d of %d bytes", id, uncompStart, uncompEnd, zt.UncompressedArchiveSize)
+		}
+		// A span may start with the last byte of the previous span (see GzipZinfo.StartCompressedOffset).
+		if id > 0 && (compStart < prevCompEnd-1 || compStart > prevCompEnd) {
+			t.Fatalf("span %d starts at %d, but span %d ends at %d", id, compStart, id-1, prevCompEnd)
+		}
+		if id > 0 && uncompStart != prevUncompEnd {
+			t.Fatalf("span %d starts at uncompressed offset %d, but span %d ends at %d", id, uncompStart, id-1, prevUncompEnd)
+		}
+		if uncompStart < uncompEnd {
+			if got := zinfo.UncompressedOffsetToSpanID(uncompStart); got != id {
+				t.Fatalf("uncompressed offset %d is in span %d, expected %d", uncompStart, got, id)
+			}
+			if got := zinfo.UncompressedOffsetToSpanID(uncompEnd - 1); got != id {
+				t.Fatalf("uncompressed offset %d is in span %d, expected %d", uncompEnd-1, got, id)
+			}
+		}
+		prevCompEnd, prevUncompEnd = compEnd, uncompEnd
+	}
+	if prevUncompEnd != zt.UncompressedArchiveSize {
+		t.Fatalf("spans end at uncompressed offset %d, expected %d", prevUncompEnd, zt.UncompressedArchiveSize)
+	}
+	for _, f := range zt.FileMetadata {
+		if f.UncompressedSize == 0 {
+			continue
+		}
+		if id := zinfo.UncompressedOffsetToSpanID(f.UncompressedOffset + f.UncompressedSize - 1); id < 0 || id > zt.MaxSpanID {
+			t.Fatalf("file %q ends in span %d of %d spans", f.Name, id, zt.MaxSpanID+1)
+		}
+	}
+}
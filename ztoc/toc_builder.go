@@ -150,6 +150,15 @@ func metadataFromTarReader(r io.Reader) ([]FileMetadata, compression.Offset, err
 			Devminor:           hdr.Devminor,
 			Xattrs:             hdr.PAXRecords,
 		}
+		// The data of the entry must be stored contiguously after its header, since it's
+		// read from the archive at its offset. This isn't the case for sparse files.
+		if _, err := io.Copy(io.Discard, tarRdr); err != nil {
+			return nil, 0, fmt.Errorf("error while reading tar entry %q: %w", hdr.Name, err)
+		}
+		if stored := pt.CurrentPos() - metadataEntry.UncompressedOffset; stored != metadataEntry.UncompressedSize {
+			return nil, 0, fmt.Errorf("unsupported input tar entry %q: %d bytes stored for %d bytes of data",
+				hdr.Name, stored, metadataEntry.UncompressedSize)
+		}
 		md = append(md, metadataEntry)
 	}
 	return md, pt.CurrentPos(), nil
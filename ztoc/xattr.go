@@ -0,0 +1,77 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+)
+
+const (
+	// paxSchilyXattr is the prefix of the PAX records holding extended attributes, as written by
+	// GNU tar, Go's archive/tar and most image builders.
+	paxSchilyXattr = "SCHILY.xattr."
+	// paxLibarchiveXattr is the prefix of the PAX records holding extended attributes written by
+	// libarchive (e.g. bsdtar), whose names are URL-encoded and whose values are base64-encoded.
+	paxLibarchiveXattr = "LIBARCHIVE.xattr."
+)
+
+// xattrNamespaces are the namespaces of the extended attributes of Linux. zTOCs built by other tools
+// may hold extended attributes without a PAX prefix, which are recognized by their namespace.
+var xattrNamespaces = []string{"security.", "system.", "trusted.", "user."}
+
+// ExtendedAttributes returns the extended attributes of the file, decoded from the PAX records of its
+// tar header which Xattrs holds. The records which aren't extended attributes (e.g. the paths and
+// sub-second timestamps which don't fit in the tar header) are skipped. When libarchive records an
+// attribute in both forms, the SCHILY.xattr one is used.
+func (src FileMetadata) ExtendedAttributes() map[string][]byte {
+	xattrs := make(map[string][]byte)
+	for k, v := range src.Xattrs {
+		if strings.HasPrefix(k, paxLibarchiveXattr) {
+			name, err := url.PathUnescape(strings.TrimPrefix(k, paxLibarchiveXattr))
+			if err != nil {
+				continue
+			}
+			value, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+			if err != nil {
+				continue
+			}
+			if _, ok := src.Xattrs[paxSchilyXattr+name]; !ok {
+				xattrs[name] = value
+			}
+		}
+	}
+	for k, v := range src.Xattrs {
+		switch {
+		case strings.HasPrefix(k, paxSchilyXattr):
+			xattrs[strings.TrimPrefix(k, paxSchilyXattr)] = []byte(v)
+		case isXattrName(k):
+			xattrs[k] = []byte(v)
+		}
+	}
+	return xattrs
+}
+
+func isXattrName(name string) bool {
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(name, ns) && len(name) > len(ns) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestExtendedAttributes(t *testing.T) {
+	capability := string([]byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	testCases := []struct {
+		name    string
+		records map[string]string
+		want    map[string][]byte
+	}{
+		{
+			name:    "no records",
+			records: nil,
+			want:    map[string][]byte{},
+		},
+		{
+			name: "schily xattrs",
+			records: map[string]string{
+				"SCHILY.xattr.security.capability": capability,
+				"SCHILY.xattr.security.selinux":    "system_u:object_r:bin_t:s0\x00",
+				"SCHILY.xattr.user.foo":            "bar",
+			},
+			want: map[string][]byte{
+				"security.capability": []byte(capability),
+				"security.selinux":    []byte("system_u:object_r:bin_t:s0\x00"),
+				"user.foo":            []byte("bar"),
+			},
+		},
+		{
+			name: "libarchive xattrs",
+			records: map[string]string{
+				"LIBARCHIVE.xattr.user.a%3Db":          base64.StdEncoding.EncodeToString([]byte("value")),
+				"LIBARCHIVE.xattr.security.capability": base64.RawStdEncoding.EncodeToString([]byte(capability)),
+			},
+			want: map[string][]byte{
+				"user.a=b":            []byte("value"),
+				"security.capability": []byte(capability),
+			},
+		},
+		{
+			name: "schily takes precedence over libarchive",
+			records: map[string]string{
+				"SCHILY.xattr.user.foo":     "schily",
+				"LIBARCHIVE.xattr.user.foo": base64.StdEncoding.EncodeToString([]byte("libarchive")),
+			},
+			want: map[string][]byte{
+				"user.foo": []byte("schily"),
+			},
+		},
+		{
+			name: "bare xattr names",
+			records: map[string]string{
+				"trusted.overlay.opaque": "y",
+				"user.":                  "empty name",
+			},
+			want: map[string][]byte{
+				"trusted.overlay.opaque": []byte("y"),
+			},
+		},
+		{
+			name: "other pax records are skipped",
+			records: map[string]string{
+				"path":                      "a/very/long/path",
+				"mtime":                     "1234567890.123456789",
+				"GNU.sparse.major":          "1",
+				"LIBARCHIVE.xattr.user.bad": "!!!",
+			},
+			want: map[string][]byte{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := FileMetadata{Xattrs: tc.records}.ExtendedAttributes()
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected extended attributes: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -20,9 +20,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
 )
 
 // ZinfoBuilder builds the `zinfo` part of a ztoc. This interface should be
@@ -36,36 +39,94 @@ type gzipZinfoBuilder struct{}
 
 // ZinfoFromFile creates zinfo for a gzip file. The underlying zinfo object (i.e. `GzipZinfo`)
 // is stored in `CompressionInfo.Checkpoints` as byte slice.
+//
+// The checkpoints are written to a temporary file next to the gzip file while it's inflated,
+// which is then mapped rather than read into memory, and the offsets of spans are read from
+// the mapping, so that memory use is bounded by neither the size of the layer nor that of the
+// zinfo.
 func (gzb gzipZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
-	index, err := compression.NewZinfoFromFile(compression.Gzip, filename, spanSize)
+	checkpoints, aligned, err := writeGzipCheckpoints(filename, spanSize)
 	if err != nil {
 		return
 	}
-	defer index.Close()
 
-	fs, err = getFileSize(filename)
+	spans, err := compression.NewGzipSpans(checkpoints.data)
 	if err != nil {
 		return
 	}
 
-	digests, err := getPerSpanDigests(filename, int64(fs), index)
+	fs, err = getFileSize(filename)
 	if err != nil {
 		return
 	}
 
-	checkpoints, err := index.Bytes()
+	digests, err := getPerSpanDigests(filename, int64(fs), spans)
 	if err != nil {
 		return
 	}
 
 	return CompressionInfo{
-		MaxSpanID:            index.MaxSpanID(),
+		MaxSpanID:            spans.MaxSpanID(),
 		SpanDigests:          digests,
-		Checkpoints:          checkpoints,
+		Checkpoints:          checkpoints.data,
+		SpanSize:             spans.SpanSize(),
+		SpanAligned:          aligned,
 		CompressionAlgorithm: compression.Gzip,
+		checkpoints:          checkpoints,
 	}, fs, nil
 }
 
+// writeGzipCheckpoints returns the mapped zinfo of a gzip file and whether it's member aligned.
+func writeGzipCheckpoints(filename string, spanSize int64) (*mappedCheckpoints, bool, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "zinfo.*")
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create zinfo file: %w", err)
+	}
+	// The mapping outlives the file.
+	defer os.Remove(tmp.Name())
+	if err := tmp.Close(); err != nil {
+		return nil, false, err
+	}
+
+	aligned, err := compression.WriteGzipZinfoFromFile(filename, spanSize, tmp.Name())
+	if err != nil {
+		return nil, false, err
+	}
+	checkpoints, err := mapCheckpoints(tmp.Name())
+	if err != nil {
+		return nil, false, fmt.Errorf("could not map zinfo file: %w", err)
+	}
+	return checkpoints, aligned, nil
+}
+
+// mappedCheckpoints are checkpoints mapped from a file, whose pages are read and dropped by the
+// kernel as needed. They are unmapped once unreachable, so they must be kept reachable, e.g. by
+// the `CompressionInfo` they belong to, while they are read.
+type mappedCheckpoints struct {
+	data []byte
+}
+
+func mapCheckpoints(name string) (*mappedCheckpoints, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(st.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	m := &mappedCheckpoints{data: data}
+	runtime.SetFinalizer(m, func(m *mappedCheckpoints) {
+		unix.Munmap(m.data)
+	})
+	return m, nil
+}
+
 type tarZinfoBuilder struct{}
 
 func (tzb tarZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
@@ -94,11 +155,19 @@ func (tzb tarZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo
 		MaxSpanID:            index.MaxSpanID(),
 		SpanDigests:          digests,
 		Checkpoints:          checkpoints,
+		SpanSize:             index.SpanSize(),
 		CompressionAlgorithm: compression.Uncompressed,
 	}, fs, nil
 }
 
-func getPerSpanDigests(filename string, fileSize int64, index compression.Zinfo) ([]digest.Digest, error) {
+// spans are the offsets of the spans of a zinfo, e.g. a `compression.Zinfo`.
+type spans interface {
+	MaxSpanID() compression.SpanID
+	StartCompressedOffset(spanID compression.SpanID) compression.Offset
+	EndCompressedOffset(spanID compression.SpanID, fileSize compression.Offset) compression.Offset
+}
+
+func getPerSpanDigests(filename string, fileSize int64, index spans) ([]digest.Digest, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("could not open file for reading: %w", err)
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 	"time"
 
 	"github.com/opencontainers/go-digest"
@@ -61,6 +62,15 @@ type CompressionInfo struct {
 	SpanDigests          []digest.Digest
 	Checkpoints          []byte
 	CompressionAlgorithm string
+	// SpanSize is the uncompressed size of the spans, except the last one. It's 0 for ztocs
+	// built before it was recorded.
+	SpanSize compression.Offset
+	// SpanAligned is true if every span starts a gzip member, so that spans are decompressed
+	// without the data preceding them.
+	SpanAligned bool
+
+	// checkpoints keeps Checkpoints mapped if they are mapped from a file, e.g. by BuildZtoc.
+	checkpoints *mappedCheckpoints
 }
 
 // TOC is the "ztoc" part of ztoc including metadata of all files in the compressed
@@ -86,6 +96,8 @@ type FileMetadata struct {
 	Devmajor int64     // Major device number (valid for TypeChar or TypeBlock)
 	Devminor int64     // Minor device number (valid for TypeChar or TypeBlock)
 
+	// Xattrs are the PAX records of the tar header of the file. The extended attributes of the
+	// file are decoded from them by ExtendedAttributes.
 	Xattrs map[string]string
 }
 
@@ -221,7 +233,59 @@ func (zt Ztoc) ExtractFromTarGz(gz string, filename string) (string, error) {
 }
 
 // Zinfo deserilizes and returns a Zinfo based on the zinfo bytes and compression
-// algorithm in the ztoc.
+// algorithm in the ztoc. It returns an error if the spans of the zinfo don't match the ztoc.
 func (zt Ztoc) Zinfo() (compression.Zinfo, error) {
-	return compression.NewZinfo(zt.CompressionAlgorithm, zt.Checkpoints)
+	zinfo, err := compression.NewZinfo(zt.CompressionAlgorithm, zt.Checkpoints)
+	runtime.KeepAlive(zt.checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	if err := zt.validateZinfo(zinfo); err != nil {
+		zinfo.Close()
+		return nil, err
+	}
+	return zinfo, nil
+}
+
+// Validate checks that the sizes, offsets and span digests of the ztoc are consistent,
+// so that a malformed ztoc (e.g. fetched from a registry) is rejected before any of
+// them is used to index spans or read the layer.
+func (zt Ztoc) Validate() error {
+	if zt.CompressedArchiveSize < 0 || zt.UncompressedArchiveSize < 0 {
+		return fmt.Errorf("invalid ztoc: negative archive size")
+	}
+	if zt.MaxSpanID < 0 {
+		return fmt.Errorf("invalid ztoc: negative max span id %d", zt.MaxSpanID)
+	}
+	if len(zt.SpanDigests) != int(zt.MaxSpanID)+1 {
+		return fmt.Errorf("invalid ztoc: %d span digests for %d spans", len(zt.SpanDigests), zt.MaxSpanID+1)
+	}
+	for i, dgst := range zt.SpanDigests {
+		if err := dgst.Validate(); err != nil {
+			return fmt.Errorf("invalid ztoc: invalid digest of span %d: %w", i, err)
+		}
+	}
+	if len(zt.Checkpoints) == 0 {
+		return fmt.Errorf("invalid ztoc: no checkpoints")
+	}
+	for _, f := range zt.FileMetadata {
+		if f.UncompressedOffset < 0 || f.UncompressedSize < 0 ||
+			f.UncompressedSize > zt.UncompressedArchiveSize-f.UncompressedOffset {
+			return fmt.Errorf("invalid ztoc: file %q at %d+%d is outside of the archive of %d bytes",
+				f.Name, f.UncompressedOffset, f.UncompressedSize, zt.UncompressedArchiveSize)
+		}
+	}
+	return nil
+}
+
+// validateZinfo checks that the spans of zinfo are the spans of the ztoc.
+func (zt Ztoc) validateZinfo(zinfo compression.Zinfo) error {
+	if zinfo.MaxSpanID() != zt.MaxSpanID {
+		return fmt.Errorf("invalid ztoc: zinfo has %d spans, expected %d", zinfo.MaxSpanID()+1, zt.MaxSpanID+1)
+	}
+	if zinfo.StartCompressedOffset(zt.MaxSpanID) > zt.CompressedArchiveSize ||
+		zinfo.StartUncompressedOffset(zt.MaxSpanID) > zt.UncompressedArchiveSize {
+		return fmt.Errorf("invalid ztoc: last span starts outside of the archive")
+	}
+	return nil
 }
@@ -50,7 +50,9 @@ func NewBuilder(buildToolIdentifier string) *Builder {
 
 // buildConfig contains configuration used when `ztoc.Builder` builds a `Ztoc`.
 type buildConfig struct {
-	algorithm string
+	algorithm               string
+	toc                     *TOC
+	uncompressedArchiveSize compression.Offset
 }
 
 // BuildOption specifies a change to `buildConfig` when building a ztoc.
@@ -64,6 +66,16 @@ func WithCompression(algorithm string) BuildOption {
 	}
 }
 
+// WithTOC specifies the TOC of the layer, e.g. built from the TOC of an eStargz layer, and the
+// size of its uncompressed archive, so that the TOC isn't built from the files of the layer.
+func WithTOC(toc TOC, uncompressedArchiveSize compression.Offset) BuildOption {
+	return func(opt *buildConfig) error {
+		opt.toc = &toc
+		opt.uncompressedArchiveSize = uncompressedArchiveSize
+		return nil
+	}
+}
+
 // defaultBuildConfig creates a `buildConfig` with default values.
 func defaultBuildConfig() buildConfig {
 	return buildConfig{
@@ -95,8 +107,13 @@ func (b *Builder) BuildZtoc(filename string, span int64, options ...BuildOption)
 		return nil, err
 	}
 
-	toc, uncompressedArchiveSize, err := b.tocBuilder.TocFromFile(opt.algorithm, filename)
-	if err != nil {
+	var (
+		toc                     TOC
+		uncompressedArchiveSize compression.Offset
+	)
+	if opt.toc != nil {
+		toc, uncompressedArchiveSize = *opt.toc, opt.uncompressedArchiveSize
+	} else if toc, uncompressedArchiveSize, err = b.tocBuilder.TocFromFile(opt.algorithm, filename); err != nil {
 		return nil, err
 	}
 
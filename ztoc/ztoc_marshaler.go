@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"runtime"
 	"sort"
 	"strings"
 	"time"
@@ -31,6 +32,10 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// fileMetadataSizeHint is the estimated size of a serialized `FileMetadata`, used to size
+// the flatbuffers builder.
+const fileMetadataSizeHint = 256
+
 // Marshal serializes Ztoc to its flatbuffers schema and returns a reader along with the descriptor (digest and size only).
 // If not successful, it will return an error.
 func Marshal(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
@@ -50,13 +55,21 @@ func Marshal(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
 
 // Unmarshal takes the reader with flatbuffers byte stream and deserializes it ztoc.
 // In case if there's any error situation during deserialization from flatbuffers, there will be an error returned.
+// Since ztocs are fetched from registries, the deserialized ztoc is validated (see Ztoc.Validate).
 func Unmarshal(serializedZtoc io.Reader) (*Ztoc, error) {
 	flatbuf, err := io.ReadAll(serializedZtoc)
 	if err != nil {
 		return nil, err
 	}
 
-	return flatbufToZtoc(flatbuf)
+	ztoc, err := flatbufToZtoc(flatbuf)
+	if err != nil {
+		return nil, err
+	}
+	if err := ztoc.Validate(); err != nil {
+		return nil, err
+	}
+	return ztoc, nil
 }
 
 func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
@@ -125,6 +138,8 @@ func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
 		ztoc.SpanDigests[i] = dgst
 	}
 	ztoc.Checkpoints = compressionInfo.CheckpointsBytes()
+	ztoc.SpanSize = compression.Offset(compressionInfo.SpanSize())
+	ztoc.SpanAligned = compressionInfo.SpanAligned()
 	ztoc.CompressionAlgorithm = strings.ToLower(compressionInfo.CompressionAlgorithm().String())
 	return ztoc, nil
 }
@@ -138,7 +153,9 @@ func ztocToFlatbuffer(ztoc *Ztoc) (fb []byte, err error) {
 	}()
 
 	// ztoc - metadata
-	builder := flatbuffers.NewBuilder(0)
+	// The builder is sized upfront since growing it copies its whole buffer, which is mostly
+	// made of the checkpoints for large layers.
+	builder := flatbuffers.NewBuilder(len(ztoc.Checkpoints) + len(ztoc.FileMetadata)*fileMetadataSizeHint)
 	version := builder.CreateString(string(ztoc.Version))
 	buildToolIdentifier := builder.CreateString(ztoc.BuildToolIdentifier)
 
@@ -161,6 +178,7 @@ func ztocToFlatbuffer(ztoc *Ztoc) (fb []byte, err error) {
 
 	// ztoc - zinfo
 	checkpointsVector := builder.CreateByteVector(ztoc.Checkpoints)
+	runtime.KeepAlive(ztoc.checkpoints)
 	spanDigestsOffsets := make([]flatbuffers.UOffsetT, 0, len(ztoc.SpanDigests))
 	for _, spanDigest := range ztoc.SpanDigests {
 		off := builder.CreateString(spanDigest.String())
@@ -176,6 +194,8 @@ func ztocToFlatbuffer(ztoc *Ztoc) (fb []byte, err error) {
 	ztoc_flatbuffers.CompressionInfoAddMaxSpanId(builder, int32(ztoc.MaxSpanID))
 	ztoc_flatbuffers.CompressionInfoAddSpanDigests(builder, spanDigests)
 	ztoc_flatbuffers.CompressionInfoAddCheckpoints(builder, checkpointsVector)
+	ztoc_flatbuffers.CompressionInfoAddSpanSize(builder, int64(ztoc.SpanSize))
+	ztoc_flatbuffers.CompressionInfoAddSpanAligned(builder, ztoc.SpanAligned)
 
 	// only add (and check) compression algorithm if not empty;
 	// if empty, use Gzip as defined in ztoc flatbuf.
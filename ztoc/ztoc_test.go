@@ -575,6 +575,12 @@ func testZtocSerialization(t *testing.T, compressionAlgo string, generator tarGe
 			if readZtoc.MaxSpanID != createdZtoc.MaxSpanID {
 				t.Fatalf("readZtoc.MaxSpanID should be equal to createdZtoc.MaxSpanID")
 			}
+			if readZtoc.SpanSize != compression.Offset(tc.spanSize) {
+				t.Fatalf("serialized ztoc span size does not match: expected %d, got %d", tc.spanSize, readZtoc.SpanSize)
+			}
+			if readZtoc.SpanAligned != createdZtoc.SpanAligned {
+				t.Fatalf("serialized ztoc span alignment does not match: expected %t, got %t", createdZtoc.SpanAligned, readZtoc.SpanAligned)
+			}
 
 			if len(readZtoc.FileMetadata) != len(createdZtoc.FileMetadata) {
 				t.Fatalf("ztoc metadata count mismatch. expected: %d, actual: %d", len(createdZtoc.FileMetadata), len(readZtoc.FileMetadata))
@@ -651,6 +657,102 @@ func testZtocSerialization(t *testing.T, compressionAlgo string, generator tarGe
 
 }
 
+func TestZtocSpanAligned(t *testing.T) {
+	const spanSize = 1 << 16
+	var entries []testutil.TarEntry
+	for i := 0; i < 5; i++ {
+		contents := make([]byte, 100000)
+		for j := range contents {
+			contents[j] = "abcdefgh"[rand.Intn(8)]
+		}
+		entries = append(entries, testutil.File(fmt.Sprintf("file%d", i), string(contents)))
+	}
+	tarBytes, err := io.ReadAll(testutil.BuildTar(entries))
+	if err != nil {
+		t.Fatalf("failed to build tar: %v", err)
+	}
+	aligned := func(t *testing.T) []byte {
+		var buf bytes.Buffer
+		aw, err := compression.NewAlignedGzipWriter(&buf, spanSize, gzip.DefaultCompression)
+		if err != nil {
+			t.Fatalf("failed to create aligned writer: %v", err)
+		}
+		if _, err := aw.Write(tarBytes); err != nil {
+			t.Fatalf("failed to write aligned gzip: %v", err)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatalf("failed to close aligned writer: %v", err)
+		}
+		return buf.Bytes()
+	}
+	unaligned := func(t *testing.T) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(tarBytes); err != nil {
+			t.Fatalf("failed to write gzip: %v", err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatalf("failed to close gzip writer: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	testCases := []struct {
+		name     string
+		compress func(*testing.T) []byte
+		aligned  bool
+	}{
+		{name: "aligned members", compress: aligned, aligned: true},
+		{name: "single member", compress: unaligned, aligned: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			compressed := tc.compress(t)
+			path, _, err := testutil.WriteTarToTempFile("layer.tar.gz", bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("failed to write layer: %v", err)
+			}
+			defer os.Remove(path)
+			createdZtoc, err := NewBuilder("test").BuildZtoc(path, spanSize)
+			if err != nil {
+				t.Fatalf("failed to build ztoc: %v", err)
+			}
+			if createdZtoc.SpanAligned != tc.aligned {
+				t.Fatalf("unexpected span alignment: expected %t, got %t", tc.aligned, createdZtoc.SpanAligned)
+			}
+			if tc.aligned && int64(createdZtoc.MaxSpanID) != int64(len(tarBytes)-1)/spanSize {
+				t.Fatalf("unexpected max span id of aligned ztoc: %d", createdZtoc.MaxSpanID)
+			}
+			r, _, err := Marshal(createdZtoc)
+			if err != nil {
+				t.Fatalf("failed to marshal ztoc: %v", err)
+			}
+			readZtoc, err := Unmarshal(r)
+			if err != nil {
+				t.Fatalf("failed to unmarshal ztoc: %v", err)
+			}
+			if readZtoc.SpanAligned != tc.aligned {
+				t.Fatalf("unexpected span alignment of unmarshaled ztoc: expected %t, got %t", tc.aligned, readZtoc.SpanAligned)
+			}
+			sr := io.NewSectionReader(bytes.NewReader(compressed), 0, int64(len(compressed)))
+			for i := range entries {
+				name := fmt.Sprintf("file%d", i)
+				got, err := readZtoc.ExtractFile(sr, name)
+				if err != nil {
+					t.Fatalf("failed to extract %s: %v", name, err)
+				}
+				entry, err := readZtoc.GetMetadataEntry(name)
+				if err != nil {
+					t.Fatalf("failed to get metadata of %s: %v", name, err)
+				}
+				if want := tarBytes[entry.UncompressedOffset : entry.UncompressedOffset+entry.UncompressedSize]; !bytes.Equal(got, want) {
+					t.Fatalf("unexpected contents of %s", name)
+				}
+			}
+		})
+	}
+}
+
 func TestWriteZtoc(t *testing.T) {
 	testCases := []struct {
 		name                    string
@@ -733,6 +835,57 @@ func TestReadZtocInWrongFormat(t *testing.T) {
 	}
 }
 
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(zt *Ztoc)
+	}{
+		{
+			name:   "missing span digest",
+			modify: func(zt *Ztoc) { zt.SpanDigests = zt.SpanDigests[1:] },
+		},
+		{
+			name:   "invalid span digest",
+			modify: func(zt *Ztoc) { zt.SpanDigests[0] = "sha256:abc" },
+		},
+		{
+			name:   "negative max span id",
+			modify: func(zt *Ztoc) { zt.MaxSpanID = -1 },
+		},
+		{
+			name:   "no checkpoints",
+			modify: func(zt *Ztoc) { zt.Checkpoints = nil },
+		},
+		{
+			name: "file outside of the archive",
+			modify: func(zt *Ztoc) {
+				zt.FileMetadata[0].UncompressedOffset = zt.UncompressedArchiveSize - zt.FileMetadata[0].UncompressedSize + 1
+			},
+		},
+		{
+			name:   "negative file offset",
+			modify: func(zt *Ztoc) { zt.FileMetadata[0].UncompressedOffset = -1 },
+		},
+	}
+
+	entries := []testutil.TarEntry{testutil.File("file", string(testutil.RandomByteData(100000)))}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			zt, _, err := BuildZtocReader(t, entries, gzip.DefaultCompression, 16384)
+			if err != nil {
+				t.Fatalf("failed to build ztoc: %v", err)
+			}
+			if err := zt.Validate(); err != nil {
+				t.Fatalf("valid ztoc failed validation: %v", err)
+			}
+			tc.modify(zt)
+			if err := zt.Validate(); err == nil {
+				t.Fatalf("expected error, but got nil")
+			}
+		})
+	}
+}
+
 func getPositionOfFirstDiffInByteSlice(a, b []byte) int {
 	sz := len(a)
 	if len(b) < len(a) {